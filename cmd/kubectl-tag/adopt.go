@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/services"
+)
+
+func init() {
+	tagadopt.Flags().Bool(
+		"cache", false, "Mirror the images of the tags created",
+	)
+	tagadopt.Flags().Bool(
+		"import", false, "Wait for the first import of the tags before annotating the deployment",
+	)
+	tagadopt.Flags().Duration(
+		"timeout", 5*time.Minute, "Timeout for the adoption, first import included",
+	)
+}
+
+var tagadopt = &cobra.Command{
+	Use:   "adopt deployment/<name>",
+	Short: "Creates tags for the images of a deployment and makes it use them",
+	RunE: func(c *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("provide a deployment")
+		}
+		kind, name := "deployment", args[0]
+		if idx := strings.Index(args[0], "/"); idx >= 0 {
+			kind, name = args[0][:idx], args[0][idx+1:]
+		}
+		switch kind {
+		case "deployment", "deployments", "deploy":
+		default:
+			return fmt.Errorf("only deployments can be adopted")
+		}
+
+		cache, err := c.Flags().GetBool("cache")
+		if err != nil {
+			return err
+		}
+		wait, err := c.Flags().GetBool("import")
+		if err != nil {
+			return err
+		}
+		timeout, err := c.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+
+		format, err := outputFormat(c)
+		if err != nil {
+			return err
+		}
+
+		tagcli, err := imagesCli()
+		if err != nil {
+			return err
+		}
+		corcli, err := coreCli()
+		if err != nil {
+			return err
+		}
+
+		ns, err := namespace(c)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		svc := services.NewAdoption(corcli, tagcli)
+		adopted, err := svc.Adopt(ctx, ns, name, cache, wait)
+		if err != nil {
+			return err
+		}
+
+		var tags []*imagtagv1.Tag
+		for _, img := range adopted {
+			tags = append(tags, img.Tag)
+		}
+		if format != "" {
+			return writeTags(os.Stdout, format, true, tags...)
+		}
+
+		for _, img := range adopted {
+			action := "using"
+			if img.Created {
+				action = "created"
+			}
+			msg := fmt.Sprintf("container %s: %s tag %s", img.Container, action, img.Tag.Name)
+			if ref := img.Tag.CurrentReferenceForTag(); ref != "" {
+				msg = fmt.Sprintf("%s (%s)", msg, ref)
+			}
+			log.Print(msg)
+		}
+		log.Printf("deployment %s adopted", name)
+		return nil
+	},
+}
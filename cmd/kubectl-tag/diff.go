@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spf13/cobra"
+
+	itagcli "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/services"
+)
+
+var tagdiff = &cobra.Command{
+	Use:   "diff <image tag> <[context/]namespace> <[context/]namespace>...",
+	Short: "Compares the image a tag points to among environments",
+	Long: "Compares the image a tag points to among environments. Environments " +
+		"are namespaces, optionally prefixed by the kube config context of the " +
+		"cluster they live in. Environments not pointing to the most recently " +
+		"imported image are reported as lagging.",
+	RunE: func(c *cobra.Command, args []string) error {
+		if len(args) < 3 {
+			return fmt.Errorf("provide an image tag and at least two environments")
+		}
+
+		format, err := outputFormat(c)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		var envs []imagtagv1.TagEnvironment
+		for _, env := range args[1:] {
+			cluster, ns := "", env
+			if idx := strings.Index(env, "/"); idx >= 0 {
+				cluster, ns = env[:idx], env[idx+1:]
+			}
+
+			cli, err := contextImagesCli(cluster)
+			if err != nil {
+				return err
+			}
+
+			it, err := cli.ImagesV1().Tags(ns).Get(ctx, args[0], metav1.GetOptions{})
+			if err != nil {
+				if !errors.IsNotFound(err) {
+					return fmt.Errorf("error reading tag in %s: %w", env, err)
+				}
+				it = nil
+			}
+			envs = append(envs, services.NewTagEnvironment(cluster, ns, it))
+		}
+
+		return writeDiff(os.Stdout, format, services.DiffProvenance(args[0], envs))
+	},
+}
+
+// contextImagesCli returns a client to access image tags in the cluster of
+// the provided kube config context. An empty context means the current one.
+func contextImagesCli(kubectx string) (*itagcli.Clientset, error) {
+	if kubectx == "" {
+		return imagesCli()
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubectx}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		rules, overrides,
+	).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error building config for %s: %s", kubectx, err)
+	}
+	return itagcli.NewForConfig(config)
+}
+
+// writeDiff writes a provenance diff to out in the provided format. Diffs are
+// written as a table for any format other than json and yaml.
+func writeDiff(out io.Writer, format string, diff *imagtagv1.ProvenanceDiff) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return enc.Encode(diff)
+	case outputYAML:
+		data, err := yaml.Marshal(diff)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTEXT\tNAMESPACE\tGENERATION\tDIGEST\tIMPORTED AT\tLAGGING")
+	for _, env := range diff.Environments {
+		kubectx, gen, at := env.Cluster, "<none>", "<none>"
+		if kubectx == "" {
+			kubectx = "<current>"
+		}
+		if env.Found {
+			gen = fmt.Sprintf("%d", env.Generation)
+		}
+		if env.ImportedAt != nil {
+			at = env.ImportedAt.UTC().Format("2006-01-02T15:04:05Z")
+		}
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\t%t\n",
+			kubectx, env.Namespace, gen, orNone(env.Digest), at, env.Lagging,
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/spf13/cobra"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func init() {
+	tagget.Flags().BoolP(
+		"watch", "w", false, "After listing, watch for changes",
+	)
+}
+
+var tagget = &cobra.Command{
+	Use:   "get [image tag]",
+	Short: "Lists tags or shows a tag, optionally watching for changes",
+	RunE: func(c *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("provide at most one image tag")
+		}
+
+		format, err := outputFormat(c)
+		if err != nil {
+			return err
+		}
+
+		cli, err := imagesCli()
+		if err != nil {
+			return err
+		}
+
+		ns, err := namespace(c)
+		if err != nil {
+			return err
+		}
+
+		opts := metav1.ListOptions{}
+		if len(args) == 1 {
+			opts.FieldSelector = fields.OneTermEqualSelector(
+				"metadata.name", args[0],
+			).String()
+		}
+
+		ctx := context.Background()
+		list, err := cli.ImagesV1().Tags(ns).List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 && len(list.Items) == 0 {
+			return fmt.Errorf("tag %s not found", args[0])
+		}
+
+		tags := make([]*imagtagv1.Tag, 0, len(list.Items))
+		for i := range list.Items {
+			tags = append(tags, &list.Items[i])
+		}
+		sort.Slice(tags, func(i, j int) bool {
+			return tags[i].Name < tags[j].Name
+		})
+
+		watchflag, err := c.Flags().GetBool("watch")
+		if err != nil {
+			return err
+		}
+		if !watchflag {
+			return writeTags(os.Stdout, format, len(args) == 0, tags...)
+		}
+
+		opts.ResourceVersion = list.ResourceVersion
+		watcher, err := cli.ImagesV1().Tags(ns).Watch(ctx, opts)
+		if err != nil {
+			return err
+		}
+		defer watcher.Stop()
+		return watchTags(format, tags, watcher)
+	},
+}
+
+// watchTags prints tags and then every change received through watcher. For
+// json and yaml every new version of a Tag is printed, otherwise a table is
+// printed with a column describing what has changed.
+func watchTags(format string, tags []*imagtagv1.Tag, watcher watch.Interface) error {
+	seen := map[string]*imagtagv1.Tag{}
+	for _, it := range tags {
+		seen[it.Namespace+"/"+it.Name] = it
+	}
+
+	structured := format == outputJSON || format == outputYAML
+	emit := func(it *imagtagv1.Tag, change string) error {
+		if structured {
+			return writeTags(os.Stdout, format, false, it)
+		}
+		return writeWatchRow(os.Stdout, format == outputWide, it, change)
+	}
+
+	if !structured {
+		headers := append(tableHeaders(format == outputWide), "CHANGE")
+		fmt.Fprintln(os.Stdout, strings.Join(headers, "\t"))
+	}
+	for _, it := range tags {
+		if err := emit(it, "Listed"); err != nil {
+			return err
+		}
+	}
+
+	for event := range watcher.ResultChan() {
+		if event.Type == watch.Error {
+			return fmt.Errorf("watch error: %v", event.Object)
+		}
+
+		it, ok := event.Object.(*imagtagv1.Tag)
+		if !ok {
+			continue
+		}
+
+		idx := it.Namespace + "/" + it.Name
+		var changes []string
+		switch event.Type {
+		case watch.Added:
+			changes = []string{"Added"}
+			seen[idx] = it
+		case watch.Deleted:
+			changes = []string{"Deleted"}
+			delete(seen, idx)
+		default:
+			changes = tagChanges(seen[idx], it)
+			seen[idx] = it
+		}
+
+		// updates we don't care about (e.g. progress updates) are
+		// not printed in table format.
+		if len(changes) == 0 && !structured {
+			continue
+		}
+		if err := emit(it, strings.Join(changes, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tagChanges describes what changed between two versions of a Tag: new
+// generations requested, generations becoming current (what triggers the
+// rollout of Deployments using the Tag) and condition flips.
+func tagChanges(old, cur *imagtagv1.Tag) []string {
+	if old == nil {
+		return []string{"Updated"}
+	}
+
+	var changes []string
+	if old.Spec.Generation != cur.Spec.Generation {
+		changes = append(
+			changes, fmt.Sprintf("GenerationRequested(%d)", cur.Spec.Generation),
+		)
+	}
+	if old.CurrentReferenceForTag() != cur.CurrentReferenceForTag() {
+		changes = append(
+			changes, fmt.Sprintf("RolloutTriggered(%d)", cur.Status.Generation),
+		)
+	}
+
+	oldconds := map[string]metav1.ConditionStatus{}
+	for _, cond := range old.Status.Conditions {
+		oldconds[cond.Type] = cond.Status
+	}
+	for _, cond := range cur.Status.Conditions {
+		if oldconds[cond.Type] == cond.Status {
+			continue
+		}
+		changes = append(
+			changes, fmt.Sprintf("%s=%s(%s)", cond.Type, cond.Status, cond.Reason),
+		)
+	}
+	return changes
+}
+
+// writeWatchRow writes a table row for a Tag followed by the change column.
+// As rows are printed as events arrive we can't align them with the rows to
+// come, columns are separated by tabs.
+func writeWatchRow(out io.Writer, wide bool, it *imagtagv1.Tag, change string) error {
+	row := append(tableRow(it, wide), change)
+	_, err := fmt.Fprintln(out, strings.Join(row, "\t"))
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spf13/cobra"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/services"
+)
+
+func init() {
+	taghistory.Flags().String(
+		"verify-key", "", "ed25519 public key (PEM) to verify the generation signatures with",
+	)
+}
+
+var taghistory = &cobra.Command{
+	Use:   "history <image tag>",
+	Short: "Shows the generations kept by a tag",
+	RunE: func(c *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("provide an image tag")
+		}
+
+		format, err := outputFormat(c)
+		if err != nil {
+			return err
+		}
+
+		keypath, err := c.Flags().GetString("verify-key")
+		if err != nil {
+			return err
+		}
+
+		cli, err := imagesCli()
+		if err != nil {
+			return err
+		}
+
+		ns, err := namespace(c)
+		if err != nil {
+			return err
+		}
+
+		it, err := cli.ImagesV1().Tags(ns).Get(
+			context.Background(), args[0], metav1.GetOptions{},
+		)
+		if err != nil {
+			return err
+		}
+		if keypath == "" {
+			return writeHistory(os.Stdout, format, it.GenerationHistory(), nil)
+		}
+
+		pub, err := services.LoadVerifyingKey(keypath)
+		if err != nil {
+			return err
+		}
+		signatures := map[int64]string{}
+		failed := 0
+		for _, hashref := range it.Status.References {
+			signatures[hashref.Generation] = "valid"
+			if err := services.VerifyGeneration(pub, it.Namespace, it.Name, hashref); err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				signatures[hashref.Generation] = "invalid"
+				if hashref.Signature == "" {
+					signatures[hashref.Generation] = "unsigned"
+				}
+				failed++
+			}
+		}
+		if err := writeHistory(os.Stdout, format, it.GenerationHistory(), signatures); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d generation(s) failed verification", failed)
+		}
+		return nil
+	},
+}
+
+// writeHistory writes the generation history of a Tag to out in the provided
+// format. History is written as a table for any format other than json and
+// yaml, wide tables include the full image reference. If signatures, mapping
+// generations into the outcome of their verification, is set tables include
+// it as well.
+func writeHistory(
+	out io.Writer,
+	format string,
+	history *imagtagv1.GenerationHistory,
+	signatures map[int64]string,
+) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return enc.Encode(history)
+	case outputYAML:
+		data, err := yaml.Marshal(history)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+
+	wide := format == outputWide
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	header := "GENERATION\tCURRENT\tDIGEST\tIMPORTED AT\tTRIGGER\tROLLOUT"
+	if signatures != nil {
+		header += "\tSIGNATURE"
+	}
+	if wide {
+		header += "\tREFERENCE"
+	}
+	fmt.Fprintln(tw, header)
+	for _, gen := range history.Generations {
+		current := ""
+		if gen.Current {
+			current = "*"
+		}
+		row := fmt.Sprintf(
+			"%d\t%s\t%s\t%s\t%s\t%s",
+			gen.Generation,
+			current,
+			orNone(gen.Digest),
+			gen.ImportedAt.UTC().Format("2006-01-02T15:04:05Z"),
+			orNone(gen.Trigger),
+			orNone(gen.Rollout),
+		)
+		if signatures != nil {
+			row += "\t" + orNone(signatures[gen.Generation])
+		}
+		if wide {
+			row += "\t" + orNone(gen.ImageReference)
+		}
+		fmt.Fprintln(tw, row)
+	}
+	return tw.Flush()
+}
+
+// orNone returns value or "<none>" if value is empty.
+func orNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 
 	"github.com/ricardomaraschini/tagger/services"
 	"github.com/spf13/cobra"
@@ -27,13 +26,14 @@ var tagimport = &cobra.Command{
 			return err
 		}
 
-		svc := services.NewTag(nil, cli, nil, nil, nil, nil, nil)
+		svc := services.NewTag(nil, cli, nil, nil, nil, nil, nil, nil, nil, nil)
 		it, err := svc.NewGeneration(context.Background(), ns, args[0])
 		if err != nil {
 			return err
 		}
 
-		log.Printf("tag %s imported (gen %d)", args[0], it.Spec.Generation)
-		return nil
+		return printTag(
+			c, it, fmt.Sprintf("tag %s imported (gen %d)", args[0], it.Spec.Generation),
+		)
 	},
 }
@@ -4,22 +4,39 @@ import (
 	"fmt"
 	"os"
 
+	corecli "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
 	"github.com/spf13/cobra"
 
 	itagcli "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	"github.com/ricardomaraschini/tagger/version"
 )
 
 func main() {
-	root := &cobra.Command{Use: "kubectl-tag"}
+	root := &cobra.Command{
+		Use:     "kubectl-tag",
+		Version: version.Get().String(),
+	}
 	root.PersistentFlags().StringP(
 		"namespace", "n", "", "Namespace to use",
 	)
+	root.PersistentFlags().StringP(
+		"output", "o", "", "Output format, one of json, yaml or wide",
+	)
 
 	root.AddCommand(tagupgrade)
 	root.AddCommand(tagdowngrade)
+	root.AddCommand(tagrollback)
 	root.AddCommand(tagimport)
+	root.AddCommand(tagget)
+	root.AddCommand(tagdiff)
+	root.AddCommand(taghistory)
+	root.AddCommand(tagadopt)
+	root.AddCommand(tagrender)
+	root.AddCommand(tagresolve)
+	root.AddCommand(tagsimulate)
+	root.AddCommand(tagwebhook)
 	if err := root.Execute(); err != nil {
 		os.Exit(1)
 	}
@@ -35,6 +52,17 @@ func imagesCli() (*itagcli.Clientset, error) {
 	return itagcli.NewForConfig(config)
 }
 
+// coreCli returns a client to access core objects, e.g. Deployments, through
+// kubernetes api.
+func coreCli() (*corecli.Clientset, error) {
+	cfgpath := os.Getenv("KUBECONFIG")
+	config, err := clientcmd.BuildConfigFromFlags("", cfgpath)
+	if err != nil {
+		return nil, fmt.Errorf("error building config: %s", err)
+	}
+	return corecli.NewForConfig(config)
+}
+
 // namespace returns the namespace provided through the --namespace/-n command
 // line flag or the default one as extracted from kube configuration.
 func namespace(c *cobra.Command) (string, error) {
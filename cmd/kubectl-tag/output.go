@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// output formats supported through the --output/-o flag. The default (empty)
+// format prints a human friendly message.
+const (
+	outputJSON = "json"
+	outputYAML = "yaml"
+	outputWide = "wide"
+)
+
+// outputFormat returns the format provided through the --output/-o flag.
+func outputFormat(c *cobra.Command) (string, error) {
+	oflag := c.Flag("output")
+	if oflag == nil {
+		return "", nil
+	}
+
+	format := oflag.Value.String()
+	switch format {
+	case "", outputJSON, outputYAML, outputWide:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// printTag prints a Tag in the format requested by the user. When no format
+// was requested msg is logged instead.
+func printTag(c *cobra.Command, it *imagtagv1.Tag, msg string) error {
+	format, err := outputFormat(c)
+	if err != nil {
+		return err
+	}
+
+	if format == "" {
+		log.Print(msg)
+		return nil
+	}
+	return writeTags(os.Stdout, format, false, it)
+}
+
+// writeTags writes tags to out in the provided format. For json and yaml a
+// single Tag is written as is while multiple tags, or if list is true, are
+// written as a TagList. Tags are written as a table for any other format.
+func writeTags(out io.Writer, format string, list bool, tags ...*imagtagv1.Tag) error {
+	var obj interface{}
+	if len(tags) == 1 && !list {
+		obj = withTypeMeta(tags[0])
+	} else {
+		tlist := &imagtagv1.TagList{}
+		tlist.APIVersion = imagtagv1.SchemeGroupVersion.String()
+		tlist.Kind = "TagList"
+		for _, it := range tags {
+			tlist.Items = append(tlist.Items, *withTypeMeta(it))
+		}
+		obj = tlist
+	}
+
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return enc.Encode(obj)
+	case outputYAML:
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	default:
+		return writeTable(out, format == outputWide, tags...)
+	}
+}
+
+// tableHeaders returns the table headers. Wide tables include the upstream
+// image and the image reference for the current generation.
+func tableHeaders(wide bool) []string {
+	headers := []string{"NAMESPACE", "NAME", "GENERATION", "IMPORTED"}
+	if wide {
+		headers = append(headers, "CACHE", "FROM", "REFERENCE")
+	}
+	return headers
+}
+
+// tableRow returns the table columns for a Tag, see tableHeaders.
+func tableRow(it *imagtagv1.Tag, wide bool) []string {
+	imported := "False"
+	if it.SpecTagImported() {
+		imported = "True"
+	}
+
+	row := []string{
+		it.Namespace,
+		it.Name,
+		fmt.Sprintf("%d", it.Spec.Generation),
+		imported,
+	}
+	if !wide {
+		return row
+	}
+
+	ref := "<none>"
+	if cur := it.CurrentReferenceForTag(); cur != "" {
+		ref = cur
+	}
+	return append(row, fmt.Sprintf("%t", it.Spec.Cache), it.Spec.From, ref)
+}
+
+// writeTable writes tags as a table.
+func writeTable(out io.Writer, wide bool, tags ...*imagtagv1.Tag) error {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(tableHeaders(wide), "\t"))
+	for _, it := range tags {
+		fmt.Fprintln(tw, strings.Join(tableRow(it, wide), "\t"))
+	}
+	return tw.Flush()
+}
+
+// withTypeMeta returns a copy of the Tag with api version and kind set, the
+// client does not populate them.
+func withTypeMeta(it *imagtagv1.Tag) *imagtagv1.Tag {
+	it = it.DeepCopy()
+	it.APIVersion = imagtagv1.SchemeGroupVersion.String()
+	it.Kind = "Tag"
+	return it
+}
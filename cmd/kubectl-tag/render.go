@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ricardomaraschini/tagger/services"
+)
+
+func init() {
+	tagrender.Flags().StringSliceP(
+		"filename", "f", nil, "Manifests to render, - reads from the standard input",
+	)
+}
+
+var tagrender = &cobra.Command{
+	Use:   "render -f <manifest>...",
+	Short: "Pins the tags referred by manifests to their current image references",
+	RunE: func(c *cobra.Command, args []string) error {
+		files, err := c.Flags().GetStringSlice("filename")
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("provide at least one manifest")
+		}
+
+		cli, err := imagesCli()
+		if err != nil {
+			return err
+		}
+
+		ns, err := namespace(c)
+		if err != nil {
+			return err
+		}
+
+		svc := services.NewRenderer(cli)
+		for _, file := range files {
+			if err := renderFile(svc, file, ns); err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+		}
+		return nil
+	},
+}
+
+// renderFile writes the manifests in file, rendered, to the standard output.
+func renderFile(svc *services.Renderer, file, namespace string) error {
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	data, err := svc.Render(context.Background(), in, namespace)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
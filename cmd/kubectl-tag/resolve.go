@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spf13/cobra"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/services"
+)
+
+func init() {
+	tagresolve.Flags().String(
+		"at", "", "Point in time, in RFC3339 format, to resolve the tag at",
+	)
+}
+
+var tagresolve = &cobra.Command{
+	Use:   "resolve <image tag> --at <time>",
+	Short: "Shows the image a tag pointed to at a given time",
+	Long: "Shows the image a tag pointed to at a given time. The tag timeline " +
+		"is used when it goes back far enough, otherwise the latest import " +
+		"before the time is reported. The SOURCE column tells which one was " +
+		"used.",
+	RunE: func(c *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("provide an image tag")
+		}
+
+		format, err := outputFormat(c)
+		if err != nil {
+			return err
+		}
+
+		atflag, err := c.Flags().GetString("at")
+		if err != nil {
+			return err
+		}
+		at, err := time.Parse(time.RFC3339, atflag)
+		if err != nil {
+			return fmt.Errorf("invalid time %q, use RFC3339", atflag)
+		}
+
+		cli, err := imagesCli()
+		if err != nil {
+			return err
+		}
+
+		ns, err := namespace(c)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		it, err := cli.ImagesV1().Tags(ns).Get(ctx, args[0], metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		audits, err := services.ListImportAudits(ctx, cli, it)
+		if err != nil {
+			return err
+		}
+
+		res, err := services.ResolutionAt(it, audits, at)
+		if err != nil {
+			return err
+		}
+		return writeResolution(os.Stdout, format, res)
+	},
+}
+
+// writeResolution writes a Tag resolution to out in the provided format. It
+// is written as a table for any format other than json and yaml.
+func writeResolution(out io.Writer, format string, res *imagtagv1.Resolution) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return enc.Encode(res)
+	case outputYAML:
+		data, err := yaml.Marshal(res)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GENERATION\tDIGEST\tSINCE\tSOURCE\tREFERENCE")
+	fmt.Fprintf(
+		tw, "%d\t%s\t%s\t%s\t%s\n",
+		res.Generation,
+		orNone(res.Digest),
+		res.Since.UTC().Format("2006-01-02T15:04:05Z"),
+		res.Source,
+		orNone(res.ImageReference),
+	)
+	return tw.Flush()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ricardomaraschini/tagger/services"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	tagrollback.Flags().Bool(
+		"to-known-good", false, "Move the tag back to its last known good generation",
+	)
+}
+
+var tagrollback = &cobra.Command{
+	Use:   "rollback <image tag> --to-known-good",
+	Short: "Move a tag back to its last known good generation",
+	RunE: func(c *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("provide an image tag")
+		}
+
+		known, err := c.Flags().GetBool("to-known-good")
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf("--to-known-good is required, use downgrade to move one generation back")
+		}
+
+		cli, err := imagesCli()
+		if err != nil {
+			return err
+		}
+
+		ns, err := namespace(c)
+		if err != nil {
+			return err
+		}
+
+		svc := services.NewTag(nil, cli, nil, nil, nil, nil, nil, nil, nil, nil)
+		it, err := svc.RollbackToKnownGood(context.Background(), ns, args[0])
+		if err != nil {
+			return err
+		}
+
+		return printTag(
+			c, it, fmt.Sprintf("tag %s rolled back (gen %d)", args[0], it.Spec.Generation),
+		)
+	},
+}
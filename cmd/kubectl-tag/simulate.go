@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/spf13/cobra"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/pkg/client"
+)
+
+func init() {
+	tagsimulate.Flags().String(
+		"api", "", "Tag API address, e.g. https://tagger.tagger:8083, defaults to $TAGGER_API",
+	)
+	tagsimulate.Flags().String(
+		"ca", "", "File holding the certificate authority of the Tag API",
+	)
+}
+
+var tagsimulate = &cobra.Command{
+	Use:   "simulate <image> --api <address>",
+	Short: "Shows whether importing an image would be accepted",
+	Long: "Shows whether importing an image into the namespace would be " +
+		"accepted, without importing it. The checks are run by the Tag API " +
+		"with the namespace credentials, the caller must be allowed to " +
+		"create tags in the namespace. Exits with an error if the import " +
+		"would be rejected.",
+	RunE: func(c *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("provide an image")
+		}
+
+		format, err := outputFormat(c)
+		if err != nil {
+			return err
+		}
+
+		address, err := c.Flags().GetString("api")
+		if err != nil {
+			return err
+		}
+		if address == "" {
+			address = os.Getenv("TAGGER_API")
+		}
+		if address == "" {
+			return fmt.Errorf("provide the tag api address through --api or TAGGER_API")
+		}
+
+		ca, err := c.Flags().GetString("ca")
+		if err != nil {
+			return err
+		}
+		cli, err := apiCli(address, ca)
+		if err != nil {
+			return err
+		}
+
+		ns, err := namespace(c)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		sim, err := cli.Simulate(ctx, ns, args[0])
+		if err != nil {
+			return err
+		}
+		if err := writeSimulation(os.Stdout, format, sim); err != nil {
+			return err
+		}
+		if !sim.Accepted {
+			return fmt.Errorf("import of %s would be rejected", sim.Image)
+		}
+		return nil
+	},
+}
+
+// apiCli returns a client to access the Tag API at address, authenticating
+// with the credentials from kube configuration. The Tag API certificate is
+// verified against the certificate authority in ca, or the system ones if
+// empty.
+func apiCli(address, ca string) (*client.Client, error) {
+	cfgpath := os.Getenv("KUBECONFIG")
+	config, err := clientcmd.BuildConfigFromFlags("", cfgpath)
+	if err != nil {
+		return nil, fmt.Errorf("error building config: %s", err)
+	}
+
+	opts := []client.Option{client.WithKubeConfig(config)}
+	if ca != "" {
+		opts = append(opts, client.WithCAFile(ca))
+	}
+	return client.New(address, opts...)
+}
+
+// writeSimulation writes an import simulation to out in the provided format.
+// It is written as a table for any format other than json and yaml.
+func writeSimulation(out io.Writer, format string, sim *imagtagv1.ImportSimulation) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "    ")
+		return enc.Encode(sim)
+	case outputYAML:
+		data, err := yaml.Marshal(sim)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tMESSAGE")
+	for _, check := range sim.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", check.Name, check.Result, orNone(check.Message))
+	}
+	return tw.Flush()
+}
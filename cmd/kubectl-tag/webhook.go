@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/spf13/cobra"
+
+	"github.com/ricardomaraschini/tagger/controllers"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/services"
+)
+
+// webhook providers we are able to simulate pushes for.
+const (
+	providerDocker = "docker"
+	providerQuay   = "quay"
+)
+
+func init() {
+	tagwebhooksimulate.Flags().String(
+		"provider", providerDocker, "Webhook provider, one of docker or quay",
+	)
+	tagwebhooksimulate.Flags().String(
+		"image", "", "Pushed image, e.g. docker.io/org/app:v1",
+	)
+	tagwebhooksimulate.Flags().String(
+		"url", "", "Webhook address, e.g. http://localhost:8082, if not set the "+
+			"webhook runs in-process without changing any tag",
+	)
+	tagwebhook.AddCommand(tagwebhooksimulate)
+}
+
+var tagwebhook = &cobra.Command{
+	Use:   "webhook",
+	Short: "Tests registry webhooks",
+}
+
+var tagwebhooksimulate = &cobra.Command{
+	Use:   "simulate --provider <docker|quay> --image <image> [--url <address>]",
+	Short: "Simulates the push of an image to a registry",
+	Long: "Sends the payload the provider sends when the image is pushed. " +
+		"With --url the payload is delivered to the running webhook, new " +
+		"generations are created for the tags tracking the image. Otherwise " +
+		"the webhook runs in-process against the tags in the cluster and " +
+		"reports what the push would do to each of them, without changing " +
+		"them. Exits with an error if the webhook rejects the payload or " +
+		"no tag tracks the image.",
+	RunE: func(c *cobra.Command, args []string) error {
+		provider, err := c.Flags().GetString("provider")
+		if err != nil {
+			return err
+		}
+		image, err := c.Flags().GetString("image")
+		if err != nil {
+			return err
+		}
+		if image == "" {
+			return fmt.Errorf("provide the pushed image through --image")
+		}
+		address, err := c.Flags().GetString("url")
+		if err != nil {
+			return err
+		}
+
+		body, err := pushPayload(provider, image)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if address != "" {
+			return deliverPush(ctx, address, body)
+		}
+
+		cli, err := imagesCli()
+		if err != nil {
+			return err
+		}
+		tags, err := cli.ImagesV1().Tags("").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		return simulatePush(os.Stdout, provider, body, tags.Items)
+	},
+}
+
+// pushPayload returns the json payload sent by provider when image is pushed.
+// Images are normalized, e.g. org/app is docker.io/org/app:latest.
+func pushPayload(provider, image string) ([]byte, error) {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+	tagged, ok := named.(reference.NamedTagged)
+	if !ok {
+		return nil, fmt.Errorf("webhooks notify tag pushes, provide a tagged image")
+	}
+	domain, path := reference.Domain(named), reference.Path(named)
+
+	var payload interface{}
+	switch provider {
+	case providerDocker:
+		parts := strings.Split(path, "/")
+		if domain != "docker.io" || len(parts) != 2 {
+			return nil, fmt.Errorf("docker hub images look like docker.io/org/app:tag")
+		}
+		payload = controllers.NewDockerRequestPayload(parts[0], parts[1], tagged.Tag())
+	case providerQuay:
+		if !strings.Contains(path, "/") {
+			return nil, fmt.Errorf("quay images look like quay.io/org/app:tag")
+		}
+		payload = controllers.NewQuayRequestPayload(domain, path, tagged.Tag())
+	default:
+		return nil, fmt.Errorf("unknown provider %q, use docker or quay", provider)
+	}
+	return json.Marshal(payload)
+}
+
+// deliverPush posts the push payload to the webhook at address.
+func deliverPush(ctx context.Context, address string, body []byte) error {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, address, bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	answer, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	log.Printf("webhook answered %s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	return webhookStatusError(resp.StatusCode)
+}
+
+// simulatePush runs the provider webhook in-process, reporting to out what
+// the push would do to each of the tags tracking the pushed image.
+func simulatePush(out io.Writer, provider string, body []byte, tags []imagtagv1.Tag) error {
+	updater := &pushSimulator{tags: tags}
+	var hook http.Handler = controllers.NewDockerWebHook(updater)
+	if provider == providerQuay {
+		hook = controllers.NewQuayWebHook(updater)
+	}
+
+	w := httptest.NewRecorder()
+	hook.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tNAME\tFROM\tOUTCOME")
+	for _, row := range updater.rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", row[0], row[1], row[2], row[3])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return webhookStatusError(w.Code)
+}
+
+// webhookStatusError returns an error unless the webhook accepted the push.
+func webhookStatusError(code int) error {
+	switch {
+	case code == http.StatusNotFound:
+		return fmt.Errorf("no tag tracks the pushed image")
+	case code >= 300:
+		return fmt.Errorf("webhook answered with %d %s", code, http.StatusText(code))
+	}
+	return nil
+}
+
+// pushSimulator is handed over to webhooks run in-process. Instead of
+// creating new generations it records what a push would do to the tags
+// tracking the pushed image.
+type pushSimulator struct {
+	tags []imagtagv1.Tag
+	rows [][4]string
+}
+
+// NewGenerationForImageRef records the outcome of the push for each tag
+// tracking imgpath. Returns NotFound if no tag tracks it, as the Tag service
+// does.
+func (p *pushSimulator) NewGenerationForImageRef(ctx context.Context, imgpath string) error {
+	tracked := false
+	for i := range p.tags {
+		it := &p.tags[i]
+		outcome := services.PushOutcome(it, imgpath)
+		if outcome == services.PushUntracked {
+			continue
+		}
+		tracked = true
+		p.rows = append(p.rows, [4]string{it.Namespace, it.Name, it.Spec.From, outcome})
+	}
+	if !tracked {
+		return errors.NewNotFound(imagtagv1.Resource("tags"), imgpath)
+	}
+	return nil
+}
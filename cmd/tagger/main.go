@@ -3,13 +3,17 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	coreinf "k8s.io/client-go/informers"
 	corecli "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -17,9 +21,12 @@ import (
 	"k8s.io/klog/v2"
 
 	"github.com/ricardomaraschini/tagger/controllers"
+	"github.com/ricardomaraschini/tagger/features"
 	itagcli "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
 	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	"github.com/ricardomaraschini/tagger/metrics"
 	"github.com/ricardomaraschini/tagger/services"
+	"github.com/ricardomaraschini/tagger/version"
 )
 
 // Controller interface is implemented by all our controllers. Designs a
@@ -29,24 +36,68 @@ type Controller interface {
 	Name() string
 }
 
+// These are the modes in which tagger can run. Webhooks and controllers can
+// be run as distinct Deployments so the admission path can be scaled apart
+// from the import workers.
+const (
+	modeAll         = "all"
+	modeWebhooks    = "webhooks"
+	modeControllers = "controllers"
+)
+
 func main() {
 	klog.InitFlags(nil)
+	flag.Var(features.Default, "feature-gates", features.Default.Usage())
+	mode := flag.String(
+		"mode", modeAll, "Run mode, one of: all, webhooks or controllers",
+	)
+	shards := flag.Int(
+		"shards", 1, "Number of controller replicas sharing namespaces",
+	)
+	shardIndex := flag.Int(
+		"shard-index", -1, "Shard owned by this replica, inferred from hostname if negative",
+	)
+	leaderElect := flag.Bool(
+		"leader-elect", false, "Run controllers only while holding the shard lease, standing by otherwise",
+	)
+	showVersion := flag.Bool("version", false, "Print version information and exit")
+	compVerbosity := componentVerbosityFlags()
 	flag.Parse()
 
+	if err := compVerbosity.apply(); err != nil {
+		klog.Fatalf("invalid log verbosity: %v", err)
+	}
+
+	if *showVersion {
+		fmt.Println(version.Get())
+		return
+	}
+
+	if flag.Arg(0) == "selftest" {
+		os.Exit(selftest())
+	}
+
+	if *mode != modeAll && *mode != modeWebhooks && *mode != modeControllers {
+		klog.Fatalf("invalid mode %q", *mode)
+	}
+
+	if *shardIndex < 0 {
+		*shardIndex = shardIndexFromHostname(*shards)
+	}
+	shard, err := services.NewShard(*shardIndex, *shards)
+	if err != nil {
+		klog.Fatalf("invalid shard configuration: %v", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
-	go func() {
-		<-sigs
-		cancel()
-	}()
 
 	klog.Info(` _|_  __,   __,  __,  _   ,_    `)
 	klog.Info(`  |  /  |  /  | /  | |/  /  |   `)
 	klog.Info(`  |_/\_/|_/\_/|/\_/|/|__/   |_/ `)
 	klog.Info(`             /|   /|            `)
 	klog.Info(`             \|   \|            `)
-	klog.Info(`starting image tag controller...`)
+	klog.Infof("version %s", version.Get())
+	klog.Infof("starting image tag controller in %q mode...", *mode)
 
 	kubeconfig := os.Getenv("KUBECONFIG")
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
@@ -61,6 +112,7 @@ func main() {
 	}
 	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
 	taglis := taginf.Images().V1().Tags().Lister()
+	tslis := taginf.Images().V1().TagSets().Lister()
 
 	// creates core client, informer and lister.
 	corcli, err := corecli.NewForConfig(config)
@@ -68,42 +120,158 @@ func main() {
 		log.Fatalf("unable to create core client: %v", err)
 	}
 	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	if features.Enabled(features.InformerTransforms) {
+		controllers.StripInformers(corinf)
+	}
 	cnflis := corinf.Core().V1().ConfigMaps().Lister()
 	seclis := corinf.Core().V1().Secrets().Lister()
 	replis := corinf.Apps().V1().ReplicaSets().Lister()
 	deplis := corinf.Apps().V1().Deployments().Lister()
+	nslis := corinf.Core().V1().Namespaces().Lister()
 
-	depsvc := services.NewDeployment(corcli, deplis, taglis)
-	tagsvc := services.NewTag(corcli, tagcli, taglis, replis, deplis, cnflis, seclis)
-	itctrl := controllers.NewTag(taginf, tagsvc, 10)
-	mtctrl := controllers.NewMutatingWebHook(tagsvc)
-	qyctrl := controllers.NewQuayWebHook(tagsvc)
-	dkctrl := controllers.NewDockerWebHook(tagsvc)
-	dpctrl := controllers.NewDeployment(corinf, depsvc)
+	// only the default service account of each namespace is watched, its
+	// image pull secrets may be the credentials imports are made with.
+	sainf := coreinf.NewSharedInformerFactoryWithOptions(
+		corcli,
+		time.Minute,
+		coreinf.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = "metadata.name=" + services.DefaultServiceAccount
+		}),
+	)
+	salis := sainf.Core().V1().ServiceAccounts().Lister()
 
-	// starts up all informers and waits for their cache to sync
-	// up, only then we start the operators i.e. start to process
-	// events from the queue.
-	klog.Info("waiting for caches to sync ...")
-	corinf.Start(ctx.Done())
-	taginf.Start(ctx.Done())
-	if !cache.WaitForCacheSync(
-		ctx.Done(),
+	// the hostname identifies this replica in the Leases it holds.
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("unable to read hostname: %v", err)
+	}
+
+	// notifications and rollouts go through the same services whether
+	// started by imports or by the Deployment controller, notifications
+	// of a namespace are then aggregated in a single batch. The Tag
+	// service applies the configuration to the Deployment service.
+	notifier := services.NewNotifier(seclis)
+	depsvc := services.NewDeployment(corcli, tagcli, deplis, replis, taglis, notifier)
+	tagsvc := services.NewTag(
+		corcli, tagcli, taglis, tslis, replis, deplis, cnflis, seclis, depsvc, notifier,
+	)
+
+	// controllers register handlers within the informers, we only create
+	// the ones needed by the mode we are running on. Everything that can
+	// be reconfigured at runtime is also registered as a config consumer.
+	mtrsrv := controllers.NewMetricsServer()
+	// the work queues of the controllers we run are reported for
+	// debugging purposes.
+	debugger := controllers.NewControllersDebugger()
+	mtrsrv.Handle("/debug/controllers", debugger)
+
+	// leading are the controllers run only while we are the leader, if
+	// leader election is enabled.
+	ctrls := []Controller{mtrsrv}
+	var leading []Controller
+	informers := []cache.InformerSynced{
 		corinf.Core().V1().ConfigMaps().Informer().HasSynced,
 		corinf.Core().V1().Secrets().Informer().HasSynced,
+		sainf.Core().V1().ServiceAccounts().Informer().HasSynced,
 		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
 		corinf.Apps().V1().Deployments().Informer().HasSynced,
 		taginf.Images().V1().Tags().Informer().HasSynced,
-	) {
-		klog.Fatal("caches not syncing")
+		taginf.Images().V1().TagSets().Informer().HasSynced,
+		corinf.Core().V1().Namespaces().Informer().HasSynced,
 	}
-	klog.Info("caches in sync, moving on.")
+
+	tagsvc.InheritTags(nslis)
+	if err := tagsvc.IndexGenerationDigests(
+		taginf.Images().V1().Tags().Informer(),
+	); err != nil {
+		klog.Fatalf("unable to index generation digests: %v", err)
+	}
+	tagsvc.PullSecretsFrom(salis)
+	consumers := []controllers.ConfigConsumer{mtrsrv, tagsvc}
+	if *mode == modeAll || *mode == modeWebhooks {
+		mtctrl := controllers.NewMutatingWebHook(tagsvc)
+		qyctrl := controllers.NewQuayWebHook(tagsvc)
+		dkctrl := controllers.NewDockerWebHook(tagsvc)
+		apictrl := controllers.NewAPI(tagsvc, services.NewAuth(corcli))
+		slctrl := controllers.NewWebhookSelectors(corcli)
+		ctrls = append(ctrls, mtctrl, qyctrl, dkctrl, apictrl, slctrl)
+		consumers = append(consumers, mtctrl, qyctrl, dkctrl, apictrl, slctrl)
+	}
+	if *mode == modeAll || *mode == modeControllers {
+		klog.Infof("processing shard %d out of %d", *shardIndex, *shards)
+		dpctrl := controllers.NewDeployment(corinf, depsvc, shard)
+		itctrl := controllers.NewTag(taginf, tagsvc, shard, 10)
+		tssvc := services.NewTagSet(tagcli, taglis, tslis)
+		tsctrl := controllers.NewTagSet(taginf, tssvc, shard)
+		gssvc := services.NewGitSync(tagcli, taglis, seclis, podNamespace(), shard)
+		gsctrl := controllers.NewGitSync(gssvc)
+		dgsvc := services.NewDigests(corcli, taglis, cnflis)
+		dgctrl := controllers.NewDigests(corinf, taginf, dgsvc, shard)
+		flsvc := services.NewFluxPolicy(corcli.Discovery().RESTClient())
+		flctrl := controllers.NewFluxPolicy(taginf, flsvc, shard)
+		scsvc := services.NewImportScheduler(corcli, podNamespace(), hostname)
+		tagsvc.ScheduleImports(scsvc)
+		ctsvc := services.NewCatalog(taglis, cnflis, seclis, shard)
+		ctsvc.PullSecretsFrom(salis)
+		ctctrl := controllers.NewCatalog(ctsvc)
+		mtrsrv.Handle("/catalog", ctctrl)
+		debugger.Add(dpctrl, itctrl, tsctrl, dgctrl, flctrl)
+		leading = append(leading, dpctrl, itctrl, tsctrl, gsctrl, dgctrl, flctrl, ctctrl)
+		consumers = append(
+			consumers, itctrl, scsvc, gssvc, gsctrl, dgsvc, dgctrl, ctsvc, ctctrl,
+		)
+		if *shardIndex == 0 {
+			// a single network policy and monitoring objects cover all
+			// shards.
+			npsvc := services.NewNetworkPolicy(corcli, taglis, cnflis, podNamespace())
+			npctrl := controllers.NewNetworkPolicy(taginf, npsvc)
+			mnsvc := services.NewMonitoring(corcli.Discovery().RESTClient(), podNamespace())
+			mnctrl := controllers.NewMonitoring(mnsvc)
+			leading = append(leading, npctrl, mnctrl)
+			consumers = append(consumers, npsvc, npctrl, mnsvc, mnctrl)
+		}
+		if *leaderElect {
+			itctrl.StandBy(
+				services.NewHandover(corcli, podNamespace(), services.HandoverName(*shardIndex)),
+			)
+		}
+		metrics.Registry.MustRegister(
+			services.NewTagStates(taglis, shard),
+			services.NewStorageUsage(taglis, shard),
+			ctsvc,
+		)
+		if features.Enabled(features.PodReadinessGate) {
+			podsvc := services.NewPodReadiness(corcli, replis, taglis)
+			podctrl := controllers.NewPod(corinf, taginf, podsvc, shard)
+			leading = append(leading, podctrl)
+			debugger.Add(podctrl)
+			informers = append(informers, corinf.Core().V1().Pods().Informer().HasSynced)
+		}
+	}
+	cfctrl := controllers.NewConfigWatcher(corinf, podNamespace(), consumers...)
+	ctrls = append(ctrls, cfctrl)
+
+	// SIGTERM and SIGINT end the process while SIGHUP triggers a reload of
+	// the configuration. Registry credentials are read from secrets on each
+	// import so they are always up to date.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				klog.Info("SIGHUP received, reloading configuration")
+				cfctrl.Reload()
+				continue
+			}
+			cancel()
+			return
+		}
+	}()
 
 	var wg sync.WaitGroup
-	ctrls := []Controller{mtctrl, qyctrl, dkctrl, dpctrl, itctrl}
-	for _, ctrl := range ctrls {
+	start := func(ctx context.Context, wg *sync.WaitGroup, c Controller) {
 		wg.Add(1)
-		go func(c Controller) {
+		go func() {
 			defer wg.Done()
 			klog.Infof("starting controller for %q", c.Name())
 			if err := c.Start(ctx); err != nil {
@@ -111,7 +279,82 @@ func main() {
 				return
 			}
 			klog.Infof("%q controller ended.", c.Name())
-		}(ctrl)
+		}()
+	}
+
+	// starts up all informers and waits for their cache to sync
+	// up, only then we start the operators i.e. start to process
+	// events from the queue.
+	klog.Info("waiting for caches to sync ...")
+	corinf.Start(ctx.Done())
+	sainf.Start(ctx.Done())
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informers...) {
+		klog.Fatal("caches not syncing")
+	}
+	klog.Info("caches in sync, moving on.")
+
+	for _, ctrl := range ctrls {
+		start(ctx, &wg, ctrl)
 	}
+	if !*leaderElect || len(leading) == 0 {
+		for _, ctrl := range leading {
+			start(ctx, &wg, ctrl)
+		}
+		wg.Wait()
+		return
+	}
+
+	// standby replicas keep their caches warm, the controllers only start
+	// once we become the leader. Losing leadership ends the process so we
+	// come back as a standby.
+	elector := services.NewLeaderElector(
+		corcli, podNamespace(), services.LeaseName(*shardIndex), hostname,
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		elector.Run(ctx, func(lctx context.Context) {
+			// the lease is only released once all controllers
+			// are done, the Tag controller saves its handover
+			// on the way out.
+			var lwg sync.WaitGroup
+			for _, ctrl := range leading {
+				start(lctx, &lwg, ctrl)
+			}
+			lwg.Wait()
+		})
+	}()
 	wg.Wait()
 }
+
+// shardIndexFromHostname infers the shard index from the pod hostname. When
+// running as a StatefulSet pods are named "<name>-<ordinal>" and the ordinal
+// is used as shard index. If we are running a single shard zero is returned.
+func shardIndexFromHostname(shards int) int {
+	if shards == 1 {
+		return 0
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("unable to read hostname: %v", err)
+	}
+
+	idx := strings.LastIndex(hostname, "-")
+	ordinal, err := strconv.Atoi(hostname[idx+1:])
+	if err != nil {
+		klog.Fatalf("unable to infer shard index from hostname %q", hostname)
+	}
+	return ordinal
+}
+
+// podNamespace returns the namespace where tagger is running. It is read from
+// POD_NAMESPACE environment variable, defaults to "tagger" if not set.
+func podNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "tagger"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	corecli "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	itagcli "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	"github.com/ricardomaraschini/tagger/services"
+)
+
+// selftest validates the tagger installation and prints a readiness report.
+// Returns the exit code for the process, non zero if any check failed.
+func selftest() int {
+	kubeconfig := os.Getenv("KUBECONFIG")
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read kubeconfig: %v\n", err)
+		return 1
+	}
+
+	tagcli, err := itagcli.NewForConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create image tag client: %v\n", err)
+		return 1
+	}
+
+	corcli, err := corecli.NewForConfig(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to create core client: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	svc := services.NewSelfTest(corcli, tagcli, podNamespace(), "assets/server.crt")
+	results := svc.Run(ctx)
+
+	code := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tMESSAGE")
+	for _, res := range results {
+		status := "PASS"
+		if !res.Passed {
+			status = "FAIL"
+			code = 1
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", res.Name, status, res.Message)
+	}
+	tw.Flush()
+	return code
+}
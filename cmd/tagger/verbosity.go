@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// components maps each component whose verbosity can be set independently
+// into the source files (without the ".go" suffix) implementing it. klog
+// matches -vmodule patterns against file base names only. Every file logging
+// through klog.V must belong to a component, see verbosity_test.go.
+var components = map[string][]string{
+	"tag": {
+		"tag", "tagset", "importer", "sysctx", "upload", "layers", "rotation",
+		"storage", "overload", "tagnames", "audit", "projection", "catalog",
+	},
+	"deployment": {"deployment", "pod", "readiness"},
+	"webhooks": {
+		"mutating", "quay", "docker", "validate", "server", "api", "auth",
+		"enforcement", "inherit",
+	},
+	"config": {"config"},
+	"sync":   {"gitsync", "digests", "flux", "netpol", "monitoring"},
+}
+
+// verbosity holds the log verbosity per component as set by the --v-<name>
+// flags. Negative values mean the verbosity has not been set and the global
+// -v applies.
+type verbosity map[string]*int
+
+// componentVerbosityFlags registers a --v-<component> flag for each one of
+// our components.
+func componentVerbosityFlags() verbosity {
+	v := verbosity{}
+	for name := range components {
+		v[name] = flag.Int(
+			fmt.Sprintf("v-%s", name),
+			-1,
+			fmt.Sprintf("Log verbosity for the %s component, defaults to -v", name),
+		)
+	}
+	return v
+}
+
+// vmodule returns a klog -vmodule value for all components whose verbosity
+// has been set. Patterns already present in current are kept and take
+// precedence as klog applies the first matching pattern.
+func (v verbosity) vmodule(current string) string {
+	names := []string{}
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	patterns := []string{}
+	if current != "" {
+		patterns = append(patterns, current)
+	}
+	for _, name := range names {
+		level := *v[name]
+		if level < 0 {
+			continue
+		}
+		for _, file := range components[name] {
+			patterns = append(patterns, fmt.Sprintf("%s=%d", file, level))
+		}
+	}
+	return strings.Join(patterns, ",")
+}
+
+// apply sets klog -vmodule flag according to the verbosity per component.
+func (v verbosity) apply() error {
+	vmodule := flag.Lookup("vmodule")
+	if vmodule == nil {
+		return fmt.Errorf("klog flags not initialized")
+	}
+	return vmodule.Value.Set(v.vmodule(vmodule.Value.String()))
+}
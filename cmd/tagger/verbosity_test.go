@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComponentsCoverVerboseFiles(t *testing.T) {
+	known := map[string]bool{}
+	for _, files := range components {
+		for _, file := range files {
+			known[file] = true
+		}
+	}
+
+	for _, pkg := range []string{"services", "controllers"} {
+		paths, err := filepath.Glob(filepath.Join("..", "..", pkg, "*.go"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(paths) == 0 {
+			t.Fatalf("no source files found in %s", pkg)
+		}
+		for _, path := range paths {
+			if strings.HasSuffix(path, "_test.go") {
+				continue
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !strings.Contains(string(data), "klog.V(") {
+				continue
+			}
+			name := strings.TrimSuffix(filepath.Base(path), ".go")
+			if !known[name] {
+				t.Errorf("%s logs through klog.V but belongs to no component", path)
+			}
+		}
+	}
+}
+
+func TestVerbosityVmodule(t *testing.T) {
+	tag, sync, unset := 4, 2, -1
+	v := verbosity{"tag": &tag, "sync": &sync, "config": &unset}
+	vmodule := v.vmodule("gitsync=1")
+
+	patterns := strings.Split(vmodule, ",")
+	if patterns[0] != "gitsync=1" {
+		t.Errorf("expected current patterns first, %q received", vmodule)
+	}
+	for _, expected := range []string{"upload=4", "catalog=4", "gitsync=2"} {
+		found := false
+		for _, pattern := range patterns {
+			found = found || pattern == expected
+		}
+		if !found {
+			t.Errorf("expected %q in %q", expected, vmodule)
+		}
+	}
+	if strings.Contains(vmodule, "config=") {
+		t.Errorf("unset component in %q", vmodule)
+	}
+}
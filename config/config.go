@@ -0,0 +1,880 @@
+// Package config holds tagger tunables. Configuration is read from a ConfigMap
+// and may be changed at runtime, components interested in configuration
+// changes are notified by the config controller (see controllers/config.go).
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ConfigMapName is the name of the ConfigMap holding tagger configuration, it
+// lives in the same namespace where tagger runs.
+const ConfigMapName = "tagger-config"
+
+// ConfigMapKey is the key, inside the ConfigMap, holding configuration yaml.
+const ConfigMapKey = "config.yaml"
+
+// Address families our servers listen on. With AddressFamilyDual servers
+// listen on IPv6 and IPv4 if the node supports both, on the only supported
+// family otherwise.
+const (
+	AddressFamilyDual = "dual"
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// Binds holds the addresses where tagger servers listen on and the address
+// family they listen on. IPv6 addresses are written in brackets, e.g.
+// "[::1]:8080".
+type Binds struct {
+	Family   string `yaml:"family"`
+	Mutating string `yaml:"mutating"`
+	Quay     string `yaml:"quay"`
+	Docker   string `yaml:"docker"`
+	Metrics  string `yaml:"metrics"`
+	API      string `yaml:"api"`
+	GitSync  string `yaml:"gitSync"`
+}
+
+// Network returns the network, as used by the net package, servers listen on
+// according to the configured address family.
+func (b Binds) Network() string {
+	switch b.Family {
+	case AddressFamilyIPv4:
+		return "tcp4"
+	case AddressFamilyIPv6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// validate checks the address family and, against it, the bind addresses.
+func (b Binds) validate() error {
+	switch b.Family {
+	case AddressFamilyDual, AddressFamilyIPv4, AddressFamilyIPv6:
+	default:
+		return fmt.Errorf("address family must be one of dual, ipv4 or ipv6")
+	}
+
+	binds := []string{b.Mutating, b.Quay, b.Docker, b.Metrics, b.API, b.GitSync}
+	for _, bind := range binds {
+		if bind == "" {
+			return fmt.Errorf("empty bind address")
+		}
+		host, port, err := net.SplitHostPort(bind)
+		if err != nil {
+			return fmt.Errorf("invalid bind address %q: %w", bind, err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return fmt.Errorf("invalid port in bind address %q", bind)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil && b.Family == AddressFamilyIPv6 {
+			return fmt.Errorf("ipv4 bind address %q with ipv6 address family", bind)
+		}
+		if ip.To4() == nil && b.Family == AddressFamilyIPv4 {
+			return fmt.Errorf("ipv6 bind address %q with ipv4 address family", bind)
+		}
+	}
+	return nil
+}
+
+// MaxLayerParallelism is the maximum number of layers copied in parallel, it
+// is imposed by the library we use to copy images.
+const MaxLayerParallelism = 6
+
+// Bandwidth holds limits, in bytes per second, for blob copies. Zero means
+// unlimited. Registry limits apply on top of the global one.
+type Bandwidth struct {
+	Global     int64            `yaml:"global"`
+	Registries map[string]int64 `yaml:"registries"`
+}
+
+// AutoRollback controls automatic rollbacks of Tags whose rollout failed.
+// Tags in the listed namespaces are rolled back even if they don't opt in.
+type AutoRollback struct {
+	Namespaces []string      `yaml:"namespaces"`
+	Deadline   time.Duration `yaml:"deadline"`
+}
+
+// Enabled returns true if Tags in the namespace are rolled back regardless of
+// their own setting.
+func (a AutoRollback) Enabled(namespace string) bool {
+	for _, ns := range a.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// DigestEnforcement restricts the images pods in the listed namespaces may
+// run to the ones imported as a Tag generation, rejecting images pulled from
+// anywhere else. With DryRun set these pods are admitted with a warning
+// instead.
+type DigestEnforcement struct {
+	Namespaces []string `yaml:"namespaces"`
+	DryRun     bool     `yaml:"dryRun"`
+}
+
+// Enforced returns true if pods in the namespace may only run images
+// imported as a Tag generation.
+func (d DigestEnforcement) Enforced(namespace string) bool {
+	for _, ns := range d.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportAudit controls the ImportAudit objects recorded for each import
+// attempt. Audits older than Retention are pruned and at most MaxPerTag of
+// them are kept for each Tag.
+type ImportAudit struct {
+	Enabled   bool          `yaml:"enabled"`
+	Retention time.Duration `yaml:"retention"`
+	MaxPerTag int           `yaml:"maxPerTag"`
+}
+
+// WorkerScaling makes the number of Tags imported in parallel to follow the
+// import queue depth, between Min and Max workers.
+type WorkerScaling struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+// CircuitBreaker stops imports from registries that have been failing, with
+// network errors or server side errors, for longer than OpenAfter. Imports
+// from such registries fail right away, a single probe import is let through
+// every ProbeInterval until one succeeds. Zero OpenAfter disables it.
+type CircuitBreaker struct {
+	OpenAfter     time.Duration `yaml:"openAfter"`
+	ProbeInterval time.Duration `yaml:"probeInterval"`
+}
+
+// ImportDeadline sets how long a single Tag import may take. Imports of images
+// of known size get PerGiB for each GiB, but never less than Minimum nor more
+// than Maximum. Imports of images of unknown size get Minimum.
+type ImportDeadline struct {
+	Minimum time.Duration `yaml:"minimum"`
+	PerGiB  time.Duration `yaml:"perGiB"`
+	Maximum time.Duration `yaml:"maximum"`
+}
+
+// For returns the deadline for importing an image of size bytes, a size of
+// zero or less means unknown.
+func (i ImportDeadline) For(size int64) time.Duration {
+	if size <= 0 {
+		return i.Minimum
+	}
+	deadline := time.Duration(float64(i.PerGiB) * float64(size) / (1 << 30))
+	if deadline < i.Minimum {
+		return i.Minimum
+	}
+	if deadline > i.Maximum {
+		return i.Maximum
+	}
+	return deadline
+}
+
+// OverloadProtection sheds the imports of Tags not used by any workload while
+// the operator is close to its resource limits. Thresholds are fractions of
+// the container memory limit and of the open files limit, a zero threshold
+// disables its check.
+type OverloadProtection struct {
+	MemoryThreshold float64 `yaml:"memoryThreshold"`
+	FileThreshold   float64 `yaml:"fileThreshold"`
+}
+
+// ImportSchedule caps how many Tags are imported at once across all replicas
+// and shards, zero MaxConcurrent meaning no cap, and holds imports back during
+// blackout windows. It complements the per registry bandwidth limits.
+type ImportSchedule struct {
+	MaxConcurrent int        `yaml:"maxConcurrent"`
+	Blackouts     []Blackout `yaml:"blackouts"`
+}
+
+// Blackout is a weekly window during which no import starts. It starts at
+// Start, "15:04" in UTC, on each of Days ("Mon" to "Sun", every day if none)
+// and lasts for Duration, possibly past midnight.
+type Blackout struct {
+	Name     string        `yaml:"name"`
+	Days     []string      `yaml:"days"`
+	Start    string        `yaml:"start"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// weekdays maps the abbreviated week day names used by blackouts.
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+// Active returns true if now falls within the blackout. The blackout must
+// have been validated.
+func (b Blackout) Active(now time.Time) bool {
+	start, err := time.Parse("15:04", b.Start)
+	if err != nil {
+		return false
+	}
+	now = now.UTC()
+	days := map[time.Weekday]bool{}
+	for _, day := range b.Days {
+		days[weekdays[day]] = true
+	}
+
+	// windows started on any of the previous days may still be running.
+	for back := 0; back <= 7; back++ {
+		day := now.AddDate(0, 0, -back)
+		if len(days) > 0 && !days[day.Weekday()] {
+			continue
+		}
+		from := time.Date(
+			day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, time.UTC,
+		)
+		if !now.Before(from) && now.Before(from.Add(b.Duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegistryRequest holds what is sent with the requests to a registry.
+type RegistryRequest struct {
+	UserAgent string `yaml:"userAgent"`
+}
+
+// RegistryRequests sets the User-Agent sent with outbound registry requests.
+// Registries, keyed by registry host, override the global User-Agent.
+type RegistryRequests struct {
+	RegistryRequest `yaml:",inline"`
+	Registries      map[string]RegistryRequest `yaml:"registries"`
+}
+
+// UserAgentFor returns the User-Agent to send to registry, empty means the
+// default one.
+func (r RegistryRequests) UserAgentFor(registry string) string {
+	if override := r.Registries[registry].UserAgent; override != "" {
+		return override
+	}
+	return r.UserAgent
+}
+
+// validate checks the User-Agent.
+func (r RegistryRequest) validate() error {
+	if !validHeaderValue(r.UserAgent) {
+		return fmt.Errorf("invalid user agent %q", r.UserAgent)
+	}
+	return nil
+}
+
+// validHeaderValue returns true if value holds no control characters other
+// than tabs, preventing header injection.
+func validHeaderValue(value string) bool {
+	for _, r := range value {
+		if (r < ' ' && r != '\t') || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// PodWebhook holds the selectors of the pod mutating webhook. When set the
+// webhook, named "core.images.io" in the Configuration (a mutating webhook
+// configuration), is kept using these selectors. A nil selector matches
+// everything.
+type PodWebhook struct {
+	Configuration     string    `yaml:"configuration"`
+	NamespaceSelector *Selector `yaml:"namespaceSelector"`
+	ObjectSelector    *Selector `yaml:"objectSelector"`
+}
+
+// NetworkPolicy makes a NetworkPolicy, named Name in our namespace, to be kept
+// restricting the egress of the pods matched by PodSelector to the registries
+// Tags are imported from, their mirrors and the cache registry. DNS and the
+// API server are always allowed, so are ExtraHosts, e.g. the CDNs registries
+// redirect blob downloads to, and ExtraCIDRs. A nil PodSelector matches every
+// pod in the namespace.
+type NetworkPolicy struct {
+	Name        string    `yaml:"name"`
+	PodSelector *Selector `yaml:"podSelector"`
+	ExtraHosts  []string  `yaml:"extraHosts"`
+	ExtraCIDRs  []string  `yaml:"extraCIDRs"`
+}
+
+// Monitoring makes a ServiceMonitor and a PrometheusRule, both named Name in
+// our namespace, to be kept for clusters running the Prometheus operator.
+// The ServiceMonitor scrapes the metrics Service every Interval, zero for the
+// Prometheus default. The PrometheusRule alerts on failing imports, on http
+// servers answering with server errors and on Tags not rolled out for
+// StaleAfter, zero for an hour. Labels are set on both objects so they are
+// picked up by the Prometheus instance selecting them.
+type Monitoring struct {
+	Name       string            `yaml:"name"`
+	Labels     map[string]string `yaml:"labels"`
+	Interval   time.Duration     `yaml:"interval"`
+	StaleAfter time.Duration     `yaml:"staleAfter"`
+}
+
+// Selector is a label selector, as found in Kubernetes objects.
+type Selector struct {
+	MatchLabels      map[string]string     `yaml:"matchLabels"`
+	MatchExpressions []SelectorRequirement `yaml:"matchExpressions"`
+}
+
+// SelectorRequirement is a label selector requirement. Operator is one of
+// In, NotIn, Exists and DoesNotExist.
+type SelectorRequirement struct {
+	Key      string   `yaml:"key"`
+	Operator string   `yaml:"operator"`
+	Values   []string `yaml:"values"`
+}
+
+// LabelSelector returns the selector as a Kubernetes label selector. A nil
+// selector is returned as an empty one, matching everything.
+func (s *Selector) LabelSelector() *metav1.LabelSelector {
+	sel := &metav1.LabelSelector{}
+	if s == nil {
+		return sel
+	}
+	sel.MatchLabels = s.MatchLabels
+	for _, req := range s.MatchExpressions {
+		sel.MatchExpressions = append(
+			sel.MatchExpressions,
+			metav1.LabelSelectorRequirement{
+				Key:      req.Key,
+				Operator: metav1.LabelSelectorOperator(req.Operator),
+				Values:   req.Values,
+			},
+		)
+	}
+	return sel
+}
+
+// MutationSkip excludes pods from mutation based on their owners. A pod is
+// skipped if any object in its ownership chain (the pod, its ReplicaSet and
+// the ReplicaSet Deployment) is owned by an object of Kind and, if set, of
+// APIVersion and Name. Rules apply to all namespaces but the ones listed in
+// ExceptNamespaces or, if Namespaces is set, only to the listed ones.
+type MutationSkip struct {
+	Kind             string   `yaml:"kind"`
+	APIVersion       string   `yaml:"apiVersion"`
+	Name             string   `yaml:"name"`
+	Namespaces       []string `yaml:"namespaces"`
+	ExceptNamespaces []string `yaml:"exceptNamespaces"`
+}
+
+// Matches returns true if the rule skips pods in namespace owned, directly
+// or not, by the provided owner.
+func (m MutationSkip) Matches(namespace, apiVersion, kind, name string) bool {
+	if m.Kind != kind {
+		return false
+	}
+	if m.APIVersion != "" && m.APIVersion != apiVersion {
+		return false
+	}
+	if m.Name != "" && m.Name != name {
+		return false
+	}
+	for _, ns := range m.ExceptNamespaces {
+		if ns == namespace {
+			return false
+		}
+	}
+	if len(m.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range m.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelProjection projects an image label, or an OCI manifest annotation,
+// onto the Tags importing the image. The value of ImageLabel in the current
+// generation of a Tag is set as the Tag Label or Annotation, only one of the
+// two may be set.
+type LabelProjection struct {
+	ImageLabel string `yaml:"imageLabel"`
+	Label      string `yaml:"label"`
+	Annotation string `yaml:"annotation"`
+}
+
+// GitSync syncs Tag definitions from a path of a Git repository. Tags found
+// under Path, in Branch (the repository default branch if empty), are created
+// or updated every Interval and whenever a sync is triggered through the git
+// sync webhook, zero Interval disables polling. Tags without a namespace are
+// created in Namespace. With Prune Tags synced before but no longer found in
+// the repository are deleted. CredentialsSecret is the name of a Secret, in
+// the namespace tagger runs, holding the "username" and "password" used to
+// access the repository over https.
+type GitSync struct {
+	Repository        string        `yaml:"repository"`
+	Branch            string        `yaml:"branch"`
+	Path              string        `yaml:"path"`
+	Interval          time.Duration `yaml:"interval"`
+	Namespace         string        `yaml:"namespace"`
+	Prune             bool          `yaml:"prune"`
+	CredentialsSecret string        `yaml:"credentialsSecret"`
+}
+
+// How pods using disabled Tags are handled by the pod mutating webhook. With
+// DisabledTagsFallback pods keep the image as written in their spec while with
+// DisabledTagsReject they are rejected.
+const (
+	DisabledTagsFallback = "fallback"
+	DisabledTagsReject   = "reject"
+)
+
+// Where imports read registry credentials from. With CredentialsFromSecrets
+// every docker config Secret in the Tag namespace is used while with
+// CredentialsFromServiceAccount only the image pull secrets of the namespace
+// default ServiceAccount are, i.e. the ones its workloads pull images with.
+const (
+	CredentialsFromSecrets        = "secrets"
+	CredentialsFromServiceAccount = "serviceAccount"
+)
+
+// Config holds all tunables that can be changed without restarting tagger.
+type Config struct {
+	// Workers is the number of Tags imported in parallel.
+	Workers int `yaml:"workers"`
+	// WorkerScaling, if set, scales the number of workers according to
+	// the number of Tags waiting to be imported. Workers is then used as
+	// the initial number of workers.
+	WorkerScaling *WorkerScaling `yaml:"workerScaling"`
+	// Binds are the addresses our http servers listen on.
+	Binds Binds `yaml:"binds"`
+	// UnqualifiedRegistries are the registries where images without an
+	// explicit registry domain are searched on.
+	UnqualifiedRegistries []string `yaml:"unqualifiedRegistries"`
+	// RegistryMirrors maps a registry domain into a list of mirrors that
+	// are attempted, in order, before the registry itself.
+	RegistryMirrors map[string][]string `yaml:"registryMirrors"`
+	// ClientCertificates maps a registry domain into a directory holding
+	// the client certificate (client.cert) and key (client.key) presented
+	// to registries requiring mutual TLS. A ca.crt file in the directory,
+	// if present, is trusted as well.
+	ClientCertificates map[string]string `yaml:"clientCertificates"`
+	// RegistryRequests sets the User-Agent sent with registry requests,
+	// globally or per registry host.
+	RegistryRequests RegistryRequests `yaml:"registryRequests"`
+	// DrainTimeout is how long our http servers wait for in-flight requests
+	// during shutdown. It should be lower than the pod's grace period.
+	DrainTimeout time.Duration `yaml:"drainTimeout"`
+	// Bandwidth limits the bandwidth used when mirroring images.
+	Bandwidth Bandwidth `yaml:"bandwidth"`
+	// LayerParallelism is the number of layers of an image copied in
+	// parallel when mirroring.
+	LayerParallelism int `yaml:"layerParallelism"`
+	// LayerRetries is how many times reading or uploading a single layer
+	// is retried.
+	LayerRetries int `yaml:"layerRetries"`
+	// UploadChunkSize is the size, in bytes, of each chunk sent when
+	// uploading layers to the cache registry.
+	UploadChunkSize int64 `yaml:"uploadChunkSize"`
+	// ImportDeadline is how long a Tag import may take before it is
+	// interrupted, uploads are resumed by the next attempt.
+	ImportDeadline ImportDeadline `yaml:"importDeadline"`
+	// MaxInflightBytes is how many bytes of layers, across all imports,
+	// may be buffered in memory at once while mirroring. Each layer being
+	// uploaded buffers one chunk. Zero disables the limit.
+	MaxInflightBytes int64 `yaml:"maxInflightBytes"`
+	// Platforms, in the "os/architecture[/variant]" format, to mirror
+	// from multi architecture images. Empty means all platforms.
+	Platforms []string `yaml:"platforms"`
+	// CredentialsSource sets where imports read registry credentials
+	// from, one of "secrets" or "serviceAccount".
+	CredentialsSource string `yaml:"credentialsSource"`
+	// CredentialsNamespace is a namespace holding registry credentials
+	// shared with all namespaces. Each Secret may restrict the namespaces
+	// allowed to use it. Empty disables shared credentials.
+	CredentialsNamespace string `yaml:"credentialsNamespace"`
+	// AutoRollback sets where failed rollouts are automatically rolled
+	// back and how long a rollout may take before being considered failed.
+	AutoRollback AutoRollback `yaml:"autoRollback"`
+	// ImportAudit sets if import attempts are recorded as ImportAudit
+	// objects and for how long they are kept.
+	ImportAudit ImportAudit `yaml:"importAudit"`
+	// MutationSkips prevent pods owned by the matching controllers from
+	// being mutated, avoiding fights with controllers managing their own
+	// image fields.
+	MutationSkips []MutationSkip `yaml:"mutationSkips"`
+	// DigestEnforcement sets the namespaces whose pods may only run
+	// images imported as a Tag generation.
+	DigestEnforcement DigestEnforcement `yaml:"digestEnforcement"`
+	// PodWebhook, if set, makes the pod mutating webhook to be kept
+	// using the configured namespace and object selectors.
+	PodWebhook *PodWebhook `yaml:"podWebhook"`
+	// NetworkPolicy, if set, makes the egress of our pods to be locked
+	// down to the registries in use.
+	NetworkPolicy *NetworkPolicy `yaml:"networkPolicy"`
+	// Monitoring, if set, makes the Prometheus operator objects scraping
+	// our metrics and alerting on them to be kept.
+	Monitoring *Monitoring `yaml:"monitoring"`
+	// LabelProjections set which image labels are copied onto the Tags
+	// as labels or annotations, e.g. the git commit an image was built
+	// from.
+	LabelProjections []LabelProjection `yaml:"labelProjections"`
+	// CircuitBreaker sets when imports from a failing registry are
+	// short-circuited and how often the registry is probed.
+	CircuitBreaker CircuitBreaker `yaml:"circuitBreaker"`
+	// DisabledTags sets what happens to new pods using a disabled Tag,
+	// one of "fallback" or "reject".
+	DisabledTags string `yaml:"disabledTags"`
+	// GitSync, if set, makes Tag definitions to be synced from a Git
+	// repository.
+	GitSync *GitSync `yaml:"gitSync"`
+	// CacheMissTimeout is how long Tags and ReplicaSets not in the cache
+	// yet are read from the API server while mutating pods. Zero disables
+	// these reads.
+	CacheMissTimeout time.Duration `yaml:"cacheMissTimeout"`
+	// DigestsConfigMap, if set, is the name of the ConfigMap kept in
+	// every namespace with Tags, mapping each Tag into its current image
+	// reference.
+	DigestsConfigMap string `yaml:"digestsConfigMap"`
+	// ImportCacheTTL is for how long the reference an import resolves is
+	// reused by other Tags, not mirrored, importing the same image. Zero
+	// disables the reuse.
+	ImportCacheTTL time.Duration `yaml:"importCacheTTL"`
+	// CatalogReportInterval is how often the upstream repositories Tags
+	// are imported from are listed, looking for tags no Tag tracks. Zero
+	// disables the report.
+	CatalogReportInterval time.Duration `yaml:"catalogReportInterval"`
+	// SigningKey, if set, is the path to the PEM encoded ed25519 private
+	// key every imported generation is signed with.
+	SigningKey string `yaml:"signingKey"`
+	// Overload sets when imports are shed to keep the operator within
+	// its memory and open files limits.
+	Overload OverloadProtection `yaml:"overload"`
+	// ImportSchedule caps the imports running at once across all
+	// replicas and sets the windows during which imports are held back.
+	ImportSchedule ImportSchedule `yaml:"importSchedule"`
+	// ScratchDir is the directory everything written to disk while
+	// importing, such as the blob info cache and git sync checkouts, is
+	// kept under. It lets the root filesystem to be read only.
+	ScratchDir string `yaml:"scratchDir"`
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Workers: 10,
+		Binds: Binds{
+			Family:   AddressFamilyDual,
+			Mutating: ":8080",
+			Quay:     ":8081",
+			Docker:   ":8082",
+			Metrics:  ":8090",
+			API:      ":8083",
+			GitSync:  ":8084",
+		},
+		UnqualifiedRegistries: []string{"docker.io"},
+		DrainTimeout:          25 * time.Second,
+		LayerParallelism:      MaxLayerParallelism,
+		LayerRetries:          3,
+		UploadChunkSize:       16 << 20,
+		MaxInflightBytes:      256 << 20,
+		ImportDeadline: ImportDeadline{
+			Minimum: 3 * time.Minute,
+			PerGiB:  2 * time.Minute,
+			Maximum: 30 * time.Minute,
+		},
+		AutoRollback: AutoRollback{
+			Deadline: 10 * time.Minute,
+		},
+		ImportAudit: ImportAudit{
+			Enabled:   true,
+			Retention: 7 * 24 * time.Hour,
+			MaxPerTag: 100,
+		},
+		CircuitBreaker: CircuitBreaker{
+			OpenAfter:     5 * time.Minute,
+			ProbeInterval: time.Minute,
+		},
+		CredentialsSource: CredentialsFromSecrets,
+		DisabledTags:      DisabledTagsFallback,
+		CacheMissTimeout:  2 * time.Second,
+		ImportCacheTTL:    time.Minute,
+		Overload: OverloadProtection{
+			MemoryThreshold: 0.9,
+			FileThreshold:   0.9,
+		},
+		ScratchDir: "/tmp",
+	}
+}
+
+// Parse parses the provided yaml content on top of the default configuration,
+// i.e. properties not present in data keep their default values.
+func Parse(data string) (*Config, error) {
+	cfg := Default()
+	if err := yaml.UnmarshalStrict([]byte(data), cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks if the configuration is valid.
+func (c *Config) Validate() error {
+	if c.Workers < 1 {
+		return fmt.Errorf("workers must be greater than zero")
+	}
+	if c.WorkerScaling != nil {
+		if c.WorkerScaling.Min < 1 {
+			return fmt.Errorf("minimum workers must be greater than zero")
+		}
+		if c.WorkerScaling.Max < c.WorkerScaling.Min {
+			return fmt.Errorf("maximum workers must not be lower than the minimum")
+		}
+	}
+	if len(c.UnqualifiedRegistries) == 0 {
+		return fmt.Errorf("at least one unqualified registry must be set")
+	}
+	if c.DrainTimeout <= 0 {
+		return fmt.Errorf("drain timeout must be greater than zero")
+	}
+	if c.CacheMissTimeout < 0 {
+		return fmt.Errorf("negative cache miss timeout")
+	}
+	if c.ImportCacheTTL < 0 {
+		return fmt.Errorf("negative import cache ttl")
+	}
+	if c.CatalogReportInterval < 0 {
+		return fmt.Errorf("negative catalog report interval")
+	}
+	if c.SigningKey != "" && !filepath.IsAbs(c.SigningKey) {
+		return fmt.Errorf("signing key must be an absolute path")
+	}
+	if !filepath.IsAbs(c.ScratchDir) {
+		return fmt.Errorf("scratch directory must be an absolute path")
+	}
+	if c.Overload.MemoryThreshold < 0 || c.Overload.MemoryThreshold > 1 {
+		return fmt.Errorf("overload memory threshold must be between 0 and 1")
+	}
+	if c.Overload.FileThreshold < 0 || c.Overload.FileThreshold > 1 {
+		return fmt.Errorf("overload file threshold must be between 0 and 1")
+	}
+	if c.ImportSchedule.MaxConcurrent < 0 {
+		return fmt.Errorf("negative max concurrent imports")
+	}
+	for _, blackout := range c.ImportSchedule.Blackouts {
+		if blackout.Name == "" {
+			return fmt.Errorf("blackouts must be named")
+		}
+		if _, err := time.Parse("15:04", blackout.Start); err != nil {
+			return fmt.Errorf("blackout %s: invalid start %q", blackout.Name, blackout.Start)
+		}
+		if blackout.Duration <= 0 || blackout.Duration > 7*24*time.Hour {
+			return fmt.Errorf("blackout %s: duration must be within a week", blackout.Name)
+		}
+		for _, day := range blackout.Days {
+			if _, ok := weekdays[day]; !ok {
+				return fmt.Errorf("blackout %s: invalid day %q", blackout.Name, day)
+			}
+		}
+	}
+	if c.LayerParallelism < 1 || c.LayerParallelism > MaxLayerParallelism {
+		return fmt.Errorf("layer parallelism must be between 1 and %d", MaxLayerParallelism)
+	}
+	if c.LayerRetries < 0 {
+		return fmt.Errorf("negative layer retries")
+	}
+	if c.UploadChunkSize < 1 {
+		return fmt.Errorf("upload chunk size must be greater than zero")
+	}
+	if c.ImportDeadline.Minimum <= 0 {
+		return fmt.Errorf("minimum import deadline must be greater than zero")
+	}
+	if c.ImportDeadline.PerGiB < 0 {
+		return fmt.Errorf("negative import deadline per GiB")
+	}
+	if c.ImportDeadline.Maximum < c.ImportDeadline.Minimum {
+		return fmt.Errorf("maximum import deadline must not be lower than the minimum")
+	}
+	if c.MaxInflightBytes < 0 {
+		return fmt.Errorf("negative max in-flight bytes")
+	}
+	if c.MaxInflightBytes > 0 && c.MaxInflightBytes < c.UploadChunkSize {
+		return fmt.Errorf("max in-flight bytes must be at least the upload chunk size")
+	}
+	for _, platform := range c.Platforms {
+		parts := strings.Split(platform, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid platform %q", platform)
+		}
+	}
+	if c.AutoRollback.Deadline <= 0 {
+		return fmt.Errorf("auto rollback deadline must be greater than zero")
+	}
+	for registry, dir := range c.ClientCertificates {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("client certificates for %s must be an absolute path", registry)
+		}
+	}
+	if err := c.RegistryRequests.validate(); err != nil {
+		return err
+	}
+	for registry, request := range c.RegistryRequests.Registries {
+		if err := request.validate(); err != nil {
+			return fmt.Errorf("registry %s: %w", registry, err)
+		}
+	}
+	if c.ImportAudit.Retention <= 0 {
+		return fmt.Errorf("import audit retention must be greater than zero")
+	}
+	if c.ImportAudit.MaxPerTag < 1 {
+		return fmt.Errorf("import audits per tag must be greater than zero")
+	}
+	for _, skip := range c.MutationSkips {
+		if skip.Kind == "" {
+			return fmt.Errorf("mutation skip rules must set a kind")
+		}
+	}
+	if c.CircuitBreaker.OpenAfter < 0 {
+		return fmt.Errorf("negative circuit breaker open after")
+	}
+	if c.CircuitBreaker.OpenAfter > 0 && c.CircuitBreaker.ProbeInterval <= 0 {
+		return fmt.Errorf("circuit breaker probe interval must be greater than zero")
+	}
+	if c.CredentialsSource != CredentialsFromSecrets &&
+		c.CredentialsSource != CredentialsFromServiceAccount {
+		return fmt.Errorf("credentials source must be either secrets or serviceAccount")
+	}
+	if c.CredentialsSource == CredentialsFromServiceAccount && c.CredentialsNamespace != "" {
+		return fmt.Errorf("shared credentials can't be used with service account credentials")
+	}
+	if c.DisabledTags != DisabledTagsFallback && c.DisabledTags != DisabledTagsReject {
+		return fmt.Errorf("disabled tags must be either fallback or reject")
+	}
+	for _, proj := range c.LabelProjections {
+		if proj.ImageLabel == "" {
+			return fmt.Errorf("label projections must set an image label")
+		}
+		if (proj.Label == "") == (proj.Annotation == "") {
+			return fmt.Errorf(
+				"projection of %s must set either a label or an annotation",
+				proj.ImageLabel,
+			)
+		}
+		key := proj.Label + proj.Annotation
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid projection key %q: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	if c.PodWebhook != nil {
+		if c.PodWebhook.Configuration == "" {
+			return fmt.Errorf("pod webhook configuration name must be set")
+		}
+		selectors := []*Selector{
+			c.PodWebhook.NamespaceSelector, c.PodWebhook.ObjectSelector,
+		}
+		for _, sel := range selectors {
+			if _, err := metav1.LabelSelectorAsSelector(sel.LabelSelector()); err != nil {
+				return fmt.Errorf("invalid pod webhook selector: %w", err)
+			}
+		}
+	}
+	if np := c.NetworkPolicy; np != nil {
+		if errs := validation.IsDNS1123Subdomain(np.Name); len(errs) > 0 {
+			return fmt.Errorf(
+				"invalid network policy name %q: %s", np.Name, strings.Join(errs, ", "),
+			)
+		}
+		if _, err := metav1.LabelSelectorAsSelector(np.PodSelector.LabelSelector()); err != nil {
+			return fmt.Errorf("invalid network policy pod selector: %w", err)
+		}
+		for _, host := range np.ExtraHosts {
+			if host == "" || strings.Contains(host, "/") {
+				return fmt.Errorf("invalid network policy host %q", host)
+			}
+		}
+		for _, cidr := range np.ExtraCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invalid network policy cidr %q", cidr)
+			}
+		}
+	}
+	if mon := c.Monitoring; mon != nil {
+		if errs := validation.IsDNS1123Subdomain(mon.Name); len(errs) > 0 {
+			return fmt.Errorf(
+				"invalid monitoring name %q: %s", mon.Name, strings.Join(errs, ", "),
+			)
+		}
+		for key, value := range mon.Labels {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf(
+					"invalid monitoring label %q: %s", key, strings.Join(errs, ", "),
+				)
+			}
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				return fmt.Errorf(
+					"invalid monitoring label value %q: %s", value, strings.Join(errs, ", "),
+				)
+			}
+		}
+		if mon.Interval != 0 && mon.Interval < time.Second {
+			return fmt.Errorf("monitoring interval must be at least one second")
+		}
+		if mon.StaleAfter != 0 && mon.StaleAfter < time.Minute {
+			return fmt.Errorf("monitoring stale after must be at least one minute")
+		}
+	}
+	if c.GitSync != nil {
+		if c.GitSync.Repository == "" {
+			return fmt.Errorf("git sync repository must be set")
+		}
+		if c.GitSync.Interval < 0 {
+			return fmt.Errorf("negative git sync interval")
+		}
+		if filepath.IsAbs(c.GitSync.Path) ||
+			strings.HasPrefix(filepath.Clean(c.GitSync.Path), "..") {
+			return fmt.Errorf("git sync path must be relative to the repository root")
+		}
+		if ns := c.GitSync.Namespace; ns != "" {
+			if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+				return fmt.Errorf(
+					"invalid git sync namespace %q: %s", ns, strings.Join(errs, ", "),
+				)
+			}
+		}
+	}
+	if name := c.DigestsConfigMap; name != "" {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return fmt.Errorf(
+				"invalid digests config map name %q: %s", name, strings.Join(errs, ", "),
+			)
+		}
+	}
+	if c.Bandwidth.Global < 0 {
+		return fmt.Errorf("negative global bandwidth")
+	}
+	for registry, bps := range c.Bandwidth.Registries {
+		if bps < 0 {
+			return fmt.Errorf("negative bandwidth for registry %s", registry)
+		}
+	}
+	return c.Binds.validate()
+}
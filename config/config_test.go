@@ -0,0 +1,892 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		data     string
+		err      string
+		expected func() *Config
+	}{
+		{
+			name:     "empty data",
+			data:     "",
+			expected: Default,
+		},
+		{
+			name: "partial config",
+			data: "workers: 3\nbinds:\n  quay: \":9091\"\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.Workers = 3
+				cfg.Binds.Quay = ":9091"
+				return cfg
+			},
+		},
+		{
+			name: "ipv6 binds",
+			data: "binds:\n  family: ipv6\n  metrics: \"[::1]:9090\"\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.Binds.Family = AddressFamilyIPv6
+				cfg.Binds.Metrics = "[::1]:9090"
+				return cfg
+			},
+		},
+		{
+			name: "unbracketed ipv6 bind",
+			data: "binds:\n  api: \"::1:8083\"\n",
+			err:  `invalid bind address "::1:8083"`,
+		},
+		{
+			name: "bind address out of the address family",
+			data: "binds:\n  family: ipv6\n  api: \"0.0.0.0:8083\"\n",
+			err:  `ipv4 bind address "0.0.0.0:8083" with ipv6 address family`,
+		},
+		{
+			name: "invalid address family",
+			data: "binds:\n  family: ipv5\n",
+			err:  "address family must be one of dual, ipv4 or ipv6",
+		},
+		{
+			name: "registry mirrors",
+			data: "registryMirrors:\n  docker.io:\n  - mirror.local\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.RegistryMirrors = map[string][]string{
+					"docker.io": {"mirror.local"},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "client certificates",
+			data: "clientCertificates:\n  registry.internal: /etc/tagger/certs/registry.internal\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.ClientCertificates = map[string]string{
+					"registry.internal": "/etc/tagger/certs/registry.internal",
+				}
+				return cfg
+			},
+		},
+		{
+			name: "relative client certificates path",
+			data: "clientCertificates:\n  registry.internal: certs\n",
+			err:  "client certificates for registry.internal must be an absolute path",
+		},
+		{
+			name: "registry requests",
+			data: "registryRequests:\n  userAgent: tagger/1.0\n" +
+				"  registries:\n    quay.io:\n      userAgent: tagger-quay/1.0\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.RegistryRequests = RegistryRequests{
+					RegistryRequest: RegistryRequest{UserAgent: "tagger/1.0"},
+					Registries: map[string]RegistryRequest{
+						"quay.io": {UserAgent: "tagger-quay/1.0"},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "registry header injection",
+			data: "registryRequests:\n  registries:\n    quay.io:\n      userAgent: \"a\\r\\nX-Other: b\"\n",
+			err:  "registry quay.io: invalid user agent",
+		},
+		{
+			name: "registry extra headers",
+			data: "registryRequests:\n  headers:\n    X-Route: internal\n",
+			err:  "field headers not found",
+		},
+		{
+			name: "mutation skips",
+			data: "mutationSkips:\n- kind: Job\n  exceptNamespaces:\n  - ci\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.MutationSkips = []MutationSkip{
+					{
+						Kind:             "Job",
+						ExceptNamespaces: []string{"ci"},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "mutation skip without kind",
+			data: "mutationSkips:\n- name: myoperator\n",
+			err:  "mutation skip rules must set a kind",
+		},
+		{
+			name: "label projections",
+			data: "labelProjections:\n- imageLabel: org.opencontainers.image.revision\n  label: images.io/revision\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.LabelProjections = []LabelProjection{
+					{
+						ImageLabel: "org.opencontainers.image.revision",
+						Label:      "images.io/revision",
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "label projection with label and annotation",
+			data: "labelProjections:\n- imageLabel: vcs-ref\n  label: revision\n  annotation: revision\n",
+			err:  "must set either a label or an annotation",
+		},
+		{
+			name: "label projection with invalid key",
+			data: "labelProjections:\n- imageLabel: vcs-ref\n  annotation: not a key\n",
+			err:  "invalid projection key",
+		},
+		{
+			name: "worker scaling",
+			data: "workerScaling:\n  min: 2\n  max: 50\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.WorkerScaling = &WorkerScaling{Min: 2, Max: 50}
+				return cfg
+			},
+		},
+		{
+			name: "worker scaling with max lower than min",
+			data: "workerScaling:\n  min: 5\n  max: 2\n",
+			err:  "maximum workers must not be lower than the minimum",
+		},
+		{
+			name: "circuit breaker disabled",
+			data: "circuitBreaker:\n  openAfter: 0s\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.CircuitBreaker.OpenAfter = 0
+				return cfg
+			},
+		},
+		{
+			name: "circuit breaker without probe interval",
+			data: "circuitBreaker:\n  openAfter: 10m\n  probeInterval: 0s\n",
+			err:  "probe interval must be greater than zero",
+		},
+		{
+			name: "reject disabled tags",
+			data: "disabledTags: reject\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.DisabledTags = DisabledTagsReject
+				return cfg
+			},
+		},
+		{
+			name: "invalid disabled tags",
+			data: "disabledTags: ignore\n",
+			err:  "disabled tags must be either fallback or reject",
+		},
+		{
+			name: "pod webhook selectors",
+			data: "podWebhook:\n  configuration: tagger\n  namespaceSelector:\n    matchLabels:\n      tagger: enabled\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.PodWebhook = &PodWebhook{
+					Configuration: "tagger",
+					NamespaceSelector: &Selector{
+						MatchLabels: map[string]string{"tagger": "enabled"},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "invalid pod webhook selector",
+			data: "podWebhook:\n  configuration: tagger\n  objectSelector:\n    matchExpressions:\n    - key: tagger\n      operator: Maybe\n",
+			err:  "invalid pod webhook selector",
+		},
+		{
+			name: "pod webhook without configuration",
+			data: "podWebhook:\n  objectSelector:\n    matchLabels:\n      tagger: enabled\n",
+			err:  "pod webhook configuration name must be set",
+		},
+		{
+			name: "network policy",
+			data: "networkPolicy:\n  name: tagger-egress\n  podSelector:\n    matchLabels:\n      app: tagger\n  extraHosts:\n  - production.cloudflare.docker.com\n  extraCIDRs:\n  - 10.0.0.0/8\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.NetworkPolicy = &NetworkPolicy{
+					Name: "tagger-egress",
+					PodSelector: &Selector{
+						MatchLabels: map[string]string{"app": "tagger"},
+					},
+					ExtraHosts: []string{"production.cloudflare.docker.com"},
+					ExtraCIDRs: []string{"10.0.0.0/8"},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "network policy without name",
+			data: "networkPolicy:\n  extraHosts:\n  - cdn.example.com\n",
+			err:  "invalid network policy name",
+		},
+		{
+			name: "invalid network policy pod selector",
+			data: "networkPolicy:\n  name: egress\n  podSelector:\n    matchExpressions:\n    - key: app\n      operator: Maybe\n",
+			err:  "invalid network policy pod selector",
+		},
+		{
+			name: "invalid network policy host",
+			data: "networkPolicy:\n  name: egress\n  extraHosts:\n  - https://cdn.example.com\n",
+			err:  "invalid network policy host",
+		},
+		{
+			name: "invalid network policy cidr",
+			data: "networkPolicy:\n  name: egress\n  extraCIDRs:\n  - 10.0.0.1\n",
+			err:  "invalid network policy cidr",
+		},
+		{
+			name: "monitoring",
+			data: "monitoring:\n  name: tagger\n  labels:\n    release: prometheus\n  interval: 30s\n  staleAfter: 2h\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.Monitoring = &Monitoring{
+					Name:       "tagger",
+					Labels:     map[string]string{"release": "prometheus"},
+					Interval:   30 * time.Second,
+					StaleAfter: 2 * time.Hour,
+				}
+				return cfg
+			},
+		},
+		{
+			name: "import schedule",
+			data: "importSchedule:\n  maxConcurrent: 5\n  blackouts:\n  - name: batch\n    days: [Mon, Fri]\n    start: \"22:00\"\n    duration: 4h\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.ImportSchedule = ImportSchedule{
+					MaxConcurrent: 5,
+					Blackouts: []Blackout{
+						{
+							Name:     "batch",
+							Days:     []string{"Mon", "Fri"},
+							Start:    "22:00",
+							Duration: 4 * time.Hour,
+						},
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "negative max concurrent imports",
+			data: "importSchedule:\n  maxConcurrent: -1\n",
+			err:  "negative max concurrent imports",
+		},
+		{
+			name: "blackout with invalid start",
+			data: "importSchedule:\n  blackouts:\n  - name: batch\n    start: 10pm\n    duration: 4h\n",
+			err:  "blackout batch: invalid start",
+		},
+		{
+			name: "blackout with invalid day",
+			data: "importSchedule:\n  blackouts:\n  - name: batch\n    days: [Monday]\n    start: \"22:00\"\n    duration: 4h\n",
+			err:  "blackout batch: invalid day",
+		},
+		{
+			name: "blackout without duration",
+			data: "importSchedule:\n  blackouts:\n  - name: batch\n    start: \"22:00\"\n",
+			err:  "blackout batch: duration must be within a week",
+		},
+		{
+			name: "monitoring without name",
+			data: "monitoring:\n  interval: 30s\n",
+			err:  "invalid monitoring name",
+		},
+		{
+			name: "invalid monitoring label",
+			data: "monitoring:\n  name: tagger\n  labels:\n    -release: prometheus\n",
+			err:  "invalid monitoring label",
+		},
+		{
+			name: "monitoring interval too short",
+			data: "monitoring:\n  name: tagger\n  interval: 500ms\n",
+			err:  "monitoring interval must be at least one second",
+		},
+		{
+			name: "monitoring stale after too short",
+			data: "monitoring:\n  name: tagger\n  staleAfter: 30s\n",
+			err:  "monitoring stale after must be at least one minute",
+		},
+		{
+			name: "git sync",
+			data: "gitSync:\n  repository: https://git.example.com/tags.git\n  path: clusters/prod\n  interval: 1m\n  prune: true\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.GitSync = &GitSync{
+					Repository: "https://git.example.com/tags.git",
+					Path:       "clusters/prod",
+					Interval:   time.Minute,
+					Prune:      true,
+				}
+				return cfg
+			},
+		},
+		{
+			name: "git sync without repository",
+			data: "gitSync:\n  path: clusters/prod\n",
+			err:  "git sync repository must be set",
+		},
+		{
+			name: "git sync path outside the repository",
+			data: "gitSync:\n  repository: https://git.example.com/tags.git\n  path: ../prod\n",
+			err:  "git sync path must be relative to the repository root",
+		},
+		{
+			name: "invalid git sync namespace",
+			data: "gitSync:\n  repository: https://git.example.com/tags.git\n  namespace: Prod\n",
+			err:  "invalid git sync namespace",
+		},
+		{
+			name: "drain timeout",
+			data: "drainTimeout: 5s",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.DrainTimeout = 5 * time.Second
+				return cfg
+			},
+		},
+		{
+			name: "invalid drain timeout",
+			data: "drainTimeout: 0s",
+			err:  "drain timeout must be greater than zero",
+		},
+		{
+			name: "cache miss reads disabled",
+			data: "cacheMissTimeout: 0s",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.CacheMissTimeout = 0
+				return cfg
+			},
+		},
+		{
+			name: "negative cache miss timeout",
+			data: "cacheMissTimeout: -1s",
+			err:  "negative cache miss timeout",
+		},
+		{
+			name: "import cache disabled",
+			data: "importCacheTTL: 0s",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.ImportCacheTTL = 0
+				return cfg
+			},
+		},
+		{
+			name: "negative import cache ttl",
+			data: "importCacheTTL: -1s",
+			err:  "negative import cache ttl",
+		},
+		{
+			name: "catalog report",
+			data: "catalogReportInterval: 1h",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.CatalogReportInterval = time.Hour
+				return cfg
+			},
+		},
+		{
+			name: "negative catalog report interval",
+			data: "catalogReportInterval: -1s",
+			err:  "negative catalog report interval",
+		},
+		{
+			name: "signing key",
+			data: "signingKey: /etc/tagger/signing/key.pem",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.SigningKey = "/etc/tagger/signing/key.pem"
+				return cfg
+			},
+		},
+		{
+			name: "relative signing key",
+			data: "signingKey: signing/key.pem",
+			err:  "signing key must be an absolute path",
+		},
+		{
+			name: "scratch directory",
+			data: "scratchDir: /var/run/tagger",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.ScratchDir = "/var/run/tagger"
+				return cfg
+			},
+		},
+		{
+			name: "relative scratch directory",
+			data: "scratchDir: scratch",
+			err:  "scratch directory must be an absolute path",
+		},
+		{
+			name: "empty scratch directory",
+			data: "scratchDir: \"\"",
+			err:  "scratch directory must be an absolute path",
+		},
+		{
+			name: "overload protection disabled",
+			data: "overload:\n  memoryThreshold: 0\n  fileThreshold: 0\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.Overload = OverloadProtection{}
+				return cfg
+			},
+		},
+		{
+			name: "invalid overload memory threshold",
+			data: "overload:\n  memoryThreshold: 1.5\n",
+			err:  "overload memory threshold must be between 0 and 1",
+		},
+		{
+			name: "negative overload file threshold",
+			data: "overload:\n  fileThreshold: -0.5\n",
+			err:  "overload file threshold must be between 0 and 1",
+		},
+		{
+			name: "digests config map",
+			data: "digestsConfigMap: image-digests",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.DigestsConfigMap = "image-digests"
+				return cfg
+			},
+		},
+		{
+			name: "invalid digests config map",
+			data: "digestsConfigMap: Image_Digests",
+			err:  "invalid digests config map name",
+		},
+		{
+			name: "bandwidth",
+			data: "bandwidth:\n  global: 1024\n  registries:\n    quay.io: 512\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.Bandwidth = Bandwidth{
+					Global: 1024,
+					Registries: map[string]int64{
+						"quay.io": 512,
+					},
+				}
+				return cfg
+			},
+		},
+		{
+			name: "credentials namespace",
+			data: "credentialsNamespace: registry-credentials\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.CredentialsNamespace = "registry-credentials"
+				return cfg
+			},
+		},
+		{
+			name: "service account credentials",
+			data: "credentialsSource: serviceAccount\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.CredentialsSource = CredentialsFromServiceAccount
+				return cfg
+			},
+		},
+		{
+			name: "invalid credentials source",
+			data: "credentialsSource: node\n",
+			err:  "credentials source must be either secrets or serviceAccount",
+		},
+		{
+			name: "service account and shared credentials",
+			data: "credentialsSource: serviceAccount\ncredentialsNamespace: shared\n",
+			err:  "shared credentials can't be used with service account credentials",
+		},
+		{
+			name: "auto rollback",
+			data: "autoRollback:\n  namespaces:\n  - prod\n  deadline: 5m\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.AutoRollback = AutoRollback{
+					Namespaces: []string{"prod"},
+					Deadline:   5 * time.Minute,
+				}
+				return cfg
+			},
+		},
+		{
+			name: "invalid auto rollback deadline",
+			data: "autoRollback:\n  deadline: 0s\n",
+			err:  "auto rollback deadline must be greater than zero",
+		},
+		{
+			name: "digest enforcement",
+			data: "digestEnforcement:\n  namespaces:\n  - prod\n  dryRun: true\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.DigestEnforcement = DigestEnforcement{
+					Namespaces: []string{"prod"},
+					DryRun:     true,
+				}
+				return cfg
+			},
+		},
+		{
+			name: "import audit",
+			data: "importAudit:\n  enabled: false\n  retention: 24h\n  maxPerTag: 10\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.ImportAudit = ImportAudit{
+					Retention: 24 * time.Hour,
+					MaxPerTag: 10,
+				}
+				return cfg
+			},
+		},
+		{
+			name: "invalid import audit retention",
+			data: "importAudit:\n  retention: 0s\n",
+			err:  "import audit retention must be greater than zero",
+		},
+		{
+			name: "invalid import audits per tag",
+			data: "importAudit:\n  maxPerTag: 0\n",
+			err:  "import audits per tag must be greater than zero",
+		},
+		{
+			name: "platforms",
+			data: "platforms:\n- linux/amd64\n- linux/arm64/v8\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.Platforms = []string{"linux/amd64", "linux/arm64/v8"}
+				return cfg
+			},
+		},
+		{
+			name: "invalid platform",
+			data: "platforms:\n- amd64\n",
+			err:  "invalid platform \"amd64\"",
+		},
+		{
+			name: "negative bandwidth",
+			data: "bandwidth:\n  registries:\n    quay.io: -1\n",
+			err:  "negative bandwidth for registry quay.io",
+		},
+		{
+			name: "layer parallelism",
+			data: "layerParallelism: 2\nlayerRetries: 0\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.LayerParallelism = 2
+				cfg.LayerRetries = 0
+				return cfg
+			},
+		},
+		{
+			name: "invalid layer parallelism",
+			data: "layerParallelism: 7",
+			err:  "layer parallelism must be between 1 and 6",
+		},
+		{
+			name: "invalid upload chunk size",
+			data: "uploadChunkSize: 0",
+			err:  "upload chunk size must be greater than zero",
+		},
+		{
+			name: "max in-flight bytes",
+			data: "uploadChunkSize: 1048576\nmaxInflightBytes: 67108864",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.UploadChunkSize = 1 << 20
+				cfg.MaxInflightBytes = 64 << 20
+				return cfg
+			},
+		},
+		{
+			name: "unlimited in-flight bytes",
+			data: "maxInflightBytes: 0",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.MaxInflightBytes = 0
+				return cfg
+			},
+		},
+		{
+			name: "import deadline",
+			data: "importDeadline:\n  minimum: 5m\n  perGiB: 1m\n  maximum: 1h\n",
+			expected: func() *Config {
+				cfg := Default()
+				cfg.ImportDeadline = ImportDeadline{
+					Minimum: 5 * time.Minute,
+					PerGiB:  time.Minute,
+					Maximum: time.Hour,
+				}
+				return cfg
+			},
+		},
+		{
+			name: "zero minimum import deadline",
+			data: "importDeadline:\n  minimum: 0s\n",
+			err:  "minimum import deadline must be greater than zero",
+		},
+		{
+			name: "negative import deadline per GiB",
+			data: "importDeadline:\n  perGiB: -1m\n",
+			err:  "negative import deadline per GiB",
+		},
+		{
+			name: "maximum import deadline below minimum",
+			data: "importDeadline:\n  minimum: 10m\n  maximum: 5m\n",
+			err:  "maximum import deadline must not be lower than the minimum",
+		},
+		{
+			name: "negative max in-flight bytes",
+			data: "maxInflightBytes: -1",
+			err:  "negative max in-flight bytes",
+		},
+		{
+			name: "max in-flight bytes below chunk size",
+			data: "uploadChunkSize: 33554432\nmaxInflightBytes: 16777216",
+			err:  "max in-flight bytes must be at least the upload chunk size",
+		},
+		{
+			name: "invalid workers",
+			data: "workers: 0",
+			err:  "workers must be greater than zero",
+		},
+		{
+			name: "empty unqualified registries",
+			data: "unqualifiedRegistries: []",
+			err:  "at least one unqualified registry must be set",
+		},
+		{
+			name: "unknown field",
+			data: "foo: bar",
+			err:  "invalid configuration",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse(tt.data)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			if !reflect.DeepEqual(cfg, tt.expected()) {
+				t.Errorf("expected %+v, %+v received", tt.expected(), cfg)
+			}
+		})
+	}
+}
+
+func TestMutationSkipMatches(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		skip      MutationSkip
+		namespace string
+		kind      string
+		expected  bool
+	}{
+		{
+			name:      "different kind",
+			skip:      MutationSkip{Kind: "Job"},
+			namespace: "ns",
+			kind:      "CronJob",
+		},
+		{
+			name:      "any namespace",
+			skip:      MutationSkip{Kind: "Job"},
+			namespace: "ns",
+			kind:      "Job",
+			expected:  true,
+		},
+		{
+			name: "excepted namespace",
+			skip: MutationSkip{
+				Kind:             "Job",
+				ExceptNamespaces: []string{"ns"},
+			},
+			namespace: "ns",
+			kind:      "Job",
+		},
+		{
+			name: "listed namespace",
+			skip: MutationSkip{
+				Kind:       "Job",
+				Namespaces: []string{"ns"},
+			},
+			namespace: "ns",
+			kind:      "Job",
+			expected:  true,
+		},
+		{
+			name: "namespace not listed",
+			skip: MutationSkip{
+				Kind:       "Job",
+				Namespaces: []string{"other"},
+			},
+			namespace: "ns",
+			kind:      "Job",
+		},
+		{
+			name: "different name",
+			skip: MutationSkip{
+				Kind: "Job",
+				Name: "other",
+			},
+			namespace: "ns",
+			kind:      "Job",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.skip.Matches(tt.namespace, "batch/v1", tt.kind, "myjob")
+			if res != tt.expected {
+				t.Errorf("expected %v, %v received", tt.expected, res)
+			}
+		})
+	}
+}
+
+func TestBindsNetwork(t *testing.T) {
+	for family, network := range map[string]string{
+		AddressFamilyDual: "tcp",
+		AddressFamilyIPv4: "tcp4",
+		AddressFamilyIPv6: "tcp6",
+	} {
+		binds := Binds{Family: family}
+		if binds.Network() != network {
+			t.Errorf("expected %s for %s, %s received", network, family, binds.Network())
+		}
+	}
+}
+
+func TestRegistryRequestsUserAgentFor(t *testing.T) {
+	requests := RegistryRequests{
+		RegistryRequest: RegistryRequest{UserAgent: "tagger/1.0"},
+		Registries: map[string]RegistryRequest{
+			"quay.io":   {UserAgent: "tagger-quay/1.0"},
+			"docker.io": {},
+		},
+	}
+
+	for registry, expected := range map[string]string{
+		"registry.internal": "tagger/1.0",
+		"quay.io":           "tagger-quay/1.0",
+		"docker.io":         "tagger/1.0",
+	} {
+		if agent := requests.UserAgentFor(registry); agent != expected {
+			t.Errorf("expected %q for %s, %q received", expected, registry, agent)
+		}
+	}
+}
+
+func TestImportDeadlineFor(t *testing.T) {
+	deadline := Default().ImportDeadline
+	for _, tt := range []struct {
+		name     string
+		size     int64
+		expected time.Duration
+	}{
+		{
+			name:     "unknown size",
+			expected: 3 * time.Minute,
+		},
+		{
+			name:     "small image",
+			size:     100 << 20,
+			expected: 3 * time.Minute,
+		},
+		{
+			name:     "proportional to size",
+			size:     5 << 30,
+			expected: 10 * time.Minute,
+		},
+		{
+			name:     "capped at maximum",
+			size:     100 << 30,
+			expected: 30 * time.Minute,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deadline.For(tt.size); got != tt.expected {
+				t.Errorf("expected %s, %s received", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestBlackoutActive(t *testing.T) {
+	// 2021-01-04 is a Monday.
+	monday := func(hour, min int) time.Time {
+		return time.Date(2021, 1, 4, hour, min, 0, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		name     string
+		blackout Blackout
+		now      time.Time
+		expected bool
+	}{
+		{
+			name:     "every day within",
+			blackout: Blackout{Start: "09:00", Duration: time.Hour},
+			now:      monday(9, 30),
+			expected: true,
+		},
+		{
+			name:     "every day after",
+			blackout: Blackout{Start: "09:00", Duration: time.Hour},
+			now:      monday(10, 0),
+		},
+		{
+			name:     "other day",
+			blackout: Blackout{Days: []string{"Tue"}, Start: "09:00", Duration: time.Hour},
+			now:      monday(9, 30),
+		},
+		{
+			name:     "past midnight",
+			blackout: Blackout{Days: []string{"Sun"}, Start: "22:00", Duration: 4 * time.Hour},
+			now:      monday(1, 0),
+			expected: true,
+		},
+		{
+			name:     "over the weekend",
+			blackout: Blackout{Days: []string{"Fri"}, Start: "18:00", Duration: 63 * time.Hour},
+			now:      monday(8, 59),
+			expected: true,
+		},
+		{
+			name:     "other time zone",
+			blackout: Blackout{Start: "09:00", Duration: time.Hour},
+			now:      monday(9, 30).In(time.FixedZone("UTC+2", 2*60*60)),
+			expected: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if active := tt.blackout.Active(tt.now); active != tt.expected {
+				t.Errorf("expected active %v, %v received", tt.expected, active)
+			}
+		})
+	}
+}
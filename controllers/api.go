@@ -0,0 +1,597 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// TagInventory abstraction exists to make testing easier. It reads and acts
+// upon Tags on behalf of API callers. You most likely wanna see Tag struct
+// under services/tag.go for a concrete implementation of this.
+type TagInventory interface {
+	Get(namespace, name string) (*imagtagv1.Tag, error)
+	List(namespace string, selector labels.Selector) ([]*imagtagv1.Tag, error)
+	Upgrade(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error)
+	Downgrade(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error)
+	RollbackToKnownGood(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error)
+	NewGeneration(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error)
+	DiffNamespaces(name string, namespaces []string) (*imagtagv1.ProvenanceDiff, error)
+	ResolveAt(ctx context.Context, namespace, name string, at time.Time) (*imagtagv1.Resolution, error)
+	SimulateImport(ctx context.Context, namespace, image string) *imagtagv1.ImportSimulation
+}
+
+// Authorizer abstraction exists to make testing easier. It authenticates API
+// callers by their bearer token and authorizes them against Tags. See Auth
+// struct under services/auth.go for a concrete implementation.
+type Authorizer interface {
+	Authenticate(ctx context.Context, token string) (authnv1.UserInfo, error)
+	Authorize(
+		ctx context.Context, user authnv1.UserInfo, verb, namespace, name string,
+	) (bool, error)
+}
+
+// APIPrefix is the path prefix for all API endpoints.
+const APIPrefix = "/api/v1/"
+
+// MaxAPIPageSize is the maximum number of Tags returned in a single page, it
+// is also the default page size.
+const MaxAPIPageSize = 500
+
+// API serves the Tag inventory over http. Callers are authenticated through
+// their bearer token and authorized against the Tags they read or change,
+// i.e. cluster RBAC applies. Endpoints are:
+//
+//	GET  /api/v1/tags
+//	GET  /api/v1/namespaces/<namespace>/tags
+//	GET  /api/v1/namespaces/<namespace>/tags/<name>
+//	GET  /api/v1/namespaces/<namespace>/tags/<name>/generations
+//	GET  /api/v1/namespaces/<namespace>/tags/<name>/resolve?at=<RFC3339 time>
+//	POST /api/v1/namespaces/<namespace>/tags/<name>/upgrade
+//	POST /api/v1/namespaces/<namespace>/tags/<name>/downgrade
+//	POST /api/v1/namespaces/<namespace>/tags/<name>/rollback
+//	POST /api/v1/namespaces/<namespace>/tags/<name>/import
+//	GET  /api/v1/tags/<name>/diff?namespaces=<namespace>,<namespace>
+//	GET  /api/v1/namespaces/<namespace>/simulate?image=<image reference>
+//	GET  /openapi/v3
+//
+// Generations returns the generation history of the Tag, with digests, import
+// times, triggers and rollout outcomes. Resolve returns the image the Tag
+// resolved to at the provided time, for incident investigations. Diffs
+// compare the digest the Tag runs in each of the namespaces, callers must be
+// allowed to get Tags in all of them. Simulate reports whether importing the
+// image into the namespace would be accepted, without importing it, callers
+// must be allowed to create Tags in the namespace.
+//
+// Lists accept the following query parameters:
+//
+//	namespace      only Tags in this namespace (for /api/v1/tags)
+//	labelSelector  only Tags matching this label selector
+//	limit          page size, up to MaxAPIPageSize
+//	continue       token, returned in a list, to fetch its next page
+//
+// All endpoints accept a "fields" query parameter with a comma separated
+// list of dotted fields (e.g. "metadata.name,status.generation") to return
+// instead of the whole Tag. An OpenAPI v3 document describing the endpoints
+// is served under OpenAPIPath.
+type API struct {
+	server  *httpServer
+	tagsvc  TagInventory
+	authsvc Authorizer
+	openapi map[string]interface{}
+}
+
+// NewAPI returns a new Tag inventory API server.
+func NewAPI(tagsvc TagInventory, authsvc Authorizer) *API {
+	api := &API{
+		tagsvc:  tagsvc,
+		authsvc: authsvc,
+		openapi: openAPIDocument(apiRoutes),
+	}
+	api.server = newHTTPServer(api.Name(), config.Default().Binds.API, api)
+	api.server.key = "assets/server.key"
+	api.server.cert = "assets/server.crt"
+	return api
+}
+
+// Name returns a name identifier for this controller.
+func (a *API) Name() string {
+	return "tag api"
+}
+
+// apiRequest holds what has been requested, as parsed from the request path.
+type apiRequest struct {
+	namespace string
+	name      string
+	action    string
+	selector  labels.Selector
+	limit     int
+	cont      string
+	fields    []string
+	// namespaces are the namespaces compared by a diff.
+	namespaces []string
+	// at is the time a resolution is requested for.
+	at time.Time
+	// image is the image reference an import is simulated for.
+	image string
+	// visible, if set, tells if the caller may see the Tags in a
+	// namespace. Set for lists across all namespaces by callers not
+	// allowed to list Tags in all of them.
+	visible func(ctx context.Context, namespace string) (bool, error)
+}
+
+// readOnly returns true if the request action does not change the Tag.
+func (r apiRequest) readOnly() bool {
+	switch r.action {
+	case "diff", "generations", "resolve", "simulate":
+		return true
+	}
+	return false
+}
+
+// allNamespaces returns true if the request lists Tags in all namespaces.
+func (r apiRequest) allNamespaces() bool {
+	return r.namespace == "" && r.name == "" && r.action == ""
+}
+
+// verb returns the Kubernetes verb the request maps to.
+func (r apiRequest) verb() string {
+	switch {
+	case r.action == "simulate":
+		return "create"
+	case r.readOnly():
+		return "get"
+	case r.action != "":
+		return "update"
+	case r.name != "":
+		return "get"
+	default:
+		return "list"
+	}
+}
+
+// parseAPIPath parses the request path into an apiRequest.
+func parseAPIPath(path string) (apiRequest, error) {
+	var req apiRequest
+	if !strings.HasPrefix(path, APIPrefix) {
+		return req, fmt.Errorf("unknown path")
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, APIPrefix), "/"), "/")
+	if len(parts) == 1 && parts[0] == "tags" {
+		return req, nil
+	}
+	if len(parts) == 3 && parts[0] == "tags" && parts[1] != "" && parts[2] == "diff" {
+		req.name = parts[1]
+		req.action = "diff"
+		return req, nil
+	}
+	if len(parts) == 3 && parts[0] == "namespaces" && parts[1] != "" &&
+		parts[2] == "simulate" {
+		req.namespace = parts[1]
+		req.action = "simulate"
+		return req, nil
+	}
+	if len(parts) < 3 || parts[0] != "namespaces" || parts[2] != "tags" {
+		return req, fmt.Errorf("unknown path")
+	}
+
+	req.namespace = parts[1]
+	switch len(parts) {
+	case 3:
+	case 4:
+		req.name = parts[3]
+	case 5:
+		req.name = parts[3]
+		req.action = parts[4]
+		switch req.action {
+		case "upgrade", "downgrade", "rollback", "import", "generations", "resolve":
+		default:
+			return req, fmt.Errorf("unknown action %q", req.action)
+		}
+	default:
+		return req, fmt.Errorf("unknown path")
+	}
+	if req.namespace == "" || (len(parts) > 3 && req.name == "") {
+		return req, fmt.Errorf("unknown path")
+	}
+	return req, nil
+}
+
+// parseAPIQuery parses list options and field selection from query into req.
+func parseAPIQuery(req *apiRequest, query url.Values) error {
+	if fields := query.Get("fields"); fields != "" {
+		req.fields = strings.Split(fields, ",")
+	}
+	if req.action == "diff" {
+		for _, ns := range strings.Split(query.Get("namespaces"), ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				req.namespaces = append(req.namespaces, ns)
+			}
+		}
+		if len(req.namespaces) < 2 {
+			return fmt.Errorf("at least two namespaces must be compared")
+		}
+		return nil
+	}
+	if req.action == "simulate" {
+		if req.image = query.Get("image"); req.image == "" {
+			return fmt.Errorf("image to simulate the import of must be provided")
+		}
+		return nil
+	}
+	if req.action == "resolve" {
+		at, err := time.Parse(time.RFC3339, query.Get("at"))
+		if err != nil {
+			return fmt.Errorf("invalid time %q, use RFC3339", query.Get("at"))
+		}
+		req.at = at
+		return nil
+	}
+	if req.name != "" {
+		return nil
+	}
+
+	if req.namespace == "" {
+		req.namespace = query.Get("namespace")
+	}
+
+	selector, err := labels.Parse(query.Get("labelSelector"))
+	if err != nil {
+		return fmt.Errorf("invalid label selector: %w", err)
+	}
+	req.selector = selector
+
+	req.limit = MaxAPIPageSize
+	if limit := query.Get("limit"); limit != "" {
+		req.limit, err = strconv.Atoi(limit)
+		if err != nil || req.limit < 1 {
+			return fmt.Errorf("invalid limit %q", limit)
+		}
+		if req.limit > MaxAPIPageSize {
+			req.limit = MaxAPIPageSize
+		}
+	}
+
+	if cont := query.Get("continue"); cont != "" {
+		key, err := base64.RawURLEncoding.DecodeString(cont)
+		if err != nil {
+			return fmt.Errorf("invalid continue token")
+		}
+		req.cont = string(key)
+	}
+	return nil
+}
+
+// paginate returns the page of tags after the continue key and up to limit
+// long. Tags must be sorted by namespace and name. If there are more Tags
+// after the page a token to fetch the next page is returned as well.
+func paginate(tags []*imagtagv1.Tag, cont string, limit int) ([]*imagtagv1.Tag, string) {
+	start := sort.Search(len(tags), func(i int) bool {
+		return tagKey(tags[i]) > cont
+	})
+	tags = tags[start:]
+	if len(tags) <= limit {
+		return tags, ""
+	}
+
+	tags = tags[:limit]
+	last := tagKey(tags[len(tags)-1])
+	return tags, base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// tagKey returns the key used to sort Tags, namespace and name.
+func tagKey(it *imagtagv1.Tag) string {
+	return it.Namespace + "/" + it.Name
+}
+
+// selectFields returns a copy of obj containing only the provided fields, as
+// dotted paths. Fields not present in obj are ignored.
+func selectFields(obj interface{}, fields []string) (map[string]interface{}, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var src map[string]interface{}
+	if err := json.Unmarshal(data, &src); err != nil {
+		return nil, err
+	}
+
+	dst := map[string]interface{}{}
+	for _, field := range fields {
+		path := strings.Split(strings.TrimSpace(field), ".")
+
+		var val interface{} = src
+		for _, key := range path {
+			obj, ok := val.(map[string]interface{})
+			if !ok {
+				val = nil
+				break
+			}
+			if val, ok = obj[key]; !ok {
+				break
+			}
+		}
+		if val == nil {
+			continue
+		}
+
+		to := dst
+		for _, key := range path[:len(path)-1] {
+			if _, ok := to[key].(map[string]interface{}); !ok {
+				to[key] = map[string]interface{}{}
+			}
+			to = to[key].(map[string]interface{})
+		}
+		to[path[len(path)-1]] = val
+	}
+	return dst, nil
+}
+
+// writeError writes a json encoded error with the provided status code.
+func (a *API) writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+}
+
+// writeObject writes obj json encoded.
+func (a *API) writeObject(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		klog.Errorf("error encoding api response: %s", err)
+	}
+}
+
+// authorize authenticates the caller and checks if it can perform the request.
+// Returns false if the request should not proceed, an error has already been
+// written to the response in this case. Callers not allowed to list Tags in
+// all namespaces have their list restricted to the namespaces they can list
+// Tags in.
+func (a *API) authorize(w http.ResponseWriter, r *http.Request, req *apiRequest) bool {
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		a.writeError(w, http.StatusUnauthorized, fmt.Errorf("bearer token required"))
+		return false
+	}
+
+	user, err := a.authsvc.Authenticate(r.Context(), token)
+	if err != nil {
+		klog.V(2).Infof("api authentication failed: %s", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		a.writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+		return false
+	}
+
+	namespaces := []string{req.namespace}
+	if req.action == "diff" {
+		namespaces = req.namespaces
+	}
+	for _, ns := range namespaces {
+		allowed, err := a.authsvc.Authorize(
+			r.Context(), user, req.verb(), ns, req.name,
+		)
+		if err != nil {
+			klog.Errorf("api authorization failed: %s", err)
+			a.writeError(w, http.StatusInternalServerError, fmt.Errorf("unable to authorize"))
+			return false
+		}
+		if !allowed && req.allNamespaces() {
+			req.visible = func(ctx context.Context, namespace string) (bool, error) {
+				return a.authsvc.Authorize(ctx, user, req.verb(), namespace, "")
+			}
+			return true
+		}
+		if !allowed {
+			a.writeError(
+				w,
+				http.StatusForbidden,
+				fmt.Errorf("%s can't %s tags in %q", user.Username, req.verb(), ns),
+			)
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP authenticates and authorizes the caller and then serves the
+// request. The OpenAPI document is served to anyone.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == OpenAPIPath {
+		if r.Method != http.MethodGet {
+			a.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use GET"))
+			return
+		}
+		a.writeObject(w, a.openapi)
+		return
+	}
+
+	req, err := parseAPIPath(r.URL.Path)
+	if err != nil {
+		a.writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := parseAPIQuery(&req, r.URL.Query()); err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	expected := http.MethodGet
+	if req.action != "" && !req.readOnly() {
+		expected = http.MethodPost
+	}
+	if r.Method != expected {
+		a.writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use %s", expected))
+		return
+	}
+
+	if !a.authorize(w, r, &req) {
+		return
+	}
+
+	obj, err := a.serve(r.Context(), req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.IsNotFound(err):
+			code = http.StatusNotFound
+		case errors.IsConflict(err):
+			code = http.StatusConflict
+		case req.action != "":
+			code = http.StatusBadRequest
+		}
+		a.writeError(w, code, err)
+		return
+	}
+	a.writeObject(w, obj)
+}
+
+// serve returns the object requested by req.
+func (a *API) serve(ctx context.Context, req apiRequest) (interface{}, error) {
+	var it *imagtagv1.Tag
+	var err error
+	switch req.action {
+	case "upgrade":
+		it, err = a.tagsvc.Upgrade(ctx, req.namespace, req.name)
+	case "downgrade":
+		it, err = a.tagsvc.Downgrade(ctx, req.namespace, req.name)
+	case "rollback":
+		it, err = a.tagsvc.RollbackToKnownGood(ctx, req.namespace, req.name)
+	case "import":
+		it, err = a.tagsvc.NewGeneration(ctx, req.namespace, req.name)
+	case "diff":
+		return a.tagsvc.DiffNamespaces(req.name, req.namespaces)
+	case "generations":
+		if it, err = a.tagsvc.Get(req.namespace, req.name); err != nil {
+			return nil, err
+		}
+		return it.GenerationHistory(), nil
+	case "resolve":
+		return a.tagsvc.ResolveAt(ctx, req.namespace, req.name, req.at)
+	case "simulate":
+		return a.tagsvc.SimulateImport(ctx, req.namespace, req.image), nil
+	default:
+		if req.name == "" {
+			return a.list(ctx, req)
+		}
+		it, err = a.tagsvc.Get(req.namespace, req.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.fields) > 0 {
+		return selectFields(withTagTypeMeta(it), req.fields)
+	}
+	return withTagTypeMeta(it), nil
+}
+
+// list returns a page of Tags as requested by req. Tags in namespaces not
+// visible to the caller are left out, before paginating.
+func (a *API) list(ctx context.Context, req apiRequest) (interface{}, error) {
+	tags, err := a.tagsvc.List(req.namespace, req.selector)
+	if err != nil {
+		return nil, err
+	}
+	if req.visible != nil {
+		if tags, err = visibleTags(ctx, tags, req.visible); err != nil {
+			return nil, err
+		}
+	}
+
+	page, next := paginate(tags, req.cont, req.limit)
+	list := tagList(page)
+	list.Continue = next
+	if len(req.fields) == 0 {
+		return list, nil
+	}
+
+	items := make([]interface{}, 0, len(list.Items))
+	for _, it := range list.Items {
+		item, err := selectFields(it, req.fields)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return map[string]interface{}{
+		"apiVersion": list.APIVersion,
+		"kind":       list.Kind,
+		"metadata":   list.ListMeta,
+		"items":      items,
+	}, nil
+}
+
+// visibleTags returns the Tags in the namespaces visible is true for. Each
+// namespace is checked once.
+func visibleTags(
+	ctx context.Context,
+	tags []*imagtagv1.Tag,
+	visible func(ctx context.Context, namespace string) (bool, error),
+) ([]*imagtagv1.Tag, error) {
+	checked := map[string]bool{}
+	var filtered []*imagtagv1.Tag
+	for _, it := range tags {
+		allowed, ok := checked[it.Namespace]
+		if !ok {
+			var err error
+			if allowed, err = visible(ctx, it.Namespace); err != nil {
+				return nil, fmt.Errorf("unable to authorize: %w", err)
+			}
+			checked[it.Namespace] = allowed
+		}
+		if allowed {
+			filtered = append(filtered, it)
+		}
+	}
+	return filtered, nil
+}
+
+// tagList returns a TagList containing copies of the provided Tags.
+func tagList(tags []*imagtagv1.Tag) *imagtagv1.TagList {
+	list := &imagtagv1.TagList{
+		Items: make([]imagtagv1.Tag, 0, len(tags)),
+	}
+	list.APIVersion = imagtagv1.SchemeGroupVersion.String()
+	list.Kind = "TagList"
+	for _, it := range tags {
+		list.Items = append(list.Items, *withTagTypeMeta(it))
+	}
+	return list
+}
+
+// withTagTypeMeta returns a copy of the Tag with api version and kind set.
+func withTagTypeMeta(it *imagtagv1.Tag) *imagtagv1.Tag {
+	it = it.DeepCopy()
+	it.APIVersion = imagtagv1.SchemeGroupVersion.String()
+	it.Kind = "Tag"
+	return it
+}
+
+// ApplyConfig moves the http server to the configured bind address and sets
+// for how long in-flight requests are drained on shutdown.
+func (a *API) ApplyConfig(cfg *config.Config) {
+	a.server.applyConfig(cfg.Binds.API, cfg.Binds.Network(), cfg.DrainTimeout)
+}
+
+// Start puts the http server online.
+func (a *API) Start(ctx context.Context) error {
+	return a.server.run(ctx)
+}
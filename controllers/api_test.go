@@ -0,0 +1,875 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+type inventory struct {
+	tags []*imagtagv1.Tag
+}
+
+func (i *inventory) Get(namespace, name string) (*imagtagv1.Tag, error) {
+	for _, it := range i.tags {
+		if it.Namespace == namespace && it.Name == name {
+			return it, nil
+		}
+	}
+	return nil, errors.NewNotFound(imagtagv1.Resource("tags"), name)
+}
+
+func (i *inventory) List(namespace string, selector labels.Selector) ([]*imagtagv1.Tag, error) {
+	var tags []*imagtagv1.Tag
+	for _, it := range i.tags {
+		if namespace != "" && it.Namespace != namespace {
+			continue
+		}
+		if !selector.Matches(labels.Set(it.Labels)) {
+			continue
+		}
+		tags = append(tags, it)
+	}
+	return tags, nil
+}
+
+func (i *inventory) Upgrade(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	it, err := i.Get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	it = it.DeepCopy()
+	it.Spec.Generation++
+	return it, nil
+}
+
+func (i *inventory) Downgrade(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	return nil, fmt.Errorf("unable to downgrade, currently at oldest generation")
+}
+
+func (i *inventory) RollbackToKnownGood(
+	ctx context.Context, namespace, name string,
+) (*imagtagv1.Tag, error) {
+	it, err := i.Get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if it.Status.LastKnownGood == nil {
+		return nil, fmt.Errorf("unable to roll back, no known good generation")
+	}
+	it = it.DeepCopy()
+	it.Spec.Generation = it.Status.LastKnownGood.Generation
+	return it, nil
+}
+
+func (i *inventory) DiffNamespaces(
+	name string, namespaces []string,
+) (*imagtagv1.ProvenanceDiff, error) {
+	diff := &imagtagv1.ProvenanceDiff{Name: name}
+	for _, ns := range namespaces {
+		_, err := i.Get(ns, name)
+		diff.Environments = append(
+			diff.Environments,
+			imagtagv1.TagEnvironment{Namespace: ns, Found: err == nil},
+		)
+	}
+	return diff, nil
+}
+
+func (i *inventory) ResolveAt(
+	ctx context.Context, namespace, name string, at time.Time,
+) (*imagtagv1.Resolution, error) {
+	it, err := i.Get(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range it.Status.Timeline {
+		if entry.Since.After(at) {
+			continue
+		}
+		return &imagtagv1.Resolution{
+			Namespace:      namespace,
+			Name:           name,
+			At:             metav1.NewTime(at),
+			Generation:     entry.Generation,
+			ImageReference: entry.ImageReference,
+			Since:          entry.Since,
+			Source:         imagtagv1.ResolutionSourceTimeline,
+		}, nil
+	}
+	return nil, fmt.Errorf("no record of %s/%s", namespace, name)
+}
+
+func (i *inventory) SimulateImport(
+	ctx context.Context, namespace, image string,
+) *imagtagv1.ImportSimulation {
+	check := imagtagv1.SimulationCheck{Name: "reference", Result: imagtagv1.SimulationPassed}
+	if strings.Contains(image, "bad") {
+		check.Result = imagtagv1.SimulationFailed
+		check.Message = "invalid reference format"
+	}
+	return &imagtagv1.ImportSimulation{
+		Namespace: namespace,
+		Image:     image,
+		Accepted:  check.Result == imagtagv1.SimulationPassed,
+		Checks:    []imagtagv1.SimulationCheck{check},
+	}
+}
+
+func (i *inventory) NewGeneration(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	return i.Upgrade(ctx, namespace, name)
+}
+
+// authorizer allows users whose tokens are in tokens to perform verbs on the
+// namespaces listed in rules, rules are indexed by "user/verb".
+type authorizer struct {
+	tokens map[string]string
+	rules  map[string][]string
+}
+
+func (a *authorizer) Authenticate(ctx context.Context, token string) (authnv1.UserInfo, error) {
+	user, ok := a.tokens[token]
+	if !ok {
+		return authnv1.UserInfo{}, fmt.Errorf("invalid token")
+	}
+	return authnv1.UserInfo{Username: user}, nil
+}
+
+func (a *authorizer) Authorize(
+	ctx context.Context, user authnv1.UserInfo, verb, namespace, name string,
+) (bool, error) {
+	for _, ns := range a.rules[user.Username+"/"+verb] {
+		if ns == "*" || ns == namespace {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestAPI(t *testing.T) {
+	inv := &inventory{
+		tags: []*imagtagv1.Tag{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "tag0"},
+				Spec:       imagtagv1.TagSpec{From: "centos:latest"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "b", Name: "tag1"},
+				Spec:       imagtagv1.TagSpec{From: "fedora:latest", Generation: 5},
+				Status: imagtagv1.TagStatus{
+					LastKnownGood: &imagtagv1.KnownGood{Generation: 3},
+				},
+			},
+		},
+	}
+	auth := &authorizer{
+		tokens: map[string]string{
+			"admin-token":    "admin",
+			"user-token":     "user",
+			"outsider-token": "outsider",
+		},
+		rules: map[string][]string{
+			"admin/list":   {"*"},
+			"admin/get":    {"*"},
+			"admin/update": {"*"},
+			"user/list":    {"a"},
+			"user/get":     {"a"},
+		},
+	}
+	api := NewAPI(inv, auth)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		code   int
+		items  int
+		gen    int64
+		err    string
+	}{
+		{
+			name:   "no token",
+			method: http.MethodGet,
+			path:   "/api/v1/tags",
+			code:   http.StatusUnauthorized,
+			err:    "bearer token required",
+		},
+		{
+			name:   "invalid token",
+			method: http.MethodGet,
+			path:   "/api/v1/tags",
+			token:  "other",
+			code:   http.StatusUnauthorized,
+			err:    "invalid token",
+		},
+		{
+			name:   "list all tags",
+			method: http.MethodGet,
+			path:   "/api/v1/tags",
+			token:  "admin-token",
+			code:   http.StatusOK,
+			items:  2,
+		},
+		{
+			name:   "list all tags restricted to permitted namespaces",
+			method: http.MethodGet,
+			path:   "/api/v1/tags",
+			token:  "user-token",
+			code:   http.StatusOK,
+			items:  1,
+		},
+		{
+			name:   "list all tags without permission in any namespace",
+			method: http.MethodGet,
+			path:   "/api/v1/tags",
+			token:  "outsider-token",
+			code:   http.StatusOK,
+			items:  0,
+		},
+		{
+			name:   "list namespace tags without permission",
+			method: http.MethodGet,
+			path:   "/api/v1/tags?namespace=b",
+			token:  "user-token",
+			code:   http.StatusForbidden,
+			err:    "user can't list tags",
+		},
+		{
+			name:   "list namespace tags",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags",
+			token:  "user-token",
+			code:   http.StatusOK,
+			items:  1,
+		},
+		{
+			name:   "get tag",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/tag0",
+			token:  "user-token",
+			code:   http.StatusOK,
+		},
+		{
+			name:   "get tag not found",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/tag1",
+			token:  "user-token",
+			code:   http.StatusNotFound,
+			err:    "not found",
+		},
+		{
+			name:   "upgrade without permission",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/tags/tag0/upgrade",
+			token:  "user-token",
+			code:   http.StatusForbidden,
+			err:    "user can't update tags",
+		},
+		{
+			name:   "upgrade",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/tags/tag0/upgrade",
+			token:  "admin-token",
+			code:   http.StatusOK,
+			gen:    1,
+		},
+		{
+			name:   "failed downgrade",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/tags/tag0/downgrade",
+			token:  "admin-token",
+			code:   http.StatusBadRequest,
+			err:    "oldest generation",
+		},
+		{
+			name:   "rollback to known good",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/b/tags/tag1/rollback",
+			token:  "admin-token",
+			code:   http.StatusOK,
+			gen:    3,
+		},
+		{
+			name:   "rollback without known good",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/tags/tag0/rollback",
+			token:  "admin-token",
+			code:   http.StatusBadRequest,
+			err:    "no known good generation",
+		},
+		{
+			name:   "wrong method",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/tag0/upgrade",
+			token:  "admin-token",
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "unknown action",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/tags/tag0/delete",
+			token:  "admin-token",
+			code:   http.StatusNotFound,
+			err:    "unknown action",
+		},
+		{
+			name:   "unknown path",
+			method: http.MethodGet,
+			path:   "/api/v1/deployments",
+			token:  "admin-token",
+			code:   http.StatusNotFound,
+			err:    "unknown path",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Fatalf("expected code %d, %d received: %s", tt.code, rec.Code, rec.Body)
+			}
+			if len(tt.err) > 0 {
+				if !strings.Contains(rec.Body.String(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			if strings.HasSuffix(tt.path, "tags") {
+				var list imagtagv1.TagList
+				if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if len(list.Items) != tt.items {
+					t.Errorf("expected %d items, %d received", tt.items, len(list.Items))
+				}
+				return
+			}
+
+			var it imagtagv1.Tag
+			if err := json.NewDecoder(rec.Body).Decode(&it); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if it.Kind != "Tag" || it.Spec.Generation != tt.gen {
+				t.Errorf("unexpected tag: %+v", it)
+			}
+		})
+	}
+}
+
+func TestAPIList(t *testing.T) {
+	inv := &inventory{}
+	for i := 0; i < 5; i++ {
+		inv.tags = append(
+			inv.tags,
+			&imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: fmt.Sprintf("ns%d", i%2),
+					Name:      fmt.Sprintf("tag%d", i),
+					Labels:    map[string]string{"even": fmt.Sprintf("%t", i%2 == 0)},
+				},
+				Spec: imagtagv1.TagSpec{
+					From:       "centos:latest",
+					Generation: int64(i),
+				},
+			},
+		)
+	}
+	// the service returns tags sorted by namespace and name.
+	sort.Slice(inv.tags, func(i, j int) bool {
+		return tagKey(inv.tags[i]) < tagKey(inv.tags[j])
+	})
+
+	auth := &authorizer{
+		tokens: map[string]string{"token": "user"},
+		rules: map[string][]string{
+			"user/list": {"*"},
+			"user/get":  {"*"},
+		},
+	}
+	api := NewAPI(inv, auth)
+
+	get := func(query string) (*http.Response, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodGet, query, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+
+		var body map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Result(), body
+	}
+
+	names := func(body map[string]interface{}) []string {
+		var names []string
+		items, _ := body["items"].([]interface{})
+		for _, item := range items {
+			meta := item.(map[string]interface{})["metadata"].(map[string]interface{})
+			names = append(names, meta["name"].(string))
+		}
+		return names
+	}
+
+	// walk through all pages.
+	var all []string
+	query := "/api/v1/tags?limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("too many pages")
+		}
+		resp, body := get(query)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d: %v", resp.StatusCode, body)
+		}
+		all = append(all, names(body)...)
+
+		meta, _ := body["metadata"].(map[string]interface{})
+		cont, _ := meta["continue"].(string)
+		if cont == "" {
+			break
+		}
+		query = "/api/v1/tags?limit=2&continue=" + cont
+	}
+	expected := []string{"tag0", "tag2", "tag4", "tag1", "tag3"}
+	if !reflect.DeepEqual(all, expected) {
+		t.Errorf("expected %v, %v received", expected, all)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		query    string
+		code     int
+		expected []string
+	}{
+		{
+			name:     "namespace filter",
+			query:    "/api/v1/tags?namespace=ns1",
+			code:     http.StatusOK,
+			expected: []string{"tag1", "tag3"},
+		},
+		{
+			name:     "label filter",
+			query:    "/api/v1/namespaces/ns0/tags?labelSelector=even%3Dtrue",
+			code:     http.StatusOK,
+			expected: []string{"tag0", "tag2", "tag4"},
+		},
+		{
+			name:  "invalid label selector",
+			query: "/api/v1/tags?labelSelector=a%20b",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "invalid limit",
+			query: "/api/v1/tags?limit=-1",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "invalid continue",
+			query: "/api/v1/tags?continue=%25",
+			code:  http.StatusBadRequest,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := get(tt.query)
+			if resp.StatusCode != tt.code {
+				t.Fatalf("expected status %d, %d received: %v", tt.code, resp.StatusCode, body)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			if found := names(body); !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("expected %v, %v received", tt.expected, found)
+			}
+		})
+	}
+
+	// field selection.
+	_, body := get("/api/v1/tags?limit=1&fields=metadata.name,spec.generation,status.none")
+	expectedItem := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "tag0"},
+		"spec":     map[string]interface{}{"generation": float64(0)},
+	}
+	items := body["items"].([]interface{})
+	if len(items) != 1 || !reflect.DeepEqual(items[0], expectedItem) {
+		t.Errorf("expected %v, %v received", expectedItem, items)
+	}
+
+	_, body = get("/api/v1/namespaces/ns1/tags/tag3?fields=kind,spec.generation")
+	expectedItem = map[string]interface{}{
+		"kind": "Tag",
+		"spec": map[string]interface{}{"generation": float64(3)},
+	}
+	if !reflect.DeepEqual(body, expectedItem) {
+		t.Errorf("expected %v, %v received", expectedItem, body)
+	}
+}
+
+func TestAPIDiff(t *testing.T) {
+	inv := &inventory{
+		tags: []*imagtagv1.Tag{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "staging", Name: "app"}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"}},
+		},
+	}
+	auth := &authorizer{
+		tokens: map[string]string{
+			"admin-token": "admin",
+			"user-token":  "user",
+		},
+		rules: map[string][]string{
+			"admin/get": {"*"},
+			"user/get":  {"staging"},
+		},
+	}
+	api := NewAPI(inv, auth)
+
+	for _, tt := range []struct {
+		name  string
+		path  string
+		token string
+		code  int
+		err   string
+		found []bool
+	}{
+		{
+			name:  "diff",
+			path:  "/api/v1/tags/app/diff?namespaces=staging,prod,dev",
+			token: "admin-token",
+			code:  http.StatusOK,
+			found: []bool{true, true, false},
+		},
+		{
+			name:  "diff without permission on all namespaces",
+			path:  "/api/v1/tags/app/diff?namespaces=staging,prod",
+			token: "user-token",
+			code:  http.StatusForbidden,
+			err:   `user can't get tags in \"prod\"`,
+		},
+		{
+			name:  "diff of a single namespace",
+			path:  "/api/v1/tags/app/diff?namespaces=staging",
+			token: "admin-token",
+			code:  http.StatusBadRequest,
+			err:   "at least two namespaces",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Fatalf("expected code %d, %d received: %s", tt.code, rec.Code, rec.Body)
+			}
+			if len(tt.err) > 0 {
+				if !strings.Contains(rec.Body.String(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, rec.Body)
+				}
+				return
+			}
+
+			var diff imagtagv1.ProvenanceDiff
+			if err := json.NewDecoder(rec.Body).Decode(&diff); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var found []bool
+			for _, env := range diff.Environments {
+				found = append(found, env.Found)
+			}
+			if !reflect.DeepEqual(found, tt.found) {
+				t.Errorf("expected found %v, %v received", tt.found, found)
+			}
+		})
+	}
+}
+
+func TestAPIGenerations(t *testing.T) {
+	inv := &inventory{
+		tags: []*imagtagv1.Tag{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "app"},
+				Status: imagtagv1.TagStatus{
+					Generation: 0,
+					References: []imagtagv1.HashReference{
+						{
+							Generation:     1,
+							ImageReference: "quay.io/app@sha256:new",
+							Trigger:        imagtagv1.ImportTriggerWebhook,
+							Rollout:        imagtagv1.RolloutFailed,
+						},
+						{
+							Generation:     0,
+							ImageReference: "quay.io/app@sha256:old",
+							Trigger:        imagtagv1.ImportTriggerSpec,
+							Rollout:        imagtagv1.RolloutComplete,
+						},
+					},
+				},
+			},
+		},
+	}
+	auth := &authorizer{
+		tokens: map[string]string{"user-token": "user"},
+		rules:  map[string][]string{"user/get": {"a"}},
+	}
+	api := NewAPI(inv, auth)
+
+	for _, tt := range []struct {
+		name    string
+		method  string
+		path    string
+		code    int
+		err     string
+		digests []string
+	}{
+		{
+			name:    "generations",
+			method:  http.MethodGet,
+			path:    "/api/v1/namespaces/a/tags/app/generations",
+			code:    http.StatusOK,
+			digests: []string{"sha256:new", "sha256:old"},
+		},
+		{
+			name:   "generations of unknown tag",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/other/generations",
+			code:   http.StatusNotFound,
+			err:    "not found",
+		},
+		{
+			name:   "generations without permission",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/b/tags/app/generations",
+			code:   http.StatusForbidden,
+			err:    `user can't get tags in \"b\"`,
+		},
+		{
+			name:   "generations through post",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/tags/app/generations",
+			code:   http.StatusMethodNotAllowed,
+			err:    "use GET",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer user-token")
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Fatalf("expected code %d, %d received: %s", tt.code, rec.Code, rec.Body)
+			}
+			if len(tt.err) > 0 {
+				if !strings.Contains(rec.Body.String(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, rec.Body)
+				}
+				return
+			}
+
+			var history imagtagv1.GenerationHistory
+			if err := json.NewDecoder(rec.Body).Decode(&history); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var digests []string
+			for _, gen := range history.Generations {
+				digests = append(digests, gen.Digest)
+			}
+			if !reflect.DeepEqual(digests, tt.digests) {
+				t.Errorf("expected digests %v, %v received", tt.digests, digests)
+			}
+			if !history.Generations[1].Current || history.Generations[0].Current {
+				t.Errorf("expected generation 0 to be the current one: %+v", history)
+			}
+		})
+	}
+}
+
+func TestAPIResolve(t *testing.T) {
+	since := metav1.NewTime(time.Date(2021, 1, 5, 12, 0, 0, 0, time.UTC))
+	inv := &inventory{
+		tags: []*imagtagv1.Tag{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "a", Name: "app"},
+				Status: imagtagv1.TagStatus{
+					Timeline: []imagtagv1.TimelineEntry{
+						{
+							Generation:     1,
+							ImageReference: "quay.io/app@sha256:new",
+							Since:          since,
+						},
+					},
+				},
+			},
+		},
+	}
+	auth := &authorizer{
+		tokens: map[string]string{"user-token": "user"},
+		rules:  map[string][]string{"user/get": {"a"}},
+	}
+	api := NewAPI(inv, auth)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{
+			name:   "resolved",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/app/resolve?at=2021-01-05T14:00:00Z",
+			code:   http.StatusOK,
+			body:   `"imageReference":"quay.io/app@sha256:new"`,
+		},
+		{
+			name:   "before any record",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/app/resolve?at=2021-01-01T00:00:00Z",
+			code:   http.StatusBadRequest,
+			body:   "no record of a/app",
+		},
+		{
+			name:   "invalid time",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/app/resolve?at=tuesday",
+			code:   http.StatusBadRequest,
+			body:   `invalid time \"tuesday\", use RFC3339`,
+		},
+		{
+			name:   "unknown tag",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/tags/other/resolve?at=2021-01-05T14:00:00Z",
+			code:   http.StatusNotFound,
+			body:   "not found",
+		},
+		{
+			name:   "without permission",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/b/tags/app/resolve?at=2021-01-05T14:00:00Z",
+			code:   http.StatusForbidden,
+			body:   `user can't get tags in \"b\"`,
+		},
+		{
+			name:   "through post",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/tags/app/resolve?at=2021-01-05T14:00:00Z",
+			code:   http.StatusMethodNotAllowed,
+			body:   "use GET",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer user-token")
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Fatalf("expected code %d, %d received: %s", tt.code, rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("expecting %q, %q received instead", tt.body, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAPISimulate(t *testing.T) {
+	auth := &authorizer{
+		tokens: map[string]string{"user-token": "user"},
+		rules: map[string][]string{
+			"user/get":    {"a", "b"},
+			"user/create": {"a"},
+		},
+	}
+	api := NewAPI(&inventory{}, auth)
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{
+			name:   "accepted",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/simulate?image=quay.io/company/app:latest",
+			code:   http.StatusOK,
+			body:   `"accepted":true`,
+		},
+		{
+			name:   "rejected",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/simulate?image=quay.io/company/bad",
+			code:   http.StatusOK,
+			body:   `"accepted":false`,
+		},
+		{
+			name:   "without image",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/a/simulate",
+			code:   http.StatusBadRequest,
+			body:   "image to simulate the import of must be provided",
+		},
+		{
+			name:   "without namespace",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces//simulate?image=centos",
+			code:   http.StatusNotFound,
+			body:   "unknown path",
+		},
+		{
+			name:   "without permission to create",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/b/simulate?image=centos",
+			code:   http.StatusForbidden,
+			body:   `user can't create tags in \"b\"`,
+		},
+		{
+			name:   "through post",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/a/simulate?image=centos",
+			code:   http.StatusMethodNotAllowed,
+			body:   "use GET",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer user-token")
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Fatalf("expected code %d, %d received: %s", tt.code, rec.Code, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.body) {
+				t.Errorf("expecting %q, %q received instead", tt.body, rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// CatalogScanner abstraction exists to make testing easier. You most likely
+// wanna see Catalog struct under services/catalog.go for a concrete
+// implementation.
+type CatalogScanner interface {
+	Scan(ctx context.Context) error
+	Report() map[string][]string
+}
+
+// catalogScanTimeout is how long listing all upstream repositories may take.
+const catalogScanTimeout = 10 * time.Minute
+
+// Catalog periodically scans the upstream repositories Tags are imported
+// from for tags no Tag tracks. The last report is served, as json, by its
+// ServeHTTP.
+type Catalog struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	catsvc   CatalogScanner
+	trigger  chan struct{}
+}
+
+// NewCatalog returns a controller scanning upstream repositories. Nothing is
+// done unless the catalog report interval is set.
+func NewCatalog(catsvc CatalogScanner) *Catalog {
+	return &Catalog{
+		catsvc:   catsvc,
+		interval: config.Default().CatalogReportInterval,
+		trigger:  make(chan struct{}, 1),
+	}
+}
+
+// Name returns a name identifier for this controller.
+func (c *Catalog) Name() string {
+	return "catalog report"
+}
+
+// ApplyConfig stores the report interval and schedules a scan.
+func (c *Catalog) ApplyConfig(cfg *config.Config) {
+	c.mtx.Lock()
+	c.interval = cfg.CatalogReportInterval
+	c.mtx.Unlock()
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// scanInterval returns how often repositories are scanned, zero if the
+// report is disabled.
+func (c *Catalog) scanInterval() time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.interval
+}
+
+// ServeHTTP writes down the last report, mapping each upstream repository
+// into the tags in it no Tag tracks.
+func (c *Catalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if c.scanInterval() == 0 {
+		http.Error(w, "catalog report not configured", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.catsvc.Report()); err != nil {
+		klog.Errorf("error encoding catalog report: %s", err)
+	}
+}
+
+// Start scans the upstream repositories every configured interval until the
+// context is cancelled.
+func (c *Catalog) Start(ctx context.Context) error {
+	// as in GitSync the ticker is reset whenever the configuration
+	// changes, a nil channel blocks forever.
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	var interval time.Duration
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+		case <-c.trigger:
+		}
+
+		if cur := c.scanInterval(); cur != interval {
+			if ticker != nil {
+				ticker.Stop()
+				ticker, tick = nil, nil
+			}
+			if cur > 0 {
+				ticker = time.NewTicker(cur)
+				tick = ticker.C
+			}
+			interval = cur
+		}
+
+		if interval == 0 {
+			continue
+		}
+		sctx, cancel := context.WithTimeout(ctx, catalogScanTimeout)
+		err := c.catsvc.Scan(sctx)
+		cancel()
+		if err != nil {
+			klog.Errorf("error scanning upstream catalog: %s", err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type catalogscanner struct {
+	report map[string][]string
+}
+
+func (c *catalogscanner) Scan(ctx context.Context) error {
+	return nil
+}
+
+func (c *catalogscanner) Report() map[string][]string {
+	return c.report
+}
+
+func TestCatalogServeHTTP(t *testing.T) {
+	report := map[string][]string{
+		"quay.io/company/app": {"latest", "v3"},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		method   string
+		interval time.Duration
+		code     int
+	}{
+		{
+			name:   "not configured",
+			method: http.MethodGet,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:     "wrong method",
+			method:   http.MethodPost,
+			interval: time.Hour,
+			code:     http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "report",
+			method:   http.MethodGet,
+			interval: time.Hour,
+			code:     http.StatusOK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := NewCatalog(&catalogscanner{report: report})
+			ctrl.mtx.Lock()
+			ctrl.interval = tt.interval
+			ctrl.mtx.Unlock()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/catalog", nil)
+			ctrl.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("expected code %d, %d received", tt.code, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var received map[string][]string
+			if err := json.NewDecoder(w.Body).Decode(&received); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(received, report) {
+				t.Errorf("expected %v, %v received", report, received)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	coreinf "k8s.io/client-go/informers"
+	corelis "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// ConfigConsumer is implemented by all components that can be reconfigured
+// at runtime, without a restart.
+type ConfigConsumer interface {
+	ApplyConfig(*config.Config)
+}
+
+// ConfigWatcher controller watches the ConfigMap holding tagger configuration
+// and propagates changes to all registered consumers. If the ConfigMap does
+// not exist the default configuration is used. Invalid configurations are
+// logged and ignored, consumers keep running with the last valid one.
+type ConfigWatcher struct {
+	cmlister  corelis.ConfigMapLister
+	namespace string
+	consumers []ConfigConsumer
+	reload    chan struct{}
+}
+
+// NewConfigWatcher returns a controller watching the tagger ConfigMap in the
+// provided namespace.
+func NewConfigWatcher(
+	inf coreinf.SharedInformerFactory, namespace string, consumers ...ConfigConsumer,
+) *ConfigWatcher {
+	ctrl := &ConfigWatcher{
+		cmlister:  inf.Core().V1().ConfigMaps().Lister(),
+		namespace: namespace,
+		consumers: consumers,
+		reload:    make(chan struct{}, 1),
+	}
+	inf.Core().V1().ConfigMaps().Informer().AddEventHandler(ctrl.handlers())
+	return ctrl
+}
+
+// Name returns a name identifier for this controller.
+func (c *ConfigWatcher) Name() string {
+	return "config"
+}
+
+// Reload schedules a reload of the configuration.
+func (c *ConfigWatcher) Reload() {
+	select {
+	case c.reload <- struct{}{}:
+	default:
+	}
+}
+
+// isConfig returns true if provided object is our config map.
+func (c *ConfigWatcher) isConfig(o interface{}) bool {
+	if tomb, ok := o.(cache.DeletedFinalStateUnknown); ok {
+		o = tomb.Obj
+	}
+	cm, ok := o.(*corev1.ConfigMap)
+	if !ok {
+		return false
+	}
+	return cm.Namespace == c.namespace && cm.Name == config.ConfigMapName
+}
+
+// handlers return a event handler that will be called by the informer
+// whenever an event occurs. Any event on our ConfigMap triggers a reload.
+func (c *ConfigWatcher) handlers() cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: c.isConfig,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: func(o interface{}) {
+				c.Reload()
+			},
+			UpdateFunc: func(o, n interface{}) {
+				c.Reload()
+			},
+			DeleteFunc: func(o interface{}) {
+				c.Reload()
+			},
+		},
+	}
+}
+
+// load reads and parses the configuration from our ConfigMap.
+func (c *ConfigWatcher) load() (*config.Config, error) {
+	cm, err := c.cmlister.ConfigMaps(c.namespace).Get(config.ConfigMapName)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return config.Default(), nil
+		}
+		return nil, err
+	}
+	return config.Parse(cm.Data[config.ConfigMapKey])
+}
+
+// apply loads the configuration and hands it over to all consumers.
+func (c *ConfigWatcher) apply() {
+	cfg, err := c.load()
+	if err != nil {
+		klog.Errorf("error loading configuration, ignoring: %s", err)
+		return
+	}
+
+	klog.Infof("applying configuration: %+v", *cfg)
+	for _, consumer := range c.consumers {
+		consumer.ApplyConfig(cfg)
+	}
+}
+
+// Start starts the controller's event loop.
+func (c *ConfigWatcher) Start(ctx context.Context) error {
+	// always apply the configuration once at start as the ConfigMap
+	// may not exist.
+	c.Reload()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.reload:
+			c.apply()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+type cfgconsumer struct {
+	sync.Mutex
+	cfg *config.Config
+}
+
+func (c *cfgconsumer) ApplyConfig(cfg *config.Config) {
+	c.Lock()
+	defer c.Unlock()
+	c.cfg = cfg
+}
+
+func (c *cfgconsumer) workers() int {
+	c.Lock()
+	defer c.Unlock()
+	if c.cfg == nil {
+		return 0
+	}
+	return c.cfg.Workers
+}
+
+func TestConfigWatcher(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	corcli := corfake.NewSimpleClientset()
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	consumer := &cfgconsumer{}
+
+	ctrl := NewConfigWatcher(corinf, "tagger", consumer)
+	corinf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		corinf.Core().V1().ConfigMaps().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error after start: %s", err)
+		}
+	}()
+
+	time.Sleep(time.Second)
+	if consumer.workers() != config.Default().Workers {
+		t.Errorf("default config not applied: %d workers", consumer.workers())
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "tagger",
+			Name:      config.ConfigMapName,
+		},
+		Data: map[string]string{
+			config.ConfigMapKey: "workers: 3",
+		},
+	}
+	if _, err := corcli.CoreV1().ConfigMaps("tagger").Create(
+		ctx, cm, metav1.CreateOptions{},
+	); err != nil {
+		t.Fatalf("error creating config map: %s", err)
+	}
+
+	time.Sleep(time.Second)
+	if consumer.workers() != 3 {
+		t.Errorf("expected 3 workers, %d found", consumer.workers())
+	}
+
+	// invalid configurations must be ignored.
+	cm.Data[config.ConfigMapKey] = "workers: -1"
+	if _, err := corcli.CoreV1().ConfigMaps("tagger").Update(
+		ctx, cm, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("error updating config map: %s", err)
+	}
+
+	time.Sleep(time.Second)
+	if consumer.workers() != 3 {
+		t.Errorf("expected 3 workers, %d found", consumer.workers())
+	}
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// QueueReporter is implemented by controllers processing events through a
+// work queue.
+type QueueReporter interface {
+	Name() string
+	QueueState() QueueState
+}
+
+// ControllersDebugger reports, as json, the state of the work queues of the
+// controllers: how many items are queued, for how long the oldest one has
+// been waiting, the items being retried and the syncs in flight. It answers
+// "why isn't my tag updating" without raising the log verbosity.
+type ControllersDebugger struct {
+	mtx       sync.Mutex
+	reporters []QueueReporter
+}
+
+// NewControllersDebugger returns a handler reporting the state of the
+// provided controllers, in order.
+func NewControllersDebugger(reporters ...QueueReporter) *ControllersDebugger {
+	return &ControllersDebugger{reporters: reporters}
+}
+
+// Add makes the state of more controllers to be reported.
+func (c *ControllersDebugger) Add(reporters ...QueueReporter) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.reporters = append(c.reporters, reporters...)
+}
+
+// ServeHTTP writes down the state of every controller.
+func (c *ControllersDebugger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	reporters := c.reporters
+	c.mtx.Unlock()
+
+	states := []QueueState{}
+	for _, reporter := range reporters {
+		states = append(states, reporter.QueueState())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(states); err != nil {
+		klog.Errorf("error encoding controllers state: %s", err)
+	}
+}
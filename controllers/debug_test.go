@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type reporter struct {
+	name  string
+	state QueueState
+}
+
+func (r reporter) Name() string {
+	return r.name
+}
+
+func (r reporter) QueueState() QueueState {
+	return r.state
+}
+
+func TestControllersDebugger(t *testing.T) {
+	debugger := NewControllersDebugger()
+
+	w := httptest.NewRecorder()
+	debugger.ServeHTTP(w, httptest.NewRequest("GET", "/debug/controllers", nil))
+	if body := w.Body.String(); body != "[]\n" {
+		t.Errorf("expected no controllers, %q received", body)
+	}
+
+	states := []QueueState{
+		{
+			Controller:           "tag",
+			Length:               3,
+			OldestItemAgeSeconds: 42,
+			Retries:              map[string]int{"dev/a": 2},
+		},
+		{
+			Controller: "deployment",
+		},
+	}
+	debugger.Add(
+		reporter{name: "tag", state: states[0]},
+		reporter{name: "deployment", state: states[1]},
+	)
+
+	w = httptest.NewRecorder()
+	debugger.ServeHTTP(w, httptest.NewRequest("GET", "/debug/controllers", nil))
+	if ctype := w.Header().Get("Content-Type"); ctype != "application/json" {
+		t.Errorf("unexpected content type %s", ctype)
+	}
+	var received []QueueState
+	if err := json.NewDecoder(w.Body).Decode(&received); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(received, states) {
+		t.Errorf("expected %+v, %+v received", states, received)
+	}
+}
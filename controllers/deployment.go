@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"reflect"
 	"sync"
 	"time"
 
@@ -12,6 +13,8 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/metrics"
 )
 
 // DeploymentUpdater abstraction exists to make testing easier. You most likely
@@ -21,24 +24,33 @@ type DeploymentUpdater interface {
 	Update(context.Context, *appsv1.Deployment) error
 }
 
+// triggersAnnotation opts a Deployment in for all the Tags its images match,
+// see TriggersAnnotation in services/triggers.go.
+const triggersAnnotation = "image-triggers"
+
 // Deployment controller handles events related to deployment creations.
 type Deployment struct {
 	deplister appslis.DeploymentLister
 	depsvc    DeploymentUpdater
-	queue     workqueue.DelayingInterface
+	shard     NamespaceOwner
+	queue     *trackedQueue
 	appctx    context.Context
 }
 
 // NewDeployment returns a new controller for Deployments. This controller
 // keeps track of deployments being created and assure that they contain the
-// right annotations if they leverage tags.
+// right annotations if they leverage tags. If shard is not nil only
+// Deployments in namespaces owned by the shard are processed.
 func NewDeployment(
-	inf coreinf.SharedInformerFactory, depsvc DeploymentUpdater,
+	inf coreinf.SharedInformerFactory,
+	depsvc DeploymentUpdater,
+	shard NamespaceOwner,
 ) *Deployment {
 	ctrl := &Deployment{
 		deplister: inf.Apps().V1().Deployments().Lister(),
-		queue:     workqueue.NewDelayingQueue(),
+		queue:     newTrackedQueue(workqueue.New(), nil),
 		depsvc:    depsvc,
+		shard:     shard,
 	}
 	inf.Apps().V1().Deployments().Informer().AddEventHandler(ctrl.handlers())
 	return ctrl
@@ -49,33 +61,88 @@ func (d *Deployment) Name() string {
 	return "deployment"
 }
 
+// QueueState returns a snapshot of the controller work queue.
+func (d *Deployment) QueueState() QueueState {
+	return d.queue.state(d.Name())
+}
+
 // enqueueEvent generates a key using "namespace/name" for the event received
-// and then enqueues this index to be processed.
+// and then enqueues this index to be processed. Events for namespaces not
+// owned by our shard are ignored.
 func (d *Deployment) enqueueEvent(o interface{}) {
 	key, err := cache.MetaNamespaceKeyFunc(o)
 	if err != nil {
 		klog.Errorf("fail to enqueue event: %v : %s", o, err)
 		return
 	}
+	if !ownsKey(d.shard, key) {
+		metrics.ShardSkippedEvents.WithLabelValues(d.Name()).Inc()
+		return
+	}
 	d.queue.Add(key)
 }
 
 // handlers return a event handler that will be called by the informer
-// whenever an event occurs. This handler basically enqueues everything
-// in our work queue. There is no handler for deployments deletion, we
-// don't care about deletes just yet.
+// whenever an event occurs. Only Deployments opting in for Tags are enqueued
+// and, of their updates, only the ones we may act upon, see relevantUpdate.
+// There is no handler for deployments deletion, we don't care about deletes
+// just yet.
 func (d *Deployment) handlers() cache.ResourceEventHandler {
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(o interface{}) {
+			if !tracksTags(o) {
+				metrics.FilteredEvents.WithLabelValues(d.Name()).Inc()
+				return
+			}
 			d.enqueueEvent(o)
 		},
 		UpdateFunc: func(o, n interface{}) {
-			d.enqueueEvent(o)
+			if !tracksTags(n) || !relevantUpdate(o, n) {
+				metrics.FilteredEvents.WithLabelValues(d.Name()).Inc()
+				return
+			}
+			d.enqueueEvent(n)
 		},
 		DeleteFunc: func(o interface{}) {},
 	}
 }
 
+// tracksTags returns true if o is a Deployment annotated to use Tags, see
+// tagTriggers in services/triggers.go.
+func tracksTags(o interface{}) bool {
+	dep, ok := o.(*appsv1.Deployment)
+	if !ok {
+		return false
+	}
+	if dep.Annotations[triggersAnnotation] == "*" {
+		return true
+	}
+	_, ok = dep.Annotations["image-tag"]
+	return ok
+}
+
+// relevantUpdate returns true if an update of a Deployment may need to be
+// processed: a resync, a change to its labels, annotations or pod template,
+// or a change to its status conditions (as they tell how a rollout goes).
+// Everything else, e.g. replicas scaled by an autoscaler, is ignored. The
+// rollouts in progress are still refreshed on every resync.
+func relevantUpdate(o, n interface{}) bool {
+	odep, ok := o.(*appsv1.Deployment)
+	if !ok {
+		return true
+	}
+	ndep, ok := n.(*appsv1.Deployment)
+	if !ok {
+		return true
+	}
+
+	return odep.ResourceVersion == ndep.ResourceVersion ||
+		!reflect.DeepEqual(odep.Labels, ndep.Labels) ||
+		!reflect.DeepEqual(odep.Annotations, ndep.Annotations) ||
+		!reflect.DeepEqual(odep.Spec.Template, ndep.Spec.Template) ||
+		!reflect.DeepEqual(odep.Status.Conditions, ndep.Status.Conditions)
+}
+
 // eventProcessor reads our events calling syncDeployment for all of them.
 func (d *Deployment) eventProcessor(wg *sync.WaitGroup) {
 	defer wg.Done()
@@ -101,6 +168,7 @@ func (d *Deployment) eventProcessor(wg *sync.WaitGroup) {
 		}
 
 		klog.Infof("event for deployment %s processed", evt)
+		d.queue.Forget(evt)
 		d.queue.Done(evt)
 	}
 }
@@ -48,7 +48,7 @@ func TestDeploymentCreated(t *testing.T) {
 	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
 	svc := &depsvc{}
 
-	ctrl := NewDeployment(corinf, svc)
+	ctrl := NewDeployment(corinf, svc, nil)
 	corinf.Start(ctx.Done())
 
 	if !cache.WaitForCacheSync(
@@ -69,15 +69,24 @@ func TestDeploymentCreated(t *testing.T) {
 	}()
 
 	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "namespace",
+			Name:        "adeployment",
+			Annotations: map[string]string{"image-tag": "true"},
+		},
+	}
+	untracked := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: "namespace",
-			Name:      "adeployment",
+			Name:      "untracked",
 		},
 	}
-	if _, err := corcli.AppsV1().Deployments("namespace").Create(
-		ctx, dep, metav1.CreateOptions{},
-	); err != nil {
-		t.Errorf("error creating deployment: %s", err)
+	for _, obj := range []*appsv1.Deployment{dep, untracked} {
+		if _, err := corcli.AppsV1().Deployments("namespace").Create(
+			ctx, obj, metav1.CreateOptions{},
+		); err != nil {
+			t.Errorf("error creating deployment: %s", err)
+		}
 	}
 
 	// give some room for the event to be dispatched towards the controller.
@@ -86,6 +95,9 @@ func TestDeploymentCreated(t *testing.T) {
 	if !reflect.DeepEqual(dep, svc.get("namespace/adeployment")) {
 		t.Errorf("expected %+v, found %+v", dep, svc.db["namespace/adeployment"])
 	}
+	if svc.get("namespace/untracked") != nil {
+		t.Errorf("deployment not using tags processed")
+	}
 
 	if svc.calls != 1 {
 		t.Errorf("expected 1 call, %d calls made", svc.calls)
@@ -102,7 +114,7 @@ func TestDeploymentUpdated(t *testing.T) {
 	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
 	svc := &depsvc{}
 
-	ctrl := NewDeployment(corinf, svc)
+	ctrl := NewDeployment(corinf, svc, nil)
 	corinf.Start(ctx.Done())
 
 	if !cache.WaitForCacheSync(
@@ -124,8 +136,9 @@ func TestDeploymentUpdated(t *testing.T) {
 
 	dep := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: "namespace",
-			Name:      "adeployment",
+			Namespace:   "namespace",
+			Name:        "adeployment",
+			Annotations: map[string]string{"image-triggers": "*"},
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: pointer.Int32Ptr(1),
@@ -144,22 +157,72 @@ func TestDeploymentUpdated(t *testing.T) {
 		t.Errorf("expected %+v, found %+v", dep, svc.db["namespace/adeployment"])
 	}
 
-	dep.Spec.Replicas = pointer.Int32Ptr(2)
-	if _, err := corcli.AppsV1().Deployments("namespace").Update(
-		ctx, dep, metav1.UpdateOptions{},
-	); err != nil {
-		t.Errorf("error updating deployment: %s", err)
-	}
+	// each step changes the deployment, the pod template and the status
+	// conditions are processed while replicas alone are not.
+	for _, step := range []struct {
+		name   string
+		change func(*appsv1.Deployment)
+		calls  int
+	}{
+		{
+			name: "pod template",
+			change: func(dep *appsv1.Deployment) {
+				dep.Spec.Template.Annotations = map[string]string{"app": "v2"}
+			},
+			calls: 2,
+		},
+		{
+			name: "replicas",
+			change: func(dep *appsv1.Deployment) {
+				dep.Spec.Replicas = pointer.Int32Ptr(2)
+			},
+			calls: 2,
+		},
+		{
+			name: "replica counts",
+			change: func(dep *appsv1.Deployment) {
+				dep.Status.Replicas = 2
+				dep.Status.ReadyReplicas = 2
+			},
+			calls: 2,
+		},
+		{
+			name: "status conditions",
+			change: func(dep *appsv1.Deployment) {
+				dep.Status.Conditions = []appsv1.DeploymentCondition{
+					{
+						Type:   appsv1.DeploymentProgressing,
+						Status: "True",
+						Reason: "NewReplicaSetAvailable",
+					},
+				}
+			},
+			calls: 3,
+		},
+	} {
+		// the fake client does not bump resource versions, equal versions
+		// are taken as resyncs.
+		step.change(dep)
+		dep.ResourceVersion = step.name
+		if _, err := corcli.AppsV1().Deployments("namespace").Update(
+			ctx, dep, metav1.UpdateOptions{},
+		); err != nil {
+			t.Errorf("error updating deployment: %s", err)
+		}
 
-	// give some room for the event to be dispatched towards the controller.
-	time.Sleep(time.Second)
+		// give some room for the event to be dispatched towards the controller.
+		time.Sleep(time.Second)
 
-	if !reflect.DeepEqual(dep, svc.get("namespace/adeployment")) {
-		t.Errorf("expected %+v, found %+v", dep, svc.db["namespace/adeployment"])
+		svc.Lock()
+		calls := svc.calls
+		svc.Unlock()
+		if calls != step.calls {
+			t.Errorf("%s: expected %d calls, %d calls made", step.name, step.calls, calls)
+		}
 	}
 
-	if svc.calls != 2 {
-		t.Errorf("expected 2 calls, %d calls made", svc.calls)
+	if !reflect.DeepEqual(dep, svc.get("namespace/adeployment")) {
+		t.Errorf("expected %+v, found %+v", dep, svc.db["namespace/adeployment"])
 	}
 
 	cancel()
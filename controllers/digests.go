@@ -0,0 +1,223 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinf "k8s.io/client-go/informers"
+	corelis "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imageinf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagelis "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// DigestsSyncer abstraction exists to make testing easier. You most likely
+// wanna see Digests struct under services/digests.go for a concrete
+// implementation of this.
+type DigestsSyncer interface {
+	Sync(ctx context.Context, namespace string) error
+}
+
+// digestsLabel is the label set on the ConfigMaps managed by the digests
+// syncer, see DigestsLabel in services/digests.go.
+const digestsLabel = "image-tag-digests"
+
+// Digests controller keeps the digests ConfigMap of each namespace in line
+// with its Tags. Events are queued by namespace so a burst of Tag changes in
+// a namespace ends up in a single sync.
+type Digests struct {
+	taglister imagelis.TagLister
+	cmlister  corelis.ConfigMapLister
+	syncer    DigestsSyncer
+	shard     NamespaceOwner
+	queue     *trackedQueue
+	appctx    context.Context
+}
+
+// NewDigests returns a new controller for the digests ConfigMaps. If shard is
+// not nil only namespaces owned by the shard are processed.
+func NewDigests(
+	corinf coreinf.SharedInformerFactory,
+	taginf imageinf.SharedInformerFactory,
+	syncer DigestsSyncer,
+	shard NamespaceOwner,
+) *Digests {
+	ctrl := &Digests{
+		taglister: taginf.Images().V1().Tags().Lister(),
+		cmlister:  corinf.Core().V1().ConfigMaps().Lister(),
+		queue:     newTrackedQueue(workqueue.New(), nil),
+		syncer:    syncer,
+		shard:     shard,
+	}
+	taginf.Images().V1().Tags().Informer().AddEventHandler(ctrl.tagHandlers())
+	corinf.Core().V1().ConfigMaps().Informer().AddEventHandler(ctrl.configMapHandlers())
+	return ctrl
+}
+
+// Name returns a name identifier for this controller.
+func (d *Digests) Name() string {
+	return "digests"
+}
+
+// QueueState returns a snapshot of the controller work queue.
+func (d *Digests) QueueState() QueueState {
+	return d.queue.state(d.Name())
+}
+
+// ApplyConfig syncs all namespaces with Tags or with digests ConfigMaps, the
+// ConfigMaps may have been enabled, renamed or disabled. The digests syncer
+// must have been given the configuration before.
+func (d *Digests) ApplyConfig(cfg *config.Config) {
+	tags, err := d.taglister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("unable to list tags: %s", err)
+	}
+	for _, it := range tags {
+		d.enqueueNamespace(it.Namespace)
+	}
+
+	sel := labels.SelectorFromSet(labels.Set{digestsLabel: "true"})
+	cms, err := d.cmlister.List(sel)
+	if err != nil {
+		klog.Errorf("unable to list digests config maps: %s", err)
+	}
+	for _, cm := range cms {
+		d.enqueueNamespace(cm.Namespace)
+	}
+}
+
+// enqueueNamespace enqueues a namespace to be synced. Namespaces not owned by
+// our shard are ignored.
+func (d *Digests) enqueueNamespace(namespace string) {
+	if d.shard != nil && !d.shard.Owns(namespace) {
+		metrics.ShardSkippedEvents.WithLabelValues(d.Name()).Inc()
+		return
+	}
+	d.queue.Add(namespace)
+}
+
+// enqueueEvent enqueues the namespace of the object in o.
+func (d *Digests) enqueueEvent(o interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(o)
+	if err != nil {
+		klog.Errorf("fail to enqueue event: %v : %s", o, err)
+		return
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		klog.Errorf("fail to enqueue event: %v : %s", o, err)
+		return
+	}
+	d.enqueueNamespace(namespace)
+}
+
+// tagHandlers return the event handlers for Tags. Resyncs are ignored as
+// they don't move Tags to another generation.
+func (d *Digests) tagHandlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			d.enqueueEvent(o)
+		},
+		UpdateFunc: func(o, n interface{}) {
+			oldtag, ok := o.(*imagtagv1.Tag)
+			if !ok {
+				return
+			}
+			newtag, ok := n.(*imagtagv1.Tag)
+			if !ok || oldtag.ResourceVersion == newtag.ResourceVersion {
+				return
+			}
+			d.enqueueEvent(n)
+		},
+		DeleteFunc: func(o interface{}) {
+			d.enqueueEvent(o)
+		},
+	}
+}
+
+// configMapHandlers return the event handlers for ConfigMaps. Only changes
+// to digests ConfigMaps, e.g. someone deleting or editing them, are of
+// interest.
+func (d *Digests) configMapHandlers() cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: func(o interface{}) bool {
+			if tomb, ok := o.(cache.DeletedFinalStateUnknown); ok {
+				o = tomb.Obj
+			}
+			cm, ok := o.(*corev1.ConfigMap)
+			return ok && cm.Labels[digestsLabel] == "true"
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(o, n interface{}) {
+				oldcm, ok := o.(*corev1.ConfigMap)
+				if !ok {
+					return
+				}
+				newcm, ok := n.(*corev1.ConfigMap)
+				if !ok || oldcm.ResourceVersion == newcm.ResourceVersion {
+					return
+				}
+				d.enqueueEvent(n)
+			},
+			DeleteFunc: func(o interface{}) {
+				d.enqueueEvent(o)
+			},
+		},
+	}
+}
+
+// eventProcessor reads our events calling syncNamespace for all of them.
+func (d *Digests) eventProcessor(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		evt, end := d.queue.Get()
+		if end {
+			return
+		}
+
+		namespace := evt.(string)
+		klog.V(5).Infof("received event for digests of namespace: %s", namespace)
+		if err := d.syncNamespace(namespace); err != nil {
+			klog.Errorf("error syncing digests of namespace %s: %v", namespace, err)
+			d.queue.Done(evt)
+			d.queue.AddAfter(evt, 5*time.Second)
+			continue
+		}
+		d.queue.Forget(evt)
+		d.queue.Done(evt)
+	}
+}
+
+// syncNamespace syncs the digests ConfigMap of a namespace.
+func (d *Digests) syncNamespace(namespace string) error {
+	ctx, cancel := context.WithTimeout(d.appctx, 10*time.Second)
+	defer cancel()
+	return d.syncer.Sync(ctx, namespace)
+}
+
+// Start starts the controller's event loop.
+func (d *Digests) Start(ctx context.Context) error {
+	// appctx is the 'keep going' context, if it is cancelled
+	// everything we might be doing should stop.
+	d.appctx = ctx
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go d.eventProcessor(&wg)
+
+	// wait until it is time to die.
+	<-d.appctx.Done()
+
+	d.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+type dgsvc struct {
+	sync.Mutex
+	calls map[string]int
+}
+
+func (d *dgsvc) Sync(ctx context.Context, namespace string) error {
+	d.Lock()
+	defer d.Unlock()
+	d.calls[namespace]++
+	return nil
+}
+
+func (d *dgsvc) get(namespace string) int {
+	d.Lock()
+	defer d.Unlock()
+	return d.calls[namespace]
+}
+
+func TestDigestsController(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	corcli := corfake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "stale",
+				Name:      "digests",
+				Labels:    map[string]string{digestsLabel: "true"},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &dgsvc{calls: map[string]int{}}
+
+	ctrl := NewDigests(corinf, taginf, svc, nil)
+	corinf.Start(ctx.Done())
+	taginf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		corinf.Core().V1().ConfigMaps().Informer().HasSynced,
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error starting controller: %s", err)
+		}
+	}()
+
+	for _, name := range []string{"app", "worker"} {
+		if _, err := tagcli.ImagesV1().Tags("prod").Create(
+			ctx,
+			&imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: name},
+			},
+			metav1.CreateOptions{},
+		); err != nil {
+			t.Errorf("error creating tag: %s", err)
+		}
+	}
+
+	// give some room for the events to be dispatched towards the controller.
+	time.Sleep(time.Second)
+
+	if calls := svc.get("prod"); calls < 1 || calls > 2 {
+		t.Errorf("expected namespace to be synced once or twice, %d syncs", calls)
+	}
+	if calls := svc.get("stale"); calls != 0 {
+		t.Errorf("namespace without tag events synced %d times", calls)
+	}
+
+	// configuration changes sync namespaces holding digests config maps,
+	// config maps not managed are of no interest.
+	ctrl.ApplyConfig(config.Default())
+	if _, err := corcli.CoreV1().ConfigMaps("other").Create(
+		ctx,
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "digests"},
+		},
+		metav1.CreateOptions{},
+	); err != nil {
+		t.Errorf("error creating config map: %s", err)
+	}
+	time.Sleep(time.Second)
+
+	if calls := svc.get("stale"); calls != 1 {
+		t.Errorf("expected 1 sync, %d syncs", calls)
+	}
+	if calls := svc.get("other"); calls != 0 {
+		t.Errorf("namespace without digests synced %d times", calls)
+	}
+
+	// removing a digests config map syncs its namespace back.
+	if err := corcli.CoreV1().ConfigMaps("stale").Delete(
+		ctx, "digests", metav1.DeleteOptions{},
+	); err != nil {
+		t.Errorf("error deleting config map: %s", err)
+	}
+	time.Sleep(time.Second)
+
+	if calls := svc.get("stale"); calls != 2 {
+		t.Errorf("expected 2 syncs, %d syncs", calls)
+	}
+
+	cancel()
+	wg.Wait()
+}
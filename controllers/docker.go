@@ -2,13 +2,19 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/metrics"
 )
 
 // DockerRequestPayload is sent by docker hub whenever a new push happen to a
@@ -55,18 +61,41 @@ func (d *DockerRequestPayload) valid() bool {
 	return true
 }
 
+// NewDockerRequestPayload returns the payload docker hub sends when tag is
+// pushed to the namespace/name repository, e.g. for docker.io/org/app:v1.
+// Official images live in the "library" namespace.
+func NewDockerRequestPayload(namespace, name, tag string) DockerRequestPayload {
+	repo := fmt.Sprintf("%s/%s", namespace, name)
+	payload := DockerRequestPayload{
+		CallbackURL: fmt.Sprintf("https://registry.hub.docker.com/u/%s/hook/", repo),
+	}
+	payload.PushData.Images = []string{}
+	payload.PushData.PushedAt = int(time.Now().Unix())
+	payload.PushData.Pusher = namespace
+	payload.PushData.Tag = tag
+	payload.Repository.Name = name
+	payload.Repository.Namespace = namespace
+	payload.Repository.Owner = namespace
+	payload.Repository.RepoName = repo
+	payload.Repository.RepoURL = fmt.Sprintf("https://hub.docker.com/r/%s", repo)
+	payload.Repository.IsOfficial = namespace == "library"
+	payload.Repository.Status = "Active"
+	return payload
+}
+
 // DockerWebHook handles docker.io requests.
 type DockerWebHook struct {
-	bind   string
+	server *httpServer
 	tagsvc TagGenerationUpdater
 }
 
 // NewDockerWebHook returns a web hook handler for docker.io webhooks.
 func NewDockerWebHook(tagsvc TagGenerationUpdater) *DockerWebHook {
-	return &DockerWebHook{
-		bind:   ":8082",
+	hook := &DockerWebHook{
 		tagsvc: tagsvc,
 	}
+	hook.server = newHTTPServer(hook.Name(), config.Default().Binds.Docker, hook)
+	return hook
 }
 
 // Name returns a name identifier for this controller.
@@ -74,63 +103,138 @@ func (d *DockerWebHook) Name() string {
 	return "docker hub webhook"
 }
 
-// ServeHTTP handles requests coming in from docker.io.
-func (d *DockerWebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// webhookResult is the outcome of processing a single image push within a
+// webhook delivery. Errors from updating Tags are only logged, they may leak
+// details about the cluster to the webhook provider.
+type webhookResult struct {
+	Image  string `json:"image"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// These are the statuses of each image push processed within a delivery.
+const (
+	webhookUpdated   = "updated"
+	webhookUntracked = "untracked"
+	webhookFailed    = "failed"
+	webhookInvalid   = "invalid"
+)
+
+// decodeDockerPayloads reads a docker delivery. A delivery may hold a single
+// push or a list of them (batched deliveries).
+func decodeDockerPayloads(body io.Reader) ([]DockerRequestPayload, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var payloads []DockerRequestPayload
+		if err := json.Unmarshal(trimmed, &payloads); err != nil {
+			return nil, err
+		}
+		return payloads, nil
+	}
+
 	var payload DockerRequestPayload
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+	if err := json.Unmarshal(trimmed, &payload); err != nil {
+		return nil, err
+	}
+	return []DockerRequestPayload{payload}, nil
+}
+
+// ServeHTTP handles requests coming in from docker.io. Identical pushes within
+// a delivery are processed only once. The result for each image is returned
+// in the response body, if only some of them fail the status is 207 (multi
+// status) so the provider does not consider the whole delivery as failed.
+// If no Tag tracks any of the images the status is 404, providers disable
+// webhooks after repeated 5xx responses.
+func (d *DockerWebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payloads, err := decodeDockerPayloads(r.Body)
+	if err != nil {
 		klog.Errorf("error unmarshaling docker request payload: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	if !payload.valid() {
-		klog.Errorf("invalid docker payload: %+v", payload)
+	var results []webhookResult
+	var imgpaths []string
+	seen := map[string]bool{}
+	for _, payload := range payloads {
+		if !payload.valid() {
+			klog.Errorf("invalid docker payload: %+v", payload)
+			results = append(results, webhookResult{
+				Status: webhookInvalid,
+				Error:  "missing tag, repository name or namespace",
+			})
+			continue
+		}
+
+		imgpath := fmt.Sprintf(
+			"docker.io/%s/%s:%s",
+			payload.Repository.Namespace,
+			payload.Repository.Name,
+			payload.PushData.Tag,
+		)
+		if seen[imgpath] {
+			klog.V(2).Infof("ignoring repeated update for image: %s", imgpath)
+			continue
+		}
+		seen[imgpath] = true
+		imgpaths = append(imgpaths, imgpath)
+	}
+
+	if len(imgpaths) == 0 {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	imgpath := fmt.Sprintf(
-		"docker.io/%s/%s:%s",
-		payload.Repository.Namespace,
-		payload.Repository.Name,
-		payload.PushData.Tag,
-	)
-	klog.Infof("received update for image: %s", imgpath)
-	if err := d.tagsvc.NewGenerationForImageRef(r.Context(), imgpath); err != nil {
-		klog.Errorf("error updating tag %s by reference: %s", imgpath, err)
-		http.Error(
-			w,
-			http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError,
-		)
-		return
+	failures, untracked := 0, 0
+	for _, imgpath := range imgpaths {
+		klog.Infof("received update for image: %s", imgpath)
+		result := webhookResult{Image: imgpath, Status: webhookUpdated}
+		err := d.tagsvc.NewGenerationForImageRef(r.Context(), imgpath)
+		switch {
+		case errors.IsNotFound(err):
+			klog.V(2).Infof("no tag tracks image %s", imgpath)
+			metrics.WebhookUntrackedImages.WithLabelValues(d.Name()).Inc()
+			result.Status = webhookUntracked
+			untracked++
+		case err != nil:
+			klog.Errorf("error updating tag %s by reference: %s", imgpath, err)
+			result.Status = webhookFailed
+			failures++
+		}
+		results = append(results, result)
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
-}
+	status := http.StatusOK
+	switch {
+	case failures == len(imgpaths):
+		status = http.StatusInternalServerError
+	case untracked == len(imgpaths):
+		status = http.StatusNotFound
+	case failures > 0 || len(results) > len(imgpaths):
+		status = http.StatusMultiStatus
+	}
 
-// Start puts the http server online.
-func (d *DockerWebHook) Start(ctx context.Context) error {
-	server := &http.Server{
-		Addr:    d.bind,
-		Handler: d,
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(
+		map[string][]webhookResult{"results": results},
+	); err != nil {
+		klog.Errorf("error encoding docker webhook response: %s", err)
 	}
+}
 
-	go func() {
-		<-ctx.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			klog.Errorf("error shutting down https server: %s", err)
-		}
-	}()
+// ApplyConfig moves the http server to the configured bind address and sets
+// for how long in-flight requests are drained on shutdown.
+func (d *DockerWebHook) ApplyConfig(cfg *config.Config) {
+	d.server.applyConfig(cfg.Binds.Docker, cfg.Binds.Network(), cfg.DrainTimeout)
+}
 
-	if err := server.ListenAndServe(); err != nil {
-		if err == http.ErrServerClosed {
-			return nil
-		}
-		return err
-	}
-	return nil
+// Start puts the http server online.
+func (d *DockerWebHook) Start(ctx context.Context) error {
+	return d.server.run(ctx)
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sync"
 	"testing"
@@ -32,6 +33,7 @@ func TestDockerWebHooks(t *testing.T) {
 		name       string
 		reqbody    interface{}
 		expected   []string
+		results    []webhookResult
 		statuscode int
 		errorout   bool
 	}{
@@ -101,6 +103,93 @@ func TestDockerWebHooks(t *testing.T) {
 			expected:   nil,
 			statuscode: http.StatusInternalServerError,
 		},
+		{
+			name: "repeated pushes",
+			reqbody: []map[string]interface{}{
+				{
+					"push_data": map[string]interface{}{
+						"tag": "latest",
+					},
+					"repository": map[string]interface{}{
+						"namespace": "tagger",
+						"name":      "app",
+					},
+				},
+				{
+					"push_data": map[string]interface{}{
+						"tag": "latest",
+					},
+					"repository": map[string]interface{}{
+						"namespace": "tagger",
+						"name":      "app",
+					},
+				},
+				{
+					"push_data": map[string]interface{}{
+						"tag": "v1",
+					},
+					"repository": map[string]interface{}{
+						"namespace": "tagger",
+						"name":      "app",
+					},
+				},
+			},
+			expected: []string{
+				"docker.io/tagger/app:latest",
+				"docker.io/tagger/app:v1",
+			},
+			results: []webhookResult{
+				{Image: "docker.io/tagger/app:latest", Status: webhookUpdated},
+				{Image: "docker.io/tagger/app:v1", Status: webhookUpdated},
+			},
+			statuscode: http.StatusOK,
+		},
+		{
+			name: "batch with invalid push",
+			reqbody: []map[string]interface{}{
+				{
+					"push_data": map[string]interface{}{
+						"tag": "latest",
+					},
+					"repository": map[string]interface{}{
+						"namespace": "tagger",
+						"name":      "app",
+					},
+				},
+				{
+					"repository": map[string]interface{}{
+						"namespace": "tagger",
+						"name":      "app",
+					},
+				},
+			},
+			expected: []string{"docker.io/tagger/app:latest"},
+			results: []webhookResult{
+				{
+					Status: webhookInvalid,
+					Error:  "missing tag, repository name or namespace",
+				},
+				{Image: "docker.io/tagger/app:latest", Status: webhookUpdated},
+			},
+			statuscode: http.StatusMultiStatus,
+		},
+		{
+			name: "untracked image",
+			reqbody: map[string]interface{}{
+				"push_data": map[string]interface{}{
+					"tag": "untracked",
+				},
+				"repository": map[string]interface{}{
+					"namespace": "tagger",
+					"name":      "app",
+				},
+			},
+			expected: nil,
+			results: []webhookResult{
+				{Image: "docker.io/tagger/app:untracked", Status: webhookUntracked},
+			},
+			statuscode: http.StatusNotFound,
+		},
 		{
 			name:       "error decoding",
 			reqbody:    "<--xyk",
@@ -131,9 +220,64 @@ func TestDockerWebHooks(t *testing.T) {
 				t.Errorf("expected %+v, found %+v", tt.expected, svc.imgpaths)
 			}
 			svc.imgpaths = nil
+
+			if tt.results == nil {
+				return
+			}
+			var body map[string][]webhookResult
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatalf("error decoding response: %s", err)
+			}
+			if !reflect.DeepEqual(tt.results, body["results"]) {
+				t.Errorf("expected results %+v, found %+v", tt.results, body["results"])
+			}
 		})
 	}
 
 	cancel()
 	wg.Wait()
 }
+
+func TestNewDockerRequestPayload(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		namespace string
+		repo      string
+		tag       string
+		expected  string
+	}{
+		{
+			name:      "organization image",
+			namespace: "org",
+			repo:      "app",
+			tag:       "v1",
+			expected:  "docker.io/org/app:v1",
+		},
+		{
+			name:      "official image",
+			namespace: "library",
+			repo:      "centos",
+			tag:       "latest",
+			expected:  "docker.io/library/centos:latest",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(NewDockerRequestPayload(tt.namespace, tt.repo, tt.tag))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			svc := &tagupdater{}
+			w := httptest.NewRecorder()
+			NewDockerWebHook(svc).ServeHTTP(
+				w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)),
+			)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, %d received", w.Code)
+			}
+			if !reflect.DeepEqual(svc.imgpaths, []string{tt.expected}) {
+				t.Errorf("expected %s, %v received", tt.expected, svc.imgpaths)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	imageinf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagelis "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// FluxPolicySyncer abstraction exists to make testing easier. You most likely
+// wanna see FluxPolicy struct under services/flux.go for a concrete
+// implementation of this.
+type FluxPolicySyncer interface {
+	Sync(context.Context, *imagtagv1.Tag) error
+}
+
+// fluxPolicyAnnotation names the Flux ImagePolicy following a Tag, see
+// FluxPolicyAnnotation in services/flux.go.
+const fluxPolicyAnnotation = "image-tag-flux-policy"
+
+// FluxPolicy controller keeps the Flux ImagePolicies named by Tags in line
+// with them. Resyncs are not ignored, a policy changed by someone else (e.g.
+// the Flux image reflector) is set back within a resync period.
+type FluxPolicy struct {
+	taglister imagelis.TagLister
+	syncer    FluxPolicySyncer
+	shard     NamespaceOwner
+	queue     *trackedQueue
+	appctx    context.Context
+}
+
+// NewFluxPolicy returns a new controller for Flux ImagePolicies. If shard is
+// not nil only Tags in namespaces owned by the shard are processed.
+func NewFluxPolicy(
+	taginf imageinf.SharedInformerFactory,
+	syncer FluxPolicySyncer,
+	shard NamespaceOwner,
+) *FluxPolicy {
+	ctrl := &FluxPolicy{
+		taglister: taginf.Images().V1().Tags().Lister(),
+		queue:     newTrackedQueue(workqueue.New(), nil),
+		syncer:    syncer,
+		shard:     shard,
+	}
+	taginf.Images().V1().Tags().Informer().AddEventHandler(ctrl.handlers())
+	return ctrl
+}
+
+// Name returns a name identifier for this controller.
+func (f *FluxPolicy) Name() string {
+	return "flux policy"
+}
+
+// QueueState returns a snapshot of the controller work queue.
+func (f *FluxPolicy) QueueState() QueueState {
+	return f.queue.state(f.Name())
+}
+
+// enqueueEvent enqueues a Tag naming a Flux ImagePolicy as "namespace/name".
+// Events for namespaces not owned by our shard are ignored.
+func (f *FluxPolicy) enqueueEvent(o interface{}) {
+	it, ok := o.(*imagtagv1.Tag)
+	if !ok || it.Annotations[fluxPolicyAnnotation] == "" {
+		return
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(o)
+	if err != nil {
+		klog.Errorf("fail to enqueue event: %v : %s", o, err)
+		return
+	}
+	if !ownsKey(f.shard, key) {
+		metrics.ShardSkippedEvents.WithLabelValues(f.Name()).Inc()
+		return
+	}
+	f.queue.Add(key)
+}
+
+// handlers return the event handlers for Tags. Deleted Tags are of no
+// interest, their policies are left as they are.
+func (f *FluxPolicy) handlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			f.enqueueEvent(o)
+		},
+		UpdateFunc: func(o, n interface{}) {
+			f.enqueueEvent(n)
+		},
+		DeleteFunc: func(o interface{}) {},
+	}
+}
+
+// eventProcessor reads our events calling syncTag for all of them.
+func (f *FluxPolicy) eventProcessor(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		evt, end := f.queue.Get()
+		if end {
+			return
+		}
+
+		namespace, name, err := cache.SplitMetaNamespaceKey(evt.(string))
+		if err != nil {
+			klog.Errorf("invalid event received %s: %s", evt, err)
+			f.queue.Done(evt)
+			continue
+		}
+
+		klog.V(5).Infof("received event for flux policy of tag: %s", evt)
+		if err := f.syncTag(namespace, name); err != nil {
+			klog.Errorf("error syncing flux policy of tag %s: %v", evt, err)
+			f.queue.Done(evt)
+			f.queue.AddAfter(evt, 5*time.Second)
+			continue
+		}
+		f.queue.Forget(evt)
+		f.queue.Done(evt)
+	}
+}
+
+// syncTag syncs the Flux ImagePolicy of a Tag.
+func (f *FluxPolicy) syncTag(namespace, name string) error {
+	ctx, cancel := context.WithTimeout(f.appctx, 10*time.Second)
+	defer cancel()
+
+	it, err := f.taglister.Tags(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return f.syncer.Sync(ctx, it.DeepCopy())
+}
+
+// Start starts the controller's event loop.
+func (f *FluxPolicy) Start(ctx context.Context) error {
+	// appctx is the 'keep going' context, if it is cancelled
+	// everything we might be doing should stop.
+	f.appctx = ctx
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go f.eventProcessor(&wg)
+
+	// wait until it is time to die.
+	<-f.appctx.Done()
+
+	f.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+type flsvc struct {
+	sync.Mutex
+	calls map[string]int
+}
+
+func (f *flsvc) Sync(ctx context.Context, it *imagtagv1.Tag) error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls[it.Name]++
+	return nil
+}
+
+func (f *flsvc) get(name string) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[name]
+}
+
+func TestFluxPolicyController(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &flsvc{calls: map[string]int{}}
+
+	ctrl := NewFluxPolicy(taginf, svc, nil)
+	taginf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), taginf.Images().V1().Tags().Informer().HasSynced) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error starting controller: %s", err)
+		}
+	}()
+
+	for _, it := range []*imagtagv1.Tag{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "prod",
+				Name:        "app",
+				Annotations: map[string]string{fluxPolicyAnnotation: "app"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "prod",
+				Name:      "worker",
+			},
+		},
+	} {
+		if _, err := tagcli.ImagesV1().Tags("prod").Create(
+			ctx, it, metav1.CreateOptions{},
+		); err != nil {
+			t.Errorf("error creating tag: %s", err)
+		}
+	}
+
+	// give some room for the events to be dispatched towards the controller.
+	time.Sleep(time.Second)
+
+	if calls := svc.get("app"); calls != 1 {
+		t.Errorf("expected 1 call, %d calls made", calls)
+	}
+	if calls := svc.get("worker"); calls != 0 {
+		t.Errorf("tag without policy synced %d times", calls)
+	}
+
+	cancel()
+	wg.Wait()
+}
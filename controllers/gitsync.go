@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// TagSyncer abstraction exists to make testing easier. You most likely wanna
+// see GitSync struct under services/gitsync.go for a concrete implementation.
+type TagSyncer interface {
+	Sync(ctx context.Context) error
+}
+
+// gitSyncTimeout is how long a single sync, fetch included, may take.
+const gitSyncTimeout = 5 * time.Minute
+
+// GitSync keeps the Tags in line with their definitions in a Git repository.
+// Tags are synced whenever the configuration changes, every configured
+// interval and when triggered by a POST to its http server, e.g. by a push
+// webhook from the Git provider. Triggers carry no information, they only
+// anticipate the next sync, so they need no authentication.
+type GitSync struct {
+	mtx     sync.Mutex
+	cfg     *config.GitSync
+	server  *httpServer
+	syncsvc TagSyncer
+	trigger chan struct{}
+}
+
+// NewGitSync returns a controller syncing Tags from Git. Nothing is done
+// unless the gitSync configuration is set.
+func NewGitSync(syncsvc TagSyncer) *GitSync {
+	ctrl := &GitSync{
+		syncsvc: syncsvc,
+		trigger: make(chan struct{}, 1),
+	}
+	ctrl.server = newHTTPServer(ctrl.Name(), config.Default().Binds.GitSync, ctrl)
+	return ctrl
+}
+
+// Name returns a name identifier for this controller.
+func (g *GitSync) Name() string {
+	return "git sync"
+}
+
+// ApplyConfig stores the git sync configuration, moves the http server to
+// the configured bind address and schedules a sync.
+func (g *GitSync) ApplyConfig(cfg *config.Config) {
+	g.mtx.Lock()
+	g.cfg = cfg.GitSync
+	g.mtx.Unlock()
+	g.server.applyConfig(cfg.Binds.GitSync, cfg.Binds.Network(), cfg.DrainTimeout)
+	g.schedule()
+}
+
+// enabled returns true if git sync is configured.
+func (g *GitSync) enabled() bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.cfg != nil
+}
+
+// pollInterval returns how often Tags are synced, zero if polling is
+// disabled.
+func (g *GitSync) pollInterval() time.Duration {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.cfg == nil {
+		return 0
+	}
+	return g.cfg.Interval
+}
+
+// schedule makes a sync to happen as soon as possible. Syncs scheduled while
+// another one is pending are coalesced.
+func (g *GitSync) schedule() {
+	select {
+	case g.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// ServeHTTP schedules a sync on POST requests. Requests are answered right
+// away, the sync happens in the background.
+func (g *GitSync) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !g.enabled() {
+		http.Error(w, "git sync not configured", http.StatusNotFound)
+		return
+	}
+
+	klog.V(2).Info("git sync triggered")
+	g.schedule()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(http.StatusText(http.StatusAccepted)))
+}
+
+// Start puts the http server online and syncs Tags until the context is
+// cancelled.
+func (g *GitSync) Start(ctx context.Context) error {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := g.server.run(ctx); err != nil {
+			klog.Errorf("git sync server failed: %s", err)
+		}
+	}()
+	defer wg.Wait()
+
+	// the ticker follows the configured interval, configuration changes
+	// always schedule a sync so it is reset right away. A nil channel
+	// blocks forever, i.e. polling is disabled.
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	var interval time.Duration
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+		case <-g.trigger:
+		}
+
+		if cur := g.pollInterval(); cur != interval {
+			if ticker != nil {
+				ticker.Stop()
+				ticker, tick = nil, nil
+			}
+			if cur > 0 {
+				ticker = time.NewTicker(cur)
+				tick = ticker.C
+			}
+			interval = cur
+		}
+
+		if !g.enabled() {
+			continue
+		}
+		sctx, cancel := context.WithTimeout(ctx, gitSyncTimeout)
+		err := g.syncsvc.Sync(sctx)
+		cancel()
+		if err != nil {
+			klog.Errorf("error syncing tags from git: %s", err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+type tagsyncer struct {
+	syncs chan struct{}
+}
+
+func (t *tagsyncer) Sync(ctx context.Context) error {
+	select {
+	case t.syncs <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func TestGitSyncServeHTTP(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		method string
+		cfg    *config.GitSync
+		code   int
+	}{
+		{
+			name:   "not configured",
+			method: http.MethodPost,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "wrong method",
+			method: http.MethodGet,
+			cfg:    &config.GitSync{Repository: "https://example.com/tags.git"},
+			code:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "triggered",
+			method: http.MethodPost,
+			cfg:    &config.GitSync{Repository: "https://example.com/tags.git"},
+			code:   http.StatusAccepted,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := NewGitSync(&tagsyncer{})
+			ctrl.mtx.Lock()
+			ctrl.cfg = tt.cfg
+			ctrl.mtx.Unlock()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/", nil)
+			ctrl.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("expected code %d, %d received", tt.code, w.Code)
+			}
+
+			scheduled := len(ctrl.trigger) == 1
+			if expected := tt.code == http.StatusAccepted; scheduled != expected {
+				t.Errorf("expected scheduled %v, %v found", expected, scheduled)
+			}
+		})
+	}
+}
+
+func TestGitSyncStart(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	syncer := &tagsyncer{syncs: make(chan struct{})}
+	ctrl := NewGitSync(syncer)
+
+	cfg := config.Default()
+	cfg.Binds.GitSync = "127.0.0.1:0"
+	cfg.GitSync = &config.GitSync{Repository: "https://example.com/tags.git"}
+	ctrl.ApplyConfig(cfg)
+
+	done := make(chan error)
+	go func() {
+		done <- ctrl.Start(ctx)
+	}()
+
+	waitSync := func(reason string) {
+		select {
+		case <-syncer.syncs:
+		case <-ctx.Done():
+			t.Fatalf("no sync after %s", reason)
+		}
+	}
+
+	waitSync("config")
+	ctrl.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	waitSync("trigger")
+
+	cfg.GitSync = &config.GitSync{
+		Repository: "https://example.com/tags.git",
+		Interval:   10 * time.Millisecond,
+	}
+	ctrl.ApplyConfig(cfg)
+	waitSync("config change")
+	waitSync("poll")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
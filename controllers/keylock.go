@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"sync"
+)
+
+// keyLock serializes operations per key while operations on distinct keys run
+// in parallel. Entries exist only while a key is locked or waited for.
+type keyLock struct {
+	mtx   sync.Mutex
+	locks map[string]*keyLockEntry
+}
+
+// keyLockEntry is the lock for a single key. Refs counts the holder and the
+// waiters, the entry is dropped once nobody refers to it.
+type keyLockEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// newKeyLock returns an empty keyLock.
+func newKeyLock() *keyLock {
+	return &keyLock{locks: map[string]*keyLockEntry{}}
+}
+
+// lock blocks until key is free and locks it. The returned function unlocks
+// the key and must be called exactly once.
+func (k *keyLock) lock(key string) func() {
+	k.mtx.Lock()
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyLockEntry{}
+		k.locks[key] = entry
+	}
+	entry.refs++
+	k.mtx.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		k.mtx.Lock()
+		defer k.mtx.Unlock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// size returns how many keys are locked or waited for.
+func (k *keyLock) size() int {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	return len(k.locks)
+}
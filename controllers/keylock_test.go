@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyLock(t *testing.T) {
+	locks := newKeyLock()
+	unlock := locks.lock("ns/a")
+
+	// distinct keys are not serialized.
+	other := make(chan bool)
+	go func() {
+		defer close(other)
+		locks.lock("ns/b")()
+	}()
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock on a distinct key blocked")
+	}
+
+	var wg sync.WaitGroup
+	acquired := make(chan bool, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer locks.lock("ns/a")()
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("key locked twice")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	unlock()
+	wg.Wait()
+	if len(acquired) != 1 {
+		t.Errorf("waiter did not acquire the lock")
+	}
+	if size := locks.size(); size != 0 {
+		t.Errorf("expected no entries left, %d found", size)
+	}
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/metrics"
+	"github.com/ricardomaraschini/tagger/version"
+)
+
+// MetricsServer exposes tagger prometheus metrics and build information
+// over http.
+type MetricsServer struct {
+	server *httpServer
+	mux    *http.ServeMux
+}
+
+// NewMetricsServer returns a web server that exposes metrics on /metrics and
+// build information on /version.
+func NewMetricsServer() *MetricsServer {
+	srv := &MetricsServer{
+		mux: http.NewServeMux(),
+	}
+	srv.mux.Handle("/metrics", metrics.Handler())
+	srv.mux.HandleFunc("/version", srv.version)
+	srv.server = newHTTPServer(srv.Name(), config.Default().Binds.Metrics, srv.mux)
+	return srv
+}
+
+// version writes down the build information as json.
+func (m *MetricsServer) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(version.Get()); err != nil {
+		klog.Errorf("error encoding version: %s", err)
+	}
+}
+
+// Handle registers another handler for the given pattern, e.g. reports
+// meant for the same audience as the metrics.
+func (m *MetricsServer) Handle(pattern string, handler http.Handler) {
+	m.mux.Handle(pattern, handler)
+}
+
+// Name returns a name identifier for this controller.
+func (m *MetricsServer) Name() string {
+	return "metrics server"
+}
+
+// ServeHTTP dispatches requests to the registered handlers.
+func (m *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mux.ServeHTTP(w, r)
+}
+
+// ApplyConfig moves the http server to the configured bind address and sets
+// for how long in-flight requests are drained on shutdown.
+func (m *MetricsServer) ApplyConfig(cfg *config.Config) {
+	m.server.applyConfig(cfg.Binds.Metrics, cfg.Binds.Network(), cfg.DrainTimeout)
+}
+
+// Start puts the http server online.
+func (m *MetricsServer) Start(ctx context.Context) error {
+	return m.server.run(ctx)
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ricardomaraschini/tagger/metrics"
+	"github.com/ricardomaraschini/tagger/version"
+)
+
+func TestMetricsServer(t *testing.T) {
+	metrics.ShardInfo.WithLabelValues("0", "1").Set(1)
+
+	srv := NewMetricsServer()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	srv.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", w.Code)
+	}
+
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading body: %s", err)
+	}
+
+	if !strings.Contains(string(body), `tagger_shard_info{index="0",total="1"} 1`) {
+		t.Errorf("shard info metric not found: %s", string(body))
+	}
+
+	if !strings.Contains(string(body), `tagger_build_info{`) {
+		t.Errorf("build info metric not found: %s", string(body))
+	}
+}
+
+func TestMetricsServerVersion(t *testing.T) {
+	srv := NewMetricsServer()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/version", nil)
+	srv.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", w.Code)
+	}
+
+	var info version.Info
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatalf("unexpected error decoding body: %s", err)
+	}
+
+	if !reflect.DeepEqual(info, version.Get()) {
+		t.Errorf("expected %+v, %+v received", version.Get(), info)
+	}
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// MonitoringSyncer abstraction exists to make testing easier. You most likely
+// wanna see Monitoring struct under services/monitoring.go for a concrete
+// implementation of this.
+type MonitoringSyncer interface {
+	Sync(ctx context.Context) (bool, error)
+}
+
+// Monitoring controller keeps the Prometheus operator objects scraping our
+// metrics and alerting on them in line with the configuration. Objects are
+// synced whenever the configuration changes and periodically, reverting
+// changes made to them by hand.
+type Monitoring struct {
+	syncer MonitoringSyncer
+	resync time.Duration
+	sync   chan struct{}
+}
+
+// NewMonitoring returns a controller for the Prometheus operator objects.
+func NewMonitoring(syncer MonitoringSyncer) *Monitoring {
+	return &Monitoring{
+		syncer: syncer,
+		resync: 5 * time.Minute,
+		sync:   make(chan struct{}, 1),
+	}
+}
+
+// Name returns a name identifier for this controller.
+func (m *Monitoring) Name() string {
+	return "monitoring"
+}
+
+// ApplyConfig schedules a sync, the monitoring syncer must have been given
+// the configuration before.
+func (m *Monitoring) ApplyConfig(cfg *config.Config) {
+	select {
+	case m.sync <- struct{}{}:
+	default:
+	}
+}
+
+// Start syncs the objects on every configuration change and every resync
+// period, until the context is cancelled.
+func (m *Monitoring) Start(ctx context.Context) error {
+	ticker := time.NewTicker(m.resync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-m.sync:
+		}
+
+		sctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		changed, err := m.syncer.Sync(sctx)
+		cancel()
+		if err != nil {
+			klog.Errorf("error syncing monitoring objects: %s", err)
+			continue
+		}
+		if changed {
+			klog.Info("monitoring objects updated")
+		}
+	}
+}
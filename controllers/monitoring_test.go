@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+type mnsvc struct {
+	sync.Mutex
+	calls int
+}
+
+func (m *mnsvc) Sync(ctx context.Context) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.calls++
+	return true, nil
+}
+
+func (m *mnsvc) get() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.calls
+}
+
+func TestMonitoringController(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	svc := &mnsvc{}
+	ctrl := NewMonitoring(svc)
+	ctrl.resync = 500 * time.Millisecond
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error starting controller: %s", err)
+		}
+	}()
+
+	// configuration changes are synced right away.
+	ctrl.ApplyConfig(config.Default())
+	time.Sleep(100 * time.Millisecond)
+	if calls := svc.get(); calls != 1 {
+		t.Errorf("expected 1 sync, %d syncs", calls)
+	}
+
+	// objects are synced again every resync period.
+	time.Sleep(time.Second)
+	if calls := svc.get(); calls < 2 {
+		t.Errorf("expected periodic syncs, %d syncs", calls)
+	}
+
+	cancel()
+	wg.Wait()
+}
@@ -18,37 +18,84 @@ import (
 
 	"github.com/mattbaird/jsonpatch"
 
+	"github.com/ricardomaraschini/tagger/config"
 	imgtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
 )
 
 // PodPatcher creates a patch for a pod resource, possibly overwritting
-// tag references by their concrete location. You might want to look at
-// the concrete implementation of this at services/tag.go.
+// tag references by their concrete location, and the warnings the pod is
+// admitted with. You might want to look at the concrete implementation of
+// this at services/tag.go.
 type PodPatcher interface {
-	PatchForPod(pod corev1.Pod) ([]jsonpatch.JsonPatchOperation, error)
+	PatchForPod(ctx context.Context, pod corev1.Pod) ([]jsonpatch.JsonPatchOperation, []string, error)
+}
+
+// PodValidator validates a pod once every mutation has been applied to it,
+// returning the warnings the pod is admitted with or an error if the pod must
+// be rejected. See services/enforcement.go for the concrete implementation.
+type PodValidator interface {
+	ValidatePod(ctx context.Context, pod corev1.Pod) ([]string, error)
+}
+
+// PodAdmitter patches pods and validates them once patched.
+type PodAdmitter interface {
+	PodPatcher
+	PodValidator
+}
+
+// admissionTimeout is how long the API server waits for a webhook when the
+// request carries no timeout. admissionMargin is the part of it kept to send
+// the response back.
+const (
+	admissionTimeout = 10 * time.Second
+	admissionMargin  = time.Second
+)
+
+// admissionContext returns a context that expires before the API server
+// gives up on the request. The API server informs its timeout through the
+// "timeout" query parameter, e.g. "/pod?timeout=10s".
+func admissionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := admissionTimeout
+	if val := r.URL.Query().Get("timeout"); val != "" {
+		if parsed, err := time.ParseDuration(val); err == nil && parsed > 0 {
+			timeout = parsed
+		}
+	}
+	if timeout > 2*admissionMargin {
+		timeout -= admissionMargin
+	} else {
+		timeout /= 2
+	}
+	return context.WithTimeout(r.Context(), timeout)
 }
 
 // MutatingWebHook handles Mutation requests from kubernetes api.
 type MutatingWebHook struct {
-	key     string
-	cert    string
-	bind    string
-	tagsvc  PodPatcher
+	server  *httpServer
+	tagsvc  PodAdmitter
 	decoder runtime.Decoder
 }
 
 // NewMutatingWebHook returns a web hook handler for kubernetes api mutation
-// requests.
-func NewMutatingWebHook(tagsvc PodPatcher) *MutatingWebHook {
+// requests. Requests for resources related to deploys (Pods) are set to pod()
+// handler while image tag resources are managed by tag() handler. Pods are
+// validated, once mutated, by the validatePod() handler.
+func NewMutatingWebHook(tagsvc PodAdmitter) *MutatingWebHook {
 	runtimeScheme := runtime.NewScheme()
 	codecs := serializer.NewCodecFactory(runtimeScheme)
-	return &MutatingWebHook{
-		key:     "assets/server.key",
-		cert:    "assets/server.crt",
-		bind:    ":8080",
+	hook := &MutatingWebHook{
 		decoder: codecs.UniversalDeserializer(),
 		tagsvc:  tagsvc,
 	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pod", hook.pod)
+	mux.HandleFunc("/tag", hook.tag)
+	mux.HandleFunc("/validate-pod", hook.validatePod)
+	hook.server = newHTTPServer(hook.Name(), config.Default().Binds.Mutating, mux)
+	hook.server.key = "assets/server.key"
+	hook.server.cert = "assets/server.crt"
+	return hook
 }
 
 // Name returns a name identifier for this controller.
@@ -128,6 +175,10 @@ func (m *MutatingWebHook) tag(w http.ResponseWriter, r *http.Request) {
 		m.responseError(w, reviewReq, err)
 		return
 	}
+	if reviewReq.Request == nil {
+		m.responseError(w, reviewReq, fmt.Errorf("admission review without request"))
+		return
+	}
 
 	objkind := reviewReq.Request.Kind.Kind
 	if objkind != "Tag" {
@@ -148,6 +199,21 @@ func (m *MutatingWebHook) tag(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := tag.ValidateImageSelector(); err != nil {
+		m.responseError(w, reviewReq, err)
+		return
+	}
+
+	if err := tag.ValidateRetag(); err != nil {
+		m.responseError(w, reviewReq, err)
+		return
+	}
+
+	if err := tag.ValidateDeprecation(); err != nil {
+		m.responseError(w, reviewReq, err)
+		return
+	}
+
 	reviewResp := &admnv1.AdmissionReview{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "admission.k8s.io/v1",
@@ -183,6 +249,10 @@ func (m *MutatingWebHook) pod(w http.ResponseWriter, r *http.Request) {
 		m.responseError(w, reviewReq, err)
 		return
 	}
+	if reviewReq.Request == nil {
+		m.responseError(w, reviewReq, fmt.Errorf("admission review without request"))
+		return
+	}
 
 	// we only mutate pods, if mutating webhook is properly configured this
 	// should never happen.
@@ -203,7 +273,11 @@ func (m *MutatingWebHook) pod(w http.ResponseWriter, r *http.Request) {
 	// XXX namespace comes in empty, set it here.
 	pod.Namespace = reviewReq.Request.Namespace
 
-	patch, err := m.tagsvc.PatchForPod(pod)
+	// lookups not answered before the API server times out are given up,
+	// the pod is then rejected with the error instead of by the timeout.
+	ctx, cancel := admissionContext(r)
+	defer cancel()
+	patch, warnings, err := m.tagsvc.PatchForPod(ctx, pod)
 	if err != nil {
 		klog.Errorf("error patching %s: %s", objkind, err)
 		m.responseError(w, reviewReq, err)
@@ -213,6 +287,7 @@ func (m *MutatingWebHook) pod(w http.ResponseWriter, r *http.Request) {
 	var ptype *admnv1.PatchType
 	var patchData []byte
 	if patch != nil {
+		klog.V(2).Infof("patching pod %s/%s", pod.Namespace, pod.GenerateName)
 		jpt := admnv1.PatchType("JSONPatch")
 		ptype = &jpt
 
@@ -234,6 +309,7 @@ func (m *MutatingWebHook) pod(w http.ResponseWriter, r *http.Request) {
 			UID:       reviewReq.Request.UID,
 			Patch:     patchData,
 			PatchType: ptype,
+			Warnings:  warnings,
 		},
 	}
 
@@ -246,30 +322,79 @@ func (m *MutatingWebHook) pod(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(resp)
 }
 
-// Start puts the http server online. Requests for resources related to
-// deploys (Deployments and Pods) are set to deploy() handler while
-// image tag resources are managed by tag() handler.
-func (m *MutatingWebHook) Start(ctx context.Context) error {
-	http.HandleFunc("/pod", m.pod)
-	http.HandleFunc("/tag", m.tag)
-	server := &http.Server{
-		Addr: m.bind,
-	}
-
-	go func() {
-		<-ctx.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			klog.Errorf("error shutting down https server: %s", err)
-		}
-	}()
+// validatePod handles validation requests made by kubernetes api with regards
+// to pods. These come after all mutating webhooks so the pod images are the
+// ones the pod is going to run.
+func (m *MutatingWebHook) validatePod(w http.ResponseWriter, r *http.Request) {
+	reviewReq := &admnv1.AdmissionReview{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		klog.Errorf("error reading body: %s", err)
+		m.responseError(w, reviewReq, err)
+		return
+	}
 
-	if err := server.ListenAndServeTLS(m.cert, m.key); err != nil {
-		if err == http.ErrServerClosed {
-			return nil
-		}
-		return err
+	if _, _, err := m.decoder.Decode(body, nil, reviewReq); err != nil {
+		klog.Errorf("cant decode body: %s", err)
+		m.responseError(w, reviewReq, err)
+		return
+	}
+	if reviewReq.Request == nil {
+		m.responseError(w, reviewReq, fmt.Errorf("admission review without request"))
+		return
+	}
+
+	objkind := reviewReq.Request.Kind.Kind
+	if objkind != "Pod" {
+		klog.Errorf("strange event for a %s, authorizing", objkind)
+		m.responseAuthorized(w, reviewReq)
+		return
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(reviewReq.Request.Object.Raw, &pod); err != nil {
+		klog.Errorf("error decoding raw object: %s", err)
+		m.responseError(w, reviewReq, err)
+		return
 	}
-	return nil
+	pod.Namespace = reviewReq.Request.Namespace
+
+	ctx, cancel := admissionContext(r)
+	defer cancel()
+	warnings, err := m.tagsvc.ValidatePod(ctx, pod)
+	if err != nil {
+		m.responseError(w, reviewReq, err)
+		return
+	}
+
+	reviewResp := &admnv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: &admnv1.AdmissionResponse{
+			Allowed:  true,
+			UID:      reviewReq.Request.UID,
+			Warnings: warnings,
+		},
+	}
+
+	resp, err := json.Marshal(reviewResp)
+	if err != nil {
+		errstr := fmt.Sprintf("error encoding response: %v", err)
+		http.Error(w, errstr, http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(resp)
+}
+
+// ApplyConfig moves the https server to the configured bind address and sets
+// for how long in-flight requests are drained on shutdown.
+func (m *MutatingWebHook) ApplyConfig(cfg *config.Config) {
+	m.server.applyConfig(cfg.Binds.Mutating, cfg.Binds.Network(), cfg.DrainTimeout)
+}
+
+// Start puts the https server online.
+func (m *MutatingWebHook) Start(ctx context.Context) error {
+	return m.server.run(ctx)
 }
@@ -2,12 +2,14 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	admnv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -21,12 +23,19 @@ import (
 )
 
 type patcher struct {
-	err   error
-	patch []jsonpatch.JsonPatchOperation
+	err      error
+	patch    []jsonpatch.JsonPatchOperation
+	warnings []string
 }
 
-func (p *patcher) PatchForPod(pod corev1.Pod) ([]jsonpatch.JsonPatchOperation, error) {
-	return p.patch, p.err
+func (p *patcher) PatchForPod(
+	ctx context.Context, pod corev1.Pod,
+) ([]jsonpatch.JsonPatchOperation, []string, error) {
+	return p.patch, p.warnings, p.err
+}
+
+func (p *patcher) ValidatePod(ctx context.Context, pod corev1.Pod) ([]string, error) {
+	return p.warnings, p.err
 }
 
 func Test_responseError(t *testing.T) {
@@ -150,6 +159,16 @@ func Test_tag(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "deprecation without message",
+			kind:    "Tag",
+			allowed: false,
+			tag: &imgv1.Tag{
+				Spec: imgv1.TagSpec{
+					Deprecation: &imgv1.TagDeprecation{},
+				},
+			},
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			mt := NewMutatingWebHook(nil)
@@ -204,6 +223,7 @@ func Test_pod(t *testing.T) {
 		kind         string
 		patcherError error
 		patcherPatch []jsonpatch.JsonPatchOperation
+		warnings     []string
 		pod          *corev1.Pod
 		allowed      bool
 	}{
@@ -230,6 +250,13 @@ func Test_pod(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:     "with warnings",
+			kind:     "Pod",
+			allowed:  true,
+			pod:      &corev1.Pod{},
+			warnings: []string{"tag default/app is deprecated: use app-v2"},
+		},
 		{
 			name:    "wrong kind",
 			kind:    "Deployment",
@@ -246,8 +273,9 @@ func Test_pod(t *testing.T) {
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			mt := NewMutatingWebHook(&patcher{
-				err:   tt.patcherError,
-				patch: tt.patcherPatch,
+				err:      tt.patcherError,
+				patch:    tt.patcherPatch,
+				warnings: tt.warnings,
 			})
 
 			podjson, err := json.Marshal(tt.pod)
@@ -291,6 +319,10 @@ func Test_pod(t *testing.T) {
 				t.Errorf("expected allowed to be %v", tt.allowed)
 			}
 
+			if !reflect.DeepEqual(resp.Response.Warnings, tt.warnings) {
+				t.Errorf("unexpected warnings: %v", resp.Response.Warnings)
+			}
+
 			if tt.patcherPatch == nil {
 				if len(resp.Response.Patch) > 0 {
 					t.Errorf("unexpected patch: %+v", resp.Response.Patch)
@@ -309,3 +341,149 @@ func Test_pod(t *testing.T) {
 		})
 	}
 }
+
+func Test_validatePod(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		kind     string
+		err      error
+		warnings []string
+		allowed  bool
+		message  string
+	}{
+		{
+			name:    "valid pod",
+			kind:    "Pod",
+			allowed: true,
+		},
+		{
+			name:     "dry run",
+			kind:     "Pod",
+			warnings: []string{"image centos:latest is not a generation of any tag"},
+			allowed:  true,
+		},
+		{
+			name:    "unknown images",
+			kind:    "Pod",
+			err:     fmt.Errorf("images not imported by any tag: centos:latest"),
+			message: "images not imported by any tag: centos:latest",
+		},
+		{
+			name:    "wrong kind",
+			kind:    "Deployment",
+			err:     fmt.Errorf("never called"),
+			allowed: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := NewMutatingWebHook(&patcher{
+				err:      tt.err,
+				warnings: tt.warnings,
+			})
+
+			podjson, err := json.Marshal(&corev1.Pod{})
+			if err != nil {
+				t.Fatalf("error marshaling pod: %s", err)
+			}
+			req := admnv1.AdmissionReview{
+				Request: &admnv1.AdmissionRequest{
+					Kind:      metav1.GroupVersionKind{Kind: tt.kind},
+					Namespace: "default",
+					Object:    runtime.RawExtension{Raw: podjson},
+					UID:       types.UID(tt.name),
+				},
+			}
+			buf := bytes.NewBuffer(nil)
+			if err := json.NewEncoder(buf).Encode(req); err != nil {
+				t.Fatalf("error marshaling body: %s", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/validate-pod", buf)
+			mt.validatePod(w, r)
+
+			var resp admnv1.AdmissionReview
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("error decoding reply: %s", err)
+			}
+			if resp.Response.UID != types.UID(tt.name) {
+				t.Errorf("expected uid %q, %q found", tt.name, resp.Response.UID)
+			}
+			if resp.Response.Allowed != tt.allowed {
+				t.Errorf("expected allowed to be %v", tt.allowed)
+			}
+			if !reflect.DeepEqual(resp.Response.Warnings, tt.warnings) {
+				t.Errorf("unexpected warnings: %v", resp.Response.Warnings)
+			}
+			if tt.message != "" &&
+				(resp.Response.Result == nil || resp.Response.Result.Message != tt.message) {
+				t.Errorf("unexpected result: %+v", resp.Response.Result)
+			}
+		})
+	}
+}
+
+func Test_podWithoutRequest(t *testing.T) {
+	mt := NewMutatingWebHook(&patcher{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/pod", bytes.NewBufferString(`{}`))
+	mt.pod(w, r)
+
+	var resp admnv1.AdmissionReview
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("error decoding reply: %s", err)
+	}
+	if resp.Response.Allowed {
+		t.Errorf("review without request allowed")
+	}
+	if resp.Response.Result == nil ||
+		resp.Response.Result.Message != "admission review without request" {
+		t.Errorf("unexpected result: %+v", resp.Response.Result)
+	}
+}
+
+func Test_admissionContext(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		url     string
+		timeout time.Duration
+	}{
+		{
+			name:    "no timeout",
+			url:     "/pod",
+			timeout: 9 * time.Second,
+		},
+		{
+			name:    "api server timeout",
+			url:     "/pod?timeout=30s",
+			timeout: 29 * time.Second,
+		},
+		{
+			name:    "short timeout",
+			url:     "/pod?timeout=1s",
+			timeout: 500 * time.Millisecond,
+		},
+		{
+			name:    "invalid timeout",
+			url:     "/pod?timeout=soon",
+			timeout: 9 * time.Second,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.url, nil)
+			ctx, cancel := admissionContext(r)
+			defer cancel()
+
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				t.Fatal("context without deadline")
+			}
+			// allow for the time spent creating the context.
+			if left := time.Until(deadline); left > tt.timeout ||
+				left < tt.timeout-time.Second {
+				t.Errorf("expected %s timeout, %s left", tt.timeout, left)
+			}
+		})
+	}
+}
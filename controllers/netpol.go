@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imageinf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// NetworkPolicySyncer abstraction exists to make testing easier. You most
+// likely wanna see NetworkPolicy struct under services/netpol.go for a
+// concrete implementation of this.
+type NetworkPolicySyncer interface {
+	Sync(ctx context.Context) (bool, error)
+}
+
+// NetworkPolicy controller keeps the egress NetworkPolicy of our pods in line
+// with the registries Tags are imported from. A sync is scheduled whenever a
+// Tag is created, deleted or starts pointing to another image, and whenever
+// the configuration changes. Registries are resolved again on every resync
+// period as their addresses change over time.
+type NetworkPolicy struct {
+	syncer NetworkPolicySyncer
+	resync time.Duration
+	sync   chan struct{}
+}
+
+// NewNetworkPolicy returns a controller for the egress NetworkPolicy.
+func NewNetworkPolicy(
+	taginf imageinf.SharedInformerFactory, syncer NetworkPolicySyncer,
+) *NetworkPolicy {
+	ctrl := &NetworkPolicy{
+		syncer: syncer,
+		resync: 5 * time.Minute,
+		sync:   make(chan struct{}, 1),
+	}
+	taginf.Images().V1().Tags().Informer().AddEventHandler(ctrl.handlers())
+	return ctrl
+}
+
+// Name returns a name identifier for this controller.
+func (n *NetworkPolicy) Name() string {
+	return "network policy"
+}
+
+// schedule schedules a sync, syncs already scheduled absorb it.
+func (n *NetworkPolicy) schedule() {
+	select {
+	case n.sync <- struct{}{}:
+	default:
+	}
+}
+
+// ApplyConfig schedules a sync, the network policy syncer must have been
+// given the configuration before.
+func (n *NetworkPolicy) ApplyConfig(cfg *config.Config) {
+	n.schedule()
+}
+
+// handlers return the event handlers for Tags. Only changes to the image a
+// Tag points to may change the registries in use.
+func (n *NetworkPolicy) handlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			n.schedule()
+		},
+		UpdateFunc: func(o, nw interface{}) {
+			oldtag, ok := o.(*imagtagv1.Tag)
+			if !ok {
+				return
+			}
+			newtag, ok := nw.(*imagtagv1.Tag)
+			if !ok || oldtag.Spec.From == newtag.Spec.From {
+				return
+			}
+			n.schedule()
+		},
+		DeleteFunc: func(o interface{}) {
+			n.schedule()
+		},
+	}
+}
+
+// Start syncs the NetworkPolicy whenever scheduled and every resync period,
+// until the context is cancelled.
+func (n *NetworkPolicy) Start(ctx context.Context) error {
+	ticker := time.NewTicker(n.resync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-n.sync:
+		}
+
+		sctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		changed, err := n.syncer.Sync(sctx)
+		cancel()
+		if err != nil {
+			klog.Errorf("error syncing network policy: %s", err)
+			continue
+		}
+		if changed {
+			klog.Info("network policy updated")
+		}
+	}
+}
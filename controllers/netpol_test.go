@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+type npsvc struct {
+	sync.Mutex
+	calls int
+}
+
+func (n *npsvc) Sync(ctx context.Context) (bool, error) {
+	n.Lock()
+	defer n.Unlock()
+	n.calls++
+	return false, nil
+}
+
+func (n *npsvc) get() int {
+	n.Lock()
+	defer n.Unlock()
+	return n.calls
+}
+
+func TestNetworkPolicyController(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &npsvc{}
+
+	ctrl := NewNetworkPolicy(taginf, svc)
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), taginf.Images().V1().Tags().Informer().HasSynced) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error starting controller: %s", err)
+		}
+	}()
+
+	ctrl.ApplyConfig(config.Default())
+	time.Sleep(time.Second)
+	if calls := svc.get(); calls != 1 {
+		t.Errorf("expected 1 sync, %d syncs", calls)
+	}
+
+	it, err := tagcli.ImagesV1().Tags("prod").Create(
+		ctx,
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+			Spec:       imagtagv1.TagSpec{From: "quay.io/company/app:latest"},
+		},
+		metav1.CreateOptions{},
+	)
+	if err != nil {
+		t.Fatalf("error creating tag: %s", err)
+	}
+	time.Sleep(time.Second)
+	if calls := svc.get(); calls != 2 {
+		t.Errorf("expected 2 syncs, %d syncs", calls)
+	}
+
+	// changes not touching the image the tag points to are of no interest.
+	it.Spec.Generation = 1
+	it.ResourceVersion = "2"
+	if it, err = tagcli.ImagesV1().Tags("prod").Update(
+		ctx, it, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("error updating tag: %s", err)
+	}
+	time.Sleep(time.Second)
+	if calls := svc.get(); calls != 2 {
+		t.Errorf("expected 2 syncs, %d syncs", calls)
+	}
+
+	it.Spec.From = "docker.io/library/nginx:latest"
+	it.ResourceVersion = "3"
+	if _, err := tagcli.ImagesV1().Tags("prod").Update(
+		ctx, it, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("error updating tag: %s", err)
+	}
+	time.Sleep(time.Second)
+	if calls := svc.get(); calls != 3 {
+		t.Errorf("expected 3 syncs, %d syncs", calls)
+	}
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,425 @@
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/version"
+)
+
+// OpenAPIPath is where the API serves its OpenAPI v3 document. The document
+// only describes the API, it is served without authentication.
+const OpenAPIPath = "/openapi/v3"
+
+// apiParameter is a query parameter accepted by an API endpoint.
+type apiParameter struct {
+	name        string
+	description string
+	required    bool
+	schema      map[string]interface{}
+	example     string
+}
+
+// apiRoute is an API endpoint as described in the OpenAPI document. Verb is
+// the verb callers must be allowed to perform on Tags. Response is the value
+// returned, json encoded.
+type apiRoute struct {
+	method     string
+	path       string
+	verb       string
+	summary    string
+	parameters []apiParameter
+	response   interface{}
+}
+
+var (
+	fieldsParameter = apiParameter{
+		name:        "fields",
+		description: "Comma separated list of dotted fields to return instead of whole Tags.",
+		schema:      map[string]interface{}{"type": "string"},
+		example:     "metadata.name,status.generation",
+	}
+	listParameters = []apiParameter{
+		{
+			name:        "labelSelector",
+			description: "Only Tags matching this label selector.",
+			schema:      map[string]interface{}{"type": "string"},
+			example:     "team=payments",
+		},
+		{
+			name:        "limit",
+			description: "Page size, defaults to and is capped at 500.",
+			schema:      map[string]interface{}{"type": "integer", "minimum": 1},
+		},
+		{
+			name:        "continue",
+			description: "The metadata.continue token returned by the previous page.",
+			schema:      map[string]interface{}{"type": "string"},
+		},
+		fieldsParameter,
+	}
+)
+
+// apiRoutes are the endpoints served by the API, in the order they are
+// documented.
+var apiRoutes = []apiRoute{
+	{
+		method:  "GET",
+		path:    "/api/v1/tags",
+		verb:    "list",
+		summary: "List Tags in all namespaces the caller can list Tags in.",
+		parameters: append([]apiParameter{
+			{
+				name:        "namespace",
+				description: "Only Tags in this namespace.",
+				schema:      map[string]interface{}{"type": "string"},
+			},
+		}, listParameters...),
+		response: imagtagv1.TagList{},
+	},
+	{
+		method:     "GET",
+		path:       "/api/v1/namespaces/{namespace}/tags",
+		verb:       "list",
+		summary:    "List Tags in a namespace.",
+		parameters: listParameters,
+		response:   imagtagv1.TagList{},
+	},
+	{
+		method:     "GET",
+		path:       "/api/v1/namespaces/{namespace}/tags/{name}",
+		verb:       "get",
+		summary:    "Read a Tag.",
+		parameters: []apiParameter{fieldsParameter},
+		response:   imagtagv1.Tag{},
+	},
+	{
+		method:   "GET",
+		path:     "/api/v1/namespaces/{namespace}/tags/{name}/generations",
+		verb:     "get",
+		summary:  "Read the generations kept by a Tag, newest first.",
+		response: imagtagv1.GenerationHistory{},
+	},
+	{
+		method:  "GET",
+		path:    "/api/v1/namespaces/{namespace}/tags/{name}/resolve",
+		verb:    "get",
+		summary: "Resolve the image a Tag pointed to at a point in time.",
+		parameters: []apiParameter{
+			{
+				name:        "at",
+				description: "RFC3339 time to resolve the Tag at.",
+				required:    true,
+				schema:      map[string]interface{}{"type": "string", "format": "date-time"},
+				example:     "2021-01-01T00:00:00Z",
+			},
+		},
+		response: imagtagv1.Resolution{},
+	},
+	{
+		method:     "POST",
+		path:       "/api/v1/namespaces/{namespace}/tags/{name}/upgrade",
+		verb:       "update",
+		summary:    "Move a Tag to its next generation.",
+		parameters: []apiParameter{fieldsParameter},
+		response:   imagtagv1.Tag{},
+	},
+	{
+		method:     "POST",
+		path:       "/api/v1/namespaces/{namespace}/tags/{name}/downgrade",
+		verb:       "update",
+		summary:    "Move a Tag to its previous generation.",
+		parameters: []apiParameter{fieldsParameter},
+		response:   imagtagv1.Tag{},
+	},
+	{
+		method:     "POST",
+		path:       "/api/v1/namespaces/{namespace}/tags/{name}/rollback",
+		verb:       "update",
+		summary:    "Move a Tag back to its last known good generation.",
+		parameters: []apiParameter{fieldsParameter},
+		response:   imagtagv1.Tag{},
+	},
+	{
+		method:     "POST",
+		path:       "/api/v1/namespaces/{namespace}/tags/{name}/import",
+		verb:       "update",
+		summary:    "Import a new generation of a Tag.",
+		parameters: []apiParameter{fieldsParameter},
+		response:   imagtagv1.Tag{},
+	},
+	{
+		method:  "GET",
+		path:    "/api/v1/tags/{name}/diff",
+		verb:    "get",
+		summary: "Compare a Tag among namespaces.",
+		parameters: []apiParameter{
+			{
+				name:        "namespaces",
+				description: "Comma separated list of at least two namespaces.",
+				required:    true,
+				schema:      map[string]interface{}{"type": "string"},
+				example:     "staging,production",
+			},
+		},
+		response: imagtagv1.ProvenanceDiff{},
+	},
+	{
+		method:  "GET",
+		path:    "/api/v1/namespaces/{namespace}/simulate",
+		verb:    "create",
+		summary: "Report whether importing an image into a namespace would be accepted.",
+		parameters: []apiParameter{
+			{
+				name:        "image",
+				description: "Reference of the image to simulate the import of.",
+				required:    true,
+				schema:      map[string]interface{}{"type": "string"},
+				example:     "quay.io/company/app:v2",
+			},
+		},
+		response: imagtagv1.ImportSimulation{},
+	},
+}
+
+// openAPIDocument returns the OpenAPI v3 document describing routes. Schemas
+// for the returned objects are generated from their types.
+func openAPIDocument(routes []apiRoute) map[string]interface{} {
+	gen := &schemaGenerator{schemas: map[string]interface{}{}}
+	paths := map[string]interface{}{}
+	for _, route := range routes {
+		item, ok := paths[route.path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = gen.operation(route)
+	}
+
+	gen.schemas["Error"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"message": map[string]interface{}{"type": "string"},
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Tagger Tag API",
+			"description": "Tag inventory, callers are authorized through RBAC on tags.images.io.",
+			"version":     version.Get().Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": gen.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A Kubernetes token, validated through a TokenReview.",
+				},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+		},
+	}
+}
+
+// schemaGenerator generates json schemas out of go types, as they are json
+// encoded. Schemas for structs are kept in schemas and referred to by name.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+// operation returns the OpenAPI operation for route.
+func (s *schemaGenerator) operation(route apiRoute) map[string]interface{} {
+	var params []interface{}
+	for _, part := range strings.Split(route.path, "/") {
+		if !strings.HasPrefix(part, "{") {
+			continue
+		}
+		params = append(params, map[string]interface{}{
+			"name":     strings.Trim(part, "{}"),
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	for _, param := range route.parameters {
+		p := map[string]interface{}{
+			"name":        param.name,
+			"in":          "query",
+			"description": param.description,
+			"required":    param.required,
+			"schema":      param.schema,
+		}
+		if param.example != "" {
+			p["example"] = param.example
+		}
+		params = append(params, p)
+	}
+
+	content := map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": s.schema(reflect.TypeOf(route.response)),
+		},
+	}
+
+	return map[string]interface{}{
+		"summary":     route.summary,
+		"description": "Requires permission to " + route.verb + " Tags.",
+		"parameters":  params,
+		"responses": map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK",
+				"content":     content,
+			},
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"$ref": "#/components/schemas/Error",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// schemaName returns the name of the schema for a named type. Our own types
+// are named after the type, others after their package, as in Kubernetes
+// (e.g. io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta).
+func schemaName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	if pkg == reflect.TypeOf(imagtagv1.Tag{}).PkgPath() {
+		return t.Name()
+	}
+	parts := strings.Split(pkg, "/")
+	domain := strings.Split(parts[0], ".")
+	for i, j := 0, len(domain)-1; i < j; i, j = i+1, j-1 {
+		domain[i], domain[j] = domain[j], domain[i]
+	}
+	parts[0] = strings.Join(domain, ".")
+	return strings.Join(append(parts, t.Name()), ".")
+}
+
+var (
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	intOrString   = map[string]interface{}{
+		"anyOf": []interface{}{
+			map[string]interface{}{"type": "integer"},
+			map[string]interface{}{"type": "string"},
+		},
+	}
+)
+
+// encodedSchemas are the schemas of types encoding themselves to json.
+var encodedSchemas = map[reflect.Type]map[string]interface{}{
+	reflect.TypeOf(metav1.Time{}): {"type": "string", "format": "date-time"},
+	reflect.TypeOf(metav1.MicroTime{}): {
+		"type": "string", "format": "date-time",
+	},
+	reflect.TypeOf(metav1.Duration{}):    {"type": "string", "example": "1h30m"},
+	reflect.TypeOf(metav1.FieldsV1{}):    {"type": "object"},
+	reflect.TypeOf(resource.Quantity{}):  intOrString,
+	reflect.TypeOf(intstr.IntOrString{}): intOrString,
+}
+
+// schema returns the schema for values of type t.
+func (s *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if schema, ok := encodedSchemas[t]; ok {
+		return schema
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": s.schema(t.Elem()),
+		}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := s.schemas[name]; !ok {
+			// registered before generating so recursive types end.
+			s.schemas[name] = map[string]interface{}{}
+			s.schemas[name] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// object returns the schema of struct type t, fields embedded without a
+// json name are inlined as encoding/json does.
+func (s *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	s.properties(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// properties adds the properties of the fields of struct type t to props.
+func (s *schemaGenerator) properties(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" && field.Anonymous {
+			ftype := field.Type
+			for ftype.Kind() == reflect.Ptr {
+				ftype = ftype.Elem()
+			}
+			if ftype.Kind() == reflect.Struct {
+				s.properties(ftype, props)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = s.schema(field.Type)
+	}
+}
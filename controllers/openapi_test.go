@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestAPIOpenAPI(t *testing.T) {
+	since := metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	inv := &inventory{
+		tags: []*imagtagv1.Tag{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "staging", Name: "tag"},
+				Spec:       imagtagv1.TagSpec{From: "centos:latest", Generation: 1},
+				Status: imagtagv1.TagStatus{
+					LastKnownGood: &imagtagv1.KnownGood{Generation: 0},
+					Timeline: []imagtagv1.TimelineEntry{
+						{Generation: 0, ImageReference: "centos@sha256:0", Since: since},
+					},
+				},
+			},
+		},
+	}
+	auth := &authorizer{
+		tokens: map[string]string{"admin-token": "admin"},
+		rules: map[string][]string{
+			"admin/list":   {"*"},
+			"admin/get":    {"*"},
+			"admin/update": {"*"},
+			"admin/create": {"*"},
+		},
+	}
+	api := NewAPI(inv, auth)
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, OpenAPIPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, %d received", w.Code)
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			Parameters []struct {
+				Name     string `json:"name"`
+				In       string `json:"in"`
+				Required bool   `json:"required"`
+				Example  string `json:"example"`
+			} `json:"parameters"`
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema struct {
+						Ref string `json:"$ref"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatalf("unexpected error decoding document: %s", err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("unexpected openapi version %q", doc.OpenAPI)
+	}
+
+	routes := 0
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			routes++
+			target := strings.ReplaceAll(path, "{namespace}", "staging")
+			target = strings.ReplaceAll(target, "{name}", "tag")
+			query := url.Values{}
+			for _, param := range op.Parameters {
+				if param.In == "query" && param.Required {
+					query.Set(param.Name, param.Example)
+				}
+			}
+			if query.Get("namespaces") != "" {
+				query.Set("namespaces", "staging,production")
+			}
+
+			t.Run(strings.ToUpper(method)+" "+target, func(t *testing.T) {
+				req := httptest.NewRequest(
+					strings.ToUpper(method), target+"?"+query.Encode(), nil,
+				)
+				req.Header.Set("Authorization", "Bearer admin-token")
+				w := httptest.NewRecorder()
+				api.ServeHTTP(w, req)
+
+				code := "default"
+				if w.Code == http.StatusOK {
+					code = "200"
+				} else if w.Code == http.StatusNotFound || w.Code == http.StatusMethodNotAllowed {
+					t.Fatalf("route not served: %d %s", w.Code, w.Body.String())
+				}
+
+				ctype := w.Header().Get("Content-Type")
+				content, ok := op.Responses[code].Content[ctype]
+				if !ok {
+					t.Fatalf("undocumented %s response with content type %s", code, ctype)
+				}
+				if content.Schema.Ref == "" {
+					return
+				}
+
+				name := strings.TrimPrefix(content.Schema.Ref, "#/components/schemas/")
+				schema, ok := doc.Components.Schemas[name]
+				if !ok {
+					t.Fatalf("schema %s not found", name)
+				}
+				var obj map[string]interface{}
+				if err := json.NewDecoder(w.Body).Decode(&obj); err != nil {
+					t.Fatalf("unexpected error decoding response: %s", err)
+				}
+				for field := range obj {
+					if _, ok := schema.Properties[field]; !ok {
+						t.Errorf("field %s not documented in %s", field, name)
+					}
+				}
+			})
+		}
+	}
+	if routes != len(apiRoutes) {
+		t.Errorf("expected %d routes, %d documented", len(apiRoutes), routes)
+	}
+
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, OpenAPIPath, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, %d received", w.Code)
+	}
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinf "k8s.io/client-go/informers"
+	corelis "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	imageinf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// PodReadinessUpdater abstraction exists to make testing easier. You most
+// likely wanna see PodReadiness struct under services/readiness.go for a
+// concrete implementation of this.
+type PodReadinessUpdater interface {
+	Pending(*corev1.Pod) bool
+	Update(context.Context, *corev1.Pod) error
+}
+
+// Pod controller manages the Tag readiness gate of pods. Pods are evaluated
+// when they change and when a Tag in their namespace changes, as a pod that
+// does not run the Tag current generation may do so after a rollback.
+type Pod struct {
+	podlister corelis.PodLister
+	podsvc    PodReadinessUpdater
+	shard     NamespaceOwner
+	queue     *trackedQueue
+	appctx    context.Context
+}
+
+// NewPod returns a new controller for pods readiness gates. If shard is not
+// nil only pods in namespaces owned by the shard are processed.
+func NewPod(
+	corinf coreinf.SharedInformerFactory,
+	taginf imageinf.SharedInformerFactory,
+	podsvc PodReadinessUpdater,
+	shard NamespaceOwner,
+) *Pod {
+	ctrl := &Pod{
+		podlister: corinf.Core().V1().Pods().Lister(),
+		queue:     newTrackedQueue(workqueue.New(), nil),
+		podsvc:    podsvc,
+		shard:     shard,
+	}
+	corinf.Core().V1().Pods().Informer().AddEventHandler(ctrl.handlers())
+	taginf.Images().V1().Tags().Informer().AddEventHandler(ctrl.tagHandlers())
+	return ctrl
+}
+
+// Name returns a name identifier for this controller.
+func (p *Pod) Name() string {
+	return "pod"
+}
+
+// QueueState returns a snapshot of the controller work queue.
+func (p *Pod) QueueState() QueueState {
+	return p.queue.state(p.Name())
+}
+
+// enqueueEvent enqueues a pod, as "namespace/name", if its readiness gate is
+// pending. Events for namespaces not owned by our shard are ignored.
+func (p *Pod) enqueueEvent(o interface{}) {
+	pod, ok := o.(*corev1.Pod)
+	if !ok || !p.podsvc.Pending(pod) {
+		return
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(o)
+	if err != nil {
+		klog.Errorf("fail to enqueue event: %v : %s", o, err)
+		return
+	}
+	if !ownsKey(p.shard, key) {
+		metrics.ShardSkippedEvents.WithLabelValues(p.Name()).Inc()
+		return
+	}
+	p.queue.Add(key)
+}
+
+// enqueueTagNamespace enqueues all pods, in the namespace of the Tag, whose
+// readiness gate is pending.
+func (p *Pod) enqueueTagNamespace(o interface{}) {
+	it, ok := o.(*imagtagv1.Tag)
+	if !ok {
+		return
+	}
+
+	pods, err := p.podlister.Pods(it.Namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("unable to list pods for tag %s/%s: %s", it.Namespace, it.Name, err)
+		return
+	}
+	for _, pod := range pods {
+		p.enqueueEvent(pod)
+	}
+}
+
+// handlers return the event handlers for pods. Deleted pods are of no
+// interest.
+func (p *Pod) handlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			p.enqueueEvent(o)
+		},
+		UpdateFunc: func(o, n interface{}) {
+			p.enqueueEvent(n)
+		},
+		DeleteFunc: func(o interface{}) {},
+	}
+}
+
+// tagHandlers return the event handlers for Tags. Resyncs are ignored as
+// they don't move Tags to another generation.
+func (p *Pod) tagHandlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			p.enqueueTagNamespace(o)
+		},
+		UpdateFunc: func(o, n interface{}) {
+			oldtag, ok := o.(*imagtagv1.Tag)
+			if !ok {
+				return
+			}
+			newtag, ok := n.(*imagtagv1.Tag)
+			if !ok || oldtag.ResourceVersion == newtag.ResourceVersion {
+				return
+			}
+			p.enqueueTagNamespace(n)
+		},
+		DeleteFunc: func(o interface{}) {},
+	}
+}
+
+// eventProcessor reads our events calling syncPod for all of them.
+func (p *Pod) eventProcessor(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		evt, end := p.queue.Get()
+		if end {
+			return
+		}
+
+		namespace, name, err := cache.SplitMetaNamespaceKey(evt.(string))
+		if err != nil {
+			klog.Errorf("invalid event received %s: %s", evt, err)
+			p.queue.Done(evt)
+			continue
+		}
+
+		klog.V(5).Infof("received event for pod: %s", evt)
+		if err := p.syncPod(namespace, name); err != nil {
+			klog.Errorf("error processing pod %s: %v", evt, err)
+			p.queue.Done(evt)
+			p.queue.AddAfter(evt, 5*time.Second)
+			continue
+		}
+		p.queue.Forget(evt)
+		p.queue.Done(evt)
+	}
+}
+
+// syncPod process an event for a pod. We allow ten seconds per pod update.
+func (p *Pod) syncPod(namespace, name string) error {
+	ctx, cancel := context.WithTimeout(p.appctx, 10*time.Second)
+	defer cancel()
+
+	pod, err := p.podlister.Pods(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return p.podsvc.Update(ctx, pod.DeepCopy())
+}
+
+// Start starts the controller's event loop.
+func (p *Pod) Start(ctx context.Context) error {
+	// appctx is the 'keep going' context, if it is cancelled
+	// everything we might be doing should stop.
+	p.appctx = ctx
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go p.eventProcessor(&wg)
+
+	// wait until it is time to die.
+	<-p.appctx.Done()
+
+	p.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinf "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+type podsvc struct {
+	sync.Mutex
+	calls map[string]int
+}
+
+func (p *podsvc) Pending(pod *corev1.Pod) bool {
+	return pod.Labels["gated"] == "true"
+}
+
+func (p *podsvc) Update(ctx context.Context, pod *corev1.Pod) error {
+	p.Lock()
+	defer p.Unlock()
+	p.calls[pod.Name]++
+	return nil
+}
+
+func (p *podsvc) get(name string) int {
+	p.Lock()
+	defer p.Unlock()
+	return p.calls[name]
+}
+
+func TestPodReadinessGate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	corcli := fake.NewSimpleClientset()
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &podsvc{calls: map[string]int{}}
+
+	ctrl := NewPod(corinf, taginf, svc, nil)
+	corinf.Start(ctx.Done())
+	taginf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		corinf.Core().V1().Pods().Informer().HasSynced,
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error starting controller: %s", err)
+		}
+	}()
+
+	for _, pod := range []*corev1.Pod{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "namespace",
+				Name:      "gated",
+				Labels:    map[string]string{"gated": "true"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "namespace",
+				Name:      "ungated",
+			},
+		},
+	} {
+		if _, err := corcli.CoreV1().Pods("namespace").Create(
+			ctx, pod, metav1.CreateOptions{},
+		); err != nil {
+			t.Errorf("error creating pod: %s", err)
+		}
+	}
+
+	// give some room for the event to be dispatched towards the controller.
+	time.Sleep(time.Second)
+
+	if calls := svc.get("gated"); calls != 1 {
+		t.Errorf("expected 1 call, %d calls made", calls)
+	}
+
+	// a tag in the namespace moving re-evaluates the pending pods.
+	if _, err := tagcli.ImagesV1().Tags("namespace").Create(
+		ctx,
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "namespace",
+				Name:      "atag",
+			},
+		},
+		metav1.CreateOptions{},
+	); err != nil {
+		t.Errorf("error creating tag: %s", err)
+	}
+	time.Sleep(time.Second)
+
+	if calls := svc.get("gated"); calls != 2 {
+		t.Errorf("expected 2 calls, %d calls made", calls)
+	}
+	if calls := svc.get("ungated"); calls != 0 {
+		t.Errorf("pod without readiness gate processed %d times", calls)
+	}
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// priorityQueue is a rate limited work queue, with the same semantics as
+// the client-go one, handing out prioritized items before any other. An
+// item is prioritized if priority returns true for it when it is added,
+// an item queued without priority is moved ahead once added with it. Items
+// are handed out in the order they were added within each priority.
+type priorityQueue struct {
+	cond     *sync.Cond
+	high     []interface{}
+	low      []interface{}
+	dirty    map[interface{}]bool
+	process  map[interface{}]bool
+	shutdown bool
+	priority func(item interface{}) bool
+	limiter  workqueue.RateLimiter
+}
+
+// newPriorityQueue returns an empty priority queue. Priority is called, on
+// every Add, outside of the queue lock.
+func newPriorityQueue(
+	limiter workqueue.RateLimiter, priority func(item interface{}) bool,
+) *priorityQueue {
+	return &priorityQueue{
+		cond:     sync.NewCond(&sync.Mutex{}),
+		dirty:    map[interface{}]bool{},
+		process:  map[interface{}]bool{},
+		priority: priority,
+		limiter:  limiter,
+	}
+}
+
+// Add queues an item, unless it is already queued. Items being processed
+// are queued again once done.
+func (q *priorityQueue) Add(item interface{}) {
+	high := q.priority(item)
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.shutdown {
+		return
+	}
+
+	if prev, ok := q.dirty[item]; ok {
+		if !high || prev {
+			return
+		}
+		q.dirty[item] = true
+		if q.process[item] {
+			return
+		}
+		for i, queued := range q.low {
+			if queued == item {
+				q.low = append(q.low[:i], q.low[i+1:]...)
+				break
+			}
+		}
+		q.high = append(q.high, item)
+		return
+	}
+
+	q.dirty[item] = high
+	if q.process[item] {
+		return
+	}
+	q.push(item, high)
+	q.cond.Signal()
+}
+
+// push appends the item to the queue matching its priority.
+func (q *priorityQueue) push(item interface{}, high bool) {
+	if high {
+		q.high = append(q.high, item)
+		return
+	}
+	q.low = append(q.low, item)
+}
+
+// Len returns how many items are queued.
+func (q *priorityQueue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.high) + len(q.low)
+}
+
+// Get blocks until an item is queued, prioritized ones first, and returns
+// it. Shutdown is true once the queue has been shut down and drained.
+func (q *priorityQueue) Get() (interface{}, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for len(q.high)+len(q.low) == 0 && !q.shutdown {
+		q.cond.Wait()
+	}
+	if len(q.high)+len(q.low) == 0 {
+		return nil, true
+	}
+
+	var item interface{}
+	if len(q.high) > 0 {
+		item, q.high = q.high[0], q.high[1:]
+	} else {
+		item, q.low = q.low[0], q.low[1:]
+	}
+	q.process[item] = true
+	delete(q.dirty, item)
+	return item, false
+}
+
+// Done marks an item as processed, queueing it again if it has been added
+// while being processed.
+func (q *priorityQueue) Done(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	delete(q.process, item)
+	if high, ok := q.dirty[item]; ok {
+		q.push(item, high)
+		q.cond.Signal()
+	}
+}
+
+// ShutDown makes Get to return once the queue is drained, items added from
+// now on are ignored.
+func (q *priorityQueue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shutdown = true
+	q.cond.Broadcast()
+}
+
+// ShuttingDown returns true if the queue has been shut down.
+func (q *priorityQueue) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.shutdown
+}
+
+// AddAfter adds an item once the duration has passed.
+func (q *priorityQueue) AddAfter(item interface{}, duration time.Duration) {
+	if q.ShuttingDown() {
+		return
+	}
+	if duration <= 0 {
+		q.Add(item)
+		return
+	}
+	time.AfterFunc(duration, func() {
+		q.Add(item)
+	})
+}
+
+// AddRateLimited adds an item once the rate limiter allows it.
+func (q *priorityQueue) AddRateLimited(item interface{}) {
+	q.AddAfter(item, q.limiter.When(item))
+}
+
+// Forget makes the rate limiter to stop tracking an item.
+func (q *priorityQueue) Forget(item interface{}) {
+	q.limiter.Forget(item)
+}
+
+// NumRequeues returns how many times an item has been requeued.
+func (q *priorityQueue) NumRequeues(item interface{}) int {
+	return q.limiter.NumRequeues(item)
+}
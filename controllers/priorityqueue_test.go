@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	var mtx sync.Mutex
+	consumed := map[string]bool{"prod/app": true}
+	priority := func(item interface{}) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return consumed[item.(string)]
+	}
+
+	for _, tt := range []struct {
+		name     string
+		adds     []string
+		promote  []string
+		expected []string
+	}{
+		{
+			name:     "consumed first",
+			adds:     []string{"dev/a", "dev/b", "prod/app", "dev/c"},
+			expected: []string{"prod/app", "dev/a", "dev/b", "dev/c"},
+		},
+		{
+			name:     "deduplicated",
+			adds:     []string{"dev/a", "prod/app", "dev/a", "prod/app"},
+			expected: []string{"prod/app", "dev/a"},
+		},
+		{
+			name:     "promoted once consumed",
+			adds:     []string{"dev/a", "dev/b", "dev/c"},
+			promote:  []string{"dev/c"},
+			expected: []string{"dev/c", "dev/a", "dev/b"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ratelimit := workqueue.NewItemExponentialFailureRateLimiter(
+				time.Millisecond, time.Second,
+			)
+			queue := newPriorityQueue(ratelimit, priority)
+			for _, key := range tt.adds {
+				queue.Add(key)
+			}
+			for _, key := range tt.promote {
+				mtx.Lock()
+				consumed[key] = true
+				mtx.Unlock()
+				queue.Add(key)
+			}
+			defer func() {
+				mtx.Lock()
+				defer mtx.Unlock()
+				for _, key := range tt.promote {
+					delete(consumed, key)
+				}
+			}()
+
+			if queue.Len() != len(tt.expected) {
+				t.Fatalf("expected %d queued, %d found", len(tt.expected), queue.Len())
+			}
+			var received []string
+			for queue.Len() > 0 {
+				item, _ := queue.Get()
+				received = append(received, item.(string))
+				queue.Done(item)
+			}
+			if !reflect.DeepEqual(received, tt.expected) {
+				t.Errorf("expected %v, %v received", tt.expected, received)
+			}
+		})
+	}
+}
+
+func TestPriorityQueueProcessing(t *testing.T) {
+	ratelimit := workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Second)
+	queue := newPriorityQueue(ratelimit, func(item interface{}) bool {
+		return item.(string) == "prod/app"
+	})
+
+	// items added while being processed are handed out once done.
+	queue.Add("prod/app")
+	item, _ := queue.Get()
+	queue.Add("dev/a")
+	queue.Add("prod/app")
+	if queue.Len() != 1 {
+		t.Fatalf("expected only dev/a queued, %d found", queue.Len())
+	}
+	queue.Done(item)
+	if item, _ = queue.Get(); item != "prod/app" {
+		t.Errorf("expected prod/app, %v received", item)
+	}
+	queue.Done(item)
+
+	// rate limited items are added after the delay.
+	queue.AddRateLimited("dev/b")
+	if queue.NumRequeues("dev/b") != 1 {
+		t.Errorf("expected one requeue, %d found", queue.NumRequeues("dev/b"))
+	}
+	queue.Forget("dev/b")
+	if queue.NumRequeues("dev/b") != 0 {
+		t.Errorf("expected no requeues, %d found", queue.NumRequeues("dev/b"))
+	}
+	if item, _ = queue.Get(); item != "dev/a" {
+		t.Errorf("expected dev/a, %v received", item)
+	}
+	queue.Done(item)
+	if item, _ = queue.Get(); item != "dev/b" {
+		t.Errorf("expected dev/b, %v received", item)
+	}
+	queue.Done(item)
+
+	// shut down queues drain and then end.
+	done := make(chan bool)
+	go func() {
+		_, end := queue.Get()
+		done <- end
+	}()
+	queue.ShutDown()
+	select {
+	case end := <-done:
+		if !end {
+			t.Error("expected the queue to end")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("get blocked after shutdown")
+	}
+	queue.Add("dev/c")
+	if queue.Len() != 0 {
+		t.Error("expected items added after shutdown to be ignored")
+	}
+}
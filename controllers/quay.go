@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
+	"strings"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/metrics"
 )
 
 // TagGenerationUpdater exists to make tests easier. You may be wondering where
@@ -28,18 +32,37 @@ type QuayRequestPayload struct {
 	UpdatedTags []string `json:"updated_tags"`
 }
 
+// NewQuayRequestPayload returns the payload quay sends when tags are pushed to
+// a repository, e.g. quay.io/org/app. Repositories are namespace/name, the
+// registry may be other than quay.io for self hosted quay.
+func NewQuayRequestPayload(registry, repository string, tags ...string) QuayRequestPayload {
+	namespace, name := repository, repository
+	if idx := strings.Index(repository, "/"); idx >= 0 {
+		namespace, name = repository[:idx], repository[idx+1:]
+	}
+	return QuayRequestPayload{
+		Name:        name,
+		Repository:  repository,
+		Namespace:   namespace,
+		DockerURL:   fmt.Sprintf("%s/%s", registry, repository),
+		HomePage:    fmt.Sprintf("https://%s/repository/%s", registry, repository),
+		UpdatedTags: tags,
+	}
+}
+
 // QuayWebHook handles quay.io requests.
 type QuayWebHook struct {
-	bind   string
+	server *httpServer
 	tagsvc TagGenerationUpdater
 }
 
 // NewQuayWebHook returns a web hook handler for quay webhooks.
 func NewQuayWebHook(tagsvc TagGenerationUpdater) *QuayWebHook {
-	return &QuayWebHook{
-		bind:   ":8081",
+	hook := &QuayWebHook{
 		tagsvc: tagsvc,
 	}
+	hook.server = newHTTPServer(hook.Name(), config.Default().Binds.Quay, hook)
+	return hook
 }
 
 // Name returns a name identifier for this controller.
@@ -47,7 +70,9 @@ func (q *QuayWebHook) Name() string {
 	return "quay webhook"
 }
 
-// ServeHTTP handles requests coming in from quay.io.
+// ServeHTTP handles requests coming in from quay.io. If no Tag tracks any of
+// the updated tags the status is 404, providers disable webhooks after
+// repeated 5xx responses.
 func (q *QuayWebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var payload QuayRequestPayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -57,9 +82,17 @@ func (q *QuayWebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	klog.Infof("received update for image: %s", payload.DockerURL)
+	untracked := 0
 	for _, tag := range payload.UpdatedTags {
 		imgpath := fmt.Sprintf("%s:%s", payload.DockerURL, tag)
-		if err := q.tagsvc.NewGenerationForImageRef(r.Context(), imgpath); err != nil {
+		err := q.tagsvc.NewGenerationForImageRef(r.Context(), imgpath)
+		if errors.IsNotFound(err) {
+			klog.V(2).Infof("no tag tracks image %s", imgpath)
+			metrics.WebhookUntrackedImages.WithLabelValues(q.Name()).Inc()
+			untracked++
+			continue
+		}
+		if err != nil {
 			klog.Errorf("error updating tag %s by reference: %s", imgpath, err)
 			http.Error(
 				w,
@@ -70,31 +103,22 @@ func (q *QuayWebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if untracked > 0 && untracked == len(payload.UpdatedTags) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
+// ApplyConfig moves the http server to the configured bind address and sets
+// for how long in-flight requests are drained on shutdown.
+func (q *QuayWebHook) ApplyConfig(cfg *config.Config) {
+	q.server.applyConfig(cfg.Binds.Quay, cfg.Binds.Network(), cfg.DrainTimeout)
+}
+
 // Start puts the http server online.
 func (q *QuayWebHook) Start(ctx context.Context) error {
-	server := &http.Server{
-		Addr:    q.bind,
-		Handler: q,
-	}
-
-	go func() {
-		<-ctx.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			klog.Errorf("error shutting down https server: %s", err)
-		}
-	}()
-
-	if err := server.ListenAndServe(); err != nil {
-		if err == http.ErrServerClosed {
-			return nil
-		}
-		return err
-	}
-	return nil
+	return q.server.run(ctx)
 }
@@ -6,10 +6,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
 )
 
 type tagupdater struct {
@@ -21,6 +27,9 @@ func (t *tagupdater) NewGenerationForImageRef(ctx context.Context, imgpath strin
 	if t.errorout {
 		return fmt.Errorf("error")
 	}
+	if strings.Contains(imgpath, "untracked") {
+		return errors.NewNotFound(imagtagv1.Resource("tags"), imgpath)
+	}
 	t.imgpaths = append(t.imgpaths, imgpath)
 	return nil
 }
@@ -82,6 +91,24 @@ func TestQuayWebHooks(t *testing.T) {
 			expected:   nil,
 			statuscode: http.StatusOK,
 		},
+		{
+			name: "untracked image",
+			reqbody: map[string]interface{}{
+				"docker_url":   "quay.io/myrepo/myimage",
+				"updated_tags": []string{"untracked"},
+			},
+			expected:   nil,
+			statuscode: http.StatusNotFound,
+		},
+		{
+			name: "partially tracked image",
+			reqbody: map[string]interface{}{
+				"docker_url":   "quay.io/myrepo/myimage",
+				"updated_tags": []string{"latest", "untracked"},
+			},
+			expected:   []string{"quay.io/myrepo/myimage:latest"},
+			statuscode: http.StatusOK,
+		},
 		{
 			name: "error on service",
 			reqbody: map[string]interface{}{
@@ -128,3 +155,35 @@ func TestQuayWebHooks(t *testing.T) {
 	cancel()
 	wg.Wait()
 }
+
+func TestNewQuayRequestPayload(t *testing.T) {
+	payload := NewQuayRequestPayload("quay.io", "org/app", "v1", "latest")
+	expected := QuayRequestPayload{
+		Name:        "app",
+		Repository:  "org/app",
+		Namespace:   "org",
+		DockerURL:   "quay.io/org/app",
+		HomePage:    "https://quay.io/repository/org/app",
+		UpdatedTags: []string{"v1", "latest"},
+	}
+	if !reflect.DeepEqual(payload, expected) {
+		t.Fatalf("expected %+v, %+v received", expected, payload)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	svc := &tagupdater{}
+	w := httptest.NewRecorder()
+	NewQuayWebHook(svc).ServeHTTP(
+		w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)),
+	)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, %d received", w.Code)
+	}
+	imgpaths := []string{"quay.io/org/app:v1", "quay.io/org/app:latest"}
+	if !reflect.DeepEqual(svc.imgpaths, imgpaths) {
+		t.Errorf("expected %v, %v received", imgpaths, svc.imgpaths)
+	}
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corecli "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// PodWebhookName is the name of the pod mutating webhook inside its mutating
+// webhook configuration.
+const PodWebhookName = "core.images.io"
+
+// WebhookSelectors keeps the namespace and object selectors of the pod
+// mutating webhook in line with the configuration, so the namespaces subject
+// to pod mutation can be changed without redeploying. Selectors are enforced
+// whenever the configuration changes and periodically, reverting changes made
+// by re-applying the webhook manifest.
+type WebhookSelectors struct {
+	mtx    sync.Mutex
+	cfg    *config.PodWebhook
+	corcli corecli.Interface
+	resync time.Duration
+	sync   chan struct{}
+}
+
+// NewWebhookSelectors returns a controller managing the pod mutating webhook
+// selectors. Nothing is done unless the podWebhook configuration is set.
+func NewWebhookSelectors(corcli corecli.Interface) *WebhookSelectors {
+	return &WebhookSelectors{
+		corcli: corcli,
+		resync: 5 * time.Minute,
+		sync:   make(chan struct{}, 1),
+	}
+}
+
+// Name returns a name identifier for this controller.
+func (w *WebhookSelectors) Name() string {
+	return "webhook selectors"
+}
+
+// ApplyConfig stores the pod webhook configuration and schedules a sync.
+func (w *WebhookSelectors) ApplyConfig(cfg *config.Config) {
+	w.mtx.Lock()
+	w.cfg = cfg.PodWebhook
+	w.mtx.Unlock()
+
+	select {
+	case w.sync <- struct{}{}:
+	default:
+	}
+}
+
+// config returns the current pod webhook configuration.
+func (w *WebhookSelectors) config() *config.PodWebhook {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.cfg
+}
+
+// syncSelectors sets the configured selectors on the pod webhook. Returns
+// false if the webhook already used them.
+func (w *WebhookSelectors) syncSelectors(ctx context.Context) (bool, error) {
+	cfg := w.config()
+	if cfg == nil {
+		return false, nil
+	}
+
+	cli := w.corcli.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	whcfg, err := cli.Get(ctx, cfg.Configuration, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, fmt.Errorf("webhook configuration %s not found", cfg.Configuration)
+		}
+		return false, err
+	}
+
+	nsel := cfg.NamespaceSelector.LabelSelector()
+	osel := cfg.ObjectSelector.LabelSelector()
+
+	found, changed := false, false
+	for i := range whcfg.Webhooks {
+		hook := &whcfg.Webhooks[i]
+		if hook.Name != PodWebhookName {
+			continue
+		}
+		found = true
+		if !selectorsEqual(hook.NamespaceSelector, nsel) {
+			hook.NamespaceSelector = nsel
+			changed = true
+		}
+		if !selectorsEqual(hook.ObjectSelector, osel) {
+			hook.ObjectSelector = osel
+			changed = true
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("webhook %s not found in %s", PodWebhookName, cfg.Configuration)
+	}
+	if !changed {
+		return false, nil
+	}
+
+	if _, err := cli.Update(ctx, whcfg, metav1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// selectorsEqual compares two label selectors. A nil selector is the same
+// as an empty one, both match everything.
+func selectorsEqual(a, b *metav1.LabelSelector) bool {
+	if a == nil {
+		a = &metav1.LabelSelector{}
+	}
+	if b == nil {
+		b = &metav1.LabelSelector{}
+	}
+	if len(a.MatchLabels) == 0 && len(b.MatchLabels) == 0 &&
+		len(a.MatchExpressions) == 0 && len(b.MatchExpressions) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Start syncs the selectors on every configuration change and every resync
+// period, until the context is cancelled.
+func (w *WebhookSelectors) Start(ctx context.Context) error {
+	ticker := time.NewTicker(w.resync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-w.sync:
+		}
+
+		sctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		changed, err := w.syncSelectors(sctx)
+		cancel()
+		if err != nil {
+			klog.Errorf("error syncing pod webhook selectors: %s", err)
+			continue
+		}
+		if changed {
+			klog.Info("pod webhook selectors updated")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	admregv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+func TestWebhookSelectorsSync(t *testing.T) {
+	webhooks := func() *admregv1.MutatingWebhookConfiguration {
+		return &admregv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "tagger",
+			},
+			Webhooks: []admregv1.MutatingWebhook{
+				{
+					Name:              PodWebhookName,
+					NamespaceSelector: &metav1.LabelSelector{},
+				},
+				{
+					Name: "tag.images.io",
+				},
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		cfg     *config.PodWebhook
+		changed bool
+		nsel    *metav1.LabelSelector
+		err     string
+	}{
+		{
+			name: "unmanaged",
+			nsel: &metav1.LabelSelector{},
+		},
+		{
+			name: "no selectors",
+			cfg: &config.PodWebhook{
+				Configuration: "tagger",
+			},
+			nsel: &metav1.LabelSelector{},
+		},
+		{
+			name: "namespace selector",
+			cfg: &config.PodWebhook{
+				Configuration: "tagger",
+				NamespaceSelector: &config.Selector{
+					MatchLabels: map[string]string{"tagger": "enabled"},
+				},
+			},
+			changed: true,
+			nsel: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"tagger": "enabled"},
+			},
+		},
+		{
+			name: "configuration not found",
+			cfg: &config.PodWebhook{
+				Configuration: "other",
+			},
+			err: "webhook configuration other not found",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			corcli := fake.NewSimpleClientset(webhooks())
+
+			cfg := config.Default()
+			cfg.PodWebhook = tt.cfg
+			ctrl := NewWebhookSelectors(corcli)
+			ctrl.ApplyConfig(cfg)
+
+			changed, err := ctrl.syncSelectors(ctx)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+			if changed != tt.changed {
+				t.Errorf("expected changed %v, %v received", tt.changed, changed)
+			}
+
+			whcfg, err := corcli.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(
+				ctx, "tagger", metav1.GetOptions{},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(whcfg.Webhooks[0].NamespaceSelector, tt.nsel) {
+				t.Errorf("unexpected namespace selector: %+v", whcfg.Webhooks[0].NamespaceSelector)
+			}
+			if whcfg.Webhooks[1].NamespaceSelector != nil {
+				t.Errorf("tag webhook changed: %+v", whcfg.Webhooks[1])
+			}
+
+			// a second sync has nothing to change.
+			if changed, err := ctrl.syncSelectors(ctx); err != nil || changed {
+				t.Errorf("unexpected second sync: %v, %v", changed, err)
+			}
+		})
+	}
+}
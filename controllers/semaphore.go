@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"sync"
+)
+
+// semaphore limits the number of concurrent operations. Its limit can be
+// changed at runtime, shrinking it does not interrupt operations already
+// holding a slot but prevents new ones from starting until enough slots are
+// released.
+type semaphore struct {
+	mtx   sync.Mutex
+	cond  *sync.Cond
+	limit int
+	inuse int
+}
+
+// newSemaphore returns a semaphore allowing up to limit concurrent holders.
+func newSemaphore(limit int) *semaphore {
+	sem := &semaphore{limit: limit}
+	sem.cond = sync.NewCond(&sem.mtx)
+	return sem
+}
+
+// acquire blocks until a slot is available.
+func (s *semaphore) acquire() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for s.inuse >= s.limit {
+		s.cond.Wait()
+	}
+	s.inuse++
+}
+
+// release gives back a previously acquired slot.
+func (s *semaphore) release() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.inuse--
+	s.cond.Broadcast()
+}
+
+// resize changes the number of concurrent holders allowed.
+func (s *semaphore) resize(limit int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.limit = limit
+	s.cond.Broadcast()
+}
+
+// usage returns the number of slots in use and the current limit.
+func (s *semaphore) usage() (int, int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.inuse, s.limit
+}
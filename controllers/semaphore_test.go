@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSemaphoreResize(t *testing.T) {
+	sem := newSemaphore(1)
+	sem.acquire()
+
+	var wg sync.WaitGroup
+	acquired := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem.acquire()
+			acquired <- true
+		}()
+	}
+
+	select {
+	case <-acquired:
+		t.Fatal("semaphore acquired beyond its limit")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	sem.resize(3)
+	wg.Wait()
+	if len(acquired) != 2 {
+		t.Errorf("expected 2 acquisitions after resize, %d found", len(acquired))
+	}
+
+	sem.resize(1)
+	for i := 0; i < 3; i++ {
+		sem.release()
+	}
+	sem.acquire()
+}
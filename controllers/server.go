@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// httpServer runs an http server whose bind address, and the network it is
+// listened on, can be changed at runtime. When either changes the current
+// listener is shut down and a new one is started, all without restarting the
+// process. If cert and key are set the server is started with TLS. On
+// shutdown the server stops accepting new connections and waits up to drain
+// for in-flight requests.
+type httpServer struct {
+	mtx      sync.Mutex
+	name     string
+	network  string
+	bind     string
+	cert     string
+	key      string
+	drain    time.Duration
+	inflight int64
+	handler  http.Handler
+	rebind   chan struct{}
+}
+
+// newHTTPServer returns a new http server listening on bind, on both IPv4
+// and IPv6 if available. Requests are counted under name.
+func newHTTPServer(name, bind string, handler http.Handler) *httpServer {
+	return &httpServer{
+		name:    name,
+		network: "tcp",
+		bind:    bind,
+		drain:   config.Default().DrainTimeout,
+		handler: handler,
+		rebind:  make(chan struct{}, 1),
+	}
+}
+
+// applyConfig sets the bind address, the network it is listened on (see
+// config.Binds.Network) and the drain timeout. If the server is running and
+// the address or the network changed it is moved to the new address.
+func (h *httpServer) applyConfig(bind, network string, drain time.Duration) {
+	h.setDrainTimeout(drain)
+	h.setBind(bind, network)
+}
+
+// setDrainTimeout sets for how long in-flight requests are waited for during
+// shutdown.
+func (h *httpServer) setDrainTimeout(drain time.Duration) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.drain = drain
+}
+
+// drainTimeout returns for how long in-flight requests are waited for.
+func (h *httpServer) drainTimeout() time.Duration {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.drain
+}
+
+// statusRecorder records the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+// WriteHeader records the status code before writing it.
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Write records an implicit 200 status code if none has been written.
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+// ServeHTTP keeps track of the number of requests being served before handing
+// them over to the actual handler. Answered requests are counted by status
+// code.
+func (h *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&h.inflight, 1)
+	defer atomic.AddInt64(&h.inflight, -1)
+
+	rec := &statusRecorder{ResponseWriter: w}
+	h.handler.ServeHTTP(rec, r)
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	metrics.HTTPRequests.WithLabelValues(h.name, strconv.Itoa(rec.code)).Inc()
+}
+
+// inFlight returns the number of requests currently being served.
+func (h *httpServer) inFlight() int64 {
+	return atomic.LoadInt64(&h.inflight)
+}
+
+// setBind changes the address, and the network, the server listens on. If
+// the server is running it is moved to the new address.
+func (h *httpServer) setBind(bind, network string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.bind == bind && h.network == network {
+		return
+	}
+	h.bind = bind
+	h.network = network
+
+	select {
+	case h.rebind <- struct{}{}:
+	default:
+	}
+}
+
+// address returns the address, and the network, the server listens on.
+func (h *httpServer) address() (string, string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.bind, h.network
+}
+
+// listen starts to serve requests on network, blocks until the server is
+// closed.
+func (h *httpServer) listen(server *http.Server, network string) error {
+	lis, err := net.Listen(network, server.Addr)
+	if err != nil {
+		return err
+	}
+	if h.cert != "" && h.key != "" {
+		err = server.ServeTLS(lis, h.cert, h.key)
+	} else {
+		err = server.Serve(lis)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// shutdown gracefully shuts down the provided server. New connections are
+// refused and we wait for in-flight requests to finish for up to the drain
+// timeout.
+func (h *httpServer) shutdown(server *http.Server) {
+	if n := h.inFlight(); n > 0 {
+		klog.Infof("draining %d in-flight requests on %s", n, server.Addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.drainTimeout())
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		klog.Errorf(
+			"error shutting down http server on %s, %d requests dropped: %s",
+			server.Addr, h.inFlight(), err,
+		)
+	}
+}
+
+// run puts the http server online. Blocks until the context is cancelled or
+// the server fails.
+func (h *httpServer) run(ctx context.Context) error {
+	for {
+		bind, network := h.address()
+		server := &http.Server{
+			Addr:    bind,
+			Handler: h,
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- h.listen(server, network)
+		}()
+
+		select {
+		case <-ctx.Done():
+			h.shutdown(server)
+			return <-errs
+		case <-h.rebind:
+			bind, network = h.address()
+			klog.Infof("moving server from %s to %s (%s)", server.Addr, bind, network)
+			h.shutdown(server)
+			if err := <-errs; err != nil {
+				return err
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// freeAddress returns a local address nobody is listening on.
+func freeAddress(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to find free port: %s", err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+func TestHTTPServerDrain(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		drain   time.Duration
+		delay   time.Duration
+		dropped bool
+	}{
+		{
+			name:  "request finishes within drain timeout",
+			drain: 5 * time.Second,
+			delay: time.Second,
+		},
+		{
+			name:    "request exceeds drain timeout",
+			drain:   500 * time.Millisecond,
+			delay:   3 * time.Second,
+			dropped: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			started := make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(tt.delay)
+				w.Write([]byte("done"))
+			})
+
+			addr := freeAddress(t)
+			server := newHTTPServer("test", addr, handler)
+			server.setDrainTimeout(tt.drain)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := server.run(ctx); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}()
+
+			// waits for the server to come up.
+			for i := 0; i < 50; i++ {
+				conn, err := net.Dial("tcp", addr)
+				if err == nil {
+					conn.Close()
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			type result struct {
+				body string
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				resp, err := http.Get(fmt.Sprintf("http://%s/", addr))
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				body, err := ioutil.ReadAll(resp.Body)
+				results <- result{body: string(body), err: err}
+			}()
+
+			<-started
+			if server.inFlight() != 1 {
+				t.Errorf("expected 1 in-flight request, %d found", server.inFlight())
+			}
+			cancel()
+			wg.Wait()
+
+			if tt.dropped {
+				if server.inFlight() != 1 {
+					t.Errorf("expected request to still be in flight")
+				}
+				return
+			}
+
+			res := <-results
+			if res.err != nil {
+				t.Fatalf("unexpected error: %s", res.err)
+			}
+			if res.body != "done" {
+				t.Errorf("unexpected body %q", res.body)
+			}
+		})
+	}
+}
+
+func TestHTTPServerNetwork(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		network string
+		local   string
+	}{
+		{
+			name:    "ipv4",
+			network: "tcp4",
+			local:   "127.0.0.1",
+		},
+		{
+			name:    "ipv6",
+			network: "tcp6",
+			local:   "::1",
+		},
+		{
+			name:    "dual stack",
+			network: "tcp",
+			local:   "::1",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lis, err := net.Listen(tt.network, net.JoinHostPort(tt.local, "0"))
+			if err != nil {
+				t.Skipf("%s not supported: %s", tt.network, err)
+			}
+			port := lis.Addr().(*net.TCPAddr).Port
+			lis.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("done"))
+			})
+			server := newHTTPServer("test", fmt.Sprintf(":%d", port), handler)
+			server.network = tt.network
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := server.run(ctx); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			}()
+			defer wg.Wait()
+			defer cancel()
+
+			addr := net.JoinHostPort(tt.local, fmt.Sprint(port))
+			var resp *http.Response
+			for i := 0; i < 50; i++ {
+				if resp, err = http.Get(fmt.Sprintf("http://%s/", addr)); err == nil {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("unable to reach server on %s: %s", addr, err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestHTTPServerRequests(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/write":
+			w.Write([]byte("done"))
+		}
+	})
+	server := newHTTPServer("requests test", ":0", handler)
+	for _, path := range []string{"/fail", "/write", "/empty", "/fail"} {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []string{
+		`tagger_http_requests_total{code="200",server="requests test"} 2`,
+		`tagger_http_requests_total{code="503",server="requests test"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("%s not found: %s", expected, w.Body.String())
+		}
+	}
+}
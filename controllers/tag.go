@@ -2,17 +2,22 @@ package controllers
 
 import (
 	"context"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 
+	"github.com/ricardomaraschini/tagger/config"
 	imageinf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
 	imagelis "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
 	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
 )
 
 // TagUpdater abstraction exists to make testing easier. You most likely wanna
@@ -21,109 +26,434 @@ type TagUpdater interface {
 	Update(context.Context, *imagtagv1.Tag) error
 }
 
+// NamespaceOwner abstraction exists to make testing easier. It is used to
+// decide if events for objects in a namespace should be processed by this
+// replica. See Shard struct in services/shard.go for a concrete implementation.
+type NamespaceOwner interface {
+	Owns(namespace string) bool
+}
+
+// HandoverStore abstraction exists to make testing easier. It persists the
+// keys of the Tags pending processing so a standby replica taking over resumes
+// them. See Handover struct in services/handover.go for a concrete
+// implementation.
+type HandoverStore interface {
+	Save(ctx context.Context, keys []string, at time.Time) error
+	Load(ctx context.Context) ([]string, time.Time, error)
+}
+
+// handoverInterval is how often, while leading, the Tags pending processing
+// are saved for a standby replica.
+const handoverInterval = 5 * time.Second
+
+// scaleInterval is how often the worker pool utilization is reported and, if
+// worker scaling is enabled, the number of workers is adjusted.
+const scaleInterval = 5 * time.Second
+
 // Tag controller handles events related to Tags. It starts and receives events
 // from the informer, calling appropriate functions on our concrete services
-// layer implementation.
+// layer implementation. Events are processed by a pool of workers, each one
+// holding a token from tokens while processing, so the number of workers can
+// be changed at runtime.
 type Tag struct {
+	mtx       sync.Mutex
+	scaling   *config.WorkerScaling
+	deadline  config.ImportDeadline
+	running   bool
+	workers   int
+	wg        sync.WaitGroup
+	busy      int32
 	taglister imagelis.TagLister
-	queue     workqueue.RateLimitingInterface
+	queue     *trackedQueue
 	tagsvc    TagUpdater
+	shard     NamespaceOwner
 	appctx    context.Context
-	tokens    chan bool
+	tokens    *semaphore
+	inflight  *inflight
+	synclocks *keyLock
+	handover  HandoverStore
+	seen      map[string]time.Time
+	pending   map[string]bool
+}
+
+// inflight keeps track of the contexts of all imports currently running,
+// indexed by Tag UID. This allows us to cancel an import when the Tag it
+// refers to is deleted or has its spec changed.
+type inflight struct {
+	sync.Mutex
+	imports map[types.UID]*inflightImport
+}
+
+// inflightImport holds the cancel function for a running import.
+type inflightImport struct {
+	cancel context.CancelFunc
+}
+
+// start registers a new import for the provided Tag UID, returning a context
+// derived from ctx. Any import already running for the same UID is cancelled.
+// Callers must call the returned function once the import is done.
+func (i *inflight) start(ctx context.Context, uid types.UID) (context.Context, func()) {
+	i.Lock()
+	defer i.Unlock()
+
+	if imp, ok := i.imports[uid]; ok {
+		imp.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	imp := &inflightImport{cancel: cancel}
+	i.imports[uid] = imp
+	return ctx, func() {
+		i.Lock()
+		defer i.Unlock()
+		cancel()
+		// a new import may have replaced ours in the meantime, only
+		// remove the entry if it is still ours.
+		if i.imports[uid] == imp {
+			delete(i.imports, uid)
+		}
+	}
+}
+
+// cancel cancels the import running for the provided Tag UID, if any.
+func (i *inflight) cancel(uid types.UID) {
+	i.Lock()
+	defer i.Unlock()
+	if imp, ok := i.imports[uid]; ok {
+		imp.cancel()
+		delete(i.imports, uid)
+	}
 }
 
 // NewTag returns a new controller for Image Tags. This controller runs image
 // tag imports in parallel, at a given time we can have at max "workers"
-// distinct image tags being processed.
+// distinct image tags being processed. Tags used by Deployments are processed
+// before the others, see consumed. If shard is not nil only Tags living in
+// namespaces owned by the shard are processed.
 func NewTag(
-	taginf imageinf.SharedInformerFactory, tagsvc TagUpdater, workers int,
+	taginf imageinf.SharedInformerFactory,
+	tagsvc TagUpdater,
+	shard NamespaceOwner,
+	workers int,
 ) *Tag {
 	ratelimit := workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Minute)
 	ctrl := &Tag{
 		taglister: taginf.Images().V1().Tags().Lister(),
-		queue:     workqueue.NewRateLimitingQueue(ratelimit),
 		tagsvc:    tagsvc,
-		tokens:    make(chan bool, workers),
+		shard:     shard,
+		tokens:    newSemaphore(workers),
+		inflight: &inflight{
+			imports: map[types.UID]*inflightImport{},
+		},
+		synclocks: newKeyLock(),
+		deadline:  config.Default().ImportDeadline,
 	}
+	ctrl.queue = newTrackedQueue(newPriorityQueue(ratelimit, ctrl.consumed), ratelimit)
 	taginf.Images().V1().Tags().Informer().AddEventHandler(ctrl.handlers())
 	return ctrl
 }
 
+// consumed returns true if the Tag with the provided key is used by running
+// workloads, i.e. it has rollouts recorded in its status. Their events take
+// precedence so production updates are not stuck behind bulk imports of
+// Tags nobody uses.
+func (t *Tag) consumed(key interface{}) bool {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key.(string))
+	if err != nil {
+		return false
+	}
+	it, err := t.taglister.Tags(namespace).Get(name)
+	if err != nil {
+		return false
+	}
+	return len(it.Status.Rollouts) > 0
+}
+
 // Name returns a name identifier for this controller.
 func (t *Tag) Name() string {
 	return "tag"
 }
 
+// QueueState returns a snapshot of the controller work queue.
+func (t *Tag) QueueState() QueueState {
+	return t.queue.state(t.Name())
+}
+
+// StandBy makes the controller stand by until it is started, i.e. until we
+// become the leader. While standing by events are only recorded, once started
+// the Tags left pending by the previous leader and the ones changed after it
+// saved them are processed, avoiding a full resync. Must be called before the
+// informers are started.
+func (t *Tag) StandBy(handover HandoverStore) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.handover = handover
+	t.seen = map[string]time.Time{}
+	t.pending = map[string]bool{}
+}
+
 // enqueueEvent generates a key using "namespace/name" for the event received
-// and then enqueues this index to be processed.
+// and then enqueues this index to be processed. Events for namespaces not
+// owned by our shard are ignored. Events are not rate limited, only retries
+// are, so events for the same Tag arriving together are deduplicated by the
+// queue.
 func (t *Tag) enqueueEvent(o interface{}) {
 	key, err := cache.MetaNamespaceKeyFunc(o)
 	if err != nil {
 		klog.Errorf("fail to enqueue event: %v : %s", o, err)
 		return
 	}
-	t.queue.AddRateLimited(key)
+	if !ownsKey(t.shard, key) {
+		metrics.ShardSkippedEvents.WithLabelValues(t.Name()).Inc()
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.handover == nil {
+		t.queue.Add(key)
+		return
+	}
+	if !t.running {
+		t.seen[key] = time.Now()
+		return
+	}
+	t.pending[key] = true
+	t.queue.Add(key)
+}
+
+// setPending records if key still needs to be processed, only tracked while
+// standby is enabled.
+func (t *Tag) setPending(key string, pending bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.handover == nil {
+		return
+	}
+	if pending {
+		t.pending[key] = true
+		return
+	}
+	delete(t.pending, key)
+}
+
+// takeOver enqueues the Tags left pending by the previous leader and the ones
+// changed after it saved them. If nothing has been saved, or it can't be
+// read, all Tags seen while standing by are enqueued.
+func (t *Tag) takeOver() {
+	t.mtx.Lock()
+	seen := t.seen
+	t.seen = map[string]time.Time{}
+	t.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(t.appctx, handoverInterval)
+	defer cancel()
+	keys, savedAt, err := t.handover.Load(ctx)
+	if err != nil {
+		klog.Errorf("unable to load handover, resyncing all tags: %s", err)
+		keys, savedAt = nil, time.Time{}
+	}
+
+	for key, at := range seen {
+		if at.After(savedAt) {
+			keys = append(keys, key)
+		}
+	}
+	klog.Infof("taking over with %d tags pending out of %d seen", len(keys), len(seen))
+	for _, key := range keys {
+		if !ownsKey(t.shard, key) {
+			continue
+		}
+		t.setPending(key, true)
+		t.queue.Add(key)
+	}
+}
+
+// saveHandover saves the Tags pending processing.
+func (t *Tag) saveHandover(ctx context.Context) {
+	t.mtx.Lock()
+	keys := make([]string, 0, len(t.pending))
+	for key := range t.pending {
+		keys = append(keys, key)
+	}
+	t.mtx.Unlock()
+
+	if err := t.handover.Save(ctx, keys, time.Now()); err != nil {
+		klog.Errorf("unable to save handover: %s", err)
+	}
+}
+
+// handoverSaver saves the Tags pending processing every handoverInterval
+// until the controller is stopped.
+func (t *Tag) handoverSaver() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(handoverInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.saveHandover(t.appctx)
+		case <-t.appctx.Done():
+			return
+		}
+	}
+}
+
+// ownsKey returns true if the provided shard owns the namespace present in
+// a "namespace/name" key. A nil shard owns everything.
+func ownsKey(shard NamespaceOwner, key string) bool {
+	if shard == nil {
+		return true
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return true
+	}
+	return shard.Owns(namespace)
+}
+
+// cancelImport cancels any in-flight import for the Tag in o. If o is not
+// a Tag this is a no-op.
+func (t *Tag) cancelImport(o interface{}) {
+	if tomb, ok := o.(cache.DeletedFinalStateUnknown); ok {
+		o = tomb.Obj
+	}
+	it, ok := o.(*imagtagv1.Tag)
+	if !ok {
+		return
+	}
+	t.inflight.cancel(it.UID)
+}
+
+// tagDeleted releases what we hold for a deleted Tag: its in-flight import
+// is cancelled, its retry backoff forgotten and it is no longer pending for
+// a standby replica. Nothing is enqueued, there is nothing left to sync. o
+// may be a tombstone, if the informer missed the deletion, in which case the
+// Tag it holds may be stale but its key and UID are still valid. Everything
+// else created for a Tag is owned by it and garbage collected.
+func (t *Tag) tagDeleted(o interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(o)
+	if err != nil {
+		klog.Errorf("fail to handle tag deletion: %v : %s", o, err)
+		return
+	}
+	if !ownsKey(t.shard, key) {
+		metrics.ShardSkippedEvents.WithLabelValues(t.Name()).Inc()
+		return
+	}
+
+	klog.Infof("tag %s deleted", key)
+	t.cancelImport(o)
+	t.queue.Forget(key)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.handover == nil {
+		return
+	}
+	delete(t.pending, key)
+	delete(t.seen, key)
 }
 
 // handlers return a event handler that will be called by the informer
-// whenever an event occurs. This handler basically enqueues everything
-// in our work queue.
+// whenever an event occurs. Creations and updates are enqueued in our work
+// queue, deletions are handled right away by tagDeleted. Changing the spec
+// of a Tag cancels any import in flight for it.
 func (t *Tag) handlers() cache.ResourceEventHandler {
 	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(o interface{}) {
 			t.enqueueEvent(o)
 		},
 		UpdateFunc: func(o, n interface{}) {
+			oldtag, ok := o.(*imagtagv1.Tag)
+			newtag, nok := n.(*imagtagv1.Tag)
+			if ok && nok && !reflect.DeepEqual(oldtag.Spec, newtag.Spec) {
+				t.cancelImport(o)
+			}
 			t.enqueueEvent(o)
 		},
-		DeleteFunc: func(o interface{}) {
-			t.enqueueEvent(o)
-		},
+		DeleteFunc: t.tagDeleted,
 	}
 }
 
-// eventProcessor reads our events calling syncTag for all of them.
-func (t *Tag) eventProcessor(wg *sync.WaitGroup) {
-	defer wg.Done()
+// worker processes events until the queue is shut down. A token is held while
+// waiting for and processing an event, so at most as many events as the
+// worker limit are processed at once. When the limit shrinks the workers in
+// excess block waiting for a token once they are done with their event.
+func (t *Tag) worker() {
+	defer t.wg.Done()
 	for {
-		evt, end := t.queue.Get()
-		if end {
+		t.tokens.acquire()
+		more := t.processNextEvent()
+		t.tokens.release()
+		if !more {
 			return
 		}
+	}
+}
 
-		t.tokens <- true
-		go func() {
-			defer func() {
-				<-t.tokens
-			}()
-
-			namespace, name, err := cache.SplitMetaNamespaceKey(evt.(string))
-			if err != nil {
-				klog.Errorf("invalid event received %s: %s", evt, err)
-				t.queue.Done(evt)
-				return
-			}
+// processNextEvent reads an event from the queue and calls syncTag for it.
+// The queue does not hand out a key again until we are done with it, events
+// for a key being processed are deduplicated and handed out afterwards.
+// Failed events are requeued with backoff. Returns false once the queue has
+// been shut down.
+func (t *Tag) processNextEvent() bool {
+	evt, end := t.queue.Get()
+	if end {
+		return false
+	}
+	defer t.queue.Done(evt)
 
-			klog.Infof("received event for tag: %s", evt)
-			if err := t.syncTag(namespace, name); err != nil {
-				klog.Errorf("error processing tag %s: %v", evt, err)
-				t.queue.Done(evt)
-				t.queue.AddRateLimited(evt)
-				return
-			}
+	atomic.AddInt32(&t.busy, 1)
+	defer atomic.AddInt32(&t.busy, -1)
+	t.setPending(evt.(string), false)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(evt.(string))
+	if err != nil {
+		klog.Errorf("invalid event received %s: %s", evt, err)
+		t.queue.Forget(evt)
+		return true
+	}
 
-			klog.Infof("event for tag %s processed", evt)
-			t.queue.Done(evt)
-			t.queue.Forget(evt)
-		}()
+	klog.Infof("received event for tag: %s", evt)
+	if err := t.syncTag(namespace, name); err != nil {
+		klog.Errorf("error processing tag %s: %v", evt, err)
+		t.setPending(evt.(string), true)
+		t.queue.AddRateLimited(evt)
+		return true
 	}
+
+	klog.Infof("event for tag %s processed", evt)
+	t.queue.Forget(evt)
+	return true
 }
 
-// syncTag process an event for an image stream. A max of three minutes is
-// allowed per image stream sync.
+// spawnWorkers starts workers until there are as many of them as the worker
+// limit. Workers only stop once the controller stops, workers in excess of
+// a shrunk limit sit waiting for a token.
+func (t *Tag) spawnWorkers() {
+	_, limit := t.tokens.usage()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if !t.running {
+		return
+	}
+	for ; t.workers < limit; t.workers++ {
+		t.wg.Add(1)
+		go t.worker()
+	}
+}
+
+// syncTag process an event for an image stream. The time allowed per sync
+// is proportional to the size of the image, when known, see ImportDeadline
+// in config/config.go. The sync is cancelled if the Tag is deleted
+// or has its spec changed while we are still processing it, in the latter
+// case a new event for the Tag is already queued. At most one sync runs for
+// a given Tag at a time, a sync for a Tag whose previous sync is still being
+// cancelled waits for it to finish before reading the Tag.
 func (t *Tag) syncTag(namespace, name string) error {
-	ctx, cancel := context.WithTimeout(t.appctx, 3*time.Minute)
-	defer cancel()
+	defer t.synclocks.lock(namespace + "/" + name)()
 
 	it, err := t.taglister.Tags(namespace).Get(name)
 	if err != nil {
@@ -133,7 +463,111 @@ func (t *Tag) syncTag(namespace, name string) error {
 		return err
 	}
 	it = it.DeepCopy()
-	return t.tagsvc.Update(ctx, it)
+
+	ctx, done := t.inflight.start(t.appctx, it.UID)
+	defer done()
+	ctx, cancel := context.WithTimeout(ctx, t.importDeadline().For(it.ExpectedImportBytes()))
+	defer cancel()
+
+	err = t.tagsvc.Update(ctx, it)
+	if err != nil && ctx.Err() == context.Canceled && t.appctx.Err() == nil {
+		klog.Infof("import for tag %s/%s cancelled", namespace, name)
+		return nil
+	}
+	return err
+}
+
+// ApplyConfig changes the number of Tags imported in parallel and the import
+// deadline. With worker scaling enabled the current number of workers is only
+// brought within the scaling bounds, from there on it follows the queue depth.
+func (t *Tag) ApplyConfig(cfg *config.Config) {
+	t.mtx.Lock()
+	t.scaling = cfg.WorkerScaling
+	t.deadline = cfg.ImportDeadline
+	t.mtx.Unlock()
+
+	if cfg.WorkerScaling == nil {
+		t.tokens.resize(cfg.Workers)
+	} else {
+		_, limit := t.tokens.usage()
+		t.tokens.resize(clampWorkers(limit, *cfg.WorkerScaling))
+	}
+	t.spawnWorkers()
+}
+
+// importDeadline returns the import deadline configuration.
+func (t *Tag) importDeadline() config.ImportDeadline {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.deadline
+}
+
+// workerScaling returns the worker scaling configuration, nil if disabled.
+func (t *Tag) workerScaling() *config.WorkerScaling {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.scaling
+}
+
+// scale reports the worker pool utilization and, if worker scaling is
+// enabled, adjusts the number of workers to the queue depth.
+func (t *Tag) scale() {
+	_, limit := t.tokens.usage()
+	inuse := int(atomic.LoadInt32(&t.busy))
+	queued := t.queue.Len()
+	metrics.WorkersBusy.Set(float64(inuse))
+	metrics.WorkersLimit.Set(float64(limit))
+	metrics.TagQueueDepth.Set(float64(queued))
+
+	scaling := t.workerScaling()
+	if scaling == nil {
+		return
+	}
+	target := desiredWorkers(inuse, queued, limit, *scaling)
+	if target == limit {
+		return
+	}
+	klog.V(2).Infof("scaling workers from %d to %d, %d queued", limit, target, queued)
+	t.tokens.resize(target)
+	t.spawnWorkers()
+	metrics.WorkersLimit.Set(float64(target))
+}
+
+// desiredWorkers returns the number of workers needed to drain the queue.
+// Workers are added at once, so bursts drain fast, but removed one at a
+// time so we don't flap between sizes while the load goes down.
+func desiredWorkers(inuse, queued, limit int, scaling config.WorkerScaling) int {
+	target := inuse + queued
+	if target < limit {
+		target = limit - 1
+	}
+	return clampWorkers(target, scaling)
+}
+
+// clampWorkers brings workers within the scaling bounds.
+func clampWorkers(workers int, scaling config.WorkerScaling) int {
+	if workers < scaling.Min {
+		return scaling.Min
+	}
+	if workers > scaling.Max {
+		return scaling.Max
+	}
+	return workers
+}
+
+// scaler calls scale every scaleInterval until the controller is stopped.
+func (t *Tag) scaler() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.scale()
+		case <-t.appctx.Done():
+			return
+		}
+	}
 }
 
 // Start starts the controller's event loop.
@@ -142,14 +576,36 @@ func (t *Tag) Start(ctx context.Context) error {
 	// everything we might be doing should stop.
 	t.appctx = ctx
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go t.eventProcessor(&wg)
+	t.mtx.Lock()
+	t.running = true
+	t.wg.Add(1)
+	go t.scaler()
+	standby := t.handover != nil
+	t.mtx.Unlock()
+	t.spawnWorkers()
+
+	if standby {
+		t.takeOver()
+		t.wg.Add(1)
+		go t.handoverSaver()
+	}
 
 	// wait until it is time to die.
 	<-t.appctx.Done()
 
+	t.mtx.Lock()
+	t.running = false
+	t.mtx.Unlock()
+
 	t.queue.ShutDown()
-	wg.Wait()
+	t.wg.Wait()
+
+	// imports cancelled on the way out are pending as well, the replica
+	// taking over retries them.
+	if standby {
+		ctx, cancel := context.WithTimeout(context.Background(), handoverInterval)
+		defer cancel()
+		t.saveHandover(ctx)
+	}
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ricardomaraschini/tagger/config"
 	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
 	taginformer "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
 	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
@@ -20,6 +21,12 @@ type tagsvc struct {
 	db    map[string]*imagtagv1.Tag
 	calls int
 	delay time.Duration
+	// running counts the updates in progress per Tag, overlaps is the
+	// highest number of updates seen running at once for a single Tag.
+	running  map[string]int
+	overlaps int
+	// failures is how many times Update fails before succeeding.
+	failures int
 }
 
 func (t *tagsvc) Update(ctx context.Context, tag *imagtagv1.Tag) error {
@@ -31,12 +38,34 @@ func (t *tagsvc) Update(ctx context.Context, tag *imagtagv1.Tag) error {
 	idx := fmt.Sprintf("%s/%s", tag.Namespace, tag.Name)
 	t.db[idx] = tag.DeepCopy()
 	t.calls++
+	if t.running == nil {
+		t.running = map[string]int{}
+	}
+	t.running[idx]++
+	if t.running[idx] > t.overlaps {
+		t.overlaps = t.running[idx]
+	}
+
+	fail := t.calls <= t.failures
 
 	t.Unlock()
 	time.Sleep(t.delay)
+
+	t.Lock()
+	t.running[idx]--
+	t.Unlock()
+	if fail {
+		return fmt.Errorf("update failed")
+	}
 	return nil
 }
 
+func (t *tagsvc) ncalls() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.calls
+}
+
 func (t *tagsvc) get(idx string) *imagtagv1.Tag {
 	t.Lock()
 	defer t.Unlock()
@@ -56,7 +85,7 @@ func TestTagCreated(t *testing.T) {
 	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
 	svc := &tagsvc{}
 
-	ctrl := NewTag(taginf, svc, 1)
+	ctrl := NewTag(taginf, svc, nil, 1)
 	taginf.Start(ctx.Done())
 
 	if !cache.WaitForCacheSync(
@@ -115,7 +144,7 @@ func TestTagUpdated(t *testing.T) {
 	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
 	svc := &tagsvc{}
 
-	ctrl := NewTag(taginf, svc, 1)
+	ctrl := NewTag(taginf, svc, nil, 1)
 	taginf.Start(ctx.Done())
 
 	if !cache.WaitForCacheSync(
@@ -190,7 +219,7 @@ func TestTagParallel(t *testing.T) {
 		delay: 3 * time.Second,
 	}
 
-	ctrl := NewTag(taginf, svc, 5)
+	ctrl := NewTag(taginf, svc, nil, 5)
 	taginf.Start(ctx.Done())
 
 	if !cache.WaitForCacheSync(
@@ -228,8 +257,9 @@ func TestTagParallel(t *testing.T) {
 		}
 	}
 
-	// give some room for the event to be dispatched towards the controller.
-	time.Sleep(3 * time.Second)
+	// events are dispatched right away, the first five imports are still
+	// running at this point.
+	time.Sleep(1500 * time.Millisecond)
 
 	if svc.len() != 5 {
 		t.Errorf("5 parallel processes expected: %d", len(svc.db))
@@ -239,6 +269,274 @@ func TestTagParallel(t *testing.T) {
 	wg.Wait()
 }
 
+func TestSyncTagSerialized(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "a"},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "namespace", Name: "b"},
+		},
+	)
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &tagsvc{delay: 500 * time.Millisecond}
+	ctrl := NewTag(taginf, svc, nil, 5)
+	ctrl.appctx = ctx
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "a", "a", "b", "b", "b"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := ctrl.syncTag("namespace", name); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if svc.overlaps != 1 {
+		t.Errorf("expected serialized syncs per tag, %d ran at once", svc.overlaps)
+	}
+	// both tags are synced in parallel, three syncs each.
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("syncs for distinct tags not run in parallel, took %s", elapsed)
+	}
+	if size := ctrl.synclocks.size(); size != 0 {
+		t.Errorf("expected no sync locks left, %d found", size)
+	}
+}
+
+func TestTagEventsDeduplicated(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &tagsvc{delay: 2 * time.Second}
+
+	ctrl := NewTag(taginf, svc, nil, 5)
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error after start: %s", err)
+		}
+	}()
+
+	tag := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "namespace",
+			Name:      "tag",
+		},
+	}
+	if _, err := tagcli.ImagesV1().Tags("namespace").Create(
+		ctx, tag, metav1.CreateOptions{},
+	); err != nil {
+		t.Fatalf("error creating tag: %s", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	// events arriving while the tag is being processed are collapsed
+	// into a single sync once the current one finishes.
+	for i := 0; i < 5; i++ {
+		tag.Labels = map[string]string{"update": fmt.Sprint(i)}
+		if _, err := tagcli.ImagesV1().Tags("namespace").Update(
+			ctx, tag, metav1.UpdateOptions{},
+		); err != nil {
+			t.Fatalf("error updating tag: %s", err)
+		}
+	}
+	time.Sleep(5 * time.Second)
+
+	if calls := svc.ncalls(); calls != 2 {
+		t.Errorf("expected 2 syncs, %d found", calls)
+	}
+	svc.Lock()
+	overlaps := svc.overlaps
+	svc.Unlock()
+	if overlaps != 1 {
+		t.Errorf("expected serialized syncs, %d ran at once", overlaps)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestTagRetried(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &tagsvc{failures: 2}
+
+	ctrl := NewTag(taginf, svc, nil, 1)
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error after start: %s", err)
+		}
+	}()
+
+	tag := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "namespace",
+			Name:      "tag",
+		},
+	}
+	if _, err := tagcli.ImagesV1().Tags("namespace").Create(
+		ctx, tag, metav1.CreateOptions{},
+	); err != nil {
+		t.Fatalf("error creating tag: %s", err)
+	}
+
+	// retries back off for one and then two seconds.
+	time.Sleep(5 * time.Second)
+	if calls := svc.ncalls(); calls != 3 {
+		t.Errorf("expected 3 syncs, %d found", calls)
+	}
+	if requeues := ctrl.queue.NumRequeues("namespace/tag"); requeues != 0 {
+		t.Errorf("expected retries to be forgotten, %d requeues found", requeues)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+type handoverstore struct {
+	sync.Mutex
+	keys    []string
+	savedAt time.Time
+	saves   int
+}
+
+func (h *handoverstore) Save(ctx context.Context, keys []string, at time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+	h.keys = keys
+	h.savedAt = at
+	h.saves++
+	return nil
+}
+
+func (h *handoverstore) Load(ctx context.Context) ([]string, time.Time, error) {
+	h.Lock()
+	defer h.Unlock()
+	return h.keys, h.savedAt, nil
+}
+
+func TestTagHandover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &tagsvc{}
+	handover := &handoverstore{}
+
+	ctrl := NewTag(taginf, svc, nil, 1)
+	ctrl.StandBy(handover)
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	create := func(name string) {
+		tag := &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "namespace",
+				Name:      name,
+			},
+		}
+		if _, err := tagcli.ImagesV1().Tags("namespace").Create(
+			ctx, tag, metav1.CreateOptions{},
+		); err != nil {
+			t.Fatalf("error creating tag: %s", err)
+		}
+	}
+
+	// "synced" was processed by the previous leader, "pending" was not
+	// and "changed" has been created after the handover was saved.
+	create("synced")
+	create("pending")
+	time.Sleep(time.Second)
+	handover.Save(ctx, []string{"namespace/pending"}, time.Now())
+	create("changed")
+	time.Sleep(time.Second)
+
+	if calls := svc.ncalls(); calls != 0 {
+		t.Fatalf("expected no syncs while standing by, %d found", calls)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error after start: %s", err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+	if calls := svc.ncalls(); calls != 2 {
+		t.Errorf("expected 2 syncs, %d found", calls)
+	}
+	for _, idx := range []string{"namespace/pending", "namespace/changed"} {
+		if svc.get(idx) == nil {
+			t.Errorf("expected %s to be synced", idx)
+		}
+	}
+	if svc.get("namespace/synced") != nil {
+		t.Errorf("expected namespace/synced not to be synced")
+	}
+
+	cancel()
+	wg.Wait()
+
+	handover.Lock()
+	defer handover.Unlock()
+	if handover.saves != 2 {
+		t.Errorf("expected handover to be saved on stop")
+	}
+	if len(handover.keys) != 0 {
+		t.Errorf("expected nothing pending, %v found", handover.keys)
+	}
+}
+
 func TestTagDeleted(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 
@@ -246,7 +544,7 @@ func TestTagDeleted(t *testing.T) {
 	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
 	svc := &tagsvc{}
 
-	ctrl := NewTag(taginf, svc, 1)
+	ctrl := NewTag(taginf, svc, nil, 1)
 	taginf.Start(ctx.Done())
 
 	if !cache.WaitForCacheSync(
@@ -306,3 +604,292 @@ func TestTagDeleted(t *testing.T) {
 	cancel()
 	wg.Wait()
 }
+
+func TestTagDeletedTombstone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	ctrl := NewTag(taginf, &tagsvc{}, nil, 1)
+	ctrl.StandBy(&handoverstore{})
+	ctrl.running = true
+
+	tag := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "namespace",
+			Name:      "atag",
+			UID:       "atag-uid",
+		},
+	}
+	ctrl.enqueueEvent(tag)
+	ctrl.queue.AddRateLimited("namespace/atag")
+	impctx, done := ctrl.inflight.start(ctx, tag.UID)
+	defer done()
+
+	ctrl.handlers().OnDelete(cache.DeletedFinalStateUnknown{
+		Key: "namespace/atag",
+		Obj: tag,
+	})
+
+	if impctx.Err() != context.Canceled {
+		t.Errorf("expected import to be cancelled, %v found", impctx.Err())
+	}
+	if requeues := ctrl.queue.NumRequeues("namespace/atag"); requeues != 0 {
+		t.Errorf("expected retries to be forgotten, %d requeues found", requeues)
+	}
+	if ctrl.pending["namespace/atag"] {
+		t.Errorf("deleted tag still pending for handover")
+	}
+}
+
+// blockingsvc blocks on every Update until the provided context is done,
+// recording how many of them were cancelled.
+type blockingsvc struct {
+	sync.Mutex
+	started   int
+	cancelled int
+}
+
+func (b *blockingsvc) Update(ctx context.Context, tag *imagtagv1.Tag) error {
+	b.Lock()
+	b.started++
+	b.Unlock()
+
+	<-ctx.Done()
+
+	b.Lock()
+	defer b.Unlock()
+	if ctx.Err() == context.Canceled {
+		b.cancelled++
+	}
+	return ctx.Err()
+}
+
+func (b *blockingsvc) counters() (int, int) {
+	b.Lock()
+	defer b.Unlock()
+	return b.started, b.cancelled
+}
+
+func TestTagDeletedWhileImporting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &blockingsvc{}
+
+	ctrl := NewTag(taginf, svc, nil, 1)
+	taginf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error after start: %s", err)
+		}
+	}()
+
+	tag := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "namespace",
+			Name:      "atag",
+			UID:       "atag-uid",
+		},
+		Spec: imagtagv1.TagSpec{
+			From: "centos:7",
+		},
+	}
+
+	if _, err := tagcli.ImagesV1().Tags("namespace").Create(
+		ctx, tag, metav1.CreateOptions{},
+	); err != nil {
+		t.Fatalf("error creating tag: %s", err)
+	}
+
+	// give some room for the event to be dispatched towards the controller.
+	time.Sleep(3 * time.Second)
+
+	if err := tagcli.ImagesV1().Tags("namespace").Delete(
+		ctx, "atag", metav1.DeleteOptions{},
+	); err != nil {
+		t.Fatalf("error deleting tag: %s", err)
+	}
+
+	// give some room for the event to be dispatched towards the controller.
+	time.Sleep(3 * time.Second)
+
+	started, cancelled := svc.counters()
+	if started != 1 {
+		t.Errorf("expected 1 import, %d started", started)
+	}
+	if cancelled != 1 {
+		t.Errorf("expected 1 cancelled import, %d cancelled", cancelled)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+type nsowner struct {
+	namespace string
+}
+
+func (n nsowner) Owns(namespace string) bool {
+	return namespace == n.namespace
+}
+
+func TestTagSharded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &tagsvc{}
+
+	ctrl := NewTag(taginf, svc, nsowner{"owned"}, 1)
+	taginf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error after start: %s", err)
+		}
+	}()
+
+	for _, ns := range []string{"owned", "not-owned"} {
+		tag := &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: ns,
+				Name:      "atag",
+			},
+			Spec: imagtagv1.TagSpec{
+				From: "centos:7",
+			},
+		}
+		if _, err := tagcli.ImagesV1().Tags(ns).Create(
+			ctx, tag, metav1.CreateOptions{},
+		); err != nil {
+			t.Fatalf("error creating tag: %s", err)
+		}
+	}
+
+	// give some room for the event to be dispatched towards the controller.
+	time.Sleep(3 * time.Second)
+
+	if svc.get("owned/atag") == nil {
+		t.Errorf("tag in owned namespace not processed")
+	}
+	if svc.get("not-owned/atag") != nil {
+		t.Errorf("tag in not owned namespace processed")
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestDesiredWorkers(t *testing.T) {
+	scaling := config.WorkerScaling{Min: 2, Max: 20}
+	for _, tt := range []struct {
+		name     string
+		inuse    int
+		queued   int
+		limit    int
+		expected int
+	}{
+		{
+			name:     "idle at minimum",
+			limit:    2,
+			expected: 2,
+		},
+		{
+			name:     "burst",
+			inuse:    4,
+			queued:   10,
+			limit:    4,
+			expected: 14,
+		},
+		{
+			name:     "burst beyond maximum",
+			inuse:    10,
+			queued:   100,
+			limit:    10,
+			expected: 20,
+		},
+		{
+			name:     "draining",
+			inuse:    3,
+			limit:    14,
+			expected: 13,
+		},
+		{
+			name:     "fully used",
+			inuse:    8,
+			limit:    8,
+			expected: 8,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			target := desiredWorkers(tt.inuse, tt.queued, tt.limit, scaling)
+			if target != tt.expected {
+				t.Errorf("expected %d workers, %d received", tt.expected, target)
+			}
+		})
+	}
+}
+
+func TestTagApplyConfigScaling(t *testing.T) {
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	ctrl := NewTag(taginf, &tagsvc{}, nil, 10)
+
+	cfg := config.Default()
+	cfg.WorkerScaling = &config.WorkerScaling{Min: 1, Max: 4}
+	ctrl.ApplyConfig(cfg)
+	if _, limit := ctrl.tokens.usage(); limit != 4 {
+		t.Errorf("expected limit to be clamped to 4, %d found", limit)
+	}
+
+	for i := 0; i < 6; i++ {
+		ctrl.queue.Add(fmt.Sprintf("namespace/tag-%d", i))
+	}
+	ctrl.scale()
+	if _, limit := ctrl.tokens.usage(); limit != 4 {
+		t.Errorf("expected limit to stay at the maximum, %d found", limit)
+	}
+
+	for ctrl.queue.Len() > 0 {
+		item, _ := ctrl.queue.Get()
+		ctrl.queue.Done(item)
+	}
+	ctrl.scale()
+	if _, limit := ctrl.tokens.usage(); limit != 3 {
+		t.Errorf("expected limit to shrink to 3, %d found", limit)
+	}
+
+	cfg.WorkerScaling = nil
+	cfg.Workers = 7
+	ctrl.ApplyConfig(cfg)
+	ctrl.scale()
+	if _, limit := ctrl.tokens.usage(); limit != 7 {
+		t.Errorf("expected fixed limit of 7, %d found", limit)
+	}
+}
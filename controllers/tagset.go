@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	imageinf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagelis "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// TagSetSyncer abstraction exists to make testing easier. You most likely
+// wanna see TagSet struct under services/tagset.go for a concrete
+// implementation of this.
+type TagSetSyncer interface {
+	Sync(context.Context, *imagtagv1.TagSet) error
+}
+
+// TagSet controller handles events related to TagSets. TagSets are synced
+// when they change and when one of their member Tags change.
+type TagSet struct {
+	tslister imagelis.TagSetLister
+	tssvc    TagSetSyncer
+	shard    NamespaceOwner
+	queue    *trackedQueue
+	appctx   context.Context
+}
+
+// NewTagSet returns a new controller for TagSets. If shard is not nil only
+// TagSets in namespaces owned by the shard are processed.
+func NewTagSet(
+	taginf imageinf.SharedInformerFactory,
+	tssvc TagSetSyncer,
+	shard NamespaceOwner,
+) *TagSet {
+	ctrl := &TagSet{
+		tslister: taginf.Images().V1().TagSets().Lister(),
+		queue:    newTrackedQueue(workqueue.New(), nil),
+		tssvc:    tssvc,
+		shard:    shard,
+	}
+	taginf.Images().V1().TagSets().Informer().AddEventHandler(ctrl.handlers())
+	taginf.Images().V1().Tags().Informer().AddEventHandler(ctrl.tagHandlers())
+	return ctrl
+}
+
+// Name returns a name identifier for this controller.
+func (t *TagSet) Name() string {
+	return "tag set"
+}
+
+// QueueState returns a snapshot of the controller work queue.
+func (t *TagSet) QueueState() QueueState {
+	return t.queue.state(t.Name())
+}
+
+// enqueueEvent enqueues a TagSet as "namespace/name". Events for namespaces
+// not owned by our shard are ignored.
+func (t *TagSet) enqueueEvent(o interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(o)
+	if err != nil {
+		klog.Errorf("fail to enqueue event: %v : %s", o, err)
+		return
+	}
+	if !ownsKey(t.shard, key) {
+		metrics.ShardSkippedEvents.WithLabelValues(t.Name()).Inc()
+		return
+	}
+	t.queue.Add(key)
+}
+
+// enqueueTagSets enqueues all TagSets the Tag is a member of.
+func (t *TagSet) enqueueTagSets(o interface{}) {
+	it, ok := o.(*imagtagv1.Tag)
+	if !ok {
+		return
+	}
+
+	sets, err := t.tslister.TagSets(it.Namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("unable to list tag sets for tag %s/%s: %s", it.Namespace, it.Name, err)
+		return
+	}
+	for _, ts := range sets {
+		if ts.Contains(it.Name) {
+			t.enqueueEvent(ts)
+		}
+	}
+}
+
+// handlers return the event handlers for TagSets. Deleted TagSets are of no
+// interest, their members are left where they are.
+func (t *TagSet) handlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			t.enqueueEvent(o)
+		},
+		UpdateFunc: func(o, n interface{}) {
+			t.enqueueEvent(n)
+		},
+		DeleteFunc: func(o interface{}) {},
+	}
+}
+
+// tagHandlers return the event handlers for Tags. Resyncs are ignored as
+// they don't move Tags to another generation. Deleted members are noticed
+// when the TagSet is synced.
+func (t *TagSet) tagHandlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(o interface{}) {
+			t.enqueueTagSets(o)
+		},
+		UpdateFunc: func(o, n interface{}) {
+			oldtag, ok := o.(*imagtagv1.Tag)
+			if !ok {
+				return
+			}
+			newtag, ok := n.(*imagtagv1.Tag)
+			if !ok || oldtag.ResourceVersion == newtag.ResourceVersion {
+				return
+			}
+			t.enqueueTagSets(n)
+		},
+		DeleteFunc: func(o interface{}) {
+			t.enqueueTagSets(o)
+		},
+	}
+}
+
+// eventProcessor reads our events calling syncTagSet for all of them.
+func (t *TagSet) eventProcessor(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		evt, end := t.queue.Get()
+		if end {
+			return
+		}
+
+		namespace, name, err := cache.SplitMetaNamespaceKey(evt.(string))
+		if err != nil {
+			klog.Errorf("invalid event received %s: %s", evt, err)
+			t.queue.Done(evt)
+			continue
+		}
+
+		klog.V(5).Infof("received event for tag set: %s", evt)
+		if err := t.syncTagSet(namespace, name); err != nil {
+			klog.Errorf("error processing tag set %s: %v", evt, err)
+			t.queue.Done(evt)
+			t.queue.AddAfter(evt, 5*time.Second)
+			continue
+		}
+		t.queue.Forget(evt)
+		t.queue.Done(evt)
+	}
+}
+
+// syncTagSet process an event for a TagSet. We allow thirty seconds per sync
+// as it may update all member Tags.
+func (t *TagSet) syncTagSet(namespace, name string) error {
+	ctx, cancel := context.WithTimeout(t.appctx, 30*time.Second)
+	defer cancel()
+
+	ts, err := t.tslister.TagSets(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return t.tssvc.Sync(ctx, ts.DeepCopy())
+}
+
+// Start starts the controller's event loop.
+func (t *TagSet) Start(ctx context.Context) error {
+	// appctx is the 'keep going' context, if it is cancelled
+	// everything we might be doing should stop.
+	t.appctx = ctx
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go t.eventProcessor(&wg)
+
+	// wait until it is time to die.
+	<-t.appctx.Done()
+
+	t.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+type tssvc struct {
+	sync.Mutex
+	calls map[string]int
+}
+
+func (t *tssvc) Sync(ctx context.Context, ts *imagtagv1.TagSet) error {
+	t.Lock()
+	defer t.Unlock()
+	t.calls[ts.Name]++
+	return nil
+}
+
+func (t *tssvc) get(name string) int {
+	t.Lock()
+	defer t.Unlock()
+	return t.calls[name]
+}
+
+func TestTagSetController(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	svc := &tssvc{calls: map[string]int{}}
+
+	ctrl := NewTagSet(taginf, svc, nil)
+	taginf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		taginf.Images().V1().TagSets().Informer().HasSynced,
+	) {
+		cancel()
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := ctrl.Start(ctx); err != nil {
+			t.Errorf("unexpected error starting controller: %s", err)
+		}
+	}()
+
+	for _, ts := range []*imagtagv1.TagSet{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "namespace",
+				Name:      "app",
+			},
+			Spec: imagtagv1.TagSetSpec{
+				Tags: []string{"frontend", "backend"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "namespace",
+				Name:      "other",
+			},
+			Spec: imagtagv1.TagSetSpec{
+				Tags: []string{"worker"},
+			},
+		},
+	} {
+		if _, err := tagcli.ImagesV1().TagSets("namespace").Create(
+			ctx, ts, metav1.CreateOptions{},
+		); err != nil {
+			t.Errorf("error creating tag set: %s", err)
+		}
+	}
+
+	// give some room for the event to be dispatched towards the controller.
+	time.Sleep(time.Second)
+
+	if calls := svc.get("app"); calls != 1 {
+		t.Errorf("expected 1 call, %d calls made", calls)
+	}
+
+	// a member tag moving syncs the sets it belongs to.
+	if _, err := tagcli.ImagesV1().Tags("namespace").Create(
+		ctx,
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "namespace",
+				Name:      "backend",
+			},
+		},
+		metav1.CreateOptions{},
+	); err != nil {
+		t.Errorf("error creating tag: %s", err)
+	}
+	time.Sleep(time.Second)
+
+	if calls := svc.get("app"); calls != 2 {
+		t.Errorf("expected 2 calls, %d calls made", calls)
+	}
+	if calls := svc.get("other"); calls != 1 {
+		t.Errorf("tag set without the tag synced %d times", calls)
+	}
+
+	cancel()
+	wg.Wait()
+}
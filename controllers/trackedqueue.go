@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+// QueueState is a snapshot of the work queue of a controller. Retries holds,
+// by key, how many times the items failing to sync have been retried, items
+// are forgotten once synced. InFlight holds the syncs currently running.
+type QueueState struct {
+	Controller           string         `json:"controller"`
+	Length               int            `json:"length"`
+	OldestItemAgeSeconds float64        `json:"oldestItemAgeSeconds"`
+	Retries              map[string]int `json:"retries,omitempty"`
+	InFlight             []InFlightSync `json:"inFlight,omitempty"`
+}
+
+// InFlightSync is a sync being run by a controller, oldest ones first.
+type InFlightSync struct {
+	Key            string    `json:"key"`
+	StartedAt      time.Time `json:"startedAt"`
+	RunningSeconds float64   `json:"runningSeconds"`
+}
+
+// trackedQueue is a work queue recording when its items were queued, which
+// ones are being processed and how many times failing items have been
+// retried, see state. Items added after a delay, or rate limited, count as
+// retries until forgotten. The delay between retries is taken from limiter,
+// if any, as with client-go rate limiting queues.
+type trackedQueue struct {
+	workqueue.Interface
+	limiter workqueue.RateLimiter
+	mtx     sync.Mutex
+	queued  map[interface{}]time.Time
+	syncing map[interface{}]time.Time
+	retries map[interface{}]int
+	now     func() time.Time
+}
+
+// newTrackedQueue returns a tracked queue handing out items through queue.
+// Limiter may be nil if items are never rate limited.
+func newTrackedQueue(queue workqueue.Interface, limiter workqueue.RateLimiter) *trackedQueue {
+	return &trackedQueue{
+		Interface: queue,
+		limiter:   limiter,
+		queued:    map[interface{}]time.Time{},
+		syncing:   map[interface{}]time.Time{},
+		retries:   map[interface{}]int{},
+		now:       time.Now,
+	}
+}
+
+// Add queues an item, recording when it was first queued.
+func (q *trackedQueue) Add(item interface{}) {
+	if q.ShuttingDown() {
+		return
+	}
+	q.mtx.Lock()
+	if _, ok := q.queued[item]; !ok {
+		q.queued[item] = q.now()
+	}
+	q.mtx.Unlock()
+	q.Interface.Add(item)
+}
+
+// Get hands out the next item, recording it as being processed.
+func (q *trackedQueue) Get() (interface{}, bool) {
+	item, shutdown := q.Interface.Get()
+	if shutdown {
+		return item, shutdown
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	delete(q.queued, item)
+	q.syncing[item] = q.now()
+	return item, shutdown
+}
+
+// Done marks an item as processed.
+func (q *trackedQueue) Done(item interface{}) {
+	q.mtx.Lock()
+	delete(q.syncing, item)
+	q.mtx.Unlock()
+	q.Interface.Done(item)
+}
+
+// AddAfter retries an item once the duration has passed.
+func (q *trackedQueue) AddAfter(item interface{}, duration time.Duration) {
+	if q.ShuttingDown() {
+		return
+	}
+	q.mtx.Lock()
+	q.retries[item]++
+	q.mtx.Unlock()
+	if duration <= 0 {
+		q.Add(item)
+		return
+	}
+	time.AfterFunc(duration, func() {
+		q.Add(item)
+	})
+}
+
+// AddRateLimited retries an item once the rate limiter allows it.
+func (q *trackedQueue) AddRateLimited(item interface{}) {
+	var delay time.Duration
+	if q.limiter != nil {
+		delay = q.limiter.When(item)
+	}
+	q.AddAfter(item, delay)
+}
+
+// Forget stops counting the retries of an item, e.g. once it synced.
+func (q *trackedQueue) Forget(item interface{}) {
+	q.mtx.Lock()
+	delete(q.retries, item)
+	q.mtx.Unlock()
+	if q.limiter != nil {
+		q.limiter.Forget(item)
+	}
+}
+
+// NumRequeues returns how many times an item has been retried.
+func (q *trackedQueue) NumRequeues(item interface{}) int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.retries[item]
+}
+
+// state returns a snapshot of the queue of the named controller.
+func (q *trackedQueue) state(controller string) QueueState {
+	length := q.Len()
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	now := q.now()
+	state := QueueState{
+		Controller: controller,
+		Length:     length,
+	}
+	for _, queued := range q.queued {
+		if age := now.Sub(queued).Seconds(); age > state.OldestItemAgeSeconds {
+			state.OldestItemAgeSeconds = age
+		}
+	}
+	if len(q.retries) > 0 {
+		state.Retries = map[string]int{}
+		for item, retries := range q.retries {
+			state.Retries[fmt.Sprint(item)] = retries
+		}
+	}
+	for item, started := range q.syncing {
+		state.InFlight = append(state.InFlight, InFlightSync{
+			Key:            fmt.Sprint(item),
+			StartedAt:      started,
+			RunningSeconds: now.Sub(started).Seconds(),
+		})
+	}
+	sort.Slice(state.InFlight, func(i, j int) bool {
+		return state.InFlight[i].StartedAt.Before(state.InFlight[j].StartedAt)
+	})
+	return state
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestTrackedQueue(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	queue := newTrackedQueue(workqueue.New(), nil)
+	queue.now = func() time.Time { return now }
+	defer queue.ShutDown()
+
+	queue.Add("dev/a")
+	now = now.Add(time.Minute)
+	queue.Add("dev/b")
+	queue.Add("dev/a")
+	now = now.Add(time.Minute)
+
+	state := queue.state("tag")
+	if state.Controller != "tag" || state.Length != 2 {
+		t.Errorf("unexpected state %+v", state)
+	}
+	if state.OldestItemAgeSeconds != 120 {
+		t.Errorf("expected oldest item age of 120s, %v found", state.OldestItemAgeSeconds)
+	}
+
+	// items being processed are in flight and no longer queued.
+	item, _ := queue.Get()
+	started := now
+	now = now.Add(30 * time.Second)
+	state = queue.state("tag")
+	if state.Length != 1 || state.OldestItemAgeSeconds != 90 {
+		t.Errorf("unexpected state %+v", state)
+	}
+	expected := []InFlightSync{{Key: "dev/a", StartedAt: started, RunningSeconds: 30}}
+	if !reflect.DeepEqual(state.InFlight, expected) {
+		t.Errorf("expected in flight %+v, %+v found", expected, state.InFlight)
+	}
+
+	// failed items are retried until forgotten.
+	queue.Done(item)
+	queue.AddAfter(item, 0)
+	queue.AddRateLimited(item)
+	state = queue.state("tag")
+	if len(state.InFlight) != 0 {
+		t.Errorf("unexpected in flight %+v", state.InFlight)
+	}
+	if !reflect.DeepEqual(state.Retries, map[string]int{"dev/a": 2}) {
+		t.Errorf("unexpected retries %+v", state.Retries)
+	}
+	if queue.NumRequeues(item) != 2 {
+		t.Errorf("expected two requeues, %d found", queue.NumRequeues(item))
+	}
+	queue.Forget(item)
+	if state = queue.state("tag"); state.Retries != nil {
+		t.Errorf("unexpected retries %+v", state.Retries)
+	}
+}
+
+func TestTrackedQueueRateLimited(t *testing.T) {
+	ratelimit := workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Second)
+	queue := newTrackedQueue(workqueue.New(), ratelimit)
+	defer queue.ShutDown()
+
+	queue.AddRateLimited("dev/a")
+	if item, _ := queue.Get(); item != "dev/a" {
+		t.Errorf("expected dev/a, %v received", item)
+	}
+	if ratelimit.NumRequeues("dev/a") != 1 {
+		t.Errorf("expected one requeue, %d found", ratelimit.NumRequeues("dev/a"))
+	}
+	queue.Forget("dev/a")
+	if ratelimit.NumRequeues("dev/a") != 0 {
+		t.Errorf("expected no requeues, %d found", ratelimit.NumRequeues("dev/a"))
+	}
+}
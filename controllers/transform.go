@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	coreinf "k8s.io/client-go/informers"
+	corecli "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// StripInformers registers, within corinf, informers that drop what tagger
+// never reads from the objects they cache. Managed fields are dropped from
+// every object while pods and ReplicaSets also have their pod spec reduced to
+// the container names and images (and the readiness gates for pods). Objects
+// tagger writes back from the cache (Deployments, ConfigMaps, Secrets and pod
+// status) keep everything else. Must be called before any other informer for
+// these types is requested from corinf.
+func StripInformers(corinf coreinf.SharedInformerFactory) {
+	corinf.InformerFor(
+		&corev1.Pod{},
+		func(cli corecli.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newStrippedInformer(
+				&cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return cli.CoreV1().Pods("").List(context.Background(), opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						return cli.CoreV1().Pods("").Watch(context.Background(), opts)
+					},
+				},
+				&corev1.Pod{},
+				resync,
+			)
+		},
+	)
+	corinf.InformerFor(
+		&appsv1.ReplicaSet{},
+		func(cli corecli.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newStrippedInformer(
+				&cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return cli.AppsV1().ReplicaSets("").List(context.Background(), opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						return cli.AppsV1().ReplicaSets("").Watch(context.Background(), opts)
+					},
+				},
+				&appsv1.ReplicaSet{},
+				resync,
+			)
+		},
+	)
+	corinf.InformerFor(
+		&appsv1.Deployment{},
+		func(cli corecli.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newStrippedInformer(
+				&cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return cli.AppsV1().Deployments("").List(context.Background(), opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						return cli.AppsV1().Deployments("").Watch(context.Background(), opts)
+					},
+				},
+				&appsv1.Deployment{},
+				resync,
+			)
+		},
+	)
+	corinf.InformerFor(
+		&corev1.ConfigMap{},
+		func(cli corecli.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newStrippedInformer(
+				&cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return cli.CoreV1().ConfigMaps("").List(context.Background(), opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						return cli.CoreV1().ConfigMaps("").Watch(context.Background(), opts)
+					},
+				},
+				&corev1.ConfigMap{},
+				resync,
+			)
+		},
+	)
+	corinf.InformerFor(
+		&corev1.Secret{},
+		func(cli corecli.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newStrippedInformer(
+				&cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return cli.CoreV1().Secrets("").List(context.Background(), opts)
+					},
+					WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+						return cli.CoreV1().Secrets("").Watch(context.Background(), opts)
+					},
+				},
+				&corev1.Secret{},
+				resync,
+			)
+		},
+	)
+}
+
+// newStrippedInformer returns a namespace indexed informer whose objects go
+// through stripObject, both when listed and when watched, before reaching
+// the cache.
+func newStrippedInformer(
+	lw *cache.ListWatch, obj runtime.Object, resync time.Duration,
+) cache.SharedIndexInformer {
+	list, watchfn := lw.ListFunc, lw.WatchFunc
+	lw.ListFunc = func(opts metav1.ListOptions) (runtime.Object, error) {
+		objs, err := list(opts)
+		if err != nil {
+			return nil, err
+		}
+		err = meta.EachListItem(objs, func(obj runtime.Object) error {
+			stripObject(obj)
+			return nil
+		})
+		return objs, err
+	}
+	lw.WatchFunc = func(opts metav1.ListOptions) (watch.Interface, error) {
+		w, err := watchfn(opts)
+		if err != nil {
+			return nil, err
+		}
+		return watch.Filter(w, func(evt watch.Event) (watch.Event, bool) {
+			stripObject(evt.Object)
+			return evt, true
+		}), nil
+	}
+
+	return cache.NewSharedIndexInformer(
+		lw, obj, resync,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+}
+
+// stripObject drops, in place, the parts of an object tagger does not read.
+// Objects of unknown types, e.g. the Status of an error event, are left as
+// they are.
+func stripObject(obj runtime.Object) {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		o.ManagedFields = nil
+		o.Spec = corev1.PodSpec{
+			Containers:     stripContainers(o.Spec.Containers),
+			ReadinessGates: o.Spec.ReadinessGates,
+		}
+	case *appsv1.ReplicaSet:
+		o.ManagedFields = nil
+		o.Spec.Template.Spec = corev1.PodSpec{
+			Containers: stripContainers(o.Spec.Template.Spec.Containers),
+		}
+	case *appsv1.Deployment:
+		o.ManagedFields = nil
+	case *corev1.ConfigMap:
+		o.ManagedFields = nil
+	case *corev1.Secret:
+		o.ManagedFields = nil
+	}
+}
+
+// stripContainers returns the containers with only their names and images.
+func stripContainers(containers []corev1.Container) []corev1.Container {
+	var stripped []corev1.Container
+	for _, c := range containers {
+		stripped = append(stripped, corev1.Container{Name: c.Name, Image: c.Image})
+	}
+	return stripped
+}
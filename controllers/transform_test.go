@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestStripInformers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	replicaSet := func(name string) *appsv1.ReplicaSet {
+		rs := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:     "prod",
+				Name:          name,
+				Annotations:   map[string]string{"image-tag": "true"},
+				ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+			},
+		}
+		rs.Spec.Template.Annotations = map[string]string{"app": "quay.io/app@sha256:0"}
+		rs.Spec.Template.Spec = corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "app",
+					Image:   "app",
+					Command: []string{"/app"},
+					Env:     []corev1.EnvVar{{Name: "DEBUG", Value: "true"}},
+				},
+			},
+			Volumes: []corev1.Volume{{Name: "data"}},
+		}
+		return rs
+	}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:     "prod",
+			Name:          "app",
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+	}
+	deployment.Spec.Template.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+
+	corcli := corfake.NewSimpleClientset(replicaSet("listed"), deployment)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	StripInformers(corinf)
+	replis := corinf.Apps().V1().ReplicaSets().Lister()
+	deplis := corinf.Apps().V1().Deployments().Lister()
+	corinf.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+		corinf.Apps().V1().Deployments().Informer().HasSynced,
+	) {
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	// objects are stripped both when listed and when watched.
+	if _, err := corcli.AppsV1().ReplicaSets("prod").Create(
+		ctx, replicaSet("watched"), metav1.CreateOptions{},
+	); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(time.Second)
+
+	for _, name := range []string{"listed", "watched"} {
+		rs, err := replis.ReplicaSets("prod").Get(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if rs.ManagedFields != nil {
+			t.Errorf("%s: managed fields kept: %v", name, rs.ManagedFields)
+		}
+		if rs.Annotations["image-tag"] != "true" ||
+			rs.Spec.Template.Annotations["app"] != "quay.io/app@sha256:0" {
+			t.Errorf("%s: annotations dropped", name)
+		}
+		expected := corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app"}},
+		}
+		if !reflect.DeepEqual(rs.Spec.Template.Spec, expected) {
+			t.Errorf("%s: expected %+v, %+v found", name, expected, rs.Spec.Template.Spec)
+		}
+	}
+
+	dep, err := deplis.Deployments("prod").Get("app")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dep.ManagedFields != nil {
+		t.Errorf("deployment managed fields kept: %v", dep.ManagedFields)
+	}
+	if len(dep.Spec.Template.Spec.Volumes) != 1 {
+		t.Errorf("deployment pod spec stripped: %+v", dep.Spec.Template.Spec)
+	}
+}
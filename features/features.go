@@ -0,0 +1,144 @@
+// Package features holds the feature gates known by tagger. Feature gates allow
+// experimental subsystems to ship disabled by default and to be turned on per
+// cluster through the --feature-gates command line flag.
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Stage indicates the maturity of a feature.
+type Stage string
+
+// These are the stages a feature may be in. Alpha features are disabled by
+// default while Beta and GA features are usually enabled by default.
+const (
+	Alpha Stage = "Alpha"
+	Beta  Stage = "Beta"
+	GA    Stage = "GA"
+)
+
+// Spec describes a feature gate, its default value and its maturity stage.
+type Spec struct {
+	Default bool
+	Stage   Stage
+}
+
+// Gates is a registry of feature gates. Gates must be registered before their
+// values can be set or read. Gates is safe for concurrent use.
+type Gates struct {
+	mtx     sync.RWMutex
+	known   map[string]Spec
+	enabled map[string]bool
+}
+
+// New returns an empty feature gates registry.
+func New() *Gates {
+	return &Gates{
+		known:   map[string]Spec{},
+		enabled: map[string]bool{},
+	}
+}
+
+// Register adds a new feature gate to the registry. Registering the same
+// feature twice is a programming error and causes a panic.
+func (g *Gates) Register(name string, spec Spec) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if _, ok := g.known[name]; ok {
+		panic(fmt.Sprintf("feature gate %q registered twice", name))
+	}
+	g.known[name] = spec
+}
+
+// Enabled returns true if provided feature is enabled. Unknown features are
+// always reported as disabled.
+func (g *Gates) Enabled(name string) bool {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	if val, ok := g.enabled[name]; ok {
+		return val
+	}
+	return g.known[name].Default
+}
+
+// Set parses a comma separated list of "Feature=bool" pairs and sets the
+// gates accordingly. Set either applies all provided values or none of them.
+// This function makes Gates a flag.Value.
+func (g *Gates) Set(value string) error {
+	values := map[string]bool{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("missing bool value for feature %q", kv[0])
+		}
+
+		name := strings.TrimSpace(kv[0])
+		enabled, err := strconv.ParseBool(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return fmt.Errorf("invalid value for feature %q: %w", name, err)
+		}
+		values[name] = enabled
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for name := range values {
+		if _, ok := g.known[name]; !ok {
+			return fmt.Errorf("unknown feature gate %q", name)
+		}
+	}
+	for name, enabled := range values {
+		g.enabled[name] = enabled
+	}
+	return nil
+}
+
+// String returns the current state of all known gates in the same format
+// accepted by Set, sorted by feature name.
+func (g *Gates) String() string {
+	var pairs []string
+	for _, name := range g.Known() {
+		pairs = append(pairs, fmt.Sprintf("%s=%t", name, g.Enabled(name)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Known returns the names of all registered feature gates, sorted.
+func (g *Gates) Known() []string {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	var names []string
+	for name := range g.known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Usage returns a human readable description of all known gates, suitable to
+// be used as help text for a command line flag.
+func (g *Gates) Usage() string {
+	lines := []string{
+		"A set of key=value pairs that describe feature gates. Options are:",
+	}
+	for _, name := range g.Known() {
+		g.mtx.RLock()
+		spec := g.known[name]
+		g.mtx.RUnlock()
+		lines = append(
+			lines,
+			fmt.Sprintf("%s=true|false (%s - default=%t)", name, spec.Stage, spec.Default),
+		)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,86 @@
+package features
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGates(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		value    string
+		err      string
+		expected map[string]bool
+	}{
+		{
+			name:  "defaults",
+			value: "",
+			expected: map[string]bool{
+				"AlphaFeature": false,
+				"BetaFeature":  true,
+				"Unknown":      false,
+			},
+		},
+		{
+			name:  "enable alpha and disable beta",
+			value: "AlphaFeature=true, BetaFeature=false",
+			expected: map[string]bool{
+				"AlphaFeature": true,
+				"BetaFeature":  false,
+			},
+		},
+		{
+			name:  "unknown feature",
+			value: "AlphaFeature=true,Unknown=true",
+			err:   `unknown feature gate "Unknown"`,
+			expected: map[string]bool{
+				"AlphaFeature": false,
+			},
+		},
+		{
+			name:  "missing value",
+			value: "AlphaFeature",
+			err:   `missing bool value for feature "AlphaFeature"`,
+		},
+		{
+			name:  "invalid value",
+			value: "AlphaFeature=maybe",
+			err:   `invalid value for feature "AlphaFeature"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gates := New()
+			gates.Register("AlphaFeature", Spec{Stage: Alpha})
+			gates.Register("BetaFeature", Spec{Stage: Beta, Default: true})
+
+			err := gates.Set(tt.value)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+			}
+
+			for name, exp := range tt.expected {
+				if gates.Enabled(name) != exp {
+					t.Errorf("expected %s to be %v", name, exp)
+				}
+			}
+		})
+	}
+}
+
+func TestGatesString(t *testing.T) {
+	gates := New()
+	gates.Register("B", Spec{Stage: Alpha})
+	gates.Register("A", Spec{Stage: Beta, Default: true})
+	if err := gates.Set("B=true,A=false"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if gates.String() != "A=false,B=true" {
+		t.Errorf("unexpected string representation: %s", gates.String())
+	}
+}
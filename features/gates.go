@@ -0,0 +1,30 @@
+package features
+
+// These are the feature gates known by tagger. Every new experimental
+// subsystem should register its gate here.
+const (
+	// Mirroring allows Tags to be cached (mirrored) into the internal
+	// registry through spec.cache.
+	Mirroring = "Mirroring"
+	// PodReadinessGate adds, to pods of annotated Deployments, a readiness
+	// gate confirming they run the current generation of their Tags.
+	PodReadinessGate = "PodReadinessGate"
+	// InformerTransforms drops, from the pods, ReplicaSets and other core
+	// objects kept in memory, the fields tagger does not read.
+	InformerTransforms = "InformerTransforms"
+)
+
+// Default is the registry used by tagger binaries.
+var Default = New()
+
+func init() {
+	Default.Register(Mirroring, Spec{Default: true, Stage: Beta})
+	Default.Register(PodReadinessGate, Spec{Default: false, Stage: Alpha})
+	Default.Register(InformerTransforms, Spec{Default: true, Stage: Beta})
+}
+
+// Enabled returns true if the provided feature is enabled on the default
+// registry.
+func Enabled(name string) bool {
+	return Default.Enabled(name)
+}
@@ -6,12 +6,16 @@ require (
 	github.com/containers/image/v5 v5.6.0
 	github.com/hashicorp/go-multierror v1.1.0
 	github.com/mattbaird/jsonpatch v0.0.0-20200820163806-098863c1fc24
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.2-0.20190823105129-775207bd45b6
+	github.com/prometheus/client_golang v1.1.0
 	github.com/spf13/cobra v1.0.0
-	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 	gopkg.in/yaml.v2 v2.3.0
 	k8s.io/api v0.19.3
 	k8s.io/apimachinery v0.19.3
 	k8s.io/client-go v0.19.3
 	k8s.io/klog/v2 v2.3.0
 	k8s.io/utils v0.0.0-20201015054608-420da100c033
+	sigs.k8s.io/yaml v1.2.0
 )
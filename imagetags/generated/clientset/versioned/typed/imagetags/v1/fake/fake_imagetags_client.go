@@ -28,6 +28,14 @@ type FakeImagesV1 struct {
 	*testing.Fake
 }
 
+func (c *FakeImagesV1) ImportAudits(namespace string) v1.ImportAuditInterface {
+	return &FakeImportAudits{c, namespace}
+}
+
+func (c *FakeImagesV1) TagSets(namespace string) v1.TagSetInterface {
+	return &FakeTagSets{c, namespace}
+}
+
 func (c *FakeImagesV1) Tags(namespace string) v1.TagInterface {
 	return &FakeTags{c, namespace}
 }
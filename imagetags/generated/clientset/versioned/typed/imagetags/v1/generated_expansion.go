@@ -18,4 +18,8 @@ limitations under the License.
 
 package v1
 
+type ImportAuditExpansion interface{}
+
 type TagExpansion interface{}
+
+type TagSetExpansion interface{}
@@ -26,6 +26,8 @@ import (
 
 type ImagesV1Interface interface {
 	RESTClient() rest.Interface
+	ImportAuditsGetter
+	TagSetsGetter
 	TagsGetter
 }
 
@@ -34,6 +36,14 @@ type ImagesV1Client struct {
 	restClient rest.Interface
 }
 
+func (c *ImagesV1Client) ImportAudits(namespace string) ImportAuditInterface {
+	return newImportAudits(c, namespace)
+}
+
+func (c *ImagesV1Client) TagSets(namespace string) TagSetInterface {
+	return newTagSets(c, namespace)
+}
+
 func (c *ImagesV1Client) Tags(namespace string) TagInterface {
 	return newTags(c, namespace)
 }
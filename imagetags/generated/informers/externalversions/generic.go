@@ -55,6 +55,8 @@ func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource
 	// Group=images.io, Version=v1
 	case v1.SchemeGroupVersion.WithResource("tags"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Images().V1().Tags().Informer()}, nil
+	case v1.SchemeGroupVersion.WithResource("tagsets"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Images().V1().TagSets().Informer()}, nil
 
 	}
 
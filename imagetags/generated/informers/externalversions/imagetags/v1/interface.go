@@ -26,6 +26,8 @@ import (
 type Interface interface {
 	// Tags returns a TagInformer.
 	Tags() TagInformer
+	// TagSets returns a TagSetInformer.
+	TagSets() TagSetInformer
 }
 
 type version struct {
@@ -43,3 +45,8 @@ func New(f internalinterfaces.SharedInformerFactory, namespace string, tweakList
 func (v *version) Tags() TagInformer {
 	return &tagInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// TagSets returns a TagSetInformer.
+func (v *version) TagSets() TagSetInformer {
+	return &tagSetInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
+}
@@ -25,3 +25,11 @@ type TagListerExpansion interface{}
 // TagNamespaceListerExpansion allows custom methods to be added to
 // TagNamespaceLister.
 type TagNamespaceListerExpansion interface{}
+
+// TagSetListerExpansion allows custom methods to be added to
+// TagSetLister.
+type TagSetListerExpansion interface{}
+
+// TagSetNamespaceListerExpansion allows custom methods to be added to
+// TagSetNamespaceLister.
+type TagSetNamespaceListerExpansion interface{}
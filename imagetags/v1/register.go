@@ -39,6 +39,10 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		SchemeGroupVersion,
 		&Tag{},
 		&TagList{},
+		&ImportAudit{},
+		&ImportAuditList{},
+		&TagSet{},
+		&TagSetList{},
 	)
 
 	scheme.AddKnownTypes(
@@ -1,11 +1,169 @@
 package v1
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// These are the condition types set on Tag status.
+const (
+	// ConditionImported tells if the generation in spec has been imported.
+	ConditionImported = "Imported"
+	// ConditionPinned tells that the Tag points to an image by digest and
+	// never moves.
+	ConditionPinned = "Pinned"
+	// ConditionManifestConverted warns that the current generation uses a
+	// legacy manifest, converted during import if the Tag is cached.
+	ConditionManifestConverted = "ManifestConverted"
+	// ConditionRolledOut tells if the Deployments using the Tag are
+	// running the current generation.
+	ConditionRolledOut = "RolledOut"
+	// ConditionReady tells if the generation in spec has been imported, and
+	// verified, and is the current generation. Meant for `kubectl wait`.
+	ConditionReady = "Ready"
+	// ConditionVerified tells if the current generation stayed healthy
+	// for the promotion policy verify window. Meant for pipelines chaining
+	// promotions across environments.
+	ConditionVerified = "Verified"
+	// ConditionThrottled tells that the import of the Tag has been held
+	// back because the operator is close to its resource limits or by the
+	// import schedule.
+	ConditionThrottled = "Throttled"
+	// ConditionRetagged tells if the retag of the latest imported
+	// generation has been pushed to the registry it was imported from.
+	ConditionRetagged = "Retagged"
+	// ConditionSunset tells if the sunset of a deprecated Tag has passed.
+	ConditionSunset = "Sunset"
+)
+
+// These are the reasons used for Tag conditions.
+const (
+	ReasonImported            = "Imported"
+	ReasonImportFailed        = "ImportFailed"
+	ReasonSchema1Converted    = "Schema1Converted"
+	ReasonSchema1NotConverted = "Schema1NotConverted"
+	ReasonDigestReference     = "DigestReference"
+	ReasonRolloutComplete     = "RolloutComplete"
+	ReasonRolloutInProgress   = "RolloutInProgress"
+	ReasonRolloutFailed       = "RolloutFailed"
+	ReasonImportPending       = "ImportPending"
+	ReasonPromotionPending    = "PromotionPending"
+	ReasonGenerationReady     = "GenerationReady"
+	ReasonVerifying           = "Verifying"
+	ReasonVerified            = "Verified"
+	ReasonVerificationFailed  = "VerificationFailed"
+	ReasonMemoryPressure      = "MemoryPressure"
+	ReasonFilePressure        = "FilePressure"
+	ReasonBlackout            = "Blackout"
+	ReasonImportBudget        = "ImportBudget"
+	ReasonHookFailed          = "HookFailed"
+	ReasonRetagged            = "Retagged"
+	ReasonRetagFailed         = "RetagFailed"
+	ReasonSunsetPending       = "SunsetPending"
+	ReasonSunsetPassed        = "SunsetPassed"
+)
+
+// These are the reasons used for the TagSet Ready condition.
+const (
+	ReasonTagNotFound      = "TagNotFound"
+	ReasonRevisionPromoted = "RevisionPromoted"
+	ReasonRolledBack       = "RolledBack"
+	ReasonRollbackFailed   = "RollbackFailed"
+)
+
+// These are the phases of a Deployment rollout.
+const (
+	RolloutProgressing = "Progressing"
+	RolloutComplete    = "Complete"
+	RolloutFailed      = "Failed"
+)
+
+// These are the phases of a generation promotion. A generation is pending
+// while it soaks and active once promoted to the current generation. If the
+// promotion policy has a verify window an active generation later becomes
+// succeeded, if it stayed healthy for the window, or failed.
+const (
+	PromotionPending   = "Pending"
+	PromotionActive    = "Active"
+	PromotionSucceeded = "Succeeded"
+	PromotionFailed    = "Failed"
+)
+
+// These are the import hooks, see ImportHooks.
+const (
+	HookPreImport  = "PreImport"
+	HookPostImport = "PostImport"
+)
+
+// These are the phases of an import hook Job.
+const (
+	HookRunning   = "Running"
+	HookSucceeded = "Succeeded"
+	HookFailed    = "Failed"
+)
+
+// These are the health statuses of a Tag, named after the Argo CD health
+// statuses so a custom health check only has to copy them.
+const (
+	HealthHealthy     = "Healthy"
+	HealthProgressing = "Progressing"
+	HealthDegraded    = "Degraded"
+	HealthSuspended   = "Suspended"
+)
+
+// ImportTriggerAnnotation records, on a Tag, what requested the import of
+// the generation in spec. Its value is "<trigger>:<generation>" so edits to
+// the spec made afterwards are not attributed to the same trigger.
+const ImportTriggerAnnotation = "image-tag-import-trigger"
+
+// These are the sources that trigger Tag imports, recorded on ImportAudits.
+const (
+	// ImportTriggerSpec means the Tag has been created or its spec edited.
+	ImportTriggerSpec = "Spec"
+	// ImportTriggerWebhook means a registry reported a push through a
+	// webhook.
+	ImportTriggerWebhook = "Webhook"
+	// ImportTriggerRequest means a new generation has been requested
+	// through the API or the kubectl plugin.
+	ImportTriggerRequest = "Request"
+)
+
+// These are the sources a Resolution may be based on, from the most to the
+// least accurate. The timeline records when each generation became the
+// current one, import audits and generations only when they were imported.
+const (
+	ResolutionSourceTimeline    = "Timeline"
+	ResolutionSourceImportAudit = "ImportAudit"
+	ResolutionSourceGeneration  = "Generation"
+)
+
+// These are the results of the checks of an import simulation. Checks that
+// could not be evaluated because an earlier check failed are skipped.
+const (
+	SimulationPassed  = "Passed"
+	SimulationFailed  = "Failed"
+	SimulationSkipped = "Skipped"
+)
+
+// MaxTimelineEntries is how many changes of the current generation are kept
+// in the Tag timeline.
+const MaxTimelineEntries = 50
+
+// schema1MediaTypes are the legacy docker schema1 manifest media types.
+var schema1MediaTypes = map[string]bool{
+	"application/vnd.docker.distribution.manifest.v1+json":      true,
+	"application/vnd.docker.distribution.manifest.v1+prettyjws": true,
+}
+
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
@@ -24,13 +182,166 @@ type Tag struct {
 // if this generation does not exist then we haven't imported it yet,
 // return an empty string instead.
 func (t *Tag) CurrentReferenceForTag() string {
+	hashref, ok := t.CurrentHashReference()
+	if !ok {
+		return ""
+	}
+	return hashref.ImageReference
+}
+
+// CurrentHashReference returns the reference for the current generation. The
+// boolean is false if the current generation has not been imported yet.
+func (t *Tag) CurrentHashReference() (HashReference, bool) {
 	for _, hashref := range t.Status.References {
 		if hashref.Generation != t.Status.Generation {
 			continue
 		}
-		return hashref.ImageReference
+		return hashref, true
 	}
-	return ""
+	return HashReference{}, false
+}
+
+// CurrentReferenceIsArtifact returns true if the current generation points to
+// an OCI artifact (e.g. a helm chart) instead of a container image. Artifacts
+// can't be used as images by pods.
+func (t *Tag) CurrentReferenceIsArtifact() bool {
+	hashref, ok := t.CurrentHashReference()
+	return ok && hashref.ArtifactType != ""
+}
+
+// PinnedDigest returns the digest the Tag is pinned to, i.e. when spec.from is
+// a digest reference such as "repo@sha256:...". Returns an empty string if the
+// Tag is not pinned.
+func (t *Tag) PinnedDigest() string {
+	idx := strings.LastIndex(t.Spec.From, "@")
+	if idx < 0 {
+		return ""
+	}
+	return t.Spec.From[idx+1:]
+}
+
+// ValidateImageSelector checks if the image selector, if any, is valid. Tags
+// pinned to a digest can't select their upstream tag.
+func (t *Tag) ValidateImageSelector() error {
+	if t.Spec.ImageSelector == nil {
+		return nil
+	}
+	if t.PinnedDigest() != "" {
+		return fmt.Errorf("image selector can't be used with a digest reference")
+	}
+	if _, err := metav1.LabelSelectorAsSelector(t.Spec.ImageSelector); err != nil {
+		return fmt.Errorf("invalid image selector: %w", err)
+	}
+	return nil
+}
+
+// retagPattern matches valid registry tags.
+var retagPattern = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// ValidateRetag checks if the retag, if any, is a valid registry tag. Tags
+// can't retag the upstream tag they import, it would be overwritten.
+func (t *Tag) ValidateRetag() error {
+	if t.Spec.Retag == "" {
+		return nil
+	}
+	if !retagPattern.MatchString(t.Spec.Retag) {
+		return fmt.Errorf("invalid retag %q", t.Spec.Retag)
+	}
+	if t.PinnedDigest() != "" || t.Spec.ImageSelector != nil {
+		return nil
+	}
+
+	upstream := "latest"
+	name := t.Spec.From[strings.LastIndex(t.Spec.From, "/")+1:]
+	if idx := strings.LastIndex(name, ":"); idx >= 0 {
+		upstream = name[idx+1:]
+	}
+	if upstream == t.Spec.Retag {
+		return fmt.Errorf("retag can't be the imported tag %q", upstream)
+	}
+	return nil
+}
+
+// ValidateDeprecation checks if a deprecated Tag tells why it is deprecated.
+func (t *Tag) ValidateDeprecation() error {
+	if t.Spec.Deprecation == nil {
+		return nil
+	}
+	if strings.TrimSpace(t.Spec.Deprecation.Message) == "" {
+		return fmt.Errorf("deprecation message must be provided")
+	}
+	return nil
+}
+
+// DeprecationWarning returns the warning for pods resolving the Tag at the
+// provided time, empty if the Tag is not deprecated.
+func (t *Tag) DeprecationWarning(now time.Time) string {
+	dep := t.Spec.Deprecation
+	if dep == nil {
+		return ""
+	}
+	warning := fmt.Sprintf("tag %s/%s is deprecated: %s", t.Namespace, t.Name, dep.Message)
+	if dep.Sunset == nil {
+		return warning
+	}
+	sunset := dep.Sunset.UTC().Format(time.RFC3339)
+	if now.Before(dep.Sunset.Time) {
+		return fmt.Sprintf("%s (sunset on %s)", warning, sunset)
+	}
+	return fmt.Sprintf("%s (sunset since %s)", warning, sunset)
+}
+
+// RegisterSunset sets the Sunset condition of Tags deprecated with a sunset,
+// true once the sunset has passed. The condition is removed from other Tags.
+// Returns false if nothing has changed.
+func (t *Tag) RegisterSunset(now time.Time) bool {
+	dep := t.Spec.Deprecation
+	if dep == nil || dep.Sunset == nil {
+		if meta.FindStatusCondition(t.Status.Conditions, ConditionSunset) == nil {
+			return false
+		}
+		meta.RemoveStatusCondition(&t.Status.Conditions, ConditionSunset)
+		return true
+	}
+
+	orig := meta.FindStatusCondition(t.Status.Conditions, ConditionSunset)
+	var prev metav1.Condition
+	if orig != nil {
+		prev = *orig
+	}
+
+	sunset := dep.Sunset.UTC().Format(time.RFC3339)
+	if now.Before(dep.Sunset.Time) {
+		t.SetCondition(
+			ConditionSunset,
+			metav1.ConditionFalse,
+			ReasonSunsetPending,
+			fmt.Sprintf("sunset on %s", sunset),
+		)
+	} else {
+		t.SetCondition(
+			ConditionSunset,
+			metav1.ConditionTrue,
+			ReasonSunsetPassed,
+			fmt.Sprintf("sunset since %s: %s", sunset, dep.Message),
+		)
+	}
+	current := meta.FindStatusCondition(t.Status.Conditions, ConditionSunset)
+	return orig == nil || prev.Status != current.Status || prev.Message != current.Message
+}
+
+// PinnedDigestImported returns true if the Tag is pinned to a digest and this
+// digest has already been imported in any generation.
+func (t *Tag) PinnedDigestImported() bool {
+	if t.PinnedDigest() == "" {
+		return false
+	}
+	for _, ref := range t.Status.References {
+		if ref.From == t.Spec.From {
+			return true
+		}
+	}
+	return false
 }
 
 // SpecTagImported returs true if tag generation defined on spec has
@@ -77,38 +388,899 @@ func (t *Tag) PrependHashReference(ref HashReference) {
 	t.Status.References = newRefs
 }
 
+// SetCondition sets a condition in Tag status. Last transition time is only
+// updated if the condition status changes.
+func (t *Tag) SetCondition(ctype string, status metav1.ConditionStatus, reason, msg string) {
+	meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+		Type:               ctype,
+		Status:             status,
+		ObservedGeneration: t.Generation,
+		Reason:             reason,
+		Message:            msg,
+	})
+}
+
 // RegisterImportFailure updates the last import attempt struct in Tag status, setting
-// it as not succeeded and with the proper error message.
+// it as not succeeded and with the proper error message. If err implements a Reason()
+// method its return is used as reason for the Imported condition.
 func (t *Tag) RegisterImportFailure(err error) {
 	t.Status.LastImportAttempt = ImportAttempt{
 		When:    metav1.Now(),
 		Succeed: false,
 		Reason:  err.Error(),
 	}
+
+	reason := ReasonImportFailed
+	var rerr interface{ Reason() string }
+	if errors.As(err, &rerr) {
+		reason = rerr.Reason()
+	}
+	t.SetCondition(ConditionImported, metav1.ConditionFalse, reason, err.Error())
+}
+
+// RegisterManifestConversion sets the ManifestConverted condition according to
+// the imported reference. If the reference was converted from schema1 the
+// condition is set to true, if it still is a schema1 (not cached Tags) it is
+// set to false. For any other media type the condition is removed.
+func (t *Tag) RegisterManifestConversion(ref HashReference) {
+	switch {
+	case schema1MediaTypes[ref.ConvertedFrom]:
+		t.SetCondition(
+			ConditionManifestConverted,
+			metav1.ConditionTrue,
+			ReasonSchema1Converted,
+			fmt.Sprintf("schema1 manifest converted to %s", ref.MediaType),
+		)
+	case schema1MediaTypes[ref.MediaType]:
+		t.SetCondition(
+			ConditionManifestConverted,
+			metav1.ConditionFalse,
+			ReasonSchema1NotConverted,
+			"deprecated schema1 manifest, enable cache to convert it",
+		)
+	default:
+		meta.RemoveStatusCondition(&t.Status.Conditions, ConditionManifestConverted)
+	}
+}
+
+// RegisterRetag sets the Retagged condition according to the imported
+// reference. The condition is removed for Tags not asking for a retag.
+func (t *Tag) RegisterRetag(ref HashReference) {
+	switch {
+	case ref.RetagFailure != "":
+		t.SetCondition(
+			ConditionRetagged, metav1.ConditionFalse, ReasonRetagFailed, ref.RetagFailure,
+		)
+	case ref.Retagged != "":
+		t.SetCondition(
+			ConditionRetagged,
+			metav1.ConditionTrue,
+			ReasonRetagged,
+			fmt.Sprintf("generation %d pushed as %s", ref.Generation, ref.Retagged),
+		)
+	case meta.FindStatusCondition(t.Status.Conditions, ConditionRetagged) != nil:
+		meta.RemoveStatusCondition(&t.Status.Conditions, ConditionRetagged)
+	}
+}
+
+// RegisterRollout records the rollout state for a Deployment. Rollouts for
+// generations other than the current one are dropped and the RolledOut
+// condition is updated. The start time of an already registered rollout is
+// kept. Returns false if nothing has changed.
+func (t *Tag) RegisterRollout(rollout Rollout) bool {
+	if rollout.Generation != t.Status.Generation {
+		return false
+	}
+
+	changed := false
+	found := false
+	var rollouts []Rollout
+	for _, cur := range t.Status.Rollouts {
+		if cur.Generation != t.Status.Generation {
+			changed = true
+			continue
+		}
+
+		if cur.Deployment != rollout.Deployment {
+			rollouts = append(rollouts, cur)
+			continue
+		}
+
+		found = true
+		rollout.StartedAt = cur.StartedAt
+		if cur.Phase == rollout.Phase &&
+			cur.Reason == rollout.Reason &&
+			cur.Message == rollout.Message &&
+			cur.Restarts == rollout.Restarts &&
+			cur.ReplicaSet == rollout.ReplicaSet {
+			rollouts = append(rollouts, cur)
+			continue
+		}
+		changed = true
+		rollouts = append(rollouts, rollout)
+	}
+	if !found {
+		changed = true
+		if rollout.StartedAt.IsZero() {
+			rollout.StartedAt = rollout.UpdatedAt
+		}
+		rollouts = append(rollouts, rollout)
+	}
+	if !changed {
+		return false
+	}
+
+	sort.Slice(rollouts, func(i, j int) bool {
+		return rollouts[i].Deployment < rollouts[j].Deployment
+	})
+	t.Status.Rollouts = rollouts
+	t.setRolloutCondition()
+	return true
+}
+
+// RolloutStartedAt returns when the rollout of the current generation started
+// on the provided Deployment. Returns the zero time if it is not known.
+func (t *Tag) RolloutStartedAt(deployment string) metav1.Time {
+	for _, rollout := range t.Status.Rollouts {
+		if rollout.Deployment != deployment {
+			continue
+		}
+		if rollout.Generation != t.Status.Generation {
+			continue
+		}
+		return rollout.StartedAt
+	}
+	return metav1.Time{}
+}
+
+// PreviousGeneration returns the latest imported generation older than the
+// current one. Returns false if the current generation is not the latest
+// imported one or if there is no older generation, i.e. we only roll back
+// from the latest generation and never further than one generation.
+func (t *Tag) PreviousGeneration() (int64, bool) {
+	if len(t.Status.References) < 2 {
+		return 0, false
+	}
+	if t.Status.References[0].Generation != t.Status.Generation {
+		return 0, false
+	}
+	return t.Status.References[1].Generation, true
+}
+
+// GenerationHistory returns the generations kept by the Tag, newest first.
+func (t *Tag) GenerationHistory() *GenerationHistory {
+	history := &GenerationHistory{
+		Namespace:   t.Namespace,
+		Name:        t.Name,
+		Generation:  t.Status.Generation,
+		Generations: []GenerationRecord{},
+	}
+	for _, hashref := range t.Status.References {
+		history.Generations = append(
+			history.Generations,
+			GenerationRecord{
+				Generation:     hashref.Generation,
+				Current:        hashref.Generation == t.Status.Generation,
+				ImageReference: hashref.ImageReference,
+				Digest:         hashref.Digest(),
+				ImportedAt:     hashref.ImportedAt,
+				Trigger:        hashref.Trigger,
+				Rollout:        hashref.Rollout,
+				Signature:      hashref.Signature,
+			},
+		)
+	}
+	return history
+}
+
+// setRolloutCondition sets the RolledOut condition based on the rollouts. Any
+// failed rollout makes the condition false, otherwise it is unknown while any
+// rollout is still progressing. The outcome is also recorded in the current
+// generation so it is kept once another generation rolls out.
+func (t *Tag) setRolloutCondition() {
+	var failed, progressing []string
+	for _, rollout := range t.Status.Rollouts {
+		switch rollout.Phase {
+		case RolloutFailed:
+			failed = append(
+				failed, fmt.Sprintf("%s: %s", rollout.Deployment, rollout.Message),
+			)
+		case RolloutProgressing:
+			progressing = append(progressing, rollout.Deployment)
+		}
+	}
+
+	phase := RolloutComplete
+	switch {
+	case len(failed) > 0:
+		phase = RolloutFailed
+		t.SetCondition(
+			ConditionRolledOut,
+			metav1.ConditionFalse,
+			ReasonRolloutFailed,
+			strings.Join(failed, "; "),
+		)
+	case len(progressing) > 0:
+		phase = RolloutProgressing
+		t.SetCondition(
+			ConditionRolledOut,
+			metav1.ConditionUnknown,
+			ReasonRolloutInProgress,
+			fmt.Sprintf("waiting for %s", strings.Join(progressing, ", ")),
+		)
+	default:
+		t.SetCondition(
+			ConditionRolledOut,
+			metav1.ConditionTrue,
+			ReasonRolloutComplete,
+			fmt.Sprintf("generation %d running", t.Status.Generation),
+		)
+	}
+
+	for i := range t.Status.References {
+		if t.Status.References[i].Generation == t.Status.Generation {
+			t.Status.References[i].Rollout = phase
+		}
+	}
+}
+
+// RegisterReadiness sets the Ready condition. A Tag is ready once the
+// generation in spec has been imported, what includes verifying its digests,
+// and promoted to the current generation. Returns false if nothing changed.
+//
+// Tags have no status subresource so every status update bumps the object
+// generation. As `kubectl wait` ignores conditions observed for an older
+// generation the Ready condition carries no observed generation, it always
+// refers to the generation in spec.
+func (t *Tag) RegisterReadiness() bool {
+	cond := metav1.Condition{
+		Type:    ConditionReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  ReasonImportPending,
+		Message: fmt.Sprintf("generation %d not imported yet", t.Spec.Generation),
+	}
+
+	imported := meta.FindStatusCondition(t.Status.Conditions, ConditionImported)
+	switch {
+	case !t.SpecTagImported():
+		if imported != nil && imported.Status == metav1.ConditionFalse {
+			cond.Reason = imported.Reason
+			cond.Message = imported.Message
+		}
+	case t.Status.Generation != t.Spec.Generation:
+		cond.Reason = ReasonPromotionPending
+		cond.Message = fmt.Sprintf(
+			"generation %d waiting for promotion", t.Spec.Generation,
+		)
+	default:
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = ReasonGenerationReady
+		cond.Message = fmt.Sprintf(
+			"generation %d imported and verified", t.Spec.Generation,
+		)
+	}
+
+	cur := meta.FindStatusCondition(t.Status.Conditions, ConditionReady)
+	if cur != nil &&
+		cur.Status == cond.Status &&
+		cur.Reason == cond.Reason &&
+		cur.Message == cond.Message &&
+		cur.ObservedGeneration == 0 {
+		return false
+	}
+	meta.SetStatusCondition(&t.Status.Conditions, cond)
+	return true
+}
+
+// HookRun returns the latest run of the provided import hook. The boolean is
+// false if the hook never ran.
+func (t *Tag) HookRun(hook string) (HookRun, bool) {
+	for _, run := range t.Status.Hooks {
+		if run.Hook == hook {
+			return run, true
+		}
+	}
+	return HookRun{}, false
+}
+
+// RegisterHookRun records the state of an import hook run, replacing the
+// previous run of the same hook. Returns false if nothing has changed.
+func (t *Tag) RegisterHookRun(run HookRun) bool {
+	for i, cur := range t.Status.Hooks {
+		if cur.Hook != run.Hook {
+			continue
+		}
+		if cur == run {
+			return false
+		}
+		t.Status.Hooks[i] = run
+		return true
+	}
+	t.Status.Hooks = append(t.Status.Hooks, run)
+	return true
+}
+
+// SpecHashReference returns the reference for the generation in spec. The
+// boolean is false if the generation has not been imported yet.
+func (t *Tag) SpecHashReference() (HashReference, bool) {
+	for _, hashref := range t.Status.References {
+		if hashref.Generation != t.Spec.Generation {
+			continue
+		}
+		return hashref, true
+	}
+	return HashReference{}, false
+}
+
+// RegisterPromotionPending records that the generation in spec is soaking
+// since the provided time, a nil since means the soak has not started yet.
+// Returns false if nothing has changed.
+func (t *Tag) RegisterPromotionPending(since *metav1.Time, msg string) bool {
+	promotion := &Promotion{
+		Generation:   t.Spec.Generation,
+		Phase:        PromotionPending,
+		SoakingSince: since,
+		Message:      msg,
+	}
+	if reflect.DeepEqual(t.Status.Promotion, promotion) {
+		return false
+	}
+	t.Status.Promotion = promotion
+	return true
+}
+
+// RegisterPromotion moves the generation in spec to active, making it the
+// current generation. Promotion state is only kept for Tags with a promotion
+// policy.
+func (t *Tag) RegisterPromotion() {
+	t.recordTimeline()
+	t.Status.Generation = t.Spec.Generation
+	verified := meta.FindStatusCondition(t.Status.Conditions, ConditionVerified)
+	if verified != nil &&
+		(t.Spec.Promotion == nil || t.Spec.Promotion.VerifyWindow.Duration == 0) {
+		meta.RemoveStatusCondition(&t.Status.Conditions, ConditionVerified)
+	}
+	if t.Spec.Promotion == nil {
+		t.Status.Promotion = nil
+		return
+	}
+
+	promotion := &Promotion{
+		Generation: t.Spec.Generation,
+		Phase:      PromotionActive,
+		PromotedAt: &metav1.Time{Time: metav1.Now().Rfc3339Copy().Time},
+	}
+	if cur := t.Status.Promotion; cur != nil && cur.Generation == t.Spec.Generation {
+		promotion.SoakingSince = cur.SoakingSince
+		if cur.Phase == PromotionActive {
+			promotion.PromotedAt = cur.PromotedAt
+		}
+	}
+	t.Status.Promotion = promotion
+
+	if t.Spec.Promotion.VerifyWindow.Duration > 0 {
+		meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+			Type:    ConditionVerified,
+			Status:  metav1.ConditionUnknown,
+			Reason:  ReasonVerifying,
+			Message: fmt.Sprintf("generation %d: promoted", t.Spec.Generation),
+		})
+	}
+}
+
+// recordTimeline adds the generation in spec to the timeline, unless it is
+// already the latest entry. The timeline is trimmed to MaxTimelineEntries.
+func (t *Tag) recordTimeline() {
+	hashref, ok := t.SpecHashReference()
+	if !ok {
+		return
+	}
+	if len(t.Status.Timeline) > 0 && t.Status.Timeline[0].Generation == hashref.Generation {
+		return
+	}
+
+	entry := TimelineEntry{
+		Generation:     hashref.Generation,
+		ImageReference: hashref.ImageReference,
+		Since:          metav1.Time{Time: metav1.Now().Rfc3339Copy().Time},
+	}
+	timeline := append([]TimelineEntry{entry}, t.Status.Timeline...)
+	if len(timeline) > MaxTimelineEntries {
+		timeline = timeline[:MaxTimelineEntries]
+	}
+	t.Status.Timeline = timeline
+}
+
+// Verifying returns true if the current generation has been promoted and
+// is within, or waiting for the end of, the promotion policy verify window.
+func (t *Tag) Verifying() bool {
+	policy, promotion := t.Spec.Promotion, t.Status.Promotion
+	if policy == nil || policy.VerifyWindow.Duration == 0 || promotion == nil {
+		return false
+	}
+	return promotion.Phase == PromotionActive &&
+		promotion.Generation == t.Status.Generation &&
+		promotion.PromotedAt != nil
+}
+
+// RegisterVerification evaluates the health of the current generation during
+// the promotion policy verify window. The promotion fails as soon as one of
+// its rollouts fails or the restarts exceed the policy budget, it succeeds
+// once the window has elapsed and no rollout is still progressing. The
+// Verified condition reflects the result and, like the Ready condition, carries
+// no observed generation. Returns false if nothing has changed.
+func (t *Tag) RegisterVerification(now time.Time) bool {
+	if !t.Verifying() {
+		return false
+	}
+	policy, promotion := t.Spec.Promotion, *t.Status.Promotion
+
+	var restarts int32
+	var failed, progressing []string
+	for _, rollout := range t.Status.Rollouts {
+		if rollout.Generation != t.Status.Generation {
+			continue
+		}
+		restarts += rollout.Restarts
+		switch rollout.Phase {
+		case RolloutFailed:
+			failed = append(
+				failed, fmt.Sprintf("%s: %s", rollout.Deployment, rollout.Message),
+			)
+		case RolloutProgressing:
+			progressing = append(progressing, rollout.Deployment)
+		}
+	}
+
+	until := promotion.PromotedAt.Add(policy.VerifyWindow.Duration)
+	cond := metav1.Condition{
+		Type:   ConditionVerified,
+		Status: metav1.ConditionUnknown,
+		Reason: ReasonVerifying,
+	}
+	switch {
+	case len(failed) > 0:
+		promotion.Phase = PromotionFailed
+		promotion.Message = fmt.Sprintf("rollout failed: %s", strings.Join(failed, "; "))
+	case policy.MaxRestarts > 0 && restarts > policy.MaxRestarts:
+		promotion.Phase = PromotionFailed
+		promotion.Message = fmt.Sprintf(
+			"%d restarts exceed the budget of %d", restarts, policy.MaxRestarts,
+		)
+	case now.Before(until):
+		promotion.Message = fmt.Sprintf(
+			"verifying until %s", until.UTC().Format(time.RFC3339),
+		)
+	case len(progressing) > 0:
+		promotion.Message = fmt.Sprintf(
+			"waiting for %s to roll out", strings.Join(progressing, ", "),
+		)
+	default:
+		promotion.Phase = PromotionSucceeded
+		promotion.VerifiedAt = &metav1.Time{Time: metav1.NewTime(now).Rfc3339Copy().Time}
+		promotion.Message = fmt.Sprintf("healthy for %s", policy.VerifyWindow.Duration)
+	}
+
+	switch promotion.Phase {
+	case PromotionFailed:
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = ReasonVerificationFailed
+	case PromotionSucceeded:
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = ReasonVerified
+	}
+	cond.Message = fmt.Sprintf("generation %d: %s", promotion.Generation, promotion.Message)
+
+	if reflect.DeepEqual(*t.Status.Promotion, promotion) {
+		return false
+	}
+	t.Status.Promotion = &promotion
+	meta.SetStatusCondition(&t.Status.Conditions, cond)
+	return true
+}
+
+// RegisterKnownGood records the current generation as the last known good
+// one once it has rolled out on every Deployment using the Tag. Generations
+// subject to a promotion verify window must also pass the verification.
+// Returns false if nothing has changed.
+func (t *Tag) RegisterKnownGood(now time.Time) bool {
+	hashref, ok := t.CurrentHashReference()
+	if !ok {
+		return false
+	}
+	if lkg := t.Status.LastKnownGood; lkg != nil && lkg.Generation == hashref.Generation {
+		return false
+	}
+
+	rollouts := 0
+	for _, rollout := range t.Status.Rollouts {
+		if rollout.Generation != hashref.Generation {
+			continue
+		}
+		if rollout.Phase != RolloutComplete {
+			return false
+		}
+		rollouts++
+	}
+	if rollouts == 0 {
+		return false
+	}
+
+	policy, promotion := t.Spec.Promotion, t.Status.Promotion
+	if policy != nil && policy.VerifyWindow.Duration > 0 &&
+		promotion != nil && promotion.Generation == hashref.Generation &&
+		promotion.Phase != PromotionSucceeded {
+		return false
+	}
+
+	t.Status.LastKnownGood = &KnownGood{
+		Generation:     hashref.Generation,
+		ImageReference: hashref.ImageReference,
+		MarkedAt:       metav1.NewTime(now).Rfc3339Copy(),
+	}
+	return true
+}
+
+// KnownGoodImported returns true if the last known good generation is still
+// among the imported references, i.e. the Tag can be moved back to it.
+func (t *Tag) KnownGoodImported() bool {
+	lkg := t.Status.LastKnownGood
+	if lkg == nil {
+		return false
+	}
+	for _, hashref := range t.Status.References {
+		if hashref.Generation == lkg.Generation {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterStorageUsage summarizes the blobs of all generations in the Tag
+// status. Blobs referred by more than one generation are shared, they are
+// stored only once. Storage usage is removed if no generation has blobs.
+// Returns true if the storage usage has changed.
+func (t *Tag) RegisterStorageUsage() bool {
+	var usage StorageUsage
+	refs := map[string]int{}
+	for _, hashref := range t.Status.References {
+		for _, blob := range hashref.Blobs {
+			usage.ReferencedBytes += blob.Size
+			refs[blob.Digest]++
+			if refs[blob.Digest] > 1 {
+				continue
+			}
+			usage.Blobs++
+			usage.StoredBytes += blob.Size
+		}
+	}
+	for _, count := range refs {
+		if count > 1 {
+			usage.SharedBlobs++
+		}
+	}
+
+	if usage.Blobs == 0 {
+		changed := t.Status.Storage != nil
+		t.Status.Storage = nil
+		return changed
+	}
+	if t.Status.Storage != nil && *t.Status.Storage == usage {
+		return false
+	}
+	t.Status.Storage = &usage
+	return true
+}
+
+// RegisterHealth summarizes the Tag state in its health. Disabled Tags are
+// suspended. A Tag is degraded if the generation in spec failed to import or
+// if the current generation failed to roll out, or failed its verification,
+// and progressing while the generation in spec is imported, promoted, rolled
+// out and verified. Otherwise the Tag is healthy. Returns false if nothing
+// has changed.
+func (t *Tag) RegisterHealth() bool {
+	var failed, progressing []string
+	for _, rollout := range t.Status.Rollouts {
+		if rollout.Generation != t.Status.Generation {
+			continue
+		}
+		switch rollout.Phase {
+		case RolloutFailed:
+			failed = append(
+				failed, fmt.Sprintf("%s: %s", rollout.Deployment, rollout.Message),
+			)
+		case RolloutProgressing:
+			progressing = append(progressing, rollout.Deployment)
+		}
+	}
+
+	imported := meta.FindStatusCondition(t.Status.Conditions, ConditionImported)
+	promotion := t.Status.Promotion
+	health := Health{Status: HealthHealthy}
+	switch {
+	case t.Spec.Disabled:
+		health.Status = HealthSuspended
+		health.Message = "tag disabled"
+	case !t.SpecTagImported() && imported != nil &&
+		imported.Status == metav1.ConditionFalse:
+		health.Status = HealthDegraded
+		health.Message = fmt.Sprintf(
+			"generation %d import failed: %s", t.Spec.Generation, imported.Message,
+		)
+	case promotion != nil && promotion.Phase == PromotionFailed &&
+		promotion.Generation == t.Status.Generation:
+		health.Status = HealthDegraded
+		health.Message = fmt.Sprintf(
+			"generation %d verification failed: %s", promotion.Generation, promotion.Message,
+		)
+	case len(failed) > 0:
+		health.Status = HealthDegraded
+		health.Message = fmt.Sprintf(
+			"generation %d rollout failed: %s", t.Status.Generation, strings.Join(failed, "; "),
+		)
+	case !t.SpecTagImported():
+		health.Status = HealthProgressing
+		health.Message = fmt.Sprintf("generation %d not imported yet", t.Spec.Generation)
+	case t.Status.Generation != t.Spec.Generation:
+		health.Status = HealthProgressing
+		health.Message = fmt.Sprintf("generation %d waiting for promotion", t.Spec.Generation)
+	case len(progressing) > 0:
+		health.Status = HealthProgressing
+		health.Message = fmt.Sprintf(
+			"generation %d rolling out: waiting for %s",
+			t.Status.Generation, strings.Join(progressing, ", "),
+		)
+	case t.Verifying():
+		health.Status = HealthProgressing
+		health.Message = fmt.Sprintf("generation %d being verified", t.Status.Generation)
+	default:
+		health.Message = fmt.Sprintf("generation %d running", t.Status.Generation)
+	}
+
+	if t.Status.Health != nil && *t.Status.Health == health {
+		return false
+	}
+	t.Status.Health = &health
+	return true
 }
 
 // RegisterImportSuccess updates the last import attempt struct in Tag status, setting
-// it as succeeded.
+// it as succeeded. Uploads and copy progress are cleared as there is nothing pending.
 func (t *Tag) RegisterImportSuccess() {
 	t.Status.LastImportAttempt = ImportAttempt{
 		When:    metav1.Now(),
 		Succeed: true,
 	}
+	t.Status.Uploads = nil
+	t.Status.Progress = nil
+	t.SetCondition(
+		ConditionImported,
+		metav1.ConditionTrue,
+		ReasonImported,
+		fmt.Sprintf("generation %d imported", t.Spec.Generation),
+	)
+
+	if dgst := t.PinnedDigest(); dgst != "" {
+		t.SetCondition(
+			ConditionPinned,
+			metav1.ConditionTrue,
+			ReasonDigestReference,
+			fmt.Sprintf("pinned to %s", dgst),
+		)
+		return
+	}
+	meta.RemoveStatusCondition(&t.Status.Conditions, ConditionPinned)
+}
+
+// ExpectedImportBytes returns the size of the image about to be imported, zero
+// if unknown. The size is read from the progress of a previous, interrupted,
+// attempt or, failing that, from the blobs mirrored for the last generation.
+func (t *Tag) ExpectedImportBytes() int64 {
+	if t.Status.Progress != nil && t.Status.Progress.BytesTotal > 0 {
+		return t.Status.Progress.BytesTotal
+	}
+	if len(t.Status.References) == 0 {
+		return 0
+	}
+	var size int64
+	for _, blob := range t.Status.References[0].Blobs {
+		size += blob.Size
+	}
+	return size
+}
+
+// SetImportTrigger records trigger as the source of the import of the
+// generation in spec.
+func (t *Tag) SetImportTrigger(trigger string) {
+	if t.Annotations == nil {
+		t.Annotations = map[string]string{}
+	}
+	t.Annotations[ImportTriggerAnnotation] = fmt.Sprintf(
+		"%s:%d", trigger, t.Spec.Generation,
+	)
+}
+
+// ImportTrigger returns what triggered the import of the generation in spec.
+// Without a trigger recorded for the generation ImportTriggerSpec is returned.
+func (t *Tag) ImportTrigger() string {
+	value := t.Annotations[ImportTriggerAnnotation]
+	idx := strings.LastIndex(value, ":")
+	if idx < 0 || value[idx+1:] != fmt.Sprint(t.Spec.Generation) {
+		return ImportTriggerSpec
+	}
+	return value[:idx]
 }
 
 // TagSpec represents the user intention with regards to tagging
 // remote images.
 type TagSpec struct {
-	From       string `json:"from"`
-	Cache      bool   `json:"cache"`
+	From         string `json:"from"`
+	Cache        bool   `json:"cache"`
+	Generation   int64  `json:"generation"`
+	AutoRollback bool   `json:"autoRollback,omitempty"`
+	// Promotion, if set, delays new generations from becoming the
+	// current generation until they have soaked.
+	Promotion *PromotionPolicy `json:"promotion,omitempty"`
+	// ImageSelector, if set, selects the upstream tag to import among the
+	// tags in the repository of From by the labels of their image config
+	// and the annotations of their manifest. The newest matching image is
+	// imported, the tag in From is ignored.
+	ImageSelector *metav1.LabelSelector `json:"imageSelector,omitempty"`
+	// Disabled Tags are neither imported nor resolved for new pods, their
+	// generations are kept for auditing.
+	Disabled bool `json:"disabled,omitempty"`
+	// Hooks, if set, are Jobs that must succeed for a new generation to be
+	// imported or to become the current generation.
+	Hooks *ImportHooks `json:"hooks,omitempty"`
+	// Retag, if set, is a tag pushed to the registry each generation is
+	// imported from, source or mirror, pointing at the imported image so
+	// consumers outside the cluster can follow the Tag.
+	Retag string `json:"retag,omitempty"`
+	// Deprecation, if set, marks the Tag as deprecated. Pods resolving it
+	// are admitted with a warning.
+	Deprecation *TagDeprecation `json:"deprecation,omitempty"`
+}
+
+// TagDeprecation holds why a Tag is deprecated and, optionally, when it
+// stops being supported. Once Sunset has passed the Sunset condition of the
+// Tag is set, the Tag keeps being resolved.
+type TagDeprecation struct {
+	Message string       `json:"message"`
+	Sunset  *metav1.Time `json:"sunset,omitempty"`
+}
+
+// ImportHooks holds the specs of the Jobs run, once per generation, for
+// new generations. The PreImport Job runs before the generation is imported,
+// against the image in from, and the PostImport Job once it is imported,
+// against the imported image. The generation is only imported, or becomes
+// the current one, after the Job succeeds. Jobs get the image in the
+// TAGGER_IMAGE environment variable.
+type ImportHooks struct {
+	PreImport  *batchv1.JobSpec `json:"preImport,omitempty"`
+	PostImport *batchv1.JobSpec `json:"postImport,omitempty"`
+}
+
+// HookRun holds the state of the latest Job run for an import hook.
+type HookRun struct {
+	Hook       string `json:"hook"`
 	Generation int64  `json:"generation"`
+	Job        string `json:"job"`
+	Phase      string `json:"phase"`
+	Message    string `json:"message,omitempty"`
+}
+
+// PromotionPolicy holds how long a new generation must soak before being
+// promoted. Soak time counts from the import or, if CanaryNamespace is set,
+// from when the same image has been rolled out by the Tag with the same name
+// in the canary namespace. If VerifyWindow is set a promoted generation must
+// keep its rollouts healthy, with at most MaxRestarts container restarts if
+// MaxRestarts is not zero, for the window before its promotion succeeds.
+type PromotionPolicy struct {
+	SoakTime        metav1.Duration `json:"soakTime"`
+	CanaryNamespace string          `json:"canaryNamespace,omitempty"`
+	VerifyWindow    metav1.Duration `json:"verifyWindow,omitempty"`
+	MaxRestarts     int32           `json:"maxRestarts,omitempty"`
+}
+
+// Promotion holds the promotion state of the latest requested generation.
+type Promotion struct {
+	Generation   int64        `json:"generation"`
+	Phase        string       `json:"phase"`
+	SoakingSince *metav1.Time `json:"soakingSince,omitempty"`
+	PromotedAt   *metav1.Time `json:"promotedAt,omitempty"`
+	VerifiedAt   *metav1.Time `json:"verifiedAt,omitempty"`
+	Message      string       `json:"message,omitempty"`
 }
 
 // TagStatus is the current status for an image tag.
 type TagStatus struct {
-	Generation        int64           `json:"generation"`
-	References        []HashReference `json:"references"`
-	LastImportAttempt ImportAttempt   `json:"lastImportAttempt"`
+	Generation        int64              `json:"generation"`
+	References        []HashReference    `json:"references"`
+	LastImportAttempt ImportAttempt      `json:"lastImportAttempt"`
+	Uploads           []BlobUpload       `json:"uploads,omitempty"`
+	Progress          *CopyProgress      `json:"progress,omitempty"`
+	Conditions        []metav1.Condition `json:"conditions,omitempty"`
+	Rollouts          []Rollout          `json:"rollouts,omitempty"`
+	Promotion         *Promotion         `json:"promotion,omitempty"`
+	Storage           *StorageUsage      `json:"storage,omitempty"`
+	LastKnownGood     *KnownGood         `json:"lastKnownGood,omitempty"`
+	Health            *Health            `json:"health,omitempty"`
+	Hooks             []HookRun          `json:"hooks,omitempty"`
+	// Timeline holds when each generation became the current one, newest
+	// first, up to MaxTimelineEntries.
+	Timeline []TimelineEntry `json:"timeline,omitempty"`
+	// InheritedBy holds the namespaces whose pods resolve the Tag through
+	// inheritance, i.e. namespaces inheriting from the Tag namespace that
+	// have no Tag with the same name, sorted.
+	InheritedBy []string `json:"inheritedBy,omitempty"`
+}
+
+// TimelineEntry records that the Tag started to resolve to a generation.
+type TimelineEntry struct {
+	Generation     int64       `json:"generation"`
+	ImageReference string      `json:"imageReference"`
+	Since          metav1.Time `json:"since"`
+}
+
+// Health summarizes the Tag state in a single status, see RegisterHealth.
+type Health struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// KnownGood is a generation that has been rolled out, and verified if the Tag
+// promotion policy asks for it, on all Deployments using the Tag.
+type KnownGood struct {
+	Generation     int64       `json:"generation"`
+	ImageReference string      `json:"imageReference"`
+	MarkedAt       metav1.Time `json:"markedAt"`
+}
+
+// StorageUsage summarizes the space the generations of a Tag take in the cache
+// registry. ReferencedBytes is the sum of the blobs of every generation while
+// StoredBytes counts blobs shared among generations only once.
+type StorageUsage struct {
+	Blobs           int   `json:"blobs"`
+	SharedBlobs     int   `json:"sharedBlobs"`
+	ReferencedBytes int64 `json:"referencedBytes"`
+	StoredBytes     int64 `json:"storedBytes"`
+}
+
+// Rollout holds the state of the rollout of the current generation on a
+// Deployment using the Tag. ReplicaSet is the one running the generation.
+type Rollout struct {
+	Deployment string      `json:"deployment"`
+	Generation int64       `json:"generation"`
+	ReplicaSet string      `json:"replicaSet,omitempty"`
+	Phase      string      `json:"phase"`
+	Reason     string      `json:"reason,omitempty"`
+	Message    string      `json:"message,omitempty"`
+	Restarts   int32       `json:"restarts,omitempty"`
+	StartedAt  metav1.Time `json:"startedAt"`
+	UpdatedAt  metav1.Time `json:"updatedAt"`
+}
+
+// CopyProgress holds the progress of an image being mirrored. ETA is the
+// estimated time until the copy is finished, based on the average speed.
+type CopyProgress struct {
+	BytesCopied int64            `json:"bytesCopied"`
+	BytesTotal  int64            `json:"bytesTotal"`
+	LayersDone  int              `json:"layersDone"`
+	LayersTotal int              `json:"layersTotal"`
+	ETA         *metav1.Duration `json:"eta,omitempty"`
+	UpdatedAt   metav1.Time      `json:"updatedAt"`
+}
+
+// BlobUpload holds the progress of a blob being uploaded to the cache registry
+// while an image is mirrored. Resumes counts how many times the upload has been
+// resumed after a failure. Location is the upload session in the registry, an
+// import interrupted by its deadline resumes the upload from there.
+type BlobUpload struct {
+	Digest   string `json:"digest"`
+	Size     int64  `json:"size"`
+	Uploaded int64  `json:"uploaded"`
+	Resumes  int    `json:"resumes,omitempty"`
+	Location string `json:"location,omitempty"`
 }
 
 // ImportAttempt holds data about an import cycle. Keeps track if it
@@ -120,12 +1292,158 @@ type ImportAttempt struct {
 	Reason  string      `json:"reason,omitempty"`
 }
 
+// BlobReference is a blob, layer or config, stored in the cache registry.
+type BlobReference struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
 // HashReference is an reference to a image hash in a given generation.
+// ImageLabels holds the image labels and annotations projected onto the Tag
+// while this is its current generation, only configured ones are recorded.
+// Blobs are the blobs mirrored into the cache registry, for cached Tags.
 type HashReference struct {
+	Generation     int64             `json:"generation"`
+	From           string            `json:"from"`
+	ImportedAt     metav1.Time       `json:"importedAt"`
+	ImageReference string            `json:"imageReference,omitempty"`
+	MediaType      string            `json:"mediaType,omitempty"`
+	ConvertedFrom  string            `json:"convertedFrom,omitempty"`
+	UpstreamTags   []string          `json:"upstreamTags,omitempty"`
+	ArtifactType   string            `json:"artifactType,omitempty"`
+	ImageLabels    map[string]string `json:"imageLabels,omitempty"`
+	Blobs          []BlobReference   `json:"blobs,omitempty"`
+	// Trigger is what requested the import of the generation, one of
+	// the ImportTrigger constants.
+	Trigger string `json:"trigger,omitempty"`
+	// Rollout is the outcome of the rollout of the generation on the
+	// Deployments using the Tag, one of the Rollout phases.
+	Rollout string `json:"rollout,omitempty"`
+	// Signature is the base64 encoded ed25519 signature, by the operator
+	// signing key, of the generation SigningPayload. Empty if signing is
+	// not configured.
+	Signature string `json:"signature,omitempty"`
+	// Retagged is the registry tag pushed pointing at the generation
+	// image, see TagSpec.Retag. RetagFailure tells why it could not be
+	// pushed, failing to push never fails the import.
+	Retagged     string `json:"retagged,omitempty"`
+	RetagFailure string `json:"retagFailure,omitempty"`
+	// Chart is the metadata of the helm chart the generation points to,
+	// nil if it is not a chart or its metadata could not be read.
+	Chart *ChartMetadata `json:"chart,omitempty"`
+}
+
+// ChartMetadata is the metadata of a helm chart, as read from its Chart.yaml
+// stored in the chart config blob.
+type ChartMetadata struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	AppVersion string `json:"appVersion,omitempty"`
+}
+
+// Digest returns the digest the generation points to, empty if the image
+// reference does not contain one.
+func (h HashReference) Digest() string {
+	idx := strings.LastIndex(h.ImageReference, "@")
+	if idx < 0 {
+		return ""
+	}
+	return h.ImageReference[idx+1:]
+}
+
+// SigningPayload returns what is signed for a generation of the Tag with the
+// provided namespace and name: the Tag, the generation, where it has been
+// imported from, the reference it points to, when it has been imported and
+// what triggered the import. Import times are taken with second precision,
+// as they are stored.
+func (h HashReference) SigningPayload(namespace, name string) []byte {
+	return []byte(
+		fmt.Sprintf(
+			"tagger-generation-v1\n%s/%s\n%d\n%s\n%s\n%s\n%s\n",
+			namespace,
+			name,
+			h.Generation,
+			h.From,
+			h.ImageReference,
+			h.ImportedAt.UTC().Format(time.RFC3339),
+			h.Trigger,
+		),
+	)
+}
+
+// GenerationRecord is an entry in the generation history of a Tag.
+type GenerationRecord struct {
 	Generation     int64       `json:"generation"`
-	From           string      `json:"from"`
-	ImportedAt     metav1.Time `json:"importedAt"`
+	Current        bool        `json:"current"`
 	ImageReference string      `json:"imageReference,omitempty"`
+	Digest         string      `json:"digest,omitempty"`
+	ImportedAt     metav1.Time `json:"importedAt"`
+	Trigger        string      `json:"trigger,omitempty"`
+	Rollout        string      `json:"rollout,omitempty"`
+	Signature      string      `json:"signature,omitempty"`
+}
+
+// GenerationHistory holds all generations kept by a Tag, newest first.
+type GenerationHistory struct {
+	Namespace   string             `json:"namespace"`
+	Name        string             `json:"name"`
+	Generation  int64              `json:"generation"`
+	Generations []GenerationRecord `json:"generations"`
+}
+
+// Resolution is the image a Tag resolved to at a point in time, the Tag
+// resolved to it Since then. Source tells what the resolution is based on,
+// one of the ResolutionSource constants.
+type Resolution struct {
+	Namespace      string      `json:"namespace"`
+	Name           string      `json:"name"`
+	At             metav1.Time `json:"at"`
+	Generation     int64       `json:"generation"`
+	ImageReference string      `json:"imageReference"`
+	Digest         string      `json:"digest,omitempty"`
+	Since          metav1.Time `json:"since"`
+	Source         string      `json:"source"`
+}
+
+// ImportSimulation is the outcome of evaluating, without importing anything,
+// the checks an import of Image into Namespace goes through. The import
+// would be Accepted if none of the Checks failed.
+type ImportSimulation struct {
+	Namespace string            `json:"namespace"`
+	Image     string            `json:"image"`
+	Accepted  bool              `json:"accepted"`
+	Checks    []SimulationCheck `json:"checks"`
+}
+
+// SimulationCheck is the Result, one of the Simulation constants, of one of
+// the checks of an import simulation.
+type SimulationCheck struct {
+	Name    string `json:"name"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// TagEnvironment is the state of a Tag in an environment, i.e. a namespace,
+// optionally in another cluster. Digest is the digest of the Tag current
+// generation, empty if the Tag does not exist or has not been imported yet.
+type TagEnvironment struct {
+	Cluster    string       `json:"cluster,omitempty"`
+	Namespace  string       `json:"namespace"`
+	Found      bool         `json:"found"`
+	Generation int64        `json:"generation"`
+	Reference  string       `json:"reference,omitempty"`
+	Digest     string       `json:"digest,omitempty"`
+	ImportedAt *metav1.Time `json:"importedAt,omitempty"`
+	Lagging    bool         `json:"lagging"`
+}
+
+// ProvenanceDiff compares the digest a Tag runs in many environments. Latest
+// is the digest imported last among all environments, environments running
+// any other digest, or no digest at all, are lagging behind.
+type ProvenanceDiff struct {
+	Name         string           `json:"name"`
+	Latest       string           `json:"latest,omitempty"`
+	Environments []TagEnvironment `json:"environments"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -134,7 +1452,172 @@ type HashReference struct {
 type TagList struct {
 	metav1.TypeMeta `json:",inline"`
 	// +optional
-	metav1.ListMeta `son:"metadata,omitempty"`
+	metav1.ListMeta `json:"metadata,omitempty"`
 
 	Items []Tag `json:"items"`
 }
+
+// +genclient
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ImportAudit records a single import attempt of a Tag. ImportAudits live in
+// the Tag namespace, are owned by the Tag and labeled with its name, they are
+// pruned after a retention period.
+type ImportAudit struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ImportAuditSpec `json:"spec,omitempty"`
+}
+
+// ImportAuditSpec holds what has been imported, why and the import result.
+// ImageReference is only set for successful imports, Error for failed ones.
+type ImportAuditSpec struct {
+	Tag            string      `json:"tag"`
+	Generation     int64       `json:"generation"`
+	From           string      `json:"from"`
+	Trigger        string      `json:"trigger"`
+	StartedAt      metav1.Time `json:"startedAt"`
+	FinishedAt     metav1.Time `json:"finishedAt"`
+	Succeed        bool        `json:"succeed"`
+	ImageReference string      `json:"imageReference,omitempty"`
+	Error          string      `json:"error,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// ImportAuditList is a list of ImportAudit.
+type ImportAuditList struct {
+	metav1.TypeMeta `json:",inline"`
+	// +optional
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ImportAudit `json:"items"`
+}
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// TagSet groups Tags, living in the same namespace, that must move together,
+// e.g. the frontend, backend and worker images of an application. Members
+// are only promoted once all of them imported their generation in spec and
+// are rolled back together, so an environment never runs mixed versions.
+type TagSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TagSetSpec   `json:"spec,omitempty"`
+	Status TagSetStatus `json:"status,omitempty"`
+}
+
+// TagSetSpec holds the names of the Tags in the set.
+type TagSetSpec struct {
+	Tags []string `json:"tags"`
+}
+
+// TagSetStatus holds the revisions the set has been promoted to, newest
+// first, and the conditions of the set.
+type TagSetStatus struct {
+	Revisions  []TagSetRevision   `json:"revisions,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// TagSetRevision records the generation of each member Tag once the set has
+// been promoted as a whole.
+type TagSetRevision struct {
+	Revision    int64            `json:"revision"`
+	Generations map[string]int64 `json:"generations"`
+	PromotedAt  metav1.Time      `json:"promotedAt"`
+}
+
+// Contains returns true if the Tag is a member of the set.
+func (t *TagSet) Contains(tag string) bool {
+	for _, name := range t.Spec.Tags {
+		if name == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// LatestRevision returns the revision the set has been promoted to last. The
+// boolean is false if the set has never been promoted.
+func (t *TagSet) LatestRevision() (TagSetRevision, bool) {
+	if len(t.Status.Revisions) == 0 {
+		return TagSetRevision{}, false
+	}
+	return t.Status.Revisions[0], true
+}
+
+// RegisterRollback drops the latest revision, returning the previous one the
+// set is moving back to. Returns false, leaving revisions untouched, if there
+// is no previous revision.
+func (t *TagSet) RegisterRollback() (TagSetRevision, bool) {
+	if len(t.Status.Revisions) < 2 {
+		return TagSetRevision{}, false
+	}
+	t.Status.Revisions = t.Status.Revisions[1:]
+	return t.Status.Revisions[0], true
+}
+
+// RegisterRevision records the provided member generations as a new revision
+// unless they are the ones in the latest revision. At most 5 revisions are
+// kept. Returns false if nothing has changed.
+func (t *TagSet) RegisterRevision(generations map[string]int64) bool {
+	next := int64(0)
+	if latest, ok := t.LatestRevision(); ok {
+		if reflect.DeepEqual(latest.Generations, generations) {
+			return false
+		}
+		next = latest.Revision + 1
+	}
+
+	revisions := []TagSetRevision{
+		{
+			Revision:    next,
+			Generations: generations,
+			PromotedAt:  metav1.Now().Rfc3339Copy(),
+		},
+	}
+	revisions = append(revisions, t.Status.Revisions...)
+	if len(revisions) > 5 {
+		revisions = revisions[:5]
+	}
+	t.Status.Revisions = revisions
+	return true
+}
+
+// SetCondition sets a condition in TagSet status. Returns false if the
+// condition was already set with the same status, reason and message.
+func (t *TagSet) SetCondition(
+	ctype string, status metav1.ConditionStatus, reason, msg string,
+) bool {
+	cur := meta.FindStatusCondition(t.Status.Conditions, ctype)
+	if cur != nil &&
+		cur.Status == status &&
+		cur.Reason == reason &&
+		cur.Message == msg &&
+		cur.ObservedGeneration == t.Generation {
+		return false
+	}
+	meta.SetStatusCondition(&t.Status.Conditions, metav1.Condition{
+		Type:               ctype,
+		Status:             status,
+		ObservedGeneration: t.Generation,
+		Reason:             reason,
+		Message:            msg,
+	})
+	return true
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// TagSetList is a list of TagSet.
+type TagSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	// +optional
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []TagSet `json:"items"`
+}
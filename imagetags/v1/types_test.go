@@ -1,9 +1,14 @@
 package v1
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestPrependHashReference(t *testing.T) {
@@ -200,3 +205,1251 @@ func TestValidateTagGeneration(t *testing.T) {
 		})
 	}
 }
+
+type reasonError struct{}
+
+func (r reasonError) Error() string  { return "failed with reason" }
+func (r reasonError) Reason() string { return "CustomReason" }
+
+func TestImportConditions(t *testing.T) {
+	tag := &Tag{}
+
+	tag.RegisterImportFailure(fmt.Errorf("generic failure"))
+	cond := meta.FindStatusCondition(tag.Status.Conditions, ConditionImported)
+	if cond == nil || cond.Status != metav1.ConditionFalse {
+		t.Fatalf("unexpected condition: %+v", cond)
+	}
+	if cond.Reason != ReasonImportFailed || cond.Message != "generic failure" {
+		t.Errorf("unexpected condition: %+v", cond)
+	}
+
+	tag.RegisterImportFailure(fmt.Errorf("wrapped: %w", reasonError{}))
+	cond = meta.FindStatusCondition(tag.Status.Conditions, ConditionImported)
+	if cond.Reason != "CustomReason" {
+		t.Errorf("expected CustomReason, %q found", cond.Reason)
+	}
+
+	tag.RegisterImportSuccess()
+	if len(tag.Status.Conditions) != 1 {
+		t.Errorf("expected one condition, %d found", len(tag.Status.Conditions))
+	}
+	if !meta.IsStatusConditionTrue(tag.Status.Conditions, ConditionImported) {
+		t.Errorf("expected imported condition to be true")
+	}
+}
+
+func TestRegisterManifestConversion(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		ref    HashReference
+		status metav1.ConditionStatus
+		reason string
+	}{
+		{
+			name: "converted schema1",
+			ref: HashReference{
+				MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+				ConvertedFrom: "application/vnd.docker.distribution.manifest.v1+prettyjws",
+			},
+			status: metav1.ConditionTrue,
+			reason: ReasonSchema1Converted,
+		},
+		{
+			name: "not converted schema1",
+			ref: HashReference{
+				MediaType: "application/vnd.docker.distribution.manifest.v1+json",
+			},
+			status: metav1.ConditionFalse,
+			reason: ReasonSchema1NotConverted,
+		},
+		{
+			name: "schema2",
+			ref: HashReference{
+				MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{}
+			tag.SetCondition(ConditionManifestConverted, metav1.ConditionTrue, "Old", "old")
+			tag.RegisterManifestConversion(tt.ref)
+
+			cond := meta.FindStatusCondition(tag.Status.Conditions, ConditionManifestConverted)
+			if tt.status == "" {
+				if cond != nil {
+					t.Errorf("condition should have been removed: %+v", cond)
+				}
+				return
+			}
+			if cond == nil {
+				t.Fatal("condition not found")
+			}
+			if cond.Status != tt.status || cond.Reason != tt.reason {
+				t.Errorf("unexpected condition: %+v", cond)
+			}
+		})
+	}
+}
+
+func TestRegisterRetag(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		ref    HashReference
+		status metav1.ConditionStatus
+		reason string
+	}{
+		{
+			name: "pushed",
+			ref: HashReference{
+				Generation: 2,
+				Retagged:   "quay.io/company/app:current-prod",
+			},
+			status: metav1.ConditionTrue,
+			reason: ReasonRetagged,
+		},
+		{
+			name: "push failed",
+			ref: HashReference{
+				Generation:   2,
+				RetagFailure: "unable to push current-prod: unauthorized",
+			},
+			status: metav1.ConditionFalse,
+			reason: ReasonRetagFailed,
+		},
+		{
+			name: "no retag",
+			ref:  HashReference{Generation: 2},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{}
+			tag.SetCondition(ConditionRetagged, metav1.ConditionTrue, "Old", "old")
+			tag.RegisterRetag(tt.ref)
+
+			cond := meta.FindStatusCondition(tag.Status.Conditions, ConditionRetagged)
+			if tt.status == "" {
+				if cond != nil {
+					t.Errorf("condition should have been removed: %+v", cond)
+				}
+				return
+			}
+			if cond == nil {
+				t.Fatal("condition not found")
+			}
+			if cond.Status != tt.status || cond.Reason != tt.reason {
+				t.Errorf("unexpected condition: %+v", cond)
+			}
+		})
+	}
+}
+
+func TestValidateRetag(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		from  string
+		retag string
+		err   string
+	}{
+		{
+			name: "no retag",
+			from: "quay.io/company/app:latest",
+		},
+		{
+			name:  "valid retag",
+			from:  "quay.io/company/app:latest",
+			retag: "current-prod",
+		},
+		{
+			name:  "invalid retag",
+			from:  "quay.io/company/app:latest",
+			retag: "current/prod",
+			err:   "invalid retag",
+		},
+		{
+			name:  "imported tag",
+			from:  "localhost:5000/app:stable",
+			retag: "stable",
+			err:   "can't be the imported tag",
+		},
+		{
+			name:  "implicit latest",
+			from:  "localhost:5000/app",
+			retag: "latest",
+			err:   "can't be the imported tag",
+		},
+		{
+			name:  "digest reference",
+			from:  "quay.io/company/app@sha256:abc",
+			retag: "latest",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{Spec: TagSpec{From: tt.from, Retag: tt.retag}}
+			err := tag.ValidateRetag()
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+			}
+		})
+	}
+}
+
+func TestPinnedDigest(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		from     string
+		refs     []HashReference
+		digest   string
+		imported bool
+	}{
+		{
+			name: "tag reference",
+			from: "centos:latest",
+		},
+		{
+			name:   "digest reference",
+			from:   "quay.io/centos/centos@sha256:abc",
+			digest: "sha256:abc",
+		},
+		{
+			name:   "digest reference with tag",
+			from:   "centos:latest@sha256:abc",
+			digest: "sha256:abc",
+		},
+		{
+			name:     "digest reference imported",
+			from:     "centos@sha256:abc",
+			refs:     []HashReference{{From: "centos@sha256:abc"}},
+			digest:   "sha256:abc",
+			imported: true,
+		},
+		{
+			name:   "other digest imported",
+			from:   "centos@sha256:abc",
+			refs:   []HashReference{{From: "centos@sha256:def"}},
+			digest: "sha256:abc",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{
+				Spec:   TagSpec{From: tt.from},
+				Status: TagStatus{References: tt.refs},
+			}
+			if dgst := tag.PinnedDigest(); dgst != tt.digest {
+				t.Errorf("expected digest %q, %q found", tt.digest, dgst)
+			}
+			if imported := tag.PinnedDigestImported(); imported != tt.imported {
+				t.Errorf("expected imported %v, %v found", tt.imported, imported)
+			}
+
+			tag.RegisterImportSuccess()
+			pinned := meta.IsStatusConditionTrue(tag.Status.Conditions, ConditionPinned)
+			if pinned != (tt.digest != "") {
+				t.Errorf("unexpected pinned condition: %+v", tag.Status.Conditions)
+			}
+		})
+	}
+}
+
+func TestValidateImageSelector(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		from     string
+		selector *metav1.LabelSelector
+		err      string
+	}{
+		{
+			name: "no selector",
+			from: "centos@sha256:abc",
+		},
+		{
+			name: "label selector",
+			from: "quay.io/centos/centos:latest",
+			selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"channel": "stable"},
+			},
+		},
+		{
+			name: "digest reference",
+			from: "quay.io/centos/centos@sha256:abc",
+			selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"channel": "stable"},
+			},
+			err: "can't be used with a digest reference",
+		},
+		{
+			name: "invalid selector",
+			from: "quay.io/centos/centos:latest",
+			selector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{
+						Key:      "channel",
+						Operator: "Around",
+					},
+				},
+			},
+			err: "invalid image selector",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{
+				Spec: TagSpec{
+					From:          tt.from,
+					ImageSelector: tt.selector,
+				},
+			}
+			err := tag.ValidateImageSelector()
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+			}
+		})
+	}
+}
+
+func TestCurrentReferenceIsArtifact(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		status   TagStatus
+		artifact bool
+	}{
+		{
+			name: "not imported",
+		},
+		{
+			name: "image",
+			status: TagStatus{
+				References: []HashReference{{ImageReference: "image"}},
+			},
+		},
+		{
+			name: "artifact",
+			status: TagStatus{
+				Generation: 1,
+				References: []HashReference{
+					{
+						Generation:     1,
+						ImageReference: "chart",
+						ArtifactType:   "application/vnd.cncf.helm.config.v1+json",
+					},
+					{ImageReference: "image"},
+				},
+			},
+			artifact: true,
+		},
+		{
+			name: "downgraded to image",
+			status: TagStatus{
+				References: []HashReference{
+					{
+						Generation:     1,
+						ImageReference: "chart",
+						ArtifactType:   "application/vnd.cncf.helm.config.v1+json",
+					},
+					{ImageReference: "image"},
+				},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{Status: tt.status}
+			if artifact := tag.CurrentReferenceIsArtifact(); artifact != tt.artifact {
+				t.Errorf("expected %v, %v received", tt.artifact, artifact)
+			}
+		})
+	}
+}
+
+func TestRegisterRollout(t *testing.T) {
+	tag := &Tag{}
+	tag.Status.Generation = 2
+	tag.Status.References = []HashReference{
+		{Generation: 2},
+		{Generation: 1, Rollout: RolloutComplete},
+	}
+	tag.Status.Rollouts = []Rollout{
+		{Deployment: "stale", Generation: 1, Phase: RolloutComplete},
+	}
+
+	if tag.RegisterRollout(Rollout{Deployment: "old", Generation: 1}) {
+		t.Errorf("rollout for previous generation registered")
+	}
+
+	if !tag.RegisterRollout(
+		Rollout{
+			Deployment: "b",
+			Generation: 2,
+			Phase:      RolloutProgressing,
+			UpdatedAt:  metav1.Now(),
+		},
+	) {
+		t.Fatal("progressing rollout not registered")
+	}
+	if len(tag.Status.Rollouts) != 1 || tag.Status.Rollouts[0].Deployment != "b" {
+		t.Errorf("stale rollout not dropped: %+v", tag.Status.Rollouts)
+	}
+	cond := meta.FindStatusCondition(tag.Status.Conditions, ConditionRolledOut)
+	if cond == nil || cond.Status != metav1.ConditionUnknown {
+		t.Errorf("unexpected condition: %+v", cond)
+	}
+
+	if tag.RegisterRollout(
+		Rollout{Deployment: "b", Generation: 2, Phase: RolloutProgressing},
+	) {
+		t.Errorf("unchanged rollout reported as changed")
+	}
+	if started := tag.RolloutStartedAt("b"); started.IsZero() {
+		t.Errorf("rollout start time not recorded")
+	}
+
+	tag.RegisterRollout(
+		Rollout{
+			Deployment: "a",
+			Generation: 2,
+			Phase:      RolloutFailed,
+			Message:    "deadline exceeded",
+		},
+	)
+	cond = meta.FindStatusCondition(tag.Status.Conditions, ConditionRolledOut)
+	if cond.Status != metav1.ConditionFalse || cond.Reason != ReasonRolloutFailed {
+		t.Errorf("unexpected condition: %+v", cond)
+	}
+	if !strings.Contains(cond.Message, "a: deadline exceeded") {
+		t.Errorf("unexpected condition message: %q", cond.Message)
+	}
+	if outcome := tag.Status.References[0].Rollout; outcome != RolloutFailed {
+		t.Errorf("expected failed rollout outcome, %q recorded", outcome)
+	}
+
+	tag.RegisterRollout(Rollout{Deployment: "a", Generation: 2, Phase: RolloutComplete})
+	tag.RegisterRollout(Rollout{Deployment: "b", Generation: 2, Phase: RolloutComplete})
+	if tag.Status.Rollouts[0].Deployment != "a" {
+		t.Errorf("rollouts not sorted: %+v", tag.Status.Rollouts)
+	}
+	if !meta.IsStatusConditionTrue(tag.Status.Conditions, ConditionRolledOut) {
+		t.Errorf("expected rolled out condition to be true")
+	}
+	if outcome := tag.Status.References[0].Rollout; outcome != RolloutComplete {
+		t.Errorf("expected complete rollout outcome, %q recorded", outcome)
+	}
+	if outcome := tag.Status.References[1].Rollout; outcome != RolloutComplete {
+		t.Errorf("outcome of previous generation changed to %q", outcome)
+	}
+}
+
+func TestGenerationHistory(t *testing.T) {
+	imported := metav1.Now()
+	tag := &Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "app"},
+		Status: TagStatus{
+			Generation: 1,
+			References: []HashReference{
+				{
+					Generation:     2,
+					ImageReference: "quay.io/app@sha256:2",
+					ImportedAt:     imported,
+					Trigger:        ImportTriggerWebhook,
+					Signature:      "c2lnbmF0dXJl",
+				},
+				{
+					Generation:     1,
+					ImageReference: "quay.io/app@sha256:1",
+					ImportedAt:     imported,
+					Trigger:        ImportTriggerRequest,
+					Rollout:        RolloutComplete,
+				},
+				{
+					Generation:     0,
+					ImageReference: "quay.io/app:latest",
+				},
+			},
+		},
+	}
+
+	expected := &GenerationHistory{
+		Namespace:  "ns",
+		Name:       "app",
+		Generation: 1,
+		Generations: []GenerationRecord{
+			{
+				Generation:     2,
+				ImageReference: "quay.io/app@sha256:2",
+				Digest:         "sha256:2",
+				ImportedAt:     imported,
+				Trigger:        ImportTriggerWebhook,
+				Signature:      "c2lnbmF0dXJl",
+			},
+			{
+				Generation:     1,
+				Current:        true,
+				ImageReference: "quay.io/app@sha256:1",
+				Digest:         "sha256:1",
+				ImportedAt:     imported,
+				Trigger:        ImportTriggerRequest,
+				Rollout:        RolloutComplete,
+			},
+			{
+				Generation:     0,
+				ImageReference: "quay.io/app:latest",
+			},
+		},
+	}
+	if history := tag.GenerationHistory(); !reflect.DeepEqual(history, expected) {
+		t.Errorf("expected %+v, received %+v", expected, history)
+	}
+
+	empty := (&Tag{}).GenerationHistory()
+	if empty.Generations == nil || len(empty.Generations) != 0 {
+		t.Errorf("expected empty generations, received %+v", empty.Generations)
+	}
+}
+
+func TestPreviousGeneration(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		tag  *Tag
+		gen  int64
+		ok   bool
+	}{
+		{
+			name: "single generation",
+			tag: &Tag{
+				Status: TagStatus{
+					References: []HashReference{{Generation: 0}},
+				},
+			},
+		},
+		{
+			name: "current is the latest",
+			gen:  1,
+			ok:   true,
+			tag: &Tag{
+				Status: TagStatus{
+					Generation: 2,
+					References: []HashReference{
+						{Generation: 2},
+						{Generation: 1},
+					},
+				},
+			},
+		},
+		{
+			name: "current is not the latest",
+			tag: &Tag{
+				Status: TagStatus{
+					Generation: 1,
+					References: []HashReference{
+						{Generation: 2},
+						{Generation: 1},
+						{Generation: 0},
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			gen, ok := tt.tag.PreviousGeneration()
+			if gen != tt.gen || ok != tt.ok {
+				t.Errorf("expected (%d, %v), (%d, %v) found", tt.gen, tt.ok, gen, ok)
+			}
+		})
+	}
+}
+
+func TestRegisterPromotion(t *testing.T) {
+	tag := &Tag{
+		Spec: TagSpec{
+			Generation: 1,
+			Promotion:  &PromotionPolicy{},
+		},
+	}
+
+	since := metav1.Now()
+	if !tag.RegisterPromotionPending(&since, "soaking") {
+		t.Fatal("pending promotion not registered")
+	}
+	if tag.RegisterPromotionPending(&since, "soaking") {
+		t.Errorf("unchanged promotion reported as changed")
+	}
+	if tag.Status.Generation != 0 {
+		t.Errorf("pending generation promoted")
+	}
+
+	tag.RegisterPromotion()
+	promotion := tag.Status.Promotion
+	if tag.Status.Generation != 1 || promotion.Phase != PromotionActive {
+		t.Errorf("generation not promoted: %+v", tag.Status)
+	}
+	if promotion.SoakingSince == nil || promotion.PromotedAt == nil {
+		t.Errorf("promotion times not recorded: %+v", promotion)
+	}
+
+	tag.Spec.Promotion = nil
+	tag.RegisterPromotion()
+	if tag.Status.Promotion != nil {
+		t.Errorf("promotion kept without policy: %+v", tag.Status.Promotion)
+	}
+}
+
+func TestRecordTimeline(t *testing.T) {
+	tag := &Tag{
+		Status: TagStatus{
+			References: []HashReference{
+				{Generation: 1, ImageReference: "quay.io/app@sha256:1"},
+				{Generation: 0, ImageReference: "quay.io/app@sha256:0"},
+			},
+		},
+	}
+
+	// promoting the same generation again is not a change.
+	for _, gen := range []int64{0, 0, 1, 0, 1} {
+		tag.Spec.Generation = gen
+		tag.RegisterPromotion()
+	}
+
+	var gens []int64
+	for _, entry := range tag.Status.Timeline {
+		gens = append(gens, entry.Generation)
+		if entry.Since.IsZero() {
+			t.Errorf("timeline entry without time: %+v", entry)
+		}
+	}
+	if !reflect.DeepEqual(gens, []int64{1, 0, 1, 0}) {
+		t.Errorf("unexpected timeline generations: %v", gens)
+	}
+	if ref := tag.Status.Timeline[0].ImageReference; ref != "quay.io/app@sha256:1" {
+		t.Errorf("unexpected timeline reference: %s", ref)
+	}
+
+	for i := 0; i < MaxTimelineEntries; i++ {
+		tag.Spec.Generation = int64(i % 2)
+		tag.RegisterPromotion()
+	}
+	if len(tag.Status.Timeline) != MaxTimelineEntries {
+		t.Errorf("expected %d entries, %d kept", MaxTimelineEntries, len(tag.Status.Timeline))
+	}
+}
+
+func TestRegisterReadiness(t *testing.T) {
+	tag := &Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Generation: 7,
+		},
+		Spec: TagSpec{
+			Generation: 1,
+		},
+	}
+
+	expect := func(status metav1.ConditionStatus, reason string) {
+		t.Helper()
+		cond := meta.FindStatusCondition(tag.Status.Conditions, ConditionReady)
+		if cond == nil || cond.Status != status || cond.Reason != reason {
+			t.Fatalf("expected %s(%s), %+v found", status, reason, cond)
+		}
+		if cond.ObservedGeneration != 0 {
+			t.Errorf("observed generation set: %d", cond.ObservedGeneration)
+		}
+	}
+
+	if !tag.RegisterReadiness() {
+		t.Fatal("readiness not registered")
+	}
+	expect(metav1.ConditionFalse, ReasonImportPending)
+	if tag.RegisterReadiness() {
+		t.Errorf("unchanged readiness reported as changed")
+	}
+
+	tag.RegisterImportFailure(fmt.Errorf("wrapped: %w", reasonError{}))
+	tag.RegisterReadiness()
+	expect(metav1.ConditionFalse, "CustomReason")
+
+	tag.RegisterImportSuccess()
+	tag.PrependHashReference(HashReference{Generation: 1})
+	tag.RegisterReadiness()
+	expect(metav1.ConditionFalse, ReasonPromotionPending)
+
+	tag.RegisterPromotion()
+	if !tag.RegisterReadiness() {
+		t.Fatal("readiness change not registered")
+	}
+	expect(metav1.ConditionTrue, ReasonGenerationReady)
+
+	tag.Spec.Generation = 2
+	tag.RegisterReadiness()
+	expect(metav1.ConditionFalse, ReasonImportPending)
+}
+
+func TestImportTrigger(t *testing.T) {
+	tag := &Tag{}
+	if trigger := tag.ImportTrigger(); trigger != ImportTriggerSpec {
+		t.Errorf("expected %s, %s found", ImportTriggerSpec, trigger)
+	}
+
+	tag.Spec.Generation = 2
+	tag.SetImportTrigger(ImportTriggerWebhook)
+	if trigger := tag.ImportTrigger(); trigger != ImportTriggerWebhook {
+		t.Errorf("expected %s, %s found", ImportTriggerWebhook, trigger)
+	}
+
+	// generation changed afterwards, e.g. the spec has been edited.
+	tag.Spec.Generation = 3
+	if trigger := tag.ImportTrigger(); trigger != ImportTriggerSpec {
+		t.Errorf("expected %s, %s found", ImportTriggerSpec, trigger)
+	}
+}
+
+func TestExpectedImportBytes(t *testing.T) {
+	tag := &Tag{}
+	if size := tag.ExpectedImportBytes(); size != 0 {
+		t.Errorf("expected unknown size, %d found", size)
+	}
+
+	tag.Status.References = []HashReference{
+		{
+			Generation: 1,
+			Blobs: []BlobReference{
+				{Digest: "sha256:a", Size: 100},
+				{Digest: "sha256:b", Size: 50},
+			},
+		},
+		{
+			Generation: 0,
+			Blobs:      []BlobReference{{Digest: "sha256:c", Size: 1000}},
+		},
+	}
+	if size := tag.ExpectedImportBytes(); size != 150 {
+		t.Errorf("expected 150 bytes, %d found", size)
+	}
+
+	// an interrupted import knows better.
+	tag.Status.Progress = &CopyProgress{BytesCopied: 10, BytesTotal: 300}
+	if size := tag.ExpectedImportBytes(); size != 300 {
+		t.Errorf("expected 300 bytes, %d found", size)
+	}
+}
+
+func TestRegisterKnownGood(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	newTag := func(rollouts ...Rollout) *Tag {
+		return &Tag{
+			Spec: TagSpec{Generation: 2},
+			Status: TagStatus{
+				Generation: 2,
+				References: []HashReference{
+					{Generation: 2, ImageReference: "cache/ns/tag@sha256:new"},
+					{Generation: 1, ImageReference: "cache/ns/tag@sha256:old"},
+				},
+				Rollouts: rollouts,
+			},
+		}
+	}
+	complete := Rollout{Deployment: "api", Generation: 2, Phase: RolloutComplete}
+	progressing := Rollout{Deployment: "web", Generation: 2, Phase: RolloutProgressing}
+
+	tag := newTag()
+	if tag.RegisterKnownGood(now) {
+		t.Errorf("expected no known good without rollouts")
+	}
+
+	tag = newTag(complete, progressing)
+	if tag.RegisterKnownGood(now) {
+		t.Errorf("expected no known good while rollouts progress")
+	}
+
+	tag = newTag(complete)
+	tag.Spec.Promotion = &PromotionPolicy{
+		VerifyWindow: metav1.Duration{Duration: time.Hour},
+	}
+	tag.Status.Promotion = &Promotion{Generation: 2, Phase: PromotionActive}
+	if tag.RegisterKnownGood(now) {
+		t.Errorf("expected no known good while verifying")
+	}
+
+	tag.Status.Promotion.Phase = PromotionSucceeded
+	if !tag.RegisterKnownGood(now) {
+		t.Fatalf("expected known good to be registered")
+	}
+	expected := &KnownGood{
+		Generation:     2,
+		ImageReference: "cache/ns/tag@sha256:new",
+		MarkedAt:       metav1.NewTime(now),
+	}
+	if !reflect.DeepEqual(tag.Status.LastKnownGood, expected) {
+		t.Errorf("expected %+v, %+v found", expected, tag.Status.LastKnownGood)
+	}
+	if tag.RegisterKnownGood(now.Add(time.Minute)) {
+		t.Errorf("expected no change for the same generation")
+	}
+	if !tag.KnownGoodImported() {
+		t.Errorf("expected known good generation to be imported")
+	}
+
+	// moving to a generation that fails keeps the known good one.
+	tag.Status.Generation = 1
+	tag.Status.Rollouts = []Rollout{
+		{Deployment: "api", Generation: 1, Phase: RolloutFailed},
+	}
+	if tag.RegisterKnownGood(now) {
+		t.Errorf("expected known good to be kept")
+	}
+	tag.Status.References = tag.Status.References[1:]
+	if tag.KnownGoodImported() {
+		t.Errorf("expected known good generation not to be imported")
+	}
+}
+
+func TestRegisterStorageUsage(t *testing.T) {
+	tag := &Tag{}
+	if tag.RegisterStorageUsage() {
+		t.Errorf("expected no change for tag without blobs")
+	}
+
+	base := BlobReference{Digest: "sha256:base", Size: 300}
+	tag.PrependHashReference(HashReference{
+		Generation: 0,
+		Blobs:      []BlobReference{base, {Digest: "sha256:app1", Size: 50}},
+	})
+	tag.PrependHashReference(HashReference{
+		Generation: 1,
+		Blobs:      []BlobReference{base, {Digest: "sha256:app2", Size: 70}},
+	})
+	if !tag.RegisterStorageUsage() {
+		t.Errorf("expected storage usage to change")
+	}
+
+	expected := &StorageUsage{
+		Blobs:           3,
+		SharedBlobs:     1,
+		ReferencedBytes: 720,
+		StoredBytes:     420,
+	}
+	if !reflect.DeepEqual(tag.Status.Storage, expected) {
+		t.Errorf("expected %+v, %+v found", expected, tag.Status.Storage)
+	}
+	if tag.RegisterStorageUsage() {
+		t.Errorf("expected no change registering the same usage")
+	}
+
+	tag.Status.References = []HashReference{{Generation: 2}}
+	if !tag.RegisterStorageUsage() {
+		t.Errorf("expected storage usage to be removed")
+	}
+	if tag.Status.Storage != nil {
+		t.Errorf("expected no storage usage, %+v found", tag.Status.Storage)
+	}
+}
+
+func TestTagSetRevisions(t *testing.T) {
+	ts := &TagSet{
+		Spec: TagSetSpec{
+			Tags: []string{"frontend", "backend"},
+		},
+	}
+
+	if !ts.Contains("backend") || ts.Contains("worker") {
+		t.Errorf("wrong members: %+v", ts.Spec.Tags)
+	}
+	if _, ok := ts.LatestRevision(); ok {
+		t.Errorf("latest revision found on empty set")
+	}
+	if _, ok := ts.RegisterRollback(); ok {
+		t.Errorf("rollback registered without revisions")
+	}
+
+	for i := int64(0); i < 7; i++ {
+		gens := map[string]int64{"frontend": i, "backend": i}
+		if !ts.RegisterRevision(gens) {
+			t.Fatalf("revision %d not registered", i)
+		}
+		if ts.RegisterRevision(map[string]int64{"frontend": i, "backend": i}) {
+			t.Errorf("revision %d registered twice", i)
+		}
+	}
+	if len(ts.Status.Revisions) != 5 {
+		t.Errorf("expected 5 revisions, %d found", len(ts.Status.Revisions))
+	}
+
+	latest, _ := ts.LatestRevision()
+	if latest.Revision != 6 || latest.Generations["frontend"] != 6 {
+		t.Errorf("unexpected latest revision: %+v", latest)
+	}
+
+	target, ok := ts.RegisterRollback()
+	if !ok || target.Revision != 5 || target.Generations["backend"] != 5 {
+		t.Errorf("unexpected rollback target: %+v", target)
+	}
+	if latest, _ := ts.LatestRevision(); latest.Revision != 5 {
+		t.Errorf("latest revision not dropped: %+v", latest)
+	}
+}
+
+func TestRegisterVerification(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	promotedAt := metav1.NewTime(now.Add(-time.Hour))
+
+	for _, tt := range []struct {
+		name     string
+		window   time.Duration
+		rollouts []Rollout
+		changed  bool
+		phase    string
+		status   metav1.ConditionStatus
+		message  string
+	}{
+		{
+			name:    "no verify window",
+			phase:   PromotionActive,
+			changed: false,
+		},
+		{
+			name:    "within window",
+			window:  2 * time.Hour,
+			changed: true,
+			phase:   PromotionActive,
+			status:  metav1.ConditionUnknown,
+			message: "verifying until 2021-01-01T13:00:00Z",
+		},
+		{
+			name:   "rollout failed",
+			window: 2 * time.Hour,
+			rollouts: []Rollout{
+				{
+					Deployment: "app",
+					Generation: 2,
+					Phase:      RolloutFailed,
+					Message:    "boom",
+				},
+			},
+			changed: true,
+			phase:   PromotionFailed,
+			status:  metav1.ConditionFalse,
+			message: "rollout failed: app: boom",
+		},
+		{
+			name:   "restart budget exhausted",
+			window: 2 * time.Hour,
+			rollouts: []Rollout{
+				{Deployment: "app", Generation: 2, Restarts: 2},
+				{Deployment: "worker", Generation: 2, Restarts: 2},
+				{Deployment: "old", Generation: 1, Restarts: 9},
+			},
+			changed: true,
+			phase:   PromotionFailed,
+			status:  metav1.ConditionFalse,
+			message: "4 restarts exceed the budget of 3",
+		},
+		{
+			name:   "window elapsed with progressing rollout",
+			window: time.Minute,
+			rollouts: []Rollout{
+				{Deployment: "app", Generation: 2, Phase: RolloutProgressing},
+			},
+			changed: true,
+			phase:   PromotionActive,
+			status:  metav1.ConditionUnknown,
+			message: "waiting for app to roll out",
+		},
+		{
+			name:   "window elapsed",
+			window: time.Minute,
+			rollouts: []Rollout{
+				{Deployment: "app", Generation: 2, Phase: RolloutComplete, Restarts: 1},
+			},
+			changed: true,
+			phase:   PromotionSucceeded,
+			status:  metav1.ConditionTrue,
+			message: "healthy for 1m0s",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{
+				Spec: TagSpec{
+					Generation: 2,
+					Promotion: &PromotionPolicy{
+						VerifyWindow: metav1.Duration{Duration: tt.window},
+						MaxRestarts:  3,
+					},
+				},
+				Status: TagStatus{
+					Generation: 2,
+					Rollouts:   tt.rollouts,
+					Promotion: &Promotion{
+						Generation: 2,
+						Phase:      PromotionActive,
+						PromotedAt: &promotedAt,
+					},
+				},
+			}
+
+			if changed := tag.RegisterVerification(now); changed != tt.changed {
+				t.Errorf("expected changed %v, %v received", tt.changed, changed)
+			}
+			if tag.Status.Promotion.Phase != tt.phase {
+				t.Errorf("expected phase %s, %+v found", tt.phase, tag.Status.Promotion)
+			}
+			if !tt.changed {
+				return
+			}
+			if tag.Status.Promotion.Message != tt.message {
+				t.Errorf("expected message %q, %q found", tt.message, tag.Status.Promotion.Message)
+			}
+
+			cond := meta.FindStatusCondition(tag.Status.Conditions, ConditionVerified)
+			if cond == nil || cond.Status != tt.status {
+				t.Errorf("expected verified condition %s, %+v found", tt.status, cond)
+			}
+			if tag.RegisterVerification(now) {
+				t.Errorf("unchanged verification reported as changed")
+			}
+		})
+	}
+}
+
+func TestRegisterHealth(t *testing.T) {
+	imported := func(generations ...int64) TagStatus {
+		status := TagStatus{Generation: generations[0]}
+		for _, gen := range generations {
+			status.References = append(status.References, HashReference{Generation: gen})
+		}
+		return status
+	}
+	policy := &PromotionPolicy{VerifyWindow: metav1.Duration{Duration: time.Hour}}
+	promotedAt := metav1.Now()
+
+	for _, tt := range []struct {
+		name    string
+		spec    TagSpec
+		status  TagStatus
+		health  string
+		message string
+	}{
+		{
+			name:    "not imported",
+			spec:    TagSpec{Generation: 0},
+			health:  HealthProgressing,
+			message: "generation 0 not imported yet",
+		},
+		{
+			name:    "disabled",
+			spec:    TagSpec{Generation: 1, Disabled: true},
+			status:  imported(1),
+			health:  HealthSuspended,
+			message: "tag disabled",
+		},
+		{
+			name: "import failed",
+			spec: TagSpec{Generation: 2},
+			status: func() TagStatus {
+				status := imported(1)
+				status.Conditions = []metav1.Condition{
+					{
+						Type:    ConditionImported,
+						Status:  metav1.ConditionFalse,
+						Message: "manifest unknown",
+					},
+				}
+				return status
+			}(),
+			health:  HealthDegraded,
+			message: "generation 2 import failed: manifest unknown",
+		},
+		{
+			name: "import failed for an imported generation",
+			spec: TagSpec{Generation: 1},
+			status: func() TagStatus {
+				status := imported(1)
+				status.Conditions = []metav1.Condition{
+					{
+						Type:   ConditionImported,
+						Status: metav1.ConditionFalse,
+					},
+				}
+				return status
+			}(),
+			health:  HealthHealthy,
+			message: "generation 1 running",
+		},
+		{
+			name:    "waiting for promotion",
+			spec:    TagSpec{Generation: 2},
+			status:  imported(1, 2),
+			health:  HealthProgressing,
+			message: "generation 2 waiting for promotion",
+		},
+		{
+			name: "rolling out",
+			spec: TagSpec{Generation: 1},
+			status: func() TagStatus {
+				status := imported(1)
+				status.Rollouts = []Rollout{
+					{Deployment: "app", Generation: 1, Phase: RolloutComplete},
+					{Deployment: "worker", Generation: 1, Phase: RolloutProgressing},
+				}
+				return status
+			}(),
+			health:  HealthProgressing,
+			message: "generation 1 rolling out: waiting for worker",
+		},
+		{
+			name: "rollout failed",
+			spec: TagSpec{Generation: 2},
+			status: func() TagStatus {
+				status := imported(1)
+				status.Rollouts = []Rollout{
+					{
+						Deployment: "app",
+						Generation: 1,
+						Phase:      RolloutFailed,
+						Message:    "crash looping",
+					},
+				}
+				return status
+			}(),
+			health:  HealthDegraded,
+			message: "generation 1 rollout failed: app: crash looping",
+		},
+		{
+			name: "verifying",
+			spec: TagSpec{Generation: 1, Promotion: policy},
+			status: func() TagStatus {
+				status := imported(1)
+				status.Promotion = &Promotion{
+					Generation: 1,
+					Phase:      PromotionActive,
+					PromotedAt: &promotedAt,
+				}
+				return status
+			}(),
+			health:  HealthProgressing,
+			message: "generation 1 being verified",
+		},
+		{
+			name: "verification failed",
+			spec: TagSpec{Generation: 1, Promotion: policy},
+			status: func() TagStatus {
+				status := imported(1)
+				status.Promotion = &Promotion{
+					Generation: 1,
+					Phase:      PromotionFailed,
+					Message:    "3 restarts exceed the budget of 1",
+				}
+				return status
+			}(),
+			health:  HealthDegraded,
+			message: "generation 1 verification failed: 3 restarts exceed the budget of 1",
+		},
+		{
+			name: "verified",
+			spec: TagSpec{Generation: 1, Promotion: policy},
+			status: func() TagStatus {
+				status := imported(1)
+				status.Promotion = &Promotion{
+					Generation: 1,
+					Phase:      PromotionSucceeded,
+				}
+				status.Rollouts = []Rollout{
+					{Deployment: "app", Generation: 1, Phase: RolloutComplete},
+					{Deployment: "old", Generation: 0, Phase: RolloutFailed},
+				}
+				return status
+			}(),
+			health:  HealthHealthy,
+			message: "generation 1 running",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{Spec: tt.spec, Status: tt.status}
+			if !tag.RegisterHealth() {
+				t.Fatal("health not registered")
+			}
+			expected := Health{Status: tt.health, Message: tt.message}
+			if *tag.Status.Health != expected {
+				t.Errorf("expected %+v, %+v found", expected, *tag.Status.Health)
+			}
+			if tag.RegisterHealth() {
+				t.Errorf("unchanged health reported as changed")
+			}
+		})
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	sunset := metav1.NewTime(now.Add(time.Hour))
+	tag := &Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+	}
+	if warning := tag.DeprecationWarning(now); warning != "" {
+		t.Errorf("unexpected warning: %s", warning)
+	}
+	if tag.RegisterSunset(now) {
+		t.Errorf("expected no sunset for tags not deprecated")
+	}
+
+	tag.Spec.Deprecation = &TagDeprecation{}
+	if err := tag.ValidateDeprecation(); err == nil {
+		t.Errorf("expected error for deprecation without message")
+	}
+
+	tag.Spec.Deprecation.Message = "use app-v2"
+	if err := tag.ValidateDeprecation(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expected := "tag prod/app is deprecated: use app-v2"
+	if warning := tag.DeprecationWarning(now); warning != expected {
+		t.Errorf("expected warning %q, %q found", expected, warning)
+	}
+	if tag.RegisterSunset(now) {
+		t.Errorf("expected no sunset for tags deprecated without one")
+	}
+
+	tag.Spec.Deprecation.Sunset = &sunset
+	expected = "tag prod/app is deprecated: use app-v2 (sunset on 2021-01-01T13:00:00Z)"
+	if warning := tag.DeprecationWarning(now); warning != expected {
+		t.Errorf("expected warning %q, %q found", expected, warning)
+	}
+	if !tag.RegisterSunset(now) {
+		t.Errorf("expected sunset condition to be set")
+	}
+	cond := meta.FindStatusCondition(tag.Status.Conditions, ConditionSunset)
+	if cond.Status != metav1.ConditionFalse || cond.Reason != ReasonSunsetPending {
+		t.Errorf("unexpected condition before sunset: %+v", cond)
+	}
+	if tag.RegisterSunset(now.Add(time.Minute)) {
+		t.Errorf("expected no change before sunset")
+	}
+
+	after := now.Add(2 * time.Hour)
+	expected = "tag prod/app is deprecated: use app-v2 (sunset since 2021-01-01T13:00:00Z)"
+	if warning := tag.DeprecationWarning(after); warning != expected {
+		t.Errorf("expected warning %q, %q found", expected, warning)
+	}
+	if !tag.RegisterSunset(after) {
+		t.Errorf("expected sunset condition to flip")
+	}
+	cond = meta.FindStatusCondition(tag.Status.Conditions, ConditionSunset)
+	if cond.Status != metav1.ConditionTrue || cond.Reason != ReasonSunsetPassed {
+		t.Errorf("unexpected condition after sunset: %+v", cond)
+	}
+	if tag.RegisterSunset(after.Add(time.Minute)) {
+		t.Errorf("expected no change after sunset")
+	}
+
+	tag.Spec.Deprecation = nil
+	if !tag.RegisterSunset(after) {
+		t.Errorf("expected sunset condition to be removed")
+	}
+	if meta.FindStatusCondition(tag.Status.Conditions, ConditionSunset) != nil {
+		t.Errorf("unexpected sunset condition")
+	}
+}
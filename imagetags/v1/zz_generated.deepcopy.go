@@ -21,13 +21,147 @@ limitations under the License.
 package v1
 
 import (
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BlobReference) DeepCopyInto(out *BlobReference) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BlobReference.
+func (in *BlobReference) DeepCopy() *BlobReference {
+	if in == nil {
+		return nil
+	}
+	out := new(BlobReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BlobUpload) DeepCopyInto(out *BlobUpload) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BlobUpload.
+func (in *BlobUpload) DeepCopy() *BlobUpload {
+	if in == nil {
+		return nil
+	}
+	out := new(BlobUpload)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ChartMetadata) DeepCopyInto(out *ChartMetadata) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ChartMetadata.
+func (in *ChartMetadata) DeepCopy() *ChartMetadata {
+	if in == nil {
+		return nil
+	}
+	out := new(ChartMetadata)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CopyProgress) DeepCopyInto(out *CopyProgress) {
+	*out = *in
+	if in.ETA != nil {
+		in, out := &in.ETA, &out.ETA
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	in.UpdatedAt.DeepCopyInto(&out.UpdatedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CopyProgress.
+func (in *CopyProgress) DeepCopy() *CopyProgress {
+	if in == nil {
+		return nil
+	}
+	out := new(CopyProgress)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GenerationHistory) DeepCopyInto(out *GenerationHistory) {
+	*out = *in
+	if in.Generations != nil {
+		in, out := &in.Generations, &out.Generations
+		*out = make([]GenerationRecord, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GenerationHistory.
+func (in *GenerationHistory) DeepCopy() *GenerationHistory {
+	if in == nil {
+		return nil
+	}
+	out := new(GenerationHistory)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GenerationRecord) DeepCopyInto(out *GenerationRecord) {
+	*out = *in
+	in.ImportedAt.DeepCopyInto(&out.ImportedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GenerationRecord.
+func (in *GenerationRecord) DeepCopy() *GenerationRecord {
+	if in == nil {
+		return nil
+	}
+	out := new(GenerationRecord)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *HashReference) DeepCopyInto(out *HashReference) {
 	*out = *in
 	in.ImportedAt.DeepCopyInto(&out.ImportedAt)
+	if in.UpstreamTags != nil {
+		in, out := &in.UpstreamTags, &out.UpstreamTags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ImageLabels != nil {
+		in, out := &in.ImageLabels, &out.ImageLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Blobs != nil {
+		in, out := &in.Blobs, &out.Blobs
+		*out = make([]BlobReference, len(*in))
+		copy(*out, *in)
+	}
+	if in.Chart != nil {
+		in, out := &in.Chart, &out.Chart
+		*out = new(ChartMetadata)
+		**out = **in
+	}
 	return
 }
 
@@ -41,6 +175,38 @@ func (in *HashReference) DeepCopy() *HashReference {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Health) DeepCopyInto(out *Health) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Health.
+func (in *Health) DeepCopy() *Health {
+	if in == nil {
+		return nil
+	}
+	out := new(Health)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HookRun) DeepCopyInto(out *HookRun) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HookRun.
+func (in *HookRun) DeepCopy() *HookRun {
+	if in == nil {
+		return nil
+	}
+	out := new(HookRun)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ImportAttempt) DeepCopyInto(out *ImportAttempt) {
 	*out = *in
@@ -58,13 +224,291 @@ func (in *ImportAttempt) DeepCopy() *ImportAttempt {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImportAudit) DeepCopyInto(out *ImportAudit) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImportAudit.
+func (in *ImportAudit) DeepCopy() *ImportAudit {
+	if in == nil {
+		return nil
+	}
+	out := new(ImportAudit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImportAudit) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImportAuditList) DeepCopyInto(out *ImportAuditList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ImportAudit, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImportAuditList.
+func (in *ImportAuditList) DeepCopy() *ImportAuditList {
+	if in == nil {
+		return nil
+	}
+	out := new(ImportAuditList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ImportAuditList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImportAuditSpec) DeepCopyInto(out *ImportAuditSpec) {
+	*out = *in
+	in.StartedAt.DeepCopyInto(&out.StartedAt)
+	in.FinishedAt.DeepCopyInto(&out.FinishedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImportAuditSpec.
+func (in *ImportAuditSpec) DeepCopy() *ImportAuditSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImportAuditSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImportHooks) DeepCopyInto(out *ImportHooks) {
+	*out = *in
+	if in.PreImport != nil {
+		in, out := &in.PreImport, &out.PreImport
+		*out = new(batchv1.JobSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PostImport != nil {
+		in, out := &in.PostImport, &out.PostImport
+		*out = new(batchv1.JobSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImportHooks.
+func (in *ImportHooks) DeepCopy() *ImportHooks {
+	if in == nil {
+		return nil
+	}
+	out := new(ImportHooks)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImportSimulation) DeepCopyInto(out *ImportSimulation) {
+	*out = *in
+	if in.Checks != nil {
+		in, out := &in.Checks, &out.Checks
+		*out = make([]SimulationCheck, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImportSimulation.
+func (in *ImportSimulation) DeepCopy() *ImportSimulation {
+	if in == nil {
+		return nil
+	}
+	out := new(ImportSimulation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KnownGood) DeepCopyInto(out *KnownGood) {
+	*out = *in
+	in.MarkedAt.DeepCopyInto(&out.MarkedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KnownGood.
+func (in *KnownGood) DeepCopy() *KnownGood {
+	if in == nil {
+		return nil
+	}
+	out := new(KnownGood)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Promotion) DeepCopyInto(out *Promotion) {
+	*out = *in
+	if in.SoakingSince != nil {
+		in, out := &in.SoakingSince, &out.SoakingSince
+		*out = (*in).DeepCopy()
+	}
+	if in.PromotedAt != nil {
+		in, out := &in.PromotedAt, &out.PromotedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.VerifiedAt != nil {
+		in, out := &in.VerifiedAt, &out.VerifiedAt
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Promotion.
+func (in *Promotion) DeepCopy() *Promotion {
+	if in == nil {
+		return nil
+	}
+	out := new(Promotion)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PromotionPolicy) DeepCopyInto(out *PromotionPolicy) {
+	*out = *in
+	out.SoakTime = in.SoakTime
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PromotionPolicy.
+func (in *PromotionPolicy) DeepCopy() *PromotionPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(PromotionPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProvenanceDiff) DeepCopyInto(out *ProvenanceDiff) {
+	*out = *in
+	if in.Environments != nil {
+		in, out := &in.Environments, &out.Environments
+		*out = make([]TagEnvironment, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProvenanceDiff.
+func (in *ProvenanceDiff) DeepCopy() *ProvenanceDiff {
+	if in == nil {
+		return nil
+	}
+	out := new(ProvenanceDiff)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Resolution) DeepCopyInto(out *Resolution) {
+	*out = *in
+	in.At.DeepCopyInto(&out.At)
+	in.Since.DeepCopyInto(&out.Since)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Resolution.
+func (in *Resolution) DeepCopy() *Resolution {
+	if in == nil {
+		return nil
+	}
+	out := new(Resolution)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Rollout) DeepCopyInto(out *Rollout) {
+	*out = *in
+	in.StartedAt.DeepCopyInto(&out.StartedAt)
+	in.UpdatedAt.DeepCopyInto(&out.UpdatedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Rollout.
+func (in *Rollout) DeepCopy() *Rollout {
+	if in == nil {
+		return nil
+	}
+	out := new(Rollout)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SimulationCheck) DeepCopyInto(out *SimulationCheck) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SimulationCheck.
+func (in *SimulationCheck) DeepCopy() *SimulationCheck {
+	if in == nil {
+		return nil
+	}
+	out := new(SimulationCheck)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageUsage) DeepCopyInto(out *StorageUsage) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageUsage.
+func (in *StorageUsage) DeepCopy() *StorageUsage {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageUsage)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Tag) DeepCopyInto(out *Tag) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Status.DeepCopyInto(&out.Status)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	return
 }
 
@@ -86,6 +530,46 @@ func (in *Tag) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagDeprecation) DeepCopyInto(out *TagDeprecation) {
+	*out = *in
+	if in.Sunset != nil {
+		in, out := &in.Sunset, &out.Sunset
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagDeprecation.
+func (in *TagDeprecation) DeepCopy() *TagDeprecation {
+	if in == nil {
+		return nil
+	}
+	out := new(TagDeprecation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagEnvironment) DeepCopyInto(out *TagEnvironment) {
+	*out = *in
+	if in.ImportedAt != nil {
+		in, out := &in.ImportedAt, &out.ImportedAt
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagEnvironment.
+func (in *TagEnvironment) DeepCopy() *TagEnvironment {
+	if in == nil {
+		return nil
+	}
+	out := new(TagEnvironment)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TagList) DeepCopyInto(out *TagList) {
 	*out = *in
@@ -119,9 +603,165 @@ func (in *TagList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSet) DeepCopyInto(out *TagSet) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSet.
+func (in *TagSet) DeepCopy() *TagSet {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSet)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TagSet) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSetList) DeepCopyInto(out *TagSetList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]TagSet, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSetList.
+func (in *TagSetList) DeepCopy() *TagSetList {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSetList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TagSetList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSetRevision) DeepCopyInto(out *TagSetRevision) {
+	*out = *in
+	if in.Generations != nil {
+		in, out := &in.Generations, &out.Generations
+		*out = make(map[string]int64, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	in.PromotedAt.DeepCopyInto(&out.PromotedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSetRevision.
+func (in *TagSetRevision) DeepCopy() *TagSetRevision {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSetRevision)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSetSpec) DeepCopyInto(out *TagSetSpec) {
+	*out = *in
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSetSpec.
+func (in *TagSetSpec) DeepCopy() *TagSetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSetStatus) DeepCopyInto(out *TagSetStatus) {
+	*out = *in
+	if in.Revisions != nil {
+		in, out := &in.Revisions, &out.Revisions
+		*out = make([]TagSetRevision, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSetStatus.
+func (in *TagSetStatus) DeepCopy() *TagSetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TagSpec) DeepCopyInto(out *TagSpec) {
 	*out = *in
+	if in.Promotion != nil {
+		in, out := &in.Promotion, &out.Promotion
+		*out = new(PromotionPolicy)
+		**out = **in
+	}
+	if in.ImageSelector != nil {
+		in, out := &in.ImageSelector, &out.ImageSelector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Hooks != nil {
+		in, out := &in.Hooks, &out.Hooks
+		*out = new(ImportHooks)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Deprecation != nil {
+		in, out := &in.Deprecation, &out.Deprecation
+		*out = new(TagDeprecation)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -146,6 +786,67 @@ func (in *TagStatus) DeepCopyInto(out *TagStatus) {
 		}
 	}
 	in.LastImportAttempt.DeepCopyInto(&out.LastImportAttempt)
+	if in.Uploads != nil {
+		in, out := &in.Uploads, &out.Uploads
+		*out = make([]BlobUpload, len(*in))
+		copy(*out, *in)
+	}
+	if in.Progress != nil {
+		in, out := &in.Progress, &out.Progress
+		*out = new(CopyProgress)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Rollouts != nil {
+		in, out := &in.Rollouts, &out.Rollouts
+		*out = make([]Rollout, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Promotion != nil {
+		in, out := &in.Promotion, &out.Promotion
+		*out = new(Promotion)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(StorageUsage)
+		**out = **in
+	}
+	if in.LastKnownGood != nil {
+		in, out := &in.LastKnownGood, &out.LastKnownGood
+		*out = new(KnownGood)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Health != nil {
+		in, out := &in.Health, &out.Health
+		*out = new(Health)
+		**out = **in
+	}
+	if in.Hooks != nil {
+		in, out := &in.Hooks, &out.Hooks
+		*out = make([]HookRun, len(*in))
+		copy(*out, *in)
+	}
+	if in.Timeline != nil {
+		in, out := &in.Timeline, &out.Timeline
+		*out = make([]TimelineEntry, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.InheritedBy != nil {
+		in, out := &in.InheritedBy, &out.InheritedBy
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -158,3 +859,20 @@ func (in *TagStatus) DeepCopy() *TagStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TimelineEntry) DeepCopyInto(out *TimelineEntry) {
+	*out = *in
+	in.Since.DeepCopyInto(&out.Since)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TimelineEntry.
+func (in *TimelineEntry) DeepCopy() *TimelineEntry {
+	if in == nil {
+		return nil
+	}
+	out := new(TimelineEntry)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,310 @@
+// Package metrics gathers all prometheus metrics exported by tagger. Metrics
+// are registered in their own registry and served by the metrics controller.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/ricardomaraschini/tagger/version"
+)
+
+const namespace = "tagger"
+
+// Registry is the prometheus registry where all tagger metrics live.
+var Registry = prometheus.NewRegistry()
+
+// BuildInfo reports the build information of the running binary. It is always
+// set to one and carries version, git sha and build date on its labels.
+var BuildInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "build_info",
+		Help:      "Build information about the running binary.",
+	},
+	[]string{"version", "git_sha", "build_date", "go_version"},
+)
+
+// ShardInfo reports the shard of namespaces owned by this replica. It is
+// always set to one and carries the shard index and total on its labels.
+var ShardInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "shard_info",
+		Help:      "Shard of namespaces owned by this replica.",
+	},
+	[]string{"index", "total"},
+)
+
+// ShardSkippedEvents counts events ignored because they belong to namespaces
+// owned by other replicas.
+var ShardSkippedEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shard_skipped_events_total",
+		Help:      "Events ignored because they belong to another shard.",
+	},
+	[]string{"controller"},
+)
+
+// FilteredEvents counts informer events ignored because they concern objects
+// or changes the controller does not act upon.
+var FilteredEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "filtered_events_total",
+		Help:      "Informer events ignored as irrelevant to the controller.",
+	},
+	[]string{"controller"},
+)
+
+// WebhookUntrackedImages counts images pushed, as reported by webhooks, that
+// no Tag tracks.
+var WebhookUntrackedImages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_untracked_images_total",
+		Help:      "Images reported by webhooks that no Tag tracks.",
+	},
+	[]string{"webhook"},
+)
+
+// NotificationDeliveries counts the deliveries of Tag events to outbound
+// webhooks by event and result, either "success" or "failure".
+var NotificationDeliveries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notification_deliveries_total",
+		Help:      "Tag events delivered to outbound webhooks.",
+	},
+	[]string{"event", "result"},
+)
+
+// HTTPRequests counts the requests answered by our http servers, i.e. the
+// webhooks, the api and the metrics server, by server and status code.
+var HTTPRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests answered by the http servers, by status code.",
+	},
+	[]string{"server", "code"},
+)
+
+// CacheMissReads counts the objects read from the API server, by resource,
+// because the cache had not seen them yet when mutating a pod.
+var CacheMissReads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_miss_reads_total",
+		Help:      "Objects read from the API server when missing from the cache.",
+	},
+	[]string{"resource"},
+)
+
+// WorkersBusy reports the number of workers importing Tags.
+var WorkersBusy = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_busy",
+		Help:      "Number of workers importing Tags.",
+	},
+)
+
+// WorkersLimit reports the number of Tags that may be imported in parallel.
+var WorkersLimit = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_limit",
+		Help:      "Number of Tags that may be imported in parallel.",
+	},
+)
+
+// TagQueueDepth reports the number of Tag events waiting for a worker.
+var TagQueueDepth = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tag_queue_depth",
+		Help:      "Number of Tag events waiting for a worker.",
+	},
+)
+
+// Leader reports if this replica holds the controllers lease, i.e. it is the
+// one processing events. Standby replicas report zero.
+var Leader = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether this replica is the leader processing events.",
+	},
+)
+
+// GitSyncLastSuccess reports when Tags have last been synced from the Git
+// repository, as a unix timestamp.
+var GitSyncLastSuccess = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "git_sync_last_success_timestamp_seconds",
+		Help:      "When Tags have last been synced from the Git repository.",
+	},
+)
+
+// InflightBytes reports the bytes of layers buffered in memory, while being
+// uploaded to the cache registry, across all imports.
+var InflightBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_bytes",
+		Help:      "Bytes of layers buffered in memory while mirroring.",
+	},
+)
+
+// RegistryCircuitOpen reports, per registry, if imports are short-circuited
+// because the registry has been failing. Set to one while the circuit is open.
+var RegistryCircuitOpen = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_circuit_open",
+		Help:      "Whether imports from the registry are short-circuited.",
+	},
+	[]string{"registry"},
+)
+
+// ThrottledImports counts, per resource under pressure ("memory" or
+// "files"), the imports held back by the overload protection.
+var ThrottledImports = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttled_imports_total",
+		Help:      "Imports held back while the operator is close to its resource limits.",
+	},
+	[]string{"resource"},
+)
+
+// HeldImports counts the imports held back by the import schedule, per reason
+// ("blackout" or "budget").
+var HeldImports = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "held_imports_total",
+		Help:      "Imports held back by a blackout window or by the concurrency budget.",
+	},
+	[]string{"reason"},
+)
+
+// UnknownImages counts the pods, in enforcing namespaces, found to run images
+// not imported as a Tag generation, per namespace and action ("reject" or, in
+// dry run, "warn").
+var UnknownImages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unknown_image_pods_total",
+		Help:      "Pods in enforcing namespaces running images no Tag imported.",
+	},
+	[]string{"namespace", "action"},
+)
+
+// ImportSlots reports how many imports may run at once across all replicas,
+// zero if not capped.
+var ImportSlots = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "import_slots",
+		Help:      "Number of imports allowed to run at once across all replicas.",
+	},
+)
+
+// ImportSlotsHeld reports how many import slots this replica holds. Summed
+// across replicas it is the cluster wide usage of the budget.
+var ImportSlotsHeld = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "import_slots_held",
+		Help:      "Number of import slots held by this replica.",
+	},
+)
+
+// TagsDesc describes the number of Tags per namespace and state. Values are
+// computed from the Tag cache on each scrape by a collector living with the
+// controllers, see services.TagStates.
+var TagsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "tags"),
+	"Number of Tags per namespace and state.",
+	[]string{"namespace", "state"},
+	nil,
+)
+
+// UntrackedUpstreamTagsDesc describes the number of tags, per upstream
+// repository Tags are imported from, that no Tag tracks. Reported from the
+// last catalog scan by services.Catalog.
+var UntrackedUpstreamTagsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "untracked_upstream_tags"),
+	"Number of tags in the upstream repository not tracked by any Tag.",
+	[]string{"repository"},
+	nil,
+)
+
+// MirrorReferencedBytesDesc describes the bytes referred by all mirrored Tag
+// generations, blobs shared among them are counted once per generation.
+// Computed on each scrape by services.StorageUsage.
+var MirrorReferencedBytesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "mirror", "referenced_bytes"),
+	"Bytes referred by all mirrored Tag generations.",
+	nil,
+	nil,
+)
+
+// MirrorStoredBytesDesc describes the bytes actually stored in the cache
+// registry, blobs shared by many Tags or generations are counted once.
+var MirrorStoredBytesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "mirror", "stored_bytes"),
+	"Bytes stored in the cache registry by mirrored Tag generations.",
+	nil,
+	nil,
+)
+
+// MirrorDedupRatioDesc describes the ratio between referenced and stored
+// bytes in the cache registry.
+var MirrorDedupRatioDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "mirror", "dedup_ratio"),
+	"Ratio between bytes referred by mirrored Tag generations and bytes stored.",
+	nil,
+	nil,
+)
+
+func init() {
+	info := version.Get()
+	BuildInfo.WithLabelValues(
+		info.Version, info.GitSHA, info.BuildDate, info.GoVersion,
+	).Set(1)
+
+	Registry.MustRegister(
+		BuildInfo,
+		ShardInfo,
+		ShardSkippedEvents,
+		FilteredEvents,
+		WebhookUntrackedImages,
+		NotificationDeliveries,
+		HTTPRequests,
+		CacheMissReads,
+		RegistryCircuitOpen,
+		ThrottledImports,
+		HeldImports,
+		UnknownImages,
+		ImportSlots,
+		ImportSlotsHeld,
+		WorkersBusy,
+		WorkersLimit,
+		TagQueueDepth,
+		Leader,
+		GitSyncLastSuccess,
+		InflightBytes,
+	)
+}
+
+// Handler returns an http handler that exposes all metrics in Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
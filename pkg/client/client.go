@@ -0,0 +1,422 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/rest"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// Error is returned when the Tag API answers with anything but 200.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+// Error returns the message returned by the Tag API, or the status code
+// if no message was returned.
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf(
+			"tag api answered with %d %s", e.StatusCode, http.StatusText(e.StatusCode),
+		)
+	}
+	return e.Message
+}
+
+// IsNotFound returns true if err was returned because the Tag does not exist.
+func IsNotFound(err error) bool {
+	var apierr *Error
+	return errors.As(err, &apierr) && apierr.StatusCode == http.StatusNotFound
+}
+
+// IsForbidden returns true if err was returned because the caller is not
+// allowed to perform the request.
+func IsForbidden(err error) bool {
+	var apierr *Error
+	return errors.As(err, &apierr) && apierr.StatusCode == http.StatusForbidden
+}
+
+// options holds what has been configured through Option.
+type options struct {
+	client   *http.Client
+	rootCAs  *x509.CertPool
+	restcfg  *rest.Config
+	token    func() (string, error)
+	attempts int
+	backoff  time.Duration
+}
+
+// Option configures a Client.
+type Option func(*options) error
+
+// WithToken authenticates with the provided bearer token, e.g. a service
+// account token.
+func WithToken(token string) Option {
+	return func(o *options) error {
+		o.token = func() (string, error) {
+			return token, nil
+		}
+		return nil
+	}
+}
+
+// WithTokenFile authenticates with the bearer token in path. The file is
+// read on every request as projected service account tokens are rotated.
+func WithTokenFile(path string) Option {
+	return func(o *options) error {
+		o.token = func() (string, error) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("error reading token: %w", err)
+			}
+			return strings.TrimSpace(string(data)), nil
+		}
+		return nil
+	}
+}
+
+// WithKubeConfig authenticates with the credentials in a kube configuration,
+// as kubectl does. Only credentials are used, the Tag API is still reached
+// at the Client address.
+func WithKubeConfig(cfg *rest.Config) Option {
+	return func(o *options) error {
+		o.restcfg = cfg
+		return nil
+	}
+}
+
+// WithCAFile verifies the Tag API certificate against the certificate
+// authority in path instead of the system ones.
+func WithCAFile(path string) Option {
+	return func(o *options) error {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		o.rootCAs = x509.NewCertPool()
+		if !o.rootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", path)
+		}
+		return nil
+	}
+}
+
+// WithHTTPClient sends requests through the provided http client. Other
+// options changing the transport are ignored.
+func WithHTTPClient(cli *http.Client) Option {
+	return func(o *options) error {
+		o.client = cli
+		return nil
+	}
+}
+
+// WithRetries makes reads to be attempted up to attempts times, waiting for
+// backoff, doubled after every attempt, in between. Reads are retried when
+// the API can't be reached or answers with a server error or 429. Requests
+// changing Tags are never retried. Defaults to 3 attempts, 500ms apart.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(o *options) error {
+		if attempts < 1 {
+			return fmt.Errorf("at least one attempt must be made")
+		}
+		o.attempts = attempts
+		o.backoff = backoff
+		return nil
+	}
+}
+
+// Client reads and acts upon Tags through the Tag API. Callers are only
+// allowed to do what cluster RBAC allows them to do on Tags.
+type Client struct {
+	address  string
+	client   *http.Client
+	token    func() (string, error)
+	attempts int
+	backoff  time.Duration
+}
+
+// New returns a client for the Tag API at address, e.g.
+// https://tagger.tagger:8083.
+func New(address string, opts ...Option) (*Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("tag api address must be provided")
+	}
+
+	o := &options{
+		attempts: 3,
+		backoff:  500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.client == nil {
+		var rt http.RoundTripper = http.DefaultTransport
+		if o.rootCAs != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = &tls.Config{RootCAs: o.rootCAs}
+			rt = transport
+		}
+		if o.restcfg != nil {
+			var err error
+			if rt, err = rest.HTTPWrappersForConfig(o.restcfg, rt); err != nil {
+				return nil, err
+			}
+		}
+		o.client = &http.Client{Transport: rt}
+	}
+
+	return &Client{
+		address:  strings.TrimSuffix(address, "/"),
+		client:   o.client,
+		token:    o.token,
+		attempts: o.attempts,
+		backoff:  o.backoff,
+	}, nil
+}
+
+// ListOptions restrict and paginate lists. Limit defaults to, and is capped
+// at, 500. Continue is the token returned, in the list metadata, by the
+// previous page.
+type ListOptions struct {
+	LabelSelector string
+	Limit         int
+	Continue      string
+}
+
+// List returns a page of the Tags in namespace, or in all namespaces the
+// caller can list Tags in if namespace is empty.
+func (c *Client) List(
+	ctx context.Context, namespace string, opts ListOptions,
+) (*imagtagv1.TagList, error) {
+	query := url.Values{}
+	if opts.LabelSelector != "" {
+		query.Set("labelSelector", opts.LabelSelector)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Continue != "" {
+		query.Set("continue", opts.Continue)
+	}
+
+	path := "tags"
+	if namespace != "" {
+		path = fmt.Sprintf("namespaces/%s/tags", url.PathEscape(namespace))
+	}
+
+	list := &imagtagv1.TagList{}
+	if err := c.do(ctx, http.MethodGet, path, query, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Get returns a Tag.
+func (c *Client) Get(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	it := &imagtagv1.Tag{}
+	if err := c.do(ctx, http.MethodGet, tagPath(namespace, name, ""), nil, it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// Generations returns the generations kept by a Tag, newest first.
+func (c *Client) Generations(
+	ctx context.Context, namespace, name string,
+) (*imagtagv1.GenerationHistory, error) {
+	hist := &imagtagv1.GenerationHistory{}
+	path := tagPath(namespace, name, "generations")
+	if err := c.do(ctx, http.MethodGet, path, nil, hist); err != nil {
+		return nil, err
+	}
+	return hist, nil
+}
+
+// Resolve returns the image a Tag pointed to at the provided time.
+func (c *Client) Resolve(
+	ctx context.Context, namespace, name string, at time.Time,
+) (*imagtagv1.Resolution, error) {
+	query := url.Values{"at": []string{at.Format(time.RFC3339)}}
+	res := &imagtagv1.Resolution{}
+	path := tagPath(namespace, name, "resolve")
+	if err := c.do(ctx, http.MethodGet, path, query, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Upgrade moves a Tag to its next generation.
+func (c *Client) Upgrade(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	return c.act(ctx, namespace, name, "upgrade")
+}
+
+// Downgrade moves a Tag to its previous generation.
+func (c *Client) Downgrade(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	return c.act(ctx, namespace, name, "downgrade")
+}
+
+// Rollback moves a Tag back to its last known good generation.
+func (c *Client) Rollback(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	return c.act(ctx, namespace, name, "rollback")
+}
+
+// Import imports a new generation of a Tag.
+func (c *Client) Import(ctx context.Context, namespace, name string) (*imagtagv1.Tag, error) {
+	return c.act(ctx, namespace, name, "import")
+}
+
+// Diff compares a Tag among at least two namespaces.
+func (c *Client) Diff(
+	ctx context.Context, name string, namespaces []string,
+) (*imagtagv1.ProvenanceDiff, error) {
+	query := url.Values{"namespaces": []string{strings.Join(namespaces, ",")}}
+	path := fmt.Sprintf("tags/%s/diff", url.PathEscape(name))
+	diff := &imagtagv1.ProvenanceDiff{}
+	if err := c.do(ctx, http.MethodGet, path, query, diff); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// Simulate reports whether importing image into namespace would be accepted,
+// without importing it.
+func (c *Client) Simulate(
+	ctx context.Context, namespace, image string,
+) (*imagtagv1.ImportSimulation, error) {
+	query := url.Values{"image": []string{image}}
+	path := fmt.Sprintf("namespaces/%s/simulate", url.PathEscape(namespace))
+	sim := &imagtagv1.ImportSimulation{}
+	if err := c.do(ctx, http.MethodGet, path, query, sim); err != nil {
+		return nil, err
+	}
+	return sim, nil
+}
+
+// act requests action upon a Tag, returning the updated Tag.
+func (c *Client) act(ctx context.Context, namespace, name, action string) (*imagtagv1.Tag, error) {
+	it := &imagtagv1.Tag{}
+	path := tagPath(namespace, name, action)
+	if err := c.do(ctx, http.MethodPost, path, nil, it); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// tagPath returns the path, relative to the api prefix, of a Tag or of an
+// action upon it.
+func tagPath(namespace, name, action string) string {
+	path := fmt.Sprintf("namespaces/%s/tags/%s", url.PathEscape(namespace), url.PathEscape(name))
+	if action != "" {
+		path += "/" + action
+	}
+	return path
+}
+
+// do sends a request and decodes the json returned into out.
+func (c *Client) do(
+	ctx context.Context, method, path string, query url.Values, out interface{},
+) error {
+	body, err := c.request(ctx, method, path, query)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("error decoding tag api response: %w", err)
+	}
+	return nil
+}
+
+// request sends a request, retrying reads, and returns the body returned.
+func (c *Client) request(
+	ctx context.Context, method, path string, query url.Values,
+) ([]byte, error) {
+	endpoint := fmt.Sprintf("%s/api/v1/%s", c.address, path)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var token string
+	if c.token != nil {
+		var err error
+		if token, err = c.token(); err != nil {
+			return nil, err
+		}
+	}
+
+	backoff := c.backoff
+	for attempt := 1; ; attempt++ {
+		body, err := c.send(ctx, method, endpoint, token)
+		if err == nil || method != http.MethodGet || attempt >= c.attempts {
+			return body, err
+		}
+		if ctx.Err() != nil || !retriable(err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+// send sends a single request, authenticated with token if not empty.
+func (c *Client) send(ctx context.Context, method, endpoint, token string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apierr := &Error{StatusCode: resp.StatusCode}
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &msg); err == nil {
+			apierr.Message = msg.Message
+		}
+		return nil, apierr
+	}
+	return body, nil
+}
+
+// retriable returns true if a request failing with err should be retried,
+// i.e. the API could not be reached or answered with a server error.
+func retriable(err error) bool {
+	var apierr *Error
+	if !errors.As(err, &apierr) {
+		return true
+	}
+	return apierr.StatusCode >= 500 || apierr.StatusCode == http.StatusTooManyRequests
+}
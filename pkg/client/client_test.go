@@ -0,0 +1,289 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// server is a fake Tag API, answering requests with the status in codes, in
+// order, and with obj once codes are exhausted. Requests are recorded.
+type server struct {
+	mtx      sync.Mutex
+	codes    []int
+	obj      interface{}
+	requests []*http.Request
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.requests = append(s.requests, r)
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(s.codes) > 0 {
+		code := s.codes[0]
+		s.codes = s.codes[1:]
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"message": "failed"})
+		return
+	}
+	json.NewEncoder(w).Encode(s.obj)
+}
+
+func TestClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "tag"},
+		Spec:       imagtagv1.TagSpec{From: "centos:latest", Generation: 1},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		codes    []int
+		obj      interface{}
+		call     func(cli *Client) (interface{}, error)
+		method   string
+		uri      string
+		requests int
+		err      string
+	}{
+		{
+			name: "get",
+			obj:  it,
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Get(ctx, "dev", "tag")
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/namespaces/dev/tags/tag",
+			requests: 1,
+		},
+		{
+			name: "list all namespaces",
+			obj:  &imagtagv1.TagList{Items: []imagtagv1.Tag{*it}},
+			call: func(cli *Client) (interface{}, error) {
+				return cli.List(ctx, "", ListOptions{LabelSelector: "team=a", Limit: 10})
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/tags?labelSelector=team%3Da&limit=10",
+			requests: 1,
+		},
+		{
+			name: "list namespace",
+			obj:  &imagtagv1.TagList{Items: []imagtagv1.Tag{*it}},
+			call: func(cli *Client) (interface{}, error) {
+				return cli.List(ctx, "dev", ListOptions{Continue: "abc"})
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/namespaces/dev/tags?continue=abc",
+			requests: 1,
+		},
+		{
+			name: "diff",
+			obj:  &imagtagv1.ProvenanceDiff{Name: "tag"},
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Diff(ctx, "tag", []string{"dev", "prod"})
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/tags/tag/diff?namespaces=dev%2Cprod",
+			requests: 1,
+		},
+		{
+			name: "resolve",
+			obj:  &imagtagv1.Resolution{Namespace: "dev", Name: "tag"},
+			call: func(cli *Client) (interface{}, error) {
+				at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+				return cli.Resolve(ctx, "dev", "tag", at)
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/namespaces/dev/tags/tag/resolve?at=2021-01-01T00%3A00%3A00Z",
+			requests: 1,
+		},
+		{
+			name: "simulate",
+			obj:  &imagtagv1.ImportSimulation{Namespace: "dev", Accepted: true},
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Simulate(ctx, "dev", "centos:latest")
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/namespaces/dev/simulate?image=centos%3Alatest",
+			requests: 1,
+		},
+		{
+			name: "upgrade",
+			obj:  it,
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Upgrade(ctx, "dev", "tag")
+			},
+			method:   http.MethodPost,
+			uri:      "/api/v1/namespaces/dev/tags/tag/upgrade",
+			requests: 1,
+		},
+		{
+			name:  "read retried on server errors",
+			codes: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			obj:   it,
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Get(ctx, "dev", "tag")
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/namespaces/dev/tags/tag",
+			requests: 3,
+		},
+		{
+			name: "read retries exhausted",
+			codes: []int{
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+				http.StatusInternalServerError,
+			},
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Generations(ctx, "dev", "tag")
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/namespaces/dev/tags/tag/generations",
+			requests: 3,
+			err:      "failed",
+		},
+		{
+			name:  "read not retried on client errors",
+			codes: []int{http.StatusForbidden},
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Get(ctx, "dev", "tag")
+			},
+			method:   http.MethodGet,
+			uri:      "/api/v1/namespaces/dev/tags/tag",
+			requests: 1,
+			err:      "failed",
+		},
+		{
+			name:  "update never retried",
+			codes: []int{http.StatusInternalServerError},
+			call: func(cli *Client) (interface{}, error) {
+				return cli.Import(ctx, "dev", "tag")
+			},
+			method:   http.MethodPost,
+			uri:      "/api/v1/namespaces/dev/tags/tag/import",
+			requests: 1,
+			err:      "failed",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &server{codes: tt.codes, obj: tt.obj}
+			httpsrv := httptest.NewServer(srv)
+			defer httpsrv.Close()
+
+			cli, err := New(
+				httpsrv.URL+"/",
+				WithToken("token"),
+				WithRetries(3, time.Millisecond),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			obj, err := tt.call(cli)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, %q received", tt.err, err)
+				}
+			} else if len(tt.err) > 0 {
+				t.Fatalf("expected error %q, nil received", tt.err)
+			} else {
+				expected, _ := json.Marshal(tt.obj)
+				received, _ := json.Marshal(obj)
+				if string(expected) != string(received) {
+					t.Errorf("expected %s, %s received", expected, received)
+				}
+			}
+
+			if len(srv.requests) != tt.requests {
+				t.Fatalf("expected %d requests, %d received", tt.requests, len(srv.requests))
+			}
+			for _, req := range srv.requests {
+				if req.Method != tt.method || req.URL.RequestURI() != tt.uri {
+					t.Errorf("unexpected request %s %s", req.Method, req.URL.RequestURI())
+				}
+				if auth := req.Header.Get("Authorization"); auth != "Bearer token" {
+					t.Errorf("unexpected authorization %q", auth)
+				}
+			}
+		})
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	srv := &server{codes: []int{http.StatusNotFound, http.StatusForbidden}}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+
+	cli, err := New(httpsrv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := cli.Get(context.Background(), "dev", "tag"); !IsNotFound(err) {
+		t.Errorf("expected not found error, %v received", err)
+	}
+	if _, err := cli.Get(context.Background(), "dev", "tag"); !IsForbidden(err) {
+		t.Errorf("expected forbidden error, %v received", err)
+	}
+
+	if _, err := New(""); err == nil {
+		t.Errorf("expected error for empty address")
+	}
+	if _, err := New(httpsrv.URL, WithRetries(0, 0)); err == nil {
+		t.Errorf("expected error for no attempts")
+	}
+}
+
+func TestClientTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagger-client")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	srv := &server{obj: &imagtagv1.Tag{}}
+	httpsrv := httptest.NewServer(srv)
+	defer httpsrv.Close()
+
+	cli, err := New(httpsrv.URL, WithTokenFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := cli.Get(context.Background(), "dev", "tag"); err == nil {
+		t.Errorf("expected error reading missing token")
+	}
+
+	// tokens are read again on every request.
+	for _, token := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := cli.Get(context.Background(), "dev", "tag"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		req := srv.requests[len(srv.requests)-1]
+		if auth := req.Header.Get("Authorization"); auth != "Bearer "+token {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+	}
+}
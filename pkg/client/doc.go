@@ -0,0 +1,6 @@
+// Package client provides a typed client for the Tag API, see API struct
+// under controllers/api.go. It authenticates with a bearer token, a token
+// file or the credentials of a kube configuration and retries reads failing
+// with server errors, so tools consuming the API don't need to hand-roll
+// http calls.
+package client
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corecli "k8s.io/client-go/kubernetes"
+
+	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// AdoptedImage is a container image of an adopted Deployment and the Tag it
+// is tracked by. Created tells if the Tag has been created by the adoption.
+type AdoptedImage struct {
+	Container string
+	Image     string
+	Tag       *imagtagv1.Tag
+	Created   bool
+}
+
+// Adoption onboards existing Deployments: Tags are created for their images
+// and the Deployments are annotated with the image triggers, so the images
+// are resolved through the Tags without touching the containers.
+type Adoption struct {
+	corcli   corecli.Interface
+	tagcli   tagclient.Interface
+	interval time.Duration
+}
+
+// NewAdoption returns a service to adopt Deployments.
+func NewAdoption(corcli corecli.Interface, tagcli tagclient.Interface) *Adoption {
+	return &Adoption{
+		corcli:   corcli,
+		tagcli:   tagcli,
+		interval: time.Second,
+	}
+}
+
+// Adopt creates a Tag for every container image of the Deployment not tracked
+// by a Tag yet, named after the container, and annotates the Deployment with
+// the image triggers. Tags referred by an image, by name or by the image they
+// are imported from, are reused. Nothing is created if a Tag named after a
+// container already exists and imports another image. Created Tags are cached
+// if cache is set. With wait the Tags are awaited to be imported, until the
+// context ends, before the Deployment is annotated so it only moves once all
+// its images resolve. Adopting a Deployment again is harmless.
+func (a *Adoption) Adopt(
+	ctx context.Context, namespace, name string, cache, wait bool,
+) ([]AdoptedImage, error) {
+	dep, err := a.corcli.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := a.tagcli.ImagesV1().Tags(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var tags []*imagtagv1.Tag
+	for i := range list.Items {
+		tags = append(tags, &list.Items[i])
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+
+	// we plan everything before creating anything, so a conflict does
+	// not leave half of the images adopted.
+	var adopted []AdoptedImage
+	for _, cont := range dep.Spec.Template.Spec.Containers {
+		img := AdoptedImage{Container: cont.Name, Image: cont.Image}
+		for _, it := range tags {
+			if imageMatchesTag(cont.Image, it, true) {
+				img.Tag = it
+				break
+			}
+		}
+
+		if img.Tag == nil {
+			for _, it := range tags {
+				if it.Name == cont.Name {
+					return nil, fmt.Errorf(
+						"tag %s already exists and imports %s", it.Name, it.Spec.From,
+					)
+				}
+			}
+			img.Tag = &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: namespace,
+					Name:      cont.Name,
+				},
+				Spec: imagtagv1.TagSpec{
+					From:  cont.Image,
+					Cache: cache,
+				},
+			}
+			img.Created = true
+			tags = append(tags, img.Tag)
+		}
+		adopted = append(adopted, img)
+	}
+
+	for i, img := range adopted {
+		if !img.Created {
+			continue
+		}
+		it, err := a.tagcli.ImagesV1().Tags(namespace).Create(
+			ctx, img.Tag, metav1.CreateOptions{},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error creating tag %s: %w", img.Tag.Name, err)
+		}
+		adopted[i].Tag = it
+	}
+
+	if wait {
+		for i, img := range adopted {
+			it, err := a.waitImport(ctx, img.Tag)
+			if err != nil {
+				return nil, err
+			}
+			adopted[i].Tag = it
+		}
+	}
+
+	if dep.Annotations[TriggersAnnotation] == "*" {
+		return adopted, nil
+	}
+
+	// waiting for imports may take a while, the Deployment is read again
+	// not to run into a conflict.
+	if wait {
+		if dep, err = a.corcli.AppsV1().Deployments(namespace).Get(
+			ctx, name, metav1.GetOptions{},
+		); err != nil {
+			return nil, err
+		}
+	}
+	if dep.Annotations == nil {
+		dep.Annotations = map[string]string{}
+	}
+	dep.Annotations[TriggersAnnotation] = "*"
+	if _, err := a.corcli.AppsV1().Deployments(namespace).Update(
+		ctx, dep, metav1.UpdateOptions{},
+	); err != nil {
+		return nil, fmt.Errorf("error annotating deployment: %w", err)
+	}
+	return adopted, nil
+}
+
+// waitImport waits until the generation in the Tag spec has been imported.
+// Returns an error if the import fails or the context ends first.
+func (a *Adoption) waitImport(ctx context.Context, it *imagtagv1.Tag) (*imagtagv1.Tag, error) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		if it.SpecTagImported() {
+			return it, nil
+		}
+
+		cond := meta.FindStatusCondition(it.Status.Conditions, imagtagv1.ConditionImported)
+		if cond != nil && cond.Status == metav1.ConditionFalse {
+			return nil, fmt.Errorf("error importing tag %s: %s", it.Name, cond.Message)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for tag %s: %w", it.Name, ctx.Err())
+		case <-ticker.C:
+		}
+
+		var err error
+		if it, err = a.tagcli.ImagesV1().Tags(it.Namespace).Get(
+			ctx, it.Name, metav1.GetOptions{},
+		); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestAdopt(t *testing.T) {
+	deployment := func(annotations map[string]string) *appsv1.Deployment {
+		dep := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "prod",
+				Name:        "app",
+				Annotations: annotations,
+			},
+		}
+		dep.Spec.Template.Spec.Containers = []corev1.Container{
+			{Name: "app", Image: "quay.io/company/app:latest"},
+			{Name: "proxy", Image: "envoy"},
+			{Name: "sidecar", Image: "centos:8"},
+			{Name: "copy", Image: "quay.io/company/app:latest"},
+		}
+		return dep
+	}
+	envoy := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "envoy"},
+		Spec:       imagtagv1.TagSpec{From: "envoyproxy/envoy:v1.18"},
+	}
+	centos := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "os"},
+		Spec:       imagtagv1.TagSpec{From: "docker.io/library/centos:8"},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		dep      *appsv1.Deployment
+		tags     []runtime.Object
+		wait     bool
+		result   string
+		expected []AdoptedImage
+		err      string
+	}{
+		{
+			name: "adopted",
+			dep:  deployment(nil),
+			tags: []runtime.Object{envoy, centos},
+			expected: []AdoptedImage{
+				{Container: "app", Image: "quay.io/company/app:latest", Created: true},
+				{Container: "proxy", Image: "envoy"},
+				{Container: "sidecar", Image: "centos:8"},
+				{Container: "copy", Image: "quay.io/company/app:latest"},
+			},
+		},
+		{
+			name: "adopted again",
+			dep:  deployment(map[string]string{TriggersAnnotation: "*"}),
+			tags: []runtime.Object{
+				envoy,
+				centos,
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+					Spec:       imagtagv1.TagSpec{From: "quay.io/company/app:latest"},
+				},
+			},
+			expected: []AdoptedImage{
+				{Container: "app", Image: "quay.io/company/app:latest"},
+				{Container: "proxy", Image: "envoy"},
+				{Container: "sidecar", Image: "centos:8"},
+				{Container: "copy", Image: "quay.io/company/app:latest"},
+			},
+		},
+		{
+			name: "name taken",
+			dep:  deployment(nil),
+			tags: []runtime.Object{
+				envoy,
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "sidecar"},
+					Spec:       imagtagv1.TagSpec{From: "fedora:34"},
+				},
+			},
+			err: "tag sidecar already exists and imports fedora:34",
+		},
+		{
+			name:   "imported",
+			dep:    deployment(nil),
+			tags:   []runtime.Object{envoy, centos},
+			wait:   true,
+			result: "imported",
+			expected: []AdoptedImage{
+				{Container: "app", Image: "quay.io/company/app:latest", Created: true},
+				{Container: "proxy", Image: "envoy"},
+				{Container: "sidecar", Image: "centos:8"},
+				{Container: "copy", Image: "quay.io/company/app:latest"},
+			},
+		},
+		{
+			name:   "import failed",
+			dep:    deployment(nil),
+			tags:   []runtime.Object{envoy, centos},
+			wait:   true,
+			result: "failed",
+			err:    "error importing tag app: unauthorized",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// tags already there are imported, the ones created
+			// are imported, or fail to, right away.
+			tags := []runtime.Object{}
+			for _, obj := range tt.tags {
+				it := obj.(*imagtagv1.Tag).DeepCopy()
+				it.Status.References = []imagtagv1.HashReference{
+					{ImageReference: it.Spec.From + "@sha256:0"},
+				}
+				tags = append(tags, it)
+			}
+			tagcli := tagfake.NewSimpleClientset(tags...)
+			tagcli.PrependReactor(
+				"create", "tags",
+				func(action clienttesting.Action) (bool, runtime.Object, error) {
+					it := action.(clienttesting.CreateAction).GetObject().(*imagtagv1.Tag)
+					switch tt.result {
+					case "imported":
+						it.Status.References = []imagtagv1.HashReference{
+							{ImageReference: it.Spec.From + "@sha256:1"},
+						}
+					case "failed":
+						it.SetCondition(
+							imagtagv1.ConditionImported,
+							metav1.ConditionFalse,
+							imagtagv1.ReasonImportFailed,
+							"unauthorized",
+						)
+					}
+					return false, nil, nil
+				},
+			)
+			corcli := corfake.NewSimpleClientset(tt.dep)
+
+			svc := NewAdoption(corcli, tagcli)
+			svc.interval = 10 * time.Millisecond
+			adopted, err := svc.Adopt(ctx, "prod", "app", true, tt.wait)
+
+			dep, derr := corcli.AppsV1().Deployments("prod").Get(ctx, "app", metav1.GetOptions{})
+			if derr != nil {
+				t.Fatalf("unexpected error: %s", derr)
+			}
+			annotated := dep.Annotations[TriggersAnnotation] == "*"
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, %v received", tt.err, err)
+				}
+				if annotated {
+					t.Errorf("deployment annotated despite the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !annotated {
+				t.Errorf("expected deployment to be annotated: %v", dep.Annotations)
+			}
+
+			tagnames := map[string]string{
+				"app":     "app",
+				"proxy":   "envoy",
+				"sidecar": "os",
+				"copy":    "app",
+			}
+			var found []AdoptedImage
+			for _, img := range adopted {
+				if img.Tag.Name != tagnames[img.Container] {
+					t.Errorf("container %s adopted by tag %s", img.Container, img.Tag.Name)
+				}
+				if img.Created && !img.Tag.Spec.Cache {
+					t.Errorf("expected tag %s to be cached", img.Tag.Name)
+				}
+				if tt.wait && img.Tag.CurrentReferenceForTag() == "" {
+					t.Errorf("expected tag %s to be imported", img.Tag.Name)
+				}
+				img.Tag = nil
+				found = append(found, img)
+			}
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, found)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// ImportAuditTagLabel is set, on ImportAudits, to the name of the Tag they
+// belong to. Tags whose names are not valid label values are not labeled.
+const ImportAuditTagLabel = "image-tag-name"
+
+// Audit records every Tag import attempt as an ImportAudit object, keeping a
+// queryable history of imports beyond the generations kept in the Tag status.
+// Old ImportAudits are pruned according to the configured retention.
+type Audit struct {
+	sync.Mutex
+	cfg    config.ImportAudit
+	tagcli tagclient.Interface
+	now    func() time.Time
+}
+
+// NewAudit returns an import audit handler.
+func NewAudit(tagcli tagclient.Interface) *Audit {
+	return &Audit{
+		cfg:    config.Default().ImportAudit,
+		tagcli: tagcli,
+		now:    time.Now,
+	}
+}
+
+// ApplyConfig applies the import audit configuration.
+func (a *Audit) ApplyConfig(cfg *config.Config) {
+	a.Lock()
+	defer a.Unlock()
+	a.cfg = cfg.ImportAudit
+}
+
+// config returns the current import audit configuration.
+func (a *Audit) config() config.ImportAudit {
+	a.Lock()
+	defer a.Unlock()
+	return a.cfg
+}
+
+// Record creates an ImportAudit for an import attempt of the generation in
+// the Tag spec started at started. The attempt failed if err is not nil,
+// otherwise hashref is the imported reference. ImportAudits for the Tag are
+// pruned afterwards. Failures are only logged, auditing never fails imports.
+func (a *Audit) Record(
+	ctx context.Context,
+	it *imagtagv1.Tag,
+	started time.Time,
+	hashref imagtagv1.HashReference,
+	err error,
+) {
+	cfg := a.config()
+	if !cfg.Enabled {
+		return
+	}
+
+	audit := &imagtagv1.ImportAudit{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-", it.Name),
+			Namespace:    it.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: imagtagv1.SchemeGroupVersion.String(),
+					Kind:       "Tag",
+					Name:       it.Name,
+					UID:        it.UID,
+				},
+			},
+		},
+		Spec: imagtagv1.ImportAuditSpec{
+			Tag:        it.Name,
+			Generation: it.Spec.Generation,
+			From:       it.Spec.From,
+			Trigger:    it.ImportTrigger(),
+			StartedAt:  metav1.NewTime(started),
+			FinishedAt: metav1.NewTime(a.now()),
+			Succeed:    err == nil,
+		},
+	}
+	if labeled(it) {
+		audit.Labels = map[string]string{ImportAuditTagLabel: it.Name}
+	}
+	if err != nil {
+		audit.Spec.Error = err.Error()
+	} else {
+		audit.Spec.ImageReference = hashref.ImageReference
+	}
+
+	if _, err := a.tagcli.ImagesV1().ImportAudits(it.Namespace).Create(
+		ctx, audit, metav1.CreateOptions{},
+	); err != nil {
+		klog.Errorf("error recording import audit for %s/%s: %s", it.Namespace, it.Name, err)
+		return
+	}
+
+	if err := a.prune(ctx, it, cfg); err != nil {
+		klog.Errorf("error pruning import audits for %s/%s: %s", it.Namespace, it.Name, err)
+	}
+}
+
+// labeled returns true if ImportAudits of the Tag carry ImportAuditTagLabel.
+func labeled(it *imagtagv1.Tag) bool {
+	return len(validation.IsValidLabelValue(it.Name)) == 0
+}
+
+// ListImportAudits returns the ImportAudits recorded for the Tag, in no
+// particular order.
+func ListImportAudits(
+	ctx context.Context, tagcli tagclient.Interface, it *imagtagv1.Tag,
+) ([]imagtagv1.ImportAudit, error) {
+	opts := metav1.ListOptions{}
+	if labeled(it) {
+		opts.LabelSelector = labels.SelectorFromSet(
+			labels.Set{ImportAuditTagLabel: it.Name},
+		).String()
+	}
+
+	list, err := tagcli.ImagesV1().ImportAudits(it.Namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var audits []imagtagv1.ImportAudit
+	for _, audit := range list.Items {
+		if audit.Spec.Tag == it.Name {
+			audits = append(audits, audit)
+		}
+	}
+	return audits, nil
+}
+
+// prune deletes the Tag ImportAudits older than the retention period and
+// the oldest ones beyond the maximum number of ImportAudits per Tag.
+func (a *Audit) prune(ctx context.Context, it *imagtagv1.Tag, cfg config.ImportAudit) error {
+	audits, err := ListImportAudits(ctx, a.tagcli, it)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(audits, func(i, j int) bool {
+		return audits[i].Spec.StartedAt.After(audits[j].Spec.StartedAt.Time)
+	})
+
+	cli := a.tagcli.ImagesV1().ImportAudits(it.Namespace)
+	oldest := a.now().Add(-cfg.Retention)
+	for i, audit := range audits {
+		if i < cfg.MaxPerTag && audit.Spec.StartedAt.After(oldest) {
+			continue
+		}
+		klog.V(4).Infof("pruning import audit %s/%s", audit.Namespace, audit.Name)
+		if err := cli.Delete(ctx, audit.Name, metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestAuditRecord(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	audit := func(name, tag string, started time.Time) runtime.Object {
+		return &imagtagv1.ImportAudit{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "ns",
+				Labels:    map[string]string{ImportAuditTagLabel: tag},
+			},
+			Spec: imagtagv1.ImportAuditSpec{
+				Tag:       tag,
+				StartedAt: metav1.NewTime(started),
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		disabled  bool
+		maxPerTag int
+		err       error
+		objects   []runtime.Object
+		remaining []string
+	}{
+		{
+			name:      "disabled",
+			disabled:  true,
+			maxPerTag: 10,
+		},
+		{
+			name:      "successful import",
+			maxPerTag: 10,
+		},
+		{
+			name:      "failed import",
+			maxPerTag: 10,
+			err:       fmt.Errorf("manifest unknown"),
+		},
+		{
+			name:      "retention",
+			maxPerTag: 10,
+			objects: []runtime.Object{
+				audit("expired", "mytag", now.Add(-48*time.Hour)),
+				audit("recent", "mytag", now.Add(-time.Hour)),
+				audit("other-tag", "othertag", now.Add(-48*time.Hour)),
+			},
+			remaining: []string{"recent", "other-tag"},
+		},
+		{
+			name:      "max per tag",
+			maxPerTag: 2,
+			objects: []runtime.Object{
+				audit("oldest", "mytag", now.Add(-2*time.Hour)),
+				audit("newest", "mytag", now.Add(-time.Hour)),
+			},
+			remaining: []string{"newest"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tagcli := tagfake.NewSimpleClientset(tt.objects...)
+			cfg := config.Default()
+			cfg.ImportAudit.Enabled = !tt.disabled
+			cfg.ImportAudit.Retention = 24 * time.Hour
+			cfg.ImportAudit.MaxPerTag = tt.maxPerTag
+
+			svc := NewAudit(tagcli)
+			svc.ApplyConfig(cfg)
+			svc.now = func() time.Time { return now }
+
+			it := &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mytag",
+					Namespace: "ns",
+				},
+				Spec: imagtagv1.TagSpec{
+					From:       "quay.io/repo/image:latest",
+					Generation: 1,
+				},
+			}
+			it.SetImportTrigger(imagtagv1.ImportTriggerWebhook)
+			hashref := imagtagv1.HashReference{
+				ImageReference: "quay.io/repo/image@sha256:abc",
+			}
+			svc.Record(ctx, it, now.Add(-time.Minute), hashref, tt.err)
+
+			list, err := tagcli.ImagesV1().ImportAudits("ns").List(
+				ctx, metav1.ListOptions{},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var recorded *imagtagv1.ImportAudit
+			names := map[string]bool{}
+			for i, audit := range list.Items {
+				if audit.Name == "" {
+					recorded = &list.Items[i]
+					continue
+				}
+				names[audit.Name] = true
+			}
+
+			if tt.disabled {
+				if len(list.Items) != 0 {
+					t.Errorf("audits recorded while disabled: %+v", list.Items)
+				}
+				return
+			}
+
+			if recorded == nil {
+				t.Fatal("import audit not recorded")
+			}
+			spec := recorded.Spec
+			if spec.Trigger != imagtagv1.ImportTriggerWebhook || spec.Generation != 1 {
+				t.Errorf("unexpected audit: %+v", spec)
+			}
+			if spec.Succeed != (tt.err == nil) {
+				t.Errorf("unexpected audit result: %+v", spec)
+			}
+			if tt.err != nil && spec.Error != tt.err.Error() {
+				t.Errorf("error not recorded: %+v", spec)
+			}
+			if tt.err == nil && spec.ImageReference != hashref.ImageReference {
+				t.Errorf("reference not recorded: %+v", spec)
+			}
+
+			if len(names) != len(tt.remaining) {
+				t.Errorf("expected %v to remain, %v found", tt.remaining, names)
+			}
+			for _, name := range tt.remaining {
+				if !names[name] {
+					t.Errorf("audit %s pruned", name)
+				}
+			}
+		})
+	}
+}
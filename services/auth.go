@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corecli "k8s.io/client-go/kubernetes"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// Auth authenticates and authorizes external callers against the cluster.
+// Bearer tokens are validated through TokenReview and access to Tags is
+// checked through SubjectAccessReview so callers are subject to the same
+// RBAC rules they would be if accessing Tags through the api server.
+type Auth struct {
+	corcli corecli.Interface
+}
+
+// NewAuth returns a new Auth service.
+func NewAuth(corcli corecli.Interface) *Auth {
+	return &Auth{corcli: corcli}
+}
+
+// Authenticate validates the provided bearer token, returning the info about
+// the user it belongs to.
+func (a *Auth) Authenticate(ctx context.Context, token string) (authnv1.UserInfo, error) {
+	var zero authnv1.UserInfo
+	if token == "" {
+		return zero, fmt.Errorf("empty token")
+	}
+
+	review, err := a.corcli.AuthenticationV1().TokenReviews().Create(
+		ctx,
+		&authnv1.TokenReview{
+			Spec: authnv1.TokenReviewSpec{
+				Token: token,
+			},
+		},
+		metav1.CreateOptions{},
+	)
+	if err != nil {
+		return zero, fmt.Errorf("unable to review token: %w", err)
+	}
+
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return zero, fmt.Errorf("invalid token: %s", review.Status.Error)
+		}
+		return zero, fmt.Errorf("invalid token")
+	}
+	return review.Status.User, nil
+}
+
+// Authorize checks if user is allowed to perform verb on Tags. An empty name
+// means all Tags in the namespace and an empty namespace means all namespaces.
+func (a *Auth) Authorize(
+	ctx context.Context, user authnv1.UserInfo, verb, namespace, name string,
+) (bool, error) {
+	extra := map[string]authzv1.ExtraValue{}
+	for key, val := range user.Extra {
+		extra[key] = authzv1.ExtraValue(val)
+	}
+
+	review, err := a.corcli.AuthorizationV1().SubjectAccessReviews().Create(
+		ctx,
+		&authzv1.SubjectAccessReview{
+			Spec: authzv1.SubjectAccessReviewSpec{
+				User:   user.Username,
+				UID:    user.UID,
+				Groups: user.Groups,
+				Extra:  extra,
+				ResourceAttributes: &authzv1.ResourceAttributes{
+					Group:     imagtagv1.SchemeGroupVersion.Group,
+					Version:   imagtagv1.SchemeGroupVersion.Version,
+					Resource:  "tags",
+					Verb:      verb,
+					Namespace: namespace,
+					Name:      name,
+				},
+			},
+		},
+		metav1.CreateOptions{},
+	)
+	if err != nil {
+		return false, fmt.Errorf("unable to review access: %w", err)
+	}
+	return review.Status.Allowed, nil
+}
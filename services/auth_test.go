@@ -0,0 +1,121 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	authzv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestAuthAuthenticate(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		token string
+		user  string
+		err   string
+	}{
+		{
+			name:  "valid token",
+			token: "valid",
+			user:  "system:serviceaccount:default:default",
+		},
+		{
+			name:  "invalid token",
+			token: "invalid",
+			err:   "invalid token: token expired",
+		},
+		{
+			name: "empty token",
+			err:  "empty token",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			corcli := corefake.NewSimpleClientset()
+			corcli.PrependReactor(
+				"create",
+				"tokenreviews",
+				func(action clienttesting.Action) (bool, runtime.Object, error) {
+					obj := action.(clienttesting.CreateAction).GetObject()
+					review := obj.(*authnv1.TokenReview)
+					if review.Spec.Token == "valid" {
+						review.Status.Authenticated = true
+						review.Status.User.Username = "system:serviceaccount:default:default"
+					} else {
+						review.Status.Error = "token expired"
+					}
+					return true, review, nil
+				},
+			)
+
+			user, err := NewAuth(corcli).Authenticate(context.Background(), tt.token)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			if user.Username != tt.user {
+				t.Errorf("expected user %q, %q received", tt.user, user.Username)
+			}
+		})
+	}
+}
+
+func TestAuthAuthorize(t *testing.T) {
+	corcli := corefake.NewSimpleClientset()
+	corcli.PrependReactor(
+		"create",
+		"subjectaccessreviews",
+		func(action clienttesting.Action) (bool, runtime.Object, error) {
+			obj := action.(clienttesting.CreateAction).GetObject()
+			review := obj.(*authzv1.SubjectAccessReview)
+			attrs := review.Spec.ResourceAttributes
+			if attrs.Group != "images.io" || attrs.Resource != "tags" {
+				return true, nil, fmt.Errorf("unexpected resource %+v", attrs)
+			}
+			review.Status.Allowed = review.Spec.User == "admin" ||
+				(attrs.Verb == "get" && attrs.Namespace == "default")
+			return true, review, nil
+		},
+	)
+
+	auth := NewAuth(corcli)
+	for _, tt := range []struct {
+		user      string
+		verb      string
+		namespace string
+		allowed   bool
+	}{
+		{user: "admin", verb: "update", namespace: "default", allowed: true},
+		{user: "user", verb: "get", namespace: "default", allowed: true},
+		{user: "user", verb: "update", namespace: "default"},
+		{user: "user", verb: "get", namespace: "other"},
+	} {
+		allowed, err := auth.Authorize(
+			context.Background(),
+			authnv1.UserInfo{Username: tt.user},
+			tt.verb,
+			tt.namespace,
+			"",
+		)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%+v: expected allowed %v", tt, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// RegistryUnavailableError is returned when imports from a registry are
+// short-circuited by the circuit breaker.
+type RegistryUnavailableError struct {
+	Registry string
+	Since    time.Time
+}
+
+// Error returns the error message.
+func (r *RegistryUnavailableError) Error() string {
+	return fmt.Sprintf(
+		"registry %s failing since %s, import short-circuited",
+		r.Registry, r.Since.UTC().Format(time.RFC3339),
+	)
+}
+
+// Reason returns the reason used in the Tag Imported condition.
+func (r *RegistryUnavailableError) Reason() string {
+	return "RegistryUnavailable"
+}
+
+// registryUnavailable returns true if err means the registry itself is not
+// working, i.e. it can't be reached or it fails with server side errors.
+// Errors such as refused credentials or unknown manifests are not caused
+// by the registry being down.
+func registryUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "error pinging docker registry") ||
+		strings.Contains(msg, "unexpected http status: 5") ||
+		strings.Contains(msg, "status code 5")
+}
+
+// breakerState holds the circuit state for a registry. FailingSince is zero
+// while the registry works.
+type breakerState struct {
+	failingSince time.Time
+	open         bool
+	probedAt     time.Time
+}
+
+// Breaker is a circuit breaker per registry. Once a registry has been failing
+// for longer than the configured period its circuit opens and imports from it
+// are short-circuited, not taking time from the workers importing from
+// healthy registries. While open one import every probe interval is let
+// through, the circuit closes once an import succeeds.
+type Breaker struct {
+	sync.Mutex
+	states    map[string]*breakerState
+	openAfter time.Duration
+	interval  time.Duration
+	now       func() time.Time
+}
+
+// NewBreaker returns a circuit breaker using the default configuration.
+func NewBreaker() *Breaker {
+	b := &Breaker{
+		states: map[string]*breakerState{},
+		now:    time.Now,
+	}
+	b.ApplyConfig(config.Default())
+	return b
+}
+
+// ApplyConfig applies the circuit breaker periods. Disabling the circuit
+// breaker closes all circuits.
+func (b *Breaker) ApplyConfig(cfg *config.Config) {
+	b.Lock()
+	defer b.Unlock()
+	b.openAfter = cfg.CircuitBreaker.OpenAfter
+	b.interval = cfg.CircuitBreaker.ProbeInterval
+	if b.openAfter > 0 {
+		return
+	}
+	for registry := range b.states {
+		metrics.RegistryCircuitOpen.WithLabelValues(registry).Set(0)
+	}
+	b.states = map[string]*breakerState{}
+}
+
+// Allow returns a RegistryUnavailableError if imports from registry must be
+// short-circuited. If the circuit is open but a probe is due the import is
+// allowed, other imports are short-circuited until the next probe.
+func (b *Breaker) Allow(registry string) error {
+	b.Lock()
+	defer b.Unlock()
+	state, ok := b.states[registry]
+	if !ok || !state.open {
+		return nil
+	}
+
+	now := b.now()
+	if now.Sub(state.probedAt) >= b.interval {
+		klog.Infof("probing registry %s", registry)
+		state.probedAt = now
+		return nil
+	}
+	return &RegistryUnavailableError{
+		Registry: registry,
+		Since:    state.failingSince,
+	}
+}
+
+// Check returns a RegistryUnavailableError if the circuit of registry is
+// open. Unlike Allow it never lets a probe through, it only reads the state.
+func (b *Breaker) Check(registry string) error {
+	b.Lock()
+	defer b.Unlock()
+	state, ok := b.states[registry]
+	if !ok || !state.open {
+		return nil
+	}
+	return &RegistryUnavailableError{
+		Registry: registry,
+		Since:    state.failingSince,
+	}
+}
+
+// Success records that an import from registry has succeeded, closing its
+// circuit.
+func (b *Breaker) Success(registry string) {
+	b.Lock()
+	defer b.Unlock()
+	state, ok := b.states[registry]
+	if !ok {
+		return
+	}
+	if state.open {
+		klog.Infof("registry %s is back, closing circuit", registry)
+		metrics.RegistryCircuitOpen.WithLabelValues(registry).Set(0)
+	}
+	delete(b.states, registry)
+}
+
+// Failure records that reading from registry has failed with err. Only errors
+// meaning the registry is unavailable are taken into account. The circuit
+// opens once the registry has been failing for long enough.
+func (b *Breaker) Failure(registry string, err error) {
+	if !registryUnavailable(err) {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.openAfter <= 0 {
+		return
+	}
+
+	now := b.now()
+	state, ok := b.states[registry]
+	if !ok {
+		state = &breakerState{failingSince: now}
+		b.states[registry] = state
+	}
+	if state.open || now.Sub(state.failingSince) < b.openAfter {
+		return
+	}
+
+	klog.Warningf(
+		"registry %s failing since %s, opening circuit: %s",
+		registry, state.failingSince.UTC().Format(time.RFC3339), err,
+	)
+	state.open = true
+	state.probedAt = now
+	metrics.RegistryCircuitOpen.WithLabelValues(registry).Set(1)
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+func TestRegistryUnavailable(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name: "nil error",
+		},
+		{
+			name: "unknown manifest",
+			err:  errors.New("manifest unknown: manifest unknown"),
+		},
+		{
+			name: "unauthorized",
+			err:  errors.New("unable to retrieve auth token: 401 unauthorized"),
+		},
+		{
+			name: "network error",
+			err: fmt.Errorf(
+				"wrapped: %w", &net.OpError{Op: "dial", Err: errors.New("refused")},
+			),
+			expected: true,
+		},
+		{
+			name:     "ping failure",
+			err:      errors.New("error pinging docker registry quay.io: timeout"),
+			expected: true,
+		},
+		{
+			name:     "server error",
+			err:      errors.New("Error reading manifest latest: unexpected http status: 503"),
+			expected: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := registryUnavailable(tt.err); res != tt.expected {
+				t.Errorf("expected %v, received %v", tt.expected, res)
+			}
+		})
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	breaker := NewBreaker()
+	breaker.now = func() time.Time { return now }
+
+	down := errors.New("error pinging docker registry quay.io: timeout")
+	breaker.Failure("quay.io", down)
+	breaker.Failure("quay.io", errors.New("manifest unknown"))
+	if err := breaker.Allow("quay.io"); err != nil {
+		t.Fatalf("circuit open right after the first failure: %s", err)
+	}
+
+	now = now.Add(5 * time.Minute)
+	breaker.Failure("quay.io", down)
+	err := breaker.Allow("quay.io")
+	var unavailable *RegistryUnavailableError
+	if !errors.As(err, &unavailable) {
+		t.Fatalf("expected registry unavailable error, received %v", err)
+	}
+	if unavailable.Reason() != "RegistryUnavailable" {
+		t.Errorf("unexpected reason %s", unavailable.Reason())
+	}
+	if err := breaker.Allow("docker.io"); err != nil {
+		t.Errorf("unexpected error for other registry: %s", err)
+	}
+
+	// one probe is allowed every probe interval.
+	now = now.Add(time.Minute)
+	if err := breaker.Allow("quay.io"); err != nil {
+		t.Errorf("expected probe to be allowed: %s", err)
+	}
+	if err := breaker.Allow("quay.io"); err == nil {
+		t.Errorf("expected only one probe to be allowed")
+	}
+
+	breaker.Success("quay.io")
+	if err := breaker.Allow("quay.io"); err != nil {
+		t.Errorf("expected circuit to be closed: %s", err)
+	}
+
+	// disabling the breaker closes open circuits.
+	breaker.Failure("quay.io", down)
+	now = now.Add(10 * time.Minute)
+	breaker.Failure("quay.io", down)
+	if err := breaker.Allow("quay.io"); err == nil {
+		t.Errorf("expected circuit to be open")
+	}
+	cfg := config.Default()
+	cfg.CircuitBreaker.OpenAfter = 0
+	breaker.ApplyConfig(cfg)
+	if err := breaker.Allow("quay.io"); err != nil {
+		t.Errorf("expected circuit to be closed: %s", err)
+	}
+	breaker.Failure("quay.io", down)
+	now = now.Add(10 * time.Minute)
+	breaker.Failure("quay.io", down)
+	if err := breaker.Allow("quay.io"); err != nil {
+		t.Errorf("expected disabled breaker to allow: %s", err)
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// MemoryBudget limits how many bytes of layers are held in memory at once
+// while mirroring, across all imports. Layers are streamed, only the chunks
+// being uploaded to the cache registry are buffered, each buffer takes its
+// size from the budget before being allocated and gives it back once the
+// upload is done. A buffer bigger than the whole budget is only allowed when
+// nothing else is in flight.
+type MemoryBudget struct {
+	mtx   sync.Mutex
+	limit int64
+	inuse int64
+	freed chan struct{}
+}
+
+// NewMemoryBudget returns a memory budget with the default limit.
+func NewMemoryBudget() *MemoryBudget {
+	b := &MemoryBudget{freed: make(chan struct{})}
+	b.ApplyConfig(config.Default())
+	return b
+}
+
+// ApplyConfig sets the budget limit, zero disables it. Buffers already
+// allocated are kept even if the new limit is lower.
+func (b *MemoryBudget) ApplyConfig(cfg *config.Config) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.limit = cfg.MaxInflightBytes
+	b.notify()
+}
+
+// notify wakes up everybody waiting for the budget. Must be called with the
+// lock held.
+func (b *MemoryBudget) notify() {
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// Acquire blocks until size bytes fit in the budget or the context is done.
+func (b *MemoryBudget) Acquire(ctx context.Context, size int64) error {
+	for {
+		b.mtx.Lock()
+		if b.limit == 0 || b.inuse == 0 || b.inuse+size <= b.limit {
+			b.inuse += size
+			metrics.InflightBytes.Set(float64(b.inuse))
+			b.mtx.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mtx.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release gives size bytes back to the budget.
+func (b *MemoryBudget) Release(size int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.inuse -= size
+	metrics.InflightBytes.Set(float64(b.inuse))
+	b.notify()
+}
+
+// usage returns the bytes in use and the current limit.
+func (b *MemoryBudget) usage() (int64, int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.inuse, b.limit
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget()
+	cfg := config.Default()
+	cfg.MaxInflightBytes = 100
+	budget.ApplyConfig(cfg)
+
+	ctx := context.Background()
+	if err := budget.Acquire(ctx, 60); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := budget.Acquire(ctx, 40); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// budget is full, we expect to time out.
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := budget.Acquire(tctx, 10); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, %v received", err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- budget.Acquire(ctx, 50)
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired while budget is full: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.Release(60)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not acquired after release")
+	}
+	if inuse, limit := budget.usage(); inuse != 90 || limit != 100 {
+		t.Errorf("expected 90 bytes out of 100 in use, %d of %d found", inuse, limit)
+	}
+
+	budget.Release(90)
+	// a buffer bigger than the budget is allowed when nothing is in flight.
+	if err := budget.Acquire(ctx, 200); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	budget.Release(200)
+
+	// disabling the budget wakes up everybody waiting.
+	if err := budget.Acquire(ctx, 100); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	go func() {
+		acquired <- budget.Acquire(ctx, 100)
+	}()
+	cfg.MaxInflightBytes = 0
+	budget.ApplyConfig(cfg)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not acquired after disabling the budget")
+	}
+}
@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// These are the annotations and labels used for canary rollouts. A Deployment
+// annotated with the canary percentage rolls new generations out through a
+// canary Deployment before switching all its replicas.
+const (
+	// CanaryAnnotation holds the percentage, from 1 to 99, of the pods that
+	// should run the new generation during the canary phase.
+	CanaryAnnotation = "image-tag-canary"
+	// CanaryDurationAnnotation holds how long the canary must be ready before
+	// the switch completes, defaults to DefaultCanaryDuration.
+	CanaryDurationAnnotation = "image-tag-canary-duration"
+	// CanaryLabel is set, on canary Deployments and their pods, to the name
+	// of the Deployment being rolled out.
+	CanaryLabel = "image-tag-canary"
+	// canaryReadyAnnotation records, on the canary Deployment, since when
+	// all its replicas are ready.
+	canaryReadyAnnotation = "image-tag-canary-ready-since"
+)
+
+// DefaultCanaryDuration is how long a canary must be ready, by default, before
+// the switch to the new generation completes.
+const DefaultCanaryDuration = 5 * time.Minute
+
+// canarySettings returns the canary percentage and duration configured on the
+// deployment. The boolean is false if the deployment does not use canaries.
+func canarySettings(dep *appsv1.Deployment) (int32, time.Duration, bool, error) {
+	value, ok := dep.Annotations[CanaryAnnotation]
+	if !ok {
+		return 0, 0, false, nil
+	}
+
+	pct, err := strconv.Atoi(value)
+	if err != nil || pct < 1 || pct > 99 {
+		return 0, 0, false, fmt.Errorf("invalid canary percentage %q", value)
+	}
+
+	duration := DefaultCanaryDuration
+	if value, ok := dep.Annotations[CanaryDurationAnnotation]; ok {
+		if duration, err = time.ParseDuration(value); err != nil {
+			return 0, 0, false, fmt.Errorf("invalid canary duration %q", value)
+		}
+	}
+	return int32(pct), duration, true, nil
+}
+
+// canaryName returns the name of the canary Deployment for a deployment.
+func canaryName(dep *appsv1.Deployment) string {
+	return fmt.Sprintf("%s-canary", dep.Name)
+}
+
+// canaryReplicas returns how many replicas the canary needs so it runs pct
+// percent of all pods, the deployment keeps all its replicas during the
+// canary phase. At least one canary replica is always run.
+func canaryReplicas(dep *appsv1.Deployment, pct int32) int32 {
+	replicas := int32(1)
+	if dep.Spec.Replicas != nil {
+		replicas = *dep.Spec.Replicas
+	}
+
+	canary := (replicas*pct + (100 - pct) - 1) / (100 - pct)
+	if canary < 1 {
+		return 1
+	}
+	return canary
+}
+
+// canaryDeployment returns the canary for a deployment. It is a copy of the
+// deployment whose pods point to the provided annotations (tag references)
+// and are labeled with CanaryLabel. Pods keep the deployment labels so they
+// are reached through the same services. The canary is owned by the
+// deployment so it is removed if the deployment is.
+func canaryDeployment(
+	dep *appsv1.Deployment, annotations map[string]string, replicas int32,
+) *appsv1.Deployment {
+	ctrl := true
+	canary := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        canaryName(dep),
+			Namespace:   dep.Namespace,
+			Labels:      map[string]string{CanaryLabel: dep.Name},
+			Annotations: map[string]string{"image-tag": "true"},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       dep.Name,
+					UID:        dep.UID,
+					Controller: &ctrl,
+				},
+			},
+		},
+		Spec: *dep.Spec.DeepCopy(),
+	}
+	if dep.Annotations[TriggersAnnotation] == "*" {
+		canary.Annotations[TriggersAnnotation] = "*"
+	}
+	for k, v := range dep.Labels {
+		canary.Labels[k] = v
+	}
+	canary.Labels[CanaryLabel] = dep.Name
+
+	canary.Spec.Replicas = &replicas
+	canary.Spec.Paused = false
+	if canary.Spec.Selector == nil {
+		canary.Spec.Selector = &metav1.LabelSelector{}
+	}
+	if canary.Spec.Selector.MatchLabels == nil {
+		canary.Spec.Selector.MatchLabels = map[string]string{}
+	}
+	canary.Spec.Selector.MatchLabels[CanaryLabel] = dep.Name
+
+	if canary.Spec.Template.Labels == nil {
+		canary.Spec.Template.Labels = map[string]string{}
+	}
+	canary.Spec.Template.Labels[CanaryLabel] = dep.Name
+
+	canary.Spec.Template.Annotations = map[string]string{}
+	for k, v := range annotations {
+		canary.Spec.Template.Annotations[k] = v
+	}
+	return canary
+}
+
+// canaryRollout drives the canary phase of a deployment moving to the provided
+// annotations (tag references). The canary Deployment is created, or updated
+// if the references changed, and once all its replicas have been ready for
+// the canary duration true is returned, meaning the switch may complete.
+func (d *Deployment) canaryRollout(
+	ctx context.Context,
+	dep *appsv1.Deployment,
+	annotations map[string]string,
+	pct int32,
+	duration time.Duration,
+) (bool, error) {
+	replicas := canaryReplicas(dep, pct)
+	desired := canaryDeployment(dep, annotations, replicas)
+
+	cli := d.corcli.AppsV1().Deployments(dep.Namespace)
+	canary, err := d.deplis.Deployments(dep.Namespace).Get(desired.Name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return false, err
+		}
+		klog.Infof("creating canary %s/%s", desired.Namespace, desired.Name)
+		if _, err := cli.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return false, fmt.Errorf("error creating canary: %w", err)
+		}
+		return false, nil
+	}
+
+	if !metav1.IsControlledBy(canary, dep) {
+		return false, fmt.Errorf("deployment %s not owned by %s", canary.Name, dep.Name)
+	}
+
+	// references or replicas changed while the canary was running, the
+	// canary starts over.
+	if !canaryUpToDate(canary, desired) {
+		canary = canary.DeepCopy()
+		canary.Spec = desired.Spec
+		delete(canary.Annotations, canaryReadyAnnotation)
+		if _, err := cli.Update(ctx, canary, metav1.UpdateOptions{}); err != nil {
+			return false, fmt.Errorf("error updating canary: %w", err)
+		}
+		return false, nil
+	}
+
+	ready := canary.Status.ObservedGeneration >= canary.Generation &&
+		canary.Status.UpdatedReplicas >= replicas &&
+		canary.Status.ReadyReplicas >= replicas
+	since, recorded := canary.Annotations[canaryReadyAnnotation]
+	if !ready {
+		if !recorded {
+			return false, nil
+		}
+		canary = canary.DeepCopy()
+		delete(canary.Annotations, canaryReadyAnnotation)
+		_, err := cli.Update(ctx, canary, metav1.UpdateOptions{})
+		return false, err
+	}
+
+	if !recorded {
+		canary = canary.DeepCopy()
+		canary.Annotations[canaryReadyAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		_, err := cli.Update(ctx, canary, metav1.UpdateOptions{})
+		return false, err
+	}
+
+	readySince, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return false, fmt.Errorf("invalid canary ready time %q: %w", since, err)
+	}
+	return time.Since(readySince) >= duration, nil
+}
+
+// canaryUpToDate returns true if the canary runs the desired references with
+// the desired number of replicas.
+func canaryUpToDate(canary, desired *appsv1.Deployment) bool {
+	if canary.Spec.Replicas == nil || *canary.Spec.Replicas != *desired.Spec.Replicas {
+		return false
+	}
+	cur := canary.Spec.Template.Annotations
+	if len(cur) != len(desired.Spec.Template.Annotations) {
+		return false
+	}
+	for k, v := range desired.Spec.Template.Annotations {
+		if cur[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteCanary removes the canary Deployment of a deployment configured for
+// canaries, if any. The canary is only removed once the deployment finished
+// rolling out so the number of pods running the new references never drops.
+func (d *Deployment) deleteCanary(ctx context.Context, dep *appsv1.Deployment) error {
+	if _, ok := dep.Annotations[CanaryAnnotation]; !ok {
+		return nil
+	}
+
+	replicas := int32(1)
+	if dep.Spec.Replicas != nil {
+		replicas = *dep.Spec.Replicas
+	}
+	if dep.Status.ObservedGeneration < dep.Generation ||
+		dep.Status.UpdatedReplicas < replicas ||
+		dep.Status.AvailableReplicas < replicas {
+		return nil
+	}
+
+	canary, err := d.deplis.Deployments(dep.Namespace).Get(canaryName(dep))
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(canary, dep) {
+		return nil
+	}
+
+	klog.Infof("removing canary %s/%s", canary.Namespace, canary.Name)
+	err = d.corcli.AppsV1().Deployments(dep.Namespace).Delete(
+		ctx, canaryName(dep), metav1.DeleteOptions{},
+	)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting canary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	coreinf "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestCanarySettings(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		annotations map[string]string
+		replicas    int32
+		canary      bool
+		expected    int32
+		duration    time.Duration
+		err         string
+	}{
+		{
+			name: "no canary",
+		},
+		{
+			name:        "ten percent",
+			annotations: map[string]string{CanaryAnnotation: "10"},
+			replicas:    9,
+			canary:      true,
+			expected:    1,
+			duration:    DefaultCanaryDuration,
+		},
+		{
+			name: "half with custom duration",
+			annotations: map[string]string{
+				CanaryAnnotation:         "50",
+				CanaryDurationAnnotation: "1m",
+			},
+			replicas: 3,
+			canary:   true,
+			expected: 3,
+			duration: time.Minute,
+		},
+		{
+			name:        "invalid percentage",
+			annotations: map[string]string{CanaryAnnotation: "100"},
+			err:         "invalid canary percentage",
+		},
+		{
+			name: "invalid duration",
+			annotations: map[string]string{
+				CanaryAnnotation:         "10",
+				CanaryDurationAnnotation: "soon",
+			},
+			err: "invalid canary duration",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: tt.annotations,
+				},
+				Spec: appsv1.DeploymentSpec{
+					Replicas: &tt.replicas,
+				},
+			}
+
+			pct, duration, canary, err := canarySettings(dep)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			if canary != tt.canary || duration != tt.duration {
+				t.Errorf("unexpected settings: %v %v", canary, duration)
+			}
+			if !canary {
+				return
+			}
+			if replicas := canaryReplicas(dep, pct); replicas != tt.expected {
+				t.Errorf("expected %d canary replicas, %d found", tt.expected, replicas)
+			}
+		})
+	}
+}
+
+func TestDeploymentCanaryRollout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	replicas := int32(4)
+	deploy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "mydeploy",
+			Namespace: "ns",
+			UID:       "deploy-uid",
+			Annotations: map[string]string{
+				"image-tag":              "true",
+				CanaryAnnotation:         "20",
+				CanaryDurationAnnotation: "1s",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "mydeploy"},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "mydeploy"},
+					Annotations: map[string]string{
+						"mytag": "remoteimage:321",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Image: "mytag",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	tag := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "mytag",
+			Namespace: "ns",
+		},
+		Status: imagtagv1.TagStatus{
+			Generation: 1,
+			References: []imagtagv1.HashReference{
+				{Generation: 1, ImageReference: "remoteimage:123"},
+				{Generation: 0, ImageReference: "remoteimage:321"},
+			},
+		},
+	}
+
+	corcli := fake.NewSimpleClientset(deploy)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	deplis := corinf.Apps().V1().Deployments().Lister()
+
+	tagcli := tagfake.NewSimpleClientset(tag)
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	corinf.Start(ctx.Done())
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		corinf.Apps().V1().Deployments().Informer().HasSynced,
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	svc := NewDeployment(corcli, tagcli, deplis, nil, taglis, nil)
+	deps := corcli.AppsV1().Deployments("ns")
+
+	// waitFor waits until the lister sees the canary in the expected state.
+	waitFor := func(cond func(*appsv1.Deployment) bool) {
+		for ctx.Err() == nil {
+			canary, err := deplis.Deployments("ns").Get("mydeploy-canary")
+			if err == nil && cond(canary) {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatal("timeout waiting for canary")
+	}
+
+	// first pass creates the canary, the deployment is left untouched.
+	if err := svc.Update(ctx, deploy.DeepCopy()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	canary, err := deps.Get(ctx, "mydeploy-canary", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("canary not created: %s", err)
+	}
+	if *canary.Spec.Replicas != 1 {
+		t.Errorf("expected one canary replica, %d found", *canary.Spec.Replicas)
+	}
+	if canary.Spec.Template.Annotations["mytag"] != "remoteimage:123" {
+		t.Errorf("canary not using new reference: %+v", canary.Spec.Template.Annotations)
+	}
+	if canary.Spec.Selector.MatchLabels[CanaryLabel] != "mydeploy" {
+		t.Errorf("canary selector not labeled: %+v", canary.Spec.Selector)
+	}
+	waitFor(func(*appsv1.Deployment) bool { return true })
+
+	// canary pods become ready, readiness is recorded.
+	canary.Status.ReadyReplicas = 1
+	canary.Status.UpdatedReplicas = 1
+	if _, err := deps.Update(ctx, canary, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	waitFor(func(c *appsv1.Deployment) bool { return c.Status.ReadyReplicas == 1 })
+	if err := svc.Update(ctx, deploy.DeepCopy()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	waitFor(func(c *appsv1.Deployment) bool {
+		_, ok := c.Annotations[canaryReadyAnnotation]
+		return ok
+	})
+
+	cur, err := deps.Get(ctx, "mydeploy", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cur.Spec.Template.Annotations["mytag"] != "remoteimage:321" {
+		t.Errorf("deployment switched before canary duration")
+	}
+
+	// after the canary duration the deployment is switched.
+	time.Sleep(time.Second)
+	if err := svc.Update(ctx, deploy.DeepCopy()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cur, err = deps.Get(ctx, "mydeploy", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cur.Spec.Template.Annotations["mytag"] != "remoteimage:123" {
+		t.Errorf("deployment not switched: %+v", cur.Spec.Template.Annotations)
+	}
+
+	// once the deployment rolled out the canary is removed.
+	cur.Status.UpdatedReplicas = replicas
+	cur.Status.AvailableReplicas = replicas
+	if err := svc.Update(ctx, cur); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := deps.Get(ctx, "mydeploy-canary", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("canary not removed: %v", err)
+	}
+}
+
+func TestDeploymentsForTagSkipsCanaries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	objects := []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "mydeploy-canary",
+				Namespace:   "ns",
+				Labels:      map[string]string{CanaryLabel: "mydeploy"},
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Image: "mytag",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	corcli := fake.NewSimpleClientset(objects...)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	deplis := corinf.Apps().V1().Deployments().Lister()
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		corinf.Apps().V1().Deployments().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	svc := NewDeployment(corcli, nil, deplis, nil, nil, nil)
+	deps, err := svc.DeploymentsForTag(
+		ctx,
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "mytag",
+				Namespace: "ns",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(deps) != 0 {
+		t.Errorf("canary returned: %+v", deps)
+	}
+}
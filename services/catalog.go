@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/hashicorp/go-multierror"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/ricardomaraschini/tagger/config"
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// catalogRepository is an upstream repository Tags are imported from, the
+// tags in it tracked by Tags and the namespace whose credentials are used
+// to list it.
+type catalogRepository struct {
+	ref       reference.Named
+	namespace string
+	tracked   map[string]bool
+}
+
+// Catalog reports the tags, in the upstream repositories Tags are imported
+// from, that no Tag tracks, so platform teams can notice images used
+// without going through Tagger. Repositories are listed on each Scan, the
+// report is kept until the next one. Repositories imported from by a Tag
+// selecting images by label are left out as any of their tags may be
+// imported. When sharding only the Tags of namespaces owned by our shard
+// are taken into account.
+type Catalog struct {
+	sync.Mutex
+	taglis   taglist.TagLister
+	syssvc   *SysContext
+	shard    *Shard
+	report   map[string][]string
+	listTags func(context.Context, types.ImageReference, *types.SystemContext) ([]string, error)
+}
+
+// NewCatalog returns a catalog reporter. Shard may be nil, meaning the Tags
+// of all namespaces are taken into account.
+func NewCatalog(
+	taglis taglist.TagLister,
+	cmlister corelister.ConfigMapLister,
+	sclister corelister.SecretLister,
+	shard *Shard,
+) *Catalog {
+	return &Catalog{
+		taglis: taglis,
+		syssvc: NewSysContext(cmlister, sclister),
+		shard:  shard,
+		report: map[string][]string{},
+		listTags: func(
+			ctx context.Context, imgref types.ImageReference, sysctx *types.SystemContext,
+		) ([]string, error) {
+			return docker.GetRepositoryTags(ctx, sysctx, imgref)
+		},
+	}
+}
+
+// PullSecretsFrom sets where the namespaces default ServiceAccounts are read
+// from, see SysContext.
+func (c *Catalog) PullSecretsFrom(salister corelister.ServiceAccountLister) {
+	c.syssvc.PullSecretsFrom(salister)
+}
+
+// ApplyConfig applies client certificates and the credentials source, shared
+// credentials namespace included, used when listing repositories. Disabling
+// the report drops the last one.
+func (c *Catalog) ApplyConfig(cfg *config.Config) {
+	c.syssvc.ApplyConfig(cfg)
+	if cfg.CatalogReportInterval > 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.report = map[string][]string{}
+}
+
+// Report returns, for each upstream repository, the tags no Tag tracks, as
+// of the last Scan. Tags are sorted.
+func (c *Catalog) Report() map[string][]string {
+	c.Lock()
+	defer c.Unlock()
+	report := map[string][]string{}
+	for repo, tags := range c.report {
+		report[repo] = append([]string{}, tags...)
+	}
+	return report
+}
+
+// repositories groups the Tags by the upstream repository they are imported
+// from. Tags importing by digest track no tag, the ones with an image
+// selector make their repository to be left out.
+func (c *Catalog) repositories() (map[string]*catalogRepository, error) {
+	tags, err := c.taglis.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Namespace != tags[j].Namespace {
+			return tags[i].Namespace < tags[j].Namespace
+		}
+		return tags[i].Name < tags[j].Name
+	})
+
+	repos := map[string]*catalogRepository{}
+	selected := map[string]bool{}
+	for _, it := range tags {
+		if c.shard != nil && !c.shard.Owns(it.Namespace) {
+			continue
+		}
+		if it.Spec.From == "" {
+			continue
+		}
+		ref, err := reference.ParseDockerRef(it.Spec.From)
+		if err != nil {
+			klog.V(4).Infof("catalog: skipping %s/%s: %s", it.Namespace, it.Name, err)
+			continue
+		}
+
+		name := ref.Name()
+		if it.Spec.ImageSelector != nil {
+			selected[name] = true
+			continue
+		}
+		repo, ok := repos[name]
+		if !ok {
+			repo = &catalogRepository{
+				ref:       reference.TrimNamed(ref),
+				namespace: it.Namespace,
+				tracked:   map[string]bool{},
+			}
+			repos[name] = repo
+		}
+		if tagged, ok := ref.(reference.NamedTagged); ok {
+			repo.tracked[tagged.Tag()] = true
+		}
+	}
+
+	for name := range selected {
+		delete(repos, name)
+	}
+	return repos, nil
+}
+
+// upstreamTags lists all tags in a repository with the credentials of the
+// repository namespace, anonymously if none work.
+func (c *Catalog) upstreamTags(ctx context.Context, repo *catalogRepository) ([]string, error) {
+	imgref, err := docker.NewReference(reference.TagNameOnly(repo.ref))
+	if err != nil {
+		return nil, err
+	}
+	auths, err := c.syssvc.AuthsFor(ctx, imgref, repo.namespace)
+	if err != nil {
+		return nil, err
+	}
+	auths = append(auths, nil)
+
+	var errors *multierror.Error
+	for _, auth := range auths {
+		domain := reference.Domain(repo.ref)
+		sysctx := &types.SystemContext{
+			DockerAuthConfig:        auth,
+			DockerCertPath:          c.syssvc.CertDirFor(domain),
+			DockerRegistryUserAgent: c.syssvc.UserAgentFor(domain),
+		}
+		tags, err := c.listTags(ctx, imgref, sysctx)
+		if err != nil {
+			errors = multierror.Append(errors, err)
+			continue
+		}
+		return tags, nil
+	}
+	return nil, errors
+}
+
+// Scan lists the upstream repositories Tags are imported from and records
+// the tags in them no Tag tracks. Repositories that can't be listed keep
+// their previous report, errors are returned once all repositories have
+// been attempted.
+func (c *Catalog) Scan(ctx context.Context) error {
+	repos, err := c.repositories()
+	if err != nil {
+		return err
+	}
+
+	prev := c.Report()
+	report := map[string][]string{}
+	var errors *multierror.Error
+	for name, repo := range repos {
+		upstream, err := c.upstreamTags(ctx, repo)
+		if err != nil {
+			errors = multierror.Append(errors, err)
+			if tags, ok := prev[name]; ok {
+				report[name] = tags
+			}
+			continue
+		}
+
+		untracked := []string{}
+		for _, tag := range upstream {
+			if !repo.tracked[tag] {
+				untracked = append(untracked, tag)
+			}
+		}
+		sort.Strings(untracked)
+		report[name] = untracked
+	}
+
+	c.Lock()
+	c.report = report
+	c.Unlock()
+	return errors.ErrorOrNil()
+}
+
+// Describe sends the description of the untracked upstream tags gauge.
+func (c *Catalog) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.UntrackedUpstreamTagsDesc
+}
+
+// Collect reports the number of untracked tags per upstream repository, as
+// of the last Scan.
+func (c *Catalog) Collect(ch chan<- prometheus.Metric) {
+	report := c.Report()
+	repos := make([]string, 0, len(report))
+	for repo := range report {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+
+	for _, repo := range repos {
+		ch <- prometheus.MustNewConstMetric(
+			metrics.UntrackedUpstreamTagsDesc,
+			prometheus.GaugeValue,
+			float64(len(report[repo])),
+			repo,
+		)
+	}
+}
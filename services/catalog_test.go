@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	coreinf "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestCatalogScan(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newTag := func(namespace, name, from string, selector bool) *imagtagv1.Tag {
+		it := &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+			Spec: imagtagv1.TagSpec{From: from},
+		}
+		if selector {
+			it.Spec.ImageSelector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{"channel": "stable"},
+			}
+		}
+		return it
+	}
+
+	objects := []runtime.Object{
+		newTag("team-a", "app", "quay.io/company/app:v1", false),
+		newTag("team-b", "app", "quay.io/company/app:v2", false),
+		newTag("team-a", "db", "quay.io/company/db@sha256:"+strings.Repeat("0", 64), false),
+		newTag("team-a", "web", "quay.io/company/web:stable", true),
+		newTag("team-b", "web", "quay.io/company/web:v1", false),
+		newTag("team-a", "broken", "quay.io/company/broken:v1", false),
+	}
+
+	tagcli := tagfake.NewSimpleClientset(objects...)
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	corinf := coreinf.NewSharedInformerFactory(fake.NewSimpleClientset(), time.Minute)
+	seclis := corinf.Core().V1().Secrets().Lister()
+	cmlist := corinf.Core().V1().ConfigMaps().Lister()
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Core().V1().Secrets().Informer().HasSynced,
+		corinf.Core().V1().ConfigMaps().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	upstream := map[string][]string{
+		"quay.io/company/app": {"v3", "v1", "v2", "latest"},
+		"quay.io/company/db":  {"latest"},
+		"quay.io/company/web": {"v1", "v2"},
+	}
+	failing := false
+	catalog := NewCatalog(taglis, cmlist, seclis, nil)
+	catalog.listTags = func(
+		ctx context.Context, imgref types.ImageReference, sysctx *types.SystemContext,
+	) ([]string, error) {
+		repo := reference.TrimNamed(imgref.DockerReference()).String()
+		tags, ok := upstream[repo]
+		if !ok || failing {
+			return nil, fmt.Errorf("unable to list %s", repo)
+		}
+		return tags, nil
+	}
+
+	if err := catalog.Scan(ctx); err == nil {
+		t.Errorf("expected error listing the broken repository")
+	}
+	expected := map[string][]string{
+		"quay.io/company/app": {"latest", "v3"},
+		"quay.io/company/db":  {"latest"},
+	}
+	if report := catalog.Report(); !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %v, %v received", expected, report)
+	}
+
+	// repositories that fail to be listed keep their last report.
+	failing = true
+	if err := catalog.Scan(ctx); err == nil {
+		t.Errorf("expected error listing repositories")
+	}
+	if report := catalog.Report(); !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected report %v, %v received", expected, report)
+	}
+}
@@ -0,0 +1,24 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// HelmChartConfigMediaType is the config media type of helm charts pushed to
+// OCI registries, the config blob holds the chart Chart.yaml as json.
+const HelmChartConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+
+// ChartMetadata parses the metadata of a helm chart out of its config blob.
+func ChartMetadata(config []byte) (*imagtagv1.ChartMetadata, error) {
+	chart := &imagtagv1.ChartMetadata{}
+	if err := json.Unmarshal(config, chart); err != nil {
+		return nil, fmt.Errorf("invalid chart config: %w", err)
+	}
+	if chart.Name == "" || chart.Version == "" {
+		return nil, fmt.Errorf("chart config without name or version")
+	}
+	return chart, nil
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestChartMetadata(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		config   string
+		expected *imagtagv1.ChartMetadata
+		err      string
+	}{
+		{
+			name: "chart",
+			config: `{"apiVersion":"v2","name":"app","version":"1.2.3",` +
+				`"appVersion":"v4.5","description":"an app","type":"application"}`,
+			expected: &imagtagv1.ChartMetadata{
+				Name:       "app",
+				Version:    "1.2.3",
+				AppVersion: "v4.5",
+			},
+		},
+		{
+			name:     "no app version",
+			config:   `{"name":"lib","version":"0.1.0"}`,
+			expected: &imagtagv1.ChartMetadata{Name: "lib", Version: "0.1.0"},
+		},
+		{
+			name:   "not a chart",
+			config: `{"architecture":"amd64","os":"linux"}`,
+			err:    "chart config without name or version",
+		},
+		{
+			name:   "invalid",
+			config: `chart`,
+			err:    "invalid chart config",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			chart, err := ChartMetadata([]byte(tt.config))
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, %q received", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Fatalf("expected error %q, nil received", tt.err)
+			}
+			if !reflect.DeepEqual(chart, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, chart)
+			}
+		})
+	}
+}
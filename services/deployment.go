@@ -2,41 +2,80 @@ package services
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	corecli "k8s.io/client-go/kubernetes"
 	aplist "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/klog/v2"
 
+	"github.com/ricardomaraschini/tagger/config"
+	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
 	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
 	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
 )
 
 // Deployment gather all actions related to deployment objects.
 type Deployment struct {
-	corcli corecli.Interface
-	deplis aplist.DeploymentLister
-	taglis taglist.TagLister
+	sync.Mutex
+	rollback config.AutoRollback
+	corcli   corecli.Interface
+	tagcli   tagclient.Interface
+	deplis   aplist.DeploymentLister
+	replis   aplist.ReplicaSetLister
+	taglis   taglist.TagLister
+	notifier *Notifier
 }
 
 // NewDeployment returns a handler for all deployment related services.
 func NewDeployment(
 	corcli corecli.Interface,
+	tagcli tagclient.Interface,
 	deplis aplist.DeploymentLister,
+	replis aplist.ReplicaSetLister,
 	taglis taglist.TagLister,
+	notifier *Notifier,
 ) *Deployment {
 	return &Deployment{
-		corcli: corcli,
-		deplis: deplis,
-		taglis: taglis,
+		rollback: config.Default().AutoRollback,
+		corcli:   corcli,
+		tagcli:   tagcli,
+		deplis:   deplis,
+		replis:   replis,
+		taglis:   taglis,
+		notifier: notifier,
 	}
 }
 
+// ApplyConfig applies the automatic rollback configuration.
+func (d *Deployment) ApplyConfig(cfg *config.Config) {
+	if d == nil {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.rollback = cfg.AutoRollback
+}
+
+// autoRollback returns the rollout deadline and true if failed rollouts of
+// the provided tag must be automatically rolled back.
+func (d *Deployment) autoRollback(it *imagtagv1.Tag) (time.Duration, bool) {
+	d.Lock()
+	defer d.Unlock()
+	return d.rollback.Deadline, it.Spec.AutoRollback || d.rollback.Enabled(it.Namespace)
+}
+
 // UpdateDeploymentsForTag updates all deployments using provided tag. Triggers
 // redeployment on deployments that have changed.
 func (d *Deployment) UpdateDeploymentsForTag(ctx context.Context, it *imagtagv1.Tag) error {
+	if d == nil {
+		return nil
+	}
 	deploys, err := d.DeploymentsForTag(ctx, it)
 	if err != nil {
 		return err
@@ -61,26 +100,53 @@ func (d *Deployment) DeploymentsForTag(
 
 	var deps []*appsv1.Deployment
 	for _, dep := range deploys {
-		if _, ok := dep.Annotations["image-tag"]; !ok {
+		tracked, wildcard := tagTriggers(dep.Annotations)
+		if !tracked {
+			continue
+		}
+		if _, ok := dep.Labels[CanaryLabel]; ok {
 			continue
 		}
 
-		for _, cont := range dep.Spec.Template.Spec.Containers {
-			if cont.Image != it.Name {
-				continue
-			}
+		if usesTag(dep, it, wildcard) {
 			deps = append(deps, dep)
-			break
 		}
 	}
 	return deps, nil
 }
 
+// usesTag returns true if a container of the Deployment refers to the Tag by
+// its image or, if the Deployment opts in for placeholders, by a placeholder.
+func usesTag(dep *appsv1.Deployment, it *imagtagv1.Tag, wildcard bool) bool {
+	for _, cont := range dep.Spec.Template.Spec.Containers {
+		if imageMatchesTag(cont.Image, it, wildcard) {
+			return true
+		}
+	}
+	if !placeholdersEnabled(dep.Annotations) {
+		return false
+	}
+	for _, name := range placeholderTags(dep.Spec.Template.Spec) {
+		if name == it.Name {
+			return true
+		}
+	}
+	return false
+}
+
 // Update verifies if the provided deployment leverages tags, if affirmative it
 // creates an annotation into its template pointing to reference pointed by the
-// tag. TODO add other containers here as well.
+// tag. If the deployment is already up to date the rollout of the current tag
+// generations is recorded in the tags. Deployments annotated for canaries are
+// only switched to new references once their canary succeeds. TODO add other
+// containers here as well.
 func (d *Deployment) Update(ctx context.Context, dep *appsv1.Deployment) error {
-	if _, ok := dep.Annotations["image-tag"]; !ok {
+	if tracked, _ := tagTriggers(dep.Annotations); !tracked {
+		return nil
+	}
+
+	// canaries are managed while processing the deployment they belong to.
+	if _, ok := dep.Labels[CanaryLabel]; ok {
 		return nil
 	}
 
@@ -88,31 +154,57 @@ func (d *Deployment) Update(ctx context.Context, dep *appsv1.Deployment) error {
 		dep.Spec.Template.Annotations = map[string]string{}
 	}
 
+	annotations := map[string]string{}
+	for k, v := range dep.Spec.Template.Annotations {
+		annotations[k] = v
+	}
+
 	changed := false
-	for _, cont := range dep.Spec.Template.Spec.Containers {
-		it, err := d.taglis.Tags(dep.Namespace).Get(cont.Image)
-		if err != nil {
-			if errors.IsNotFound(err) {
-				continue
-			}
-			return err
+	upgrade := false
+	tags, err := deploymentTags(d.taglis, dep)
+	if err != nil {
+		return err
+	}
+	for _, it := range tags {
+		// disabled tags are not rolled out, deployments keep the
+		// reference they have.
+		if it.Spec.Disabled {
+			continue
 		}
 
 		ref := it.CurrentReferenceForTag()
-		if ref == "" {
+		if ref == "" || it.CurrentReferenceIsArtifact() {
 			continue
 		}
 
-		if dep.Spec.Template.Annotations[it.Name] != ref {
-			dep.Spec.Template.Annotations[it.Name] = ref
+		if annotations[it.Name] != ref {
+			upgrade = upgrade || annotations[it.Name] != ""
+			annotations[it.Name] = ref
 			changed = true
 		}
 	}
 
 	if !changed {
-		return nil
+		if err := d.deleteCanary(ctx, dep); err != nil {
+			return err
+		}
+		return d.recordRollouts(ctx, dep)
 	}
 
+	// deployments running a previous reference go through a canary phase
+	// first, if they are configured to do so.
+	pct, duration, canary, err := canarySettings(dep)
+	if err != nil {
+		return err
+	}
+	if canary && upgrade {
+		done, err := d.canaryRollout(ctx, dep, annotations, pct, duration)
+		if err != nil || !done {
+			return err
+		}
+	}
+
+	dep.Spec.Template.Annotations = annotations
 	if _, err := d.corcli.AppsV1().Deployments(dep.Namespace).Update(
 		ctx, dep, metav1.UpdateOptions{},
 	); err != nil {
@@ -120,3 +212,321 @@ func (d *Deployment) Update(ctx context.Context, dep *appsv1.Deployment) error {
 	}
 	return nil
 }
+
+// recordRollouts records, in all tags used by the deployment, the state of
+// the rollout of their current generation. The rollout is tracked through the
+// ReplicaSet whose template points to the current tag reference.
+func (d *Deployment) recordRollouts(ctx context.Context, dep *appsv1.Deployment) error {
+	if d.replis == nil || d.tagcli == nil {
+		return nil
+	}
+	tags, err := deploymentTags(d.taglis, dep)
+	if err != nil {
+		return err
+	}
+	for _, it := range tags {
+		ref := it.CurrentReferenceForTag()
+		if ref == "" || it.CurrentReferenceIsArtifact() {
+			continue
+		}
+
+		rs, err := d.replicaSetForReference(dep, it.Name, ref)
+		if err != nil {
+			return err
+		}
+
+		rollout := rolloutFor(dep, rs, it.Status.Generation)
+		deadline, rollback := d.autoRollback(it)
+		if rollback && rollout.Phase == imagtagv1.RolloutProgressing {
+			if rollout, err = d.checkRolloutHealth(
+				ctx, it, rs, rollout, deadline,
+			); err != nil {
+				return err
+			}
+		}
+
+		// restarts are only counted while the promotion of the current
+		// generation is being verified, see RegisterVerification.
+		if rs != nil && it.Verifying() {
+			if rollout.Restarts, err = d.podRestarts(ctx, rs); err != nil {
+				return err
+			}
+		}
+
+		completed := rollout.Phase == imagtagv1.RolloutComplete &&
+			rolloutPhase(it, rollout) != imagtagv1.RolloutComplete
+
+		orig := it
+		it = it.DeepCopy()
+		it.RegisterRollout(rollout)
+		it.RegisterVerification(time.Now())
+		it.RegisterKnownGood(time.Now())
+		it.RegisterHealth()
+		if tagChanged(orig, it) {
+			if it, err = d.tagcli.ImagesV1().Tags(it.Namespace).Update(
+				ctx, it, metav1.UpdateOptions{},
+			); err != nil {
+				return fmt.Errorf("error recording rollout: %w", err)
+			}
+			if completed {
+				d.notifier.RolloutCompleted(it, dep.Name)
+			}
+		}
+
+		// a generation failing its verification is rolled back as a
+		// failed rollout would be.
+		promotion := it.Status.Promotion
+		if rollout.Phase != imagtagv1.RolloutFailed &&
+			promotion != nil &&
+			promotion.Phase == imagtagv1.PromotionFailed &&
+			promotion.Generation == it.Status.Generation {
+			rollout.Phase = imagtagv1.RolloutFailed
+			rollout.Reason = imagtagv1.ReasonVerificationFailed
+			rollout.Message = promotion.Message
+		}
+
+		if !rollback || rollout.Phase != imagtagv1.RolloutFailed {
+			continue
+		}
+		if err := d.rollBack(ctx, it, rollout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rolloutPhase returns the phase recorded on the Tag for the rollout of the
+// same generation on the same Deployment, empty if none has been recorded.
+func rolloutPhase(it *imagtagv1.Tag, rollout imagtagv1.Rollout) string {
+	for _, cur := range it.Status.Rollouts {
+		if cur.Generation == rollout.Generation && cur.Deployment == rollout.Deployment {
+			return cur.Phase
+		}
+	}
+	return ""
+}
+
+// checkRolloutHealth verifies if a progressing rollout has exceeded the
+// deadline or if any of the ReplicaSet pods is crash looping. If so the
+// rollout is returned as failed.
+func (d *Deployment) checkRolloutHealth(
+	ctx context.Context,
+	it *imagtagv1.Tag,
+	rs *appsv1.ReplicaSet,
+	rollout imagtagv1.Rollout,
+	deadline time.Duration,
+) (imagtagv1.Rollout, error) {
+	if rs != nil {
+		msg, err := d.crashLoopingPod(ctx, rs)
+		if err != nil {
+			return rollout, err
+		}
+		if msg != "" {
+			rollout.Phase = imagtagv1.RolloutFailed
+			rollout.Reason = "CrashLoopBackOff"
+			rollout.Message = msg
+			return rollout, nil
+		}
+	}
+
+	started := it.RolloutStartedAt(rollout.Deployment)
+	if started.IsZero() || time.Since(started.Time) < deadline {
+		return rollout, nil
+	}
+	rollout.Phase = imagtagv1.RolloutFailed
+	rollout.Reason = "RolloutDeadlineExceeded"
+	rollout.Message = fmt.Sprintf("not ready after %s", deadline)
+	return rollout, nil
+}
+
+// replicaSetPods returns the pods controlled by the provided ReplicaSet.
+func (d *Deployment) replicaSetPods(
+	ctx context.Context, rs *appsv1.ReplicaSet,
+) ([]corev1.Pod, error) {
+	selector, err := metav1.LabelSelectorAsSelector(rs.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, err := d.corcli.CoreV1().Pods(rs.Namespace).List(
+		ctx, metav1.ListOptions{LabelSelector: selector.String()},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %w", err)
+	}
+
+	var owned []corev1.Pod
+	for _, pod := range pods.Items {
+		if metav1.IsControlledBy(&pod, rs) {
+			owned = append(owned, pod)
+		}
+	}
+	return owned, nil
+}
+
+// podRestarts returns the sum of the container restarts of all pods of the
+// provided ReplicaSet.
+func (d *Deployment) podRestarts(
+	ctx context.Context, rs *appsv1.ReplicaSet,
+) (int32, error) {
+	pods, err := d.replicaSetPods(ctx, rs)
+	if err != nil {
+		return 0, err
+	}
+
+	var restarts int32
+	for _, pod := range pods {
+		for _, cst := range pod.Status.ContainerStatuses {
+			restarts += cst.RestartCount
+		}
+	}
+	return restarts, nil
+}
+
+// crashLoopingPod returns a message describing the first pod of the provided
+// ReplicaSet found in crash loop. Returns an empty string if none is.
+func (d *Deployment) crashLoopingPod(
+	ctx context.Context, rs *appsv1.ReplicaSet,
+) (string, error) {
+	pods, err := d.replicaSetPods(ctx, rs)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pod := range pods {
+		for _, cst := range pod.Status.ContainerStatuses {
+			if cst.State.Waiting == nil {
+				continue
+			}
+			if cst.State.Waiting.Reason != "CrashLoopBackOff" {
+				continue
+			}
+			return fmt.Sprintf(
+				"container %s in pod %s is crash looping", cst.Name, pod.Name,
+			), nil
+		}
+	}
+	return "", nil
+}
+
+// rollBack moves the tag back to its previous generation after its rollout
+// failed. Tags are only rolled back from their latest generation, so a failed
+// rollout of a generation we rolled back to does not trigger another one.
+func (d *Deployment) rollBack(
+	ctx context.Context, it *imagtagv1.Tag, rollout imagtagv1.Rollout,
+) error {
+	if it.Spec.Generation != it.Status.Generation {
+		return nil
+	}
+
+	prev, ok := it.PreviousGeneration()
+	if !ok {
+		return nil
+	}
+
+	klog.Infof(
+		"rolling back tag %s/%s to generation %d", it.Namespace, it.Name, prev,
+	)
+
+	it = it.DeepCopy()
+	it.Spec.Generation = prev
+	it.RegisterReadiness()
+	it.RegisterHealth()
+	if _, err := d.tagcli.ImagesV1().Tags(it.Namespace).Update(
+		ctx, it, metav1.UpdateOptions{},
+	); err != nil {
+		return fmt.Errorf("error rolling back: %w", err)
+	}
+
+	tagEvent(
+		ctx, d.corcli, it, corev1.EventTypeWarning, "AutoRollback",
+		fmt.Sprintf(
+			"rollout of generation %d on deployment %s failed (%s: %s), "+
+				"rolled back to generation %d",
+			rollout.Generation, rollout.Deployment,
+			rollout.Reason, rollout.Message, prev,
+		),
+	)
+	return nil
+}
+
+// replicaSetForReference returns the ReplicaSet owned by the deployment whose
+// pod template is annotated with the provided tag reference. Returns nil if
+// the ReplicaSet has not been created yet.
+func (d *Deployment) replicaSetForReference(
+	dep *appsv1.Deployment, tagname, ref string,
+) (*appsv1.ReplicaSet, error) {
+	rsets, err := d.replis.ReplicaSets(dep.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rs := range rsets {
+		if !metav1.IsControlledBy(rs, dep) {
+			continue
+		}
+		if rs.Spec.Template.Annotations[tagname] != ref {
+			continue
+		}
+		return rs, nil
+	}
+	return nil, nil
+}
+
+// rolloutFor returns the rollout state of a generation on a deployment. The
+// rollout is complete once the ReplicaSet has all desired replicas ready and
+// failed if the deployment reports it has not progressed within its deadline
+// or if the ReplicaSet is failing to create pods.
+func rolloutFor(
+	dep *appsv1.Deployment, rs *appsv1.ReplicaSet, gen int64,
+) imagtagv1.Rollout {
+	rollout := imagtagv1.Rollout{
+		Deployment: dep.Name,
+		Generation: gen,
+		Phase:      imagtagv1.RolloutProgressing,
+		UpdatedAt:  metav1.Now(),
+	}
+
+	for _, cond := range dep.Status.Conditions {
+		if cond.Type != appsv1.DeploymentProgressing {
+			continue
+		}
+		if cond.Status == corev1.ConditionFalse &&
+			cond.Reason == "ProgressDeadlineExceeded" {
+			rollout.Phase = imagtagv1.RolloutFailed
+			rollout.Reason = cond.Reason
+			rollout.Message = cond.Message
+		}
+	}
+
+	if rs == nil {
+		return rollout
+	}
+	rollout.ReplicaSet = rs.Name
+
+	for _, cond := range rs.Status.Conditions {
+		if cond.Type != appsv1.ReplicaSetReplicaFailure {
+			continue
+		}
+		if cond.Status == corev1.ConditionTrue {
+			rollout.Phase = imagtagv1.RolloutFailed
+			rollout.Reason = cond.Reason
+			rollout.Message = cond.Message
+			return rollout
+		}
+	}
+
+	if rollout.Phase == imagtagv1.RolloutFailed {
+		return rollout
+	}
+
+	desired := int32(1)
+	if rs.Spec.Replicas != nil {
+		desired = *rs.Spec.Replicas
+	}
+	if rs.Status.ReadyReplicas >= desired {
+		rollout.Phase = imagtagv1.RolloutComplete
+		rollout.Message = fmt.Sprintf("%d replicas ready", rs.Status.ReadyReplicas)
+	}
+	return rollout
+}
@@ -15,6 +15,7 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/tools/cache"
 
+	"github.com/ricardomaraschini/tagger/config"
 	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
 	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
 	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
@@ -487,3 +488,563 @@ func TestDeploymentUpdate(t *testing.T) {
 		})
 	}
 }
+
+func TestDeploymentRecordRollouts(t *testing.T) {
+	one := int32(1)
+	for _, tt := range []struct {
+		name    string
+		status  appsv1.DeploymentStatus
+		rsets   []runtime.Object
+		phase   string
+		replset string
+	}{
+		{
+			name:  "replica set not created yet",
+			phase: imagtagv1.RolloutProgressing,
+		},
+		{
+			name:    "replica set not ready",
+			phase:   imagtagv1.RolloutProgressing,
+			replset: "mydeploy-new",
+			rsets: []runtime.Object{
+				rolloutReplicaSet("mydeploy-new", "remoteimage:123", 0, nil),
+			},
+		},
+		{
+			name:    "replica set ready",
+			phase:   imagtagv1.RolloutComplete,
+			replset: "mydeploy-new",
+			rsets: []runtime.Object{
+				rolloutReplicaSet("mydeploy-old", "remoteimage:321", 1, nil),
+				rolloutReplicaSet("mydeploy-new", "remoteimage:123", 1, &one),
+			},
+		},
+		{
+			name:    "replica failure",
+			phase:   imagtagv1.RolloutFailed,
+			replset: "mydeploy-new",
+			rsets: []runtime.Object{
+				func() runtime.Object {
+					rs := rolloutReplicaSet("mydeploy-new", "remoteimage:123", 0, nil)
+					rs.Status.Conditions = []appsv1.ReplicaSetCondition{
+						{
+							Type:   appsv1.ReplicaSetReplicaFailure,
+							Status: corev1.ConditionTrue,
+							Reason: "FailedCreate",
+						},
+					}
+					return rs
+				}(),
+			},
+		},
+		{
+			name:    "progress deadline exceeded",
+			phase:   imagtagv1.RolloutFailed,
+			replset: "mydeploy-new",
+			status: appsv1.DeploymentStatus{
+				Conditions: []appsv1.DeploymentCondition{
+					{
+						Type:   appsv1.DeploymentProgressing,
+						Status: corev1.ConditionFalse,
+						Reason: "ProgressDeadlineExceeded",
+					},
+				},
+			},
+			rsets: []runtime.Object{
+				rolloutReplicaSet("mydeploy-new", "remoteimage:123", 0, nil),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			deploy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mydeploy",
+					Namespace: "ns",
+					UID:       "deploy-uid",
+					Annotations: map[string]string{
+						"image-tag": "true",
+					},
+				},
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"mytag": "remoteimage:123",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Image: "mytag",
+								},
+							},
+						},
+					},
+				},
+				Status: tt.status,
+			}
+
+			tag := &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mytag",
+					Namespace: "ns",
+				},
+				Status: imagtagv1.TagStatus{
+					Generation: 1,
+					References: []imagtagv1.HashReference{
+						{
+							Generation:     1,
+							ImageReference: "remoteimage:123",
+						},
+					},
+				},
+			}
+
+			corcli := fake.NewSimpleClientset(append(tt.rsets, deploy)...)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			replis := corinf.Apps().V1().ReplicaSets().Lister()
+
+			tagcli := tagfake.NewSimpleClientset(tag)
+			taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+
+			corinf.Start(ctx.Done())
+			taginf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+				taginf.Images().V1().Tags().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			svc := NewDeployment(corcli, tagcli, nil, replis, taglis, nil)
+			if err := svc.Update(ctx, deploy); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			it, err := tagcli.ImagesV1().Tags("ns").Get(ctx, "mytag", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error fetching tag: %s", err)
+			}
+			if len(it.Status.Rollouts) != 1 {
+				t.Fatalf("expected one rollout, found %+v", it.Status.Rollouts)
+			}
+
+			rollout := it.Status.Rollouts[0]
+			if rollout.Phase != tt.phase || rollout.ReplicaSet != tt.replset {
+				t.Errorf("unexpected rollout: %+v", rollout)
+			}
+			if rollout.Deployment != "mydeploy" || rollout.Generation != 1 {
+				t.Errorf("unexpected rollout: %+v", rollout)
+			}
+		})
+	}
+}
+
+// rolloutReplicaSet returns a ReplicaSet owned by the "mydeploy" Deployment
+// running the provided tag reference.
+func rolloutReplicaSet(name, ref string, ready int32, replicas *int32) *appsv1.ReplicaSet {
+	ctrl := true
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "ns",
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       "mydeploy",
+					UID:        "deploy-uid",
+					Controller: &ctrl,
+				},
+			},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: replicas,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"mytag": ref,
+					},
+				},
+			},
+		},
+		Status: appsv1.ReplicaSetStatus{
+			ReadyReplicas: ready,
+		},
+	}
+}
+
+func TestDeploymentAutoRollback(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		tagRefs    []imagtagv1.HashReference
+		optIn      bool
+		namespaces []string
+		expected   int64
+	}{
+		{
+			name:     "not enabled",
+			expected: 2,
+			tagRefs: []imagtagv1.HashReference{
+				{Generation: 2, ImageReference: "remoteimage:123"},
+				{Generation: 1, ImageReference: "remoteimage:321"},
+			},
+		},
+		{
+			name:     "enabled on tag",
+			optIn:    true,
+			expected: 1,
+			tagRefs: []imagtagv1.HashReference{
+				{Generation: 2, ImageReference: "remoteimage:123"},
+				{Generation: 1, ImageReference: "remoteimage:321"},
+			},
+		},
+		{
+			name:       "enabled on namespace",
+			namespaces: []string{"ns"},
+			expected:   1,
+			tagRefs: []imagtagv1.HashReference{
+				{Generation: 2, ImageReference: "remoteimage:123"},
+				{Generation: 1, ImageReference: "remoteimage:321"},
+			},
+		},
+		{
+			name:     "no previous generation",
+			optIn:    true,
+			expected: 2,
+			tagRefs: []imagtagv1.HashReference{
+				{Generation: 2, ImageReference: "remoteimage:123"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			deploy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mydeploy",
+					Namespace: "ns",
+					UID:       "deploy-uid",
+					Annotations: map[string]string{
+						"image-tag": "true",
+					},
+				},
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"mytag": "remoteimage:123",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Image: "mytag",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			rs := rolloutReplicaSet("mydeploy-new", "remoteimage:123", 0, nil)
+			rs.UID = "rs-uid"
+			rs.Spec.Selector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "mydeploy"},
+			}
+
+			ctrl := true
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mydeploy-new-abcde",
+					Namespace: "ns",
+					Labels:    map[string]string{"app": "mydeploy"},
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: "apps/v1",
+							Kind:       "ReplicaSet",
+							Name:       rs.Name,
+							UID:        rs.UID,
+							Controller: &ctrl,
+						},
+					},
+				},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{
+						{
+							Name: "app",
+							State: corev1.ContainerState{
+								Waiting: &corev1.ContainerStateWaiting{
+									Reason: "CrashLoopBackOff",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			tag := &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mytag",
+					Namespace: "ns",
+				},
+				Spec: imagtagv1.TagSpec{
+					Generation:   2,
+					AutoRollback: tt.optIn,
+				},
+				Status: imagtagv1.TagStatus{
+					Generation: 2,
+					References: tt.tagRefs,
+				},
+			}
+
+			corcli := fake.NewSimpleClientset(deploy, rs, pod)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			replis := corinf.Apps().V1().ReplicaSets().Lister()
+
+			tagcli := tagfake.NewSimpleClientset(tag)
+			taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+
+			corinf.Start(ctx.Done())
+			taginf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+				taginf.Images().V1().Tags().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			cfg := config.Default()
+			cfg.AutoRollback.Namespaces = tt.namespaces
+			svc := NewDeployment(corcli, tagcli, nil, replis, taglis, nil)
+			svc.ApplyConfig(cfg)
+			if err := svc.Update(ctx, deploy); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			it, err := tagcli.ImagesV1().Tags("ns").Get(ctx, "mytag", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error fetching tag: %s", err)
+			}
+			if it.Spec.Generation != tt.expected {
+				t.Errorf("expected generation %d, %d found", tt.expected, it.Spec.Generation)
+			}
+
+			evts, err := corcli.CoreV1().Events("ns").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error listing events: %s", err)
+			}
+			rolledBack := it.Spec.Generation != tag.Spec.Generation
+			if rolledBack != (len(evts.Items) == 1) {
+				t.Errorf("unexpected events: %+v", evts.Items)
+			}
+		})
+	}
+}
+
+func TestDeploymentVerification(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		restarts   int32
+		phase      string
+		generation int64
+	}{
+		{
+			name:       "within budget",
+			restarts:   2,
+			phase:      imagtagv1.PromotionActive,
+			generation: 2,
+		},
+		{
+			name:       "budget exhausted",
+			restarts:   5,
+			phase:      imagtagv1.PromotionFailed,
+			generation: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			deploy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "mydeploy",
+					Namespace:   "ns",
+					UID:         "deploy-uid",
+					Annotations: map[string]string{"image-tag": "true"},
+				},
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								"mytag": "remoteimage:123",
+							},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Image: "mytag",
+								},
+							},
+						},
+					},
+				},
+			}
+
+			rs := rolloutReplicaSet("mydeploy-new", "remoteimage:123", 1, nil)
+			rs.UID = "rs-uid"
+			rs.Spec.Selector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "mydeploy"},
+			}
+
+			ctrl := true
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mydeploy-new-abcde",
+					Namespace: "ns",
+					Labels:    map[string]string{"app": "mydeploy"},
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: "apps/v1",
+							Kind:       "ReplicaSet",
+							Name:       rs.Name,
+							UID:        rs.UID,
+							Controller: &ctrl,
+						},
+					},
+				},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{
+						{
+							Name:         "app",
+							RestartCount: tt.restarts,
+						},
+					},
+				},
+			}
+
+			promotedAt := metav1.NewTime(time.Now().Add(-time.Minute))
+			tag := &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mytag",
+					Namespace: "ns",
+				},
+				Spec: imagtagv1.TagSpec{
+					Generation:   2,
+					AutoRollback: true,
+					Promotion: &imagtagv1.PromotionPolicy{
+						VerifyWindow: metav1.Duration{Duration: time.Hour},
+						MaxRestarts:  3,
+					},
+				},
+				Status: imagtagv1.TagStatus{
+					Generation: 2,
+					References: []imagtagv1.HashReference{
+						{Generation: 2, ImageReference: "remoteimage:123"},
+						{Generation: 1, ImageReference: "remoteimage:321"},
+					},
+					Promotion: &imagtagv1.Promotion{
+						Generation: 2,
+						Phase:      imagtagv1.PromotionActive,
+						PromotedAt: &promotedAt,
+					},
+				},
+			}
+
+			corcli := fake.NewSimpleClientset(deploy, rs, pod)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			replis := corinf.Apps().V1().ReplicaSets().Lister()
+
+			tagcli := tagfake.NewSimpleClientset(tag)
+			taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+
+			corinf.Start(ctx.Done())
+			taginf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+				taginf.Images().V1().Tags().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			svc := NewDeployment(corcli, tagcli, nil, replis, taglis, nil)
+			if err := svc.Update(ctx, deploy); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			it, err := tagcli.ImagesV1().Tags("ns").Get(ctx, "mytag", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error fetching tag: %s", err)
+			}
+			if it.Status.Promotion.Phase != tt.phase {
+				t.Errorf("expected phase %s, %+v found", tt.phase, it.Status.Promotion)
+			}
+			if it.Spec.Generation != tt.generation {
+				t.Errorf("expected generation %d, %d found", tt.generation, it.Spec.Generation)
+			}
+			if len(it.Status.Rollouts) != 1 || it.Status.Rollouts[0].Restarts != tt.restarts {
+				t.Errorf("restarts not recorded: %+v", it.Status.Rollouts)
+			}
+		})
+	}
+}
+
+func TestRolloutPhase(t *testing.T) {
+	tag := &imagtagv1.Tag{
+		Status: imagtagv1.TagStatus{
+			Rollouts: []imagtagv1.Rollout{
+				{
+					Deployment: "a",
+					Generation: 1,
+					Phase:      imagtagv1.RolloutComplete,
+				},
+				{
+					Deployment: "b",
+					Generation: 1,
+					Phase:      imagtagv1.RolloutProgressing,
+				},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name    string
+		rollout imagtagv1.Rollout
+		phase   string
+	}{
+		{
+			name:    "recorded rollout",
+			rollout: imagtagv1.Rollout{Deployment: "a", Generation: 1},
+			phase:   imagtagv1.RolloutComplete,
+		},
+		{
+			name:    "another deployment",
+			rollout: imagtagv1.Rollout{Deployment: "b", Generation: 1},
+			phase:   imagtagv1.RolloutProgressing,
+		},
+		{
+			name:    "another generation",
+			rollout: imagtagv1.Rollout{Deployment: "a", Generation: 2},
+		},
+		{
+			name:    "unknown deployment",
+			rollout: imagtagv1.Rollout{Deployment: "c", Generation: 1},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if phase := rolloutPhase(tag, tt.rollout); phase != tt.phase {
+				t.Errorf("expected %q, %q received", tt.phase, phase)
+			}
+		})
+	}
+}
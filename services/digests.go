@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corecli "k8s.io/client-go/kubernetes"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+)
+
+// DigestsLabel is set to "true" on the ConfigMaps holding the Tag digests of
+// a namespace. Only ConfigMaps carrying it are updated, and deleted, so
+// ConfigMaps created by other means are never touched.
+const DigestsLabel = "image-tag-digests"
+
+// Digests keeps, in every namespace with Tags, a ConfigMap mapping each Tag
+// name into its current image reference (by digest), see the digestsConfigMap
+// configuration. Tools that can't rely on the pod mutating webhook, e.g. Helm
+// values or scripts, can then use the references Tagger resolved. Tags not
+// imported yet, disabled or pointing to an artifact are left out.
+type Digests struct {
+	sync.Mutex
+	name     string
+	corcli   corecli.Interface
+	taglis   taglist.TagLister
+	cmlister corelister.ConfigMapLister
+}
+
+// NewDigests returns a service keeping the digests ConfigMaps. Nothing is
+// done unless the digestsConfigMap configuration is set.
+func NewDigests(
+	corcli corecli.Interface,
+	taglis taglist.TagLister,
+	cmlister corelister.ConfigMapLister,
+) *Digests {
+	return &Digests{
+		corcli:   corcli,
+		taglis:   taglis,
+		cmlister: cmlister,
+	}
+}
+
+// ApplyConfig applies the name of the digests ConfigMaps.
+func (d *Digests) ApplyConfig(cfg *config.Config) {
+	d.Lock()
+	defer d.Unlock()
+	d.name = cfg.DigestsConfigMap
+}
+
+// configMapName returns the name of the digests ConfigMaps, empty if they
+// are disabled.
+func (d *Digests) configMapName() string {
+	d.Lock()
+	defer d.Unlock()
+	return d.name
+}
+
+// Sync brings the digests ConfigMap of the namespace in line with its Tags.
+// The ConfigMap is deleted once no Tag of the namespace has a reference left,
+// as are the ones kept under a previous name or while disabled.
+func (d *Digests) Sync(ctx context.Context, namespace string) error {
+	name := d.configMapName()
+	digests, err := d.digests(namespace, name)
+	if err != nil {
+		return err
+	}
+
+	sel := labels.SelectorFromSet(labels.Set{DigestsLabel: "true"})
+	cms, err := d.cmlister.ConfigMaps(namespace).List(sel)
+	if err != nil {
+		return err
+	}
+
+	var current *corev1.ConfigMap
+	for _, cm := range cms {
+		if cm.Name == name && len(digests) > 0 {
+			current = cm
+			continue
+		}
+		if err := d.corcli.CoreV1().ConfigMaps(namespace).Delete(
+			ctx, cm.Name, metav1.DeleteOptions{},
+		); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		klog.V(2).Infof("digests config map %s/%s deleted", namespace, cm.Name)
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+
+	if current == nil {
+		if _, err := d.cmlister.ConfigMaps(namespace).Get(name); err == nil {
+			return fmt.Errorf("config map %s/%s not managed by tagger", namespace, name)
+		} else if !errors.IsNotFound(err) {
+			return err
+		}
+
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+				Labels:    map[string]string{DigestsLabel: "true"},
+			},
+			Data: digests,
+		}
+		_, err := d.corcli.CoreV1().ConfigMaps(namespace).Create(
+			ctx, cm, metav1.CreateOptions{},
+		)
+		return err
+	}
+
+	if reflect.DeepEqual(current.Data, digests) {
+		return nil
+	}
+	current = current.DeepCopy()
+	current.Data = digests
+	_, err = d.corcli.CoreV1().ConfigMaps(namespace).Update(
+		ctx, current, metav1.UpdateOptions{},
+	)
+	return err
+}
+
+// digests returns the current references of the Tags in the namespace,
+// indexed by Tag name. Nothing is returned if the ConfigMaps are disabled,
+// i.e. name is empty.
+func (d *Digests) digests(namespace, name string) (map[string]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	tags, err := d.taglis.Tags(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	digests := map[string]string{}
+	for _, it := range tags {
+		if it.Spec.Disabled || it.CurrentReferenceIsArtifact() {
+			continue
+		}
+		if ref := it.CurrentReferenceForTag(); ref != "" {
+			digests[it.Name] = ref
+		}
+	}
+	return digests, nil
+}
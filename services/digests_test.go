@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	taginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestDigestsSync(t *testing.T) {
+	tags := []runtime.Object{
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+			Spec:       imagtagv1.TagSpec{Generation: 1},
+			Status: imagtagv1.TagStatus{
+				Generation: 1,
+				References: []imagtagv1.HashReference{
+					{Generation: 1, ImageReference: "quay.io/company/app@sha256:1"},
+					{Generation: 0, ImageReference: "quay.io/company/app@sha256:0"},
+				},
+			},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "worker"},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "quay.io/company/worker@sha256:0"},
+				},
+			},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "pending"},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "disabled"},
+			Spec:       imagtagv1.TagSpec{Disabled: true},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "quay.io/company/disabled@sha256:0"},
+				},
+			},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "staging", Name: "pending"},
+		},
+	}
+	prodDigests := map[string]string{
+		"app":    "quay.io/company/app@sha256:1",
+		"worker": "quay.io/company/worker@sha256:0",
+	}
+
+	managed := func(namespace, name string, data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+				Labels:    map[string]string{DigestsLabel: "true"},
+			},
+			Data: data,
+		}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		cfgname   string
+		namespace string
+		objects   []runtime.Object
+		expected  map[string]map[string]string
+		err       string
+	}{
+		{
+			name:      "disabled",
+			namespace: "prod",
+			expected:  map[string]map[string]string{},
+		},
+		{
+			name:      "created",
+			cfgname:   "digests",
+			namespace: "prod",
+			expected:  map[string]map[string]string{"prod/digests": prodDigests},
+		},
+		{
+			name:      "updated",
+			cfgname:   "digests",
+			namespace: "prod",
+			objects: []runtime.Object{
+				managed("prod", "digests", map[string]string{"app": "old"}),
+			},
+			expected: map[string]map[string]string{"prod/digests": prodDigests},
+		},
+		{
+			name:      "renamed",
+			cfgname:   "digests",
+			namespace: "prod",
+			objects: []runtime.Object{
+				managed("prod", "image-digests", prodDigests),
+			},
+			expected: map[string]map[string]string{"prod/digests": prodDigests},
+		},
+		{
+			name:      "disabled afterwards",
+			namespace: "prod",
+			objects: []runtime.Object{
+				managed("prod", "digests", prodDigests),
+			},
+			expected: map[string]map[string]string{},
+		},
+		{
+			name:      "no references",
+			cfgname:   "digests",
+			namespace: "staging",
+			objects: []runtime.Object{
+				managed("staging", "digests", map[string]string{"pending": "old"}),
+			},
+			expected: map[string]map[string]string{},
+		},
+		{
+			name:      "other namespaces untouched",
+			cfgname:   "digests",
+			namespace: "staging",
+			objects: []runtime.Object{
+				managed("prod", "digests", map[string]string{"app": "old"}),
+			},
+			expected: map[string]map[string]string{
+				"prod/digests": {"app": "old"},
+			},
+		},
+		{
+			name:      "not managed",
+			cfgname:   "digests",
+			namespace: "prod",
+			objects: []runtime.Object{
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "digests"},
+					Data:       map[string]string{"key": "value"},
+				},
+			},
+			expected: map[string]map[string]string{
+				"prod/digests": {"key": "value"},
+			},
+			err: "config map prod/digests not managed by tagger",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tagcli := tagfake.NewSimpleClientset(tags...)
+			taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+
+			corcli := corfake.NewSimpleClientset(tt.objects...)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			cmlis := corinf.Core().V1().ConfigMaps().Lister()
+
+			taginf.Start(ctx.Done())
+			corinf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				taginf.Images().V1().Tags().Informer().HasSynced,
+				corinf.Core().V1().ConfigMaps().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			svc := NewDigests(corcli, taglis, cmlis)
+			svc.ApplyConfig(&config.Config{DigestsConfigMap: tt.cfgname})
+			err := svc.Sync(ctx, tt.namespace)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, %v received", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			cms, err := corcli.CoreV1().ConfigMaps("").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			found := map[string]map[string]string{}
+			for _, cm := range cms.Items {
+				found[cm.Namespace+"/"+cm.Name] = cm.Data
+			}
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("expected %v, %v found", tt.expected, found)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/opencontainers/go-digest"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// ValidatePod verifies, for pods in namespaces with digest enforcement, that
+// every container image is pinned to the digest of a generation of some Tag,
+// i.e. that everything the pod runs went through us. It is meant to be run
+// once every mutation has been applied to the pod. Pods running any other
+// image are rejected or, in dry run, admitted with a warning per image.
+func (t *Tag) ValidatePod(ctx context.Context, pod corev1.Pod) ([]string, error) {
+	t.Lock()
+	enforcement := t.enforcement
+	t.Unlock()
+	if !enforcement.Enforced(pod.Namespace) {
+		return nil, nil
+	}
+
+	t.Lock()
+	digests := t.digests
+	t.Unlock()
+	if digests == nil {
+		return nil, fmt.Errorf("generation digests not indexed")
+	}
+
+	var images []string
+	for _, c := range pod.Spec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range pod.Spec.Containers {
+		images = append(images, c.Image)
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		images = append(images, c.Image)
+	}
+
+	seen := map[string]bool{}
+	var unknown []string
+	for _, image := range images {
+		if seen[image] {
+			continue
+		}
+		seen[image] = true
+		known, err := knownDigest(digests, imageDigest(image))
+		if err != nil {
+			return nil, err
+		}
+		if known {
+			continue
+		}
+		unknown = append(unknown, image)
+	}
+	if len(unknown) == 0 {
+		return nil, nil
+	}
+
+	if enforcement.DryRun {
+		metrics.UnknownImages.WithLabelValues(pod.Namespace, "warn").Inc()
+		var warnings []string
+		for _, image := range unknown {
+			warnings = append(
+				warnings, fmt.Sprintf("image %s is not a generation of any tag", image),
+			)
+		}
+		return warnings, nil
+	}
+
+	metrics.UnknownImages.WithLabelValues(pod.Namespace, "reject").Inc()
+	klog.V(2).Infof("pod %s/%s rejected, unknown images", pod.Namespace, pod.GenerateName)
+	return nil, fmt.Errorf(
+		"images not imported by any tag: %s", strings.Join(unknown, ", "),
+	)
+}
+
+// GenerationDigestIndex is the name of the Tag informer index mapping the
+// digests of Tag generations into the Tags holding them.
+const GenerationDigestIndex = "generationDigest"
+
+// IndexGenerationDigests indexes the Tags of the informer by the digests of
+// their generations, the index is kept up to date by the informer. Pod digest
+// enforcement looks every image up in the index. Must be called before the
+// informer is started.
+func (t *Tag) IndexGenerationDigests(taginf cache.SharedIndexInformer) error {
+	if err := taginf.AddIndexers(
+		cache.Indexers{GenerationDigestIndex: generationDigests},
+	); err != nil {
+		return err
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.digests = taginf.GetIndexer()
+	return nil
+}
+
+// generationDigests is the index function of GenerationDigestIndex.
+func generationDigests(obj interface{}) ([]string, error) {
+	it, ok := obj.(*imagtagv1.Tag)
+	if !ok {
+		return nil, nil
+	}
+	var digests []string
+	for _, ref := range it.Status.References {
+		if dgst := ref.Digest(); dgst != "" {
+			digests = append(digests, dgst)
+		}
+	}
+	return digests, nil
+}
+
+// knownDigest returns true if dgst is the digest of a generation of any Tag.
+func knownDigest(digests cache.Indexer, dgst string) (bool, error) {
+	if dgst == "" {
+		return false, nil
+	}
+	tags, err := digests.ByIndex(GenerationDigestIndex, dgst)
+	if err != nil {
+		return false, err
+	}
+	return len(tags) > 0, nil
+}
+
+// imageDigest returns the digest an image reference is pinned to, empty if
+// it is not pinned to a valid digest.
+func imageDigest(image string) string {
+	idx := strings.LastIndex(image, "@")
+	if idx < 0 {
+		return ""
+	}
+	dgst, err := digest.Parse(image[idx+1:])
+	if err != nil {
+		return ""
+	}
+	return dgst.String()
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	taginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestValidatePod(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	current := "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	previous := "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	other := "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "platform", Name: "base"},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "cache.io/platform/base@" + current},
+					{ImageReference: "quay.io/company/base@" + previous},
+				},
+			},
+		},
+	)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	svc := NewTag(nil, tagcli, taglis, nil, nil, nil, nil, nil, nil, nil)
+	if err := svc.IndexGenerationDigests(taginf.Images().V1().Tags().Informer()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), taginf.Images().V1().Tags().Informer().HasSynced) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	for _, tt := range []struct {
+		name      string
+		namespace string
+		dryRun    bool
+		init      []string
+		images    []string
+		warnings  []string
+		err       string
+	}{
+		{
+			name:      "namespace not enforcing",
+			namespace: "dev",
+			images:    []string{"centos:latest"},
+		},
+		{
+			name:      "generations of a tag",
+			namespace: "prod",
+			init:      []string{"cache.io/platform/base@" + current},
+			images:    []string{"quay.io/company/base@" + previous},
+		},
+		{
+			name:      "same digest elsewhere",
+			namespace: "prod",
+			images:    []string{"docker.io/library/base@" + current},
+		},
+		{
+			name:      "not pinned",
+			namespace: "prod",
+			images:    []string{"cache.io/platform/base@" + current, "centos:latest"},
+			err:       "images not imported by any tag: centos:latest",
+		},
+		{
+			name:      "unknown digest",
+			namespace: "prod",
+			init:      []string{"quay.io/company/tool@" + other},
+			images:    []string{"cache.io/platform/base@" + current},
+			err:       "images not imported by any tag: quay.io/company/tool@" + other,
+		},
+		{
+			name:      "dry run",
+			namespace: "prod",
+			dryRun:    true,
+			images:    []string{"centos:latest", "centos:latest", "base"},
+			warnings: []string{
+				"image centos:latest is not a generation of any tag",
+				"image base is not a generation of any tag",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: "pod"},
+			}
+			for _, image := range tt.init {
+				pod.Spec.InitContainers = append(
+					pod.Spec.InitContainers, corev1.Container{Image: image},
+				)
+			}
+			for _, image := range tt.images {
+				pod.Spec.Containers = append(
+					pod.Spec.Containers, corev1.Container{Image: image},
+				)
+			}
+
+			cfg := config.Default()
+			cfg.DigestEnforcement = config.DigestEnforcement{
+				Namespaces: []string{"prod"},
+				DryRun:     tt.dryRun,
+			}
+			svc.ApplyConfig(cfg)
+
+			warnings, err := svc.ValidatePod(ctx, pod)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, %q received", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Fatalf("expected error %q, nil received", tt.err)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("expected warnings %v, %v received", tt.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestValidatePodIndexUpdates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dgst := "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "platform", Name: "base"},
+	}
+	tagcli := tagfake.NewSimpleClientset(it)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	svc := NewTag(nil, tagcli, taglis, nil, nil, nil, nil, nil, nil, nil)
+	if err := svc.IndexGenerationDigests(taginf.Images().V1().Tags().Informer()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), taginf.Images().V1().Tags().Informer().HasSynced) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	cfg := config.Default()
+	cfg.DigestEnforcement = config.DigestEnforcement{Namespaces: []string{"prod"}}
+	svc.ApplyConfig(cfg)
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "pod"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Image: "quay.io/company/base@" + dgst}},
+		},
+	}
+	if _, err := svc.ValidatePod(ctx, pod); err == nil {
+		t.Fatal("expected unknown image to be rejected")
+	}
+
+	// the index follows the Tag as new generations are imported.
+	it.Status.References = []imagtagv1.HashReference{
+		{ImageReference: "quay.io/company/base@" + dgst},
+	}
+	if _, err := tagcli.ImagesV1().Tags("platform").Update(
+		ctx, it, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for {
+		if _, err := svc.ValidatePod(ctx, pod); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("new generation never indexed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+
+	"github.com/containers/image/v5/docker/reference"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// FluxPolicyAnnotation, set on a Tag, holds the name of a Flux ImagePolicy,
+// in the Tag namespace, whose status follows the Tag current generation.
+const FluxPolicyAnnotation = "image-tag-flux-policy"
+
+// fluxPolicyPath is the API path of a Flux ImagePolicy, by namespace and
+// name. Flux types are not vendored, policies are handled as unstructured.
+const fluxPolicyPath = "/apis/image.toolkit.fluxcd.io/v1beta2/namespaces/%s/imagepolicies/%s"
+
+// FluxPolicy writes the image Tags resolved into the status of Flux
+// ImagePolicies, the way the Flux image reflector would. The Flux image
+// automation, and anything else reading the policies, then follows Tagger
+// while a cluster moves from one to the other. Policies are only read and
+// updated, never created.
+type FluxPolicy struct {
+	restcli rest.Interface
+}
+
+// NewFluxPolicy returns a service keeping Flux ImagePolicies in line with
+// Tags. The client is used for raw requests on absolute paths, e.g. the
+// discovery rest client.
+func NewFluxPolicy(restcli rest.Interface) *FluxPolicy {
+	return &FluxPolicy{
+		restcli: restcli,
+	}
+}
+
+// Sync sets the latest image of the ImagePolicy named in the Tag annotation
+// to the Tag current generation. Nothing is done for Tags without the
+// annotation, disabled or without a current generation. Missing policies are
+// logged and otherwise ignored.
+func (f *FluxPolicy) Sync(ctx context.Context, it *imagtagv1.Tag) error {
+	name := it.Annotations[FluxPolicyAnnotation]
+	if name == "" || it.Spec.Disabled {
+		return nil
+	}
+	hashref, ok := it.CurrentHashReference()
+	if !ok || hashref.ImageReference == "" {
+		return nil
+	}
+
+	latest, ref, err := fluxLatestImage(hashref)
+	if err != nil {
+		return fmt.Errorf("error parsing reference of %s/%s: %w", it.Namespace, it.Name, err)
+	}
+
+	path := fmt.Sprintf(fluxPolicyPath, it.Namespace, name)
+	raw, err := f.restcli.Get().AbsPath(path).Do(ctx).Raw()
+	if err != nil {
+		if errors.IsNotFound(err) {
+			klog.V(2).Infof("flux image policy %s/%s not found", it.Namespace, name)
+			return nil
+		}
+		return fmt.Errorf("error reading flux image policy %s/%s: %w", it.Namespace, name, err)
+	}
+
+	policy := &unstructured.Unstructured{}
+	if err := policy.UnmarshalJSON(raw); err != nil {
+		return fmt.Errorf("error decoding flux image policy %s/%s: %w", it.Namespace, name, err)
+	}
+
+	status, _, err := unstructured.NestedMap(policy.Object, "status")
+	if err != nil {
+		return fmt.Errorf("invalid flux image policy %s/%s: %w", it.Namespace, name, err)
+	}
+	if status == nil {
+		status = map[string]interface{}{}
+	}
+	current := status["latestImage"]
+	currentRef := status["latestRef"]
+	if current == latest && reflect.DeepEqual(currentRef, ref) {
+		return nil
+	}
+	status["latestImage"] = latest
+	status["latestRef"] = ref
+	policy.Object["status"] = status
+
+	body, err := json.Marshal(policy.Object)
+	if err != nil {
+		return err
+	}
+	if err := f.restcli.Put().AbsPath(path, "status").Body(body).Do(ctx).Error(); err != nil {
+		return fmt.Errorf("error updating flux image policy %s/%s: %w", it.Namespace, name, err)
+	}
+	klog.V(2).Infof("flux image policy %s/%s set to %s", it.Namespace, name, latest)
+	return nil
+}
+
+// fluxLatestImage returns the latest image, and its reference split by name,
+// tag and digest, as recorded by Flux for the generation. The tag is the one
+// the generation has been imported from, if any, so "name:tag@digest" is
+// returned.
+func fluxLatestImage(hashref imagtagv1.HashReference) (string, map[string]interface{}, error) {
+	digest := hashref.Digest()
+	if digest == "" {
+		return "", nil, fmt.Errorf("%s has no digest", hashref.ImageReference)
+	}
+	name := strings.TrimSuffix(hashref.ImageReference, "@"+digest)
+
+	var tag string
+	if hashref.From != "" {
+		from, err := reference.ParseDockerRef(hashref.From)
+		if err != nil {
+			return "", nil, err
+		}
+		if tagged, ok := from.(reference.Tagged); ok {
+			tag = tagged.Tag()
+		}
+	}
+
+	ref := map[string]interface{}{"name": name, "digest": digest}
+	latest := name
+	if tag != "" {
+		ref["tag"] = tag
+		latest = fmt.Sprintf("%s:%s", name, tag)
+	}
+	return fmt.Sprintf("%s@%s", latest, digest), ref, nil
+}
@@ -0,0 +1,236 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	restfake "k8s.io/client-go/rest/fake"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// fluxServer answers requests for a single Flux ImagePolicy, kept as a map.
+type fluxServer struct {
+	policy map[string]interface{}
+	puts   int
+}
+
+func (f *fluxServer) do(req *http.Request) (*http.Response, error) {
+	const path = "/apis/image.toolkit.fluxcd.io/v1beta2/namespaces/prod/imagepolicies/app"
+
+	respond := func(code int, body interface{}) (*http.Response, error) {
+		data, _ := json.Marshal(body)
+		return &http.Response{
+			StatusCode: code,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(data)),
+		}, nil
+	}
+	notFound := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   metav1.StatusReasonNotFound,
+		Code:     http.StatusNotFound,
+	}
+
+	switch {
+	case f.policy == nil:
+		return respond(http.StatusNotFound, notFound)
+	case req.Method == http.MethodGet && req.URL.Path == path:
+		return respond(http.StatusOK, f.policy)
+	case req.Method == http.MethodPut && req.URL.Path == path+"/status":
+		f.puts++
+		f.policy = map[string]interface{}{}
+		if err := json.NewDecoder(req.Body).Decode(&f.policy); err != nil {
+			return nil, err
+		}
+		return respond(http.StatusOK, f.policy)
+	}
+	return respond(http.StatusNotFound, notFound)
+}
+
+func TestFluxPolicySync(t *testing.T) {
+	const digest = "sha256:5b0bcabd1ed22e9fb1310cf6c2dec7cdef19f0ad69efa1f392e94a4333501270"
+
+	imported := imagtagv1.TagStatus{
+		Generation: 1,
+		References: []imagtagv1.HashReference{
+			{
+				Generation:     1,
+				From:           "quay.io/company/app:v1.2",
+				ImageReference: "mirror.internal/prod/app@sha256:1",
+			},
+			{
+				Generation:     0,
+				From:           "quay.io/company/app:v1.1",
+				ImageReference: "mirror.internal/prod/app@sha256:0",
+			},
+		},
+	}
+	annotations := map[string]string{FluxPolicyAnnotation: "app"}
+
+	policy := func(status map[string]interface{}) map[string]interface{} {
+		obj := map[string]interface{}{
+			"apiVersion": "image.toolkit.fluxcd.io/v1beta2",
+			"kind":       "ImagePolicy",
+			"metadata": map[string]interface{}{
+				"namespace": "prod",
+				"name":      "app",
+			},
+			"spec": map[string]interface{}{
+				"imageRepositoryRef": map[string]interface{}{"name": "app"},
+			},
+		}
+		if status != nil {
+			obj["status"] = status
+		}
+		return obj
+	}
+	synced := map[string]interface{}{
+		"observedGeneration": float64(3),
+		"latestImage":        "mirror.internal/prod/app:v1.2@sha256:1",
+		"latestRef": map[string]interface{}{
+			"name":   "mirror.internal/prod/app",
+			"tag":    "v1.2",
+			"digest": "sha256:1",
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		tag      *imagtagv1.Tag
+		policy   map[string]interface{}
+		expected map[string]interface{}
+		puts     int
+	}{
+		{
+			name: "tag without annotation",
+			tag: &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+				Status:     imported,
+			},
+			policy:   policy(nil),
+			expected: policy(nil),
+		},
+		{
+			name: "tag not imported",
+			tag: &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "prod",
+					Name:        "app",
+					Annotations: annotations,
+				},
+			},
+			policy:   policy(nil),
+			expected: policy(nil),
+		},
+		{
+			name: "disabled tag",
+			tag: &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "prod",
+					Name:        "app",
+					Annotations: annotations,
+				},
+				Spec:   imagtagv1.TagSpec{Disabled: true},
+				Status: imported,
+			},
+			policy:   policy(nil),
+			expected: policy(nil),
+		},
+		{
+			name: "policy not found",
+			tag: &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "prod",
+					Name:        "app",
+					Annotations: annotations,
+				},
+				Status: imported,
+			},
+		},
+		{
+			name: "policy updated",
+			tag: &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "prod",
+					Name:        "app",
+					Annotations: annotations,
+				},
+				Status: imported,
+			},
+			policy: policy(map[string]interface{}{
+				"observedGeneration": float64(3),
+				"latestImage":        "quay.io/company/app:v1.1",
+			}),
+			expected: policy(synced),
+			puts:     1,
+		},
+		{
+			name: "policy up to date",
+			tag: &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "prod",
+					Name:        "app",
+					Annotations: annotations,
+				},
+				Status: imported,
+			},
+			policy:   policy(synced),
+			expected: policy(synced),
+		},
+		{
+			name: "imported by digest",
+			tag: &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "prod",
+					Name:        "app",
+					Annotations: annotations,
+				},
+				Status: imagtagv1.TagStatus{
+					References: []imagtagv1.HashReference{
+						{
+							From:           "quay.io/company/app@" + digest,
+							ImageReference: "quay.io/company/app@" + digest,
+						},
+					},
+				},
+			},
+			policy: policy(nil),
+			expected: policy(map[string]interface{}{
+				"latestImage": "quay.io/company/app@" + digest,
+				"latestRef": map[string]interface{}{
+					"name":   "quay.io/company/app",
+					"digest": digest,
+				},
+			}),
+			puts: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &fluxServer{policy: tt.policy}
+			restcli := &restfake.RESTClient{
+				NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+				Client:               restfake.CreateHTTPClient(srv.do),
+			}
+
+			svc := NewFluxPolicy(restcli)
+			if err := svc.Sync(context.Background(), tt.tag); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(srv.policy, tt.expected) {
+				t.Errorf("expected %v, %v found", tt.expected, srv.policy)
+			}
+			if srv.puts != tt.puts {
+				t.Errorf("expected %d updates, %d made", tt.puts, srv.puts)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// GitSyncLabel is set to "true" on Tags created by the git sync. Only Tags
+// carrying it are updated, and pruned, by the sync so Tags created by other
+// means are never touched.
+const GitSyncLabel = "image-tag-git-sync"
+
+// GitSyncCommitAnnotation holds, on Tags managed by the git sync, the commit
+// the Tag has last been changed by.
+const GitSyncCommitAnnotation = "image-tag-git-commit"
+
+// GitSync syncs Tag definitions from a path of a Git repository, see the
+// gitSync configuration. The repository is fetched through the git binary
+// into a work directory, only the last commit of the configured branch is
+// fetched. Tags are read from every yaml and json file under the path, other
+// objects in these files are ignored. When sharding only Tags in namespaces
+// owned by our shard are synced.
+type GitSync struct {
+	sync.Mutex
+	cfg       *config.GitSync
+	tagcli    tagclient.Interface
+	taglis    taglist.TagLister
+	sclister  corelister.SecretLister
+	namespace string
+	shard     *Shard
+	scratch   string
+	workdir   string
+	remote    string
+}
+
+// NewGitSync returns a git sync service. Credentials Secrets are read from
+// namespace, a nil shard syncs Tags in all namespaces.
+func NewGitSync(
+	tagcli tagclient.Interface,
+	taglis taglist.TagLister,
+	sclister corelister.SecretLister,
+	namespace string,
+	shard *Shard,
+) *GitSync {
+	return &GitSync{
+		tagcli:    tagcli,
+		taglis:    taglis,
+		sclister:  sclister,
+		namespace: namespace,
+		shard:     shard,
+		scratch:   config.Default().ScratchDir,
+	}
+}
+
+// ApplyConfig applies the git sync configuration and the scratch directory
+// the work directory is created in.
+func (g *GitSync) ApplyConfig(cfg *config.Config) {
+	g.Lock()
+	defer g.Unlock()
+	g.cfg = cfg.GitSync
+	g.scratch = cfg.ScratchDir
+}
+
+// config returns the current git sync configuration and scratch directory.
+func (g *GitSync) config() (*config.GitSync, string) {
+	g.Lock()
+	defer g.Unlock()
+	return g.cfg, g.scratch
+}
+
+// owns returns true if Tags in namespace are synced by us.
+func (g *GitSync) owns(namespace string) bool {
+	return g.shard == nil || g.shard.Owns(namespace)
+}
+
+// Sync fetches the repository and applies the Tags found in it. Nothing is
+// done if git sync is not configured. Failing to sync a Tag does not stop
+// the others from being synced, an error is returned at the end. Syncs must
+// not run concurrently as they share the work directory.
+func (g *GitSync) Sync(ctx context.Context) error {
+	cfg, scratch := g.config()
+	if cfg == nil {
+		return nil
+	}
+
+	commit, err := g.fetch(ctx, cfg, scratch)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", cfg.Repository, err)
+	}
+
+	tags, err := g.read(cfg)
+	if err != nil {
+		return fmt.Errorf("error reading tags at %s: %w", commit, err)
+	}
+
+	if err := g.apply(ctx, cfg, commit, tags); err != nil {
+		return err
+	}
+	metrics.GitSyncLastSuccess.SetToCurrentTime()
+	klog.V(2).Infof("%d tags synced from %s at %s", len(tags), cfg.Repository, commit)
+	return nil
+}
+
+// fetch fetches the last commit of the configured branch into the work
+// directory, created under scratch, and checks it out. Returns the commit.
+func (g *GitSync) fetch(ctx context.Context, cfg *config.GitSync, scratch string) (string, error) {
+	if scratch == "" {
+		scratch = os.TempDir()
+	}
+	scratch = filepath.Clean(scratch)
+	if g.workdir == "" || filepath.Dir(g.workdir) != scratch {
+		dir, err := ioutil.TempDir(scratch, "tagger-gitsync-")
+		if err != nil {
+			return "", err
+		}
+		if g.workdir != "" {
+			if err := os.RemoveAll(g.workdir); err != nil {
+				klog.Errorf("unable to remove %s: %s", g.workdir, err)
+			}
+		}
+		g.workdir = dir
+		g.remote = ""
+	}
+
+	// the work directory is started over if the repository changed.
+	if g.remote != cfg.Repository {
+		if err := os.RemoveAll(g.workdir); err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(g.workdir, 0700); err != nil {
+			return "", err
+		}
+		if _, err := g.git(ctx, nil, "init"); err != nil {
+			return "", err
+		}
+		if _, err := g.git(ctx, nil, "remote", "add", "origin", cfg.Repository); err != nil {
+			return "", err
+		}
+		g.remote = cfg.Repository
+	}
+
+	auth, err := g.credentials(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	branch := cfg.Branch
+	if branch == "" {
+		branch = "HEAD"
+	}
+	if _, err := g.git(ctx, auth, "fetch", "--depth", "1", "--no-tags", "origin", branch); err != nil {
+		g.remote = ""
+		return "", err
+	}
+	if _, err := g.git(ctx, nil, "checkout", "--force", "--detach", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	return g.git(ctx, nil, "rev-parse", "HEAD")
+}
+
+// credentials returns the git options authenticating against the repository
+// with the credentials in the configured Secret, if any.
+func (g *GitSync) credentials(cfg *config.GitSync) ([]string, error) {
+	if cfg.CredentialsSecret == "" {
+		return nil, nil
+	}
+
+	sec, err := g.sclister.Secrets(g.namespace).Get(cfg.CredentialsSecret)
+	if err != nil {
+		return nil, fmt.Errorf("error reading credentials: %w", err)
+	}
+	userpass := fmt.Sprintf("%s:%s", sec.Data["username"], sec.Data["password"])
+	header := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(userpass))
+	return []string{"-c", "http.extraHeader=" + header}, nil
+}
+
+// git runs a git command in the work directory, opts are placed before the
+// command. Returns the trimmed output. Errors carry the command name and its
+// output but never the options, as they may hold credentials.
+func (g *GitSync) git(ctx context.Context, opts []string, command string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append(append(opts, command), args...)...)
+	cmd.Dir = g.workdir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// read returns the Tags defined in the yaml and json files under the
+// configured path, indexed by "namespace/name". Tags without a namespace are
+// placed in the configured namespace.
+func (g *GitSync) read(cfg *config.GitSync) (map[string]*imagtagv1.Tag, error) {
+	root := filepath.Join(g.workdir, cfg.Path)
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	tags := map[string]*imagtagv1.Tag{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		rel, err := filepath.Rel(g.workdir, path)
+		if err != nil {
+			return err
+		}
+		found, err := readTags(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		for _, it := range found {
+			if it.Namespace == "" {
+				it.Namespace = cfg.Namespace
+			}
+			if it.Namespace == "" {
+				return fmt.Errorf("%s: tag %s has no namespace", rel, it.Name)
+			}
+			key := fmt.Sprintf("%s/%s", it.Namespace, it.Name)
+			if _, ok := tags[key]; ok {
+				return fmt.Errorf("%s: tag %s defined twice", rel, key)
+			}
+			tags[key] = it
+		}
+		return nil
+	})
+	return tags, err
+}
+
+// readTags returns the Tags in a file holding one or more yaml documents or
+// json objects. Other kinds of objects are ignored.
+func readTags(path string) ([]*imagtagv1.Tag, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tags []*imagtagv1.Tag
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if err == io.EOF {
+				return tags, nil
+			}
+			return nil, err
+		}
+		if obj["apiVersion"] != imagtagv1.SchemeGroupVersion.String() || obj["kind"] != "Tag" {
+			continue
+		}
+
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		it := &imagtagv1.Tag{}
+		if err := json.Unmarshal(data, it); err != nil {
+			return nil, err
+		}
+		if it.Name == "" {
+			return nil, fmt.Errorf("tag without a name")
+		}
+		tags = append(tags, it)
+	}
+}
+
+// apply creates or updates the Tags read from the repository and, if pruning
+// is enabled, deletes the ones synced before and no longer present.
+func (g *GitSync) apply(
+	ctx context.Context, cfg *config.GitSync, commit string, tags map[string]*imagtagv1.Tag,
+) error {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var failures []string
+	for _, key := range keys {
+		it := tags[key]
+		if !g.owns(it.Namespace) {
+			continue
+		}
+		if err := g.applyTag(ctx, it, commit); err != nil {
+			klog.Errorf("error syncing tag %s: %s", key, err)
+			failures = append(failures, key)
+		}
+	}
+
+	if cfg.Prune {
+		pruned, err := g.prune(ctx, tags)
+		if err != nil {
+			return fmt.Errorf("error pruning tags: %w", err)
+		}
+		failures = append(failures, pruned...)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to sync tags: %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// applyTag creates the Tag or, if it is managed by the git sync, updates its
+// spec, labels and annotations. The generation in the cluster is kept unless
+// the repository sets one, so upgrades and downgrades done through the API
+// or kubectl tag are not reverted.
+func (g *GitSync) applyTag(ctx context.Context, it *imagtagv1.Tag, commit string) error {
+	cur, err := g.taglis.Tags(it.Namespace).Get(it.Name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		it = &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   it.Namespace,
+				Name:        it.Name,
+				Labels:      it.Labels,
+				Annotations: it.Annotations,
+			},
+			Spec: it.Spec,
+		}
+		if it.Labels == nil {
+			it.Labels = map[string]string{}
+		}
+		if it.Annotations == nil {
+			it.Annotations = map[string]string{}
+		}
+		it.Labels[GitSyncLabel] = "true"
+		it.Annotations[GitSyncCommitAnnotation] = commit
+		_, err := g.tagcli.ImagesV1().Tags(it.Namespace).Create(
+			ctx, it, metav1.CreateOptions{},
+		)
+		return err
+	}
+
+	if cur.Labels[GitSyncLabel] != "true" {
+		klog.Warningf(
+			"tag %s/%s not created by git sync, leaving it alone", it.Namespace, it.Name,
+		)
+		return nil
+	}
+
+	upd := cur.DeepCopy()
+	upd.Spec = it.Spec
+	if upd.Spec.Generation == 0 {
+		upd.Spec.Generation = cur.Spec.Generation
+	}
+	for key, val := range it.Labels {
+		upd.Labels[key] = val
+	}
+	if len(it.Annotations) > 0 && upd.Annotations == nil {
+		upd.Annotations = map[string]string{}
+	}
+	for key, val := range it.Annotations {
+		upd.Annotations[key] = val
+	}
+	if reflect.DeepEqual(upd, cur) {
+		return nil
+	}
+
+	if upd.Annotations == nil {
+		upd.Annotations = map[string]string{}
+	}
+	upd.Annotations[GitSyncCommitAnnotation] = commit
+	_, err = g.tagcli.ImagesV1().Tags(upd.Namespace).Update(ctx, upd, metav1.UpdateOptions{})
+	return err
+}
+
+// prune deletes the Tags created by the git sync that are not in tags.
+// Returns the Tags that could not be deleted.
+func (g *GitSync) prune(ctx context.Context, tags map[string]*imagtagv1.Tag) ([]string, error) {
+	synced, err := g.taglis.List(labels.SelectorFromSet(labels.Set{GitSyncLabel: "true"}))
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []string
+	for _, it := range synced {
+		key := fmt.Sprintf("%s/%s", it.Namespace, it.Name)
+		if _, ok := tags[key]; ok || !g.owns(it.Namespace) {
+			continue
+		}
+
+		klog.Infof("tag %s no longer in git, deleting", key)
+		if err := g.tagcli.ImagesV1().Tags(it.Namespace).Delete(
+			ctx, it.Name, metav1.DeleteOptions{},
+		); err != nil && !errors.IsNotFound(err) {
+			klog.Errorf("error pruning tag %s: %s", key, err)
+			failures = append(failures, key)
+		}
+	}
+	return failures, nil
+}
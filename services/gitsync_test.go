@@ -0,0 +1,312 @@
+package services
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	taginformer "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// gitRepo is a local repository Tags are synced from.
+type gitRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newGitRepo(t *testing.T) *gitRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary not available")
+	}
+	dir, err := ioutil.TempDir("", "tagger-gitrepo-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	repo := &gitRepo{t: t, dir: dir}
+	repo.git("init")
+	repo.git("config", "user.email", "tagger@example.com")
+	repo.git("config", "user.name", "tagger")
+	return repo
+}
+
+func (r *gitRepo) git(args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %s: %s", args[0], err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit replaces the repository content by files and commits. Returns the
+// commit.
+func (r *gitRepo) commit(files map[string]string) string {
+	entries, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		r.t.Fatalf("unexpected error: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == ".git" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(r.dir, entry.Name())); err != nil {
+			r.t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	for name, content := range files {
+		path := filepath.Join(r.dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatalf("unexpected error: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			r.t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	r.git("add", "-A")
+	r.git("commit", "--allow-empty", "-m", "update")
+	return r.git("rev-parse", "HEAD")
+}
+
+func TestGitSync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	repo := newGitRepo(t)
+	defer os.RemoveAll(repo.dir)
+
+	manual := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "manual"},
+		Spec:       imagtagv1.TagSpec{From: "centos:7"},
+	}
+	tagcli := tagfake.NewSimpleClientset(manual)
+	taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), taginf.Images().V1().Tags().Informer().HasSynced) {
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	scratch, err := ioutil.TempDir("", "tagger-scratch-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	svc := NewGitSync(tagcli, taglis, nil, "tagger", nil)
+	svc.ApplyConfig(&config.Config{
+		GitSync: &config.GitSync{
+			Repository: "file://" + repo.dir,
+			Path:       "prod",
+			Namespace:  "prod",
+			Prune:      true,
+		},
+		ScratchDir: scratch,
+	})
+
+	first := repo.commit(map[string]string{
+		"README.md": "not a tag",
+		"prod/tags.yaml": `apiVersion: images.io/v1
+kind: Tag
+metadata:
+  name: app
+  labels:
+    team: payments
+spec:
+  from: quay.io/company/app:latest
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: images.io/v1
+kind: Tag
+metadata:
+  name: manual
+spec:
+  from: centos:8
+`,
+		"prod/worker/worker.json": `{
+  "apiVersion": "images.io/v1",
+  "kind": "Tag",
+  "metadata": {"name": "worker", "namespace": "workers"},
+  "spec": {"from": "quay.io/company/worker:latest"}
+}`,
+		"staging/tags.yaml": `apiVersion: images.io/v1
+kind: Tag
+metadata:
+  name: staging
+spec:
+  from: quay.io/company/app:staging
+`,
+	})
+
+	if err := svc.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"prod/app":       "quay.io/company/app:latest",
+		"prod/manual":    "centos:7",
+		"workers/worker": "quay.io/company/worker:latest",
+	}
+	checkGitSyncedTags(ctx, t, tagcli, expected, first)
+	if filepath.Dir(svc.workdir) != scratch {
+		t.Errorf("work directory %s not in scratch directory %s", svc.workdir, scratch)
+	}
+
+	app, err := tagcli.ImagesV1().Tags("prod").Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if app.Labels["team"] != "payments" {
+		t.Errorf("expected labels to be synced: %v", app.Labels)
+	}
+
+	// upgrades done in the cluster are kept, the worker is pruned.
+	app.Spec.Generation = 3
+	if _, err := tagcli.ImagesV1().Tags("prod").Update(
+		ctx, app, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	second := repo.commit(map[string]string{
+		"prod/tags.yaml": `apiVersion: images.io/v1
+kind: Tag
+metadata:
+  name: app
+spec:
+  from: quay.io/company/app:stable
+`,
+	})
+	time.Sleep(time.Second)
+
+	if err := svc.Sync(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = map[string]string{
+		"prod/app":    "quay.io/company/app:stable",
+		"prod/manual": "centos:7",
+	}
+	checkGitSyncedTags(ctx, t, tagcli, expected, second)
+
+	app, err = tagcli.ImagesV1().Tags("prod").Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if app.Spec.Generation != 3 {
+		t.Errorf("expected generation to be kept, %d found", app.Spec.Generation)
+	}
+}
+
+// checkGitSyncedTags compares the Tags in the cluster, by their from, with
+// expected. Tags synced from git must have been changed by commit.
+func checkGitSyncedTags(
+	ctx context.Context,
+	t *testing.T,
+	tagcli *tagfake.Clientset,
+	expected map[string]string,
+	commit string,
+) {
+	list, err := tagcli.ImagesV1().Tags("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	found := map[string]string{}
+	for _, it := range list.Items {
+		key := it.Namespace + "/" + it.Name
+		found[key] = it.Spec.From
+		if it.Name == "manual" {
+			if it.Labels[GitSyncLabel] != "" {
+				t.Errorf("tag %s should not be managed by git sync", key)
+			}
+			continue
+		}
+		if it.Labels[GitSyncLabel] != "true" {
+			t.Errorf("expected tag %s to be labeled", key)
+		}
+		if it.Annotations[GitSyncCommitAnnotation] != commit {
+			t.Errorf("expected tag %s to be synced from %s: %v", key, commit, it.Annotations)
+		}
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, %v found", expected, found)
+	}
+}
+
+func TestGitSyncInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		path  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "missing path",
+			path: "prod",
+			err:  "no such file or directory",
+		},
+		{
+			name: "tag without namespace",
+			files: map[string]string{
+				"tag.yaml": "apiVersion: images.io/v1\nkind: Tag\nmetadata:\n  name: app\n",
+			},
+			err: "tag.yaml: tag app has no namespace",
+		},
+		{
+			name: "tag defined twice",
+			files: map[string]string{
+				"a.yaml": "apiVersion: images.io/v1\nkind: Tag\nmetadata:\n  name: app\n  namespace: prod\n",
+				"b.yaml": "apiVersion: images.io/v1\nkind: Tag\nmetadata:\n  name: app\n  namespace: prod\n",
+			},
+			err: "b.yaml: tag prod/app defined twice",
+		},
+		{
+			name: "tag without name",
+			files: map[string]string{
+				"tag.yaml": "apiVersion: images.io/v1\nkind: Tag\nmetadata:\n  namespace: prod\n",
+			},
+			err: "tag.yaml: tag without a name",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			repo := newGitRepo(t)
+			defer os.RemoveAll(repo.dir)
+			repo.commit(tt.files)
+
+			tagcli := tagfake.NewSimpleClientset()
+			taginf := taginformer.NewSharedInformerFactory(tagcli, time.Minute)
+			svc := NewGitSync(tagcli, taginf.Images().V1().Tags().Lister(), nil, "tagger", nil)
+			defer os.RemoveAll(svc.workdir)
+			svc.ApplyConfig(&config.Config{
+				GitSync: &config.GitSync{
+					Repository: "file://" + repo.dir,
+					Path:       tt.path,
+					Prune:      true,
+				},
+			})
+
+			err := svc.Sync(ctx)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error %q, %v received", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corecli "k8s.io/client-go/kubernetes"
+)
+
+// Keys of the handover ConfigMap. Pending holds one "namespace/name" key per
+// line and SavedAt when the keys were saved, in RFC3339 with nanoseconds.
+const (
+	handoverPendingKey = "pending"
+	handoverSavedAtKey = "savedAt"
+)
+
+// Handover persists, in a ConfigMap, the keys the leader still has to process
+// so the replica taking over resumes them. Events observed by a standby
+// replica after the keys were saved must be processed as well, see Tag
+// controller in controllers/tag.go.
+type Handover struct {
+	corcli    corecli.Interface
+	namespace string
+	name      string
+}
+
+// NewHandover returns a handover stored in the ConfigMap with the provided
+// namespace and name.
+func NewHandover(corcli corecli.Interface, namespace, name string) *Handover {
+	return &Handover{
+		corcli:    corcli,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Save stores the pending keys, replacing the ones previously saved.
+func (h *Handover) Save(ctx context.Context, keys []string, at time.Time) error {
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+	data := map[string]string{
+		handoverPendingKey: strings.Join(keys, "\n"),
+		handoverSavedAtKey: at.UTC().Format(time.RFC3339Nano),
+	}
+
+	cms := h.corcli.CoreV1().ConfigMaps(h.namespace)
+	cm, err := cms.Get(ctx, h.name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: h.namespace,
+				Name:      h.name,
+			},
+			Data: data,
+		}
+		_, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+
+	cm.Data = data
+	_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// Load returns the pending keys and when they were saved. If nothing has
+// been saved the zero time is returned.
+func (h *Handover) Load(ctx context.Context) ([]string, time.Time, error) {
+	cm, err := h.corcli.CoreV1().ConfigMaps(h.namespace).Get(
+		ctx, h.name, metav1.GetOptions{},
+	)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, cm.Data[handoverSavedAtKey])
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid handover time: %w", err)
+	}
+
+	var keys []string
+	for _, key := range strings.Split(cm.Data[handoverPendingKey], "\n") {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, at, nil
+}
+
+// HandoverName returns the name of the handover ConfigMap of a shard.
+func HandoverName(shard int) string {
+	return fmt.Sprintf("tagger-handover-%d", shard)
+}
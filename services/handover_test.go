@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHandover(t *testing.T) {
+	ctx := context.Background()
+	handover := NewHandover(fake.NewSimpleClientset(), "tagger", HandoverName(0))
+
+	keys, at, err := handover.Load(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if keys != nil || !at.IsZero() {
+		t.Errorf("expected nothing saved, %v at %s received", keys, at)
+	}
+
+	saved := time.Date(2021, 1, 1, 12, 0, 0, 500, time.UTC)
+	for _, pending := range [][]string{
+		{"ns/b", "ns/a"},
+		{"ns/c"},
+		nil,
+	} {
+		if err := handover.Save(ctx, pending, saved); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		keys, at, err := handover.Load(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !at.Equal(saved) {
+			t.Errorf("expected %s, %s received", saved, at)
+		}
+
+		var expected []string
+		if pending != nil {
+			expected = append(expected, pending...)
+			if len(expected) == 2 {
+				expected[0], expected[1] = expected[1], expected[0]
+			}
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("expected %v, %v received", expected, keys)
+		}
+	}
+}
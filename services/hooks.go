@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// HookTagLabel is set on import hook Jobs, holding the name of the Tag they
+// were run for.
+const HookTagLabel = "image-tag-hook"
+
+// HookError is returned when an import hook Job fails.
+type HookError struct {
+	Hook    string
+	Job     string
+	Message string
+}
+
+// Error returns the error message.
+func (h *HookError) Error() string {
+	return fmt.Sprintf("%s hook job %s failed: %s", h.Hook, h.Job, h.Message)
+}
+
+// Reason returns the reason used in the Tag conditions.
+func (h *HookError) Reason() string {
+	return imagtagv1.ReasonHookFailed
+}
+
+// ImportHooks runs the import hook Jobs of Tags, see imagtagv1.ImportHooks.
+// A Job is created once per hook and generation, it is named after the Tag,
+// the hook and the generation, and owned by the Tag so it is removed with it.
+type ImportHooks struct {
+	corcli kubernetes.Interface
+}
+
+// NewImportHooks returns a runner for import hook Jobs.
+func NewImportHooks(corcli kubernetes.Interface) *ImportHooks {
+	return &ImportHooks{
+		corcli: corcli,
+	}
+}
+
+// Run creates, if it does not exist yet, the Job for the hook and the Tag
+// generation in spec and returns its state. The spec is only used when the
+// Job is created and image is handed to its containers.
+func (h *ImportHooks) Run(
+	ctx context.Context, it *imagtagv1.Tag, hook string, spec *batchv1.JobSpec, image string,
+) (imagtagv1.HookRun, error) {
+	name := hookJobName(it, hook)
+	run := imagtagv1.HookRun{
+		Hook:       hook,
+		Generation: it.Spec.Generation,
+		Job:        name,
+		Phase:      imagtagv1.HookRunning,
+	}
+
+	jobs := h.corcli.BatchV1().Jobs(it.Namespace)
+	job, err := jobs.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		job, err = jobs.Create(ctx, hookJob(it, hook, spec, image), metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			job, err = jobs.Get(ctx, name, metav1.GetOptions{})
+		}
+	}
+	if err != nil {
+		return imagtagv1.HookRun{}, err
+	}
+
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch cond.Type {
+		case batchv1.JobComplete:
+			run.Phase = imagtagv1.HookSucceeded
+		case batchv1.JobFailed:
+			run.Phase = imagtagv1.HookFailed
+			run.Message = cond.Message
+		}
+	}
+	return run, nil
+}
+
+// hookJobName returns the name of the Job for the hook and the Tag generation
+// in spec. Tag names are trimmed so the Job name fits in the job-name label
+// set on its pods.
+func hookJobName(it *imagtagv1.Tag, hook string) string {
+	suffix := fmt.Sprintf("-%s-%d", strings.ToLower(hook), it.Spec.Generation)
+	name := it.Name
+	if max := 63 - len(suffix); len(name) > max {
+		name = strings.TrimRight(name[:max], "-.")
+	}
+	return name + suffix
+}
+
+// hookJob returns the Job for the hook and the Tag generation in spec. Every
+// container gets the image, the Tag name and the generation through the
+// TAGGER_IMAGE, TAGGER_TAG and TAGGER_GENERATION environment variables.
+func hookJob(
+	it *imagtagv1.Tag, hook string, spec *batchv1.JobSpec, image string,
+) *batchv1.Job {
+	ctrl := true
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      hookJobName(it, hook),
+			Namespace: it.Namespace,
+			Labels:    map[string]string{HookTagLabel: it.Name},
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "images.io/v1",
+					Kind:       "Tag",
+					Name:       it.Name,
+					UID:        it.UID,
+					Controller: &ctrl,
+				},
+			},
+		},
+		Spec: *spec.DeepCopy(),
+	}
+
+	// jobs are only accepted with one of these restart policies.
+	podspec := &job.Spec.Template.Spec
+	if podspec.RestartPolicy != corev1.RestartPolicyOnFailure {
+		podspec.RestartPolicy = corev1.RestartPolicyNever
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "TAGGER_IMAGE", Value: image},
+		{Name: "TAGGER_TAG", Value: it.Name},
+		{Name: "TAGGER_GENERATION", Value: strconv.FormatInt(it.Spec.Generation, 10)},
+	}
+	for i := range podspec.InitContainers {
+		podspec.InitContainers[i].Env = append(podspec.InitContainers[i].Env, env...)
+	}
+	for i := range podspec.Containers {
+		podspec.Containers[i].Env = append(podspec.Containers[i].Env, env...)
+	}
+	return job
+}
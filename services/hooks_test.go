@@ -0,0 +1,280 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corfake "k8s.io/client-go/kubernetes/fake"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func hookTestSpec() *batchv1.JobSpec {
+	return &batchv1.JobSpec{
+		Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:  "contract",
+						Image: "quay.io/company/contract-tests:latest",
+						Env:   []corev1.EnvVar{{Name: "SUITE", Value: "api"}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func hookTestJob(name string, cond batchv1.JobConditionType, msg string) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+		},
+	}
+	if cond != "" {
+		job.Status.Conditions = []batchv1.JobCondition{
+			{Type: cond, Status: corev1.ConditionTrue, Message: msg},
+		}
+	}
+	return job
+}
+
+func TestImportHooksRun(t *testing.T) {
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "app",
+			UID:       "uid",
+		},
+		Spec: imagtagv1.TagSpec{
+			From:       "quay.io/company/app:latest",
+			Generation: 2,
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		objects  []runtime.Object
+		expected imagtagv1.HookRun
+	}{
+		{
+			name: "job created",
+			expected: imagtagv1.HookRun{
+				Hook:       imagtagv1.HookPostImport,
+				Generation: 2,
+				Job:        "app-postimport-2",
+				Phase:      imagtagv1.HookRunning,
+			},
+		},
+		{
+			name: "job succeeded",
+			objects: []runtime.Object{
+				hookTestJob("app-postimport-2", batchv1.JobComplete, ""),
+			},
+			expected: imagtagv1.HookRun{
+				Hook:       imagtagv1.HookPostImport,
+				Generation: 2,
+				Job:        "app-postimport-2",
+				Phase:      imagtagv1.HookSucceeded,
+			},
+		},
+		{
+			name: "job failed",
+			objects: []runtime.Object{
+				hookTestJob("app-postimport-2", batchv1.JobFailed, "backoff limit exceeded"),
+			},
+			expected: imagtagv1.HookRun{
+				Hook:       imagtagv1.HookPostImport,
+				Generation: 2,
+				Job:        "app-postimport-2",
+				Phase:      imagtagv1.HookFailed,
+				Message:    "backoff limit exceeded",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			corcli := corfake.NewSimpleClientset(tt.objects...)
+			hooks := NewImportHooks(corcli)
+			run, err := hooks.Run(
+				ctx, it, imagtagv1.HookPostImport, hookTestSpec(), "cache/app@sha256:abc",
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(run, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, run)
+			}
+
+			job, err := corcli.BatchV1().Jobs("default").Get(ctx, run.Job, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(tt.objects) > 0 {
+				return
+			}
+
+			if job.Labels[HookTagLabel] != "app" {
+				t.Errorf("expected job labeled with the tag, %v found", job.Labels)
+			}
+			if len(job.OwnerReferences) != 1 || job.OwnerReferences[0].UID != "uid" {
+				t.Errorf("expected job owned by the tag, %v found", job.OwnerReferences)
+			}
+			podspec := job.Spec.Template.Spec
+			if podspec.RestartPolicy != corev1.RestartPolicyNever {
+				t.Errorf("expected restart policy never, %s found", podspec.RestartPolicy)
+			}
+			env := []corev1.EnvVar{
+				{Name: "SUITE", Value: "api"},
+				{Name: "TAGGER_IMAGE", Value: "cache/app@sha256:abc"},
+				{Name: "TAGGER_TAG", Value: "app"},
+				{Name: "TAGGER_GENERATION", Value: "2"},
+			}
+			if !reflect.DeepEqual(podspec.Containers[0].Env, env) {
+				t.Errorf("expected env %v, %v found", env, podspec.Containers[0].Env)
+			}
+		})
+	}
+}
+
+func TestHookJobName(t *testing.T) {
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("a", 60) + "-b"},
+		Spec:       imagtagv1.TagSpec{Generation: 10},
+	}
+	name := hookJobName(it, imagtagv1.HookPreImport)
+	if len(name) > 63 {
+		t.Errorf("job name %s longer than 63 characters", name)
+	}
+	if !strings.HasSuffix(name, "-preimport-10") {
+		t.Errorf("expected hook and generation suffix, %s found", name)
+	}
+}
+
+func TestPreImportHook(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec: imagtagv1.TagSpec{
+			From:       "quay.io/company/app:latest",
+			Generation: 1,
+			Hooks:      &imagtagv1.ImportHooks{PreImport: hookTestSpec()},
+		},
+	}
+	corcli := corfake.NewSimpleClientset()
+	tagcli := tagfake.NewSimpleClientset(it)
+	svc := NewTag(corcli, tagcli, nil, nil, nil, nil, nil, nil, nil, nil)
+
+	cur := it.DeepCopy()
+	passed, err := svc.preImportHook(ctx, it, cur)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if passed {
+		t.Fatal("expected the import to wait for the hook")
+	}
+	stored, err := tagcli.ImagesV1().Tags("default").Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if run, _ := stored.HookRun(imagtagv1.HookPreImport); run.Phase != imagtagv1.HookRunning {
+		t.Errorf("expected running hook recorded, %+v found", run)
+	}
+
+	// the job fails, the failure is recorded as an import failure.
+	job := hookTestJob("app-preimport-1", batchv1.JobFailed, "tests failed")
+	if _, err := corcli.BatchV1().Jobs("default").UpdateStatus(
+		ctx, job, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cur = stored.DeepCopy()
+	if passed, err = svc.preImportHook(ctx, stored, cur); err != nil || passed {
+		t.Fatalf("expected import held without error, %v %v received", passed, err)
+	}
+	cond := meta.FindStatusCondition(cur.Status.Conditions, imagtagv1.ConditionImported)
+	if cond == nil || cond.Reason != imagtagv1.ReasonHookFailed {
+		t.Errorf("expected import failed by the hook, %+v found", cond)
+	}
+}
+
+func TestPostImportHook(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newTag := func() *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+			Spec: imagtagv1.TagSpec{
+				From:       "quay.io/company/app:latest",
+				Generation: 2,
+				Hooks:      &imagtagv1.ImportHooks{PostImport: hookTestSpec()},
+			},
+			Status: imagtagv1.TagStatus{
+				Generation: 1,
+				References: []imagtagv1.HashReference{
+					{Generation: 2, ImageReference: "cache/app@sha256:2"},
+					{Generation: 1, ImageReference: "cache/app@sha256:1"},
+				},
+			},
+		}
+	}
+
+	corcli := corfake.NewSimpleClientset()
+	svc := NewTag(corcli, tagfake.NewSimpleClientset(), nil, nil, nil, nil, nil, nil, nil, nil)
+
+	it := newTag()
+	held, err := svc.postImportHook(ctx, it)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !held {
+		t.Fatal("expected generation held while the hook runs")
+	}
+	expected := "waiting for PostImport hook job app-postimport-2"
+	if it.Status.Promotion == nil || it.Status.Promotion.Message != expected {
+		t.Errorf("expected promotion pending, %+v found", it.Status.Promotion)
+	}
+	job, err := corcli.BatchV1().Jobs("default").Get(ctx, "app-postimport-2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	env := job.Spec.Template.Spec.Containers[0].Env
+	if image := env[1]; image.Value != "cache/app@sha256:2" {
+		t.Errorf("expected hook run against the imported image, %v found", image)
+	}
+
+	// the job succeeds, the generation may be promoted.
+	job.Status.Conditions = []batchv1.JobCondition{
+		{Type: batchv1.JobComplete, Status: corev1.ConditionTrue},
+	}
+	if _, err := corcli.BatchV1().Jobs("default").UpdateStatus(
+		ctx, job, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if held, err = svc.postImportHook(ctx, it); err != nil || held {
+		t.Errorf("expected generation released, %v %v received", held, err)
+	}
+
+	// downgrades are never held.
+	downgrade := newTag()
+	downgrade.Spec.Generation = 0
+	if held, err = svc.postImportHook(ctx, downgrade); err != nil || held {
+		t.Errorf("expected downgrade not held, %v %v received", held, err)
+	}
+}
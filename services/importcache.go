@@ -0,0 +1,168 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/containers/image/v5/docker/reference"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// importInvalidationKeep is how long pushes to a repository are remembered,
+// longer than an import may take, see syncTag in controllers/tag.go.
+const importInvalidationKeep = 5 * time.Minute
+
+// importCacheEntry is a reference resolved by an import, and when the import
+// resolving it started.
+type importCacheEntry struct {
+	repository string
+	hashref    imagtagv1.HashReference
+	resolvedAt time.Time
+}
+
+// ImportCache shares the references resolved by imports among the Tags, not
+// mirrored, importing the same image: for the configured TTL a single check
+// against the upstream registry serves all of them. References resolved with
+// credentials are only shared among the Tags of the same namespace, the ones
+// resolved anonymously among all Tags. A push reported by a webhook drops the
+// references resolved, until then, for the pushed repository.
+type ImportCache struct {
+	sync.Mutex
+	ttl         time.Duration
+	entries     map[string]importCacheEntry
+	invalidated map[string]time.Time
+	now         func() time.Time
+}
+
+// NewImportCache returns an import cache using the default configuration.
+func NewImportCache() *ImportCache {
+	return &ImportCache{
+		ttl:         config.Default().ImportCacheTTL,
+		entries:     map[string]importCacheEntry{},
+		invalidated: map[string]time.Time{},
+		now:         time.Now,
+	}
+}
+
+// ApplyConfig applies the import cache TTL. Everything cached is dropped as
+// the configuration may change how images resolve (e.g. registry mirrors or
+// image label projections).
+func (c *ImportCache) ApplyConfig(cfg *config.Config) {
+	c.Lock()
+	defer c.Unlock()
+	c.ttl = cfg.ImportCacheTTL
+	c.entries = map[string]importCacheEntry{}
+}
+
+// importCacheKey returns the key of the references resolved for the Tag. An
+// empty namespace means the reference has been resolved anonymously.
+func importCacheKey(namespace string, it *imagtagv1.Tag) string {
+	selector := ""
+	if it.Spec.ImageSelector != nil {
+		selector = metav1.FormatLabelSelector(it.Spec.ImageSelector)
+	}
+	return fmt.Sprintf("%s|%s|%s", namespace, it.Spec.From, selector)
+}
+
+// importRepository returns the repository an image reference belongs to,
+// the reference itself if it can't be parsed.
+func importRepository(image string) string {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return image
+	}
+	return named.Name()
+}
+
+// Get returns a reference resolved, within the TTL, for another Tag importing
+// the same image as the provided one. The reference is returned for the
+// generation in the Tag spec.
+func (c *ImportCache) Get(it *imagtagv1.Tag) (imagtagv1.HashReference, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.ttl == 0 {
+		return imagtagv1.HashReference{}, false
+	}
+
+	for _, key := range []string{importCacheKey(it.Namespace, it), importCacheKey("", it)} {
+		entry, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+		if c.now().Sub(entry.resolvedAt) > c.ttl {
+			delete(c.entries, key)
+			continue
+		}
+
+		hashref := *entry.hashref.DeepCopy()
+		hashref.Generation = it.Spec.Generation
+		hashref.ImportedAt = metav1.NewTime(c.now())
+		return hashref, true
+	}
+	return imagtagv1.HashReference{}, false
+}
+
+// Put caches the reference resolved for a Tag by an import started at
+// started. Anonymous tells if the reference has been resolved without
+// credentials. References resolved before the last push to the repository
+// are ignored.
+func (c *ImportCache) Put(
+	it *imagtagv1.Tag,
+	hashref imagtagv1.HashReference,
+	anonymous bool,
+	started time.Time,
+) {
+	c.Lock()
+	defer c.Unlock()
+	if c.ttl == 0 {
+		return
+	}
+
+	repository := importRepository(it.Spec.From)
+	if started.Before(c.invalidated[repository]) {
+		return
+	}
+
+	// expired entries are dropped here as well, so images no longer
+	// imported don't stay around.
+	for key, entry := range c.entries {
+		if c.now().Sub(entry.resolvedAt) > c.ttl {
+			delete(c.entries, key)
+		}
+	}
+	for repo, at := range c.invalidated {
+		if c.now().Sub(at) > importInvalidationKeep {
+			delete(c.invalidated, repo)
+		}
+	}
+
+	namespace := it.Namespace
+	if anonymous {
+		namespace = ""
+	}
+	c.entries[importCacheKey(namespace, it)] = importCacheEntry{
+		repository: repository,
+		hashref:    *hashref.DeepCopy(),
+		resolvedAt: started,
+	}
+}
+
+// Invalidate drops the references resolved for the repository of image, as
+// something has been pushed to it. Imports in flight are not cached either.
+func (c *ImportCache) Invalidate(image string) {
+	c.Lock()
+	defer c.Unlock()
+
+	repository := importRepository(image)
+	c.invalidated[repository] = c.now()
+	for key, entry := range c.entries {
+		if entry.repository == repository {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestImportCache(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	tag := func(namespace, from string, gen int64) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "base"},
+			Spec:       imagtagv1.TagSpec{From: from, Generation: gen},
+		}
+	}
+	hashref := imagtagv1.HashReference{
+		Generation:     0,
+		From:           "centos:8",
+		ImageReference: "docker.io/library/centos@sha256:1",
+	}
+
+	for _, tt := range []struct {
+		name      string
+		ttl       time.Duration
+		anonymous bool
+		put       *imagtagv1.Tag
+		get       *imagtagv1.Tag
+		elapsed   time.Duration
+		pushed    string
+		pushedAt  time.Duration
+		expected  bool
+	}{
+		{
+			name:      "shared among namespaces",
+			ttl:       time.Minute,
+			anonymous: true,
+			put:       tag("dev", "centos:8", 0),
+			get:       tag("prod", "centos:8", 3),
+			elapsed:   30 * time.Second,
+			expected:  true,
+		},
+		{
+			name:     "resolved with credentials",
+			ttl:      time.Minute,
+			put:      tag("dev", "centos:8", 0),
+			get:      tag("prod", "centos:8", 3),
+			elapsed:  30 * time.Second,
+			expected: false,
+		},
+		{
+			name:     "resolved with credentials in the same namespace",
+			ttl:      time.Minute,
+			put:      tag("dev", "centos:8", 0),
+			get:      tag("dev", "centos:8", 3),
+			elapsed:  30 * time.Second,
+			expected: true,
+		},
+		{
+			name:      "another image",
+			ttl:       time.Minute,
+			anonymous: true,
+			put:       tag("dev", "centos:8", 0),
+			get:       tag("prod", "centos:7", 3),
+			elapsed:   30 * time.Second,
+			expected:  false,
+		},
+		{
+			name:      "expired",
+			ttl:       time.Minute,
+			anonymous: true,
+			put:       tag("dev", "centos:8", 0),
+			get:       tag("prod", "centos:8", 3),
+			elapsed:   2 * time.Minute,
+			expected:  false,
+		},
+		{
+			name:      "disabled",
+			anonymous: true,
+			put:       tag("dev", "centos:8", 0),
+			get:       tag("prod", "centos:8", 3),
+			expected:  false,
+		},
+		{
+			name:      "pushed after resolved",
+			ttl:       time.Minute,
+			anonymous: true,
+			put:       tag("dev", "centos:8", 0),
+			get:       tag("prod", "centos:8", 3),
+			elapsed:   30 * time.Second,
+			pushed:    "docker.io/library/centos:latest",
+			pushedAt:  10 * time.Second,
+			expected:  false,
+		},
+		{
+			name:      "pushed while resolving",
+			ttl:       time.Minute,
+			anonymous: true,
+			put:       tag("dev", "centos:8", 0),
+			get:       tag("prod", "centos:8", 3),
+			elapsed:   30 * time.Second,
+			pushed:    "docker.io/library/centos:8",
+			pushedAt:  -time.Second,
+			expected:  false,
+		},
+		{
+			name:      "pushed to another repository",
+			ttl:       time.Minute,
+			anonymous: true,
+			put:       tag("dev", "centos:8", 0),
+			get:       tag("prod", "centos:8", 3),
+			elapsed:   30 * time.Second,
+			pushed:    "docker.io/library/fedora:34",
+			pushedAt:  10 * time.Second,
+			expected:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			cache := NewImportCache()
+			cache.now = func() time.Time { return now }
+			cfg := config.Default()
+			cfg.ImportCacheTTL = tt.ttl
+			cache.ApplyConfig(cfg)
+
+			// a negative pushedAt means the push arrived while the
+			// import was still resolving, before it was cached.
+			if tt.pushed != "" && tt.pushedAt < 0 {
+				now = start.Add(-tt.pushedAt)
+				cache.Invalidate(tt.pushed)
+			}
+			now = start.Add(time.Second)
+			cache.Put(tt.put, hashref, tt.anonymous, start)
+			if tt.pushed != "" && tt.pushedAt > 0 {
+				now = start.Add(tt.pushedAt)
+				cache.Invalidate(tt.pushed)
+			}
+
+			now = start.Add(tt.elapsed)
+			found, ok := cache.Get(tt.get)
+			if ok != tt.expected {
+				t.Fatalf("expected %v, received %v", tt.expected, ok)
+			}
+			if !ok {
+				return
+			}
+			if found.ImageReference != hashref.ImageReference {
+				t.Errorf("expected %s, %s received", hashref.ImageReference, found.ImageReference)
+			}
+			if found.Generation != tt.get.Spec.Generation {
+				t.Errorf("expected generation %d, %d received", tt.get.Spec.Generation, found.Generation)
+			}
+			if !found.ImportedAt.Time.Equal(now) {
+				t.Errorf("expected import time %s, %s received", now, found.ImportedAt)
+			}
+		})
+	}
+}
@@ -5,25 +5,42 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
 
 	imgcopy "github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
 	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/go-digest"
 
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/features"
 	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
 )
 
 // Importer wrap srvices for tag import related operations.
 type Importer struct {
-	syssvc *SysContext
+	sync.Mutex
+	syssvc        *SysContext
+	throttle      *Throttle
+	layers        *Layers
+	breaker       *Breaker
+	imports       *ImportCache
+	budget        *MemoryBudget
+	uploadChunk   int64
+	uploadRetries int
+	platforms     []Platform
+	projections   []config.LabelProjection
 }
 
 // NewImporter returns a handler for tag related services.
@@ -31,10 +48,24 @@ func NewImporter(
 	cmlister corelister.ConfigMapLister, sclister corelister.SecretLister,
 ) *Importer {
 	return &Importer{
-		syssvc: NewSysContext(cmlister, sclister),
+		syssvc:   NewSysContext(cmlister, sclister),
+		throttle: NewThrottle(),
+		layers:   NewLayers(),
+		breaker:  NewBreaker(),
+		imports:  NewImportCache(),
+		budget:   NewMemoryBudget(),
+
+		uploadChunk:   config.Default().UploadChunkSize,
+		uploadRetries: config.Default().LayerRetries,
 	}
 }
 
+// PullSecretsFrom sets where the namespaces default ServiceAccounts are read
+// from, see SysContext.
+func (i *Importer) PullSecretsFrom(salister corelister.ServiceAccountLister) {
+	i.syssvc.PullSecretsFrom(salister)
+}
+
 // SplitRegistryDomain splits the domain from the repository and image.
 func (i *Importer) SplitRegistryDomain(imgPath string) (string, string) {
 	imageSlices := strings.SplitN(imgPath, "/", 2)
@@ -71,75 +102,244 @@ func (i *Importer) DefaultPolicyContext() (*signature.PolicyContext, error) {
 	return signature.NewPolicyContext(pol)
 }
 
+// uploader returns a chunked uploader for the cache registry at host.
+func (i *Importer) uploader(
+	host string, sysctx *types.SystemContext, progress *ImportProgress,
+) *ChunkedUploader {
+	i.Lock()
+	defer i.Unlock()
+	return NewChunkedUploader(
+		host, sysctx, i.uploadChunk, i.uploadRetries,
+	).WithProgress(progress).WithBudget(i.budget)
+}
+
 // cacheTag copies an image from one registry to another. The first is
 // the source registry, the latter is our caching registry. Returns the
-// cached image reference to be used.
+// cached image reference to be used and the blobs it refers to. Layers
+// are uploaded to the cache registry in resumable chunks, upload progress
+// is reported to progress. If forceMIME is not empty the manifest is
+// converted to it.
 func (i *Importer) cacheTag(
 	ctx context.Context,
 	it *imagtagv1.Tag,
 	from string,
 	srcCtx *types.SystemContext,
-) (string, error) {
+	progress *ImportProgress,
+	forceMIME string,
+) (string, []imagtagv1.BlobReference, error) {
 	fromRef, err := i.ImageRefForStringRef(from)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
+	// only the configured platforms are copied from manifest lists.
+	fromRef = i.platformFilter().ImageReference(fromRef)
+
+	// blobs read from the source registry respect bandwidth limits, layers
+	// are verified and retried individually.
+	fromRef = i.layers.ImageReference(i.throttle.ImageReference(fromRef), progress)
 
 	inregaddr, outregaddr, err := i.syssvc.CacheRegistryAddresses()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	// We cache images under registry/namespace/image-tag.
 	to := fmt.Sprintf("%s/%s/%s", inregaddr, it.Namespace, it.Name)
 	toRef, err := i.ImageRefForStringRef(to)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
+	dstCtx := i.syssvc.Scratch(i.syssvc.CacheRegistryContext(ctx))
+	dstCtx.DockerRegistryUserAgent = i.syssvc.UserAgentFor(inregaddr)
+	toRef = i.uploader(inregaddr, dstCtx, progress).ImageReference(toRef)
+
+	// blobs referred by the written manifests are recorded so storage
+	// usage, and how much of it is shared, can be reported.
+	recorder := NewBlobRecorder()
+	toRef = recorder.ImageReference(toRef)
+
 	polctx, err := i.DefaultPolicyContext()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	manifest, err := imgcopy.Image(
 		ctx, polctx, toRef, fromRef, &imgcopy.Options{
-			ImageListSelection: imgcopy.CopyAllImages,
-			SourceCtx:          srcCtx,
-			DestinationCtx:     i.syssvc.CacheRegistryContext(ctx),
+			ImageListSelection:    imgcopy.CopyAllImages,
+			SourceCtx:             srcCtx,
+			DestinationCtx:        dstCtx,
+			ForceManifestMIMEType: forceMIME,
 		},
 	)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	return fmt.Sprintf(
 		"%s/%s/%s@sha256:%x", outregaddr, it.Namespace, it.Name, sha256.Sum256(manifest),
-	), nil
+	), recorder.Blobs(), nil
 }
 
-// ImportTag runs an import on provided Tag.
+// retag pushes the manifest with the provided digest, in the repository of
+// ref, under tag. Blobs are already in the repository so only the manifest
+// is written. Returns the pushed reference.
+func (i *Importer) retag(
+	ctx context.Context,
+	ref reference.Named,
+	dgst digest.Digest,
+	tag string,
+	sysctx *types.SystemContext,
+) (string, error) {
+	repo := reference.TrimNamed(ref)
+	tagged, err := reference.WithTag(repo, tag)
+	if err != nil {
+		return "", err
+	}
+	digested, err := reference.WithDigest(repo, dgst)
+	if err != nil {
+		return "", err
+	}
+
+	fromRef, err := docker.NewReference(digested)
+	if err != nil {
+		return "", err
+	}
+	toRef, err := docker.NewReference(tagged)
+	if err != nil {
+		return "", err
+	}
+
+	polctx, err := i.DefaultPolicyContext()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := imgcopy.Image(
+		ctx, polctx, toRef, fromRef, &imgcopy.Options{
+			ImageListSelection: imgcopy.CopyAllImages,
+			SourceCtx:          sysctx,
+			DestinationCtx:     sysctx,
+		},
+	); err != nil {
+		return "", err
+	}
+	return tagged.String(), nil
+}
+
+// ApplyConfig applies provided configuration to the system context, to the
+// bandwidth throttle, to layers copy, to the registries circuit breaker, to
+// the import cache, to the memory budget and to image label projections.
+func (i *Importer) ApplyConfig(cfg *config.Config) {
+	i.syssvc.ApplyConfig(cfg)
+	i.throttle.ApplyConfig(cfg)
+	i.layers.ApplyConfig(cfg)
+	i.breaker.ApplyConfig(cfg)
+	i.imports.ApplyConfig(cfg)
+	i.budget.ApplyConfig(cfg)
+
+	i.Lock()
+	defer i.Unlock()
+	i.uploadChunk = cfg.UploadChunkSize
+	i.uploadRetries = cfg.LayerRetries
+	i.projections = cfg.LabelProjections
+
+	// platforms have already been validated with the config.
+	i.platforms = nil
+	for _, platform := range cfg.Platforms {
+		if p, err := ParsePlatform(platform); err == nil {
+			i.platforms = append(i.platforms, p)
+		}
+	}
+}
+
+// platformFilter returns a filter for the configured platforms.
+func (i *Importer) platformFilter() *PlatformFilter {
+	i.Lock()
+	defer i.Unlock()
+	return NewPlatformFilter(i.platforms)
+}
+
+// labelProjections returns the configured image label projections.
+func (i *Importer) labelProjections() []config.LabelProjection {
+	i.Lock()
+	defer i.Unlock()
+	return i.projections
+}
+
+// Invalidate makes imports of image, and of the other images in the same
+// repository, to be resolved upstream again, see ImportCache.
+func (i *Importer) Invalidate(image string) {
+	i.imports.Invalidate(image)
+}
+
+// ImportTag runs an import on provided Tag. If the Tag is cached the copy
+// and upload progress are reported to progress, it may be nil. Tags not
+// cached may reuse the reference resolved by another Tag importing the same
+// image, unless the import has been explicitly requested.
 func (i *Importer) ImportTag(
-	ctx context.Context, it *imagtagv1.Tag,
+	ctx context.Context, it *imagtagv1.Tag, progress *ImportProgress,
 ) (imagtagv1.HashReference, error) {
 	var zero imagtagv1.HashReference
 	if it.Spec.From == "" {
 		return zero, fmt.Errorf("empty tag reference")
 	}
+	if it.Spec.Cache && !features.Enabled(features.Mirroring) {
+		return zero, fmt.Errorf("unable to cache image: mirroring feature disabled")
+	}
+
+	// tags pushing a retag always go upstream, the retag is pushed
+	// where the image is imported from.
+	started := time.Now()
+	if !it.Spec.Cache && it.Spec.Retag == "" &&
+		it.ImportTrigger() != imagtagv1.ImportTriggerRequest {
+		if hashref, ok := i.imports.Get(it); ok {
+			klog.V(2).Infof("%s resolved to %s (shared)", it.Spec.From, hashref.ImageReference)
+			return hashref, nil
+		}
+	}
 
 	regDomain, remainder := i.SplitRegistryDomain(it.Spec.From)
 
-	registries := i.syssvc.UnqualifiedRegistries(ctx)
+	candidates := i.syssvc.UnqualifiedRegistries(ctx)
 	if regDomain != "" {
-		registries = []string{regDomain}
+		candidates = []string{regDomain}
+	}
+
+	// mirrors are attempted before the registry they mirror.
+	var registries []string
+	for _, registry := range candidates {
+		registries = append(registries, i.syssvc.MirrorsFor(registry)...)
+		registries = append(registries, registry)
 	}
 	if len(registries) == 0 {
 		return zero, fmt.Errorf("no registry candidates found")
 	}
 
+	// tags with an image selector import the newest image, among the
+	// upstream tags, whose labels match the selector.
+	var selector labels.Selector
+	if it.Spec.ImageSelector != nil {
+		sel, err := metav1.LabelSelectorAsSelector(it.Spec.ImageSelector)
+		if err != nil {
+			return zero, fmt.Errorf("invalid image selector: %w", err)
+		}
+		selector = sel
+	}
+
+	// registries with an open circuit are skipped, if all of them are
+	// the import is short-circuited.
+	var unavailable error
 	var errors *multierror.Error
 	for _, registry := range registries {
+		if err := i.breaker.Allow(registry); err != nil {
+			klog.V(4).Infof("skipping %s: %s", registry, err)
+			unavailable = err
+			continue
+		}
+
 		imgFullPath := fmt.Sprintf("%s/%s", registry, remainder)
+		klog.V(4).Infof("attempting to import %s", imgFullPath)
 		namedReference, err := reference.ParseDockerRef(imgFullPath)
 		if err != nil {
 			errors = multierror.Append(errors, err)
@@ -162,45 +362,184 @@ func (i *Importer) ImportTag(
 		auths = append(auths, nil)
 
 		for _, auth := range auths {
-			sysctx := &types.SystemContext{
-				DockerAuthConfig: auth,
+			sysctx := i.syssvc.Scratch(&types.SystemContext{
+				DockerAuthConfig:        auth,
+				DockerCertPath:          i.syssvc.CertDirFor(registry),
+				DockerRegistryUserAgent: i.syssvc.UserAgentFor(registry),
+			})
+
+			srcref, srcpath := imgref, imgFullPath
+			var selected reference.NamedTagged
+			if selector != nil {
+				selected, err = SelectUpstreamTag(
+					ctx, imgref.DockerReference(), sysctx, selector,
+				)
+				if err != nil {
+					i.breaker.Failure(registry, err)
+					errors = multierror.Append(errors, err)
+					continue
+				}
+				if srcref, err = docker.NewReference(selected); err != nil {
+					errors = multierror.Append(errors, err)
+					continue
+				}
+				srcpath = selected.String()
+				klog.V(2).Infof("%s selected for %s", srcpath, it.Spec.From)
 			}
 
 			// XXX move this to its own func.
-			img, err := imgref.NewImage(ctx, sysctx)
+			src, err := srcref.NewImageSource(ctx, sysctx)
 			if err != nil {
+				klog.V(4).Infof("unable to read %s: %s", srcpath, err)
+				i.breaker.Failure(registry, err)
 				errors = multierror.Append(errors, err)
 				continue
 			}
 
-			manifestBlob, _, err := img.Manifest(ctx)
+			// we check the manifest media type before going any further,
+			// unsupported media types are reported as such instead of
+			// failing somewhere down the road with obscure errors.
+			rawManifest, rawMIME, err := src.GetManifest(ctx, nil)
+			if err != nil {
+				src.Close()
+				i.breaker.Failure(registry, err)
+				errors = multierror.Append(errors, err)
+				continue
+			}
+			i.breaker.Success(registry)
+			if _, err := InspectManifest(rawManifest, rawMIME); err != nil {
+				src.Close()
+				return zero, err
+			}
+
+			// tags pinned to a digest import exactly the manifest with
+			// that digest, for manifest lists this is the list itself.
+			pinned := it.PinnedDigest()
+			if pinned != "" {
+				if err := VerifyDigest(rawManifest, pinned); err != nil {
+					src.Close()
+					return zero, err
+				}
+			}
+
+			img, err := image.FromSource(ctx, sysctx, src)
 			if err != nil {
-				img.Close()
+				src.Close()
 				errors = multierror.Append(errors, err)
 				continue
 			}
 			defer img.Close()
 
+			manifestBlob, manifestMIME, err := img.Manifest(ctx)
+			if err != nil {
+				errors = multierror.Append(errors, err)
+				continue
+			}
+
+			info, err := InspectManifest(manifestBlob, manifestMIME)
+			if err != nil {
+				return zero, err
+			}
+
 			dgst, err := manifest.Digest(manifestBlob)
 			if err != nil {
 				return zero, fmt.Errorf("error calculating digest: %w", err)
 			}
 
-			imageref := fmt.Sprintf("%s@%s", imgref.DockerReference().Name(), dgst)
+			if pinned != "" {
+				dgst = digest.Digest(pinned)
+			}
+
+			imageref := fmt.Sprintf("%s@%s", srcref.DockerReference().Name(), dgst)
+			klog.V(2).Infof("%s resolved to %s", it.Spec.From, imageref)
+
+			hashref := imagtagv1.HashReference{
+				Generation: it.Spec.Generation,
+				From:       it.Spec.From,
+				MediaType:  info.MediaType,
+			}
+			if info.Artifact {
+				klog.V(2).Infof(
+					"%s is an artifact (%s)", it.Spec.From, info.ConfigMediaType,
+				)
+				hashref.ArtifactType = info.ConfigMediaType
+			}
+			// chart metadata is purely informative, failing to read
+			// it does not fail the import.
+			if info.ConfigMediaType == HelmChartConfigMediaType {
+				config, err := img.ConfigBlob(ctx)
+				if err == nil {
+					hashref.Chart, err = ChartMetadata(config)
+				}
+				if err != nil {
+					klog.V(2).Infof("unable to read chart for %s: %s", imageref, err)
+				}
+			}
+			// for imports by digest we look for the upstream tags
+			// pointing to it, purely informative.
+			if pinned != "" {
+				tags, err := UpstreamTags(
+					ctx, imgref.DockerReference(), sysctx, dgst,
+				)
+				if err != nil {
+					klog.V(2).Infof("unable to resolve tags for %s: %s", imageref, err)
+				}
+				hashref.UpstreamTags = tags
+			}
+			if selected != nil {
+				hashref.UpstreamTags = []string{selected.Tag()}
+			}
+			// image labels are recorded only if projected onto the
+			// Tag, failing to read them does not fail the import.
+			if projections := i.labelProjections(); len(projections) > 0 {
+				lbls, _, err := mergedImageLabels(ctx, img)
+				if err != nil {
+					klog.V(2).Infof("unable to read labels for %s: %s", imageref, err)
+				}
+				hashref.ImageLabels = ProjectedLabels(lbls, projections)
+			}
+
 			if it.Spec.Cache {
-				imageref, err = i.cacheTag(ctx, it, imageref, sysctx)
+				// legacy schema1 manifests are converted while
+				// being cached.
+				forceMIME := ""
+				if info.Schema1() {
+					forceMIME = manifest.DockerV2Schema2MediaType
+					hashref.ConvertedFrom = info.MediaType
+					hashref.MediaType = forceMIME
+					klog.Warningf("converting schema1 manifest for %s", it.Spec.From)
+				}
+
+				progress.SetTotals(info.Blobs, info.Size)
+				imageref, hashref.Blobs, err = i.cacheTagRotatingAuth(
+					ctx, it, srcref, imageref, sysctx, progress, forceMIME,
+				)
 				if err != nil {
 					return zero, fmt.Errorf("unable to cache image: %w", err)
 				}
 			}
 
-			return imagtagv1.HashReference{
-				Generation:     it.Spec.Generation,
-				From:           it.Spec.From,
-				ImportedAt:     metav1.NewTime(time.Now()),
-				ImageReference: imageref,
-			}, nil
+			hashref.ImportedAt = metav1.NewTime(time.Now())
+			hashref.ImageReference = imageref
+			if !it.Spec.Cache {
+				i.imports.Put(it, hashref, auth == nil, started)
+			}
+			if it.Spec.Retag != "" {
+				hashref.Retagged, err = i.retag(
+					ctx, srcref.DockerReference(), dgst, it.Spec.Retag, sysctx,
+				)
+				if err != nil {
+					klog.Errorf("unable to retag %s: %s", imageref, err)
+					hashref.RetagFailure = fmt.Sprintf(
+						"unable to push %s: %s", it.Spec.Retag, err,
+					)
+				}
+			}
+			return hashref, nil
 		}
 	}
+	if errors == nil && unavailable != nil {
+		return zero, unavailable
+	}
 	return zero, errors.ErrorOrNil()
 }
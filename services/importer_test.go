@@ -1,11 +1,23 @@
 package services
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+
 	coreinf "k8s.io/client-go/informers"
 	corfake "k8s.io/client-go/kubernetes/fake"
 
@@ -153,7 +165,7 @@ func TestImportPath(t *testing.T) {
 
 			imp := NewImporter(cmlist, seclis)
 			imp.syssvc.unqualifiedRegistries = tt.unqreg
-			_, err := imp.ImportTag(context.Background(), tt.tag)
+			_, err := imp.ImportTag(context.Background(), tt.tag, nil)
 			if err != nil {
 				if len(tt.err) == 0 {
 					t.Errorf("unexpected error %s", err)
@@ -166,3 +178,272 @@ func TestImportPath(t *testing.T) {
 		})
 	}
 }
+
+// imageRegistry is an in memory registry serving and storing manifests and
+// blobs per repository. Blobs are pushed with the chunked upload protocol.
+type imageRegistry struct {
+	sync.Mutex
+	manifests map[string]map[string][]byte
+	blobs     map[string]map[string][]byte
+	uploads   map[string][]byte
+}
+
+// put stores a manifest, or a blob if mime is empty, in repo. Manifests are
+// stored under reference and under their digest.
+func (g *imageRegistry) put(repo, ref, mime string, data []byte) digest.Digest {
+	dgst := digest.FromBytes(data)
+	if mime == "" {
+		if g.blobs[repo] == nil {
+			g.blobs[repo] = map[string][]byte{}
+		}
+		g.blobs[repo][dgst.String()] = data
+		return dgst
+	}
+	if g.manifests[repo] == nil {
+		g.manifests[repo] = map[string][]byte{}
+	}
+	g.manifests[repo][ref] = data
+	g.manifests[repo][dgst.String()] = data
+	return dgst
+}
+
+func (g *imageRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.Lock()
+	defer g.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if path == "" {
+		return
+	}
+
+	if idx := strings.Index(path, "/blobs/uploads/"); idx >= 0 {
+		repo, id := path[:idx], path[idx+len("/blobs/uploads/"):]
+		if id == "" {
+			id = fmt.Sprintf("%d", len(g.uploads))
+			g.uploads[id] = nil
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		g.uploads[id] = append(g.uploads[id], body...)
+		if r.Method == http.MethodPut {
+			dgst := g.put(repo, "", "", g.uploads[id])
+			if dgst.String() != r.URL.Query().Get("digest") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id))
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(g.uploads[id])-1))
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	stored, kind := g.manifests, "/manifests/"
+	if strings.Contains(path, "/blobs/") {
+		stored, kind = g.blobs, "/blobs/"
+	}
+	idx := strings.Index(path, kind)
+	if idx < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repo, ref := path[:idx], path[idx+len(kind):]
+
+	if r.Method == http.MethodPut {
+		body, _ := ioutil.ReadAll(r.Body)
+		dgst := g.put(repo, ref, r.Header.Get("Content-Type"), body)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	data, ok := stored[repo][ref]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if kind == "/manifests/" {
+		var mime struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &mime)
+		w.Header().Set("Content-Type", mime.MediaType)
+	}
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func TestCacheTag(t *testing.T) {
+	registry := &imageRegistry{
+		manifests: map[string]map[string][]byte{},
+		blobs:     map[string]map[string][]byte{},
+		uploads:   map[string][]byte{},
+	}
+
+	var descriptors []string
+	images := map[string][]string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		config := []byte(fmt.Sprintf(`{"architecture": %q, "os": "linux"}`, arch))
+		var layer bytes.Buffer
+		gz := gzip.NewWriter(&layer)
+		gz.Write([]byte("layer for " + arch))
+		gz.Close()
+		cfgdgst := registry.put("upstream/app", "", "", config)
+		laydgst := registry.put("upstream/app", "", "", layer.Bytes())
+		image := []byte(fmt.Sprintf(`{
+			"schemaVersion": 2,
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"config": {
+				"mediaType": "application/vnd.oci.image.config.v1+json",
+				"digest": %q,
+				"size": %d
+			},
+			"layers": [{
+				"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+				"digest": %q,
+				"size": %d
+			}]
+		}`, cfgdgst, len(config), laydgst, layer.Len()))
+		dgst := registry.put(
+			"upstream/app", arch, "application/vnd.oci.image.manifest.v1+json", image,
+		)
+		images[arch] = []string{dgst.String(), cfgdgst.String(), laydgst.String()}
+		descriptors = append(descriptors, fmt.Sprintf(`{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest": %q,
+			"size": %d,
+			"platform": {"architecture": %q, "os": "linux"}
+		}`, dgst, len(image), arch))
+	}
+	index := []byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": [%s]
+	}`, strings.Join(descriptors, ",")))
+	idxdgst := registry.put(
+		"upstream/app", "latest", "application/vnd.oci.image.index.v1+json", index,
+	)
+
+	// a list served by a digest it does not match.
+	tampered := digest.FromString("tampered")
+	registry.manifests["upstream/app"][tampered.String()] = index
+
+	server := httptest.NewTLSServer(registry)
+	defer server.Close()
+	host := server.Listener.Addr().String()
+
+	os.Setenv("CACHE_REGISTRY_ADDRESS", host)
+	os.Setenv("CACHE_REGISTRY_INSECURE", "true")
+	defer os.Unsetenv("CACHE_REGISTRY_ADDRESS")
+	defer os.Unsetenv("CACHE_REGISTRY_INSECURE")
+
+	dir, err := ioutil.TempDir("", "tagger-cache-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filtered, err := FilterManifestList(
+		index,
+		"application/vnd.oci.image.index.v1+json",
+		[]Platform{{OS: "linux", Architecture: "amd64"}},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		from      digest.Digest
+		platforms []Platform
+		expected  digest.Digest
+		copied    []string
+		skipped   []string
+		err       string
+	}{
+		{
+			name:     "all platforms",
+			from:     idxdgst,
+			expected: idxdgst,
+			copied:   append(images["amd64"], images["arm64"]...),
+		},
+		{
+			name:      "filtered platforms",
+			from:      idxdgst,
+			platforms: []Platform{{OS: "linux", Architecture: "amd64"}},
+			expected:  digest.FromBytes(filtered),
+			copied:    images["amd64"],
+			skipped:   images["arm64"],
+		},
+		{
+			name:      "filtered platforms digest mismatch",
+			from:      tampered,
+			platforms: []Platform{{OS: "linux", Architecture: "amd64"}},
+			err:       "does not match",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			imp := NewImporter(nil, nil)
+			imp.syssvc.scratchDir = dir
+			imp.platforms = tt.platforms
+
+			it := &imgtagv1.Tag{}
+			it.Namespace = "namespace"
+			it.Name = strings.ReplaceAll(tt.name, " ", "-")
+
+			ref, _, err := imp.cacheTag(
+				context.Background(),
+				it,
+				fmt.Sprintf("%s/upstream/app@%s", host, tt.from),
+				&types.SystemContext{
+					DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+				},
+				nil,
+				"",
+			)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			expected := fmt.Sprintf("%s/namespace/%s@%s", host, it.Name, tt.expected)
+			if ref != expected {
+				t.Errorf("expected %q, %q received", expected, ref)
+			}
+
+			repo := "namespace/" + it.Name
+			if _, ok := registry.manifests[repo][tt.expected.String()]; !ok {
+				t.Errorf("manifest %s not stored", tt.expected)
+			}
+			for _, dgst := range tt.copied {
+				_, manifest := registry.manifests[repo][dgst]
+				_, blob := registry.blobs[repo][dgst]
+				if !manifest && !blob {
+					t.Errorf("%s not copied", dgst)
+				}
+			}
+			for _, dgst := range tt.skipped {
+				_, manifest := registry.manifests[repo][dgst]
+				_, blob := registry.blobs[repo][dgst]
+				if manifest || blob {
+					t.Errorf("%s copied", dgst)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// InheritFromLabel is the namespace label naming the namespace Tags are
+// inherited from. Pods resolve the Tags of the named namespace when there is
+// no Tag of their own with the same name. Inheritance is not transitive, the
+// label on the named namespace is not followed.
+const InheritFromLabel = "tagger.dev/inherit-from"
+
+// InheritTags makes pods resolve Tags through namespace inheritance, the
+// namespace labels are read from the provided lister. Without it pods only
+// resolve Tags in their own namespace.
+func (t *Tag) InheritTags(nslis corelister.NamespaceLister) {
+	t.Lock()
+	defer t.Unlock()
+	t.nslis = nslis
+}
+
+// inheritedFrom returns the namespace Tags are inherited from by namespace,
+// an empty string if it does not inherit Tags. A namespace inheriting from
+// itself inherits nothing.
+func (t *Tag) inheritedFrom(namespace string) (string, error) {
+	t.Lock()
+	nslis := t.nslis
+	t.Unlock()
+	if nslis == nil {
+		return "", nil
+	}
+
+	ns, err := nslis.Get(namespace)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if parent := ns.Labels[InheritFromLabel]; parent != namespace {
+		return parent, nil
+	}
+	return "", nil
+}
+
+// inheritedTag returns the Tag a pod image refers to in the namespace the pod
+// namespace inherits from, nil if there is none. Inherited Tags are only read
+// from the cache. See tagForImage for wildcard.
+func (t *Tag) inheritedTag(namespace, image string, wildcard bool) (*imagtagv1.Tag, error) {
+	parent, err := t.inheritedFrom(namespace)
+	if err != nil || parent == "" {
+		return nil, err
+	}
+
+	it, err := tagForImage(t.taglis, parent, image, wildcard)
+	if err != nil || it == nil {
+		return nil, err
+	}
+	klog.V(2).Infof("image %s in %s resolved by tag %s/%s", image, namespace, parent, it.Name)
+	return it, nil
+}
+
+// registerInheritance records in the Tag status the namespaces resolving it
+// through inheritance. Namespaces with a Tag of the same name are left out as
+// their own Tag takes precedence.
+func (t *Tag) registerInheritance(it *imagtagv1.Tag) error {
+	t.Lock()
+	nslis := t.nslis
+	t.Unlock()
+	if nslis == nil {
+		it.Status.InheritedBy = nil
+		return nil
+	}
+
+	req, err := labels.NewRequirement(InheritFromLabel, selection.Equals, []string{it.Namespace})
+	if err != nil {
+		// namespace names are always valid label values.
+		return err
+	}
+	nss, err := nslis.List(labels.NewSelector().Add(*req))
+	if err != nil {
+		return err
+	}
+
+	var inheritedBy []string
+	for _, ns := range nss {
+		if ns.Name == it.Namespace {
+			continue
+		}
+		_, err := t.taglis.Tags(ns.Name).Get(it.Name)
+		if err == nil {
+			continue
+		}
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		inheritedBy = append(inheritedBy, ns.Name)
+	}
+	sort.Strings(inheritedBy)
+	it.Status.InheritedBy = inheritedBy
+	return nil
+}
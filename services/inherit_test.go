@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/mattbaird/jsonpatch"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	taginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func inheritanceFixture(
+	ctx context.Context, t *testing.T, namespaces map[string]string, tags []runtime.Object,
+) *Tag {
+	var nss []runtime.Object
+	for name, parent := range namespaces {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if parent != "" {
+			ns.Labels = map[string]string{InheritFromLabel: parent}
+		}
+		nss = append(nss, ns)
+	}
+	for name := range namespaces {
+		nss = append(nss, &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "replicaset",
+				Namespace:   name,
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+		})
+	}
+
+	tagcli := tagfake.NewSimpleClientset(tags...)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	corcli := corfake.NewSimpleClientset(nss...)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+	nslis := corinf.Core().V1().Namespaces().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+		corinf.Core().V1().Namespaces().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	svc := NewTag(nil, tagcli, taglis, nil, rslist, nil, nil, nil, nil, nil)
+	svc.ApplyConfig(config.Default())
+	svc.InheritTags(nslis)
+	return svc
+}
+
+func inheritedTag(namespace, name string) *imagtagv1.Tag {
+	return &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Status: imagtagv1.TagStatus{
+			References: []imagtagv1.HashReference{
+				{ImageReference: namespace + "/" + name + "@sha256:abc"},
+			},
+		},
+	}
+}
+
+func TestPatchForPodInheritedTags(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	svc := inheritanceFixture(
+		ctx, t,
+		map[string]string{
+			"platform": "",
+			"team-a":   "platform",
+			"team-b":   "team-a",
+			"team-c":   "",
+			"team-d":   "team-d",
+		},
+		[]runtime.Object{
+			inheritedTag("platform", "base"),
+			inheritedTag("platform", "runtime"),
+			inheritedTag("team-a", "runtime"),
+			inheritedTag("team-d", "other"),
+		},
+	)
+
+	for _, tt := range []struct {
+		name      string
+		namespace string
+		images    []string
+		patch     []jsonpatch.JsonPatchOperation
+	}{
+		{
+			name:      "inherited tag",
+			namespace: "team-a",
+			images:    []string{"base"},
+			patch: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/image",
+					Value:     "platform/base@sha256:abc",
+				},
+			},
+		},
+		{
+			name:      "own tag takes precedence",
+			namespace: "team-a",
+			images:    []string{"runtime"},
+			patch: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/image",
+					Value:     "team-a/runtime@sha256:abc",
+				},
+			},
+		},
+		{
+			name:      "inheritance is not transitive",
+			namespace: "team-b",
+			images:    []string{"base", "runtime"},
+			patch: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/1/image",
+					Value:     "team-a/runtime@sha256:abc",
+				},
+			},
+		},
+		{
+			name:      "namespace without label",
+			namespace: "team-c",
+			images:    []string{"base"},
+		},
+		{
+			name:      "namespace inheriting from itself",
+			namespace: "team-d",
+			images:    []string{"base", "other"},
+			patch: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/1/image",
+					Value:     "team-d/other@sha256:abc",
+				},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: tt.namespace,
+					Name:      "my-pod",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							Kind: "ReplicaSet",
+							Name: "replicaset",
+						},
+					},
+				},
+			}
+			for _, image := range tt.images {
+				pod.Spec.Containers = append(
+					pod.Spec.Containers, corev1.Container{Image: image},
+				)
+			}
+
+			patch, _, err := svc.PatchForPod(ctx, pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(patch, tt.patch) {
+				t.Errorf("expected patch %+v, %+v received", tt.patch, patch)
+			}
+		})
+	}
+}
+
+func TestRegisterInheritance(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	svc := inheritanceFixture(
+		ctx, t,
+		map[string]string{
+			"platform": "platform",
+			"team-a":   "platform",
+			"team-b":   "platform",
+			"team-c":   "platform",
+			"team-d":   "",
+		},
+		[]runtime.Object{
+			inheritedTag("platform", "base"),
+			inheritedTag("team-b", "base"),
+		},
+	)
+
+	it := inheritedTag("platform", "base")
+	if err := svc.registerInheritance(it); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"team-a", "team-c"}
+	if !reflect.DeepEqual(it.Status.InheritedBy, expected) {
+		t.Errorf("expected %v, %v received", expected, it.Status.InheritedBy)
+	}
+
+	// without namespace labels nothing is inherited.
+	svc.InheritTags(nil)
+	if err := svc.registerInheritance(it); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if it.Status.InheritedBy != nil {
+		t.Errorf("expected no inheriting namespaces, %v received", it.Status.InheritedBy)
+	}
+}
@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// Layers controls how image layers are read when mirroring. It limits the
+// number of layers read in parallel, verifies each layer digest while it is
+// read and retries failed reads of a single layer, resuming from where the
+// failure happened, instead of failing the whole image copy.
+type Layers struct {
+	sync.Mutex
+	tokens  chan struct{}
+	retries int
+	backoff time.Duration
+}
+
+// NewLayers returns a Layers configured with default parallelism and retries.
+func NewLayers() *Layers {
+	l := &Layers{backoff: time.Second}
+	l.ApplyConfig(config.Default())
+	return l
+}
+
+// ApplyConfig applies layers parallelism and retries. Layers already being
+// read keep their slots on the previous configuration.
+func (l *Layers) ApplyConfig(cfg *config.Config) {
+	l.Lock()
+	defer l.Unlock()
+	if l.tokens == nil || cap(l.tokens) != cfg.LayerParallelism {
+		l.tokens = make(chan struct{}, cfg.LayerParallelism)
+	}
+	l.retries = cfg.LayerRetries
+}
+
+// settings returns the current slots and the number of retries.
+func (l *Layers) settings() (chan struct{}, int) {
+	l.Lock()
+	defer l.Unlock()
+	return l.tokens, l.retries
+}
+
+// ImageReference wraps provided image reference so layers read from its image
+// sources are verified, retried and read with limited parallelism. Bytes read
+// are reported to progress, it may be nil.
+func (l *Layers) ImageReference(
+	ref types.ImageReference, progress *ImportProgress,
+) types.ImageReference {
+	return &layersReference{
+		ImageReference: ref,
+		layers:         l,
+		progress:       progress,
+	}
+}
+
+// layersReference is an image reference whose image sources are wrapped by
+// a layersSource.
+type layersReference struct {
+	types.ImageReference
+	layers   *Layers
+	progress *ImportProgress
+}
+
+// NewImageSource returns an image source with verified and retried layers.
+func (r *layersReference) NewImageSource(
+	ctx context.Context, sys *types.SystemContext,
+) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &layersSource{
+		ImageSource: src,
+		layers:      r.layers,
+		progress:    r.progress,
+	}, nil
+}
+
+// layersSource is an image source whose blobs are read through a layerReader.
+type layersSource struct {
+	types.ImageSource
+	layers   *Layers
+	progress *ImportProgress
+}
+
+// GetBlob waits for a free slot and then opens the blob. Opening the blob is
+// retried as well. The slot is released when the returned reader is closed.
+func (s *layersSource) GetBlob(
+	ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache,
+) (io.ReadCloser, int64, error) {
+	tokens, retries := s.layers.settings()
+	select {
+	case tokens <- struct{}{}:
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+
+	reader := &layerReader{
+		ctx:      ctx,
+		src:      s.ImageSource,
+		info:     info,
+		cache:    cache,
+		retries:  retries,
+		backoff:  s.layers.backoff,
+		release:  func() { <-tokens },
+		progress: s.progress,
+	}
+	if info.Digest != "" {
+		reader.verifier = info.Digest.Verifier()
+	}
+
+	size, err := reader.open()
+	for err != nil && reader.retry(err) {
+		size, err = reader.open()
+	}
+	if err != nil {
+		reader.release()
+		return nil, 0, err
+	}
+	return reader, size, nil
+}
+
+// layerReader reads a layer verifying its digest. If a read fails the layer
+// is opened again and the bytes already read are skipped.
+type layerReader struct {
+	ctx      context.Context
+	src      types.ImageSource
+	info     types.BlobInfo
+	cache    types.BlobInfoCache
+	reader   io.ReadCloser
+	verifier digest.Verifier
+	progress *ImportProgress
+	offset   int64
+	retries  int
+	backoff  time.Duration
+	release  func()
+	once     sync.Once
+}
+
+// open opens the layer, skipping the bytes that have already been read.
+func (l *layerReader) open() (int64, error) {
+	rc, size, err := l.src.GetBlob(l.ctx, l.info, l.cache)
+	if err != nil {
+		return 0, err
+	}
+
+	if l.offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, rc, l.offset); err != nil {
+			rc.Close()
+			return 0, fmt.Errorf("error skipping %d bytes: %w", l.offset, err)
+		}
+	}
+	l.reader = rc
+	return size, nil
+}
+
+// retry returns true if we should attempt again after err, waiting for the
+// backoff period before returning. Refused credentials are not retried as
+// they are refused again, the whole copy is retried with fresh credentials.
+func (l *layerReader) retry(err error) bool {
+	if l.retries <= 0 || l.ctx.Err() != nil || isUnauthorized(err) {
+		return false
+	}
+	l.retries--
+	klog.V(2).Infof(
+		"retrying layer %s at offset %d, %d attempts left: %s",
+		l.info.Digest, l.offset, l.retries, err,
+	)
+
+	select {
+	case <-time.After(l.backoff):
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+// Read reads from the layer. On EOF the digest of the content is verified.
+func (l *layerReader) Read(p []byte) (int, error) {
+	for {
+		if l.reader == nil {
+			if _, err := l.open(); err != nil {
+				if !l.retry(err) {
+					return 0, err
+				}
+				continue
+			}
+		}
+
+		n, err := l.reader.Read(p)
+		if n > 0 {
+			l.offset += int64(n)
+			if l.verifier != nil {
+				l.verifier.Write(p[:n])
+			}
+		}
+
+		if err == nil {
+			l.progress.Read(l.info.Digest.String(), l.info.Size, int64(n), false)
+			return n, nil
+		}
+
+		if err == io.EOF {
+			if l.verifier != nil && !l.verifier.Verified() {
+				return n, fmt.Errorf("digest mismatch for layer %s", l.info.Digest)
+			}
+			l.progress.Read(l.info.Digest.String(), l.info.Size, int64(n), true)
+			return n, io.EOF
+		}
+
+		if n > 0 {
+			l.progress.Read(l.info.Digest.String(), l.info.Size, int64(n), false)
+		}
+
+		// we return what we have read so far, the error is going to be
+		// returned again on the next call.
+		if n > 0 {
+			return n, nil
+		}
+
+		if !l.retry(err) {
+			return 0, err
+		}
+		l.reader.Close()
+		l.reader = nil
+	}
+}
+
+// Close closes the underlying reader and releases the parallelism slot.
+func (l *layerReader) Close() error {
+	l.once.Do(l.release)
+	if l.reader == nil {
+		return nil
+	}
+	return l.reader.Close()
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// flakyReader fails after reading failAt bytes.
+type flakyReader struct {
+	reader io.Reader
+	read   int
+	failAt int
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	if f.failAt >= 0 && f.read >= f.failAt {
+		return 0, fmt.Errorf("connection reset")
+	}
+	if f.failAt >= 0 && len(p) > f.failAt-f.read {
+		p = p[:f.failAt-f.read]
+	}
+	n, err := f.reader.Read(p)
+	f.read += n
+	return n, err
+}
+
+// flakySource is an image source whose blobs fail to be read a number of
+// times before succeeding.
+type flakySource struct {
+	types.ImageSource
+	sync.Mutex
+	data     []byte
+	failures int
+	opens    int
+}
+
+func (f *flakySource) GetBlob(
+	ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache,
+) (io.ReadCloser, int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.opens++
+
+	failAt := -1
+	if f.failures > 0 {
+		f.failures--
+		failAt = len(f.data) / 2
+	}
+	return ioutil.NopCloser(
+		&flakyReader{
+			reader: bytes.NewReader(f.data),
+			failAt: failAt,
+		},
+	), int64(len(f.data)), nil
+}
+
+func TestLayersGetBlob(t *testing.T) {
+	data := []byte(strings.Repeat("layer content ", 1024))
+	for _, tt := range []struct {
+		name     string
+		failures int
+		retries  int
+		digest   digest.Digest
+		opens    int
+		err      string
+	}{
+		{
+			name:   "no failures",
+			digest: digest.FromBytes(data),
+			opens:  1,
+		},
+		{
+			name:     "resumed after failure",
+			failures: 2,
+			retries:  3,
+			digest:   digest.FromBytes(data),
+			opens:    3,
+		},
+		{
+			name:     "too many failures",
+			failures: 2,
+			retries:  1,
+			digest:   digest.FromBytes(data),
+			err:      "connection reset",
+		},
+		{
+			name:   "digest mismatch",
+			digest: digest.FromString("something else"),
+			err:    "digest mismatch",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.LayerRetries = tt.retries
+			layers := NewLayers()
+			layers.backoff = time.Millisecond
+			layers.ApplyConfig(cfg)
+
+			fsrc := &flakySource{data: data, failures: tt.failures}
+			src := &layersSource{ImageSource: fsrc, layers: layers}
+
+			rc, _, err := src.GetBlob(
+				context.Background(), types.BlobInfo{Digest: tt.digest}, nil,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer rc.Close()
+
+			read, err := ioutil.ReadAll(rc)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			if !bytes.Equal(read, data) {
+				t.Errorf("content mismatch, %d bytes read", len(read))
+			}
+			if fsrc.opens != tt.opens {
+				t.Errorf("expected %d opens, %d found", tt.opens, fsrc.opens)
+			}
+		})
+	}
+}
+
+func TestLayersParallelism(t *testing.T) {
+	cfg := config.Default()
+	cfg.LayerParallelism = 1
+	layers := NewLayers()
+	layers.ApplyConfig(cfg)
+
+	fsrc := &flakySource{data: []byte("content")}
+	src := &layersSource{ImageSource: fsrc, layers: layers}
+
+	first, _, err := src.GetBlob(context.Background(), types.BlobInfo{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, _, err := src.GetBlob(ctx, types.BlobInfo{}, nil); err == nil {
+		t.Fatal("second blob opened while first was still open")
+	}
+
+	first.Close()
+	second, _, err := src.GetBlob(context.Background(), types.BlobInfo{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	coordv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corecli "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// Default timings of the leader election. The lease is renewed every
+// LeaseRenewPeriod and taken over by a standby replica if not renewed for
+// LeaseDuration. Standby replicas attempt to take the lease every
+// LeaseRetryPeriod.
+const (
+	LeaseDuration    = 15 * time.Second
+	LeaseRenewPeriod = 5 * time.Second
+	LeaseRetryPeriod = 2 * time.Second
+)
+
+// LeaderElector elects, among the replicas sharing a Lease, the one running
+// the controllers. Other replicas stand by with their caches warm, taking
+// over once the leader releases the Lease or stops renewing it.
+type LeaderElector struct {
+	corcli    corecli.Interface
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+	renew     time.Duration
+	retry     time.Duration
+	now       func() time.Time
+}
+
+// NewLeaderElector returns a leader elector using the Lease with the provided
+// namespace and name. Identity identifies this replica, e.g. its hostname.
+func NewLeaderElector(corcli corecli.Interface, namespace, name, identity string) *LeaderElector {
+	return &LeaderElector{
+		corcli:    corcli,
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		duration:  LeaseDuration,
+		renew:     LeaseRenewPeriod,
+		retry:     LeaseRetryPeriod,
+		now:       time.Now,
+	}
+}
+
+// Run waits until we become the leader and then calls lead with a context
+// cancelled once leadership is lost or ctx is cancelled. Run returns after
+// lead returns, releasing the Lease so a standby replica takes over right
+// away. Leadership is never reacquired, callers are expected to exit.
+func (l *LeaderElector) Run(ctx context.Context, lead func(context.Context)) {
+	klog.Infof("waiting for lease %s/%s", l.namespace, l.name)
+	if !l.acquire(ctx) {
+		return
+	}
+	klog.Infof("lease %s/%s acquired, leading", l.namespace, l.name)
+	metrics.Leader.Set(1)
+	defer metrics.Leader.Set(0)
+
+	lctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lead(lctx)
+	}()
+
+	l.keep(lctx, done)
+	cancel()
+	<-done
+	l.release()
+}
+
+// acquire attempts to take the Lease every retry period until it succeeds or
+// ctx is cancelled. Returns false if ctx has been cancelled.
+func (l *LeaderElector) acquire(ctx context.Context) bool {
+	ticker := time.NewTicker(l.retry)
+	defer ticker.Stop()
+	for {
+		ok, err := l.tryAcquireOrRenew(ctx)
+		if err != nil {
+			klog.Errorf("error acquiring lease: %s", err)
+		}
+		if ok {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// keep renews the Lease every renew period. Returns once ctx is cancelled,
+// lead has returned (done closed) or the Lease could not be renewed before
+// expiring.
+func (l *LeaderElector) keep(ctx context.Context, done chan struct{}) {
+	ticker := time.NewTicker(l.renew)
+	defer ticker.Stop()
+	renewed := l.now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		ok, err := l.tryAcquireOrRenew(ctx)
+		if err != nil {
+			klog.Errorf("error renewing lease: %s", err)
+		}
+		if ok {
+			renewed = l.now()
+			continue
+		}
+		if err == nil {
+			klog.Errorf("lease %s/%s taken by another replica", l.namespace, l.name)
+			return
+		}
+		if l.now().Sub(renewed) >= l.duration {
+			klog.Errorf("unable to renew lease %s/%s, stepping down", l.namespace, l.name)
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew takes the Lease if it is free, expired or already ours.
+// Returns false, and no error, if another replica holds the Lease.
+func (l *LeaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := metav1.NewMicroTime(l.now())
+	seconds := int32(l.duration / time.Second)
+	transitions := int32(0)
+
+	leases := l.corcli.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return false, err
+		}
+		lease = &coordv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: l.namespace,
+				Name:      l.name,
+			},
+			Spec: coordv1.LeaseSpec{
+				HolderIdentity:       &l.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+				LeaseTransitions:     &transitions,
+			},
+		}
+		if _, err := leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			if errors.IsAlreadyExists(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	if !l.ours(lease) && !l.available(lease) {
+		return false, nil
+	}
+
+	if !l.ours(lease) {
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions
+		}
+		transitions++
+		lease.Spec.HolderIdentity = &l.identity
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// ours returns true if we hold the Lease.
+func (l *LeaderElector) ours(lease *coordv1.Lease) bool {
+	holder := lease.Spec.HolderIdentity
+	return holder != nil && *holder == l.identity
+}
+
+// available returns true if nobody holds the Lease or if its holder has not
+// renewed it in time.
+func (l *LeaderElector) available(lease *coordv1.Lease) bool {
+	holder := lease.Spec.HolderIdentity
+	if holder == nil || *holder == "" {
+		return true
+	}
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	duration := time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	return l.now().After(lease.Spec.RenewTime.Add(duration))
+}
+
+// release gives the Lease up so a standby replica does not need to wait for
+// it to expire. Failures are only logged, the Lease expires anyway.
+func (l *LeaderElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.renew)
+	defer cancel()
+
+	leases := l.corcli.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("error releasing lease: %s", err)
+		return
+	}
+	if !l.ours(lease) {
+		return
+	}
+
+	empty := ""
+	lease.Spec.HolderIdentity = &empty
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		klog.Errorf("error releasing lease: %s", err)
+		return
+	}
+	klog.Infof("lease %s/%s released", l.namespace, l.name)
+}
+
+// LeaseName returns the name of the Lease elected among the replicas of a
+// shard, each shard elects its own leader.
+func LeaseName(shard int) string {
+	return fmt.Sprintf("tagger-controllers-%d", shard)
+}
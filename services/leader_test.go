@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElectorAcquire(t *testing.T) {
+	ctx := context.Background()
+	corcli := fake.NewSimpleClientset()
+
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	first := NewLeaderElector(corcli, "tagger", "lease", "first")
+	first.now = clock
+	second := NewLeaderElector(corcli, "tagger", "lease", "second")
+	second.now = clock
+
+	for _, tt := range []struct {
+		name     string
+		elector  *LeaderElector
+		advance  time.Duration
+		acquired bool
+	}{
+		{
+			name:     "create lease",
+			elector:  first,
+			acquired: true,
+		},
+		{
+			name:    "lease held by another replica",
+			elector: second,
+		},
+		{
+			name:     "renew",
+			elector:  first,
+			advance:  10 * time.Second,
+			acquired: true,
+		},
+		{
+			name:    "lease still valid",
+			elector: second,
+			advance: 10 * time.Second,
+		},
+		{
+			name:     "expired lease",
+			elector:  second,
+			advance:  10 * time.Second,
+			acquired: true,
+		},
+		{
+			name:    "lease taken over",
+			elector: first,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			acquired, err := tt.elector.tryAcquireOrRenew(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if acquired != tt.acquired {
+				t.Errorf("expected acquired %v, %v received", tt.acquired, acquired)
+			}
+		})
+	}
+
+	lease, err := corcli.CoordinationV1().Leases("tagger").Get(ctx, "lease", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *lease.Spec.HolderIdentity != "second" || *lease.Spec.LeaseTransitions != 1 {
+		t.Errorf("unexpected lease: %+v", lease.Spec)
+	}
+
+	// once released the lease is taken right away.
+	second.release()
+	if acquired, err := first.tryAcquireOrRenew(ctx); err != nil || !acquired {
+		t.Errorf("expected released lease to be acquired: %v", err)
+	}
+}
+
+func TestLeaderElectorRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	corcli := fake.NewSimpleClientset()
+	elector := NewLeaderElector(corcli, "tagger", "lease", "replica")
+	elector.renew = 100 * time.Millisecond
+
+	led := false
+	elector.Run(ctx, func(lctx context.Context) {
+		led = true
+	})
+	if !led {
+		t.Fatal("expected to lead")
+	}
+
+	lease, err := corcli.CoordinationV1().Leases("tagger").Get(ctx, "lease", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *lease.Spec.HolderIdentity != "" {
+		t.Errorf("expected lease to be released, held by %s", *lease.Spec.HolderIdentity)
+	}
+}
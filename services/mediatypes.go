@@ -0,0 +1,144 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MediaTypeError is returned when an image uses a manifest media type we are
+// unable to handle.
+type MediaTypeError struct {
+	MediaType string
+}
+
+// Error returns the error message.
+func (m *MediaTypeError) Error() string {
+	return fmt.Sprintf("unsupported manifest media type %q", m.MediaType)
+}
+
+// Reason returns the reason used in the Tag Imported condition.
+func (m *MediaTypeError) Reason() string {
+	return "UnsupportedMediaType"
+}
+
+// DigestMismatchError is returned when the manifest digest does not match the
+// digest a Tag is pinned to.
+type DigestMismatchError struct {
+	Expected string
+	Found    string
+}
+
+// Error returns the error message.
+func (d *DigestMismatchError) Error() string {
+	return fmt.Sprintf("manifest digest %s does not match %s", d.Found, d.Expected)
+}
+
+// Reason returns the reason used in the Tag Imported condition.
+func (d *DigestMismatchError) Reason() string {
+	return "DigestMismatch"
+}
+
+// VerifyDigest checks that the manifest blob matches the expected digest.
+func VerifyDigest(blob []byte, expected string) error {
+	dgst, err := digest.Parse(expected)
+	if err != nil {
+		return fmt.Errorf("invalid digest %q: %w", expected, err)
+	}
+	if found := dgst.Algorithm().FromBytes(blob); found != dgst {
+		return &DigestMismatchError{Expected: expected, Found: found.String()}
+	}
+	return nil
+}
+
+// supportedManifests are the manifest media types we are able to import.
+var supportedManifests = map[string]bool{
+	manifest.DockerV2Schema1MediaType:       true,
+	manifest.DockerV2Schema1SignedMediaType: true,
+	manifest.DockerV2Schema2MediaType:       true,
+	manifest.DockerV2ListMediaType:          true,
+	imgspecv1.MediaTypeImageManifest:        true,
+	imgspecv1.MediaTypeImageIndex:           true,
+}
+
+// imageConfigs are the config media types of runnable images, OCI manifests
+// with other config media types are artifacts (e.g. helm charts).
+var imageConfigs = map[string]bool{
+	manifest.DockerV2Schema2ConfigMediaType: true,
+	imgspecv1.MediaTypeImageConfig:          true,
+}
+
+// ManifestInfo holds information about an image manifest.
+type ManifestInfo struct {
+	// MediaType is the manifest media type.
+	MediaType string
+	// ConfigMediaType is the config media type, empty for lists and
+	// schema1 manifests.
+	ConfigMediaType string
+	// Artifact is true if the manifest is an OCI artifact, i.e. not a
+	// runnable image.
+	Artifact bool
+	// Blobs is the number of blobs (layers and config) referred by the
+	// manifest, zero for lists.
+	Blobs int
+	// Size is the sum of the sizes of all blobs.
+	Size int64
+}
+
+// InspectManifest returns information about the provided manifest. Returns a
+// MediaTypeError if the manifest media type is not supported. If the media
+// type is empty it is guessed from the manifest content.
+func InspectManifest(blob []byte, mime string) (*ManifestInfo, error) {
+	if mime == "" || mime == "application/json" {
+		mime = manifest.GuessMIMEType(blob)
+	}
+	if !supportedManifests[mime] {
+		return nil, &MediaTypeError{MediaType: mime}
+	}
+
+	info := &ManifestInfo{MediaType: mime}
+	if manifest.MIMETypeIsMultiImage(mime) {
+		return info, nil
+	}
+
+	man, err := manifest.FromBlob(blob, mime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s manifest: %w", mime, err)
+	}
+
+	blobs := []int64{}
+	for _, layer := range man.LayerInfos() {
+		blobs = append(blobs, layer.Size)
+	}
+	if config := man.ConfigInfo(); config.Digest != "" {
+		blobs = append(blobs, config.Size)
+	}
+	info.Blobs = len(blobs)
+	for _, size := range blobs {
+		if size > 0 {
+			info.Size += size
+		}
+	}
+
+	if mime == imgspecv1.MediaTypeImageManifest {
+		var oci imgspecv1.Manifest
+		if err := json.Unmarshal(blob, &oci); err != nil {
+			return nil, fmt.Errorf("invalid oci manifest: %w", err)
+		}
+		info.ConfigMediaType = oci.Config.MediaType
+		info.Artifact = !imageConfigs[oci.Config.MediaType]
+	}
+	if mime == manifest.DockerV2Schema2MediaType {
+		info.ConfigMediaType = manifest.DockerV2Schema2ConfigMediaType
+	}
+	return info, nil
+}
+
+// Schema1 returns true if the manifest is a legacy docker schema1 manifest.
+func (m *ManifestInfo) Schema1() bool {
+	return m.MediaType == manifest.DockerV2Schema1MediaType ||
+		m.MediaType == manifest.DockerV2Schema1SignedMediaType
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestInspectManifest(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		mime     string
+		blob     string
+		expected *ManifestInfo
+		err      string
+	}{
+		{
+			name: "docker schema2",
+			mime: manifest.DockerV2Schema2MediaType,
+			blob: `{
+				"schemaVersion": 2,
+				"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+				"config": {
+					"mediaType": "application/vnd.docker.container.image.v1+json",
+					"size": 10,
+					"digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+				},
+				"layers": [{
+					"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+					"size": 100,
+					"digest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+				}]
+			}`,
+			expected: &ManifestInfo{
+				MediaType:       manifest.DockerV2Schema2MediaType,
+				ConfigMediaType: manifest.DockerV2Schema2ConfigMediaType,
+				Blobs:           2,
+				Size:            110,
+			},
+		},
+		{
+			name: "oci image with zstd layer",
+			mime: imgspecv1.MediaTypeImageManifest,
+			blob: `{
+				"schemaVersion": 2,
+				"config": {
+					"mediaType": "application/vnd.oci.image.config.v1+json",
+					"size": 10,
+					"digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+				},
+				"layers": [{
+					"mediaType": "application/vnd.oci.image.layer.v1.tar+zstd",
+					"size": 100,
+					"digest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+				}]
+			}`,
+			expected: &ManifestInfo{
+				MediaType:       imgspecv1.MediaTypeImageManifest,
+				ConfigMediaType: imgspecv1.MediaTypeImageConfig,
+				Blobs:           2,
+				Size:            110,
+			},
+		},
+		{
+			name: "oci artifact",
+			mime: imgspecv1.MediaTypeImageManifest,
+			blob: `{
+				"schemaVersion": 2,
+				"config": {
+					"mediaType": "application/vnd.cncf.helm.config.v1+json",
+					"size": 10,
+					"digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+				},
+				"layers": [{
+					"mediaType": "application/tar+gzip",
+					"size": 100,
+					"digest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+				}]
+			}`,
+			expected: &ManifestInfo{
+				MediaType:       imgspecv1.MediaTypeImageManifest,
+				ConfigMediaType: "application/vnd.cncf.helm.config.v1+json",
+				Artifact:        true,
+				Blobs:           2,
+				Size:            110,
+			},
+		},
+		{
+			name: "image index",
+			mime: imgspecv1.MediaTypeImageIndex,
+			blob: `{"schemaVersion": 2, "manifests": []}`,
+			expected: &ManifestInfo{
+				MediaType: imgspecv1.MediaTypeImageIndex,
+			},
+		},
+		{
+			name: "unknown media type",
+			mime: "application/vnd.unknown.manifest.v1+json",
+			blob: `{}`,
+			err:  `unsupported manifest media type "application/vnd.unknown.manifest.v1+json"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := InspectManifest([]byte(tt.blob), tt.mime)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if err.Error() != tt.err {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				var mterr *MediaTypeError
+				if !errors.As(err, &mterr) {
+					t.Errorf("expected media type error, %T received", err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			if !reflect.DeepEqual(info, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, info)
+			}
+		})
+	}
+}
+
+func TestManifestInfoSchema1(t *testing.T) {
+	for mime, expected := range map[string]bool{
+		manifest.DockerV2Schema1MediaType:       true,
+		manifest.DockerV2Schema1SignedMediaType: true,
+		manifest.DockerV2Schema2MediaType:       false,
+		imgspecv1.MediaTypeImageManifest:        false,
+	} {
+		info := &ManifestInfo{MediaType: mime}
+		if info.Schema1() != expected {
+			t.Errorf("%s: expected %v", mime, expected)
+		}
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	blob := []byte(`{"schemaVersion": 2}`)
+	for _, tt := range []struct {
+		name     string
+		expected string
+		err      string
+	}{
+		{
+			name:     "matching digest",
+			expected: digest.FromBytes(blob).String(),
+		},
+		{
+			name:     "mismatching digest",
+			expected: digest.FromString("other").String(),
+			err:      "does not match",
+		},
+		{
+			name:     "invalid digest",
+			expected: "sha256:abc",
+			err:      "invalid digest",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyDigest(blob, tt.expected)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// MonitoringLabel is set to "true" on the Prometheus operator objects kept by
+// tagger. Only objects carrying it are updated, and deleted.
+const MonitoringLabel = "image-tag-monitoring"
+
+// MetricsServiceLabel is the label, set to "true", of the Service exposing our
+// metrics through a port named "metrics". It is what ServiceMonitors select.
+const MetricsServiceLabel = "image-tag-metrics"
+
+// monitoringPath is the API path of the Prometheus operator objects, by
+// namespace and resource. Prometheus operator types are not vendored, objects
+// are handled as unstructured.
+const monitoringPath = "/apis/monitoring.coreos.com/v1/namespaces/%s/%s"
+
+// defaultStaleAfter is for how long Tags may not be rolled out before an
+// alert is raised, if not configured.
+const defaultStaleAfter = time.Hour
+
+// Monitoring keeps, on clusters running the Prometheus operator, a
+// ServiceMonitor scraping our metrics and a PrometheusRule with the default
+// alerts, see the monitoring configuration. Objects kept under a previous
+// name, or while disabled, are deleted.
+type Monitoring struct {
+	mtx       sync.Mutex
+	cfg       *config.Monitoring
+	restcli   rest.Interface
+	namespace string
+}
+
+// NewMonitoring returns a service keeping the Prometheus operator objects in
+// namespace. The client is used for raw requests on absolute paths, e.g. the
+// discovery rest client. Nothing is done unless the monitoring configuration
+// is set.
+func NewMonitoring(restcli rest.Interface, namespace string) *Monitoring {
+	return &Monitoring{
+		restcli:   restcli,
+		namespace: namespace,
+	}
+}
+
+// ApplyConfig applies the monitoring configuration.
+func (m *Monitoring) ApplyConfig(cfg *config.Config) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.cfg = cfg.Monitoring
+}
+
+// config returns the monitoring configuration, nil if disabled.
+func (m *Monitoring) config() *config.Monitoring {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.cfg
+}
+
+// Sync brings the ServiceMonitor and the PrometheusRule in line with the
+// configuration. Returns true if any of them has been created or updated.
+func (m *Monitoring) Sync(ctx context.Context) (bool, error) {
+	cfg := m.config()
+	objects := []struct {
+		resource string
+		kind     string
+		spec     func(*config.Monitoring) map[string]interface{}
+	}{
+		{"servicemonitors", "ServiceMonitor", m.serviceMonitorSpec},
+		{"prometheusrules", "PrometheusRule", m.prometheusRuleSpec},
+	}
+
+	changed := false
+	for _, obj := range objects {
+		var spec map[string]interface{}
+		if cfg != nil {
+			spec = obj.spec(cfg)
+		}
+		updated, err := m.sync(ctx, cfg, obj.resource, obj.kind, spec)
+		if err != nil {
+			return changed, fmt.Errorf("error syncing %s: %w", obj.resource, err)
+		}
+		changed = changed || updated
+	}
+	return changed, nil
+}
+
+// sync keeps the object of the provided resource in line with spec. Objects
+// kept under other names are deleted, a nil cfg deletes them all.
+func (m *Monitoring) sync(
+	ctx context.Context,
+	cfg *config.Monitoring,
+	resource string,
+	kind string,
+	spec map[string]interface{},
+) (bool, error) {
+	path := fmt.Sprintf(monitoringPath, m.namespace, resource)
+	sel := labels.SelectorFromSet(labels.Set{MonitoringLabel: "true"})
+	raw, err := m.restcli.Get().AbsPath(path).Param("labelSelector", sel.String()).Do(ctx).Raw()
+	if err != nil {
+		if errors.IsNotFound(err) {
+			if cfg == nil {
+				return false, nil
+			}
+			return false, fmt.Errorf("%s not served, is the prometheus operator installed?", resource)
+		}
+		return false, err
+	}
+
+	list := &unstructured.UnstructuredList{}
+	if err := list.UnmarshalJSON(raw); err != nil {
+		return false, err
+	}
+
+	var current *unstructured.Unstructured
+	for i, obj := range list.Items {
+		if cfg != nil && obj.GetName() == cfg.Name {
+			current = &list.Items[i]
+			continue
+		}
+		if err := m.restcli.Delete().AbsPath(path, obj.GetName()).Do(ctx).Error(); err != nil &&
+			!errors.IsNotFound(err) {
+			return false, err
+		}
+		klog.V(2).Infof("%s %s/%s deleted", kind, m.namespace, obj.GetName())
+	}
+	if cfg == nil {
+		return false, nil
+	}
+
+	objlabels := map[string]string{MonitoringLabel: "true"}
+	for key, value := range cfg.Labels {
+		objlabels[key] = value
+	}
+
+	if current == nil {
+		err := m.restcli.Get().AbsPath(path, cfg.Name).Do(ctx).Error()
+		if err == nil {
+			return false, fmt.Errorf(
+				"%s %s/%s not managed by tagger", kind, m.namespace, cfg.Name,
+			)
+		} else if !errors.IsNotFound(err) {
+			return false, err
+		}
+
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		obj.SetAPIVersion("monitoring.coreos.com/v1")
+		obj.SetKind(kind)
+		obj.SetNamespace(m.namespace)
+		obj.SetName(cfg.Name)
+		obj.SetLabels(objlabels)
+		body, err := json.Marshal(obj.Object)
+		if err != nil {
+			return false, err
+		}
+		if err := m.restcli.Post().AbsPath(path).Body(body).Do(ctx).Error(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if reflect.DeepEqual(current.Object["spec"], spec) &&
+		reflect.DeepEqual(current.GetLabels(), objlabels) {
+		return false, nil
+	}
+	current.Object["spec"] = spec
+	current.SetLabels(objlabels)
+	body, err := json.Marshal(current.Object)
+	if err != nil {
+		return false, err
+	}
+	if err := m.restcli.Put().AbsPath(path, cfg.Name).Body(body).Do(ctx).Error(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// serviceMonitorSpec returns the spec of a ServiceMonitor scraping the metrics
+// Service in our namespace. Values are kept as found in decoded json, so they
+// can be compared with the spec read back.
+func (m *Monitoring) serviceMonitorSpec(cfg *config.Monitoring) map[string]interface{} {
+	endpoint := map[string]interface{}{
+		"port": "metrics",
+		"path": "/metrics",
+	}
+	if cfg.Interval > 0 {
+		endpoint["interval"] = promDuration(cfg.Interval)
+	}
+	return map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{MetricsServiceLabel: "true"},
+		},
+		"namespaceSelector": map[string]interface{}{
+			"matchNames": []interface{}{m.namespace},
+		},
+		"endpoints": []interface{}{endpoint},
+	}
+}
+
+// prometheusRuleSpec returns the spec of a PrometheusRule alerting on failing
+// imports, on Tags not rolled out for too long and on http servers answering
+// with server errors. Tags are reported by every replica of the shard owning
+// them so their counts are never summed across pods.
+func (m *Monitoring) prometheusRuleSpec(cfg *config.Monitoring) map[string]interface{} {
+	stale := cfg.StaleAfter
+	if stale == 0 {
+		stale = defaultStaleAfter
+	}
+
+	rule := func(alert, expr string, after time.Duration, summary, desc string) interface{} {
+		return map[string]interface{}{
+			"alert": alert,
+			"expr":  expr,
+			"for":   promDuration(after),
+			"labels": map[string]interface{}{
+				"severity": "warning",
+			},
+			"annotations": map[string]interface{}{
+				"summary":     summary,
+				"description": desc,
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"groups": []interface{}{
+			map[string]interface{}{
+				"name": "tagger",
+				"rules": []interface{}{
+					rule(
+						"TaggerImportsFailing",
+						`max by (namespace) (tagger_tags{state="failing"}) > 0`,
+						15*time.Minute,
+						"Tags fail to import",
+						"{{ $value }} Tags in {{ $labels.namespace }} fail to import.",
+					),
+					rule(
+						"TaggerTagsStale",
+						`max by (namespace) (tagger_tags{state=~"pending|drifted"}) > 0`,
+						stale,
+						"Tags not rolled out",
+						"{{ $value }} Tags in {{ $labels.namespace }} are not imported "+
+							"or not running their current generation.",
+					),
+					rule(
+						"TaggerServerErrors",
+						`sum by (server) (rate(tagger_http_requests_total{code=~"5.."}[5m])) > 0`,
+						10*time.Minute,
+						"Tagger answers with server errors",
+						"The {{ $labels.server }} answers with server errors.",
+					),
+				},
+			},
+		},
+	}
+}
+
+// promDuration formats d as a Prometheus duration, in the largest unit
+// expressing it in whole numbers.
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
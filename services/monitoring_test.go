@@ -0,0 +1,278 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	restfake "k8s.io/client-go/rest/fake"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// monitoringServer answers requests for Prometheus operator objects in the
+// tagger namespace, kept by resource and name.
+type monitoringServer struct {
+	notServed bool
+	objects   map[string]map[string]map[string]interface{}
+}
+
+func (m *monitoringServer) do(req *http.Request) (*http.Response, error) {
+	const prefix = "/apis/monitoring.coreos.com/v1/namespaces/tagger/"
+
+	respond := func(code int, body interface{}) (*http.Response, error) {
+		data, _ := json.Marshal(body)
+		return &http.Response{
+			StatusCode: code,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(data)),
+		}, nil
+	}
+	notFound := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Reason:   metav1.StatusReasonNotFound,
+		Code:     http.StatusNotFound,
+	}
+
+	if m.notServed || !strings.HasPrefix(req.URL.Path, prefix) {
+		return respond(http.StatusNotFound, notFound)
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, prefix), "/")
+	objects := m.objects[parts[0]]
+	if objects == nil {
+		objects = map[string]map[string]interface{}{}
+		m.objects[parts[0]] = objects
+	}
+
+	if len(parts) == 1 {
+		switch req.Method {
+		case http.MethodGet:
+			items := []interface{}{}
+			for _, obj := range objects {
+				meta := obj["metadata"].(map[string]interface{})
+				labels, _ := meta["labels"].(map[string]interface{})
+				if req.URL.Query().Get("labelSelector") == MonitoringLabel+"=true" &&
+					labels[MonitoringLabel] != "true" {
+					continue
+				}
+				items = append(items, obj)
+			}
+			return respond(http.StatusOK, map[string]interface{}{
+				"apiVersion": "monitoring.coreos.com/v1",
+				"kind":       "List",
+				"items":      items,
+			})
+		case http.MethodPost:
+			obj := map[string]interface{}{}
+			if err := json.NewDecoder(req.Body).Decode(&obj); err != nil {
+				return nil, err
+			}
+			name := obj["metadata"].(map[string]interface{})["name"].(string)
+			objects[name] = obj
+			return respond(http.StatusCreated, obj)
+		}
+		return respond(http.StatusNotFound, notFound)
+	}
+
+	obj, ok := objects[parts[1]]
+	if !ok {
+		return respond(http.StatusNotFound, notFound)
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return respond(http.StatusOK, obj)
+	case http.MethodPut:
+		obj = map[string]interface{}{}
+		if err := json.NewDecoder(req.Body).Decode(&obj); err != nil {
+			return nil, err
+		}
+		objects[parts[1]] = obj
+		return respond(http.StatusOK, obj)
+	case http.MethodDelete:
+		delete(objects, parts[1])
+		return respond(http.StatusOK, metav1.Status{Status: metav1.StatusSuccess})
+	}
+	return respond(http.StatusNotFound, notFound)
+}
+
+// names returns the names of the objects of the provided resource, sorted.
+func (m *monitoringServer) names(resource string) []string {
+	var names []string
+	for name := range m.objects[resource] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMonitoringSync(t *testing.T) {
+	object := func(kind, name string, managed bool) map[string]interface{} {
+		meta := map[string]interface{}{"name": name, "namespace": "tagger"}
+		if managed {
+			meta["labels"] = map[string]interface{}{MonitoringLabel: "true"}
+		}
+		return map[string]interface{}{
+			"apiVersion": "monitoring.coreos.com/v1",
+			"kind":       kind,
+			"metadata":   meta,
+			"spec":       map[string]interface{}{},
+		}
+	}
+
+	cfg := &config.Monitoring{
+		Name:     "tagger",
+		Labels:   map[string]string{"release": "prometheus"},
+		Interval: 30 * time.Second,
+	}
+
+	for _, tt := range []struct {
+		name      string
+		cfg       *config.Monitoring
+		notServed bool
+		objects   map[string]map[string]map[string]interface{}
+		changed   bool
+		monitors  []string
+		rules     []string
+		err       string
+	}{
+		{
+			name:     "created",
+			cfg:      cfg,
+			changed:  true,
+			monitors: []string{"tagger"},
+			rules:    []string{"tagger"},
+		},
+		{
+			name: "updated and renamed",
+			cfg:  cfg,
+			objects: map[string]map[string]map[string]interface{}{
+				"servicemonitors": {
+					"tagger": object("ServiceMonitor", "tagger", true),
+					"old":    object("ServiceMonitor", "old", true),
+				},
+				"prometheusrules": {
+					"old": object("PrometheusRule", "old", true),
+				},
+			},
+			changed:  true,
+			monitors: []string{"tagger"},
+			rules:    []string{"tagger"},
+		},
+		{
+			name: "disabled",
+			objects: map[string]map[string]map[string]interface{}{
+				"servicemonitors": {
+					"tagger": object("ServiceMonitor", "tagger", true),
+					"other":  object("ServiceMonitor", "other", false),
+				},
+			},
+			monitors: []string{"other"},
+		},
+		{
+			name:      "disabled without prometheus operator",
+			notServed: true,
+		},
+		{
+			name:      "prometheus operator not installed",
+			cfg:       cfg,
+			notServed: true,
+			err:       "is the prometheus operator installed?",
+		},
+		{
+			name: "not managed",
+			cfg:  cfg,
+			objects: map[string]map[string]map[string]interface{}{
+				"servicemonitors": {
+					"tagger": object("ServiceMonitor", "tagger", false),
+				},
+			},
+			monitors: []string{"tagger"},
+			err:      "ServiceMonitor tagger/tagger not managed by tagger",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &monitoringServer{notServed: tt.notServed, objects: tt.objects}
+			if srv.objects == nil {
+				srv.objects = map[string]map[string]map[string]interface{}{}
+			}
+			restcli := &restfake.RESTClient{
+				NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+				Client:               restfake.CreateHTTPClient(srv.do),
+			}
+
+			svc := NewMonitoring(restcli, "tagger")
+			svc.ApplyConfig(&config.Config{Monitoring: tt.cfg})
+
+			ctx := context.Background()
+			changed, err := svc.Sync(ctx)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, %v received", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if changed != tt.changed {
+				t.Errorf("expected changed %v, %v received", tt.changed, changed)
+			}
+			if names := srv.names("servicemonitors"); !reflect.DeepEqual(names, tt.monitors) {
+				t.Errorf("expected service monitors %v, %v found", tt.monitors, names)
+			}
+			if names := srv.names("prometheusrules"); !reflect.DeepEqual(names, tt.rules) {
+				t.Errorf("expected prometheus rules %v, %v found", tt.rules, names)
+			}
+			if tt.err != "" || tt.cfg == nil {
+				return
+			}
+
+			monitor := srv.objects["servicemonitors"]["tagger"]
+			labels := monitor["metadata"].(map[string]interface{})["labels"]
+			expected := map[string]interface{}{MonitoringLabel: "true", "release": "prometheus"}
+			if !reflect.DeepEqual(labels, expected) {
+				t.Errorf("unexpected labels: %v", labels)
+			}
+			endpoints := monitor["spec"].(map[string]interface{})["endpoints"].([]interface{})
+			if interval := endpoints[0].(map[string]interface{})["interval"]; interval != "30s" {
+				t.Errorf("unexpected interval: %v", interval)
+			}
+
+			rules, _ := json.Marshal(srv.objects["prometheusrules"]["tagger"])
+			for _, alert := range []string{
+				"TaggerImportsFailing", "TaggerTagsStale", "TaggerServerErrors", `"for":"1h"`,
+			} {
+				if !strings.Contains(string(rules), alert) {
+					t.Errorf("%s not found in rules: %s", alert, rules)
+				}
+			}
+
+			// a second sync has nothing to change.
+			if changed, err := svc.Sync(ctx); err != nil || changed {
+				t.Errorf("unexpected second sync: %v, %v", changed, err)
+			}
+		})
+	}
+}
+
+func TestPromDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		30 * time.Second: "30s",
+		90 * time.Second: "90s",
+		15 * time.Minute: "15m",
+		2 * time.Hour:    "2h",
+		90 * time.Minute: "90m",
+	} {
+		if found := promDuration(d); found != expected {
+			t.Errorf("expected %s for %v, %s found", expected, d, found)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corecli "k8s.io/client-go/kubernetes"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+)
+
+// NetworkPolicyLabel is set to "true" on the NetworkPolicies kept by tagger.
+// Only NetworkPolicies carrying it are updated, and deleted.
+const NetworkPolicyLabel = "image-tag-network-policy"
+
+// registryHosts maps registries whose api is served, and authenticated, by
+// other hosts into these hosts.
+var registryHosts = map[string][]string{
+	"docker.io": {"registry-1.docker.io", "auth.docker.io"},
+}
+
+// NetworkPolicy keeps a NetworkPolicy, in our namespace, restricting the
+// egress of our pods to the registries Tags are imported from, see the
+// networkPolicy configuration. NetworkPolicies only take addresses so the
+// registries are resolved on every sync. DNS and the API server are always
+// allowed, the latter through the endpoints of the "kubernetes" Service.
+type NetworkPolicy struct {
+	sync.Mutex
+	cfg       *config.NetworkPolicy
+	corcli    corecli.Interface
+	taglis    taglist.TagLister
+	impsvc    *Importer
+	namespace string
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewNetworkPolicy returns a service keeping the NetworkPolicy in namespace.
+// Nothing is done unless the networkPolicy configuration is set.
+func NewNetworkPolicy(
+	corcli corecli.Interface,
+	taglis taglist.TagLister,
+	cmlister corelister.ConfigMapLister,
+	namespace string,
+) *NetworkPolicy {
+	return &NetworkPolicy{
+		corcli:    corcli,
+		taglis:    taglis,
+		impsvc:    NewImporter(cmlister, nil),
+		namespace: namespace,
+		lookup:    net.DefaultResolver.LookupIPAddr,
+	}
+}
+
+// ApplyConfig applies the network policy configuration and the registries,
+// unqualified and mirrors, Tags may be imported from.
+func (n *NetworkPolicy) ApplyConfig(cfg *config.Config) {
+	n.impsvc.syssvc.ApplyConfig(cfg)
+	n.Lock()
+	defer n.Unlock()
+	n.cfg = cfg.NetworkPolicy
+}
+
+// config returns the network policy configuration, nil if disabled.
+func (n *NetworkPolicy) config() *config.NetworkPolicy {
+	n.Lock()
+	defer n.Unlock()
+	return n.cfg
+}
+
+// Sync brings the NetworkPolicy in line with the registries in use. Policies
+// kept under a previous name, or while disabled, are deleted. Returns true if
+// the NetworkPolicy has been created or updated.
+func (n *NetworkPolicy) Sync(ctx context.Context) (bool, error) {
+	cfg := n.config()
+	cli := n.corcli.NetworkingV1().NetworkPolicies(n.namespace)
+
+	sel := labels.SelectorFromSet(labels.Set{NetworkPolicyLabel: "true"})
+	pols, err := cli.List(ctx, metav1.ListOptions{LabelSelector: sel.String()})
+	if err != nil {
+		return false, err
+	}
+
+	var current *netv1.NetworkPolicy
+	for i, pol := range pols.Items {
+		if cfg != nil && pol.Name == cfg.Name {
+			current = &pols.Items[i]
+			continue
+		}
+		if err := cli.Delete(ctx, pol.Name, metav1.DeleteOptions{}); err != nil &&
+			!errors.IsNotFound(err) {
+			return false, err
+		}
+		klog.V(2).Infof("network policy %s/%s deleted", n.namespace, pol.Name)
+	}
+	if cfg == nil {
+		return false, nil
+	}
+
+	spec, err := n.spec(ctx, cfg)
+	if err != nil {
+		return false, err
+	}
+
+	if current == nil {
+		if _, err := cli.Get(ctx, cfg.Name, metav1.GetOptions{}); err == nil {
+			return false, fmt.Errorf(
+				"network policy %s/%s not managed by tagger", n.namespace, cfg.Name,
+			)
+		} else if !errors.IsNotFound(err) {
+			return false, err
+		}
+
+		pol := &netv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: n.namespace,
+				Name:      cfg.Name,
+				Labels:    map[string]string{NetworkPolicyLabel: "true"},
+			},
+			Spec: spec,
+		}
+		if _, err := cli.Create(ctx, pol, metav1.CreateOptions{}); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if reflect.DeepEqual(current.Spec, spec) {
+		return false, nil
+	}
+	current = current.DeepCopy()
+	current.Spec = spec
+	if _, err := cli.Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// spec returns the NetworkPolicy spec for the registries in use. Hosts that
+// can't be resolved are left out, failing to find the API server fails as
+// we would lock ourselves out.
+func (n *NetworkPolicy) spec(
+	ctx context.Context, cfg *config.NetworkPolicy,
+) (netv1.NetworkPolicySpec, error) {
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dns := intstr.FromInt(53)
+	rules := []netv1.NetworkPolicyEgressRule{
+		{
+			Ports: []netv1.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dns},
+				{Protocol: &tcp, Port: &dns},
+			},
+		},
+	}
+
+	apirule, err := n.apiServerRule(ctx)
+	if err != nil {
+		return netv1.NetworkPolicySpec{}, fmt.Errorf("unable to find api server: %w", err)
+	}
+	rules = append(rules, apirule)
+
+	hosts, err := n.hosts(cfg)
+	if err != nil {
+		return netv1.NetworkPolicySpec{}, err
+	}
+
+	// addresses are grouped by port, one rule per port.
+	byport := map[int][]string{}
+	for _, host := range hosts {
+		name, port := splitHostPort(host)
+		addrs, err := n.lookup(ctx, name)
+		if err != nil {
+			klog.Errorf("unable to resolve %s, left out of network policy: %s", name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			byport[port] = append(byport[port], hostCIDR(addr.IP))
+		}
+	}
+	ports := make([]int, 0, len(byport))
+	for port := range byport {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		target := intstr.FromInt(port)
+		rules = append(rules, netv1.NetworkPolicyEgressRule{
+			Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: &target}},
+			To:    ipBlockPeers(byport[port]),
+		})
+	}
+
+	if len(cfg.ExtraCIDRs) > 0 {
+		rules = append(rules, netv1.NetworkPolicyEgressRule{
+			To: ipBlockPeers(cfg.ExtraCIDRs),
+		})
+	}
+
+	return netv1.NetworkPolicySpec{
+		PodSelector: *cfg.PodSelector.LabelSelector(),
+		PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeEgress},
+		Egress:      rules,
+	}, nil
+}
+
+// apiServerRule returns an egress rule allowing the API server, read from the
+// endpoints of the "kubernetes" Service in the default namespace.
+func (n *NetworkPolicy) apiServerRule(ctx context.Context) (netv1.NetworkPolicyEgressRule, error) {
+	var rule netv1.NetworkPolicyEgressRule
+	eps, err := n.corcli.CoreV1().Endpoints("default").Get(ctx, "kubernetes", metav1.GetOptions{})
+	if err != nil {
+		return rule, err
+	}
+
+	var cidrs []string
+	ports := map[int32]bool{}
+	for _, subset := range eps.Subsets {
+		for _, addr := range subset.Addresses {
+			if ip := net.ParseIP(addr.IP); ip != nil {
+				cidrs = append(cidrs, hostCIDR(ip))
+			}
+		}
+		for _, port := range subset.Ports {
+			ports[port.Port] = true
+		}
+	}
+	if len(cidrs) == 0 || len(ports) == 0 {
+		return rule, fmt.Errorf("no api server endpoints")
+	}
+
+	rule.To = ipBlockPeers(cidrs)
+	tcp := corev1.ProtocolTCP
+	for port := range ports {
+		target := intstr.FromInt(int(port))
+		rule.Ports = append(rule.Ports, netv1.NetworkPolicyPort{Protocol: &tcp, Port: &target})
+	}
+	sort.Slice(rule.Ports, func(i, j int) bool {
+		return rule.Ports[i].Port.IntVal < rule.Ports[j].Port.IntVal
+	})
+	return rule, nil
+}
+
+// hosts returns, sorted, the hosts we may need to reach: the registries Tags
+// are imported from, their mirrors, the cache registry and the extra hosts.
+func (n *NetworkPolicy) hosts(cfg *config.NetworkPolicy) ([]string, error) {
+	tags, err := n.taglis.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	registries := map[string]bool{}
+	for _, it := range tags {
+		domain, _ := n.impsvc.SplitRegistryDomain(it.Spec.From)
+		if domain != "" {
+			registries[domain] = true
+			continue
+		}
+		for _, reg := range n.impsvc.syssvc.UnqualifiedRegistries(context.Background()) {
+			registries[reg] = true
+		}
+	}
+
+	uniq := map[string]bool{}
+	for reg := range registries {
+		for _, mirror := range n.impsvc.syssvc.MirrorsFor(reg) {
+			uniq[mirror] = true
+		}
+		if hosts, ok := registryHosts[reg]; ok {
+			for _, host := range hosts {
+				uniq[host] = true
+			}
+			continue
+		}
+		uniq[reg] = true
+	}
+	if inreg, _, err := n.impsvc.syssvc.CacheRegistryAddresses(); err == nil && inreg != "" {
+		uniq[inreg] = true
+	}
+	for _, host := range cfg.ExtraHosts {
+		uniq[host] = true
+	}
+
+	hosts := make([]string, 0, len(uniq))
+	for host := range uniq {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// splitHostPort splits a registry host into its name and port, registries
+// without an explicit port are reached on 443. Paths, if any, are dropped.
+func splitHostPort(host string) (string, int) {
+	host = strings.SplitN(host, "/", 2)[0]
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host, 443
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return name, 443
+	}
+	return name, p
+}
+
+// hostCIDR returns the CIDR covering only the provided address.
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// ipBlockPeers returns one peer per CIDR, sorted and without duplicates.
+func ipBlockPeers(cidrs []string) []netv1.NetworkPolicyPeer {
+	uniq := map[string]bool{}
+	for _, cidr := range cidrs {
+		uniq[cidr] = true
+	}
+	sorted := make([]string, 0, len(uniq))
+	for cidr := range uniq {
+		sorted = append(sorted, cidr)
+	}
+	sort.Strings(sorted)
+
+	peers := make([]netv1.NetworkPolicyPeer, 0, len(sorted))
+	for _, cidr := range sorted {
+		peers = append(peers, netv1.NetworkPolicyPeer{IPBlock: &netv1.IPBlock{CIDR: cidr}})
+	}
+	return peers
+}
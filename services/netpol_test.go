@@ -0,0 +1,244 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	taginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestNetworkPolicySync(t *testing.T) {
+	tags := []runtime.Object{
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+			Spec:       imagtagv1.TagSpec{From: "quay.io/company/app:latest"},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "nginx"},
+			Spec:       imagtagv1.TagSpec{From: "nginx:latest"},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "internal"},
+			Spec:       imagtagv1.TagSpec{From: "registry.internal:5000/team/app:1"},
+		},
+	}
+
+	apiserver := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kubernetes"},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+				Ports:     []corev1.EndpointPort{{Port: 6443}},
+			},
+		},
+	}
+
+	addresses := map[string][]string{
+		"quay.io":              {"3.3.3.3", "3.3.3.4"},
+		"registry-1.docker.io": {"1.1.1.1"},
+		"auth.docker.io":       {"2.2.2.2", "2001:db8::1"},
+		"mirror.internal":      {"10.1.1.1"},
+		"registry.internal":    {"10.2.2.2"},
+	}
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		ips, ok := addresses[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host")
+		}
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+
+	tcp, udp := corev1.ProtocolTCP, corev1.ProtocolUDP
+	port := func(p int) *intstr.IntOrString {
+		target := intstr.FromInt(p)
+		return &target
+	}
+	peers := func(cidrs ...string) []netv1.NetworkPolicyPeer {
+		var out []netv1.NetworkPolicyPeer
+		for _, cidr := range cidrs {
+			out = append(out, netv1.NetworkPolicyPeer{IPBlock: &netv1.IPBlock{CIDR: cidr}})
+		}
+		return out
+	}
+	expected := netv1.NetworkPolicySpec{
+		PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "tagger"}},
+		PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeEgress},
+		Egress: []netv1.NetworkPolicyEgressRule{
+			{
+				Ports: []netv1.NetworkPolicyPort{
+					{Protocol: &udp, Port: port(53)},
+					{Protocol: &tcp, Port: port(53)},
+				},
+			},
+			{
+				Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: port(6443)}},
+				To:    peers("10.0.0.1/32"),
+			},
+			{
+				Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: port(443)}},
+				To: peers(
+					"1.1.1.1/32", "2.2.2.2/32", "2001:db8::1/128", "3.3.3.3/32", "3.3.3.4/32",
+				),
+			},
+			{
+				Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp, Port: port(5000)}},
+				To:    peers("10.1.1.1/32", "10.2.2.2/32"),
+			},
+			{
+				To: peers("192.168.0.0/16"),
+			},
+		},
+	}
+
+	managed := func(name string) *netv1.NetworkPolicy {
+		return &netv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "tagger",
+				Name:      name,
+				Labels:    map[string]string{NetworkPolicyLabel: "true"},
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		disabled bool
+		objects  []runtime.Object
+		changed  bool
+		expected []string
+		err      string
+	}{
+		{
+			name:     "created",
+			objects:  []runtime.Object{apiserver},
+			changed:  true,
+			expected: []string{"tagger-egress"},
+		},
+		{
+			name:     "updated and renamed",
+			objects:  []runtime.Object{apiserver, managed("tagger-egress"), managed("old")},
+			changed:  true,
+			expected: []string{"tagger-egress"},
+		},
+		{
+			name:     "disabled",
+			disabled: true,
+			objects:  []runtime.Object{apiserver, managed("tagger-egress")},
+		},
+		{
+			name: "not managed",
+			objects: []runtime.Object{
+				apiserver,
+				&netv1.NetworkPolicy{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "tagger", Name: "tagger-egress"},
+				},
+			},
+			expected: []string{"tagger-egress"},
+			err:      "network policy tagger/tagger-egress not managed by tagger",
+		},
+		{
+			name:     "api server not found",
+			objects:  []runtime.Object{managed("tagger-egress")},
+			expected: []string{"tagger-egress"},
+			err:      "unable to find api server",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tagcli := tagfake.NewSimpleClientset(tags...)
+			taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+
+			corcli := corfake.NewSimpleClientset(tt.objects...)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			cmlis := corinf.Core().V1().ConfigMaps().Lister()
+
+			taginf.Start(ctx.Done())
+			corinf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				taginf.Images().V1().Tags().Informer().HasSynced,
+				corinf.Core().V1().ConfigMaps().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			cfg := config.Default()
+			cfg.RegistryMirrors = map[string][]string{"docker.io": {"mirror.internal:5000"}}
+			if !tt.disabled {
+				cfg.NetworkPolicy = &config.NetworkPolicy{
+					Name: "tagger-egress",
+					PodSelector: &config.Selector{
+						MatchLabels: map[string]string{"app": "tagger"},
+					},
+					ExtraHosts: []string{"unresolvable.internal"},
+					ExtraCIDRs: []string{"192.168.0.0/16"},
+				}
+			}
+
+			svc := NewNetworkPolicy(corcli, taglis, cmlis, "tagger")
+			svc.lookup = lookup
+			svc.ApplyConfig(cfg)
+
+			changed, err := svc.Sync(ctx)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, %v received", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if changed != tt.changed {
+				t.Errorf("expected changed %v, %v received", tt.changed, changed)
+			}
+
+			pols, err := corcli.NetworkingV1().NetworkPolicies("").List(
+				ctx, metav1.ListOptions{},
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var found []string
+			for _, pol := range pols.Items {
+				found = append(found, pol.Name)
+				if tt.err == "" && !reflect.DeepEqual(pol.Spec, expected) {
+					t.Errorf("unexpected spec: %+v", pol.Spec)
+				}
+			}
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("expected %v, %v found", tt.expected, found)
+			}
+			if tt.err != "" {
+				return
+			}
+
+			// a second sync has nothing to change.
+			if changed, err := svc.Sync(ctx); err != nil || changed {
+				t.Errorf("unexpected second sync: %v, %v", changed, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// NotificationWebhookLabel must be set to "true" on Secrets registering an
+// outbound webhook. The Secret holds the webhook URL under the "url" key and,
+// optionally, the key used to sign the deliveries under the "secret" key, an
+// aggregation window under the "window" key and the payload format under the
+// "format" key.
+const NotificationWebhookLabel = "image-tag-webhook"
+
+// NotificationSignatureHeader holds the hex encoded HMAC-SHA256 of the body,
+// prefixed by "sha256=", for webhooks registered with a secret.
+const NotificationSignatureHeader = "X-Tagger-Signature"
+
+// NotificationTimeout is how long a webhook has to answer a delivery.
+const NotificationTimeout = 10 * time.Second
+
+// Events delivered to outbound webhooks. EventDigest is delivered, in place
+// of the events it aggregates, to webhooks with an aggregation window.
+const (
+	EventGenerationCreated = "GenerationCreated"
+	EventRolloutCompleted  = "RolloutCompleted"
+	EventDigest            = "Digest"
+)
+
+// Payload formats supported by outbound webhooks. Slack payloads can be
+// posted straight to Slack, and compatible, incoming webhooks.
+const (
+	NotificationFormatJSON  = "json"
+	NotificationFormatSlack = "slack"
+)
+
+// Notification is the body delivered to outbound webhooks. Deployment is only
+// set for EventRolloutCompleted.
+type Notification struct {
+	Event          string    `json:"event"`
+	Namespace      string    `json:"namespace"`
+	Tag            string    `json:"tag"`
+	Generation     int64     `json:"generation"`
+	From           string    `json:"from,omitempty"`
+	ImageReference string    `json:"imageReference,omitempty"`
+	Deployment     string    `json:"deployment,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// Digest is the body delivered to outbound webhooks with an aggregation
+// window, holding all events that happened in the namespace during the
+// window.
+type Digest struct {
+	Event         string         `json:"event"`
+	Namespace     string         `json:"namespace"`
+	Summary       string         `json:"summary"`
+	Notifications []Notification `json:"notifications"`
+	Time          time.Time      `json:"time"`
+}
+
+// slackMessage is the body delivered to outbound webhooks using the slack
+// format.
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// Notifier delivers Tag events to the outbound webhooks registered, through
+// Secrets labeled with NotificationWebhookLabel, in the Tag namespace. This
+// allows external systems, e.g. CD dashboards, to follow Tags. Deliveries
+// happen in the background and failures are only logged, they never fail
+// imports or rollouts. Webhooks with an aggregation window receive a single
+// Digest once the window, started by the first event, ends so busy clusters
+// don't flood chat channels. Events waiting for a window to end are lost if
+// the operator stops. A nil Notifier delivers nothing.
+type Notifier struct {
+	mtx      sync.Mutex
+	sclister corelister.SecretLister
+	client   *http.Client
+	now      func() time.Time
+	after    func(time.Duration, func())
+	batches  map[string][]Notification
+	wg       sync.WaitGroup
+}
+
+// NewNotifier returns a Notifier reading webhooks from the provided lister.
+func NewNotifier(sclister corelister.SecretLister) *Notifier {
+	return &Notifier{
+		sclister: sclister,
+		client:   &http.Client{Timeout: NotificationTimeout},
+		now:      time.Now,
+		after: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+		batches: map[string][]Notification{},
+	}
+}
+
+// GenerationCreated notifies the import of the Tag generation hashref.
+func (n *Notifier) GenerationCreated(it *imagtagv1.Tag, hashref imagtagv1.HashReference) {
+	if n == nil {
+		return
+	}
+	n.notify(Notification{
+		Event:          EventGenerationCreated,
+		Namespace:      it.Namespace,
+		Tag:            it.Name,
+		Generation:     hashref.Generation,
+		From:           hashref.From,
+		ImageReference: hashref.ImageReference,
+		Time:           n.now(),
+	})
+}
+
+// RolloutCompleted notifies the completion of the rollout of the current Tag
+// generation on a Deployment.
+func (n *Notifier) RolloutCompleted(it *imagtagv1.Tag, deployment string) {
+	if n == nil {
+		return
+	}
+	n.notify(Notification{
+		Event:          EventRolloutCompleted,
+		Namespace:      it.Namespace,
+		Tag:            it.Name,
+		Generation:     it.Status.Generation,
+		ImageReference: it.CurrentReferenceForTag(),
+		Deployment:     deployment,
+		Time:           n.now(),
+	})
+}
+
+// notify delivers the notification to all webhooks in its namespace, or keeps
+// it for the Digest of the webhooks with an aggregation window.
+func (n *Notifier) notify(ntf Notification) {
+	if n.sclister == nil {
+		return
+	}
+
+	secrets, err := n.sclister.Secrets(ntf.Namespace).List(
+		labels.SelectorFromSet(labels.Set{NotificationWebhookLabel: "true"}),
+	)
+	if err != nil {
+		klog.Errorf("error listing webhooks for %s: %s", ntf.Namespace, err)
+		return
+	}
+
+	for _, sec := range secrets {
+		window, err := notificationWindow(sec)
+		if err != nil {
+			klog.Errorf("webhook %s/%s not aggregated: %s", sec.Namespace, sec.Name, err)
+		}
+		if window > 0 {
+			n.aggregate(sec, window, ntf)
+			continue
+		}
+
+		n.wg.Add(1)
+		go func(sec *corev1.Secret) {
+			defer n.wg.Done()
+			n.send(sec, ntf.Event, []Notification{ntf})
+		}(sec)
+	}
+}
+
+// aggregate keeps the notification until the window of the webhook registered
+// by sec ends, starting the window if none is running.
+func (n *Notifier) aggregate(sec *corev1.Secret, window time.Duration, ntf Notification) {
+	key := fmt.Sprintf("%s/%s", sec.Namespace, sec.Name)
+
+	n.mtx.Lock()
+	pending, running := n.batches[key]
+	n.batches[key] = append(pending, ntf)
+	n.mtx.Unlock()
+	if running {
+		return
+	}
+
+	n.wg.Add(1)
+	n.after(window, func() {
+		defer n.wg.Done()
+		n.flush(sec.Namespace, sec.Name)
+	})
+}
+
+// flush delivers a Digest with the notifications aggregated for a webhook.
+// The webhook Secret is read again as it may have changed, or be gone, since
+// the window started.
+func (n *Notifier) flush(namespace, name string) {
+	key := fmt.Sprintf("%s/%s", namespace, name)
+
+	n.mtx.Lock()
+	ntfs := n.batches[key]
+	delete(n.batches, key)
+	n.mtx.Unlock()
+
+	sec, err := n.sclister.Secrets(namespace).Get(name)
+	if err != nil {
+		klog.Errorf("dropping %d notifications for webhook %s: %s", len(ntfs), key, err)
+		return
+	}
+	n.send(sec, EventDigest, ntfs)
+}
+
+// send encodes the notifications in the format of the webhook registered by
+// sec and delivers them. Notifications are sent as a Digest if event is
+// EventDigest.
+func (n *Notifier) send(sec *corev1.Secret, event string, ntfs []Notification) {
+	result := "success"
+	body, err := n.encode(sec, event, ntfs)
+	if err == nil {
+		err = n.deliver(sec, body)
+	}
+	if err != nil {
+		klog.Errorf(
+			"error delivering %s to webhook %s/%s: %s",
+			event, sec.Namespace, sec.Name, err,
+		)
+		result = "failure"
+	}
+	metrics.NotificationDeliveries.WithLabelValues(event, result).Inc()
+}
+
+// encode returns the body delivered to the webhook registered by sec.
+func (n *Notifier) encode(sec *corev1.Secret, event string, ntfs []Notification) ([]byte, error) {
+	switch format := string(sec.Data["format"]); format {
+	case "", NotificationFormatJSON:
+		if event != EventDigest {
+			return json.Marshal(ntfs[0])
+		}
+		return json.Marshal(Digest{
+			Event:         EventDigest,
+			Namespace:     sec.Namespace,
+			Summary:       summarizeNotifications(sec.Namespace, ntfs),
+			Notifications: ntfs,
+			Time:          n.now(),
+		})
+	case NotificationFormatSlack:
+		if event != EventDigest {
+			return json.Marshal(slackMessage{Text: describeNotification(ntfs[0])})
+		}
+		lines := []string{summarizeNotifications(sec.Namespace, ntfs)}
+		for _, ntf := range ntfs {
+			lines = append(lines, "• "+describeNotification(ntf))
+		}
+		return json.Marshal(slackMessage{Text: strings.Join(lines, "\n")})
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// notificationWindow returns the aggregation window of the webhook registered
+// by sec, zero if none is set.
+func notificationWindow(sec *corev1.Secret) (time.Duration, error) {
+	value := string(sec.Data["window"])
+	if value == "" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window: %w", err)
+	}
+	if window < 0 {
+		return 0, fmt.Errorf("negative window")
+	}
+	return window, nil
+}
+
+// summarizeNotifications returns a one line summary of the notifications, as
+// in "3 generations imported, 1 rollout completed in default".
+func summarizeNotifications(namespace string, ntfs []Notification) string {
+	var imported, rolledOut int
+	for _, ntf := range ntfs {
+		switch ntf.Event {
+		case EventGenerationCreated:
+			imported++
+		case EventRolloutCompleted:
+			rolledOut++
+		}
+	}
+
+	var parts []string
+	if imported == 1 {
+		parts = append(parts, "1 generation imported")
+	} else if imported > 1 {
+		parts = append(parts, fmt.Sprintf("%d generations imported", imported))
+	}
+	if rolledOut == 1 {
+		parts = append(parts, "1 rollout completed")
+	} else if rolledOut > 1 {
+		parts = append(parts, fmt.Sprintf("%d rollouts completed", rolledOut))
+	}
+	return fmt.Sprintf("%s in %s", strings.Join(parts, ", "), namespace)
+}
+
+// describeNotification returns a human readable description of the event.
+func describeNotification(ntf Notification) string {
+	if ntf.Event == EventRolloutCompleted {
+		return fmt.Sprintf(
+			"%s/%s generation %d rolled out on %s",
+			ntf.Namespace, ntf.Tag, ntf.Generation, ntf.Deployment,
+		)
+	}
+	return fmt.Sprintf(
+		"%s/%s generation %d imported from %s",
+		ntf.Namespace, ntf.Tag, ntf.Generation, ntf.From,
+	)
+}
+
+// deliver posts body to the webhook registered by sec, signing it if the
+// Secret holds a key.
+func (n *Notifier) deliver(sec *corev1.Secret, body []byte) error {
+	url := string(sec.Data["url"])
+	if url == "" {
+		return fmt.Errorf("no url in secret")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), NotificationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key := sec.Data["secret"]; len(key) > 0 {
+		req.Header.Set(NotificationSignatureHeader, "sha256="+SignNotification(key, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// wait blocks until all deliveries in progress are finished.
+func (n *Notifier) wait() {
+	n.wg.Wait()
+}
+
+// SignNotification returns the hex encoded HMAC-SHA256 of body using key, as
+// sent in NotificationSignatureHeader so receivers can verify deliveries.
+func SignNotification(key, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
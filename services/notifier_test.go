@@ -0,0 +1,369 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// delivery is a notification received by a test webhook.
+type delivery struct {
+	path         string
+	signature    string
+	notification Notification
+}
+
+func TestNotifier(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	tag := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "namespace",
+			Name:      "tag",
+		},
+		Status: imagtagv1.TagStatus{
+			Generation: 1,
+			References: []imagtagv1.HashReference{
+				{
+					Generation:     1,
+					From:           "centos:7",
+					ImageReference: "centos@sha256:abc",
+				},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name       string
+		secrets    func(url string) []runtime.Object
+		notify     func(n *Notifier)
+		deliveries []delivery
+	}{
+		{
+			name: "no webhooks",
+			notify: func(n *Notifier) {
+				n.GenerationCreated(tag, tag.Status.References[0])
+			},
+		},
+		{
+			name: "generation created",
+			secrets: func(url string) []runtime.Object {
+				return []runtime.Object{
+					webhookSecret("namespace", "hook", url+"/hook", "key", true),
+					webhookSecret("namespace", "unlabeled", url+"/unlabeled", "", false),
+					webhookSecret("another", "hook", url+"/another", "", true),
+				}
+			},
+			notify: func(n *Notifier) {
+				n.GenerationCreated(tag, tag.Status.References[0])
+			},
+			deliveries: []delivery{
+				{
+					path:      "/hook",
+					signature: "key",
+					notification: Notification{
+						Event:          EventGenerationCreated,
+						Namespace:      "namespace",
+						Tag:            "tag",
+						Generation:     1,
+						From:           "centos:7",
+						ImageReference: "centos@sha256:abc",
+						Time:           now,
+					},
+				},
+			},
+		},
+		{
+			name: "rollout completed",
+			secrets: func(url string) []runtime.Object {
+				return []runtime.Object{
+					webhookSecret("namespace", "hook", url+"/hook", "", true),
+				}
+			},
+			notify: func(n *Notifier) {
+				n.RolloutCompleted(tag, "deploy")
+			},
+			deliveries: []delivery{
+				{
+					path: "/hook",
+					notification: Notification{
+						Event:          EventRolloutCompleted,
+						Namespace:      "namespace",
+						Tag:            "tag",
+						Generation:     1,
+						ImageReference: "centos@sha256:abc",
+						Deployment:     "deploy",
+						Time:           now,
+					},
+				},
+			},
+		},
+		{
+			name: "failing webhook",
+			secrets: func(url string) []runtime.Object {
+				return []runtime.Object{
+					webhookSecret("namespace", "hook", url+"/fail", "", true),
+					webhookSecret("namespace", "nourl", "", "", true),
+				}
+			},
+			notify: func(n *Notifier) {
+				n.RolloutCompleted(tag, "deploy")
+			},
+			deliveries: []delivery{
+				{
+					path: "/fail",
+					notification: Notification{
+						Event:          EventRolloutCompleted,
+						Namespace:      "namespace",
+						Tag:            "tag",
+						Generation:     1,
+						ImageReference: "centos@sha256:abc",
+						Deployment:     "deploy",
+						Time:           now,
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var mtx sync.Mutex
+			var deliveries []delivery
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					body, err := ioutil.ReadAll(r.Body)
+					if err != nil {
+						t.Errorf("unexpected error reading body: %s", err)
+					}
+
+					var ntf Notification
+					if err := json.Unmarshal(body, &ntf); err != nil {
+						t.Errorf("unexpected error decoding body: %s", err)
+					}
+
+					// we record the key that signed the body instead of
+					// the signature itself.
+					signature := r.Header.Get(NotificationSignatureHeader)
+					if signature == "sha256="+SignNotification([]byte("key"), body) {
+						signature = "key"
+					}
+
+					mtx.Lock()
+					deliveries = append(deliveries, delivery{
+						path:         r.URL.Path,
+						signature:    signature,
+						notification: ntf,
+					})
+					mtx.Unlock()
+
+					if r.URL.Path == "/fail" {
+						w.WriteHeader(http.StatusInternalServerError)
+					}
+				},
+			))
+			defer server.Close()
+
+			var objects []runtime.Object
+			if tt.secrets != nil {
+				objects = tt.secrets(server.URL)
+			}
+			corcli := corfake.NewSimpleClientset(objects...)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			seclis := corinf.Core().V1().Secrets().Lister()
+			corinf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				corinf.Core().V1().Secrets().Informer().HasSynced,
+			) {
+				t.Fatal("timeout waiting for caches to sync")
+			}
+
+			notifier := NewNotifier(seclis)
+			notifier.now = func() time.Time { return now }
+			tt.notify(notifier)
+			notifier.wait()
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			for i := range deliveries {
+				deliveries[i].notification.Time = deliveries[i].notification.Time.UTC()
+			}
+			if !reflect.DeepEqual(deliveries, tt.deliveries) {
+				t.Errorf("expected %+v, %+v received", tt.deliveries, deliveries)
+			}
+		})
+	}
+
+	// a nil notifier delivers nothing.
+	var notifier *Notifier
+	notifier.GenerationCreated(tag, tag.Status.References[0])
+	notifier.RolloutCompleted(tag, "deploy")
+}
+
+func webhookSecret(namespace, name, url, key string, labeled bool) *corev1.Secret {
+	sec := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Data: map[string][]byte{},
+	}
+	if labeled {
+		sec.Labels = map[string]string{NotificationWebhookLabel: "true"}
+	}
+	if url != "" {
+		sec.Data["url"] = []byte(url)
+	}
+	if key != "" {
+		sec.Data["secret"] = []byte(key)
+	}
+	return sec
+}
+
+func TestNotifierDigest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	tag := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "namespace",
+			Name:      "tag",
+		},
+		Status: imagtagv1.TagStatus{
+			Generation: 2,
+			References: []imagtagv1.HashReference{
+				{Generation: 2, From: "centos:8", ImageReference: "centos@sha256:def"},
+				{Generation: 1, From: "centos:7", ImageReference: "centos@sha256:abc"},
+			},
+		},
+	}
+
+	var mtx sync.Mutex
+	bodies := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("unexpected error reading body: %s", err)
+			}
+			mtx.Lock()
+			bodies[r.URL.Path] = append(bodies[r.URL.Path], string(body))
+			mtx.Unlock()
+		},
+	))
+	defer server.Close()
+
+	digest := webhookSecret("namespace", "digest", server.URL+"/digest", "", true)
+	digest.Data["window"] = []byte("5m")
+	slack := webhookSecret("namespace", "slack", server.URL+"/slack", "", true)
+	slack.Data["window"] = []byte("5m")
+	slack.Data["format"] = []byte("slack")
+	direct := webhookSecret("namespace", "direct", server.URL+"/direct", "", true)
+	direct.Data["format"] = []byte("slack")
+	invalid := webhookSecret("namespace", "invalid", server.URL+"/invalid", "", true)
+	invalid.Data["window"] = []byte("soon")
+
+	corcli := corfake.NewSimpleClientset(digest, slack, direct, invalid)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	seclis := corinf.Core().V1().Secrets().Lister()
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), corinf.Core().V1().Secrets().Informer().HasSynced) {
+		t.Fatal("timeout waiting for caches to sync")
+	}
+
+	// windows end only when we say so.
+	var windows []func()
+	notifier := NewNotifier(seclis)
+	notifier.now = func() time.Time { return now }
+	notifier.after = func(d time.Duration, f func()) {
+		if d != 5*time.Minute {
+			t.Errorf("expected a 5m window, %s found", d)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		windows = append(windows, f)
+	}
+
+	notifier.GenerationCreated(tag, tag.Status.References[1])
+	notifier.GenerationCreated(tag, tag.Status.References[0])
+	notifier.RolloutCompleted(tag, "deploy")
+
+	mtx.Lock()
+	if len(windows) != 2 {
+		t.Fatalf("expected a window per aggregating webhook, %d found", len(windows))
+	}
+	for _, path := range []string{"/digest", "/slack"} {
+		if len(bodies[path]) != 0 {
+			t.Errorf("%s received notifications before the window ended", path)
+		}
+	}
+	pending := windows
+	mtx.Unlock()
+	for _, end := range pending {
+		end()
+	}
+	notifier.wait()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(bodies["/direct"]) != 3 || len(bodies["/invalid"]) != 3 {
+		t.Errorf("expected every event delivered without a window: %v", bodies)
+	}
+	expected := `{"text":"namespace/tag generation 1 imported from centos:7"}`
+	if !strings.Contains(strings.Join(bodies["/direct"], "\n"), expected) {
+		t.Errorf("expected %s, %v received", expected, bodies["/direct"])
+	}
+
+	if len(bodies["/digest"]) != 1 {
+		t.Fatalf("expected a single digest, %d received", len(bodies["/digest"]))
+	}
+	var received Digest
+	if err := json.Unmarshal([]byte(bodies["/digest"][0]), &received); err != nil {
+		t.Fatalf("unexpected error decoding digest: %s", err)
+	}
+	if received.Event != EventDigest {
+		t.Errorf("expected %s event, %s received", EventDigest, received.Event)
+	}
+	summary := "2 generations imported, 1 rollout completed in namespace"
+	if received.Summary != summary {
+		t.Errorf("expected summary %q, %q received", summary, received.Summary)
+	}
+	if len(received.Notifications) != 3 {
+		t.Errorf("expected 3 notifications, %d received", len(received.Notifications))
+	}
+
+	if len(bodies["/slack"]) != 1 {
+		t.Fatalf("expected a single slack message, %d received", len(bodies["/slack"]))
+	}
+	var msg slackMessage
+	if err := json.Unmarshal([]byte(bodies["/slack"][0]), &msg); err != nil {
+		t.Fatalf("unexpected error decoding slack message: %s", err)
+	}
+	text := strings.Join([]string{
+		summary,
+		"• namespace/tag generation 1 imported from centos:7",
+		"• namespace/tag generation 2 imported from centos:8",
+		"• namespace/tag generation 2 rolled out on deploy",
+	}, "\n")
+	if msg.Text != text {
+		t.Errorf("expected %q, %q received", text, msg.Text)
+	}
+}
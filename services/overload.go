@@ -0,0 +1,175 @@
+package services
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// cgroupMemoryLimits are the files holding the container memory limit, for
+// cgroups v2 and v1.
+var cgroupMemoryLimits = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// ResourceUsage is how much of a resource is in use and the limit for it.
+// A zero limit means the resource is not limited.
+type ResourceUsage struct {
+	Used  uint64
+	Limit uint64
+}
+
+// OverloadError is returned when an import is held back because the
+// operator is close to the limit of a resource.
+type OverloadError struct {
+	Resource  string
+	Threshold float64
+}
+
+// Error returns the error message. Actual usage is left out so the message
+// is the same while the pressure lasts.
+func (o *OverloadError) Error() string {
+	return fmt.Sprintf(
+		"import throttled, %s usage over %.0f%% of the limit",
+		o.Resource, o.Threshold*100,
+	)
+}
+
+// Reason returns the reason used in the Tag Throttled condition.
+func (o *OverloadError) Reason() string {
+	if o.Resource == "files" {
+		return imagtagv1.ReasonFilePressure
+	}
+	return imagtagv1.ReasonMemoryPressure
+}
+
+// Overload admits imports based on the operator resource usage. Once memory,
+// against the container limit, or open files, against the process limit,
+// go over their thresholds new imports of Tags not used by any workload are
+// held back, so the operator is not OOM killed mid copy. Resources without
+// a limit are never considered under pressure.
+type Overload struct {
+	sync.Mutex
+	memThreshold  float64
+	fileThreshold float64
+	memory        func() ResourceUsage
+	files         func() ResourceUsage
+}
+
+// NewOverload returns an overload protection reading the operator resource
+// usage, with the default thresholds.
+func NewOverload() *Overload {
+	cfg := config.Default()
+	return &Overload{
+		memThreshold:  cfg.Overload.MemoryThreshold,
+		fileThreshold: cfg.Overload.FileThreshold,
+		memory:        memoryUsage,
+		files:         fileUsage,
+	}
+}
+
+// ApplyConfig applies the overload thresholds.
+func (o *Overload) ApplyConfig(cfg *config.Config) {
+	o.Lock()
+	defer o.Unlock()
+	o.memThreshold = cfg.Overload.MemoryThreshold
+	o.fileThreshold = cfg.Overload.FileThreshold
+}
+
+// Admit returns an OverloadError if imports of Tags not used by any workload
+// should be held back, nil otherwise.
+func (o *Overload) Admit() *OverloadError {
+	o.Lock()
+	memThreshold, fileThreshold := o.memThreshold, o.fileThreshold
+	o.Unlock()
+
+	for _, check := range []struct {
+		resource  string
+		threshold float64
+		usage     func() ResourceUsage
+	}{
+		{"memory", memThreshold, o.memory},
+		{"files", fileThreshold, o.files},
+	} {
+		if check.threshold == 0 {
+			continue
+		}
+		usage := check.usage()
+		if usage.Limit == 0 {
+			continue
+		}
+		if float64(usage.Used) < check.threshold*float64(usage.Limit) {
+			continue
+		}
+		klog.V(4).Infof("%s usage at %d out of %d", check.resource, usage.Used, usage.Limit)
+		metrics.ThrottledImports.WithLabelValues(check.resource).Inc()
+		return &OverloadError{Resource: check.resource, Threshold: check.threshold}
+	}
+	return nil
+}
+
+// memoryUsage returns the memory obtained from the OS, and not released back
+// to it, by the go runtime and the container memory limit.
+func memoryUsage() ResourceUsage {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return ResourceUsage{
+		Used:  stats.Sys - stats.HeapReleased,
+		Limit: cgroupMemoryLimit(),
+	}
+}
+
+// cgroupMemoryLimit returns the container memory limit, zero if there is
+// none or it can't be read.
+func cgroupMemoryLimit() uint64 {
+	for _, path := range cgroupMemoryLimits {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0
+		}
+		// cgroups v1 reports no limit as a huge number, the
+		// page aligned max int64.
+		if limit >= math.MaxInt64/4096*4096 {
+			return 0
+		}
+		return limit
+	}
+	return 0
+}
+
+// fileUsage returns the number of files open by the process and the open
+// files limit. Files can only be counted where /proc is available.
+func fileUsage() ResourceUsage {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return ResourceUsage{}
+	}
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return ResourceUsage{}
+	}
+	return ResourceUsage{
+		Used:  uint64(len(fds)),
+		Limit: uint64(rlimit.Cur),
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestOverloadAdmit(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		memory    ResourceUsage
+		files     ResourceUsage
+		memThresh float64
+		reason    string
+	}{
+		{
+			name:      "under thresholds",
+			memory:    ResourceUsage{Used: 50, Limit: 100},
+			files:     ResourceUsage{Used: 10, Limit: 1024},
+			memThresh: 0.9,
+		},
+		{
+			name:      "memory pressure",
+			memory:    ResourceUsage{Used: 95, Limit: 100},
+			files:     ResourceUsage{Used: 10, Limit: 1024},
+			memThresh: 0.9,
+			reason:    imagtagv1.ReasonMemoryPressure,
+		},
+		{
+			name:      "file pressure",
+			memory:    ResourceUsage{Used: 50, Limit: 100},
+			files:     ResourceUsage{Used: 1000, Limit: 1024},
+			memThresh: 0.9,
+			reason:    imagtagv1.ReasonFilePressure,
+		},
+		{
+			name:      "no memory limit",
+			memory:    ResourceUsage{Used: 1 << 40},
+			files:     ResourceUsage{Used: 10, Limit: 1024},
+			memThresh: 0.9,
+		},
+		{
+			name:   "memory protection disabled",
+			memory: ResourceUsage{Used: 100, Limit: 100},
+			files:  ResourceUsage{Used: 10, Limit: 1024},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			overload := NewOverload()
+			overload.memory = func() ResourceUsage { return tt.memory }
+			overload.files = func() ResourceUsage { return tt.files }
+
+			cfg := config.Default()
+			cfg.Overload.MemoryThreshold = tt.memThresh
+			overload.ApplyConfig(cfg)
+
+			err := overload.Admit()
+			if err == nil {
+				if len(tt.reason) > 0 {
+					t.Errorf("expected %s, nil received instead", tt.reason)
+				}
+				return
+			}
+			if err.Reason() != tt.reason {
+				t.Errorf("expected reason %q, %q received", tt.reason, err.Reason())
+			}
+		})
+	}
+}
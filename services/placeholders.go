@@ -0,0 +1,178 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/mattbaird/jsonpatch"
+
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// PlaceholdersAnnotation set to "true" on a Deployment makes "$(TAG:<name>)"
+// placeholders, in the environment variable values and in the args of its
+// containers, to be replaced by the image reference of the Tag <name>. Meant
+// for workloads passing images on, e.g. operators launching their own pods.
+const PlaceholdersAnnotation = "image-tag-placeholders"
+
+// placeholderRE matches a "$(TAG:<name>)" placeholder, capturing the Tag name.
+var placeholderRE = regexp.MustCompile(`\$\(TAG:([a-z0-9]([-a-z0-9.]*[a-z0-9])?)\)`)
+
+// placeholdersEnabled returns true if the provided annotations (of a
+// Deployment or of a ReplicaSet) opt in for placeholders.
+func placeholdersEnabled(annotations map[string]string) bool {
+	return annotations[PlaceholdersAnnotation] == "true"
+}
+
+// placeholderTags returns the names of the Tags referred by placeholders in
+// the containers of the pod spec, sorted.
+func placeholderTags(spec corev1.PodSpec) []string {
+	seen := map[string]bool{}
+	collect := func(value string) {
+		for _, match := range placeholderRE.FindAllStringSubmatch(value, -1) {
+			seen[match[1]] = true
+		}
+	}
+	for _, c := range spec.Containers {
+		for _, env := range c.Env {
+			collect(env.Value)
+		}
+		for _, arg := range c.Args {
+			collect(arg)
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deploymentTags returns the Tags used by a Deployment: the ones its container
+// images refer to and, if the Deployment opts in, the ones its placeholders
+// refer to. Each Tag is returned once.
+func deploymentTags(
+	taglis taglist.TagLister, dep *appsv1.Deployment,
+) ([]*imagtagv1.Tag, error) {
+	_, wildcard := tagTriggers(dep.Annotations)
+
+	var tags []*imagtagv1.Tag
+	seen := map[string]bool{}
+	for _, cont := range dep.Spec.Template.Spec.Containers {
+		it, err := tagForImage(taglis, dep.Namespace, cont.Image, wildcard)
+		if err != nil {
+			return nil, err
+		}
+		if it == nil || seen[it.Name] {
+			continue
+		}
+		seen[it.Name] = true
+		tags = append(tags, it)
+	}
+
+	if !placeholdersEnabled(dep.Annotations) {
+		return tags, nil
+	}
+	for _, name := range placeholderTags(dep.Spec.Template.Spec) {
+		if seen[name] {
+			continue
+		}
+		it, err := taglis.Tags(dep.Namespace).Get(name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		seen[name] = true
+		tags = append(tags, it)
+	}
+	return tags, nil
+}
+
+// placeholderPatch returns the patch replacing the placeholders of the pod
+// containers by the references of their Tags, as resolved by resolve. Pods
+// with placeholders that can't be resolved, e.g. for Tags not imported yet,
+// are rejected so no container starts with a placeholder in place of an
+// image reference.
+func placeholderPatch(
+	pod corev1.Pod, resolve func(name string) (string, error),
+) ([]jsonpatch.JsonPatchOperation, error) {
+	refs := map[string]string{}
+	expand := func(value string) (string, error) {
+		return expandPlaceholders(value, func(name string) (string, error) {
+			if ref, ok := refs[name]; ok {
+				return ref, nil
+			}
+			ref, err := resolve(name)
+			if err != nil {
+				return "", err
+			}
+			refs[name] = ref
+			return ref, nil
+		})
+	}
+
+	var patch []jsonpatch.JsonPatchOperation
+	for i, c := range pod.Spec.Containers {
+		for j, env := range c.Env {
+			value, err := expand(env.Value)
+			if err != nil {
+				return nil, err
+			}
+			if value == env.Value {
+				continue
+			}
+			patch = append(patch, jsonpatch.NewPatch(
+				"replace", fmt.Sprintf("/spec/containers/%d/env/%d/value", i, j), value,
+			))
+		}
+		for j, arg := range c.Args {
+			value, err := expand(arg)
+			if err != nil {
+				return nil, err
+			}
+			if value == arg {
+				continue
+			}
+			patch = append(patch, jsonpatch.NewPatch(
+				"replace", fmt.Sprintf("/spec/containers/%d/args/%d", i, j), value,
+			))
+		}
+	}
+	return patch, nil
+}
+
+// expandPlaceholders replaces the placeholders in value by the references of
+// their Tags, as resolved by resolve. Placeholders resolving to an empty
+// reference are reported as an error.
+func expandPlaceholders(value string, resolve func(name string) (string, error)) (string, error) {
+	var rerr error
+	expanded := placeholderRE.ReplaceAllStringFunc(value, func(match string) string {
+		if rerr != nil {
+			return match
+		}
+		name := placeholderRE.FindStringSubmatch(match)[1]
+		ref, err := resolve(name)
+		if err != nil {
+			rerr = err
+			return match
+		}
+		if ref == "" {
+			rerr = fmt.Errorf(
+				"unable to resolve %s: tag not found, disabled or not imported", match,
+			)
+			return match
+		}
+		return ref
+	})
+	return expanded, rerr
+}
@@ -0,0 +1,388 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/mattbaird/jsonpatch"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	taginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestPlaceholderTags(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		spec     corev1.PodSpec
+		expected []string
+	}{
+		{
+			name:     "no containers",
+			expected: []string{},
+		},
+		{
+			name: "env and args",
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Env: []corev1.EnvVar{
+							{Name: "WORKER_IMAGE", Value: "$(TAG:worker)"},
+							{Name: "OTHER", Value: "$(OTHER)"},
+						},
+						Args: []string{"--images=$(TAG:job),$(TAG:worker)"},
+					},
+					{
+						Args: []string{"$(TAG:a.b-c)", "$(TAG:Upper)", "$(TAG:)"},
+					},
+				},
+			},
+			expected: []string{"a.b-c", "job", "worker"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			names := placeholderTags(tt.spec)
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("expected %v, %v received", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestPlaceholderPatch(t *testing.T) {
+	refs := map[string]string{
+		"worker": "quay.io/company/worker@sha256:1",
+		"job":    "quay.io/company/job@sha256:2",
+	}
+
+	for _, tt := range []struct {
+		name       string
+		containers []corev1.Container
+		expected   []jsonpatch.JsonPatchOperation
+		resolves   int
+		err        string
+	}{
+		{
+			name: "no placeholders",
+			containers: []corev1.Container{
+				{
+					Env:  []corev1.EnvVar{{Name: "IMAGE", Value: "TAG:worker"}},
+					Args: []string{"$(worker)"},
+				},
+			},
+		},
+		{
+			name: "resolved",
+			containers: []corev1.Container{
+				{
+					Env: []corev1.EnvVar{
+						{Name: "LEVEL", Value: "debug"},
+						{Name: "WORKER_IMAGE", Value: "$(TAG:worker)"},
+					},
+				},
+				{
+					Args: []string{"run", "--images=$(TAG:worker),$(TAG:job)"},
+				},
+			},
+			resolves: 2,
+			expected: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/env/1/value",
+					Value:     "quay.io/company/worker@sha256:1",
+				},
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/1/args/1",
+					Value:     "--images=quay.io/company/worker@sha256:1,quay.io/company/job@sha256:2",
+				},
+			},
+		},
+		{
+			name: "unresolved",
+			containers: []corev1.Container{
+				{
+					Env: []corev1.EnvVar{{Name: "IMAGE", Value: "$(TAG:missing)"}},
+				},
+			},
+			resolves: 1,
+			err:      "unable to resolve $(TAG:missing)",
+		},
+		{
+			name: "resolve error",
+			containers: []corev1.Container{
+				{Args: []string{"$(TAG:broken)"}},
+			},
+			resolves: 1,
+			err:      "error reading tag",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var resolves int
+			resolve := func(name string) (string, error) {
+				resolves++
+				if name == "broken" {
+					return "", fmt.Errorf("error reading tag")
+				}
+				return refs[name], nil
+			}
+
+			pod := corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}}
+			patch, err := placeholderPatch(pod, resolve)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, %v received", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(patch, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, patch)
+			}
+			if resolves != tt.resolves {
+				t.Errorf("expected %d resolves, %d done", tt.resolves, resolves)
+			}
+		})
+	}
+}
+
+func TestDeploymentTagsPlaceholders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "operator"},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker"},
+		},
+	)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), taginf.Images().V1().Tags().Informer().HasSynced) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	spec := corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Image: "operator",
+				Env: []corev1.EnvVar{
+					{Name: "WORKER_IMAGE", Value: "$(TAG:worker)"},
+					{Name: "OPERATOR_IMAGE", Value: "$(TAG:operator)"},
+					{Name: "MISSING_IMAGE", Value: "$(TAG:missing)"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:        "placeholders disabled",
+			annotations: map[string]string{"image-tag": "true"},
+			expected:    []string{"operator"},
+		},
+		{
+			name: "placeholders enabled",
+			annotations: map[string]string{
+				"image-tag":            "true",
+				PlaceholdersAnnotation: "true",
+			},
+			expected: []string{"operator", "worker"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dep := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "operator",
+					Annotations: tt.annotations,
+				},
+			}
+			dep.Spec.Template.Spec = spec
+
+			tags, err := deploymentTags(taglis, dep)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			names := []string{}
+			for _, it := range tags {
+				names = append(names, it.Name)
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("expected %v, %v received", tt.expected, names)
+			}
+
+			for _, it := range tags {
+				if !usesTag(dep, it, false) {
+					t.Errorf("expected deployment to use tag %s", it.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchForPodPlaceholders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "worker"},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "worker ref"},
+				},
+			},
+		},
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "job"},
+		},
+	)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	corcli := corfake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "enabled",
+				Annotations: map[string]string{
+					"image-tag":            "true",
+					PlaceholdersAnnotation: "true",
+				},
+			},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "pinned",
+				Annotations: map[string]string{
+					"image-tag":            "true",
+					PlaceholdersAnnotation: "true",
+				},
+			},
+			Spec: appsv1.ReplicaSetSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{"worker": "pinned ref"},
+					},
+				},
+			},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "disabled",
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	for _, tt := range []struct {
+		name     string
+		rs       string
+		env      string
+		expected []jsonpatch.JsonPatchOperation
+		err      string
+	}{
+		{
+			name: "current reference",
+			rs:   "enabled",
+			env:  "$(TAG:worker)",
+			expected: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/env/0/value",
+					Value:     "worker ref",
+				},
+			},
+		},
+		{
+			name: "replica set reference",
+			rs:   "pinned",
+			env:  "$(TAG:worker)",
+			expected: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/env/0/value",
+					Value:     "pinned ref",
+				},
+			},
+		},
+		{
+			name: "placeholders disabled",
+			rs:   "disabled",
+			env:  "$(TAG:worker)",
+		},
+		{
+			name: "tag not imported",
+			rs:   "enabled",
+			env:  "$(TAG:job)",
+			err:  "unable to resolve $(TAG:job)",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: "ReplicaSet", Name: tt.rs},
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Image: "centos:8",
+							Env:   []corev1.EnvVar{{Name: "IMAGE", Value: tt.env}},
+						},
+					},
+				},
+			}
+
+			svc := NewTag(corcli, tagcli, taglis, nil, rslist, nil, nil, nil, nil, nil)
+			patch, _, err := svc.PatchForPod(ctx, pod)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, %v received", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(patch, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, patch)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Platform identifies an operating system and architecture, optionally with
+// an architecture variant (e.g. "v8" for arm64).
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ParsePlatform parses a platform in the "os/architecture[/variant]" format.
+func ParsePlatform(platform string) (Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q", platform)
+	}
+
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// String returns the platform in the "os/architecture[/variant]" format.
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
+
+// matches returns true if the provided os, architecture and variant match the
+// platform. Variant is only compared if it is set in the platform.
+func (p Platform) matches(os, arch, variant string) bool {
+	if p.OS != os || p.Architecture != arch {
+		return false
+	}
+	return p.Variant == "" || p.Variant == variant
+}
+
+// matchesAny returns true if os, architecture and variant match any of the
+// platforms.
+func matchesAny(platforms []Platform, os, arch, variant string) bool {
+	for _, p := range platforms {
+		if p.matches(os, arch, variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterManifestList returns the manifest list in blob with only the instances
+// matching the provided platforms. Blobs that are not manifest lists, or all
+// blobs if no platform is provided, are returned untouched.
+func FilterManifestList(blob []byte, mime string, platforms []Platform) ([]byte, error) {
+	if len(platforms) == 0 || !manifest.MIMETypeIsMultiImage(mime) {
+		return blob, nil
+	}
+
+	var list manifest.List
+	var kept int
+	switch manifest.NormalizedMIMEType(mime) {
+	case manifest.DockerV2ListMediaType:
+		schema2, err := manifest.Schema2ListFromManifest(blob)
+		if err != nil {
+			return nil, err
+		}
+		var manifests []manifest.Schema2ManifestDescriptor
+		for _, m := range schema2.Manifests {
+			if matchesAny(platforms, m.Platform.OS, m.Platform.Architecture, m.Platform.Variant) {
+				manifests = append(manifests, m)
+			}
+		}
+		schema2.Manifests = manifests
+		list, kept = schema2, len(manifests)
+	case imgspecv1.MediaTypeImageIndex:
+		index, err := manifest.OCI1IndexFromManifest(blob)
+		if err != nil {
+			return nil, err
+		}
+		var manifests []imgspecv1.Descriptor
+		for _, m := range index.Manifests {
+			if m.Platform == nil {
+				continue
+			}
+			if matchesAny(platforms, m.Platform.OS, m.Platform.Architecture, m.Platform.Variant) {
+				manifests = append(manifests, m)
+			}
+		}
+		index.Manifests = manifests
+		list, kept = index, len(manifests)
+	default:
+		return nil, &MediaTypeError{MediaType: mime}
+	}
+
+	if kept == 0 {
+		return nil, fmt.Errorf("no image for platforms %v", platforms)
+	}
+	return list.Serialize()
+}
+
+// PlatformFilter wraps image references so manifest lists read from them only
+// contain the instances for a set of platforms. Copying from these references
+// mirrors only the images for these platforms and writes a valid manifest list
+// containing only them.
+type PlatformFilter struct {
+	platforms []Platform
+}
+
+// NewPlatformFilter returns a filter for the provided platforms.
+func NewPlatformFilter(platforms []Platform) *PlatformFilter {
+	return &PlatformFilter{platforms: platforms}
+}
+
+// ImageReference wraps provided image reference. If the filter has no
+// platforms the reference is returned as is.
+func (f *PlatformFilter) ImageReference(ref types.ImageReference) types.ImageReference {
+	if len(f.platforms) == 0 {
+		return ref
+	}
+	return &platformReference{ImageReference: ref, platforms: f.platforms}
+}
+
+// platformReference is an image reference whose image sources are wrapped
+// by a platformSource.
+type platformReference struct {
+	types.ImageReference
+	platforms []Platform
+}
+
+// NewImageSource returns an image source whose manifest lists are filtered.
+func (r *platformReference) NewImageSource(
+	ctx context.Context, sys *types.SystemContext,
+) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &platformSource{ImageSource: src, platforms: r.platforms}, nil
+}
+
+// platformSource is an image source whose top level manifest, if a list, is
+// filtered by platforms.
+type platformSource struct {
+	types.ImageSource
+	platforms []Platform
+}
+
+// GetManifest returns the manifest. Top level manifest lists only contain the
+// instances for the filtered platforms. If the source is referred by digest
+// the upstream manifest is verified against it before being filtered.
+func (s *platformSource) GetManifest(
+	ctx context.Context, instance *digest.Digest,
+) ([]byte, string, error) {
+	blob, mime, err := s.ImageSource.GetManifest(ctx, instance)
+	if err != nil || instance != nil {
+		return blob, mime, err
+	}
+
+	named := s.ImageSource.Reference().DockerReference()
+	if canonical, ok := named.(reference.Canonical); ok {
+		matches, err := manifest.MatchesDigest(blob, canonical.Digest())
+		if err != nil {
+			return nil, "", err
+		}
+		if !matches {
+			return nil, "", &DigestMismatchError{
+				Expected: canonical.Digest().String(),
+				Found:    digest.FromBytes(blob).String(),
+			}
+		}
+	}
+
+	filtered, err := FilterManifestList(blob, mime, s.platforms)
+	if err != nil {
+		return nil, "", err
+	}
+	return filtered, mime, nil
+}
+
+// Reference returns the source reference without its digest. The image
+// library verifies top level manifests against the digest in the reference,
+// a filtered list does not match it as it is not the upstream one.
+func (s *platformSource) Reference() types.ImageReference {
+	return &digestlessReference{ImageReference: s.ImageSource.Reference()}
+}
+
+// digestlessReference is an image reference whose docker reference has no
+// digest.
+type digestlessReference struct {
+	types.ImageReference
+}
+
+// DockerReference returns the docker reference without its digest.
+func (r *digestlessReference) DockerReference() reference.Named {
+	named := r.ImageReference.DockerReference()
+	if _, ok := named.(reference.Canonical); !ok {
+		return named
+	}
+	return reference.TrimNamed(named)
+}
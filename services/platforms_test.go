@@ -0,0 +1,167 @@
+package services
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for _, tt := range []struct {
+		platform string
+		expected Platform
+		err      string
+	}{
+		{
+			platform: "linux/amd64",
+			expected: Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			platform: "linux/arm64/v8",
+			expected: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		},
+		{
+			platform: "amd64",
+			err:      "invalid platform",
+		},
+		{
+			platform: "linux/",
+			err:      "invalid platform",
+		},
+		{
+			platform: "linux/arm/v7/extra",
+			err:      "invalid platform",
+		},
+	} {
+		t.Run(tt.platform, func(t *testing.T) {
+			platform, err := ParsePlatform(tt.platform)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			if platform != tt.expected {
+				t.Errorf("expected %+v, %+v received", tt.expected, platform)
+			}
+			if platform.String() != tt.platform {
+				t.Errorf("expected %q, %q received", tt.platform, platform.String())
+			}
+		})
+	}
+}
+
+func TestFilterManifestList(t *testing.T) {
+	schema2 := `{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests": [
+			{"digest": "sha256:amd64", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:arm64", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+			{"digest": "sha256:ppc64le", "platform": {"os": "linux", "architecture": "ppc64le"}}
+		]
+	}`
+	oci := `{
+		"schemaVersion": 2,
+		"manifests": [
+			{"digest": "sha256:amd64", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:attestation"},
+			{"digest": "sha256:arm", "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}}
+		]
+	}`
+
+	for _, tt := range []struct {
+		name      string
+		blob      string
+		mime      string
+		platforms []string
+		expected  []string
+		err       string
+	}{
+		{
+			name:      "schema2 list",
+			blob:      schema2,
+			mime:      manifest.DockerV2ListMediaType,
+			platforms: []string{"linux/amd64", "linux/arm64"},
+			expected:  []string{"sha256:amd64", "sha256:arm64"},
+		},
+		{
+			name:      "schema2 list with variant",
+			blob:      schema2,
+			mime:      manifest.DockerV2ListMediaType,
+			platforms: []string{"linux/arm64/v7"},
+			err:       "no image for platforms",
+		},
+		{
+			name:      "oci index",
+			blob:      oci,
+			mime:      imgspecv1.MediaTypeImageIndex,
+			platforms: []string{"linux/arm/v7"},
+			expected:  []string{"sha256:arm"},
+		},
+		{
+			name:     "no platforms",
+			blob:     oci,
+			mime:     imgspecv1.MediaTypeImageIndex,
+			expected: []string{"sha256:amd64", "sha256:attestation", "sha256:arm"},
+		},
+		{
+			name:      "not a list",
+			blob:      `{"schemaVersion": 2, "manifests": [{"digest": "sha256:other"}]}`,
+			mime:      manifest.DockerV2Schema2MediaType,
+			platforms: []string{"linux/amd64"},
+			expected:  []string{"sha256:other"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var platforms []Platform
+			for _, p := range tt.platforms {
+				platform, err := ParsePlatform(p)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				platforms = append(platforms, platform)
+			}
+
+			blob, err := FilterManifestList([]byte(tt.blob), tt.mime, platforms)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			var list struct {
+				Manifests []struct {
+					Digest string `json:"digest"`
+				} `json:"manifests"`
+			}
+			if err := json.Unmarshal(blob, &list); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var digests []string
+			for _, m := range list.Manifests {
+				digests = append(digests, m.Digest)
+			}
+			if !reflect.DeepEqual(digests, tt.expected) {
+				t.Errorf("expected %v, %v received", tt.expected, digests)
+			}
+		})
+	}
+}
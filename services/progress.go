@@ -0,0 +1,276 @@
+package services
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// blobProgress holds how much of a blob has already been read.
+type blobProgress struct {
+	size int64
+	read int64
+	done bool
+}
+
+// progressSnapshot is the progress waiting to be handed over to flush.
+type progressSnapshot struct {
+	uploads  []imagtagv1.BlobUpload
+	progress imagtagv1.CopyProgress
+}
+
+// ImportProgress keeps track of an import progress: blobs read from the source
+// registry and uploads to the cache registry. Progress is handed over to the
+// flush function at most once per interval so we don't overload the api server
+// with updates while layers are being copied. Flush is called by a single
+// goroutine, without holding the lock, so a slow flush never stalls the copy;
+// if it lags behind only the latest progress is flushed. All methods are no-op
+// when called on a nil ImportProgress.
+type ImportProgress struct {
+	mtx         sync.Mutex
+	uploads     map[string]*imagtagv1.BlobUpload
+	previous    map[string]imagtagv1.BlobUpload
+	blobs       map[string]*blobProgress
+	layersTotal int
+	bytesTotal  int64
+	started     time.Time
+	flush       func([]imagtagv1.BlobUpload, imagtagv1.CopyProgress)
+	interval    time.Duration
+	last        time.Time
+	pending     *progressSnapshot
+	wake        chan struct{}
+	done        chan struct{}
+	closed      bool
+}
+
+// NewImportProgress returns an import progress tracker that calls flush with
+// the current progress at most once every interval. Callers must Close it once
+// the import is over.
+func NewImportProgress(
+	interval time.Duration,
+	flush func([]imagtagv1.BlobUpload, imagtagv1.CopyProgress),
+) *ImportProgress {
+	return &ImportProgress{
+		uploads:  map[string]*imagtagv1.BlobUpload{},
+		previous: map[string]imagtagv1.BlobUpload{},
+		blobs:    map[string]*blobProgress{},
+		started:  time.Now(),
+		flush:    flush,
+		interval: interval,
+	}
+}
+
+// SetTotals sets the number of layers and bytes expected to be copied.
+func (p *ImportProgress) SetTotals(layers int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.layersTotal = layers
+	p.bytesTotal = bytes
+}
+
+// Read records that n bytes have been read from the blob with the provided
+// digest and size. Once done is true the blob has been fully read.
+func (p *ImportProgress) Read(digest string, size, n int64, done bool) {
+	if p == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	blob, ok := p.blobs[digest]
+	if !ok {
+		blob = &blobProgress{size: size}
+		p.blobs[digest] = blob
+	}
+	blob.read += n
+	blob.done = blob.done || done
+	p.maybeFlush(false)
+}
+
+// Resume sets the uploads recorded by a previous, interrupted, import so the
+// uploads of the same blobs are resumed instead of started over.
+func (p *ImportProgress) Resume(uploads []imagtagv1.BlobUpload) {
+	if p == nil {
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, upload := range uploads {
+		if upload.Location == "" {
+			continue
+		}
+		p.previous[upload.Digest] = upload
+	}
+}
+
+// ResumeLocation returns the location of the upload of the blob with the
+// provided digest left by a previous import, empty if there is none.
+func (p *ImportProgress) ResumeLocation(digest string) string {
+	if p == nil {
+		return ""
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.previous[digest].Location
+}
+
+// Uploaded records that uploaded bytes out of size have been sent for blob
+// with the provided digest to the upload in location. If resumed is true the
+// upload has been resumed after a failure.
+func (p *ImportProgress) Uploaded(
+	digest, location string, uploaded, size int64, resumed bool,
+) {
+	if p == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	upload, ok := p.uploads[digest]
+	if !ok {
+		upload = &imagtagv1.BlobUpload{
+			Digest:  digest,
+			Resumes: p.previous[digest].Resumes,
+		}
+		p.uploads[digest] = upload
+	}
+	upload.Size = size
+	upload.Uploaded = uploaded
+	upload.Location = location
+	if resumed {
+		upload.Resumes++
+	}
+	p.maybeFlush(resumed)
+}
+
+// Snapshot returns the current uploads and copy progress, e.g. to be recorded
+// when the import fails.
+func (p *ImportProgress) Snapshot() ([]imagtagv1.BlobUpload, imagtagv1.CopyProgress) {
+	if p == nil {
+		return nil, imagtagv1.CopyProgress{}
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.uploadsSnapshot(), p.copyProgress()
+}
+
+// Close stops flushing the progress. If a flush is pending, or running, Close
+// waits for it to finish. Progress recorded afterwards is not flushed.
+func (p *ImportProgress) Close() {
+	if p == nil {
+		return
+	}
+
+	p.mtx.Lock()
+	if p.closed {
+		p.mtx.Unlock()
+		return
+	}
+	p.closed = true
+	wake, done := p.wake, p.done
+	p.mtx.Unlock()
+
+	if wake == nil {
+		return
+	}
+	close(wake)
+	<-done
+}
+
+// maybeFlush hands the current progress over to the flusher if interval has
+// elapsed since the last time or if force is true. The flusher is started on
+// the first call. Must be called with the lock held.
+func (p *ImportProgress) maybeFlush(force bool) {
+	if p.closed || (time.Since(p.last) < p.interval && !force) {
+		return
+	}
+	p.last = time.Now()
+	p.pending = &progressSnapshot{
+		uploads:  p.uploadsSnapshot(),
+		progress: p.copyProgress(),
+	}
+
+	if p.wake == nil {
+		p.wake = make(chan struct{}, 1)
+		p.done = make(chan struct{})
+		go p.flusher(p.wake, p.done)
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flusher calls flush with the pending progress every time it is woken up,
+// until wake is closed. Done is closed once it returns.
+func (p *ImportProgress) flusher(wake, done chan struct{}) {
+	defer close(done)
+	for range wake {
+		p.mtx.Lock()
+		pending := p.pending
+		p.pending = nil
+		p.mtx.Unlock()
+
+		if pending != nil {
+			p.flush(pending.uploads, pending.progress)
+		}
+	}
+}
+
+// uploadsSnapshot returns the uploads sorted by digest. Must be called with
+// the lock held.
+func (p *ImportProgress) uploadsSnapshot() []imagtagv1.BlobUpload {
+	uploads := make([]imagtagv1.BlobUpload, 0, len(p.uploads))
+	for _, upload := range p.uploads {
+		uploads = append(uploads, *upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Digest < uploads[j].Digest
+	})
+	return uploads
+}
+
+// copyProgress summarizes the copy progress. Totals are never lower than what
+// has been seen so far as for multi architecture images we only know the
+// totals for one of the images in advance. Must be called with the lock held.
+func (p *ImportProgress) copyProgress() imagtagv1.CopyProgress {
+	prog := imagtagv1.CopyProgress{
+		LayersTotal: p.layersTotal,
+		BytesTotal:  p.bytesTotal,
+		UpdatedAt:   metav1.Now(),
+	}
+
+	var seen int64
+	for _, blob := range p.blobs {
+		prog.BytesCopied += blob.read
+		if blob.size > 0 {
+			seen += blob.size
+		}
+		if blob.done {
+			prog.LayersDone++
+		}
+	}
+	if len(p.blobs) > prog.LayersTotal {
+		prog.LayersTotal = len(p.blobs)
+	}
+	if seen > prog.BytesTotal {
+		prog.BytesTotal = seen
+	}
+
+	elapsed := time.Since(p.started)
+	if prog.BytesCopied > 0 && prog.BytesTotal > prog.BytesCopied {
+		remaining := prog.BytesTotal - prog.BytesCopied
+		eta := time.Duration(float64(elapsed) / float64(prog.BytesCopied) * float64(remaining))
+		prog.ETA = &metav1.Duration{Duration: eta.Round(time.Second)}
+	}
+	return prog
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestImportProgress(t *testing.T) {
+	var flushes int
+	var last imagtagv1.CopyProgress
+	progress := NewImportProgress(
+		time.Hour,
+		func(_ []imagtagv1.BlobUpload, p imagtagv1.CopyProgress) {
+			flushes++
+			last = p
+		},
+	)
+	progress.started = time.Now().Add(-10 * time.Second)
+	progress.SetTotals(2, 200)
+
+	// the first read is always flushed, the following ones are only
+	// flushed after the interval.
+	progress.Read("sha256:a", 100, 100, true)
+	progress.Read("sha256:b", 100, 50, false)
+	progress.Close()
+	if flushes != 1 {
+		t.Errorf("expected 1 flush, %d found", flushes)
+	}
+
+	progress.mtx.Lock()
+	prog := progress.copyProgress()
+	progress.mtx.Unlock()
+
+	if prog.BytesCopied != 150 || prog.BytesTotal != 200 {
+		t.Errorf("unexpected bytes: %+v", prog)
+	}
+	if prog.LayersDone != 1 || prog.LayersTotal != 2 {
+		t.Errorf("unexpected layers: %+v", prog)
+	}
+	if prog.ETA == nil {
+		t.Fatalf("expected eta to be set")
+	}
+	if prog.ETA.Duration < 3*time.Second || prog.ETA.Duration > 4*time.Second {
+		t.Errorf("unexpected eta: %v", prog.ETA.Duration)
+	}
+	if last.BytesCopied != 100 {
+		t.Errorf("unexpected flushed progress: %+v", last)
+	}
+
+	// blobs beyond the known totals (e.g. multi arch images) grow them.
+	progress.Read("sha256:c", 100, 100, true)
+	progress.mtx.Lock()
+	prog = progress.copyProgress()
+	progress.mtx.Unlock()
+	if prog.LayersTotal != 3 || prog.BytesTotal != 300 {
+		t.Errorf("totals not updated: %+v", prog)
+	}
+}
+
+func TestImportProgressNil(t *testing.T) {
+	var progress *ImportProgress
+	progress.SetTotals(1, 1)
+	progress.Read("sha256:a", 1, 1, true)
+	progress.Uploaded("sha256:a", "/upload", 1, 1, false)
+	progress.Resume([]imagtagv1.BlobUpload{{Digest: "sha256:a", Location: "/upload"}})
+	if loc := progress.ResumeLocation("sha256:a"); loc != "" {
+		t.Errorf("unexpected resume location %q", loc)
+	}
+	progress.Snapshot()
+	progress.Close()
+}
+
+func TestImportProgressSlowFlush(t *testing.T) {
+	var flushed []imagtagv1.CopyProgress
+	block := make(chan struct{})
+	progress := NewImportProgress(
+		0,
+		func(_ []imagtagv1.BlobUpload, p imagtagv1.CopyProgress) {
+			<-block
+			flushed = append(flushed, p)
+		},
+	)
+
+	// reads go on while the first flush is blocked, only the progress
+	// after the last one is flushed once it is released.
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for i := 0; i < 10; i++ {
+			progress.Read("sha256:a", 10, 1, i == 9)
+		}
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reads blocked by flush")
+	}
+	close(block)
+	progress.Close()
+
+	if len(flushed) == 0 || len(flushed) > 2 {
+		t.Fatalf("expected 1 or 2 flushes, %d found", len(flushed))
+	}
+	if last := flushed[len(flushed)-1]; last.BytesCopied != 10 || last.LayersDone != 1 {
+		t.Errorf("unexpected last flushed progress: %+v", last)
+	}
+
+	// progress recorded after closing is not flushed.
+	flushes := len(flushed)
+	progress.Read("sha256:b", 10, 10, true)
+	if len(flushed) != flushes {
+		t.Errorf("progress flushed after close")
+	}
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// ProjectedLabels returns the image labels, among the provided ones, that
+// are projected onto Tags by the configured projections.
+func ProjectedLabels(
+	lbls map[string]string, projections []config.LabelProjection,
+) map[string]string {
+	var projected map[string]string
+	for _, proj := range projections {
+		value, ok := lbls[proj.ImageLabel]
+		if !ok {
+			continue
+		}
+		if projected == nil {
+			projected = map[string]string{}
+		}
+		projected[proj.ImageLabel] = value
+	}
+	return projected
+}
+
+// ProjectImageLabels sets the labels and annotations of a Tag according to
+// the image labels recorded for its current generation. Projected keys are
+// removed if the current generation image does not carry the image label.
+// Values that are not valid label values (e.g. URLs) are only projected as
+// annotations. Returns true if the Tag has been changed.
+func ProjectImageLabels(
+	it *imagtagv1.Tag, projections []config.LabelProjection,
+) bool {
+	hashref, ok := it.CurrentHashReference()
+	if !ok {
+		return false
+	}
+
+	changed := false
+	for _, proj := range projections {
+		value, found := hashref.ImageLabels[proj.ImageLabel]
+		target := &it.Labels
+		key := proj.Label
+		if proj.Annotation != "" {
+			target = &it.Annotations
+			key = proj.Annotation
+		}
+
+		if found && proj.Label != "" {
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				klog.V(2).Infof(
+					"unable to project %s onto %s/%s: %v",
+					proj.ImageLabel, it.Namespace, it.Name, errs,
+				)
+				found = false
+			}
+		}
+
+		current, exists := (*target)[key]
+		if !found {
+			if exists {
+				delete(*target, key)
+				changed = true
+			}
+			continue
+		}
+		if exists && current == value {
+			continue
+		}
+		if *target == nil {
+			*target = map[string]string{}
+		}
+		(*target)[key] = value
+		changed = true
+	}
+	return changed
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestProjectedLabels(t *testing.T) {
+	projections := []config.LabelProjection{
+		{
+			ImageLabel: "org.opencontainers.image.revision",
+			Label:      "images.io/revision",
+		},
+		{
+			ImageLabel: "org.opencontainers.image.source",
+			Annotation: "images.io/source",
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		lbls     map[string]string
+		expected map[string]string
+	}{
+		{
+			name: "no labels",
+		},
+		{
+			name: "unprojected labels",
+			lbls: map[string]string{"maintainer": "me"},
+		},
+		{
+			name: "projected and unprojected labels",
+			lbls: map[string]string{
+				"maintainer":                        "me",
+				"org.opencontainers.image.revision": "abc123",
+			},
+			expected: map[string]string{
+				"org.opencontainers.image.revision": "abc123",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			projected := ProjectedLabels(tt.lbls, projections)
+			if !reflect.DeepEqual(projected, tt.expected) {
+				t.Errorf("expected %v, received %v", tt.expected, projected)
+			}
+		})
+	}
+}
+
+func TestProjectImageLabels(t *testing.T) {
+	projections := []config.LabelProjection{
+		{
+			ImageLabel: "org.opencontainers.image.revision",
+			Label:      "images.io/revision",
+		},
+		{
+			ImageLabel: "org.opencontainers.image.source",
+			Annotation: "images.io/source",
+		},
+		{
+			ImageLabel: "build-url",
+			Label:      "images.io/build",
+		},
+	}
+
+	newTag := func(lbls, annotations, imglbls map[string]string) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "mytag",
+				Namespace:   "prod",
+				Labels:      lbls,
+				Annotations: annotations,
+			},
+			Status: imagtagv1.TagStatus{
+				Generation: 1,
+				References: []imagtagv1.HashReference{
+					{
+						Generation: 2,
+						ImageLabels: map[string]string{
+							"org.opencontainers.image.revision": "next",
+						},
+					},
+					{
+						Generation:  1,
+						ImageLabels: imglbls,
+					},
+				},
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name        string
+		tag         *imagtagv1.Tag
+		changed     bool
+		labels      map[string]string
+		annotations map[string]string
+	}{
+		{
+			name: "current generation not imported",
+			tag: &imagtagv1.Tag{
+				Status: imagtagv1.TagStatus{Generation: 1},
+			},
+		},
+		{
+			name: "nothing to project",
+			tag:  newTag(nil, nil, nil),
+		},
+		{
+			name: "label and annotation projected",
+			tag: newTag(
+				map[string]string{"app": "web"},
+				nil,
+				map[string]string{
+					"org.opencontainers.image.revision": "abc123",
+					"org.opencontainers.image.source":   "https://github.com/org/repo",
+				},
+			),
+			changed: true,
+			labels: map[string]string{
+				"app":                "web",
+				"images.io/revision": "abc123",
+			},
+			annotations: map[string]string{
+				"images.io/source": "https://github.com/org/repo",
+			},
+		},
+		{
+			name: "already projected",
+			tag: newTag(
+				map[string]string{"images.io/revision": "abc123"},
+				nil,
+				map[string]string{
+					"org.opencontainers.image.revision": "abc123",
+				},
+			),
+			labels: map[string]string{"images.io/revision": "abc123"},
+		},
+		{
+			name: "projection updated",
+			tag: newTag(
+				map[string]string{"images.io/revision": "abc123"},
+				nil,
+				map[string]string{
+					"org.opencontainers.image.revision": "def456",
+				},
+			),
+			changed: true,
+			labels:  map[string]string{"images.io/revision": "def456"},
+		},
+		{
+			name: "projection removed",
+			tag: newTag(
+				map[string]string{"images.io/revision": "abc123"},
+				map[string]string{"images.io/source": "https://github.com/org/repo"},
+				nil,
+			),
+			changed:     true,
+			labels:      map[string]string{},
+			annotations: map[string]string{},
+		},
+		{
+			name: "invalid label value",
+			tag: newTag(
+				nil,
+				nil,
+				map[string]string{
+					"build-url": "https://ci.example.com/build/1",
+				},
+			),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := ProjectImageLabels(tt.tag, projections)
+			if changed != tt.changed {
+				t.Errorf("expected changed %v, received %v", tt.changed, changed)
+			}
+			if !reflect.DeepEqual(tt.tag.Labels, tt.labels) {
+				t.Errorf("expected labels %v, received %v", tt.labels, tt.tag.Labels)
+			}
+			if !reflect.DeepEqual(tt.tag.Annotations, tt.annotations) {
+				t.Errorf(
+					"expected annotations %v, received %v",
+					tt.annotations, tt.tag.Annotations,
+				)
+			}
+		})
+	}
+}
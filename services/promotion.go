@@ -0,0 +1,240 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// Promotion decides when a new generation becomes the current generation for
+// Tags with a promotion policy. A new generation stays pending until it has
+// soaked for the policy soak time, then it is promoted (becomes active). Tags
+// that are members of a TagSet are only promoted once the other members with
+// a new generation may be promoted as well.
+type Promotion struct {
+	taglis taglist.TagLister
+	tslis  taglist.TagSetLister
+	now    func() time.Time
+}
+
+// NewPromotion returns a promotion handler. The Tag lister is used to look up
+// Tags in canary namespaces and TagSet members, the TagSet lister to find the
+// sets a Tag belongs to. If the TagSet lister is nil TagSets are ignored.
+func NewPromotion(taglis taglist.TagLister, tslis taglist.TagSetLister) *Promotion {
+	return &Promotion{
+		taglis: taglis,
+		tslis:  tslis,
+		now:    time.Now,
+	}
+}
+
+// Promote moves the generation in spec to the current generation if it may
+// be promoted, otherwise its pending state is recorded in the Tag status.
+// Downgrades, first imports and Tags without a promotion policy are always
+// promoted unless they are part of a TagSet still waiting for other members.
+// Downgrades and first imports are never held by TagSets. Returns true if the
+// Tag status has been changed.
+func (p *Promotion) Promote(it *imagtagv1.Tag) (bool, error) {
+	_, hasCurrent := it.CurrentHashReference()
+	downgrade := it.Spec.Generation < it.Status.Generation
+	if !hasCurrent || downgrade {
+		it.RegisterPromotion()
+		return true, nil
+	}
+
+	since, msg, err := p.promotable(it)
+	if err != nil {
+		return false, err
+	}
+	if msg != "" {
+		return it.RegisterPromotionPending(since, msg), nil
+	}
+
+	if msg, err = p.setPending(it); err != nil {
+		return false, err
+	}
+	if msg != "" {
+		return it.RegisterPromotionPending(nil, msg), nil
+	}
+
+	it.RegisterPromotion()
+	return true, nil
+}
+
+// promotable decides if the generation in spec may be promoted considering
+// only the Tag own promotion policy. If it may not be promoted yet a message
+// explaining why is returned together with the time its soak started, if
+// it has started.
+func (p *Promotion) promotable(it *imagtagv1.Tag) (*metav1.Time, string, error) {
+	policy := it.Spec.Promotion
+	if policy == nil {
+		return nil, "", nil
+	}
+
+	hashref, ok := it.SpecHashReference()
+	if !ok {
+		return nil, "", fmt.Errorf("generation %d not imported", it.Spec.Generation)
+	}
+
+	since, msg, err := p.soakStart(it, hashref)
+	if err != nil {
+		return nil, "", err
+	}
+	if since == nil {
+		return nil, msg, nil
+	}
+
+	until := since.Add(policy.SoakTime.Duration)
+	if p.now().Before(until) {
+		msg = fmt.Sprintf("soaking until %s", until.UTC().Format(time.RFC3339))
+		return since, msg, nil
+	}
+	return nil, "", nil
+}
+
+// setPending checks the TagSets the Tag is a member of. Every other member
+// with a generation pending promotion must be promotable for the Tag to be
+// promoted, otherwise a message naming the member holding the set back is
+// returned.
+func (p *Promotion) setPending(it *imagtagv1.Tag) (string, error) {
+	if p.tslis == nil {
+		return "", nil
+	}
+
+	sets, err := p.tslis.TagSets(it.Namespace).List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Name < sets[j].Name
+	})
+	for _, ts := range sets {
+		if !ts.Contains(it.Name) {
+			continue
+		}
+
+		for _, name := range ts.Spec.Tags {
+			if name == it.Name {
+				continue
+			}
+
+			member, err := p.taglis.Tags(it.Namespace).Get(name)
+			if err != nil {
+				if errors.IsNotFound(err) {
+					return fmt.Sprintf("tag set %s: tag %s not found", ts.Name, name), nil
+				}
+				return "", err
+			}
+			if member.Spec.Generation == member.Status.Generation {
+				continue
+			}
+			if _, hasCurrent := member.CurrentHashReference(); !hasCurrent {
+				continue
+			}
+			if !member.SpecTagImported() {
+				msg := fmt.Sprintf(
+					"tag set %s: waiting for tag %s generation %d import",
+					ts.Name, name, member.Spec.Generation,
+				)
+				return msg, nil
+			}
+
+			_, msg, err := p.promotable(member)
+			if err != nil {
+				return "", err
+			}
+			if msg != "" {
+				return fmt.Sprintf("tag set %s: waiting for tag %s, %s", ts.Name, name, msg), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// soakStart returns when the soak of the provided reference started. Without
+// a canary namespace the soak starts when the reference is imported, with a
+// canary namespace it starts when the Tag with the same name in the canary
+// namespace has rolled out the same image. Returns nil if the soak has not
+// started yet, in this case the message explains why.
+func (p *Promotion) soakStart(
+	it *imagtagv1.Tag, hashref imagtagv1.HashReference,
+) (*metav1.Time, string, error) {
+	canaryns := it.Spec.Promotion.CanaryNamespace
+	if canaryns == "" {
+		since := hashref.ImportedAt
+		return &since, "", nil
+	}
+
+	canary, err := p.taglis.Tags(canaryns).Get(it.Name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Sprintf("canary tag %s/%s not found", canaryns, it.Name), nil
+		}
+		return nil, "", err
+	}
+
+	canaryref, ok := canary.CurrentHashReference()
+	if !ok || referenceDigest(canaryref.ImageReference) != referenceDigest(hashref.ImageReference) {
+		return nil, fmt.Sprintf("waiting for canary %s/%s to use the image", canaryns, it.Name), nil
+	}
+
+	// canaries verifying their promotions must succeed, the soak starts
+	// once they do.
+	if policy := canary.Spec.Promotion; policy != nil && policy.VerifyWindow.Duration > 0 {
+		since, msg := canaryVerified(canary)
+		return since, msg, nil
+	}
+
+	cond := meta.FindStatusCondition(canary.Status.Conditions, imagtagv1.ConditionRolledOut)
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		return nil, fmt.Sprintf("waiting for canary %s/%s to roll out", canaryns, it.Name), nil
+	}
+	since := cond.LastTransitionTime
+	return &since, "", nil
+}
+
+// canaryVerified returns when the canary promotion of its current generation
+// succeeded. Returns nil if it has not succeeded, in this case the message
+// explains why.
+func canaryVerified(canary *imagtagv1.Tag) (*metav1.Time, string) {
+	promotion := canary.Status.Promotion
+	if promotion == nil || promotion.Generation != canary.Status.Generation {
+		msg := fmt.Sprintf("waiting for canary %s/%s to be verified", canary.Namespace, canary.Name)
+		return nil, msg
+	}
+
+	switch promotion.Phase {
+	case imagtagv1.PromotionSucceeded:
+		return promotion.VerifiedAt, ""
+	case imagtagv1.PromotionFailed:
+		msg := fmt.Sprintf(
+			"canary %s/%s failed verification: %s",
+			canary.Namespace, canary.Name, promotion.Message,
+		)
+		return nil, msg
+	default:
+		msg := fmt.Sprintf("waiting for canary %s/%s to be verified", canary.Namespace, canary.Name)
+		return nil, msg
+	}
+}
+
+// referenceDigest returns the digest part of an image reference by digest,
+// e.g. "sha256:..." for "quay.io/repo/image@sha256:...". The same image cached
+// in different registries has different references but the same digest.
+func referenceDigest(ref string) string {
+	idx := strings.LastIndex(ref, "@")
+	if idx < 0 {
+		return ref
+	}
+	return ref[idx+1:]
+}
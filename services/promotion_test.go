@@ -0,0 +1,377 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestPromotionPromote(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	hourAgo := metav1.NewTime(now.Add(-time.Hour))
+	minuteAgo := metav1.NewTime(now.Add(-time.Minute))
+
+	newTag := func(policy *imagtagv1.PromotionPolicy, specGen int64) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "mytag",
+				Namespace: "prod",
+			},
+			Spec: imagtagv1.TagSpec{
+				Generation: specGen,
+				Promotion:  policy,
+			},
+			Status: imagtagv1.TagStatus{
+				Generation: 1,
+				References: []imagtagv1.HashReference{
+					{
+						Generation:     2,
+						ImageReference: "cache.local/prod/mytag@sha256:new",
+						ImportedAt:     minuteAgo,
+					},
+					{
+						Generation:     1,
+						ImageReference: "cache.local/prod/mytag@sha256:old",
+						ImportedAt:     hourAgo,
+					},
+				},
+			},
+		}
+	}
+
+	canary := func(ref string, rolledOut metav1.ConditionStatus) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "mytag",
+				Namespace: "canary",
+			},
+			Status: imagtagv1.TagStatus{
+				Generation: 0,
+				References: []imagtagv1.HashReference{
+					{
+						Generation:     0,
+						ImageReference: ref,
+					},
+				},
+				Conditions: []metav1.Condition{
+					{
+						Type:               imagtagv1.ConditionRolledOut,
+						Status:             rolledOut,
+						LastTransitionTime: hourAgo,
+					},
+				},
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		tag      *imagtagv1.Tag
+		objects  []runtime.Object
+		promoted bool
+		phase    string
+		message  string
+	}{
+		{
+			name:     "no policy",
+			tag:      newTag(nil, 2),
+			promoted: true,
+		},
+		{
+			name: "downgrade",
+			tag: newTag(
+				&imagtagv1.PromotionPolicy{
+					SoakTime: metav1.Duration{Duration: time.Hour},
+				},
+				0,
+			),
+			promoted: true,
+			phase:    imagtagv1.PromotionActive,
+		},
+		{
+			name: "soaking",
+			tag: newTag(
+				&imagtagv1.PromotionPolicy{
+					SoakTime: metav1.Duration{Duration: time.Hour},
+				},
+				2,
+			),
+			phase:   imagtagv1.PromotionPending,
+			message: "soaking until 2021-01-01T12:59:00Z",
+		},
+		{
+			name: "soaked",
+			tag: newTag(
+				&imagtagv1.PromotionPolicy{
+					SoakTime: metav1.Duration{Duration: time.Minute},
+				},
+				2,
+			),
+			promoted: true,
+			phase:    imagtagv1.PromotionActive,
+		},
+		{
+			name: "canary not found",
+			tag: newTag(
+				&imagtagv1.PromotionPolicy{
+					SoakTime:        metav1.Duration{Duration: time.Minute},
+					CanaryNamespace: "canary",
+				},
+				2,
+			),
+			phase:   imagtagv1.PromotionPending,
+			message: "canary tag canary/mytag not found",
+		},
+		{
+			name: "canary using another image",
+			tag: newTag(
+				&imagtagv1.PromotionPolicy{
+					SoakTime:        metav1.Duration{Duration: time.Minute},
+					CanaryNamespace: "canary",
+				},
+				2,
+			),
+			objects: []runtime.Object{
+				canary("quay.io/repo/mytag@sha256:old", metav1.ConditionTrue),
+			},
+			phase:   imagtagv1.PromotionPending,
+			message: "waiting for canary canary/mytag to use the image",
+		},
+		{
+			name: "canary not rolled out",
+			tag: newTag(
+				&imagtagv1.PromotionPolicy{
+					SoakTime:        metav1.Duration{Duration: time.Minute},
+					CanaryNamespace: "canary",
+				},
+				2,
+			),
+			objects: []runtime.Object{
+				canary("quay.io/repo/mytag@sha256:new", metav1.ConditionUnknown),
+			},
+			phase:   imagtagv1.PromotionPending,
+			message: "waiting for canary canary/mytag to roll out",
+		},
+		{
+			name: "canary soaked",
+			tag: newTag(
+				&imagtagv1.PromotionPolicy{
+					SoakTime:        metav1.Duration{Duration: 30 * time.Minute},
+					CanaryNamespace: "canary",
+				},
+				2,
+			),
+			objects: []runtime.Object{
+				canary("quay.io/repo/mytag@sha256:new", metav1.ConditionTrue),
+			},
+			promoted: true,
+			phase:    imagtagv1.PromotionActive,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tagcli := tagfake.NewSimpleClientset(tt.objects...)
+			taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+			taginf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				taginf.Images().V1().Tags().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			prom := NewPromotion(taglis, nil)
+			prom.now = func() time.Time { return now }
+
+			if _, err := prom.Promote(tt.tag); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			promoted := tt.tag.Status.Generation == tt.tag.Spec.Generation
+			if promoted != tt.promoted {
+				t.Errorf("expected promoted to be %v, status %+v", tt.promoted, tt.tag.Status)
+			}
+
+			promotion := tt.tag.Status.Promotion
+			if tt.phase == "" {
+				if promotion != nil {
+					t.Errorf("unexpected promotion: %+v", promotion)
+				}
+				return
+			}
+			if promotion == nil {
+				t.Fatal("promotion not recorded")
+			}
+			if promotion.Phase != tt.phase {
+				t.Errorf("expected phase %s, %+v found", tt.phase, promotion)
+			}
+			if !strings.Contains(promotion.Message, tt.message) {
+				t.Errorf("expected message %q, %q found", tt.message, promotion.Message)
+			}
+		})
+	}
+}
+
+func TestPromotionTagSet(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	member := func(name string, policy *imagtagv1.PromotionPolicy) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "prod",
+			},
+			Spec: imagtagv1.TagSpec{
+				Generation: 2,
+				Promotion:  policy,
+			},
+			Status: imagtagv1.TagStatus{
+				Generation: 1,
+				References: []imagtagv1.HashReference{
+					{Generation: 2, ImportedAt: metav1.NewTime(now.Add(-time.Minute))},
+					{Generation: 1, ImportedAt: metav1.NewTime(now.Add(-time.Hour))},
+				},
+			},
+		}
+	}
+
+	frontend := member("frontend", nil)
+	backend := member(
+		"backend", &imagtagv1.PromotionPolicy{
+			SoakTime: metav1.Duration{Duration: 30 * time.Minute},
+		},
+	)
+	tagcli := tagfake.NewSimpleClientset(
+		frontend,
+		backend,
+		&imagtagv1.TagSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app",
+				Namespace: "prod",
+			},
+			Spec: imagtagv1.TagSetSpec{
+				Tags: []string{"frontend", "backend"},
+			},
+		},
+	)
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	tslis := taginf.Images().V1().TagSets().Lister()
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		taginf.Images().V1().TagSets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	prom := NewPromotion(taglis, tslis)
+	prom.now = func() time.Time { return now }
+
+	if _, err := prom.Promote(frontend); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if frontend.Status.Generation != 1 {
+		t.Errorf("frontend promoted before backend soaked")
+	}
+	msg := "tag set app: waiting for tag backend, soaking until"
+	if !strings.Contains(frontend.Status.Promotion.Message, msg) {
+		t.Errorf("unexpected promotion: %+v", frontend.Status.Promotion)
+	}
+
+	// once the backend has soaked the frontend may move.
+	prom.now = func() time.Time { return now.Add(time.Hour) }
+	if _, err := prom.Promote(frontend); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if frontend.Status.Generation != 2 {
+		t.Errorf("frontend not promoted: %+v", frontend.Status)
+	}
+}
+
+func TestCanaryVerified(t *testing.T) {
+	verifiedAt := metav1.NewTime(time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	for _, tt := range []struct {
+		name      string
+		promotion *imagtagv1.Promotion
+		since     *metav1.Time
+		message   string
+	}{
+		{
+			name:    "not promoted",
+			message: "waiting for canary canary/mytag to be verified",
+		},
+		{
+			name: "verifying",
+			promotion: &imagtagv1.Promotion{
+				Generation: 1,
+				Phase:      imagtagv1.PromotionActive,
+			},
+			message: "waiting for canary canary/mytag to be verified",
+		},
+		{
+			name: "failed",
+			promotion: &imagtagv1.Promotion{
+				Generation: 1,
+				Phase:      imagtagv1.PromotionFailed,
+				Message:    "5 restarts exceed the budget of 3",
+			},
+			message: "canary canary/mytag failed verification: 5 restarts",
+		},
+		{
+			name: "previous generation succeeded",
+			promotion: &imagtagv1.Promotion{
+				Generation: 0,
+				Phase:      imagtagv1.PromotionSucceeded,
+				VerifiedAt: &verifiedAt,
+			},
+			message: "waiting for canary canary/mytag to be verified",
+		},
+		{
+			name: "succeeded",
+			promotion: &imagtagv1.Promotion{
+				Generation: 1,
+				Phase:      imagtagv1.PromotionSucceeded,
+				VerifiedAt: &verifiedAt,
+			},
+			since: &verifiedAt,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			canary := &imagtagv1.Tag{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "mytag",
+					Namespace: "canary",
+				},
+				Status: imagtagv1.TagStatus{
+					Generation: 1,
+					Promotion:  tt.promotion,
+				},
+			}
+
+			since, msg := canaryVerified(canary)
+			if !strings.Contains(msg, tt.message) || (tt.message == "" && msg != "") {
+				t.Errorf("expected message %q, %q received", tt.message, msg)
+			}
+			if since != tt.since {
+				t.Errorf("expected since %v, %v received", tt.since, since)
+			}
+		})
+	}
+}
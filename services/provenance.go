@@ -0,0 +1,73 @@
+package services
+
+import (
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// NewTagEnvironment returns the state of the Tag in an environment. The Tag
+// may be nil, meaning it does not exist in the environment.
+func NewTagEnvironment(cluster, namespace string, it *imagtagv1.Tag) imagtagv1.TagEnvironment {
+	env := imagtagv1.TagEnvironment{
+		Cluster:   cluster,
+		Namespace: namespace,
+	}
+	if it == nil {
+		return env
+	}
+
+	env.Found = true
+	env.Generation = it.Status.Generation
+	hashref, ok := it.CurrentHashReference()
+	if !ok {
+		return env
+	}
+	env.Reference = hashref.ImageReference
+	env.Digest = hashref.Digest()
+	importedAt := hashref.ImportedAt
+	env.ImportedAt = &importedAt
+	return env
+}
+
+// DiffProvenance compares the environments of the Tag with the provided name.
+// Environments are kept in the provided order.
+func DiffProvenance(name string, envs []imagtagv1.TagEnvironment) *imagtagv1.ProvenanceDiff {
+	diff := &imagtagv1.ProvenanceDiff{Name: name}
+
+	var newest *metav1.Time
+	for _, env := range envs {
+		if env.Digest == "" {
+			continue
+		}
+		if newest == nil || env.ImportedAt.After(newest.Time) {
+			newest = env.ImportedAt
+			diff.Latest = env.Digest
+		}
+	}
+
+	for _, env := range envs {
+		env.Lagging = env.Digest != diff.Latest
+		diff.Environments = append(diff.Environments, env)
+	}
+	return diff
+}
+
+// DiffNamespaces compares the Tag with the provided name among namespaces,
+// Tags are read from the cache. Namespaces without the Tag are reported as
+// lagging.
+func (t *Tag) DiffNamespaces(name string, namespaces []string) (*imagtagv1.ProvenanceDiff, error) {
+	var envs []imagtagv1.TagEnvironment
+	for _, ns := range namespaces {
+		it, err := t.taglis.Tags(ns).Get(name)
+		if err != nil {
+			if !errors.IsNotFound(err) {
+				return nil, err
+			}
+			it = nil
+		}
+		envs = append(envs, NewTagEnvironment("", ns, it))
+	}
+	return DiffProvenance(name, envs), nil
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestDiffProvenance(t *testing.T) {
+	newTag := func(gen int64, ref string, at time.Time) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			Spec: imagtagv1.TagSpec{Generation: gen},
+			Status: imagtagv1.TagStatus{
+				Generation: gen,
+				References: []imagtagv1.HashReference{
+					{
+						Generation:     gen,
+						ImageReference: ref,
+						ImportedAt:     metav1.NewTime(at),
+					},
+				},
+			},
+		}
+	}
+
+	base := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	envs := []imagtagv1.TagEnvironment{
+		NewTagEnvironment("", "prod", newTag(1, "registry/app@sha256:old", base)),
+		NewTagEnvironment("", "staging", newTag(2, "registry/app@sha256:new", base.Add(time.Hour))),
+		NewTagEnvironment("", "dev", nil),
+	}
+
+	diff := DiffProvenance("app", envs)
+	if diff.Latest != "sha256:new" {
+		t.Errorf("expected latest sha256:new, %s received", diff.Latest)
+	}
+
+	var lagging []bool
+	for _, env := range diff.Environments {
+		lagging = append(lagging, env.Lagging)
+	}
+	expected := []bool{true, false, true}
+	if !reflect.DeepEqual(lagging, expected) {
+		t.Errorf("expected lagging %v, %v received", expected, lagging)
+	}
+	if diff.Environments[1].Generation != 2 || !diff.Environments[1].Found {
+		t.Errorf("unexpected staging environment: %+v", diff.Environments[1])
+	}
+	if diff.Environments[2].Found {
+		t.Errorf("expected dev environment not to be found")
+	}
+}
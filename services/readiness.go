@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corecli "k8s.io/client-go/kubernetes"
+	aplist "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/klog/v2"
+
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+)
+
+// ReadinessGateAnnotation set to "true" on a Deployment makes its pods carry
+// the PodConditionTagCurrent readiness gate. Requires the PodReadinessGate
+// feature gate.
+const ReadinessGateAnnotation = "image-tag-readiness-gate"
+
+// PodConditionTagCurrent is the pod condition, used as readiness gate, set
+// to true once all pod containers using Tags run the Tag current generation.
+const PodConditionTagCurrent corev1.PodConditionType = "images.io/tag-current"
+
+// These are the reasons used for the PodConditionTagCurrent condition.
+const (
+	ReasonTagCurrent = "TagCurrent"
+	ReasonStaleImage = "StaleImage"
+	ReasonUntracked  = "Untracked"
+)
+
+// PodReadiness manages the PodConditionTagCurrent readiness gate. It catches
+// pods started from stale specs, e.g. a ReplicaSet cached before the Tag has
+// moved, keeping them unready.
+type PodReadiness struct {
+	corcli corecli.Interface
+	replis aplist.ReplicaSetLister
+	taglis taglist.TagLister
+}
+
+// NewPodReadiness returns a handler for the Tag readiness gate of pods.
+func NewPodReadiness(
+	corcli corecli.Interface,
+	replis aplist.ReplicaSetLister,
+	taglis taglist.TagLister,
+) *PodReadiness {
+	return &PodReadiness{
+		corcli: corcli,
+		replis: replis,
+		taglis: taglis,
+	}
+}
+
+// readinessGateEnabled returns true if pods owned by a ReplicaSet with the
+// provided annotations should carry the readiness gate.
+func readinessGateEnabled(annotations map[string]string) bool {
+	return annotations[ReadinessGateAnnotation] == "true"
+}
+
+// hasReadinessGate returns true if the pod carries the PodConditionTagCurrent
+// readiness gate.
+func hasReadinessGate(pod *corev1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == PodConditionTagCurrent {
+			return true
+		}
+	}
+	return false
+}
+
+// tagCurrentCondition returns the PodConditionTagCurrent condition of the pod
+// or nil if it has not been set yet.
+func tagCurrentCondition(pod *corev1.Pod) *corev1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == PodConditionTagCurrent {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// Pending returns true if the pod carries the readiness gate and it has not
+// been set to true yet.
+func (p *PodReadiness) Pending(pod *corev1.Pod) bool {
+	if !hasReadinessGate(pod) {
+		return false
+	}
+	cond := tagCurrentCondition(pod)
+	return cond == nil || cond.Status != corev1.ConditionTrue
+}
+
+// Update evaluates the readiness gate of the pod. Containers using Tags must
+// run the Tag current generation for the condition to be true. Once true the
+// condition is never flipped back: pods of previous ReplicaSets keep serving
+// while a new generation rolls out.
+func (p *PodReadiness) Update(ctx context.Context, pod *corev1.Pod) error {
+	if !p.Pending(pod) {
+		return nil
+	}
+
+	status, reason, msg, err := p.evaluate(pod)
+	if err != nil {
+		return err
+	}
+
+	if cur := tagCurrentCondition(pod); cur != nil &&
+		cur.Status == status &&
+		cur.Reason == reason &&
+		cur.Message == msg {
+		return nil
+	}
+
+	pod = pod.DeepCopy()
+	cond := corev1.PodCondition{
+		Type:               PodConditionTagCurrent,
+		Status:             status,
+		Reason:             reason,
+		Message:            msg,
+		LastTransitionTime: metav1.Now(),
+	}
+	if cur := tagCurrentCondition(pod); cur != nil {
+		*cur = cond
+	} else {
+		pod.Status.Conditions = append(pod.Status.Conditions, cond)
+	}
+
+	klog.V(4).Infof("pod %s/%s tag current: %s", pod.Namespace, pod.Name, status)
+	_, err = p.corcli.CoreV1().Pods(pod.Namespace).UpdateStatus(
+		ctx, pod, metav1.UpdateOptions{},
+	)
+	return err
+}
+
+// evaluate compares the images the pod runs against the current generation
+// of the Tags its ReplicaSet uses. Pods not owned by a ReplicaSet using Tags
+// are reported as untracked, with a true status, so they are not kept unready.
+func (p *PodReadiness) evaluate(
+	pod *corev1.Pod,
+) (corev1.ConditionStatus, string, string, error) {
+	if len(pod.OwnerReferences) == 0 || pod.OwnerReferences[0].Kind != "ReplicaSet" {
+		return corev1.ConditionTrue, ReasonUntracked, "pod not owned by a replica set", nil
+	}
+
+	rs, err := p.replis.ReplicaSets(pod.Namespace).Get(pod.OwnerReferences[0].Name)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	tracked, wildcard := tagTriggers(rs.Annotations)
+	if !tracked {
+		return corev1.ConditionTrue, ReasonUntracked, "replica set does not use tags", nil
+	}
+
+	images := map[string]string{}
+	for _, c := range pod.Spec.Containers {
+		images[c.Name] = c.Image
+	}
+
+	var stale []string
+	for _, c := range rs.Spec.Template.Spec.Containers {
+		it, err := tagForImage(p.taglis, pod.Namespace, c.Image, wildcard)
+		if err != nil {
+			return "", "", "", err
+		}
+		// pods of disabled tags run the image as written in their spec.
+		if it == nil || it.Spec.Disabled || it.CurrentReferenceIsArtifact() {
+			continue
+		}
+
+		ref := it.CurrentReferenceForTag()
+		if ref == "" {
+			stale = append(stale, fmt.Sprintf("%s: tag %s not imported", c.Name, it.Name))
+			continue
+		}
+		if images[c.Name] != ref {
+			stale = append(
+				stale,
+				fmt.Sprintf(
+					"%s: expected generation %d (%s)", c.Name, it.Status.Generation, ref,
+				),
+			)
+		}
+	}
+
+	if len(stale) > 0 {
+		return corev1.ConditionFalse, ReasonStaleImage, strings.Join(stale, "; "), nil
+	}
+	return corev1.ConditionTrue, ReasonTagCurrent, "containers run current tag generations", nil
+}
@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	coreinf "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/ricardomaraschini/tagger/features"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestPodReadinessUpdate(t *testing.T) {
+	gated := corev1.PodSpec{
+		ReadinessGates: []corev1.PodReadinessGate{
+			{ConditionType: PodConditionTagCurrent},
+		},
+		Containers: []corev1.Container{
+			{
+				Name:  "app",
+				Image: "remoteimage:123",
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name      string
+		pod       *corev1.Pod
+		status    corev1.ConditionStatus
+		reason    string
+		untouched bool
+	}{
+		{
+			name: "pod without readiness gate",
+			pod: &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: gated.Containers,
+				},
+			},
+			untouched: true,
+		},
+		{
+			name: "pod not owned by a replica set",
+			pod: &corev1.Pod{
+				Spec: gated,
+			},
+			status: corev1.ConditionTrue,
+			reason: ReasonUntracked,
+		},
+		{
+			name: "pod running current generation",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: "ReplicaSet", Name: "myrs"},
+					},
+				},
+				Spec: gated,
+			},
+			status: corev1.ConditionTrue,
+			reason: ReasonTagCurrent,
+		},
+		{
+			name: "pod started from a stale spec",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					OwnerReferences: []metav1.OwnerReference{
+						{Kind: "ReplicaSet", Name: "myrs"},
+					},
+				},
+				Spec: corev1.PodSpec{
+					ReadinessGates: gated.ReadinessGates,
+					Containers: []corev1.Container{
+						{
+							Name:  "app",
+							Image: "remoteimage:321",
+						},
+					},
+				},
+			},
+			status: corev1.ConditionFalse,
+			reason: ReasonStaleImage,
+		},
+		{
+			name: "condition already true",
+			pod: &corev1.Pod{
+				Spec: corev1.PodSpec{
+					ReadinessGates: gated.ReadinessGates,
+					Containers: []corev1.Container{
+						{
+							Name:  "app",
+							Image: "remoteimage:321",
+						},
+					},
+				},
+				Status: corev1.PodStatus{
+					Conditions: []corev1.PodCondition{
+						{
+							Type:   PodConditionTagCurrent,
+							Status: corev1.ConditionTrue,
+							Reason: ReasonTagCurrent,
+						},
+					},
+				},
+			},
+			status:    corev1.ConditionTrue,
+			reason:    ReasonTagCurrent,
+			untouched: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tt.pod.Name = "mypod"
+			tt.pod.Namespace = "ns"
+			objects := []runtime.Object{
+				tt.pod,
+				&appsv1.ReplicaSet{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "myrs",
+						Namespace:   "ns",
+						Annotations: map[string]string{"image-tag": "true"},
+					},
+					Spec: appsv1.ReplicaSetSpec{
+						Template: corev1.PodTemplateSpec{
+							Spec: corev1.PodSpec{
+								Containers: []corev1.Container{
+									{
+										Name:  "app",
+										Image: "mytag",
+									},
+									{
+										Name:  "sidecar",
+										Image: "busybox",
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+
+			corcli := fake.NewSimpleClientset(objects...)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			replis := corinf.Apps().V1().ReplicaSets().Lister()
+
+			tagcli := tagfake.NewSimpleClientset(
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "mytag",
+						Namespace: "ns",
+					},
+					Status: imagtagv1.TagStatus{
+						Generation: 1,
+						References: []imagtagv1.HashReference{
+							{Generation: 1, ImageReference: "remoteimage:123"},
+							{Generation: 0, ImageReference: "remoteimage:321"},
+						},
+					},
+				},
+			)
+			taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+
+			corinf.Start(ctx.Done())
+			taginf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+				taginf.Images().V1().Tags().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			svc := NewPodReadiness(corcli, replis, taglis)
+			if err := svc.Update(ctx, tt.pod); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if tt.untouched {
+				for _, action := range corcli.Actions() {
+					if action.GetVerb() == "update" {
+						t.Errorf("unexpected pod update: %+v", action)
+					}
+				}
+				return
+			}
+
+			pod, err := corcli.CoreV1().Pods("ns").Get(ctx, "mypod", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			cond := tagCurrentCondition(pod)
+			if cond == nil || cond.Status != tt.status || cond.Reason != tt.reason {
+				t.Errorf("expected %s(%s), %+v found", tt.status, tt.reason, cond)
+			}
+		})
+	}
+}
+
+func TestPatchForPodReadinessGate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := features.Default.Set("PodReadinessGate=true"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer features.Default.Set("PodReadinessGate=false")
+
+	corcli := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "myrs",
+				Namespace: "ns",
+				Annotations: map[string]string{
+					"image-tag":             "true",
+					ReadinessGateAnnotation: "true",
+				},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	replis := corinf.Apps().V1().ReplicaSets().Lister()
+
+	tagcli := tagfake.NewSimpleClientset()
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	corinf.Start(ctx.Done())
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	svc := NewTag(nil, tagcli, taglis, nil, replis, nil, nil, nil, nil, nil)
+	patch, _, err := svc.PatchForPod(
+		ctx,
+		corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "mypod",
+				Namespace: "ns",
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "ReplicaSet", Name: "myrs"},
+				},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Image: "busybox",
+					},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(patch) != 1 || patch[0].Path != "/spec/readinessGates" {
+		t.Errorf("readiness gate not added: %+v", patch)
+	}
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// podSpecPaths maps the kinds of objects holding pods into the path of their
+// pod spec.
+var podSpecPaths = map[string][]string{
+	"Pod":         {"spec"},
+	"Deployment":  {"spec", "template", "spec"},
+	"ReplicaSet":  {"spec", "template", "spec"},
+	"StatefulSet": {"spec", "template", "spec"},
+	"DaemonSet":   {"spec", "template", "spec"},
+	"Job":         {"spec", "template", "spec"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// Renderer pins the Tags referred by manifests to the image references they
+// currently point to, as the pod mutating webhook would, so the manifests can
+// be applied, or committed, without relying on the webhook. Tags are read
+// from the cluster, once per namespace.
+type Renderer struct {
+	tagcli tagclient.Interface
+	tags   map[string][]*imagtagv1.Tag
+}
+
+// NewRenderer returns a renderer reading Tags through tagcli.
+func NewRenderer(tagcli tagclient.Interface) *Renderer {
+	return &Renderer{
+		tagcli: tagcli,
+		tags:   map[string][]*imagtagv1.Tag{},
+	}
+}
+
+// Render reads the yaml documents, or json objects, from in and returns them
+// as yaml documents with their Tags resolved. Objects without a namespace
+// are taken as living in namespace. Only objects holding pods and opting in
+// for Tags, through the same annotations as Deployments, are changed: the
+// images of their containers referring to Tags and, if placeholders are
+// enabled, the placeholders in their environment variables and args are
+// replaced. Lists are rendered item by item. Referring to a Tag without an
+// image reference, e.g. not imported yet, is an error.
+func (r *Renderer) Render(ctx context.Context, in io.Reader, namespace string) ([]byte, error) {
+	var out bytes.Buffer
+	decoder := utilyaml.NewYAMLOrJSONDecoder(in, 4096)
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if err == io.EOF {
+				return out.Bytes(), nil
+			}
+			return nil, err
+		}
+		if obj == nil {
+			continue
+		}
+
+		if err := r.renderObject(ctx, obj, namespace); err != nil {
+			return nil, err
+		}
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString("---\n")
+		out.Write(data)
+	}
+}
+
+// renderObject resolves the Tags referred by an object, in place.
+func (r *Renderer) renderObject(
+	ctx context.Context, obj map[string]interface{}, namespace string,
+) error {
+	u := &unstructured.Unstructured{Object: obj}
+	if u.GetNamespace() != "" {
+		namespace = u.GetNamespace()
+	}
+
+	if u.IsList() {
+		items, _, err := unstructured.NestedSlice(obj, "items")
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if item, ok := item.(map[string]interface{}); ok {
+				if err := r.renderObject(ctx, item, namespace); err != nil {
+					return err
+				}
+			}
+		}
+		return unstructured.SetNestedSlice(obj, items, "items")
+	}
+
+	path, ok := podSpecPaths[u.GetKind()]
+	if !ok {
+		return nil
+	}
+	tracked, wildcard := tagTriggers(u.GetAnnotations())
+	if !tracked {
+		return nil
+	}
+	placeholders := placeholdersEnabled(u.GetAnnotations())
+
+	containers, found, err := unstructured.NestedSlice(obj, append(path, "containers")...)
+	if err != nil || !found {
+		return err
+	}
+
+	resolve := func(name string) (string, error) {
+		return r.reference(ctx, namespace, name, false)
+	}
+	for _, c := range containers {
+		cont, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		err := r.renderContainer(ctx, cont, namespace, wildcard, placeholders, resolve)
+		if err != nil {
+			return fmt.Errorf("%s %s/%s: %w", u.GetKind(), namespace, u.GetName(), err)
+		}
+	}
+	return unstructured.SetNestedSlice(obj, containers, append(path, "containers")...)
+}
+
+// renderContainer resolves the image of a container and, if placeholders is
+// set, the placeholders in its environment variables and args, in place.
+func (r *Renderer) renderContainer(
+	ctx context.Context,
+	cont map[string]interface{},
+	namespace string,
+	wildcard bool,
+	placeholders bool,
+	resolve func(name string) (string, error),
+) error {
+	if image, ok := cont["image"].(string); ok {
+		ref, err := r.reference(ctx, namespace, image, wildcard)
+		if err != nil {
+			return err
+		}
+		if ref != "" {
+			cont["image"] = ref
+		}
+	}
+	if !placeholders {
+		return nil
+	}
+
+	if env, ok := cont["env"].([]interface{}); ok {
+		for _, e := range env {
+			envvar, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			value, ok := envvar["value"].(string)
+			if !ok {
+				continue
+			}
+			expanded, err := expandPlaceholders(value, resolve)
+			if err != nil {
+				return err
+			}
+			envvar["value"] = expanded
+		}
+	}
+
+	if args, ok := cont["args"].([]interface{}); ok {
+		for i, a := range args {
+			arg, ok := a.(string)
+			if !ok {
+				continue
+			}
+			expanded, err := expandPlaceholders(arg, resolve)
+			if err != nil {
+				return err
+			}
+			args[i] = expanded
+		}
+	}
+	return nil
+}
+
+// reference returns the image reference of the Tag an image refers to, by
+// name or, if wildcard is set, by the image the Tag is imported from. An
+// empty string is returned if the image refers to no Tag.
+func (r *Renderer) reference(
+	ctx context.Context, namespace, image string, wildcard bool,
+) (string, error) {
+	tags, err := r.namespaceTags(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+
+	// as in tagForImage a Tag named after the image wins, otherwise the
+	// first Tag, by name, imported from it.
+	var match *imagtagv1.Tag
+	for _, it := range tags {
+		if it.Name == image {
+			match = it
+			break
+		}
+		if match == nil && imageMatchesTag(image, it, wildcard) {
+			match = it
+		}
+	}
+	if match == nil {
+		return "", nil
+	}
+
+	ref := currentReference(match)
+	if ref == "" {
+		return "", fmt.Errorf(
+			"tag %s/%s is disabled, not imported or an artifact", namespace, match.Name,
+		)
+	}
+	return ref, nil
+}
+
+// namespaceTags returns the Tags in a namespace, sorted by name.
+func (r *Renderer) namespaceTags(ctx context.Context, namespace string) ([]*imagtagv1.Tag, error) {
+	if tags, ok := r.tags[namespace]; ok {
+		return tags, nil
+	}
+
+	list, err := r.tagcli.ImagesV1().Tags(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var tags []*imagtagv1.Tag
+	for i := range list.Items {
+		tags = append(tags, &list.Items[i])
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	r.tags[namespace] = tags
+	return tags, nil
+}
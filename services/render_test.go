@@ -0,0 +1,319 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestRender(t *testing.T) {
+	tags := []*imagtagv1.Tag{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+			Spec:       imagtagv1.TagSpec{From: "quay.io/company/app:latest"},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "quay.io/company/app@sha256:1"},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "os"},
+			Spec:       imagtagv1.TagSpec{From: "centos:8"},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "docker.io/library/centos@sha256:2"},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "pending"},
+			Spec:       imagtagv1.TagSpec{From: "fedora:34"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "app"},
+			Spec:       imagtagv1.TagSpec{From: "quay.io/company/app:latest"},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "quay.io/company/app@sha256:3"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		input    string
+		expected string
+		err      string
+	}{
+		{
+			name: "deployment referring tags by name",
+			input: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  annotations:
+    image-tag: "true"
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app
+      - name: sidecar
+        image: centos:8
+`,
+			expected: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    image-tag: "true"
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - image: quay.io/company/app@sha256:1
+        name: app
+      - image: centos:8
+        name: sidecar
+`,
+		},
+		{
+			name: "wildcard triggers",
+			input: `
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: app
+  annotations:
+    image-triggers: "*"
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app
+      - name: sidecar
+        image: docker.io/library/centos:8
+      - name: proxy
+        image: envoy
+`,
+			expected: `---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  annotations:
+    image-triggers: '*'
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - image: quay.io/company/app@sha256:1
+        name: app
+      - image: docker.io/library/centos@sha256:2
+        name: sidecar
+      - image: envoy
+        name: proxy
+`,
+		},
+		{
+			name: "placeholders",
+			input: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: operator
+  namespace: prod
+  annotations:
+    image-tag: "true"
+    image-tag-placeholders: "true"
+spec:
+  containers:
+  - name: operator
+    image: quay.io/company/operator:v1
+    args:
+    - --image=$(TAG:app)
+    env:
+    - name: BASE
+      value: $(TAG:os)
+`,
+			expected: `---
+apiVersion: v1
+kind: Pod
+metadata:
+  annotations:
+    image-tag: "true"
+    image-tag-placeholders: "true"
+  name: operator
+  namespace: prod
+spec:
+  containers:
+  - args:
+    - --image=quay.io/company/app@sha256:1
+    env:
+    - name: BASE
+      value: docker.io/library/centos@sha256:2
+    image: quay.io/company/operator:v1
+    name: operator
+`,
+		},
+		{
+			name: "object not opting in",
+			input: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`,
+			expected: `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - image: app
+        name: app
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`,
+		},
+		{
+			name: "list and cronjob",
+			input: `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: batch/v1
+  kind: CronJob
+  metadata:
+    name: report
+    namespace: dev
+    annotations:
+      image-tag: "true"
+  spec:
+    jobTemplate:
+      spec:
+        template:
+          spec:
+            containers:
+            - name: report
+              image: app
+`,
+			expected: `---
+apiVersion: v1
+items:
+- apiVersion: batch/v1
+  kind: CronJob
+  metadata:
+    annotations:
+      image-tag: "true"
+    name: report
+    namespace: dev
+  spec:
+    jobTemplate:
+      spec:
+        template:
+          spec:
+            containers:
+            - image: quay.io/company/app@sha256:3
+              name: report
+kind: List
+`,
+		},
+		{
+			name: "tag not imported",
+			input: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  annotations:
+    image-tag: "true"
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: pending
+`,
+			err: "tag prod/pending is disabled, not imported or an artifact",
+		},
+		{
+			name: "placeholder not found",
+			input: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  annotations:
+    image-tag: "true"
+    image-tag-placeholders: "true"
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app
+        args:
+        - $(TAG:missing)
+`,
+			err: "unable to resolve $(TAG:missing)",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tagcli := tagfake.NewSimpleClientset()
+			for _, it := range tags {
+				if _, err := tagcli.ImagesV1().Tags(it.Namespace).Create(
+					context.Background(), it, metav1.CreateOptions{},
+				); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+
+			svc := NewRenderer(tagcli)
+			out, err := svc.Render(
+				context.Background(), bytes.NewBufferString(tt.input), "prod",
+			)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected error %q, %v received", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(out) != tt.expected {
+				t.Errorf("expected:\n%s\nreceived:\n%s", tt.expected, out)
+			}
+		})
+	}
+}
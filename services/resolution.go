@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// ResolutionAt returns the image the Tag resolved to at the provided time.
+// The Tag timeline is used if it goes back far enough, otherwise the latest
+// successful import before the time, among the provided ImportAudits and the
+// generations kept by the Tag, is taken as what the Tag resolved to. Imports
+// are less accurate as they don't account for promotions nor downgrades.
+func ResolutionAt(
+	it *imagtagv1.Tag, audits []imagtagv1.ImportAudit, at time.Time,
+) (*imagtagv1.Resolution, error) {
+	res := &imagtagv1.Resolution{
+		Namespace: it.Namespace,
+		Name:      it.Name,
+		At:        metav1.NewTime(at),
+	}
+
+	for _, entry := range it.Status.Timeline {
+		if entry.Since.After(at) {
+			continue
+		}
+		res.Generation = entry.Generation
+		res.ImageReference = entry.ImageReference
+		res.Since = entry.Since
+		res.Source = imagtagv1.ResolutionSourceTimeline
+		res.Digest = imagtagv1.HashReference{ImageReference: entry.ImageReference}.Digest()
+		return res, nil
+	}
+
+	for _, audit := range audits {
+		if !audit.Spec.Succeed || audit.Spec.Tag != it.Name {
+			continue
+		}
+		if audit.Spec.FinishedAt.After(at) || !audit.Spec.FinishedAt.After(res.Since.Time) {
+			continue
+		}
+		res.Generation = audit.Spec.Generation
+		res.ImageReference = audit.Spec.ImageReference
+		res.Since = audit.Spec.FinishedAt
+		res.Source = imagtagv1.ResolutionSourceImportAudit
+	}
+
+	for _, hashref := range it.Status.References {
+		if hashref.ImportedAt.After(at) || !hashref.ImportedAt.After(res.Since.Time) {
+			continue
+		}
+		res.Generation = hashref.Generation
+		res.ImageReference = hashref.ImageReference
+		res.Since = hashref.ImportedAt
+		res.Source = imagtagv1.ResolutionSourceGeneration
+	}
+
+	if res.Source == "" {
+		return nil, fmt.Errorf(
+			"no record of %s/%s at %s", it.Namespace, it.Name, at.UTC().Format(time.RFC3339),
+		)
+	}
+	res.Digest = imagtagv1.HashReference{ImageReference: res.ImageReference}.Digest()
+	return res, nil
+}
+
+// ResolveAt returns the image the Tag resolved to at the provided time, see
+// ResolutionAt. The Tag is read from the cache.
+func (t *Tag) ResolveAt(
+	ctx context.Context, namespace, name string, at time.Time,
+) (*imagtagv1.Resolution, error) {
+	it, err := t.taglis.Tags(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	audits, err := ListImportAudits(ctx, t.tagcli, it)
+	if err != nil {
+		return nil, fmt.Errorf("error listing import audits: %w", err)
+	}
+	return ResolutionAt(it, audits, at)
+}
@@ -0,0 +1,120 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestResolutionAt(t *testing.T) {
+	day := func(d, h int) metav1.Time {
+		return metav1.NewTime(time.Date(2021, 1, d, h, 0, 0, 0, time.UTC))
+	}
+	audit := func(gen int64, ref string, finished metav1.Time, succeed bool) imagtagv1.ImportAudit {
+		return imagtagv1.ImportAudit{
+			Spec: imagtagv1.ImportAuditSpec{
+				Tag:            "app",
+				Generation:     gen,
+				FinishedAt:     finished,
+				Succeed:        succeed,
+				ImageReference: ref,
+			},
+		}
+	}
+
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+		Status: imagtagv1.TagStatus{
+			Generation: 3,
+			References: []imagtagv1.HashReference{
+				{Generation: 3, ImageReference: "quay.io/app@sha256:3", ImportedAt: day(6, 10)},
+				{Generation: 2, ImageReference: "quay.io/app@sha256:2", ImportedAt: day(4, 10)},
+			},
+			// generation 2 has only been promoted on the 5th.
+			Timeline: []imagtagv1.TimelineEntry{
+				{Generation: 3, ImageReference: "quay.io/app@sha256:3", Since: day(6, 11)},
+				{Generation: 2, ImageReference: "quay.io/app@sha256:2", Since: day(5, 9)},
+			},
+		},
+	}
+	audits := []imagtagv1.ImportAudit{
+		audit(0, "quay.io/app@sha256:0", day(1, 10), true),
+		audit(1, "quay.io/app@sha256:1", day(2, 10), true),
+		audit(2, "", day(3, 10), false),
+	}
+
+	for _, tt := range []struct {
+		name       string
+		at         metav1.Time
+		generation int64
+		source     string
+		since      metav1.Time
+		err        string
+	}{
+		{
+			name:       "current generation",
+			at:         day(7, 0),
+			generation: 3,
+			source:     imagtagv1.ResolutionSourceTimeline,
+			since:      day(6, 11),
+		},
+		{
+			name:       "imported but not promoted yet",
+			at:         day(6, 10),
+			generation: 2,
+			source:     imagtagv1.ResolutionSourceTimeline,
+			since:      day(5, 9),
+		},
+		{
+			name:       "before the timeline",
+			at:         day(4, 12),
+			generation: 2,
+			source:     imagtagv1.ResolutionSourceGeneration,
+			since:      day(4, 10),
+		},
+		{
+			name:       "failed imports are ignored",
+			at:         day(3, 12),
+			generation: 1,
+			source:     imagtagv1.ResolutionSourceImportAudit,
+			since:      day(2, 10),
+		},
+		{
+			name: "before any record",
+			at:   day(1, 0),
+			err:  "no record of prod/app at 2021-01-01T00:00:00Z",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ResolutionAt(it, audits, tt.at.Time)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Fatalf("expecting error %q, nil received instead", tt.err)
+			}
+
+			if res.Generation != tt.generation || res.Source != tt.source {
+				t.Errorf(
+					"expected generation %d from %s, %d from %s received",
+					tt.generation, tt.source, res.Generation, res.Source,
+				)
+			}
+			if !res.Since.Equal(&tt.since) {
+				t.Errorf("expected since %s, %s received", tt.since, res.Since)
+			}
+			digest := res.ImageReference[strings.Index(res.ImageReference, "@")+1:]
+			if res.Digest != digest {
+				t.Errorf("expected digest %s, %s received", digest, res.Digest)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// isUnauthorized returns true if err has been caused by the registry refusing
+// the credentials in use (http 401).
+func isUnauthorized(err error) bool {
+	if err == nil {
+		return false
+	}
+	var unauth docker.ErrUnauthorizedForCredentials
+	if errors.As(err, &unauth) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "401 unauthorized") ||
+		strings.Contains(msg, "status code 401")
+}
+
+// sameAuth returns true if both auths hold the same credentials.
+func sameAuth(a, b *types.DockerAuthConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// freshAuth resolves the credentials for imgref again, through the Secret
+// lister, and returns the first one not present in tried. Returns nil if
+// the Secrets hold no credentials other than the ones already tried. This
+// is how a rotated robot account password is picked up.
+func (i *Importer) freshAuth(
+	ctx context.Context,
+	imgref types.ImageReference,
+	namespace string,
+	tried []*types.DockerAuthConfig,
+) (*types.DockerAuthConfig, error) {
+	auths, err := i.syssvc.AuthsFor(ctx, imgref, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, auth := range auths {
+		known := false
+		for _, prev := range tried {
+			if sameAuth(auth, prev) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return auth, nil
+		}
+	}
+	return nil, nil
+}
+
+// cacheTagRotatingAuth caches an image like cacheTag but, if the source
+// registry refuses the credentials mid-stream, the credentials are resolved
+// again and the copy is retried with the new ones. Credentials in Secrets
+// may be rotated while an import runs, without this the import would fail
+// until the Tag is imported again.
+func (i *Importer) cacheTagRotatingAuth(
+	ctx context.Context,
+	it *imagtagv1.Tag,
+	imgref types.ImageReference,
+	from string,
+	srcCtx *types.SystemContext,
+	progress *ImportProgress,
+	forceMIME string,
+) (string, []imagtagv1.BlobReference, error) {
+	tried := []*types.DockerAuthConfig{srcCtx.DockerAuthConfig}
+	for {
+		ref, blobs, err := i.cacheTag(ctx, it, from, srcCtx, progress, forceMIME)
+		if !isUnauthorized(err) {
+			return ref, blobs, err
+		}
+
+		auth, ferr := i.freshAuth(ctx, imgref, it.Namespace, tried)
+		if ferr != nil {
+			klog.V(2).Infof("unable to refresh credentials for %s: %s", from, ferr)
+			return "", nil, err
+		}
+		if auth == nil {
+			return "", nil, err
+		}
+
+		klog.V(2).Infof("credentials for %s refused, retrying with refreshed ones", from)
+		tried = append(tried, auth)
+		fresh := *srcCtx
+		fresh.DockerAuthConfig = auth
+		srcCtx = &fresh
+	}
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinf "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+)
+
+func TestIsUnauthorized(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name: "nil error",
+		},
+		{
+			name: "unrelated error",
+			err:  fmt.Errorf("connection reset by peer"),
+		},
+		{
+			name:     "unauthorized",
+			err:      docker.ErrUnauthorizedForCredentials{Err: fmt.Errorf("denied")},
+			expected: true,
+		},
+		{
+			name: "wrapped unauthorized",
+			err: fmt.Errorf(
+				"unable to cache image: %w",
+				fmt.Errorf(
+					"error fetching blob: %w",
+					docker.ErrUnauthorizedForCredentials{Err: fmt.Errorf("denied")},
+				),
+			),
+			expected: true,
+		},
+		{
+			name:     "unauthorized status code",
+			err:      fmt.Errorf("invalid status code 401 unauthorized"),
+			expected: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := isUnauthorized(tt.err); res != tt.expected {
+				t.Errorf("expected %v, %v received", tt.expected, res)
+			}
+		})
+	}
+}
+
+func TestFreshAuth(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	secret := func(password string) *corev1.Secret {
+		auths, _ := json.Marshal(
+			dockerAuthConfig{
+				Auths: map[string]registryAuth{
+					"quay.io": {
+						Username: "robot",
+						Password: password,
+					},
+				},
+			},
+		)
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns",
+				Name:      "robot",
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: auths,
+			},
+		}
+	}
+
+	fakecli := fake.NewSimpleClientset(secret("old"))
+	informer := coreinf.NewSharedInformerFactory(fakecli, time.Minute)
+	seclis := informer.Core().V1().Secrets().Lister()
+	informer.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		informer.Core().V1().Secrets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	imp := NewImporter(nil, seclis)
+	ref, _ := reference.ParseDockerRef("quay.io/repo/image:latest")
+	imgref, _ := docker.NewReference(ref)
+
+	tried := []*types.DockerAuthConfig{{Username: "robot", Password: "old"}}
+	auth, err := imp.freshAuth(ctx, imgref, "ns", tried)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if auth != nil {
+		t.Errorf("credentials not rotated, %+v received", auth)
+	}
+
+	// the robot account password is rotated.
+	if _, err := fakecli.CoreV1().Secrets("ns").Update(
+		ctx, secret("new"), metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for ctx.Err() == nil {
+		auth, err = imp.freshAuth(ctx, imgref, "ns", tried)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if auth != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if auth == nil || auth.Password != "new" {
+		t.Errorf("rotated credentials not returned: %+v", auth)
+	}
+}
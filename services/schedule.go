@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corecli "k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// ImportSlotName returns the name of the Lease backing the import slot with
+// the provided index.
+func ImportSlotName(index int) string {
+	return fmt.Sprintf("tagger-import-slot-%d", index)
+}
+
+// ScheduleError is returned when an import is held back by the import
+// schedule, either by a blackout window or because the concurrency budget is
+// exhausted.
+type ScheduleError struct {
+	Blackout      string
+	MaxConcurrent int
+}
+
+// Error returns the error message.
+func (s *ScheduleError) Error() string {
+	if s.Blackout != "" {
+		return fmt.Sprintf("import held back, blackout %s in progress", s.Blackout)
+	}
+	return fmt.Sprintf(
+		"import held back, %d imports already running cluster wide", s.MaxConcurrent,
+	)
+}
+
+// Reason returns the reason used in the Tag Throttled condition.
+func (s *ScheduleError) Reason() string {
+	if s.Blackout != "" {
+		return imagtagv1.ReasonBlackout
+	}
+	return imagtagv1.ReasonImportBudget
+}
+
+// ImportScheduler admits imports based on the import schedule. No import
+// starts during a blackout window and, if a concurrency budget is set, each
+// import holds one of a fixed number of slots shared by all replicas. Slots
+// are Leases, renewed while the import runs, so slots held by a replica that
+// goes away are freed once their Lease expires.
+type ImportScheduler struct {
+	sync.Mutex
+	cfg       config.ImportSchedule
+	corcli    corecli.Interface
+	namespace string
+	identity  string
+	now       func() time.Time
+}
+
+// NewImportScheduler returns a scheduler keeping the slot Leases in the
+// provided namespace. Identity identifies this replica, e.g. its hostname.
+// Nothing is held back until a schedule is configured.
+func NewImportScheduler(
+	corcli corecli.Interface, namespace, identity string,
+) *ImportScheduler {
+	return &ImportScheduler{
+		corcli:    corcli,
+		namespace: namespace,
+		identity:  identity,
+		now:       time.Now,
+	}
+}
+
+// ApplyConfig applies the import schedule. Slots held by imports already
+// running are kept until they finish.
+func (s *ImportScheduler) ApplyConfig(cfg *config.Config) {
+	s.Lock()
+	defer s.Unlock()
+	s.cfg = cfg.ImportSchedule
+	metrics.ImportSlots.Set(float64(s.cfg.MaxConcurrent))
+}
+
+// Admit returns a ScheduleError if the import of the Tag can't start now.
+// Otherwise it returns a function to be called once the import is done,
+// releasing the slot taken for it.
+func (s *ImportScheduler) Admit(ctx context.Context, it *imagtagv1.Tag) (func(), error) {
+	s.Lock()
+	cfg := s.cfg
+	now := s.now()
+	s.Unlock()
+
+	for _, blackout := range cfg.Blackouts {
+		if blackout.Active(now) {
+			metrics.HeldImports.WithLabelValues("blackout").Inc()
+			return nil, &ScheduleError{Blackout: blackout.Name}
+		}
+	}
+	if cfg.MaxConcurrent == 0 {
+		return func() {}, nil
+	}
+
+	identity := fmt.Sprintf("%s/%s/%s", s.identity, it.Namespace, it.Name)
+	for i := 0; i < cfg.MaxConcurrent; i++ {
+		slot := NewLeaderElector(s.corcli, s.namespace, ImportSlotName(i), identity)
+		ok, err := slot.tryAcquireOrRenew(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error acquiring import slot: %w", err)
+		}
+		if ok {
+			return s.hold(slot), nil
+		}
+	}
+	metrics.HeldImports.WithLabelValues("budget").Inc()
+	return nil, &ScheduleError{MaxConcurrent: cfg.MaxConcurrent}
+}
+
+// hold renews the slot Lease until the returned function is called, the
+// Lease is then released. Failing to renew the Lease does not stop the
+// import, at worst another import takes the slot once the Lease expires.
+func (s *ImportScheduler) hold(slot *LeaderElector) func() {
+	metrics.ImportSlotsHeld.Inc()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(slot.renew)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			rctx, rcancel := context.WithTimeout(ctx, slot.renew)
+			ok, err := slot.tryAcquireOrRenew(rctx)
+			rcancel()
+			if err != nil && ctx.Err() == nil {
+				klog.Errorf("error renewing import slot %s: %s", slot.name, err)
+			} else if !ok && err == nil {
+				klog.Warningf("import slot %s taken by another import", slot.name)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		slot.release()
+		metrics.ImportSlotsHeld.Dec()
+	}
+}
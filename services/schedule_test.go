@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestImportSchedulerBudget(t *testing.T) {
+	ctx := context.Background()
+	corcli := fake.NewSimpleClientset()
+	tag := func(name string) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		}
+	}
+
+	// two replicas share the same budget.
+	first := NewImportScheduler(corcli, "tagger", "first")
+	second := NewImportScheduler(corcli, "tagger", "second")
+	cfg := config.Default()
+	cfg.ImportSchedule.MaxConcurrent = 2
+	first.ApplyConfig(cfg)
+	second.ApplyConfig(cfg)
+
+	releaseA, err := first.Admit(ctx, tag("a"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	releaseB, err := second.Admit(ctx, tag("b"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer releaseB()
+
+	_, err = first.Admit(ctx, tag("c"))
+	serr, ok := err.(*ScheduleError)
+	if !ok {
+		t.Fatalf("expected schedule error, %v received", err)
+	}
+	if serr.Reason() != imagtagv1.ReasonImportBudget {
+		t.Errorf("unexpected reason %s", serr.Reason())
+	}
+
+	lease, err := corcli.CoordinationV1().Leases("tagger").Get(
+		ctx, ImportSlotName(1), metav1.GetOptions{},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if holder := *lease.Spec.HolderIdentity; holder != "second/default/b" {
+		t.Errorf("unexpected slot holder %s", holder)
+	}
+
+	// a released slot is taken right away.
+	releaseA()
+	releaseC, err := second.Admit(ctx, tag("c"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	releaseC()
+
+	// without a budget imports are never held back.
+	cfg.ImportSchedule.MaxConcurrent = 0
+	first.ApplyConfig(cfg)
+	for i := 0; i < 5; i++ {
+		release, err := first.Admit(ctx, tag(fmt.Sprintf("tag%d", i)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer release()
+	}
+}
+
+func TestImportSchedulerBlackout(t *testing.T) {
+	ctx := context.Background()
+	sched := NewImportScheduler(fake.NewSimpleClientset(), "tagger", "first")
+	cfg := config.Default()
+	cfg.ImportSchedule.Blackouts = []config.Blackout{
+		{Name: "batch", Start: "22:00", Duration: 4 * time.Hour},
+	}
+	sched.ApplyConfig(cfg)
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tag"},
+	}
+
+	sched.now = func() time.Time { return time.Date(2021, 1, 4, 23, 0, 0, 0, time.UTC) }
+	_, err := sched.Admit(ctx, it)
+	serr, ok := err.(*ScheduleError)
+	if !ok {
+		t.Fatalf("expected schedule error, %v received", err)
+	}
+	if serr.Reason() != imagtagv1.ReasonBlackout || serr.Blackout != "batch" {
+		t.Errorf("unexpected schedule error %+v", serr)
+	}
+
+	sched.now = func() time.Time { return time.Date(2021, 1, 4, 12, 0, 0, 0, time.UTC) }
+	release, err := sched.Admit(ctx, it)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	release()
+}
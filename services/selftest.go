@@ -0,0 +1,397 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	authv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corecli "k8s.io/client-go/kubernetes"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// CheckResult holds the outcome of a single self test check.
+type CheckResult struct {
+	Name    string
+	Passed  bool
+	Message string
+}
+
+// permission is an action tagger needs to be allowed to execute against the
+// kubernetes api.
+type permission struct {
+	verb     string
+	group    string
+	resource string
+}
+
+// requiredPermissions lists all actions tagger executes against the api.
+var requiredPermissions = []permission{
+	{"get", imagtagv1.SchemeGroupVersion.Group, "tags"},
+	{"list", imagtagv1.SchemeGroupVersion.Group, "tags"},
+	{"watch", imagtagv1.SchemeGroupVersion.Group, "tags"},
+	{"update", imagtagv1.SchemeGroupVersion.Group, "tags"},
+	{"list", "apps", "deployments"},
+	{"watch", "apps", "deployments"},
+	{"update", "apps", "deployments"},
+	{"list", "apps", "replicasets"},
+	{"watch", "apps", "replicasets"},
+	{"list", "", "configmaps"},
+	{"watch", "", "configmaps"},
+	{"list", "", "secrets"},
+	{"watch", "", "secrets"},
+	{"list", "", "serviceaccounts"},
+	{"watch", "", "serviceaccounts"},
+	{"list", "", "namespaces"},
+	{"watch", "", "namespaces"},
+}
+
+// SelfTest validates that tagger has been properly installed. It checks for
+// a valid configuration, RBAC permissions, CRD presence, webhook certificate
+// validity and registry connectivity, over IPv6 as well if we have an IPv6
+// address, for every registry referenced by existing Tags.
+type SelfTest struct {
+	corcli    corecli.Interface
+	tagcli    tagclient.Interface
+	impsvc    *Importer
+	namespace string
+	certPath  string
+	httpcli   *http.Client
+	resolver  *net.Resolver
+	dialer    *net.Dialer
+	// localAddrs returns the addresses of our network interfaces.
+	localAddrs func() ([]net.Addr, error)
+}
+
+// NewSelfTest returns a self test runner. The configuration is read from the
+// provided namespace, certPath points to the certificate used by the mutating
+// webhook.
+func NewSelfTest(
+	corcli corecli.Interface, tagcli tagclient.Interface, namespace, certPath string,
+) *SelfTest {
+	return &SelfTest{
+		corcli:    corcli,
+		tagcli:    tagcli,
+		impsvc:    NewImporter(nil, nil),
+		namespace: namespace,
+		certPath:  certPath,
+		httpcli:   &http.Client{Timeout: 10 * time.Second},
+		resolver:  net.DefaultResolver,
+		dialer:    &net.Dialer{Timeout: 10 * time.Second},
+
+		localAddrs: net.InterfaceAddrs,
+	}
+}
+
+// Run executes all checks and returns their results. The configuration is
+// checked, and applied, first so registries are probed as imports reach them.
+func (s *SelfTest) Run(ctx context.Context) []CheckResult {
+	results := []CheckResult{s.checkConfig(ctx), s.checkCRD()}
+	results = append(results, s.checkPermissions(ctx)...)
+	results = append(results, s.checkCertificate())
+	results = append(results, s.checkRegistries(ctx)...)
+	return results
+}
+
+// checkConfig verifies the configuration ConfigMap, if present, is valid and
+// applies it. Defaults are applied if it is not present or invalid.
+func (s *SelfTest) checkConfig(ctx context.Context) CheckResult {
+	res := CheckResult{Name: "configuration"}
+	cm, err := s.corcli.CoreV1().ConfigMaps(s.namespace).Get(
+		ctx, config.ConfigMapName, metav1.GetOptions{},
+	)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			res.Message = fmt.Sprintf("unable to read configuration: %s", err)
+			return res
+		}
+		res.Passed = true
+		res.Message = fmt.Sprintf(
+			"%s/%s not found, using defaults", s.namespace, config.ConfigMapName,
+		)
+		return res
+	}
+
+	cfg, err := config.Parse(cm.Data[config.ConfigMapKey])
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	s.impsvc.ApplyConfig(cfg)
+	res.Passed = true
+	res.Message = fmt.Sprintf("%s/%s applied", s.namespace, config.ConfigMapName)
+	return res
+}
+
+// checkCRD verifies that the Tag custom resource definition is installed.
+func (s *SelfTest) checkCRD() CheckResult {
+	res := CheckResult{Name: "tag custom resource definition"}
+	gv := imagtagv1.SchemeGroupVersion.String()
+	list, err := s.corcli.Discovery().ServerResourcesForGroupVersion(gv)
+	if err != nil {
+		res.Message = fmt.Sprintf("unable to discover %s: %s", gv, err)
+		return res
+	}
+
+	for _, rsc := range list.APIResources {
+		if rsc.Name != "tags" {
+			continue
+		}
+		res.Passed = true
+		res.Message = fmt.Sprintf("%s tags found", gv)
+		return res
+	}
+	res.Message = fmt.Sprintf("tags not found in %s", gv)
+	return res
+}
+
+// checkPermissions verifies, through SelfSubjectAccessReviews, that we are
+// allowed to execute all actions we need.
+func (s *SelfTest) checkPermissions(ctx context.Context) []CheckResult {
+	var results []CheckResult
+	for _, perm := range requiredPermissions {
+		res := CheckResult{
+			Name: fmt.Sprintf("permission to %s %s", perm.verb, perm.resource),
+		}
+
+		review := &authv1.SelfSubjectAccessReview{
+			Spec: authv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authv1.ResourceAttributes{
+					Verb:     perm.verb,
+					Group:    perm.group,
+					Resource: perm.resource,
+				},
+			},
+		}
+
+		review, err := s.corcli.AuthorizationV1().SelfSubjectAccessReviews().Create(
+			ctx, review, metav1.CreateOptions{},
+		)
+		if err != nil {
+			res.Message = fmt.Sprintf("unable to review access: %s", err)
+			results = append(results, res)
+			continue
+		}
+
+		res.Passed = review.Status.Allowed
+		res.Message = "allowed"
+		if !res.Passed {
+			res.Message = fmt.Sprintf("denied %s", review.Status.Reason)
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// checkCertificate verifies the webhook certificate can be parsed and is
+// not expired or about to expire.
+func (s *SelfTest) checkCertificate() CheckResult {
+	res := CheckResult{Name: "webhook certificate"}
+	data, err := ioutil.ReadFile(s.certPath)
+	if err != nil {
+		res.Message = fmt.Sprintf("unable to read certificate: %s", err)
+		return res
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		res.Message = "no pem data found in certificate"
+		return res
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		res.Message = fmt.Sprintf("unable to parse certificate: %s", err)
+		return res
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		res.Message = fmt.Sprintf("certificate not valid before %s", cert.NotBefore)
+	case now.After(cert.NotAfter):
+		res.Message = fmt.Sprintf("certificate expired on %s", cert.NotAfter)
+	case now.Add(30 * 24 * time.Hour).After(cert.NotAfter):
+		res.Passed = true
+		res.Message = fmt.Sprintf("certificate expires soon (%s)", cert.NotAfter)
+	default:
+		res.Passed = true
+		res.Message = fmt.Sprintf("certificate valid until %s", cert.NotAfter)
+	}
+	return res
+}
+
+// registriesInUse returns the distinct registries referenced by all Tags in
+// the cluster.
+func (s *SelfTest) registriesInUse(ctx context.Context) ([]string, error) {
+	tags, err := s.tagcli.ImagesV1().Tags("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	uniq := map[string]bool{}
+	for _, tag := range tags.Items {
+		domain, _ := s.impsvc.SplitRegistryDomain(tag.Spec.From)
+		if domain != "" {
+			uniq[domain] = true
+			continue
+		}
+		for _, reg := range s.impsvc.syssvc.UnqualifiedRegistries(ctx) {
+			uniq[reg] = true
+		}
+	}
+
+	var registries []string
+	for reg := range uniq {
+		registries = append(registries, reg)
+	}
+	sort.Strings(registries)
+	return registries, nil
+}
+
+// checkRegistries verifies we can reach every registry referenced by Tags.
+// A registry is considered reachable if its /v2/ endpoint replies with 200
+// or 401 (authentication required). If we have an IPv6 address registries
+// are also checked to be reachable over IPv6.
+func (s *SelfTest) checkRegistries(ctx context.Context) []CheckResult {
+	registries, err := s.registriesInUse(ctx)
+	if err != nil {
+		return []CheckResult{
+			{
+				Name:    "registry connectivity",
+				Message: fmt.Sprintf("unable to list tags: %s", err),
+			},
+		}
+	}
+
+	ipv4, ipv6, err := s.localFamilies()
+	if err != nil {
+		return []CheckResult{
+			{
+				Name:    "registry connectivity",
+				Message: fmt.Sprintf("unable to read local addresses: %s", err),
+			},
+		}
+	}
+
+	var results []CheckResult
+	for _, reg := range registries {
+		host := reg
+		if reg == "docker.io" {
+			host = "registry-1.docker.io"
+		}
+		results = append(results, s.checkRegistry(ctx, reg, host))
+		if ipv6 {
+			results = append(results, s.checkRegistryIPv6(ctx, reg, host, ipv4))
+		}
+	}
+	return results
+}
+
+// checkRegistry verifies we can reach the /v2/ endpoint of the registry at
+// host.
+func (s *SelfTest) checkRegistry(ctx context.Context, reg, host string) CheckResult {
+	res := CheckResult{Name: fmt.Sprintf("registry %s connectivity", reg)}
+	url := fmt.Sprintf("https://%s/v2/", host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+
+	// probes carry the configured User-Agent so registries behind an
+	// allow-list relying on it are reported as reachable.
+	if agent := s.impsvc.syssvc.UserAgentFor(reg); agent != "" {
+		req.Header.Set("User-Agent", agent)
+	}
+
+	resp, err := s.httpcli.Do(req)
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	resp.Body.Close()
+
+	res.Message = resp.Status
+	res.Passed = resp.StatusCode == http.StatusOK
+	res.Passed = res.Passed || resp.StatusCode == http.StatusUnauthorized
+	return res
+}
+
+// localFamilies returns if we have global unicast IPv4 and IPv6 addresses.
+func (s *SelfTest) localFamilies() (bool, bool, error) {
+	addrs, err := s.localAddrs()
+	if err != nil {
+		return false, false, err
+	}
+
+	var ipv4, ipv6 bool
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			ipv4 = true
+			continue
+		}
+		ipv6 = true
+	}
+	return ipv4, ipv6, nil
+}
+
+// checkRegistryIPv6 verifies we can connect to the registry at host over
+// IPv6. Registries without IPv6 addresses only fail the check if we have no
+// IPv4 address to reach them through, i.e. on IPv6 only clusters.
+func (s *SelfTest) checkRegistryIPv6(
+	ctx context.Context, reg, host string, ipv4 bool,
+) CheckResult {
+	res := CheckResult{Name: fmt.Sprintf("registry %s ipv6 connectivity", reg)}
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, "443"
+	}
+
+	addrs, err := s.resolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		res.Message = fmt.Sprintf("unable to resolve %s: %s", hostname, err)
+		return res
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		res.Passed = ipv4
+		res.Message = fmt.Sprintf("%s has no ipv6 address", hostname)
+		return res
+	}
+
+	for _, ip := range ips {
+		conn, derr := s.dialer.DialContext(ctx, "tcp6", net.JoinHostPort(ip.String(), port))
+		if derr != nil {
+			err = derr
+			continue
+		}
+		conn.Close()
+		res.Passed = true
+		res.Message = fmt.Sprintf("connected to %s", ip)
+		return res
+	}
+	res.Message = err.Error()
+	return res
+}
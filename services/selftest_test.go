@@ -0,0 +1,293 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedisco "k8s.io/client-go/discovery/fake"
+	corfake "k8s.io/client-go/kubernetes/fake"
+	clitesting "k8s.io/client-go/testing"
+
+	"github.com/ricardomaraschini/tagger/config"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func writeCert(t *testing.T, dir string, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tagger"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %s", err)
+	}
+
+	path := filepath.Join(dir, "server.crt")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("unable to write certificate: %s", err)
+	}
+	return path
+}
+
+func TestSelfTest(t *testing.T) {
+	// the registry refuses requests without the User-Agent it requires,
+	// if any, as a WAF would.
+	var mtx sync.Mutex
+	var required string
+	registry := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if required != "" && r.Header.Get("User-Agent") != required {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+		}),
+	)
+	defer registry.Close()
+	reghost := strings.TrimPrefix(registry.URL, "https://")
+
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct {
+		name     string
+		allowed  bool
+		crd      bool
+		notAfter time.Time
+		config   string
+		agent    string
+		failures []string
+	}{
+		{
+			name:     "happy path",
+			allowed:  true,
+			crd:      true,
+			notAfter: time.Now().Add(365 * 24 * time.Hour),
+		},
+		{
+			name:     "configured user agent",
+			allowed:  true,
+			crd:      true,
+			notAfter: time.Now().Add(365 * 24 * time.Hour),
+			config:   "registryRequests:\n  userAgent: tagger/acme\n",
+			agent:    "tagger/acme",
+		},
+		{
+			name:     "invalid configuration",
+			allowed:  true,
+			crd:      true,
+			notAfter: time.Now().Add(365 * 24 * time.Hour),
+			config:   "unknown: true\n",
+			failures: []string{"configuration"},
+		},
+		{
+			name:     "missing crd",
+			allowed:  true,
+			notAfter: time.Now().Add(365 * 24 * time.Hour),
+			failures: []string{"tag custom resource definition"},
+		},
+		{
+			name:     "expired certificate and no permissions",
+			crd:      true,
+			notAfter: time.Now().Add(-time.Minute),
+			failures: []string{
+				"webhook certificate",
+				"permission to get tags",
+				"permission to update deployments",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mtx.Lock()
+			required = tt.agent
+			mtx.Unlock()
+
+			corcli := corfake.NewSimpleClientset()
+			if tt.config != "" {
+				corcli = corfake.NewSimpleClientset(
+					&corev1.ConfigMap{
+						ObjectMeta: metav1.ObjectMeta{
+							Name:      config.ConfigMapName,
+							Namespace: "tagger",
+						},
+						Data: map[string]string{config.ConfigMapKey: tt.config},
+					},
+				)
+			}
+			corcli.PrependReactor(
+				"create", "selfsubjectaccessreviews",
+				func(clitesting.Action) (bool, runtime.Object, error) {
+					return true, &authv1.SelfSubjectAccessReview{
+						Status: authv1.SubjectAccessReviewStatus{
+							Allowed: tt.allowed,
+						},
+					}, nil
+				},
+			)
+			if tt.crd {
+				corcli.Discovery().(*fakedisco.FakeDiscovery).Resources = []*metav1.APIResourceList{
+					{
+						GroupVersion: imagtagv1.SchemeGroupVersion.String(),
+						APIResources: []metav1.APIResource{{Name: "tags"}},
+					},
+				}
+			}
+
+			tagcli := tagfake.NewSimpleClientset(
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "tag",
+						Namespace: "default",
+					},
+					Spec: imagtagv1.TagSpec{
+						From: fmt.Sprintf("%s/repo/image:latest", reghost),
+					},
+				},
+			)
+
+			svc := NewSelfTest(corcli, tagcli, "tagger", writeCert(t, dir, tt.notAfter))
+			svc.httpcli = registry.Client()
+			svc.localAddrs = func() ([]net.Addr, error) {
+				return []net.Addr{
+					&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)},
+				}, nil
+			}
+
+			failed := map[string]bool{}
+			results := svc.Run(context.Background())
+			for _, res := range results {
+				if !res.Passed {
+					failed[res.Name] = true
+				}
+			}
+
+			for _, name := range tt.failures {
+				if !failed[name] {
+					t.Errorf("expected %q to fail", name)
+				}
+			}
+
+			regcheck := fmt.Sprintf("registry %s connectivity", reghost)
+			if failed[regcheck] {
+				t.Errorf("registry connectivity check failed")
+			}
+
+			if len(tt.failures) == 0 && len(failed) > 0 {
+				t.Errorf("unexpected failures: %v", failed)
+			}
+		})
+	}
+}
+
+func TestSelfTestIPv6(t *testing.T) {
+	lis, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 not supported: %s", err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	closed, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	closed.Close()
+
+	for _, tt := range []struct {
+		name   string
+		host   string
+		ipv4   bool
+		passed bool
+	}{
+		{
+			name:   "reachable over ipv6",
+			host:   lis.Addr().String(),
+			passed: true,
+		},
+		{
+			name: "unreachable over ipv6",
+			host: closed.Addr().String(),
+			ipv4: true,
+		},
+		{
+			name:   "no ipv6 address on dual stack",
+			host:   "127.0.0.1:5000",
+			ipv4:   true,
+			passed: true,
+		},
+		{
+			name: "no ipv6 address on ipv6 only",
+			host: "127.0.0.1:5000",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := NewSelfTest(nil, nil, "", "")
+			res := svc.checkRegistryIPv6(context.Background(), tt.host, tt.host, tt.ipv4)
+			if res.Passed != tt.passed {
+				t.Errorf("expected passed %v, %+v received", tt.passed, res)
+			}
+		})
+	}
+}
+
+func TestSelfTestLocalFamilies(t *testing.T) {
+	svc := NewSelfTest(nil, nil, "", "")
+	svc.localAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+	ipv4, ipv6, err := svc.localFamilies()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ipv4 || !ipv6 {
+		t.Errorf("expected ipv6 only, ipv4 %v ipv6 %v received", ipv4, ipv6)
+	}
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// Shard represents a deterministic slice of all namespaces in the cluster.
+// When running multiple controller replicas each one owns a shard and only
+// processes objects living in the namespaces that belong to it. Namespaces
+// are distributed among shards using jump consistent hashing, so growing
+// the number of shards moves as few namespaces as possible.
+type Shard struct {
+	index int
+	total int
+}
+
+// NewShard returns a Shard for the replica at position index out of total
+// replicas.
+func NewShard(index, total int) (*Shard, error) {
+	if total < 1 {
+		return nil, fmt.Errorf("invalid number of shards: %d", total)
+	}
+	if index < 0 || index >= total {
+		return nil, fmt.Errorf("shard index must be within [0, %d)", total)
+	}
+	metrics.ShardInfo.WithLabelValues(
+		strconv.Itoa(index), strconv.Itoa(total),
+	).Set(1)
+	return &Shard{
+		index: index,
+		total: total,
+	}, nil
+}
+
+// Owns returns true if the provided namespace belongs to this shard.
+func (s *Shard) Owns(namespace string) bool {
+	if s.total == 1 {
+		return true
+	}
+	return ShardFor(namespace, s.total) == s.index
+}
+
+// ShardFor returns the index of the shard, out of total, owning namespace.
+func ShardFor(namespace string, total int) int {
+	hash := fnv.New64a()
+	hash.Write([]byte(namespace))
+	return jumpHash(hash.Sum64(), total)
+}
+
+// jumpHash implements "A Fast, Minimal Memory, Consistent Hash Algorithm" by
+// John Lamping and Eric Veach. Returns a bucket in [0, buckets).
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
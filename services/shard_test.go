@@ -0,0 +1,95 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewShard(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		index int
+		total int
+		err   bool
+	}{
+		{
+			name:  "single shard",
+			index: 0,
+			total: 1,
+		},
+		{
+			name:  "no shards",
+			index: 0,
+			total: 0,
+			err:   true,
+		},
+		{
+			name:  "index out of bounds",
+			index: 3,
+			total: 3,
+			err:   true,
+		},
+		{
+			name:  "negative index",
+			index: -1,
+			total: 3,
+			err:   true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewShard(tt.index, tt.total)
+			if err != nil && !tt.err {
+				t.Errorf("unexpected error: %s", err)
+			} else if err == nil && tt.err {
+				t.Errorf("expecting error, nil received instead")
+			}
+		})
+	}
+}
+
+func TestShardOwns(t *testing.T) {
+	total := 4
+	var shards []*Shard
+	for i := 0; i < total; i++ {
+		shard, err := NewShard(i, total)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		shards = append(shards, shard)
+	}
+
+	owned := make([]int, total)
+	for i := 0; i < 1000; i++ {
+		ns := fmt.Sprintf("namespace-%d", i)
+		owners := 0
+		for idx, shard := range shards {
+			if !shard.Owns(ns) {
+				continue
+			}
+			owners++
+			owned[idx]++
+		}
+		if owners != 1 {
+			t.Fatalf("namespace %s owned by %d shards", ns, owners)
+		}
+	}
+
+	for idx, count := range owned {
+		if count < 150 {
+			t.Errorf("shard %d owns only %d namespaces", idx, count)
+		}
+	}
+}
+
+func TestShardForConsistency(t *testing.T) {
+	// growing from 4 to 5 shards must only move namespaces towards
+	// the new shard.
+	for i := 0; i < 1000; i++ {
+		ns := fmt.Sprintf("namespace-%d", i)
+		before := ShardFor(ns, 4)
+		after := ShardFor(ns, 5)
+		if before != after && after != 4 {
+			t.Errorf("namespace %s moved from %d to %d", ns, before, after)
+		}
+	}
+}
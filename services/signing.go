@@ -0,0 +1,126 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// GenerationSigner signs the generations imported into Tags with the
+// operator signing key, so the import history can be verified by anyone
+// holding the public key. Anyone able to write Tags may still edit their
+// status but can't forge a signature for a record they changed.
+type GenerationSigner struct {
+	sync.RWMutex
+	key ed25519.PrivateKey
+}
+
+// NewGenerationSigner returns a signer signing nothing until a signing key
+// is configured.
+func NewGenerationSigner() *GenerationSigner {
+	return &GenerationSigner{}
+}
+
+// ApplyConfig reads the configured signing key. If the key can't be read
+// the error is logged and generations are not signed until it can.
+func (g *GenerationSigner) ApplyConfig(cfg *config.Config) {
+	var key ed25519.PrivateKey
+	if cfg.SigningKey != "" {
+		var err error
+		if key, err = LoadSigningKey(cfg.SigningKey); err != nil {
+			klog.Errorf("generations won't be signed: %s", err)
+		}
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	g.key = key
+}
+
+// Sign sets the signature of a generation imported into the Tag. Nothing is
+// done if no signing key is configured.
+func (g *GenerationSigner) Sign(it *imagtagv1.Tag, hashref *imagtagv1.HashReference) {
+	g.RLock()
+	defer g.RUnlock()
+	if g.key == nil {
+		return
+	}
+	sig := ed25519.Sign(g.key, hashref.SigningPayload(it.Namespace, it.Name))
+	hashref.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+// VerifyGeneration checks the signature of a generation of the Tag with the
+// provided namespace and name against the public key.
+func VerifyGeneration(
+	pub ed25519.PublicKey, namespace, name string, hashref imagtagv1.HashReference,
+) error {
+	if hashref.Signature == "" {
+		return fmt.Errorf("generation %d not signed", hashref.Generation)
+	}
+	sig, err := base64.StdEncoding.DecodeString(hashref.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature for generation %d: %w", hashref.Generation, err)
+	}
+	if !ed25519.Verify(pub, hashref.SigningPayload(namespace, name), sig) {
+		return fmt.Errorf("signature mismatch for generation %d", hashref.Generation)
+	}
+	return nil
+}
+
+// readPEM returns the bytes of the first PEM block in the file at path.
+func readPEM(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no pem data found in %s", path)
+	}
+	return block.Bytes, nil
+}
+
+// LoadSigningKey reads a PEM encoded PKCS #8 ed25519 private key, as
+// generated by "openssl genpkey -algorithm ed25519".
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	edkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is not an ed25519 key")
+	}
+	return edkey, nil
+}
+
+// LoadVerifyingKey reads a PEM encoded PKIX ed25519 public key, as generated
+// by "openssl pkey -pubout".
+func LoadVerifyingKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	edkey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an ed25519 key")
+	}
+	return edkey, nil
+}
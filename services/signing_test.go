@@ -0,0 +1,151 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestGenerationSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagger-signing")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	privder, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pubder, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	privpath := filepath.Join(dir, "key.pem")
+	pubpath := filepath.Join(dir, "pub.pem")
+	for path, block := range map[string]*pem.Block{
+		privpath: {Type: "PRIVATE KEY", Bytes: privder},
+		pubpath:  {Type: "PUBLIC KEY", Bytes: pubder},
+	} {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "prod", Name: "app"},
+	}
+	newHashRef := func() imagtagv1.HashReference {
+		return imagtagv1.HashReference{
+			Generation:     3,
+			From:           "quay.io/company/app:latest",
+			ImportedAt:     metav1.NewTime(time.Date(2021, 1, 1, 12, 0, 0, 500, time.UTC)),
+			ImageReference: "quay.io/company/app@sha256:0123",
+			Trigger:        imagtagv1.ImportTriggerWebhook,
+		}
+	}
+
+	signer := NewGenerationSigner()
+	unsigned := newHashRef()
+	signer.Sign(it, &unsigned)
+	if unsigned.Signature != "" {
+		t.Errorf("expected no signature without a signing key")
+	}
+
+	cfg := config.Default()
+	cfg.SigningKey = privpath
+	signer.ApplyConfig(cfg)
+	verifier, err := LoadVerifyingKey(pubpath)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		tamper    func(*imagtagv1.HashReference)
+		namespace string
+		err       string
+	}{
+		{
+			name:      "valid",
+			namespace: "prod",
+		},
+		{
+			name:      "image reference changed",
+			namespace: "prod",
+			tamper: func(h *imagtagv1.HashReference) {
+				h.ImageReference = "quay.io/company/app@sha256:4567"
+			},
+			err: "signature mismatch for generation 3",
+		},
+		{
+			name:      "copied from another tag",
+			namespace: "dev",
+			err:       "signature mismatch for generation 3",
+		},
+		{
+			name:      "rollout changed",
+			namespace: "prod",
+			tamper: func(h *imagtagv1.HashReference) {
+				h.Rollout = imagtagv1.RolloutComplete
+			},
+		},
+		{
+			name:      "signature dropped",
+			namespace: "prod",
+			tamper: func(h *imagtagv1.HashReference) {
+				h.Signature = ""
+			},
+			err: "generation 3 not signed",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hashref := newHashRef()
+			signer.Sign(it, &hashref)
+
+			// signatures must survive the status being stored, where
+			// import times lose their sub second precision.
+			data, err := json.Marshal(hashref)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var stored imagtagv1.HashReference
+			if err := json.Unmarshal(data, &stored); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.tamper != nil {
+				tt.tamper(&stored)
+			}
+
+			err = VerifyGeneration(verifier, tt.namespace, it.Name, stored)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error %s", err)
+					return
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("invalid error %s", err)
+				}
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %s, nil received instead", tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/hashicorp/go-multierror"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// These are the checks of an import simulation, in the order they are made.
+// The digest check is only made for digest references and the platforms
+// check only for manifest lists when platforms are configured.
+const (
+	SimulationReference  = "reference"
+	SimulationRegistries = "registries"
+	SimulationBreaker    = "circuit breaker"
+	SimulationManifest   = "manifest"
+	SimulationMediaType  = "media type"
+	SimulationDigest     = "digest"
+	SimulationPlatforms  = "platforms"
+)
+
+// simulation accumulates the checks of an import simulation. Once a check
+// fails the following ones are skipped.
+type simulation struct {
+	imagtagv1.ImportSimulation
+}
+
+// check records the result of a check, err being nil for passed checks.
+func (s *simulation) check(name string, err error, message string) {
+	result := imagtagv1.SimulationCheck{
+		Name:    name,
+		Result:  imagtagv1.SimulationPassed,
+		Message: message,
+	}
+	if err != nil {
+		s.Accepted = false
+		result.Result = imagtagv1.SimulationFailed
+		result.Message = err.Error()
+	}
+	s.Checks = append(s.Checks, result)
+}
+
+// skip records the provided checks as skipped.
+func (s *simulation) skip(names ...string) {
+	for _, name := range names {
+		s.Checks = append(s.Checks, imagtagv1.SimulationCheck{
+			Name:   name,
+			Result: imagtagv1.SimulationSkipped,
+		})
+	}
+}
+
+// Simulate evaluates the checks an import of image into namespace would go
+// through, reading the manifest with the namespace credentials as an import
+// would, without importing anything. The registries are not marked as
+// failing or recovered by the simulation.
+func (i *Importer) Simulate(
+	ctx context.Context, namespace, image string,
+) *imagtagv1.ImportSimulation {
+	sim := &simulation{
+		ImportSimulation: imagtagv1.ImportSimulation{
+			Namespace: namespace,
+			Image:     image,
+			Accepted:  true,
+		},
+	}
+
+	if _, err := reference.ParseDockerRef(image); err != nil {
+		sim.check(SimulationReference, err, "")
+		sim.skip(SimulationRegistries, SimulationBreaker, SimulationManifest, SimulationMediaType)
+		return &sim.ImportSimulation
+	}
+	sim.check(SimulationReference, nil, "")
+
+	domain, remainder := i.SplitRegistryDomain(image)
+	candidates := i.syssvc.UnqualifiedRegistries(ctx)
+	if domain != "" {
+		candidates = []string{domain}
+	}
+	var registries []string
+	for _, registry := range candidates {
+		registries = append(registries, i.syssvc.MirrorsFor(registry)...)
+		registries = append(registries, registry)
+	}
+	if len(registries) == 0 {
+		sim.check(SimulationRegistries, fmt.Errorf("no registry candidates found"), "")
+		sim.skip(SimulationBreaker, SimulationManifest, SimulationMediaType)
+		return &sim.ImportSimulation
+	}
+	sim.check(SimulationRegistries, nil, strings.Join(registries, ", "))
+
+	var allowed, open []string
+	for _, registry := range registries {
+		if err := i.breaker.Check(registry); err != nil {
+			open = append(open, err.Error())
+			continue
+		}
+		allowed = append(allowed, registry)
+	}
+	if len(allowed) == 0 {
+		sim.check(SimulationBreaker, fmt.Errorf("%s", strings.Join(open, ", ")), "")
+		sim.skip(SimulationManifest, SimulationMediaType)
+		return &sim.ImportSimulation
+	}
+	message := "all circuits closed"
+	if len(open) > 0 {
+		message = strings.Join(open, ", ")
+	}
+	sim.check(SimulationBreaker, nil, message)
+
+	registry, blob, mime, err := i.readManifest(ctx, namespace, remainder, allowed)
+	if err != nil {
+		sim.check(SimulationManifest, err, "")
+		sim.skip(SimulationMediaType)
+		return &sim.ImportSimulation
+	}
+	sim.check(SimulationManifest, nil, fmt.Sprintf("read from %s", registry))
+
+	info, err := InspectManifest(blob, mime)
+	if err != nil {
+		sim.check(SimulationMediaType, err, "")
+		return &sim.ImportSimulation
+	}
+	message = info.MediaType
+	if info.Artifact {
+		message = fmt.Sprintf("%s, artifact of type %s", info.MediaType, info.ConfigMediaType)
+	}
+	sim.check(SimulationMediaType, nil, message)
+
+	it := &imagtagv1.Tag{Spec: imagtagv1.TagSpec{From: image}}
+	if pinned := it.PinnedDigest(); pinned != "" {
+		sim.check(SimulationDigest, VerifyDigest(blob, pinned), pinned)
+	}
+
+	i.Lock()
+	platforms := i.platforms
+	i.Unlock()
+	if len(platforms) > 0 && manifest.MIMETypeIsMultiImage(info.MediaType) {
+		var names []string
+		for _, platform := range platforms {
+			names = append(names, platform.String())
+		}
+		_, err := FilterManifestList(blob, info.MediaType, platforms)
+		sim.check(SimulationPlatforms, err, strings.Join(names, ", "))
+	}
+	return &sim.ImportSimulation
+}
+
+// readManifest reads the manifest of the image at remainder from the first of
+// the registries it can be read from, with the namespace credentials. Returns
+// the registry the manifest has been read from, the manifest and its type.
+func (i *Importer) readManifest(
+	ctx context.Context, namespace, remainder string, registries []string,
+) (string, []byte, string, error) {
+	var errors *multierror.Error
+	for _, registry := range registries {
+		named, err := reference.ParseDockerRef(fmt.Sprintf("%s/%s", registry, remainder))
+		if err != nil {
+			errors = multierror.Append(errors, err)
+			continue
+		}
+		imgref, err := docker.NewReference(named)
+		if err != nil {
+			errors = multierror.Append(errors, err)
+			continue
+		}
+		auths, err := i.syssvc.AuthsFor(ctx, imgref, namespace)
+		if err != nil {
+			errors = multierror.Append(errors, err)
+			continue
+		}
+		auths = append(auths, nil)
+
+		for _, auth := range auths {
+			sysctx := i.syssvc.Scratch(&types.SystemContext{
+				DockerAuthConfig:        auth,
+				DockerCertPath:          i.syssvc.CertDirFor(registry),
+				DockerRegistryUserAgent: i.syssvc.UserAgentFor(registry),
+			})
+			src, err := imgref.NewImageSource(ctx, sysctx)
+			if err != nil {
+				errors = multierror.Append(errors, err)
+				continue
+			}
+			blob, mime, err := src.GetManifest(ctx, nil)
+			src.Close()
+			if err != nil {
+				errors = multierror.Append(errors, err)
+				continue
+			}
+			return registry, blob, mime, nil
+		}
+	}
+	return "", nil, "", fmt.Errorf("unable to read manifest: %w", errors.ErrorOrNil())
+}
@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	coreinf "k8s.io/client-go/informers"
+	corfake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/ricardomaraschini/tagger/config"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestSimulate(t *testing.T) {
+	image := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size": 7023,
+			"digest": "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+		},
+		"layers": []
+	}`)
+	list := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests": [
+			{
+				"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+				"size": 7143,
+				"digest": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+				"platform": {"architecture": "amd64", "os": "linux"}
+			}
+		]
+	}`)
+	manifests := map[string]struct {
+		mime string
+		blob []byte
+	}{
+		"app":      {"application/vnd.docker.distribution.manifest.v2+json", image},
+		"list":     {"application/vnd.docker.distribution.manifest.list.v2+json", list},
+		"artifact": {"application/vnd.oci.artifact.manifest.v1+json", []byte(`{}`)},
+	}
+
+	registry := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/" {
+				return
+			}
+			parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/company/"), "/")
+			m, ok := manifests[parts[0]]
+			if !ok || len(parts) != 3 || parts[1] != "manifests" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", m.mime)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.blob).String())
+			w.Write(m.blob)
+		},
+	))
+	defer registry.Close()
+	reghost := strings.TrimPrefix(registry.URL, "https://")
+
+	dir, err := ioutil.TempDir("", "tagger-simulation-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	capem := pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: registry.Certificate().Raw},
+	)
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), capem, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		image     string
+		platforms []string
+		open      bool
+		accepted  bool
+		results   map[string]string
+		message   string
+	}{
+		{
+			name:     "accepted",
+			image:    reghost + "/company/app:latest",
+			accepted: true,
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationPassed,
+				SimulationBreaker:    imagtagv1.SimulationPassed,
+				SimulationManifest:   imagtagv1.SimulationPassed,
+				SimulationMediaType:  imagtagv1.SimulationPassed,
+			},
+		},
+		{
+			name:     "pinned digest",
+			image:    fmt.Sprintf("%s/company/app@%s", reghost, digest.FromBytes(image)),
+			accepted: true,
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationPassed,
+				SimulationBreaker:    imagtagv1.SimulationPassed,
+				SimulationManifest:   imagtagv1.SimulationPassed,
+				SimulationMediaType:  imagtagv1.SimulationPassed,
+				SimulationDigest:     imagtagv1.SimulationPassed,
+			},
+		},
+		{
+			name:      "platform available",
+			image:     reghost + "/company/list:latest",
+			platforms: []string{"linux/amd64"},
+			accepted:  true,
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationPassed,
+				SimulationBreaker:    imagtagv1.SimulationPassed,
+				SimulationManifest:   imagtagv1.SimulationPassed,
+				SimulationMediaType:  imagtagv1.SimulationPassed,
+				SimulationPlatforms:  imagtagv1.SimulationPassed,
+			},
+		},
+		{
+			name:      "platform not available",
+			image:     reghost + "/company/list:latest",
+			platforms: []string{"linux/arm64"},
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationPassed,
+				SimulationBreaker:    imagtagv1.SimulationPassed,
+				SimulationManifest:   imagtagv1.SimulationPassed,
+				SimulationMediaType:  imagtagv1.SimulationPassed,
+				SimulationPlatforms:  imagtagv1.SimulationFailed,
+			},
+			message: "no image for platforms",
+		},
+		{
+			name:  "unsupported media type",
+			image: reghost + "/company/artifact:latest",
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationPassed,
+				SimulationBreaker:    imagtagv1.SimulationPassed,
+				SimulationManifest:   imagtagv1.SimulationPassed,
+				SimulationMediaType:  imagtagv1.SimulationFailed,
+			},
+			message: "application/vnd.oci.artifact.manifest.v1+json",
+		},
+		{
+			name:  "unknown image",
+			image: reghost + "/company/other:latest",
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationPassed,
+				SimulationBreaker:    imagtagv1.SimulationPassed,
+				SimulationManifest:   imagtagv1.SimulationFailed,
+				SimulationMediaType:  imagtagv1.SimulationSkipped,
+			},
+			message: "unable to read manifest",
+		},
+		{
+			name:  "circuit open",
+			image: reghost + "/company/app:latest",
+			open:  true,
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationPassed,
+				SimulationBreaker:    imagtagv1.SimulationFailed,
+				SimulationManifest:   imagtagv1.SimulationSkipped,
+				SimulationMediaType:  imagtagv1.SimulationSkipped,
+			},
+			message: "import short-circuited",
+		},
+		{
+			name:  "no registries",
+			image: "centos:latest",
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationPassed,
+				SimulationRegistries: imagtagv1.SimulationFailed,
+				SimulationBreaker:    imagtagv1.SimulationSkipped,
+				SimulationManifest:   imagtagv1.SimulationSkipped,
+				SimulationMediaType:  imagtagv1.SimulationSkipped,
+			},
+			message: "no registry candidates found",
+		},
+		{
+			name:  "invalid reference",
+			image: "Invalid:Reference:",
+			results: map[string]string{
+				SimulationReference:  imagtagv1.SimulationFailed,
+				SimulationRegistries: imagtagv1.SimulationSkipped,
+				SimulationBreaker:    imagtagv1.SimulationSkipped,
+				SimulationManifest:   imagtagv1.SimulationSkipped,
+				SimulationMediaType:  imagtagv1.SimulationSkipped,
+			},
+			message: "invalid reference format",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			corcli := corfake.NewSimpleClientset()
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			imp := NewImporter(
+				corinf.Core().V1().ConfigMaps().Lister(),
+				corinf.Core().V1().Secrets().Lister(),
+			)
+
+			cfg := config.Default()
+			cfg.UnqualifiedRegistries = nil
+			cfg.ClientCertificates = map[string]string{reghost: dir}
+			cfg.Platforms = tt.platforms
+			imp.ApplyConfig(cfg)
+			if tt.open {
+				imp.breaker.states[reghost] = &breakerState{
+					open:         true,
+					failingSince: time.Now().Add(-time.Hour),
+					probedAt:     time.Now().Add(-time.Hour),
+				}
+			}
+
+			sim := imp.Simulate(context.Background(), "default", tt.image)
+			if sim.Accepted != tt.accepted {
+				t.Errorf("expected accepted %v: %+v", tt.accepted, sim.Checks)
+			}
+
+			results := map[string]string{}
+			var messages []string
+			for _, check := range sim.Checks {
+				results[check.Name] = check.Result
+				messages = append(messages, check.Message)
+			}
+			if !reflect.DeepEqual(results, tt.results) {
+				t.Errorf("expected results %v, %v received", tt.results, results)
+			}
+			if !strings.Contains(strings.Join(messages, "\n"), tt.message) {
+				t.Errorf("expected message %q in %v", tt.message, messages)
+			}
+
+			// a simulation never lets a probe through open circuits.
+			if tt.open && imp.breaker.Allow(reghost) != nil {
+				t.Errorf("probe consumed by the simulation")
+			}
+		})
+	}
+}
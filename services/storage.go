@@ -0,0 +1,194 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// BlobRecorder records the blobs referred by the manifests written to image
+// destinations. For manifest lists the blobs of every image in the list are
+// recorded, each blob is recorded only once.
+type BlobRecorder struct {
+	mtx   sync.Mutex
+	blobs map[string]int64
+}
+
+// NewBlobRecorder returns an empty blob recorder.
+func NewBlobRecorder() *BlobRecorder {
+	return &BlobRecorder{blobs: map[string]int64{}}
+}
+
+// ImageReference wraps provided image reference so the blobs referred by the
+// manifests written to its image destinations are recorded.
+func (b *BlobRecorder) ImageReference(ref types.ImageReference) types.ImageReference {
+	return &recordedReference{
+		ImageReference: ref,
+		recorder:       b,
+	}
+}
+
+// Blobs returns the recorded blobs sorted by digest.
+func (b *BlobRecorder) Blobs() []imagtagv1.BlobReference {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if len(b.blobs) == 0 {
+		return nil
+	}
+
+	blobs := make([]imagtagv1.BlobReference, 0, len(b.blobs))
+	for dgst, size := range b.blobs {
+		blobs = append(blobs, imagtagv1.BlobReference{Digest: dgst, Size: size})
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Digest < blobs[j].Digest
+	})
+	return blobs
+}
+
+// record records the blobs referred by a manifest. Manifest lists don't
+// refer to blobs, the manifests of their images are written separately.
+func (b *BlobRecorder) record(blob []byte) error {
+	mime := manifest.GuessMIMEType(blob)
+	if manifest.MIMETypeIsMultiImage(mime) {
+		return nil
+	}
+
+	man, err := manifest.FromBlob(blob, mime)
+	if err != nil {
+		return fmt.Errorf("invalid %s manifest: %w", mime, err)
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, layer := range man.LayerInfos() {
+		b.blobs[layer.Digest.String()] = layer.Size
+	}
+	if config := man.ConfigInfo(); config.Digest != "" {
+		b.blobs[config.Digest.String()] = config.Size
+	}
+	return nil
+}
+
+// recordedReference is an image reference whose destinations record the
+// blobs referred by the manifests written to them.
+type recordedReference struct {
+	types.ImageReference
+	recorder *BlobRecorder
+}
+
+// NewImageDestination returns an image destination recording blobs.
+func (r *recordedReference) NewImageDestination(
+	ctx context.Context, sys *types.SystemContext,
+) (types.ImageDestination, error) {
+	dst, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &recordedDestination{
+		ImageDestination: dst,
+		recorder:         r.recorder,
+	}, nil
+}
+
+// recordedDestination is an image destination recording the blobs referred
+// by the manifests written to it.
+type recordedDestination struct {
+	types.ImageDestination
+	recorder *BlobRecorder
+}
+
+// PutManifest writes the manifest and records the blobs it refers to.
+func (d *recordedDestination) PutManifest(
+	ctx context.Context, blob []byte, instanceDigest *digest.Digest,
+) error {
+	if err := d.ImageDestination.PutManifest(ctx, blob, instanceDigest); err != nil {
+		return err
+	}
+	if err := d.recorder.record(blob); err != nil {
+		klog.V(2).Infof("unable to record blobs: %s", err)
+	}
+	return nil
+}
+
+// StorageUsage is a prometheus collector reporting how much the blobs of all
+// Tag generations take in the cache registry. Blobs are stored only once by
+// the registry no matter how many Tags and generations refer to them, the
+// ratio between referenced and stored bytes informs the registry sizing. As
+// TagStates it reads Tags from the cache and honors the shard.
+type StorageUsage struct {
+	taglis taglist.TagLister
+	shard  *Shard
+}
+
+// NewStorageUsage returns a collector for cache registry storage usage. Shard
+// may be nil, meaning all namespaces are reported.
+func NewStorageUsage(taglis taglist.TagLister, shard *Shard) *StorageUsage {
+	return &StorageUsage{
+		taglis: taglis,
+		shard:  shard,
+	}
+}
+
+// Describe sends the description of the storage gauges.
+func (s *StorageUsage) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.MirrorReferencedBytesDesc
+	ch <- metrics.MirrorStoredBytesDesc
+	ch <- metrics.MirrorDedupRatioDesc
+}
+
+// Collect sums the blobs of all Tag generations. The dedup ratio is one when
+// nothing has been mirrored.
+func (s *StorageUsage) Collect(ch chan<- prometheus.Metric) {
+	tags, err := s.taglis.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("unable to list tags for metrics: %s", err)
+		return
+	}
+
+	var referenced, stored int64
+	seen := map[string]bool{}
+	for _, it := range tags {
+		if s.shard != nil && !s.shard.Owns(it.Namespace) {
+			continue
+		}
+		for _, hashref := range it.Status.References {
+			for _, blob := range hashref.Blobs {
+				referenced += blob.Size
+				if seen[blob.Digest] {
+					continue
+				}
+				seen[blob.Digest] = true
+				stored += blob.Size
+			}
+		}
+	}
+
+	ratio := 1.0
+	if stored > 0 {
+		ratio = float64(referenced) / float64(stored)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		metrics.MirrorReferencedBytesDesc, prometheus.GaugeValue, float64(referenced),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		metrics.MirrorStoredBytesDesc, prometheus.GaugeValue, float64(stored),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		metrics.MirrorDedupRatioDesc, prometheus.GaugeValue, ratio,
+	)
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestBlobRecorderRecord(t *testing.T) {
+	image := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"config": {
+			"mediaType": "application/vnd.docker.container.image.v1+json",
+			"size": 10,
+			"digest": "sha256:c0"
+		},
+		"layers": [
+			{
+				"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				"size": 100,
+				"digest": "sha256:a1"
+			},
+			{
+				"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				"size": 200,
+				"digest": "sha256:b2"
+			}
+		]
+	}`)
+	list := []byte(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+		"manifests": []
+	}`)
+
+	recorder := NewBlobRecorder()
+	if blobs := recorder.Blobs(); blobs != nil {
+		t.Errorf("expected no blobs, received %v", blobs)
+	}
+
+	for _, blob := range [][]byte{image, list, image} {
+		if err := recorder.record(blob); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := recorder.record([]byte("{")); err == nil {
+		t.Errorf("expected error recording invalid manifest")
+	}
+
+	expected := []imagtagv1.BlobReference{
+		{Digest: "sha256:a1", Size: 100},
+		{Digest: "sha256:b2", Size: 200},
+		{Digest: "sha256:c0", Size: 10},
+	}
+	if blobs := recorder.Blobs(); !reflect.DeepEqual(blobs, expected) {
+		t.Errorf("expected %v, received %v", expected, blobs)
+	}
+}
+
+func TestStorageUsageCollect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newTag := func(namespace, name string, blobs ...[]imagtagv1.BlobReference) *imagtagv1.Tag {
+		it := &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+		}
+		for i, gen := range blobs {
+			it.Status.References = append(
+				it.Status.References,
+				imagtagv1.HashReference{Generation: int64(i), Blobs: gen},
+			)
+		}
+		return it
+	}
+
+	base := imagtagv1.BlobReference{Digest: "sha256:base", Size: 300}
+	app1 := imagtagv1.BlobReference{Digest: "sha256:app1", Size: 50}
+	app2 := imagtagv1.BlobReference{Digest: "sha256:app2", Size: 50}
+
+	objects := []runtime.Object{
+		newTag(
+			"team-a", "one",
+			[]imagtagv1.BlobReference{base, app1},
+			[]imagtagv1.BlobReference{base, app2},
+		),
+		newTag("team-b", "two", []imagtagv1.BlobReference{base, app2}),
+		newTag("team-b", "three"),
+	}
+
+	tagcli := tagfake.NewSimpleClientset(objects...)
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewStorageUsage(taglis, nil))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	values := map[string]float64{}
+	for _, family := range families {
+		values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+	}
+
+	for name, expected := range map[string]float64{
+		"tagger_mirror_referenced_bytes": 1050,
+		"tagger_mirror_stored_bytes":     400,
+		"tagger_mirror_dedup_ratio":      2.625,
+	} {
+		if values[name] != expected {
+			t.Errorf("expected %v for %s, %v received", expected, name, values[name])
+		}
+	}
+}
@@ -2,11 +2,17 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	corelister "k8s.io/client-go/listers/core/v1"
 	"k8s.io/klog/v2"
@@ -15,14 +21,78 @@ import (
 
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/types"
+
+	"github.com/ricardomaraschini/tagger/config"
 )
 
+// SharedCredentialsNamespacesAnnotation, when present on a Secret in the
+// credentials namespace, holds a comma separated list of namespaces allowed
+// to use it. Secrets without it may be used by all namespaces.
+const SharedCredentialsNamespacesAnnotation = "image-tag-namespaces"
+
+// DefaultServiceAccount is the ServiceAccount whose image pull secrets are
+// used by imports when reading credentials from the service account.
+const DefaultServiceAccount = "default"
+
 // We use dockerAuthConfig to unmarshal a default docker configuration present on
 // secrets of type SecretTypeDockerConfigJson. XXX doesn't containers/image export
 // a similar structure? Of maybe even a function to parse a docker configuration
 // file?
 type dockerAuthConfig struct {
-	Auths map[string]types.DockerAuthConfig
+	Auths map[string]registryAuth
+}
+
+// registryAuth is an authentication in a docker configuration. Besides the
+// username and password written by kubectl, config files written by docker,
+// helm registry login and oras only hold the base64 encoded user:password
+// in Auth, token based logins hold a refresh token in IdentityToken.
+type registryAuth struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// dockerAuth returns the authentication, decoding Auth if needed.
+func (r registryAuth) dockerAuth() (*types.DockerAuthConfig, error) {
+	auth := &types.DockerAuthConfig{
+		Username:      r.Username,
+		Password:      r.Password,
+		IdentityToken: r.IdentityToken,
+	}
+	if auth.Username != "" || r.Auth == "" {
+		return auth, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(r.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth: %w", err)
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid auth, expected user:password")
+	}
+	auth.Username, auth.Password = parts[0], parts[1]
+	return auth, nil
+}
+
+// registryHost returns the registry host a docker configuration key refers
+// to. Keys are written as urls by some tools, e.g. https://index.docker.io/v1/
+// by docker or https://registry.io by helm, docker hub aliases are mapped to
+// docker.io.
+func registryHost(key string) string {
+	host := key
+	if idx := strings.Index(host, "://"); idx >= 0 {
+		host = host[idx+3:]
+	}
+	if idx := strings.Index(host, "/"); idx >= 0 {
+		host = host[:idx]
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return host
 }
 
 // LocalRegistryHostingV1 describes a local registry that developer tools can
@@ -76,9 +146,17 @@ type LocalRegistryHostingV1 struct {
 // with things such as configured docker authentications or unqualified
 // registries configs.
 type SysContext struct {
+	sync.RWMutex
 	sclister              corelister.SecretLister
 	cmlister              corelister.ConfigMapLister
+	salister              corelister.ServiceAccountLister
 	unqualifiedRegistries []string
+	registryMirrors       map[string][]string
+	clientCertificates    map[string]string
+	registryRequests      config.RegistryRequests
+	credentialsNamespace  string
+	credentialsSource     string
+	scratchDir            string
 }
 
 // NewSysContext returns a new SysContext helper.
@@ -88,17 +166,87 @@ func NewSysContext(
 	return &SysContext{
 		sclister:              sclister,
 		cmlister:              cmlister,
-		unqualifiedRegistries: []string{"docker.io"},
+		unqualifiedRegistries: config.Default().UnqualifiedRegistries,
+		credentialsSource:     config.Default().CredentialsSource,
+		scratchDir:            config.Default().ScratchDir,
 	}
 }
 
+// PullSecretsFrom sets where the ServiceAccounts are read from when reading
+// credentials from the namespace default ServiceAccount image pull secrets.
+// Only the default ServiceAccounts need to be known.
+func (s *SysContext) PullSecretsFrom(salister corelister.ServiceAccountLister) {
+	s.Lock()
+	defer s.Unlock()
+	s.salister = salister
+}
+
+// ApplyConfig updates unqualified registries, registry mirrors, client
+// certificates, registry request headers, the credentials source, the shared
+// credentials namespace and the scratch directory according to provided
+// configuration.
+func (s *SysContext) ApplyConfig(cfg *config.Config) {
+	s.Lock()
+	defer s.Unlock()
+	s.unqualifiedRegistries = cfg.UnqualifiedRegistries
+	s.registryMirrors = cfg.RegistryMirrors
+	s.clientCertificates = cfg.ClientCertificates
+	s.registryRequests = cfg.RegistryRequests
+	s.credentialsNamespace = cfg.CredentialsNamespace
+	s.credentialsSource = cfg.CredentialsSource
+	s.scratchDir = cfg.ScratchDir
+}
+
+// ScratchDir returns the directory we are allowed to write to, everything
+// else may be mounted read only.
+func (s *SysContext) ScratchDir() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.scratchDir
+}
+
+// Scratch points the places where the system context makes the image
+// library to write, i.e. the blob info cache and big temporary files, into
+// the scratch directory. Returns the provided system context.
+func (s *SysContext) Scratch(sysctx *types.SystemContext) *types.SystemContext {
+	dir := s.ScratchDir()
+	sysctx.BlobInfoCacheDir = filepath.Join(dir, "blob-info-cache")
+	sysctx.BigFilesTemporaryDir = dir
+	return sysctx
+}
+
 // UnqualifiedRegistries returns the list of unqualified registries
-// configured on the system. XXX here we should return the cluster
-// wide configuration for unqualified registries.
+// configured on the system.
 func (s *SysContext) UnqualifiedRegistries(ctx context.Context) []string {
+	s.RLock()
+	defer s.RUnlock()
 	return s.unqualifiedRegistries
 }
 
+// MirrorsFor returns the list of mirrors configured for a registry. Mirrors
+// should be attempted, in order, before the registry itself.
+func (s *SysContext) MirrorsFor(registry string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.registryMirrors[registry]
+}
+
+// CertDirFor returns the directory holding the client certificate used when
+// talking to a registry, empty if the registry does not use mutual TLS.
+func (s *SysContext) CertDirFor(registry string) string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.clientCertificates[registry]
+}
+
+// UserAgentFor returns the User-Agent sent to a registry, empty means the
+// default one.
+func (s *SysContext) UserAgentFor(registry string) string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.registryRequests.UserAgentFor(registry)
+}
+
 // parseCacheRegistryConfig reads configmap local-registry-hosting from kube-public
 // namespace, parses its content and returns the local registry configuration.
 func (s *SysContext) parseCacheRegistryConfig() (*LocalRegistryHostingV1, error) {
@@ -158,21 +306,109 @@ func (s *SysContext) CacheRegistryContext(ctx context.Context) *types.SystemCont
 
 // AuthsFor return configured authentications for the registry hosting
 // the image reference. Namespace is the namespace from where read docker
-// authentications.
+// authentications. Authentications shared through the credentials namespace
+// the namespace is allowed to use come last. When reading credentials from
+// the service account only the image pull secrets of the namespace default
+// ServiceAccount are used, in the order they are listed.
 func (s *SysContext) AuthsFor(
 	ctx context.Context, imgref types.ImageReference, namespace string,
 ) ([]*types.DockerAuthConfig, error) {
+	domain := reference.Domain(imgref.DockerReference())
+	if domain == "" {
+		return nil, nil
+	}
+
+	s.RLock()
+	source := s.credentialsSource
+	s.RUnlock()
+	if source == config.CredentialsFromServiceAccount {
+		secrets, err := s.pullSecrets(namespace)
+		if err != nil {
+			return nil, err
+		}
+		return authsFromSecrets(secrets, domain), nil
+	}
+
 	// XXX get secrets by type?
 	secrets, err := s.sclister.Secrets(namespace).List(labels.Everything())
 	if err != nil {
 		return nil, err
 	}
+	dockerAuths := authsFromSecrets(secrets, domain)
 
-	domain := reference.Domain(imgref.DockerReference())
-	if domain == "" {
-		return nil, nil
+	s.RLock()
+	credns := s.credentialsNamespace
+	s.RUnlock()
+	if credns == "" || credns == namespace {
+		return dockerAuths, nil
+	}
+
+	shared, err := s.sclister.Secrets(credns).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []*corev1.Secret
+	for _, sec := range shared {
+		if !sharedWith(sec, namespace) {
+			continue
+		}
+		allowed = append(allowed, sec)
+	}
+	return append(dockerAuths, authsFromSecrets(allowed, domain)...), nil
+}
+
+// pullSecrets returns the image pull secrets of the namespace default
+// ServiceAccount. As for pods, pull secrets that don't exist are ignored.
+func (s *SysContext) pullSecrets(namespace string) ([]*corev1.Secret, error) {
+	s.RLock()
+	salister := s.salister
+	s.RUnlock()
+	if salister == nil {
+		return nil, fmt.Errorf("service accounts are not being watched")
+	}
+
+	sa, err := salister.ServiceAccounts(namespace).Get(DefaultServiceAccount)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
+	var secrets []*corev1.Secret
+	for _, ref := range sa.ImagePullSecrets {
+		sec, err := s.sclister.Secrets(namespace).Get(ref.Name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				klog.V(2).Infof("pull secret %s/%s not found", namespace, ref.Name)
+				continue
+			}
+			return nil, err
+		}
+		secrets = append(secrets, sec)
+	}
+	return secrets, nil
+}
+
+// sharedWith returns true if the provided shared credentials Secret may be
+// used by namespace.
+func sharedWith(sec *corev1.Secret, namespace string) bool {
+	value, ok := sec.Annotations[SharedCredentialsNamespacesAnnotation]
+	if !ok {
+		return true
+	}
+	for _, ns := range strings.Split(value, ",") {
+		if strings.TrimSpace(ns) == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// authsFromSecrets returns the authentications for domain found in the docker
+// config secrets.
+func authsFromSecrets(secrets []*corev1.Secret, domain string) []*types.DockerAuthConfig {
 	var dockerAuths []*types.DockerAuthConfig
 	for _, sec := range secrets {
 		if sec.Type != corev1.SecretTypeDockerConfigJson {
@@ -190,12 +426,38 @@ func (s *SysContext) AuthsFor(
 			continue
 		}
 
-		sec, ok := cfg.Auths[domain]
+		regauth, ok := authForDomain(cfg, domain)
 		if !ok {
 			continue
 		}
 
-		dockerAuths = append(dockerAuths, &sec)
+		auth, err := regauth.dockerAuth()
+		if err != nil {
+			klog.Infof("ignoring secret %s/%s: %s", sec.Namespace, sec.Name, err)
+			continue
+		}
+		dockerAuths = append(dockerAuths, auth)
+	}
+	return dockerAuths
+}
+
+// authForDomain returns the authentication for domain in a docker config.
+// Keys matching the domain exactly take precedence over keys written as
+// urls, see registryHost.
+func authForDomain(cfg dockerAuthConfig, domain string) (registryAuth, bool) {
+	if auth, ok := cfg.Auths[domain]; ok {
+		return auth, true
+	}
+
+	keys := make([]string, 0, len(cfg.Auths))
+	for key := range cfg.Auths {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if registryHost(key) == domain {
+			return cfg.Auths[key], true
+		}
 	}
-	return dockerAuths, nil
+	return registryAuth{}, false
 }
@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -17,6 +18,8 @@ import (
 	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/types"
+
+	"github.com/ricardomaraschini/tagger/config"
 )
 
 func TestUnqualifiedRegistries(t *testing.T) {
@@ -32,12 +35,12 @@ func TestUnqualifiedRegistries(t *testing.T) {
 func TestAuthsFor(t *testing.T) {
 	auths, _ := json.Marshal(
 		dockerAuthConfig{
-			Auths: map[string]types.DockerAuthConfig{
-				"docker.io": types.DockerAuthConfig{
+			Auths: map[string]registryAuth{
+				"docker.io": registryAuth{
 					Username: "user",
 					Password: "pass",
 				},
-				"quay.io": types.DockerAuthConfig{
+				"quay.io": registryAuth{
 					Username: "another-user",
 					Password: "another-pass",
 				},
@@ -200,3 +203,349 @@ func TestAuthsFor(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthsForSharedCredentials(t *testing.T) {
+	auths, _ := json.Marshal(
+		dockerAuthConfig{
+			Auths: map[string]registryAuth{
+				"quay.io": {
+					Username: "robot",
+					Password: "pass",
+				},
+			},
+		},
+	)
+
+	secret := func(namespace, name, allowed string) *corev1.Secret {
+		sec := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: auths,
+			},
+		}
+		if allowed != "" {
+			sec.Annotations = map[string]string{
+				SharedCredentialsNamespacesAnnotation: allowed,
+			}
+		}
+		return sec
+	}
+
+	for _, tt := range []struct {
+		name       string
+		credns     string
+		namespace  string
+		authsCount int
+		objects    []runtime.Object
+	}{
+		{
+			name:      "shared credentials disabled",
+			namespace: "team-a",
+			objects: []runtime.Object{
+				secret("credentials", "robot", ""),
+			},
+		},
+		{
+			name:       "shared with all namespaces",
+			credns:     "credentials",
+			namespace:  "team-a",
+			authsCount: 1,
+			objects: []runtime.Object{
+				secret("credentials", "robot", ""),
+			},
+		},
+		{
+			name:       "namespace credentials and shared ones",
+			credns:     "credentials",
+			namespace:  "team-a",
+			authsCount: 2,
+			objects: []runtime.Object{
+				secret("credentials", "robot", ""),
+				secret("team-a", "own", ""),
+			},
+		},
+		{
+			name:       "restricted to other namespaces",
+			credns:     "credentials",
+			namespace:  "team-a",
+			authsCount: 1,
+			objects: []runtime.Object{
+				secret("credentials", "robot", "team-a, team-b"),
+				secret("credentials", "other", "team-b"),
+			},
+		},
+		{
+			name:       "credentials namespace itself",
+			credns:     "credentials",
+			namespace:  "credentials",
+			authsCount: 1,
+			objects: []runtime.Object{
+				secret("credentials", "robot", "team-b"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			fakecli := fake.NewSimpleClientset(tt.objects...)
+			informer := coreinf.NewSharedInformerFactory(fakecli, time.Minute)
+			seclis := informer.Core().V1().Secrets().Lister()
+			informer.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				informer.Core().V1().Secrets().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			cfg := config.Default()
+			cfg.CredentialsNamespace = tt.credns
+			sysctx := NewSysContext(nil, seclis)
+			sysctx.ApplyConfig(cfg)
+
+			ref, _ := reference.ParseDockerRef("quay.io/repo/image:latest")
+			imgref, _ := docker.NewReference(ref)
+			auths, err := sysctx.AuthsFor(ctx, imgref, tt.namespace)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(auths) != tt.authsCount {
+				t.Errorf("expecting %d, %d received", tt.authsCount, len(auths))
+			}
+		})
+	}
+}
+
+func TestAuthsForServiceAccount(t *testing.T) {
+	secret := func(name, user string) *corev1.Secret {
+		auths, _ := json.Marshal(
+			dockerAuthConfig{
+				Auths: map[string]registryAuth{
+					"quay.io": {Username: user, Password: "pass"},
+				},
+			},
+		)
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "team-a",
+				Name:      name,
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: auths,
+			},
+		}
+	}
+	account := func(name string, secrets ...string) *corev1.ServiceAccount {
+		sa := &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "team-a",
+				Name:      name,
+			},
+		}
+		for _, sec := range secrets {
+			sa.ImagePullSecrets = append(
+				sa.ImagePullSecrets, corev1.LocalObjectReference{Name: sec},
+			)
+		}
+		return sa
+	}
+
+	for _, tt := range []struct {
+		name    string
+		objects []runtime.Object
+		users   []string
+	}{
+		{
+			name: "pull secrets in order",
+			objects: []runtime.Object{
+				account(DefaultServiceAccount, "second", "first"),
+				secret("first", "first"),
+				secret("second", "second"),
+				secret("unused", "unused"),
+			},
+			users: []string{"second", "first"},
+		},
+		{
+			name: "missing pull secret",
+			objects: []runtime.Object{
+				account(DefaultServiceAccount, "missing", "first"),
+				secret("first", "first"),
+			},
+			users: []string{"first"},
+		},
+		{
+			name: "other service accounts",
+			objects: []runtime.Object{
+				account("builder", "first"),
+				secret("first", "first"),
+			},
+		},
+		{
+			name: "no pull secrets",
+			objects: []runtime.Object{
+				account(DefaultServiceAccount),
+				secret("first", "first"),
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			fakecli := fake.NewSimpleClientset(tt.objects...)
+			informer := coreinf.NewSharedInformerFactory(fakecli, time.Minute)
+			seclis := informer.Core().V1().Secrets().Lister()
+			salis := informer.Core().V1().ServiceAccounts().Lister()
+			informer.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				informer.Core().V1().Secrets().Informer().HasSynced,
+				informer.Core().V1().ServiceAccounts().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			cfg := config.Default()
+			cfg.CredentialsSource = config.CredentialsFromServiceAccount
+			sysctx := NewSysContext(nil, seclis)
+			sysctx.ApplyConfig(cfg)
+
+			ref, _ := reference.ParseDockerRef("quay.io/repo/image:latest")
+			imgref, _ := docker.NewReference(ref)
+			if _, err := sysctx.AuthsFor(ctx, imgref, "team-a"); err == nil {
+				t.Errorf("expected error without service accounts")
+			}
+
+			sysctx.PullSecretsFrom(salis)
+			auths, err := sysctx.AuthsFor(ctx, imgref, "team-a")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			var users []string
+			for _, auth := range auths {
+				users = append(users, auth.Username)
+			}
+			if !reflect.DeepEqual(users, tt.users) {
+				t.Errorf("expected users %v, %v received", tt.users, users)
+			}
+		})
+	}
+}
+
+func TestSysContextApplyConfig(t *testing.T) {
+	sysctx := NewSysContext(nil, nil)
+	cfg := config.Default()
+	cfg.UnqualifiedRegistries = []string{"quay.io", "docker.io"}
+	cfg.RegistryMirrors = map[string][]string{
+		"docker.io": {"mirror.local"},
+	}
+	cfg.ClientCertificates = map[string]string{
+		"registry.internal": "/etc/tagger/certs",
+	}
+	sysctx.ApplyConfig(cfg)
+
+	unq := sysctx.UnqualifiedRegistries(context.Background())
+	if !reflect.DeepEqual(unq, cfg.UnqualifiedRegistries) {
+		t.Errorf("unexpected unqualified registries: %v", unq)
+	}
+
+	mirrors := sysctx.MirrorsFor("docker.io")
+	if !reflect.DeepEqual(mirrors, []string{"mirror.local"}) {
+		t.Errorf("unexpected mirrors: %v", mirrors)
+	}
+
+	if mirrors := sysctx.MirrorsFor("quay.io"); len(mirrors) != 0 {
+		t.Errorf("unexpected mirrors for quay.io: %v", mirrors)
+	}
+
+	if dir := sysctx.CertDirFor("registry.internal"); dir != "/etc/tagger/certs" {
+		t.Errorf("unexpected client certificates dir: %q", dir)
+	}
+
+	if dir := sysctx.CertDirFor("quay.io"); dir != "" {
+		t.Errorf("unexpected client certificates dir for quay.io: %q", dir)
+	}
+
+	cfg.ScratchDir = "/var/run/tagger"
+	sysctx.ApplyConfig(cfg)
+	scratch := sysctx.Scratch(&types.SystemContext{})
+	if scratch.BlobInfoCacheDir != "/var/run/tagger/blob-info-cache" {
+		t.Errorf("unexpected blob info cache dir: %q", scratch.BlobInfoCacheDir)
+	}
+	if scratch.BigFilesTemporaryDir != "/var/run/tagger" {
+		t.Errorf("unexpected temporary dir: %q", scratch.BigFilesTemporaryDir)
+	}
+}
+
+func TestAuthsFromSecretsLoginConventions(t *testing.T) {
+	secret := func(cfg string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "creds"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(cfg)},
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		config   string
+		domain   string
+		expected []*types.DockerAuthConfig
+	}{
+		{
+			name:     "kubectl",
+			config:   `{"auths":{"quay.io":{"username":"user","password":"pass","auth":"eDp5"}}}`,
+			domain:   "quay.io",
+			expected: []*types.DockerAuthConfig{{Username: "user", Password: "pass"}},
+		},
+		{
+			name:     "helm registry login",
+			config:   `{"auths":{"ghcr.io":{"auth":"dXNlcjpwYXNzOndvcmQ="}}}`,
+			domain:   "ghcr.io",
+			expected: []*types.DockerAuthConfig{{Username: "user", Password: "pass:word"}},
+		},
+		{
+			name:     "oras token login",
+			config:   `{"auths":{"https://acr.io":{"auth":"MDAwMDA6","identitytoken":"token"}}}`,
+			domain:   "acr.io",
+			expected: []*types.DockerAuthConfig{{Username: "00000", IdentityToken: "token"}},
+		},
+		{
+			name:     "docker hub url",
+			config:   `{"auths":{"https://index.docker.io/v1/":{"auth":"dXNlcjpwYXNz"}}}`,
+			domain:   "docker.io",
+			expected: []*types.DockerAuthConfig{{Username: "user", Password: "pass"}},
+		},
+		{
+			name: "exact key first",
+			config: `{"auths":{` +
+				`"https://quay.io":{"auth":"dXJsOnBhc3M="},` +
+				`"quay.io":{"auth":"dXNlcjpwYXNz"}}}`,
+			domain:   "quay.io",
+			expected: []*types.DockerAuthConfig{{Username: "user", Password: "pass"}},
+		},
+		{
+			name:   "invalid auth",
+			config: `{"auths":{"quay.io":{"auth":"dXNlcg=="}}}`,
+			domain: "quay.io",
+		},
+		{
+			name:   "other registry",
+			config: `{"auths":{"https://quay.io.evil.com":{"auth":"dXNlcjpwYXNz"}}}`,
+			domain: "quay.io",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			auths := authsFromSecrets([]*corev1.Secret{secret(tt.config)}, tt.domain)
+			if !reflect.DeepEqual(auths, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, auths)
+			}
+		})
+	}
+}
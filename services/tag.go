@@ -2,58 +2,177 @@ package services
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
 	corecli "k8s.io/client-go/kubernetes"
 	aplist "k8s.io/client-go/listers/apps/v1"
 	corelister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/mattbaird/jsonpatch"
 
+	"github.com/ricardomaraschini/tagger/config"
+	"github.com/ricardomaraschini/tagger/features"
 	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
 	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
 	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
 )
 
 // Tag gather all actions related to image tag objects.
 type Tag struct {
-	tagcli tagclient.Interface
-	taglis taglist.TagLister
-	replis aplist.ReplicaSetLister
-	deplis aplist.DeploymentLister
-	impsvc *Importer
-	depsvc *Deployment
+	sync.Mutex
+	skips            []config.MutationSkip
+	disabledTags     string
+	enforcement      config.DigestEnforcement
+	projs            []config.LabelProjection
+	corcli           corecli.Interface
+	tagcli           tagclient.Interface
+	taglis           taglist.TagLister
+	replis           aplist.ReplicaSetLister
+	deplis           aplist.DeploymentLister
+	nslis            corelister.NamespaceLister
+	digests          cache.Indexer
+	impsvc           *Importer
+	depsvc           *Deployment
+	prosvc           *Promotion
+	audsvc           *Audit
+	signer           *GenerationSigner
+	overload         *Overload
+	sched            *ImportScheduler
+	hooks            *ImportHooks
+	notifier         *Notifier
+	cacheMissTimeout time.Duration
+	lookups          map[string]*liveRead
+	misses           map[string]time.Time
 }
 
-// NewTag returns a handler for all image tag related services.
+// tagMissTTL is for how long Tags not found on the API server are not looked
+// up again. Most images not in the cache, as redis or nginx sidecars, don't
+// name a Tag at all and would otherwise cost a read for every pod.
+const tagMissTTL = 10 * time.Second
+
+// NewTag returns a handler for all image tag related services. Deployments
+// using Tags are rolled out through depsvc and new generations are notified
+// through notifier, both shared with the Deployment controller so there is a
+// single set of notification batches. Both may be nil.
 func NewTag(
 	corcli corecli.Interface,
 	tagcli tagclient.Interface,
 	taglis taglist.TagLister,
+	tslis taglist.TagSetLister,
 	replis aplist.ReplicaSetLister,
 	deplis aplist.DeploymentLister,
 	cmlister corelister.ConfigMapLister,
 	sclister corelister.SecretLister,
+	depsvc *Deployment,
+	notifier *Notifier,
 ) *Tag {
 	return &Tag{
-		tagcli: tagcli,
-		taglis: taglis,
-		replis: replis,
-		deplis: deplis,
-		impsvc: NewImporter(cmlister, sclister),
-		depsvc: NewDeployment(corcli, deplis, taglis),
+		corcli:   corcli,
+		tagcli:   tagcli,
+		taglis:   taglis,
+		replis:   replis,
+		deplis:   deplis,
+		impsvc:   NewImporter(cmlister, sclister),
+		depsvc:   depsvc,
+		prosvc:   NewPromotion(taglis, tslis),
+		audsvc:   NewAudit(tagcli),
+		signer:   NewGenerationSigner(),
+		overload: NewOverload(),
+		hooks:    NewImportHooks(corcli),
+		notifier: notifier,
+
+		cacheMissTimeout: config.Default().CacheMissTimeout,
 	}
 }
 
+// ApplyConfig applies provided configuration to the Tag service and the
+// services it owns.
+func (t *Tag) ApplyConfig(cfg *config.Config) {
+	t.Lock()
+	t.skips = cfg.MutationSkips
+	t.disabledTags = cfg.DisabledTags
+	t.enforcement = cfg.DigestEnforcement
+	t.projs = cfg.LabelProjections
+	t.cacheMissTimeout = cfg.CacheMissTimeout
+	t.Unlock()
+	t.impsvc.ApplyConfig(cfg)
+	t.audsvc.ApplyConfig(cfg)
+	t.signer.ApplyConfig(cfg)
+	t.overload.ApplyConfig(cfg)
+	t.depsvc.ApplyConfig(cfg)
+}
+
+// ScheduleImports makes imports go through the provided scheduler, see
+// ImportScheduler. Imports are not scheduled otherwise.
+func (t *Tag) ScheduleImports(sched *ImportScheduler) {
+	t.Lock()
+	defer t.Unlock()
+	t.sched = sched
+}
+
+// PullSecretsFrom sets where the namespaces default ServiceAccounts are read
+// from when importing, see SysContext.
+func (t *Tag) PullSecretsFrom(salister corelister.ServiceAccountLister) {
+	t.impsvc.PullSecretsFrom(salister)
+}
+
+// Get returns a Tag by namespace and name.
+func (t *Tag) Get(namespace, name string) (*imagtagv1.Tag, error) {
+	return t.taglis.Tags(namespace).Get(name)
+}
+
+// List returns all Tags in a namespace matching the label selector, if
+// namespace is empty Tags in all namespaces are returned. Tags are sorted by
+// namespace and name.
+func (t *Tag) List(namespace string, selector labels.Selector) ([]*imagtagv1.Tag, error) {
+	var tags []*imagtagv1.Tag
+	var err error
+	if namespace == "" {
+		tags, err = t.taglis.List(selector)
+	} else {
+		tags, err = t.taglis.Tags(namespace).List(selector)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Namespace != tags[j].Namespace {
+			return tags[i].Namespace < tags[j].Namespace
+		}
+		return tags[i].Name < tags[j].Name
+	})
+	return tags, nil
+}
+
+// SimulateImport evaluates, without importing anything, the checks an import
+// of image into namespace would go through.
+func (t *Tag) SimulateImport(
+	ctx context.Context, namespace, image string,
+) *imagtagv1.ImportSimulation {
+	return t.impsvc.Simulate(ctx, namespace, image)
+}
+
 // CurrentReferenceForTagByName returns the image reference a tag is pointing to.
-// If we can't find the image tag by namespace and name an empty string is returned
-// instead.
+// If we can't find the image tag by namespace and name, or if it is disabled, an
+// empty string is returned instead.
 func (t *Tag) CurrentReferenceForTagByName(namespace, name string) (string, error) {
 	it, err := t.taglis.Tags(namespace).Get(name)
 	if err != nil {
@@ -62,71 +181,559 @@ func (t *Tag) CurrentReferenceForTagByName(namespace, name string) (string, erro
 		}
 		return "", err
 	}
-	return it.CurrentReferenceForTag(), nil
+	return currentReference(it), nil
+}
+
+// currentReference returns the image reference the Tag is pointing to. An
+// empty string is returned for disabled Tags and for Tags pointing to an
+// artifact.
+func currentReference(it *imagtagv1.Tag) string {
+	if it.Spec.Disabled {
+		return ""
+	}
+
+	// artifacts can't be run, pods keep pointing to the Tag name.
+	if it.CurrentReferenceIsArtifact() {
+		klog.Warningf("tag %s/%s points to an artifact, not an image", it.Namespace, it.Name)
+		return ""
+	}
+	return it.CurrentReferenceForTag()
 }
 
 // PatchForPod creates and returns a json patch to be applied on top of a pod
 // in order to make it point to an already imported image tag. May returns nil
-// if no patch is needed (i.e. pod does not use image tag).
-func (t *Tag) PatchForPod(pod corev1.Pod) ([]jsonpatch.JsonPatchOperation, error) {
+// if no patch is needed (i.e. pod does not use image tag). Everything is read
+// from the caches but the objects the caches have not seen yet, see readLive.
+// The patch only replaces what changed so its size does not grow with the pod
+// spec. Warnings are returned for the deprecated Tags the pod resolves, one
+// per Tag.
+func (t *Tag) PatchForPod(
+	ctx context.Context, pod corev1.Pod,
+) ([]jsonpatch.JsonPatchOperation, []string, error) {
 	if len(pod.OwnerReferences) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	// TODO multiple / different types of owners
 	podOwner := pod.OwnerReferences[0]
 	if podOwner.Kind != "ReplicaSet" {
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	rs, err := t.replis.ReplicaSets(pod.Namespace).Get(podOwner.Name)
+	rs, err := t.replicaSet(ctx, pod.Namespace, podOwner.Name)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// if the replica set has no image tag annotation there is nothing to
 	// be patched.
-	if _, ok := rs.Annotations["image-tag"]; !ok {
-		return nil, nil
+	tracked, wildcard := tagTriggers(rs.Annotations)
+	if !tracked {
+		return nil, nil, nil
+	}
+
+	skip, err := t.skipMutation(pod, rs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if skip {
+		klog.V(2).Infof("pod %s/%s owner excluded from mutation", pod.Namespace, pod.GenerateName)
+		return nil, nil, nil
 	}
 
 	// TODO We need to check other types of containers within a pod. Here
 	// we are going only for the containers on spec.containers.
-	nconts := []corev1.Container{}
-	for _, c := range pod.Spec.Containers {
-		ref, err := t.CurrentReferenceForTagByName(pod.Namespace, c.Image)
+	warnings := map[string]string{}
+	var patch []jsonpatch.JsonPatchOperation
+	for i, c := range pod.Spec.Containers {
+		ref, err := t.podReference(ctx, rs, pod.Namespace, c.Image, wildcard, warnings)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if ref == "" || ref == c.Image {
+			continue
 		}
+		patch = append(patch, jsonpatch.NewPatch(
+			"replace", fmt.Sprintf("/spec/containers/%d/image", i), ref,
+		))
+	}
 
-		if ref != "" {
-			c.Image = ref
+	if placeholdersEnabled(rs.Annotations) {
+		ppatch, err := placeholderPatch(pod, func(name string) (string, error) {
+			return t.podReference(ctx, rs, pod.Namespace, name, false, warnings)
+		})
+		if err != nil {
+			return nil, nil, err
 		}
-		nconts = append(nconts, c)
+		patch = append(patch, ppatch...)
 	}
-	changed := pod.DeepCopy()
-	changed.Spec.Containers = nconts
 
-	origData, err := json.Marshal(pod)
+	if features.Enabled(features.PodReadinessGate) &&
+		readinessGateEnabled(rs.Annotations) &&
+		!hasReadinessGate(&pod) {
+		gate := corev1.PodReadinessGate{ConditionType: PodConditionTagCurrent}
+		if len(pod.Spec.ReadinessGates) == 0 {
+			patch = append(patch, jsonpatch.NewPatch(
+				"add", "/spec/readinessGates", []corev1.PodReadinessGate{gate},
+			))
+		} else {
+			patch = append(patch, jsonpatch.NewPatch(
+				"add", "/spec/readinessGates/-", gate,
+			))
+		}
+	}
+
+	var deprecated []string
+	for _, warning := range warnings {
+		deprecated = append(deprecated, warning)
+	}
+	sort.Strings(deprecated)
+	return patch, deprecated, nil
+}
+
+// podReference returns the image reference a container image, or a Tag
+// name, resolves to for a pod of the ReplicaSet. Pods use the reference their
+// ReplicaSet has been rolled out with, this way pods of canaries and of
+// previous ReplicaSets keep their images. An empty string is returned if the
+// image refers to no Tag, or to a disabled one. The warning of a deprecated
+// Tag is kept in warnings, by Tag name.
+func (t *Tag) podReference(
+	ctx context.Context,
+	rs *appsv1.ReplicaSet,
+	namespace, image string,
+	wildcard bool,
+	warnings map[string]string,
+) (string, error) {
+	it, err := t.podTag(ctx, namespace, image, wildcard)
 	if err != nil {
+		return "", err
+	}
+	name := image
+	if it != nil {
+		name = it.Name
+	}
+
+	// pods using disabled tags are either rejected or keep the image as
+	// written in their spec, even if their replica set has been rolled
+	// out with a reference.
+	disabled, err := t.disabledTag(it)
+	if err != nil || disabled {
+		return "", err
+	}
+
+	if it != nil {
+		if warning := it.DeprecationWarning(time.Now()); warning != "" {
+			warnings[it.Name] = warning
+		}
+	}
+
+	if ref := rs.Spec.Template.Annotations[name]; ref != "" {
+		return ref, nil
+	}
+	if it == nil {
+		return "", nil
+	}
+	return currentReference(it), nil
+}
+
+// replicaSet returns a ReplicaSet from the cache. Pods are admitted right
+// after their ReplicaSet is created, often before the cache has seen it, in
+// this case the ReplicaSet is read from the API server.
+func (t *Tag) replicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error) {
+	rs, err := t.replis.ReplicaSets(namespace).Get(name)
+	if err == nil || !errors.IsNotFound(err) || t.corcli == nil {
+		return rs, err
+	}
+
+	obj, lerr := t.readLive(
+		ctx, fmt.Sprintf("replicasets/%s/%s", namespace, name),
+		func(ctx context.Context) (interface{}, error) {
+			return t.corcli.AppsV1().ReplicaSets(namespace).Get(
+				ctx, name, metav1.GetOptions{},
+			)
+		},
+	)
+	if lerr == errNoLiveRead {
 		return nil, err
+	} else if lerr != nil {
+		return nil, lerr
 	}
-	changedData, err := json.Marshal(changed)
+	return obj.(*appsv1.ReplicaSet), nil
+}
+
+// podTag returns the Tag a pod image refers to, nil if there is none. Tags
+// created together with the Deployment using them, e.g. by the same `kubectl
+// apply`, may not be in the cache yet so images naming a Tag the cache does
+// not know are looked up on the API server, Tags not found there are not
+// looked up again for a while. Failed lookups are taken as no Tag, pods are
+// not rejected because the API server is slow. Only then the Tags inherited
+// by the pod namespace are considered, see inheritedTag. See tagForImage for
+// wildcard.
+func (t *Tag) podTag(
+	ctx context.Context, namespace, image string, wildcard bool,
+) (*imagtagv1.Tag, error) {
+	it, err := tagForImage(t.taglis, namespace, image, wildcard)
+	if err != nil || it != nil {
+		return it, err
+	}
+	if errs := validation.IsDNS1123Subdomain(image); len(errs) > 0 || t.tagcli == nil {
+		return t.inheritedTag(namespace, image, wildcard)
+	}
+
+	key := fmt.Sprintf("tags/%s/%s", namespace, image)
+	if t.missing(key) {
+		return t.inheritedTag(namespace, image, wildcard)
+	}
+
+	obj, err := t.readLive(
+		ctx, key,
+		func(ctx context.Context) (interface{}, error) {
+			it, err := t.tagcli.ImagesV1().Tags(namespace).Get(
+				ctx, image, metav1.GetOptions{},
+			)
+			if errors.IsNotFound(err) {
+				t.missed(key)
+			}
+			return it, err
+		},
+	)
 	if err != nil {
-		return nil, err
+		if err != errNoLiveRead && !errors.IsNotFound(err) {
+			klog.Errorf("unable to look %s up, assuming no tag: %s", key, err)
+		}
+		return t.inheritedTag(namespace, image, wildcard)
+	}
+	return obj.(*imagtagv1.Tag), nil
+}
+
+// missed records that key was not found on the API server, expired records
+// are dropped.
+func (t *Tag) missed(key string) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for k, expires := range t.misses {
+		if now.After(expires) {
+			delete(t.misses, k)
+		}
+	}
+	if t.misses == nil {
+		t.misses = map[string]time.Time{}
+	}
+	t.misses[key] = now.Add(tagMissTTL)
+}
+
+// missing returns true if key was recently not found on the API server.
+func (t *Tag) missing(key string) bool {
+	t.Lock()
+	defer t.Unlock()
+	expires, ok := t.misses[key]
+	return ok && time.Now().Before(expires)
+}
+
+// errNoLiveRead is returned by readLive when reads from the API server are
+// disabled.
+var errNoLiveRead = fmt.Errorf("live reads disabled")
+
+// liveRead is a read of an object from the API server, shared by the pods
+// waiting on it. done is closed once obj or err is set.
+type liveRead struct {
+	done chan struct{}
+	obj  interface{}
+	err  error
+}
+
+// readLive reads an object missing from the cache through read, for at most
+// the configured cache miss timeout. Concurrent reads of the same key, as for
+// the burst of pods created with a ReplicaSet, share a single request. If
+// ctx, the admission deadline, expires first an error is returned while the
+// read goes on for the pods admitted next. Returns errNoLiveRead if the cache
+// miss timeout is zero.
+func (t *Tag) readLive(
+	ctx context.Context, key string, read func(context.Context) (interface{}, error),
+) (interface{}, error) {
+	t.Lock()
+	timeout := t.cacheMissTimeout
+	lookup, ok := t.lookups[key]
+	if !ok && timeout > 0 {
+		lookup = &liveRead{done: make(chan struct{})}
+		if t.lookups == nil {
+			t.lookups = map[string]*liveRead{}
+		}
+		t.lookups[key] = lookup
+	}
+	t.Unlock()
+	if lookup == nil {
+		return nil, errNoLiveRead
+	}
+
+	if !ok {
+		metrics.CacheMissReads.WithLabelValues(strings.Split(key, "/")[0]).Inc()
+		go func() {
+			lctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			lookup.obj, lookup.err = read(lctx)
+			t.Lock()
+			delete(t.lookups, key)
+			t.Unlock()
+			close(lookup.done)
+		}()
+	}
+
+	select {
+	case <-lookup.done:
+		return lookup.obj, lookup.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("error reading %s: %w", key, ctx.Err())
+	}
+}
+
+// disabledTag returns true if the Tag exists and is disabled. If disabled
+// Tags are configured to be rejected an error is returned instead.
+func (t *Tag) disabledTag(it *imagtagv1.Tag) (bool, error) {
+	if it == nil || !it.Spec.Disabled {
+		return false, nil
+	}
+
+	t.Lock()
+	policy := t.disabledTags
+	t.Unlock()
+	if policy == config.DisabledTagsReject {
+		return false, fmt.Errorf("tag %s/%s is disabled", it.Namespace, it.Name)
+	}
+	klog.V(2).Infof("tag %s/%s disabled, keeping literal image", it.Namespace, it.Name)
+	return true, nil
+}
+
+// skipMutation returns true if a configured mutation skip rule matches any
+// owner of the pod, of its ReplicaSet or of the ReplicaSet Deployment.
+func (t *Tag) skipMutation(pod corev1.Pod, rs *appsv1.ReplicaSet) (bool, error) {
+	t.Lock()
+	skips := t.skips
+	t.Unlock()
+	if len(skips) == 0 {
+		return false, nil
+	}
+
+	owners := append([]metav1.OwnerReference{}, pod.OwnerReferences...)
+	owners = append(owners, rs.OwnerReferences...)
+	for _, owner := range rs.OwnerReferences {
+		if owner.Kind != "Deployment" {
+			continue
+		}
+		dep, err := t.deplis.Deployments(pod.Namespace).Get(owner.Name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		owners = append(owners, dep.OwnerReferences...)
+	}
+
+	for _, owner := range owners {
+		for _, skip := range skips {
+			if skip.Matches(pod.Namespace, owner.APIVersion, owner.Kind, owner.Name) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// progressRecorder returns a function that records the import progress in the
+// Tag status and, at most once per eventInterval, as an Event. As it runs while
+// the Tag is being imported the function works on its own copy of the Tag, also
+// returned. The copy resource version follows the recorded updates so, once the
+// progress is closed, the update at the end of the import does not fail.
+// Failures are only logged as progress is informative.
+func (t *Tag) progressRecorder(
+	ctx context.Context, it *imagtagv1.Tag, eventInterval time.Duration,
+) (*imagtagv1.Tag, func([]imagtagv1.BlobUpload, imagtagv1.CopyProgress)) {
+	var lastEvent time.Time
+	recorded := it.DeepCopy()
+	record := func(uploads []imagtagv1.BlobUpload, progress imagtagv1.CopyProgress) {
+		recorded.Status.Uploads = uploads
+		recorded.Status.Progress = &progress
+		updated, err := t.tagcli.ImagesV1().Tags(recorded.Namespace).Update(
+			ctx, recorded.DeepCopy(), metav1.UpdateOptions{},
+		)
+		if err != nil {
+			klog.Errorf("error recording import progress: %s", err)
+		} else {
+			recorded.ResourceVersion = updated.ResourceVersion
+		}
+
+		if time.Since(lastEvent) < eventInterval {
+			return
+		}
+		lastEvent = time.Now()
+
+		msg := fmt.Sprintf(
+			"copied %d of %d bytes, %d of %d layers",
+			progress.BytesCopied, progress.BytesTotal,
+			progress.LayersDone, progress.LayersTotal,
+		)
+		if progress.ETA != nil {
+			msg = fmt.Sprintf("%s, eta %s", msg, progress.ETA.Duration)
+		}
+		t.event(ctx, recorded, corev1.EventTypeNormal, "ImportProgress", msg)
 	}
+	return recorded, record
+}
+
+// event creates an Event for provided Tag. Failures are only logged.
+func (t *Tag) event(
+	ctx context.Context, it *imagtagv1.Tag, evtype, reason, message string,
+) {
+	tagEvent(ctx, t.corcli, it, evtype, reason, message)
+}
 
-	patch, err := jsonpatch.CreatePatch(origData, changedData)
+// tagEvent creates an Event for provided Tag using corcli. Failures are only
+// logged.
+func tagEvent(
+	ctx context.Context,
+	corcli corecli.Interface,
+	it *imagtagv1.Tag,
+	evtype, reason, message string,
+) {
+	now := metav1.Now()
+	evt := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s.", it.Name),
+			Namespace:    it.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      imagtagv1.SchemeGroupVersion.String(),
+			Kind:            "Tag",
+			Namespace:       it.Namespace,
+			Name:            it.Name,
+			UID:             it.UID,
+			ResourceVersion: it.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           evtype,
+		Source:         corev1.EventSource{Component: "tagger"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := corcli.CoreV1().Events(it.Namespace).Create(
+		ctx, evt, metav1.CreateOptions{},
+	); err != nil {
+		klog.Errorf("error creating event for tag %s/%s: %s", it.Namespace, it.Name, err)
+	}
+}
+
+// throttleError is an error holding an import back, e.g. an OverloadError or
+// a ScheduleError. Reason is the reason of the Throttled condition it sets.
+type throttleError interface {
+	error
+	Reason() string
+}
+
+// throttle records, in the Throttled condition, that the import of the Tag
+// has been held back and returns err so the Tag is retried later.
+func (t *Tag) throttle(
+	ctx context.Context, orig, it *imagtagv1.Tag, err throttleError,
+) error {
+	klog.V(2).Infof("tag %s/%s: %s", it.Namespace, it.Name, err)
+	it.SetCondition(imagtagv1.ConditionThrottled, metav1.ConditionTrue, err.Reason(), err.Error())
+	if tagChanged(orig, it) {
+		if _, uerr := t.tagcli.ImagesV1().Tags(it.Namespace).Update(
+			ctx, it, metav1.UpdateOptions{},
+		); uerr != nil {
+			klog.Errorf("error updating tag status: %s", uerr)
+		}
+	}
+	return fmt.Errorf("tag %s/%s: %w", it.Namespace, it.Name, err)
+}
+
+// runHook runs the import hook for the generation in spec, recording its state
+// in the Tag status. Hooks that already finished for the generation are not
+// looked up again.
+func (t *Tag) runHook(
+	ctx context.Context, it *imagtagv1.Tag, hook string, spec *batchv1.JobSpec, image string,
+) (imagtagv1.HookRun, error) {
+	if run, ok := it.HookRun(hook); ok &&
+		run.Generation == it.Spec.Generation &&
+		run.Phase != imagtagv1.HookRunning {
+		return run, nil
+	}
+
+	run, err := t.hooks.Run(ctx, it, hook, spec, image)
 	if err != nil {
-		return nil, err
+		return imagtagv1.HookRun{}, fmt.Errorf("error running %s hook: %w", hook, err)
+	}
+	it.RegisterHookRun(run)
+	return run, nil
+}
+
+// preImportHook runs the pre import hook of the Tag, if any, returning true
+// once it succeeded and the generation in spec may be imported. Until then
+// the hook state is recorded in the Tag, a failed hook as an import failure.
+func (t *Tag) preImportHook(ctx context.Context, orig, it *imagtagv1.Tag) (bool, error) {
+	if it.Spec.Hooks == nil || it.Spec.Hooks.PreImport == nil {
+		return true, nil
+	}
+
+	prev, _ := it.HookRun(imagtagv1.HookPreImport)
+	run, err := t.runHook(ctx, it, imagtagv1.HookPreImport, it.Spec.Hooks.PreImport, it.Spec.From)
+	if err != nil {
+		return false, err
+	}
+	if run.Phase == imagtagv1.HookSucceeded {
+		return true, nil
+	}
+
+	// failures are registered once, otherwise every resync would move
+	// the last import attempt.
+	if run.Phase == imagtagv1.HookFailed && run != prev {
+		it.RegisterImportFailure(&HookError{Hook: run.Hook, Job: run.Job, Message: run.Message})
+	}
+	it.RegisterReadiness()
+	it.RegisterHealth()
+	if !tagChanged(orig, it) {
+		return false, nil
+	}
+	_, err = t.tagcli.ImagesV1().Tags(it.Namespace).Update(ctx, it, metav1.UpdateOptions{})
+	return false, err
+}
+
+// postImportHook runs the post import hook of the Tag, if any, against the
+// imported generation in spec. Returns true, recording why in the promotion
+// state, while the generation must be held from becoming the current one.
+// Downgrades, and generations already current, are never held.
+func (t *Tag) postImportHook(ctx context.Context, it *imagtagv1.Tag) (bool, error) {
+	if it.Spec.Hooks == nil || it.Spec.Hooks.PostImport == nil {
+		return false, nil
+	}
+	if it.Spec.Generation <= it.Status.Generation {
+		return false, nil
+	}
+	hashref, ok := it.SpecHashReference()
+	if !ok {
+		return false, nil
 	}
 
-	// make sure we always return the zero value for a slice and not
-	// an empty one.
-	if len(patch) == 0 {
-		return nil, nil
+	run, err := t.runHook(
+		ctx, it, imagtagv1.HookPostImport, it.Spec.Hooks.PostImport, hashref.ImageReference,
+	)
+	if err != nil {
+		return false, err
 	}
-	return patch, nil
+
+	switch run.Phase {
+	case imagtagv1.HookSucceeded:
+		return false, nil
+	case imagtagv1.HookFailed:
+		herr := &HookError{Hook: run.Hook, Job: run.Job, Message: run.Message}
+		it.RegisterPromotionPending(nil, herr.Error())
+	default:
+		it.RegisterPromotionPending(nil, fmt.Sprintf("waiting for %s hook job %s", run.Hook, run.Job))
+	}
+	return true, nil
 }
 
 // Update manages image tag updates, assuring we have the tag imported.
@@ -136,70 +743,200 @@ func (t *Tag) Update(ctx context.Context, it *imagtagv1.Tag) error {
 	var err error
 	var hashref imagtagv1.HashReference
 
+	// disabled tags keep their generations but are neither imported nor
+	// rolled out, only their health and sunset are kept up to date.
+	if it.Spec.Disabled {
+		klog.V(2).Infof("tag %s/%s disabled, skipping", it.Namespace, it.Name)
+		orig := it.DeepCopy()
+		it.RegisterHealth()
+		it.RegisterSunset(time.Now())
+		if err := t.registerInheritance(it); err != nil {
+			return fmt.Errorf("error reading inheriting namespaces: %w", err)
+		}
+		if !tagChanged(orig, it) {
+			return nil
+		}
+		_, err := t.tagcli.ImagesV1().Tags(it.Namespace).Update(
+			ctx, it, metav1.UpdateOptions{},
+		)
+		return err
+	}
+
+	orig := it.DeepCopy()
 	alreadyImported := it.SpecTagImported()
 	if !alreadyImported {
+		// Tags used by workloads are always imported, the others
+		// wait while we are close to our resource limits.
+		if len(it.Status.Rollouts) == 0 {
+			if err := t.overload.Admit(); err != nil {
+				return t.throttle(ctx, orig, it, err)
+			}
+		}
+
+		// the import schedule holds back every import, the slot taken
+		// is kept until we are done with the Tag.
+		t.Lock()
+		sched := t.sched
+		t.Unlock()
+		if sched != nil {
+			release, err := sched.Admit(ctx, it)
+			if serr, ok := err.(*ScheduleError); ok {
+				return t.throttle(ctx, orig, it, serr)
+			} else if err != nil {
+				return err
+			}
+			defer release()
+		}
+		if meta.FindStatusCondition(it.Status.Conditions, imagtagv1.ConditionThrottled) != nil {
+			meta.RemoveStatusCondition(&it.Status.Conditions, imagtagv1.ConditionThrottled)
+		}
+
+		if passed, err := t.preImportHook(ctx, orig, it); !passed || err != nil {
+			return err
+		}
+
 		klog.Infof("tag %s/%s needs import, importing...", it.Namespace, it.Name)
 
-		hashref, err = t.impsvc.ImportTag(ctx, it)
+		// uploads interrupted by a previous attempt are resumed.
+		recorded, recorder := t.progressRecorder(ctx, it, 30*time.Second)
+		progress := NewImportProgress(5*time.Second, recorder)
+		progress.Resume(it.Status.Uploads)
+
+		started := time.Now()
+		hashref, err = t.impsvc.ImportTag(ctx, it, progress)
+		progress.Close()
+		it.ResourceVersion = recorded.ResourceVersion
+		t.audsvc.Record(ctx, it, started, hashref, err)
 		if err != nil {
 			// if we fail to import the tag we need to record the failure on tag's
 			// status and update it. If we fail to update the tag we only log,
-			// returning the original error.
+			// returning the original error. The progress so far is kept so the
+			// next attempt resumes from it.
 			it.RegisterImportFailure(err)
+			it.RegisterReadiness()
+			it.RegisterHealth()
+			if uploads, prog := progress.Snapshot(); len(uploads) > 0 {
+				it.Status.Uploads = uploads
+				it.Status.Progress = &prog
+			}
+
+			// past the deadline our context is of no use to record it.
+			uctx := ctx
+			if ctx.Err() == context.DeadlineExceeded {
+				var cancel context.CancelFunc
+				uctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+			}
 			if _, err := t.tagcli.ImagesV1().Tags(it.Namespace).Update(
-				ctx, it, metav1.UpdateOptions{},
+				uctx, it, metav1.UpdateOptions{},
 			); err != nil {
 				klog.Errorf("error updating tag status: %s", err)
 			}
 			return fmt.Errorf("fail import %s/%s: %w", it.Namespace, it.Name, err)
 		}
 		it.RegisterImportSuccess()
+		hashref.Trigger = it.ImportTrigger()
+		t.signer.Sign(it, &hashref)
 		it.PrependHashReference(hashref)
+		it.RegisterManifestConversion(hashref)
+		it.RegisterRetag(hashref)
+		it.RegisterStorageUsage()
 
 		klog.Infof("tag %s/%s imported.", it.Namespace, it.Name)
 	}
 
+	// a new generation only becomes the current one once promoted, see
+	// Promotion struct in services/promotion.go.
 	genMismatch := it.Spec.Generation != it.Status.Generation
 	if !alreadyImported || genMismatch {
-		it.Status.Generation = it.Spec.Generation
+		held, err := t.postImportHook(ctx, it)
+		if err != nil {
+			return err
+		}
+		if !held {
+			if _, err = t.prosvc.Promote(it); err != nil {
+				return fmt.Errorf("error promoting generation: %w", err)
+			}
+		}
+	}
+
+	// readiness is evaluated even if nothing else changed so Tags created
+	// before the Ready condition existed get it too. Verification is also
+	// evaluated here for Tags not used by any Deployment.
+	it.RegisterReadiness()
+	it.RegisterVerification(time.Now())
+	it.RegisterKnownGood(time.Now())
+	it.RegisterHealth()
+	it.RegisterSunset(time.Now())
+	if err := t.registerInheritance(it); err != nil {
+		return fmt.Errorf("error reading inheriting namespaces: %w", err)
+	}
+
+	// labels are projected from the current generation so selectors find
+	// what Tags are in use, not what they are about to be promoted to.
+	t.Lock()
+	ProjectImageLabels(it, t.projs)
+	t.Unlock()
+
+	// periodic resyncs go through here for every Tag, the Tag is only
+	// updated if its status, or its projected labels, actually changed.
+	if tagChanged(orig, it) {
 		if it, err = t.tagcli.ImagesV1().Tags(it.Namespace).Update(
 			ctx, it, metav1.UpdateOptions{},
 		); err != nil {
 			return fmt.Errorf("error updating image stream: %w", err)
 		}
 	}
+	if !alreadyImported {
+		t.notifier.GenerationCreated(it, hashref)
+	}
 
 	return t.depsvc.UpdateDeploymentsForTag(ctx, it)
 }
 
+// tagChanged returns true if the status, the labels or the annotations of a
+// Tag differ from the ones in orig, i.e. if the Tag needs to be updated.
+// Empty and nil label or annotation maps are taken as equal.
+func tagChanged(orig, it *imagtagv1.Tag) bool {
+	sameMap := func(a, b map[string]string) bool {
+		return (len(a) == 0 && len(b) == 0) || reflect.DeepEqual(a, b)
+	}
+	return !reflect.DeepEqual(orig.Status, it.Status) ||
+		!sameMap(orig.Labels, it.Labels) ||
+		!sameMap(orig.Annotations, it.Annotations)
+}
+
 // NewGenerationForImageRef looks through all image tags we have and creates a
 // new generation in all of those who point to the provided image path. Image
-// path looks like "quay.io/repo/image:tag". TODO add unqualified registries
-// support and consider also empty tag as "latest".
+// path looks like "quay.io/repo/image:tag". If no Tag points to the image path
+// a NotFound error is returned. TODO add unqualified registries support and
+// consider also empty tag as "latest".
 func (t *Tag) NewGenerationForImageRef(ctx context.Context, imgpath string) error {
 	tags, err := t.taglis.List(labels.Everything())
 	if err != nil {
 		return err
 	}
 
-	for _, tag := range tags {
-		if tag.Spec.From != imgpath {
-			continue
-		}
+	// references resolved before the push are not to be shared anymore.
+	t.impsvc.Invalidate(imgpath)
 
-		// tag has not been imported yet, it makes no sense to create
-		// a new generation for it.
-		if len(tag.Status.References) == 0 {
+	tracked := false
+	for _, tag := range tags {
+		outcome := PushOutcome(tag, imgpath)
+		if outcome == PushUntracked {
 			continue
 		}
+		tracked = true
 
-		lastImport := tag.Status.References[0]
-		if lastImport.Generation != tag.Spec.Generation {
-			// we still have a pending import for this image
+		if outcome != PushNewGeneration {
 			continue
 		}
 
+		tag = tag.DeepCopy()
 		tag.Spec.Generation++
+		tag.SetImportTrigger(imagtagv1.ImportTriggerWebhook)
+		tag.RegisterReadiness()
+		tag.RegisterHealth()
 		if _, err := t.tagcli.ImagesV1().Tags(tag.Namespace).Update(
 			ctx, tag, metav1.UpdateOptions{},
 		); err != nil {
@@ -207,9 +944,60 @@ func (t *Tag) NewGenerationForImageRef(ctx context.Context, imgpath string) erro
 		}
 	}
 
+	if !tracked {
+		return errors.NewNotFound(imagtagv1.Resource("tags"), imgpath)
+	}
 	return nil
 }
 
+// These are the outcomes of a push notification for a Tag, see PushOutcome.
+const (
+	PushUntracked     = "Untracked"
+	PushDisabled      = "Disabled"
+	PushNotImported   = "NotImported"
+	PushImportPending = "ImportPending"
+	PushNewGeneration = "NewGeneration"
+)
+
+// PushOutcome returns what a push notification for imgpath does to the Tag.
+// Tags not tracking the image are left untouched, as are disabled ones. It
+// makes no sense to create a new generation for Tags not imported yet or
+// whose last generation is still being imported.
+func PushOutcome(it *imagtagv1.Tag, imgpath string) string {
+	switch {
+	case !tracksImageRef(it, imgpath):
+		return PushUntracked
+	case it.Spec.Disabled:
+		return PushDisabled
+	case len(it.Status.References) == 0:
+		return PushNotImported
+	case it.Status.References[0].Generation != it.Spec.Generation:
+		return PushImportPending
+	}
+	return PushNewGeneration
+}
+
+// tracksImageRef returns true if pushing imgpath may change what the Tag
+// imports. Tags with an image selector track every tag in the repository.
+func tracksImageRef(it *imagtagv1.Tag, imgpath string) bool {
+	if it.Spec.From == imgpath {
+		return true
+	}
+	if it.Spec.ImageSelector == nil {
+		return false
+	}
+
+	pushed, err := reference.ParseDockerRef(imgpath)
+	if err != nil {
+		return false
+	}
+	from, err := reference.ParseDockerRef(it.Spec.From)
+	if err != nil {
+		return false
+	}
+	return pushed.Name() == from.Name()
+}
+
 // Upgrade increments the expected (spec) generation for a tag. This function updates
 // the object through the kubernetes api.
 func (t *Tag) Upgrade(
@@ -222,11 +1010,16 @@ func (t *Tag) Upgrade(
 		return nil, err
 	}
 
+	if it.Spec.Disabled {
+		return nil, fmt.Errorf("tag is disabled")
+	}
 	if !it.SpecTagImported() {
 		return nil, fmt.Errorf("pending tag import")
 	}
 
 	it.Spec.Generation++
+	it.RegisterReadiness()
+	it.RegisterHealth()
 	return t.tagcli.ImagesV1().Tags(namespace).Update(
 		ctx, it, metav1.UpdateOptions{},
 	)
@@ -248,12 +1041,49 @@ func (t *Tag) Downgrade(
 	if !it.SpecTagImported() {
 		return nil, fmt.Errorf("unable to downgrade, currently at oldest generation")
 	}
+	it.RegisterReadiness()
+	it.RegisterHealth()
 
 	return t.tagcli.ImagesV1().Tags(namespace).Update(
 		context.Background(), it, metav1.UpdateOptions{},
 	)
 }
 
+// RollbackToKnownGood moves the expected (spec) generation for a tag back to
+// its last known good generation, see RegisterKnownGood. This function updates
+// the object through the kubernetes api.
+func (t *Tag) RollbackToKnownGood(
+	ctx context.Context, namespace string, name string,
+) (*imagtagv1.Tag, error) {
+	it, err := t.tagcli.ImagesV1().Tags(namespace).Get(
+		ctx, name, metav1.GetOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	lkg := it.Status.LastKnownGood
+	if lkg == nil {
+		return nil, fmt.Errorf("unable to roll back, no known good generation")
+	}
+	if lkg.Generation == it.Spec.Generation {
+		return nil, fmt.Errorf("unable to roll back, already at known good generation")
+	}
+	if !it.KnownGoodImported() {
+		return nil, fmt.Errorf(
+			"unable to roll back, known good generation %d no longer kept",
+			lkg.Generation,
+		)
+	}
+
+	it.Spec.Generation = lkg.Generation
+	it.RegisterReadiness()
+	it.RegisterHealth()
+	return t.tagcli.ImagesV1().Tags(namespace).Update(
+		ctx, it, metav1.UpdateOptions{},
+	)
+}
+
 // NewGeneration creates a new generation for a tag. The new generation is set
 // to 'last import generation + 1'. If no generation was imported then the next
 // generation is zero.
@@ -267,11 +1097,24 @@ func (t *Tag) NewGeneration(
 		return nil, err
 	}
 
+	if tag.Spec.Disabled {
+		return nil, fmt.Errorf("tag is disabled")
+	}
+
+	// tags pinned to a digest never move, once the digest has been
+	// imported there is nothing new to import.
+	if tag.PinnedDigestImported() {
+		return nil, fmt.Errorf("tag pinned to already imported %s", tag.PinnedDigest())
+	}
+
 	nextGen := int64(0)
 	if len(tag.Status.References) > 0 {
 		nextGen = tag.Status.References[0].Generation + 1
 	}
 	tag.Spec.Generation = nextGen
+	tag.SetImportTrigger(imagtagv1.ImportTriggerRequest)
+	tag.RegisterReadiness()
+	tag.RegisterHealth()
 
 	return t.tagcli.ImagesV1().Tags(namespace).Update(
 		ctx, tag, metav1.UpdateOptions{},
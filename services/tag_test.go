@@ -2,8 +2,10 @@ package services
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,10 +15,12 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	coreinf "k8s.io/client-go/informers"
 	corfake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 
 	"github.com/mattbaird/jsonpatch"
 
+	"github.com/ricardomaraschini/tagger/config"
 	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
 	taginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
 	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
@@ -70,6 +74,48 @@ func TestCurrentReferenceForTagByName(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:   "artifact",
+			itname: "tag",
+			objects: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "tag",
+						Namespace: "default",
+					},
+					Status: imagtagv1.TagStatus{
+						Generation: 0,
+						References: []imagtagv1.HashReference{
+							{
+								Generation:     0,
+								ImageReference: "chart ref",
+								ArtifactType:   "application/vnd.cncf.helm.config.v1+json",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:   "disabled",
+			itname: "tag",
+			objects: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "tag",
+						Namespace: "default",
+					},
+					Spec: imagtagv1.TagSpec{
+						Disabled: true,
+					},
+					Status: imagtagv1.TagStatus{
+						References: []imagtagv1.HashReference{
+							{ImageReference: "ref"},
+						},
+					},
+				},
+			},
+		},
 		{
 			name:   "tag in different namespace",
 			itname: "tag",
@@ -107,7 +153,7 @@ func TestCurrentReferenceForTagByName(t *testing.T) {
 				t.Fatal("errors waiting for caches to sync")
 			}
 
-			svc := NewTag(nil, nil, taglis, nil, nil, nil, nil)
+			svc := NewTag(nil, nil, taglis, nil, nil, nil, nil, nil, nil, nil)
 			ref, err := svc.CurrentReferenceForTagByName("default", tt.itname)
 			if err != nil {
 				if len(tt.err) == 0 {
@@ -233,6 +279,139 @@ func TestPatchForPod(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "replica set reference",
+			expected: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/image",
+					Value:     "previous ref",
+				},
+			},
+			pod: corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "my-pod",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							Kind: "ReplicaSet",
+							Name: "replicaset",
+						},
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Image: "imagetag",
+						},
+					},
+				},
+			},
+			tags: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "imagetag",
+						Namespace: "default",
+					},
+					Status: imagtagv1.TagStatus{
+						Generation: 1,
+						References: []imagtagv1.HashReference{
+							{
+								Generation:     1,
+								ImageReference: "image ref",
+							},
+							{
+								Generation:     0,
+								ImageReference: "previous ref",
+							},
+						},
+					},
+				},
+			},
+			replicas: []runtime.Object{
+				&appsv1.ReplicaSet{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "replicaset",
+						Namespace: "default",
+						Annotations: map[string]string{
+							"image-tag": "true",
+						},
+					},
+					Spec: appsv1.ReplicaSetSpec{
+						Template: corev1.PodTemplateSpec{
+							ObjectMeta: metav1.ObjectMeta{
+								Annotations: map[string]string{
+									"imagetag": "previous ref",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "wildcard triggers",
+			expected: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/image",
+					Value:     "image ref",
+				},
+			},
+			pod: corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "my-pod",
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							Kind: "ReplicaSet",
+							Name: "replicaset",
+						},
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Image: "quay.io/company/myapp:latest",
+						},
+						{
+							Image: "centos:latest",
+						},
+					},
+				},
+			},
+			tags: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "imagetag",
+						Namespace: "default",
+					},
+					Spec: imagtagv1.TagSpec{
+						From: "quay.io/company/myapp:latest",
+					},
+					Status: imagtagv1.TagStatus{
+						Generation: 0,
+						References: []imagtagv1.HashReference{
+							{
+								Generation:     0,
+								ImageReference: "image ref",
+							},
+						},
+					},
+				},
+			},
+			replicas: []runtime.Object{
+				&appsv1.ReplicaSet{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "replicaset",
+						Namespace: "default",
+						Annotations: map[string]string{
+							TriggersAnnotation: "*",
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "replica without annotation",
 			pod: corev1.Pod{
@@ -288,46 +467,772 @@ func TestPatchForPod(t *testing.T) {
 		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tagcli := tagfake.NewSimpleClientset(tt.tags...)
+			taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+
+			corcli := corfake.NewSimpleClientset(tt.replicas...)
+			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+			rslist := corinf.Apps().V1().ReplicaSets().Lister()
+
+			taginf.Start(ctx.Done())
+			corinf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				taginf.Images().V1().Tags().Informer().HasSynced,
+				corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			svc := NewTag(nil, nil, taglis, nil, rslist, nil, nil, nil, nil, nil)
+			patch, _, err := svc.PatchForPod(ctx, tt.pod)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+			}
+
+			if !reflect.DeepEqual(tt.expected, patch) {
+				t.Errorf("patch mismatch: %v, %v", tt.expected, patch)
+			}
+		})
+	}
+}
+
+func TestPatchForPodMutationSkips(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "imagetag",
+				Namespace: "default",
+			},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "image ref"},
+				},
+			},
+		},
+	)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	corcli := corfake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "deployment",
+				Namespace: "default",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: "operators.io/v1",
+						Kind:       "Database",
+						Name:       "mydb",
+					},
+				},
+			},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "replicaset",
+				Namespace:   "default",
+				Annotations: map[string]string{"image-tag": "true"},
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						Kind: "Deployment",
+						Name: "deployment",
+					},
+				},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+	deplis := corinf.Apps().V1().Deployments().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+		corinf.Apps().V1().Deployments().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "my-pod",
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Kind: "ReplicaSet",
+					Name: "replicaset",
+				},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Image: "imagetag",
+				},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name    string
+		skips   []config.MutationSkip
+		patched bool
+	}{
+		{
+			name:    "no rules",
+			patched: true,
+		},
+		{
+			name: "operator in another namespace",
+			skips: []config.MutationSkip{
+				{
+					Kind:       "Database",
+					Namespaces: []string{"other"},
+				},
+			},
+			patched: true,
+		},
+		{
+			name: "deployment owned by operator",
+			skips: []config.MutationSkip{
+				{
+					APIVersion: "operators.io/v1",
+					Kind:       "Database",
+				},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.MutationSkips = tt.skips
+
+			svc := NewTag(nil, tagcli, taglis, nil, rslist, deplis, nil, nil, nil, nil)
+			svc.ApplyConfig(cfg)
+			patch, _, err := svc.PatchForPod(ctx, pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if patched := patch != nil; patched != tt.patched {
+				t.Errorf("expected patched %v, patch %+v", tt.patched, patch)
+			}
+		})
+	}
+}
+
+func TestPatchForPodDisabledTags(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "imagetag",
+				Namespace: "default",
+			},
+			Spec: imagtagv1.TagSpec{
+				Disabled: true,
+			},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "image ref"},
+				},
+			},
+		},
+	)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	corcli := corfake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "replicaset",
+				Namespace:   "default",
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+			Spec: appsv1.ReplicaSetSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{"imagetag": "image ref"},
+					},
+				},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "my-pod",
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Kind: "ReplicaSet",
+					Name: "replicaset",
+				},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Image: "imagetag",
+				},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{
+			name:   "fallback to literal image",
+			policy: config.DisabledTagsFallback,
+		},
+		{
+			name:   "reject",
+			policy: config.DisabledTagsReject,
+			err:    "tag default/imagetag is disabled",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.DisabledTags = tt.policy
+
+			svc := NewTag(nil, tagcli, taglis, nil, rslist, nil, nil, nil, nil, nil)
+			svc.ApplyConfig(cfg)
+			patch, _, err := svc.PatchForPod(ctx, pod)
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+			}
+			if patch != nil {
+				t.Errorf("expected no patch, %+v received", patch)
+			}
+		})
+	}
+}
+
+func TestPatchForPodDeprecatedTags(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tag := func(name string, dep *imagtagv1.TagDeprecation) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: imagtagv1.TagSpec{
+				Deprecation: dep,
+			},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: name + "@sha256:abc"},
+				},
+			},
+		}
+	}
+	tagcli := tagfake.NewSimpleClientset(
+		tag("old", &imagtagv1.TagDeprecation{Message: "use new"}),
+		tag("new", nil),
+	)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	corcli := corfake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "replicaset",
+				Namespace:   "default",
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "my-pod",
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					Kind: "ReplicaSet",
+					Name: "replicaset",
+				},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "old"},
+				{Image: "new"},
+				{Image: "old"},
+			},
+		},
+	}
+
+	svc := NewTag(nil, tagcli, taglis, nil, rslist, nil, nil, nil, nil, nil)
+	svc.ApplyConfig(config.Default())
+	patch, warnings, err := svc.PatchForPod(ctx, pod)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(patch) != 3 {
+		t.Errorf("expected 3 patches, %+v received", patch)
+	}
+	expected := []string{"tag default/old is deprecated: use new"}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("expected warnings %v, %v received", expected, warnings)
+	}
+}
+
+func TestPatchForPodReplicaSetFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "imagetag",
+				Namespace: "default",
+			},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "image ref"},
+				},
+			},
+		},
+	)
+	taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	// the replica sets exist only in the API server, never in the cache.
+	corcli := corfake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "replicaset",
+				Namespace:   "default",
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+		},
+	)
+	var mtx sync.Mutex
+	gets := 0
+	release := make(chan struct{})
+	corcli.PrependReactor(
+		"get",
+		"replicasets",
+		func(action clienttesting.Action) (bool, runtime.Object, error) {
+			mtx.Lock()
+			gets++
+			mtx.Unlock()
+			if action.(clienttesting.GetAction).GetName() == "stuck" {
+				time.Sleep(time.Second)
+			}
+			<-release
+			return false, nil, nil
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corfake.NewSimpleClientset(), time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	pod := func(owner string) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				OwnerReferences: []metav1.OwnerReference{
+					{Kind: "ReplicaSet", Name: owner},
+				},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Image: "imagetag"},
+				},
+			},
+		}
+	}
+
+	svc := NewTag(corcli, tagcli, taglis, nil, rslist, nil, nil, nil, nil, nil)
+
+	// pods admitted together wait on the same read.
+	var wg sync.WaitGroup
+	patches := make([][]jsonpatch.JsonPatchOperation, 5)
+	errs := make([]error, 5)
+	for i := range patches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			patches[i], _, errs[i] = svc.PatchForPod(ctx, pod("replicaset"))
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	expected := []jsonpatch.JsonPatchOperation{
+		{
+			Operation: "replace",
+			Path:      "/spec/containers/0/image",
+			Value:     "image ref",
+		},
+	}
+	for i := range patches {
+		if errs[i] != nil {
+			t.Errorf("unexpected error: %s", errs[i])
+		}
+		if !reflect.DeepEqual(patches[i], expected) {
+			t.Errorf("expected %+v, %+v received", expected, patches[i])
+		}
+	}
+	mtx.Lock()
+	if gets != 1 {
+		t.Errorf("expected a single replica set read, %d found", gets)
+	}
+	mtx.Unlock()
+
+	// reads are bounded by the admission deadline.
+	sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer scancel()
+	if _, _, err := svc.PatchForPod(sctx, pod("stuck")); err == nil ||
+		!strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Errorf("expected deadline error, %v received", err)
+	}
+
+	if _, _, err := svc.PatchForPod(ctx, pod("missing")); err == nil ||
+		!strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected not found error, %v received", err)
+	}
+}
+
+func TestPatchForPodTagFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the tag exists only in the API server, never in the cache.
+	tagcli := tagfake.NewSimpleClientset(
+		&imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "imagetag",
+				Namespace: "default",
+			},
+			Status: imagtagv1.TagStatus{
+				References: []imagtagv1.HashReference{
+					{ImageReference: "image ref"},
+				},
+			},
+		},
+	)
+	taginf := taginf.NewSharedInformerFactory(tagfake.NewSimpleClientset(), time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+
+	corcli := corfake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "replicaset",
+				Namespace:   "default",
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "replicaset"},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "imagetag"},
+				{Image: "docker.io/library/centos:8"},
+				{Image: "sidecar"},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		timeout  time.Duration
+		expected []jsonpatch.JsonPatchOperation
+	}{
+		{
+			name:    "live reads",
+			timeout: time.Second,
+			expected: []jsonpatch.JsonPatchOperation{
+				{
+					Operation: "replace",
+					Path:      "/spec/containers/0/image",
+					Value:     "image ref",
+				},
+			},
+		},
+		{
+			name: "live reads disabled",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.CacheMissTimeout = tt.timeout
 
-			tagcli := tagfake.NewSimpleClientset(tt.tags...)
-			taginf := taginf.NewSharedInformerFactory(tagcli, time.Minute)
-			taglis := taginf.Images().V1().Tags().Lister()
+			svc := NewTag(corcli, tagcli, taglis, nil, rslist, nil, nil, nil, nil, nil)
+			svc.ApplyConfig(cfg)
+			patch, _, err := svc.PatchForPod(ctx, pod)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(patch, tt.expected) {
+				t.Errorf("expected %+v, %+v received", tt.expected, patch)
+			}
+		})
+	}
+}
 
-			corcli := corfake.NewSimpleClientset(tt.replicas...)
-			corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
-			rslist := corinf.Apps().V1().ReplicaSets().Lister()
+func TestPatchForPodTagMisses(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-			taginf.Start(ctx.Done())
-			corinf.Start(ctx.Done())
-			if !cache.WaitForCacheSync(
-				ctx.Done(),
-				taginf.Images().V1().Tags().Informer().HasSynced,
-				corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
-			) {
-				t.Fatal("errors waiting for caches to sync")
-			}
+	taginf := taginf.NewSharedInformerFactory(tagfake.NewSimpleClientset(), time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
 
-			svc := NewTag(nil, nil, taglis, rslist, nil, nil, nil)
-			patch, err := svc.PatchForPod(tt.pod)
-			if err != nil {
-				if len(tt.err) == 0 {
-					t.Errorf("unexpected error: %s", err)
-				} else if !strings.Contains(err.Error(), tt.err) {
-					t.Errorf("expecting %q, %q received instead", tt.err, err)
+	corcli := corfake.NewSimpleClientset(
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "replicaset",
+				Namespace:   "default",
+				Annotations: map[string]string{"image-tag": "true"},
+			},
+		},
+	)
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	rslist := corinf.Apps().V1().ReplicaSets().Lister()
+
+	taginf.Start(ctx.Done())
+	corinf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+		corinf.Apps().V1().ReplicaSets().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "replicaset"},
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Image: "redis"},
+				{Image: "nginx"},
+			},
+		},
+	}
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		gets int
+	}{
+		{
+			name: "not found tags are not looked up again",
+			gets: 2,
+		},
+		{
+			name: "failed lookups admit the pod",
+			err:  fmt.Errorf("api server unavailable"),
+			gets: 4,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mtx sync.Mutex
+			gets := 0
+			tagcli := tagfake.NewSimpleClientset()
+			tagcli.PrependReactor(
+				"get",
+				"tags",
+				func(action clienttesting.Action) (bool, runtime.Object, error) {
+					mtx.Lock()
+					defer mtx.Unlock()
+					gets++
+					return tt.err != nil, nil, tt.err
+				},
+			)
+
+			svc := NewTag(corcli, tagcli, taglis, nil, rslist, nil, nil, nil, nil, nil)
+			for i := 0; i < 2; i++ {
+				patch, _, err := svc.PatchForPod(ctx, pod)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if len(patch) != 0 {
+					t.Errorf("unexpected patch %+v", patch)
 				}
-			} else if len(tt.err) > 0 {
-				t.Errorf("expecting error %q, nil received instead", tt.err)
 			}
 
-			if !reflect.DeepEqual(tt.expected, patch) {
-				t.Errorf("patch mismatch: %v, %v", tt.expected, patch)
+			mtx.Lock()
+			defer mtx.Unlock()
+			if gets != tt.gets {
+				t.Errorf("expected %d reads, %d received", tt.gets, gets)
 			}
 		})
 	}
 }
 
+func TestUpdateDisabledTag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "imagetag",
+			Namespace: "default",
+		},
+		Spec: imagtagv1.TagSpec{
+			Generation: 1,
+			Disabled:   true,
+		},
+	}
+	tagcli := tagfake.NewSimpleClientset(it)
+
+	svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil, nil, nil, nil)
+	if err := svc.Update(ctx, it.DeepCopy()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	it, err := tagcli.ImagesV1().Tags("default").Get(ctx, "imagetag", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if it.Status.Health == nil || it.Status.Health.Status != imagtagv1.HealthSuspended {
+		t.Errorf("expected suspended health, %+v found", it.Status.Health)
+	}
+	if len(it.Status.References) > 0 {
+		t.Errorf("disabled tag imported: %+v", it.Status.References)
+	}
+}
+
+func TestUpdateUnchangedTag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "imagetag",
+			Namespace: "default",
+		},
+		Spec: imagtagv1.TagSpec{
+			From:       "centos:latest",
+			Generation: 1,
+		},
+		Status: imagtagv1.TagStatus{
+			Generation: 1,
+			References: []imagtagv1.HashReference{
+				{Generation: 1, ImageReference: "centos@sha256:1"},
+				{Generation: 0, ImageReference: "centos@sha256:0"},
+			},
+		},
+	}
+	tagcli := tagfake.NewSimpleClientset(it)
+	corcli := corfake.NewSimpleClientset()
+	corinf := coreinf.NewSharedInformerFactory(corcli, time.Minute)
+	deplis := corinf.Apps().V1().Deployments().Lister()
+	replis := corinf.Apps().V1().ReplicaSets().Lister()
+
+	depsvc := NewDeployment(corcli, tagcli, deplis, replis, nil, nil)
+	svc := NewTag(corcli, tagcli, nil, nil, replis, deplis, nil, nil, depsvc, nil)
+	for i, expected := range []int{1, 0} {
+		cur, err := tagcli.ImagesV1().Tags("default").Get(ctx, "imagetag", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tagcli.ClearActions()
+
+		if err := svc.Update(ctx, cur.DeepCopy()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		updates := 0
+		for _, action := range tagcli.Actions() {
+			if action.GetVerb() == "update" {
+				updates++
+			}
+		}
+		if updates != expected {
+			t.Errorf("sync %d: expected %d updates, %d made", i, expected, updates)
+		}
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	for _, tt := range []struct {
 		name       string
@@ -419,7 +1324,10 @@ func TestUpdate(t *testing.T) {
 				t.Fatal("errors waiting for caches to sync")
 			}
 
-			svc := NewTag(corcli, tagcli, taglis, replis, deplis, cmlist, seclis)
+			depsvc := NewDeployment(corcli, tagcli, deplis, replis, taglis, nil)
+			svc := NewTag(
+				corcli, tagcli, taglis, nil, replis, deplis, cmlist, seclis, depsvc, nil,
+			)
 
 			err := svc.Update(ctx, tt.tag)
 			if err != nil {
@@ -459,6 +1367,25 @@ func TestNewGenerationForImageRef(t *testing.T) {
 		{
 			name:    "no tags",
 			imgpath: "quay.io/repo/image:latest",
+			err:     "not found",
+		},
+		{
+			name:    "no tag tracking imgpath",
+			imgpath: "quay.io/repo/image:latest",
+			expgens: []int64{2},
+			err:     "not found",
+			tagObjects: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "namespace",
+						Name:      "name",
+					},
+					Spec: imagtagv1.TagSpec{
+						Generation: 2,
+						From:       "quay.io/repo2/image:latest",
+					},
+				},
+			},
 		},
 		{
 			name:    "tag not imported yet",
@@ -583,6 +1510,50 @@ func TestNewGenerationForImageRef(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "tag selecting images in the repository",
+			imgpath: "quay.io/repo/image:v2",
+			expgens: []int64{3, 2},
+			tagObjects: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "a_namespace",
+						Name:      "a_name",
+					},
+					Spec: imagtagv1.TagSpec{
+						Generation: 2,
+						From:       "quay.io/repo/image:latest",
+						ImageSelector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"channel": "stable"},
+						},
+					},
+					Status: imagtagv1.TagStatus{
+						References: []imagtagv1.HashReference{
+							{
+								Generation: 2,
+							},
+						},
+					},
+				},
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "b_namespace",
+						Name:      "b_name",
+					},
+					Spec: imagtagv1.TagSpec{
+						Generation: 2,
+						From:       "quay.io/repo/image:latest",
+					},
+					Status: imagtagv1.TagStatus{
+						References: []imagtagv1.HashReference{
+							{
+								Generation: 2,
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name:    "tag generation not imported yet",
 			imgpath: "quay.io/repo/image:latest",
@@ -624,7 +1595,7 @@ func TestNewGenerationForImageRef(t *testing.T) {
 				t.Fatal("errors waiting for caches to sync")
 			}
 
-			tag := NewTag(nil, tagcli, taglis, nil, nil, nil, nil)
+			tag := NewTag(nil, tagcli, taglis, nil, nil, nil, nil, nil, nil, nil)
 			err := tag.NewGenerationForImageRef(ctx, tt.imgpath)
 			if err != nil {
 				if len(tt.err) == 0 {
@@ -652,6 +1623,65 @@ func TestNewGenerationForImageRef(t *testing.T) {
 	}
 }
 
+func TestPushOutcome(t *testing.T) {
+	imported := imagtagv1.TagStatus{
+		References: []imagtagv1.HashReference{{Generation: 1}},
+	}
+	for _, tt := range []struct {
+		name    string
+		imgpath string
+		spec    imagtagv1.TagSpec
+		status  imagtagv1.TagStatus
+		outcome string
+	}{
+		{
+			name:    "untracked",
+			imgpath: "quay.io/repo/other:latest",
+			spec:    imagtagv1.TagSpec{From: "quay.io/repo/image:latest", Generation: 1},
+			status:  imported,
+			outcome: PushUntracked,
+		},
+		{
+			name:    "disabled",
+			imgpath: "quay.io/repo/image:latest",
+			spec: imagtagv1.TagSpec{
+				From:       "quay.io/repo/image:latest",
+				Generation: 1,
+				Disabled:   true,
+			},
+			status:  imported,
+			outcome: PushDisabled,
+		},
+		{
+			name:    "not imported",
+			imgpath: "quay.io/repo/image:latest",
+			spec:    imagtagv1.TagSpec{From: "quay.io/repo/image:latest"},
+			outcome: PushNotImported,
+		},
+		{
+			name:    "import pending",
+			imgpath: "quay.io/repo/image:latest",
+			spec:    imagtagv1.TagSpec{From: "quay.io/repo/image:latest", Generation: 2},
+			status:  imported,
+			outcome: PushImportPending,
+		},
+		{
+			name:    "new generation",
+			imgpath: "quay.io/repo/image:latest",
+			spec:    imagtagv1.TagSpec{From: "quay.io/repo/image:latest", Generation: 1},
+			status:  imported,
+			outcome: PushNewGeneration,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			it := &imagtagv1.Tag{Spec: tt.spec, Status: tt.status}
+			if outcome := PushOutcome(it, tt.imgpath); outcome != tt.outcome {
+				t.Errorf("expected %q, %q received", tt.outcome, outcome)
+			}
+		})
+	}
+}
+
 func TestUpgrade(t *testing.T) {
 	for _, tt := range []struct {
 		name         string
@@ -684,6 +1714,31 @@ func TestUpgrade(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:         "disabled tag",
+			tagName:      "atag",
+			tagNamespace: "atagnamespace",
+			err:          "tag is disabled",
+			tagObjects: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "atag",
+						Namespace: "atagnamespace",
+					},
+					Spec: imagtagv1.TagSpec{
+						Generation: 2,
+						Disabled:   true,
+					},
+					Status: imagtagv1.TagStatus{
+						References: []imagtagv1.HashReference{
+							{
+								Generation: 2,
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			name:         "happy path",
 			tagName:      "atag",
@@ -715,7 +1770,7 @@ func TestUpgrade(t *testing.T) {
 
 			tagcli := tagfake.NewSimpleClientset(tt.tagObjects...)
 
-			svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil)
+			svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil, nil, nil, nil)
 			it, err := svc.Upgrade(ctx, tt.tagNamespace, tt.tagName)
 			if err != nil {
 				if len(tt.err) == 0 {
@@ -802,7 +1857,7 @@ func TestDowngrade(t *testing.T) {
 
 			tagcli := tagfake.NewSimpleClientset(tt.tagObjects...)
 
-			svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil)
+			svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil, nil, nil, nil)
 			it, err := svc.Downgrade(ctx, tt.tagNamespace, tt.tagName)
 			if err != nil {
 				if len(tt.err) == 0 {
@@ -823,6 +1878,81 @@ func TestDowngrade(t *testing.T) {
 	}
 }
 
+func TestRollbackToKnownGood(t *testing.T) {
+	newTag := func(specgen int64, lkg *imagtagv1.KnownGood) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "atag",
+				Namespace: "atagnamespace",
+			},
+			Spec: imagtagv1.TagSpec{
+				Generation: specgen,
+			},
+			Status: imagtagv1.TagStatus{
+				Generation: specgen,
+				References: []imagtagv1.HashReference{
+					{Generation: 4},
+					{Generation: 3},
+					{Generation: 2},
+				},
+				LastKnownGood: lkg,
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		tag    *imagtagv1.Tag
+		expgen int64
+		err    string
+	}{
+		{
+			name: "no known good generation",
+			tag:  newTag(4, nil),
+			err:  "no known good generation",
+		},
+		{
+			name: "already at known good generation",
+			tag:  newTag(4, &imagtagv1.KnownGood{Generation: 4}),
+			err:  "already at known good generation",
+		},
+		{
+			name: "known good generation no longer kept",
+			tag:  newTag(4, &imagtagv1.KnownGood{Generation: 1}),
+			err:  "no longer kept",
+		},
+		{
+			name:   "happy path",
+			tag:    newTag(4, &imagtagv1.KnownGood{Generation: 2}),
+			expgen: 2,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			tagcli := tagfake.NewSimpleClientset(tt.tag)
+
+			svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil, nil, nil, nil)
+			it, err := svc.RollbackToKnownGood(ctx, "atagnamespace", "atag")
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+			}
+
+			if it.Spec.Generation != tt.expgen {
+				t.Errorf("unexpected gen: %v", it.Spec.Generation)
+			}
+		})
+	}
+}
+
 func TestNewGeneration(t *testing.T) {
 	for _, tt := range []struct {
 		name         string
@@ -882,6 +2012,32 @@ func TestNewGeneration(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:         "pinned digest already imported",
+			tagName:      "atag",
+			tagNamespace: "atagnamespace",
+			err:          "tag pinned to already imported sha256:abc",
+			tagObjects: []runtime.Object{
+				&imagtagv1.Tag{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "atag",
+						Namespace: "atagnamespace",
+					},
+					Spec: imagtagv1.TagSpec{
+						From:       "centos@sha256:abc",
+						Generation: 0,
+					},
+					Status: imagtagv1.TagStatus{
+						References: []imagtagv1.HashReference{
+							{
+								From:       "centos@sha256:abc",
+								Generation: 0,
+							},
+						},
+					},
+				},
+			},
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -889,7 +2045,7 @@ func TestNewGeneration(t *testing.T) {
 
 			tagcli := tagfake.NewSimpleClientset(tt.tagObjects...)
 
-			svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil)
+			svc := NewTag(nil, tagcli, nil, nil, nil, nil, nil, nil, nil, nil)
 			it, err := svc.NewGeneration(ctx, tt.tagNamespace, tt.tagName)
 			if err != nil {
 				if len(tt.err) == 0 {
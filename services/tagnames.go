@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxTagLookups caps the number of upstream tags inspected when looking for
+// the tags pointing to a digest. Repositories may have thousands of tags and
+// every lookup is a request to the registry.
+const maxTagLookups = 50
+
+// UpstreamTags returns the tags in the repository of ref that point to the
+// provided digest. Only the first maxTagLookups tags in the repository are
+// inspected. Tags that can't be read are skipped.
+func UpstreamTags(
+	ctx context.Context,
+	ref reference.Named,
+	sysctx *types.SystemContext,
+	dgst digest.Digest,
+) ([]string, error) {
+	repo := reference.TrimNamed(ref)
+	tags, err := repositoryTags(ctx, repo, sysctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []string
+	for _, tag := range tags {
+		tagged, err := reference.WithTag(repo, tag)
+		if err != nil {
+			continue
+		}
+
+		tagdgst, err := tagDigest(ctx, tagged, sysctx)
+		if err != nil {
+			klog.V(4).Infof("unable to read %s: %s", tagged, err)
+			continue
+		}
+
+		if tagdgst == dgst {
+			found = append(found, tag)
+		}
+	}
+	return found, nil
+}
+
+// SelectUpstreamTag returns the tag, in the repository of ref, whose image
+// labels and manifest annotations match the selector. If many do the one
+// with the newest image is returned. Only the first maxTagLookups tags in the
+// repository are inspected, tags that can't be read are skipped.
+func SelectUpstreamTag(
+	ctx context.Context,
+	ref reference.Named,
+	sysctx *types.SystemContext,
+	selector labels.Selector,
+) (reference.NamedTagged, error) {
+	repo := reference.TrimNamed(ref)
+	tags, err := repositoryTags(ctx, repo, sysctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected reference.NamedTagged
+	var newest time.Time
+	for _, tag := range tags {
+		tagged, err := reference.WithTag(repo, tag)
+		if err != nil {
+			continue
+		}
+
+		lbls, created, err := imageLabels(ctx, tagged, sysctx)
+		if err != nil {
+			klog.V(4).Infof("unable to read %s: %s", tagged, err)
+			continue
+		}
+		if !selector.Matches(labels.Set(lbls)) {
+			continue
+		}
+		if selected == nil || created.After(newest) {
+			selected, newest = tagged, created
+		}
+	}
+
+	if selected == nil {
+		return nil, fmt.Errorf("no tag in %s matches %q", repo, selector)
+	}
+	return selected, nil
+}
+
+// repositoryTags lists the tags in a repository, capped at maxTagLookups.
+func repositoryTags(
+	ctx context.Context, repo reference.Named, sysctx *types.SystemContext,
+) ([]string, error) {
+	// references without tag nor digest can't be used, any tag does
+	// as only the repository is used when listing tags.
+	reporef, err := docker.NewReference(reference.TagNameOnly(repo))
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := docker.GetRepositoryTags(ctx, sysctx, reporef)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tags: %w", err)
+	}
+	if len(tags) > maxTagLookups {
+		klog.V(2).Infof(
+			"%s has %d tags, inspecting only %d",
+			repo, len(tags), maxTagLookups,
+		)
+		tags = tags[:maxTagLookups]
+	}
+	return tags, nil
+}
+
+// imageLabels returns the labels of the image a tagged reference points to,
+// merged with the annotations of its manifest, and when the image has been
+// created. Labels take precedence over annotations with the same key.
+func imageLabels(
+	ctx context.Context, ref reference.NamedTagged, sysctx *types.SystemContext,
+) (map[string]string, time.Time, error) {
+	imgref, err := docker.NewReference(ref)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	src, err := imgref.NewImageSource(ctx, sysctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	img, err := image.FromSource(ctx, sysctx, src)
+	if err != nil {
+		src.Close()
+		return nil, time.Time{}, err
+	}
+	defer img.Close()
+	return mergedImageLabels(ctx, img)
+}
+
+// mergedImageLabels returns the labels of an image merged with the
+// annotations of its manifest, and when the image has been created.
+func mergedImageLabels(
+	ctx context.Context, img types.Image,
+) (map[string]string, time.Time, error) {
+	merged := map[string]string{}
+	blob, mime, err := img.Manifest(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if mime == imgspecv1.MediaTypeImageManifest {
+		if oci, err := manifest.OCI1FromManifest(blob); err == nil {
+			for key, value := range oci.Annotations {
+				merged[key] = value
+			}
+		}
+	}
+
+	info, err := img.Inspect(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for key, value := range info.Labels {
+		merged[key] = value
+	}
+
+	var created time.Time
+	if info.Created != nil {
+		created = *info.Created
+	}
+	return merged, created, nil
+}
+
+// tagDigest returns the digest of the manifest a tagged reference points to.
+func tagDigest(
+	ctx context.Context, ref reference.NamedTagged, sysctx *types.SystemContext,
+) (digest.Digest, error) {
+	imgref, err := docker.NewReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := imgref.NewImageSource(ctx, sysctx)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	blob, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(blob)
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// tagsRegistry serves a repository tags list and the manifests they point to.
+type tagsRegistry map[string]string
+
+func (t tagsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.URL.Path == "/v2/repo/tags/list":
+		var tags []string
+		for tag := range t {
+			tags = append(tags, tag)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name": "repo",
+			"tags": tags,
+		})
+	case strings.HasPrefix(r.URL.Path, "/v2/repo/manifests/"):
+		tag := strings.TrimPrefix(r.URL.Path, "/v2/repo/manifests/")
+		blob, ok := t[tag]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.DockerV2Schema2MediaType)
+		fmt.Fprint(w, blob)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestUpstreamTags(t *testing.T) {
+	first := `{"schemaVersion": 2, "config": {"digest": "sha256:a"}}`
+	second := `{"schemaVersion": 2, "config": {"digest": "sha256:b"}}`
+	for _, tt := range []struct {
+		name     string
+		registry tagsRegistry
+		digest   digest.Digest
+		expected []string
+	}{
+		{
+			name:     "single tag",
+			registry: tagsRegistry{"v1": first, "v2": second},
+			digest:   digest.FromString(first),
+			expected: []string{"v1"},
+		},
+		{
+			name:     "no tag",
+			registry: tagsRegistry{"v1": first},
+			digest:   digest.FromString(second),
+		},
+		{
+			name:     "multiple tags",
+			registry: tagsRegistry{"v2": second, "latest": second, "v1": first},
+			digest:   digest.FromString(second),
+			expected: []string{"latest", "v2"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(tt.registry)
+			defer server.Close()
+
+			ref, err := reference.ParseNormalizedNamed(
+				fmt.Sprintf("%s/repo@%s", server.Listener.Addr(), tt.digest),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			tags, err := UpstreamTags(
+				context.Background(),
+				ref,
+				&types.SystemContext{
+					DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+				},
+				tt.digest,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// tags come in whatever order the registry lists them.
+			found := map[string]bool{}
+			for _, tag := range tags {
+				found[tag] = true
+			}
+			expected := map[string]bool{}
+			for _, tag := range tt.expected {
+				expected[tag] = true
+			}
+			if !reflect.DeepEqual(found, expected) {
+				t.Errorf("expected %v, %v received", tt.expected, tags)
+			}
+		})
+	}
+}
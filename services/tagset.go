@@ -0,0 +1,230 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	tagclient "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// TagSet moves the member Tags of TagSets together. Members waiting for the
+// rest of the set are promoted once the whole set may be promoted, see the
+// Promotion struct, and the generations of the members are recorded as a set
+// revision once all of them are promoted. If a member is moved back to an
+// older generation, by a downgrade or by an automatic rollback, all members
+// are moved back to the previous revision.
+type TagSet struct {
+	tagcli tagclient.Interface
+	taglis taglist.TagLister
+	prosvc *Promotion
+}
+
+// NewTagSet returns a handler for TagSets.
+func NewTagSet(
+	tagcli tagclient.Interface,
+	taglis taglist.TagLister,
+	tslis taglist.TagSetLister,
+) *TagSet {
+	return &TagSet{
+		tagcli: tagcli,
+		taglis: taglis,
+		prosvc: NewPromotion(taglis, tslis),
+	}
+}
+
+// Sync promotes, or rolls back, the members of the TagSet and records the
+// result in the TagSet status. Beware that the TagSet is changed in place,
+// i.e. use DeepCopy() before passing it in.
+func (t *TagSet) Sync(ctx context.Context, ts *imagtagv1.TagSet) error {
+	members, missing, err := t.members(ts)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		msg := fmt.Sprintf("tags not found: %s", strings.Join(missing, ", "))
+		return t.setReady(ctx, ts, metav1.ConditionFalse, imagtagv1.ReasonTagNotFound, msg)
+	}
+
+	if latest, ok := ts.LatestRevision(); ok && movedBack(members, latest) {
+		return t.rollback(ctx, ts, members)
+	}
+
+	if err := t.promote(ctx, members); err != nil {
+		return err
+	}
+
+	var pending []string
+	generations := map[string]int64{}
+	for _, it := range members {
+		_, hasCurrent := it.CurrentHashReference()
+		if !hasCurrent || it.Spec.Generation != it.Status.Generation {
+			pending = append(pending, it.Name)
+			continue
+		}
+		generations[it.Name] = it.Status.Generation
+	}
+	if len(pending) > 0 {
+		msg := fmt.Sprintf("waiting for tags: %s", strings.Join(pending, ", "))
+		return t.setReady(ctx, ts, metav1.ConditionFalse, imagtagv1.ReasonPromotionPending, msg)
+	}
+
+	registered := ts.RegisterRevision(generations)
+	latest, _ := ts.LatestRevision()
+	msg := fmt.Sprintf("revision %d promoted", latest.Revision)
+	changed := ts.SetCondition(
+		imagtagv1.ConditionReady, metav1.ConditionTrue, imagtagv1.ReasonRevisionPromoted, msg,
+	)
+	if !registered && !changed {
+		return nil
+	}
+	if registered {
+		klog.Infof("tag set %s/%s at revision %d", ts.Namespace, ts.Name, latest.Revision)
+	}
+	return t.update(ctx, ts)
+}
+
+// members returns the member Tags of the TagSet, in the same order as in the
+// TagSet spec, and the names of the members that do not exist.
+func (t *TagSet) members(ts *imagtagv1.TagSet) ([]*imagtagv1.Tag, []string, error) {
+	var members []*imagtagv1.Tag
+	var missing []string
+	for _, name := range ts.Spec.Tags {
+		it, err := t.taglis.Tags(ts.Namespace).Get(name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				missing = append(missing, name)
+				continue
+			}
+			return nil, nil, err
+		}
+		members = append(members, it)
+	}
+	return members, missing, nil
+}
+
+// movedBack returns true if any member is expected to run a generation older
+// than the one it has in the provided revision. Members added to the set after
+// the revision has been recorded are not considered.
+func movedBack(members []*imagtagv1.Tag, rev imagtagv1.TagSetRevision) bool {
+	for _, it := range members {
+		gen, ok := rev.Generations[it.Name]
+		if ok && it.Spec.Generation < gen {
+			return true
+		}
+	}
+	return false
+}
+
+// promote promotes the members whose new generation is waiting for the rest
+// of the set. Promoted members are replaced, in the provided slice, by their
+// updated version.
+func (t *TagSet) promote(ctx context.Context, members []*imagtagv1.Tag) error {
+	for i, it := range members {
+		if it.Spec.Generation <= it.Status.Generation || !it.SpecTagImported() {
+			continue
+		}
+
+		it = it.DeepCopy()
+		if _, err := t.prosvc.Promote(it); err != nil {
+			return err
+		}
+		if it.Spec.Generation != it.Status.Generation {
+			continue
+		}
+
+		it.RegisterReadiness()
+
+		it.RegisterHealth()
+		updated, err := t.tagcli.ImagesV1().Tags(it.Namespace).Update(
+			ctx, it, metav1.UpdateOptions{},
+		)
+		if err != nil {
+			return fmt.Errorf("error promoting tag %s: %w", it.Name, err)
+		}
+		members[i] = updated
+	}
+	return nil
+}
+
+// rollback moves all members back to their generation in the previous set
+// revision, dropping the latest revision. Members are moved before the TagSet
+// is updated so an interrupted rollback is resumed on the next sync.
+func (t *TagSet) rollback(
+	ctx context.Context, ts *imagtagv1.TagSet, members []*imagtagv1.Tag,
+) error {
+	next := ts.DeepCopy()
+	target, ok := next.RegisterRollback()
+	if !ok {
+		return t.setReady(
+			ctx, ts, metav1.ConditionFalse, imagtagv1.ReasonRollbackFailed,
+			"no previous revision to roll back to",
+		)
+	}
+
+	var moving []*imagtagv1.Tag
+	for _, it := range members {
+		gen, ok := target.Generations[it.Name]
+		if !ok || it.Spec.Generation == gen {
+			continue
+		}
+
+		it = it.DeepCopy()
+		it.Spec.Generation = gen
+		if !it.SpecTagImported() {
+			msg := fmt.Sprintf("tag %s generation %d no longer available", it.Name, gen)
+			return t.setReady(
+				ctx, ts, metav1.ConditionFalse, imagtagv1.ReasonRollbackFailed, msg,
+			)
+		}
+		it.RegisterReadiness()
+		it.RegisterHealth()
+		moving = append(moving, it)
+	}
+
+	for _, it := range moving {
+		if _, err := t.tagcli.ImagesV1().Tags(it.Namespace).Update(
+			ctx, it, metav1.UpdateOptions{},
+		); err != nil {
+			return fmt.Errorf("error rolling back tag %s: %w", it.Name, err)
+		}
+	}
+
+	klog.Infof("tag set %s/%s rolled back to revision %d", ts.Namespace, ts.Name, target.Revision)
+	msg := fmt.Sprintf("rolling back to revision %d", target.Revision)
+	next.SetCondition(
+		imagtagv1.ConditionReady, metav1.ConditionFalse, imagtagv1.ReasonRolledBack, msg,
+	)
+	return t.update(ctx, next)
+}
+
+// setReady sets the Ready condition on the TagSet, updating it only if the
+// condition has changed.
+func (t *TagSet) setReady(
+	ctx context.Context,
+	ts *imagtagv1.TagSet,
+	status metav1.ConditionStatus,
+	reason string,
+	msg string,
+) error {
+	if !ts.SetCondition(imagtagv1.ConditionReady, status, reason, msg) {
+		return nil
+	}
+	return t.update(ctx, ts)
+}
+
+// update updates the TagSet through the kubernetes api.
+func (t *TagSet) update(ctx context.Context, ts *imagtagv1.TagSet) error {
+	if _, err := t.tagcli.ImagesV1().TagSets(ts.Namespace).Update(
+		ctx, ts, metav1.UpdateOptions{},
+	); err != nil {
+		return fmt.Errorf("error updating tag set: %w", err)
+	}
+	return nil
+}
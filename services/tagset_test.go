@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestTagSetSync(t *testing.T) {
+	member := func(name string, spec, status int64, imported ...int64) *imagtagv1.Tag {
+		it := &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "ns",
+			},
+			Spec: imagtagv1.TagSpec{
+				Generation: spec,
+			},
+			Status: imagtagv1.TagStatus{
+				Generation: status,
+			},
+		}
+		for _, gen := range imported {
+			it.Status.References = append(
+				it.Status.References,
+				imagtagv1.HashReference{Generation: gen},
+			)
+		}
+		return it
+	}
+
+	revision := func(rev, gen int64) imagtagv1.TagSetRevision {
+		return imagtagv1.TagSetRevision{
+			Revision:    rev,
+			Generations: map[string]int64{"frontend": gen, "backend": gen},
+		}
+	}
+
+	for _, tt := range []struct {
+		name      string
+		tags      []string
+		revisions []imagtagv1.TagSetRevision
+		objects   []runtime.Object
+		promoted  map[string]int64
+		moved     map[string]int64
+		reason    string
+		revision  int64
+	}{
+		{
+			name: "members promoted together",
+			objects: []runtime.Object{
+				member("frontend", 2, 1, 2, 1),
+				member("backend", 2, 1, 2, 1),
+			},
+			promoted: map[string]int64{"frontend": 2, "backend": 2},
+			reason:   imagtagv1.ReasonRevisionPromoted,
+			revision: 0,
+		},
+		{
+			name:      "new revision recorded",
+			revisions: []imagtagv1.TagSetRevision{revision(0, 1)},
+			objects: []runtime.Object{
+				member("frontend", 2, 1, 2, 1),
+				member("backend", 1, 1, 1),
+			},
+			promoted: map[string]int64{"frontend": 2, "backend": 1},
+			reason:   imagtagv1.ReasonRevisionPromoted,
+			revision: 1,
+		},
+		{
+			name:      "member waiting for import",
+			revisions: []imagtagv1.TagSetRevision{revision(0, 1)},
+			objects: []runtime.Object{
+				member("frontend", 2, 1, 2, 1),
+				member("backend", 2, 1, 1),
+			},
+			promoted: map[string]int64{"frontend": 1, "backend": 1},
+			reason:   imagtagv1.ReasonPromotionPending,
+			revision: 0,
+		},
+		{
+			name: "member not found",
+			tags: []string{"frontend", "worker"},
+			objects: []runtime.Object{
+				member("frontend", 2, 1, 2, 1),
+			},
+			promoted: map[string]int64{"frontend": 1},
+			reason:   imagtagv1.ReasonTagNotFound,
+			revision: -1,
+		},
+		{
+			name: "member moved back",
+			revisions: []imagtagv1.TagSetRevision{
+				revision(1, 2),
+				revision(0, 1),
+			},
+			objects: []runtime.Object{
+				member("frontend", 1, 1, 2, 1),
+				member("backend", 2, 2, 2, 1),
+			},
+			moved:    map[string]int64{"frontend": 1, "backend": 1},
+			reason:   imagtagv1.ReasonRolledBack,
+			revision: 0,
+		},
+		{
+			name:      "nothing to roll back to",
+			revisions: []imagtagv1.TagSetRevision{revision(0, 2)},
+			objects: []runtime.Object{
+				member("frontend", 1, 1, 2, 1),
+				member("backend", 2, 2, 2, 1),
+			},
+			promoted: map[string]int64{"frontend": 1, "backend": 2},
+			reason:   imagtagv1.ReasonRollbackFailed,
+			revision: 0,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if tt.tags == nil {
+				tt.tags = []string{"frontend", "backend"}
+			}
+			ts := &imagtagv1.TagSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app",
+					Namespace: "ns",
+				},
+				Spec: imagtagv1.TagSetSpec{
+					Tags: tt.tags,
+				},
+				Status: imagtagv1.TagSetStatus{
+					Revisions: tt.revisions,
+				},
+			}
+
+			tagcli := tagfake.NewSimpleClientset(append(tt.objects, ts)...)
+			taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+			tslis := taginf.Images().V1().TagSets().Lister()
+			taginf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				taginf.Images().V1().Tags().Informer().HasSynced,
+				taginf.Images().V1().TagSets().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			svc := NewTagSet(tagcli, taglis, tslis)
+			if err := svc.Sync(ctx, ts.DeepCopy()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			for name, gen := range tt.promoted {
+				it, err := tagcli.ImagesV1().Tags("ns").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if it.Status.Generation != gen {
+					t.Errorf("expected %s at generation %d, %+v", name, gen, it.Status)
+				}
+			}
+
+			for name, gen := range tt.moved {
+				it, err := tagcli.ImagesV1().Tags("ns").Get(ctx, name, metav1.GetOptions{})
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if it.Spec.Generation != gen {
+					t.Errorf("expected %s moved to generation %d, %+v", name, gen, it.Spec)
+				}
+			}
+
+			ts, err := tagcli.ImagesV1().TagSets("ns").Get(ctx, "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			cond := meta.FindStatusCondition(ts.Status.Conditions, imagtagv1.ConditionReady)
+			if cond == nil || cond.Reason != tt.reason {
+				t.Errorf("expected reason %s, %+v found", tt.reason, cond)
+			}
+
+			latest, ok := ts.LatestRevision()
+			if tt.revision < 0 {
+				if ok {
+					t.Errorf("unexpected revision: %+v", latest)
+				}
+				return
+			}
+			if latest.Revision != tt.revision {
+				t.Errorf("expected revision %d, %+v found", tt.revision, ts.Status.Revisions)
+			}
+		})
+	}
+}
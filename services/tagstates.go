@@ -0,0 +1,122 @@
+package services
+
+import (
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+	"github.com/ricardomaraschini/tagger/metrics"
+)
+
+// These are the states a Tag is reported in by the tags gauge. Each Tag is in
+// exactly one state, if many apply the first one in this list is used.
+const (
+	// TagStateFailing means the last import of the Tag failed.
+	TagStateFailing = "failing"
+	// TagStatePaused means a new generation is held back by the Tag
+	// promotion policy.
+	TagStatePaused = "paused"
+	// TagStateDrifted means Deployments using the Tag do not run its
+	// current generation, their rollout is in progress or has failed.
+	TagStateDrifted = "drifted"
+	// TagStatePending means the Tag has not been imported yet.
+	TagStatePending = "pending"
+	// TagStateReady means the Tag current generation is imported and
+	// running everywhere it is used.
+	TagStateReady = "ready"
+)
+
+// tagStates holds all states in the order they take precedence.
+var tagStates = []string{
+	TagStateFailing,
+	TagStatePaused,
+	TagStateDrifted,
+	TagStatePending,
+	TagStateReady,
+}
+
+// TagState returns the state a Tag is in.
+func TagState(it *imagtagv1.Tag) string {
+	conds := it.Status.Conditions
+	switch {
+	case meta.IsStatusConditionFalse(conds, imagtagv1.ConditionImported):
+		return TagStateFailing
+	case it.Status.Promotion != nil &&
+		it.Status.Promotion.Phase == imagtagv1.PromotionPending:
+		return TagStatePaused
+	case meta.FindStatusCondition(conds, imagtagv1.ConditionRolledOut) != nil &&
+		!meta.IsStatusConditionTrue(conds, imagtagv1.ConditionRolledOut):
+		return TagStateDrifted
+	}
+	if _, ok := it.CurrentHashReference(); !ok {
+		return TagStatePending
+	}
+	return TagStateReady
+}
+
+// TagStates is a prometheus collector reporting the number of Tags in each
+// state per namespace. Tags are read from the cache on each scrape so the
+// numbers are never stale. When sharding only the namespaces owned by our
+// shard are reported, summing up all replicas gives the cluster totals.
+type TagStates struct {
+	taglis taglist.TagLister
+	shard  *Shard
+}
+
+// NewTagStates returns a collector for Tag states. Shard may be nil, meaning
+// all namespaces are reported.
+func NewTagStates(taglis taglist.TagLister, shard *Shard) *TagStates {
+	return &TagStates{
+		taglis: taglis,
+		shard:  shard,
+	}
+}
+
+// Describe sends the description of the tags gauge.
+func (t *TagStates) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.TagsDesc
+}
+
+// Collect counts Tags per namespace and state. All states are reported for
+// every namespace with Tags, including the ones with no Tags in them.
+func (t *TagStates) Collect(ch chan<- prometheus.Metric) {
+	tags, err := t.taglis.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("unable to list tags for metrics: %s", err)
+		return
+	}
+
+	counts := map[string]map[string]int{}
+	for _, it := range tags {
+		if t.shard != nil && !t.shard.Owns(it.Namespace) {
+			continue
+		}
+		if _, ok := counts[it.Namespace]; !ok {
+			counts[it.Namespace] = map[string]int{}
+		}
+		counts[it.Namespace][TagState(it)]++
+	}
+
+	namespaces := make([]string, 0, len(counts))
+	for ns := range counts {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	for _, ns := range namespaces {
+		for _, state := range tagStates {
+			ch <- prometheus.MustNewConstMetric(
+				metrics.TagsDesc,
+				prometheus.GaugeValue,
+				float64(counts[ns][state]),
+				ns, state,
+			)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestTagState(t *testing.T) {
+	imported := []imagtagv1.HashReference{
+		{
+			Generation:     0,
+			ImageReference: "quay.io/repo/image@sha256:abc",
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		status   imagtagv1.TagStatus
+		expected string
+	}{
+		{
+			name:     "not imported",
+			expected: TagStatePending,
+		},
+		{
+			name:     "ready",
+			status:   imagtagv1.TagStatus{References: imported},
+			expected: TagStateReady,
+		},
+		{
+			name: "failing",
+			status: imagtagv1.TagStatus{
+				References: imported,
+				Conditions: []metav1.Condition{
+					{
+						Type:   imagtagv1.ConditionImported,
+						Status: metav1.ConditionFalse,
+					},
+				},
+			},
+			expected: TagStateFailing,
+		},
+		{
+			name: "paused",
+			status: imagtagv1.TagStatus{
+				References: imported,
+				Promotion: &imagtagv1.Promotion{
+					Phase: imagtagv1.PromotionPending,
+				},
+			},
+			expected: TagStatePaused,
+		},
+		{
+			name: "drifted",
+			status: imagtagv1.TagStatus{
+				References: imported,
+				Conditions: []metav1.Condition{
+					{
+						Type:   imagtagv1.ConditionRolledOut,
+						Status: metav1.ConditionUnknown,
+					},
+				},
+			},
+			expected: TagStateDrifted,
+		},
+		{
+			name: "rolled out",
+			status: imagtagv1.TagStatus{
+				References: imported,
+				Conditions: []metav1.Condition{
+					{
+						Type:   imagtagv1.ConditionRolledOut,
+						Status: metav1.ConditionTrue,
+					},
+				},
+			},
+			expected: TagStateReady,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			it := &imagtagv1.Tag{Status: tt.status}
+			if state := TagState(it); state != tt.expected {
+				t.Errorf("expected state %q, %q received", tt.expected, state)
+			}
+		})
+	}
+}
+
+func TestTagStatesCollect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	newTag := func(namespace, name string, imported bool) *imagtagv1.Tag {
+		it := &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+		}
+		if imported {
+			it.Status.References = []imagtagv1.HashReference{
+				{ImageReference: "quay.io/repo/image@sha256:abc"},
+			}
+		}
+		return it
+	}
+
+	objects := []runtime.Object{
+		newTag("team-a", "one", true),
+		newTag("team-a", "two", true),
+		newTag("team-a", "three", false),
+		newTag("team-b", "one", true),
+	}
+
+	tagcli := tagfake.NewSimpleClientset(objects...)
+	taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+	taglis := taginf.Images().V1().Tags().Lister()
+	taginf.Start(ctx.Done())
+	if !cache.WaitForCacheSync(
+		ctx.Done(),
+		taginf.Images().V1().Tags().Informer().HasSynced,
+	) {
+		t.Fatal("errors waiting for caches to sync")
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewTagStates(taglis, nil))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("expected one metric family, %d received", len(families))
+	}
+
+	values := map[string]float64{}
+	for _, metric := range families[0].GetMetric() {
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		key := labels["namespace"] + "/" + labels["state"]
+		values[key] = metric.GetGauge().GetValue()
+	}
+
+	if len(values) != 2*len(tagStates) {
+		t.Errorf("expected all states for both namespaces: %v", values)
+	}
+	for key, expected := range map[string]float64{
+		"team-a/ready":   2,
+		"team-a/pending": 1,
+		"team-a/failing": 0,
+		"team-b/ready":   1,
+	} {
+		if values[key] != expected {
+			t.Errorf("expected %v for %s, %v received", expected, key, values[key])
+		}
+	}
+}
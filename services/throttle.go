@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+// Throttle limits the bandwidth used when copying blobs. A global limit is
+// shared by all copies and optional per registry limits apply only to blobs
+// read from a given registry. Limits are expressed in bytes per second, zero
+// means unlimited.
+type Throttle struct {
+	sync.Mutex
+	global     *rate.Limiter
+	registries map[string]*rate.Limiter
+}
+
+// NewThrottle returns a bandwidth throttle without any limit set.
+func NewThrottle() *Throttle {
+	return &Throttle{
+		global:     rate.NewLimiter(rate.Inf, 0),
+		registries: map[string]*rate.Limiter{},
+	}
+}
+
+// setLimit sets the limiter rate to provided bytes per second. Zero or
+// negative values disable the limit.
+func setLimit(lim *rate.Limiter, bps int64) {
+	if bps <= 0 {
+		lim.SetLimit(rate.Inf)
+		lim.SetBurst(0)
+		return
+	}
+	lim.SetLimit(rate.Limit(bps))
+	lim.SetBurst(int(bps))
+}
+
+// ApplyConfig applies configured bandwidth limits. Limits are changed in
+// place so copies already in progress are affected as well.
+func (t *Throttle) ApplyConfig(cfg *config.Config) {
+	t.Lock()
+	defer t.Unlock()
+
+	setLimit(t.global, cfg.Bandwidth.Global)
+	for registry, lim := range t.registries {
+		if _, ok := cfg.Bandwidth.Registries[registry]; !ok {
+			setLimit(lim, 0)
+			delete(t.registries, registry)
+		}
+	}
+	for registry, bps := range cfg.Bandwidth.Registries {
+		lim, ok := t.registries[registry]
+		if !ok {
+			lim = rate.NewLimiter(rate.Inf, 0)
+			t.registries[registry] = lim
+		}
+		setLimit(lim, bps)
+	}
+}
+
+// limitersFor returns the limiters applying to blobs read from registry.
+func (t *Throttle) limitersFor(registry string) []*rate.Limiter {
+	t.Lock()
+	defer t.Unlock()
+	lims := []*rate.Limiter{t.global}
+	if lim, ok := t.registries[registry]; ok {
+		lims = append(lims, lim)
+	}
+	return lims
+}
+
+// Reader returns a reader that respects the bandwidth limits set for the
+// provided registry.
+func (t *Throttle) Reader(ctx context.Context, registry string, r io.Reader) io.Reader {
+	return &throttledReader{
+		ctx:      ctx,
+		reader:   r,
+		limiters: t.limitersFor(registry),
+	}
+}
+
+// ImageReference wraps provided image reference so all blobs read from its
+// image sources are throttled.
+func (t *Throttle) ImageReference(ref types.ImageReference) types.ImageReference {
+	registry := ""
+	if named := ref.DockerReference(); named != nil {
+		registry = reference.Domain(named)
+	}
+	return &throttledReference{
+		ImageReference: ref,
+		throttle:       t,
+		registry:       registry,
+	}
+}
+
+// throttledReader is an io.Reader that waits on a set of rate limiters after
+// each read, slowing down the reads to respect their limits.
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*rate.Limiter
+}
+
+// Read reads at most the burst of the most restrictive limiter and then waits
+// until the limiters allow the bytes read.
+func (t *throttledReader) Read(p []byte) (int, error) {
+	for _, lim := range t.limiters {
+		if lim.Limit() == rate.Inf {
+			continue
+		}
+		if burst := lim.Burst(); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := t.reader.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+	for _, lim := range t.limiters {
+		if werr := lim.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttledReference is an image reference whose image sources are throttled.
+type throttledReference struct {
+	types.ImageReference
+	throttle *Throttle
+	registry string
+}
+
+// NewImageSource returns a throttled image source.
+func (t *throttledReference) NewImageSource(
+	ctx context.Context, sys *types.SystemContext,
+) (types.ImageSource, error) {
+	src, err := t.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledSource{
+		ImageSource: src,
+		throttle:    t.throttle,
+		registry:    t.registry,
+	}, nil
+}
+
+// throttledSource is an image source whose blobs are read respecting the
+// configured bandwidth limits.
+type throttledSource struct {
+	types.ImageSource
+	throttle *Throttle
+	registry string
+}
+
+// GetBlob returns a throttled stream for the blob.
+func (t *throttledSource) GetBlob(
+	ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache,
+) (io.ReadCloser, int64, error) {
+	rc, size, err := t.ImageSource.GetBlob(ctx, info, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &readCloser{
+		Reader: t.throttle.Reader(ctx, t.registry, rc),
+		Closer: rc,
+	}, size, nil
+}
+
+// readCloser glues together a reader and a closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
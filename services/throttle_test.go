@@ -0,0 +1,106 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/ricardomaraschini/tagger/config"
+)
+
+func TestThrottleApplyConfig(t *testing.T) {
+	throttle := NewThrottle()
+
+	cfg := config.Default()
+	cfg.Bandwidth = config.Bandwidth{
+		Global: 2048,
+		Registries: map[string]int64{
+			"quay.io": 1024,
+		},
+	}
+	throttle.ApplyConfig(cfg)
+
+	lims := throttle.limitersFor("quay.io")
+	if len(lims) != 2 {
+		t.Fatalf("expected 2 limiters, %d found", len(lims))
+	}
+	if lims[0].Limit() != 2048 || lims[1].Limit() != 1024 {
+		t.Errorf("unexpected limits: %v, %v", lims[0].Limit(), lims[1].Limit())
+	}
+
+	if lims := throttle.limitersFor("docker.io"); len(lims) != 1 {
+		t.Errorf("expected 1 limiter, %d found", len(lims))
+	}
+
+	// limits are updated in place, readers already running must see them.
+	throttle.ApplyConfig(config.Default())
+	for _, lim := range lims {
+		if lim.Limit() != rate.Inf {
+			t.Errorf("expected no limit, %v found", lim.Limit())
+		}
+	}
+	if lims := throttle.limitersFor("quay.io"); len(lims) != 1 {
+		t.Errorf("expected 1 limiter, %d found", len(lims))
+	}
+}
+
+func TestThrottleReader(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		global   int64
+		registry int64
+		size     int
+		min      time.Duration
+	}{
+		{
+			name: "unlimited",
+			size: 1024 * 1024,
+		},
+		{
+			name:   "global limit",
+			global: 1000,
+			size:   2500,
+			min:    time.Second,
+		},
+		{
+			name:     "registry limit",
+			global:   1000000,
+			registry: 1000,
+			size:     2500,
+			min:      time.Second,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Bandwidth = config.Bandwidth{
+				Global: tt.global,
+				Registries: map[string]int64{
+					"quay.io": tt.registry,
+				},
+			}
+			throttle := NewThrottle()
+			throttle.ApplyConfig(cfg)
+
+			data := bytes.Repeat([]byte("x"), tt.size)
+			reader := throttle.Reader(
+				context.Background(), "quay.io", bytes.NewReader(data),
+			)
+
+			start := time.Now()
+			read, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(read) != tt.size {
+				t.Errorf("expected %d bytes, %d read", tt.size, len(read))
+			}
+			if elapsed := time.Since(start); elapsed < tt.min {
+				t.Errorf("read too fast: %v", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/containers/image/v5/docker/reference"
+
+	taglist "github.com/ricardomaraschini/tagger/imagetags/generated/listers/imagetags/v1"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// TriggersAnnotation set to "*" on a Deployment makes every container image
+// matching a Tag in the namespace to be resolved and tracked, there is no need
+// to annotate it with "image-tag". An image matches a Tag if it refers to the
+// Tag by name or if it is the image the Tag is imported from.
+const TriggersAnnotation = "image-triggers"
+
+// tagTriggers returns if the provided annotations (of a Deployment or of a
+// ReplicaSet) opt in for Tags and if all container images matching a Tag are
+// tracked, not only those referring to Tags by name.
+func tagTriggers(annotations map[string]string) (bool, bool) {
+	if annotations[TriggersAnnotation] == "*" {
+		return true, true
+	}
+	_, ok := annotations["image-tag"]
+	return ok, false
+}
+
+// normalizeImage returns the fully qualified form of an image reference, e.g.
+// "docker.io/library/centos:latest" for "centos". References that can't be
+// parsed are returned as they are.
+func normalizeImage(image string) string {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return image
+	}
+	return named.String()
+}
+
+// imageMatchesTag returns true if a container image refers to the Tag by name
+// or, if wildcard is set, if it is the image the Tag is imported from.
+func imageMatchesTag(image string, it *imagtagv1.Tag, wildcard bool) bool {
+	if image == it.Name {
+		return true
+	}
+	if !wildcard || it.Spec.From == "" {
+		return false
+	}
+	return normalizeImage(image) == normalizeImage(it.Spec.From)
+}
+
+// tagForImage returns the Tag a container image refers to. Images refer to
+// Tags by name and, if wildcard is set, by the image the Tag is imported
+// from. If many Tags are imported from the image the first one, by name, is
+// returned. Returns nil if no Tag matches the image.
+func tagForImage(
+	taglis taglist.TagLister, namespace, image string, wildcard bool,
+) (*imagtagv1.Tag, error) {
+	it, err := taglis.Tags(namespace).Get(image)
+	if err == nil {
+		return it, nil
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if !wildcard {
+		return nil, nil
+	}
+
+	tags, err := taglis.Tags(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	for _, it := range tags {
+		if imageMatchesTag(image, it, true) {
+			return it, nil
+		}
+	}
+	return nil, nil
+}
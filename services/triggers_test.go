@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	itaginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+func TestTagTriggers(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		annotations map[string]string
+		tracked     bool
+		wildcard    bool
+	}{
+		{
+			name: "no annotations",
+		},
+		{
+			name:        "image tag",
+			annotations: map[string]string{"image-tag": "true"},
+			tracked:     true,
+		},
+		{
+			name:        "wildcard",
+			annotations: map[string]string{TriggersAnnotation: "*"},
+			tracked:     true,
+			wildcard:    true,
+		},
+		{
+			name:        "not a wildcard",
+			annotations: map[string]string{TriggersAnnotation: "mytag"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tracked, wildcard := tagTriggers(tt.annotations)
+			if tracked != tt.tracked || wildcard != tt.wildcard {
+				t.Errorf(
+					"expected %v/%v, %v/%v received",
+					tt.tracked, tt.wildcard, tracked, wildcard,
+				)
+			}
+		})
+	}
+}
+
+func TestTagForImage(t *testing.T) {
+	newTag := func(name, from string) *imagtagv1.Tag {
+		return &imagtagv1.Tag{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "ns",
+			},
+			Spec: imagtagv1.TagSpec{
+				From: from,
+			},
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		image    string
+		wildcard bool
+		objects  []runtime.Object
+		expected string
+	}{
+		{
+			name:     "by name",
+			image:    "mytag",
+			objects:  []runtime.Object{newTag("mytag", "centos:latest")},
+			expected: "mytag",
+		},
+		{
+			name:    "by source without wildcard",
+			image:   "centos:latest",
+			objects: []runtime.Object{newTag("mytag", "centos:latest")},
+		},
+		{
+			name:     "by source",
+			image:    "docker.io/library/centos:latest",
+			wildcard: true,
+			objects:  []runtime.Object{newTag("mytag", "centos")},
+			expected: "mytag",
+		},
+		{
+			name:     "many tags from the same image",
+			image:    "quay.io/repo/app:v1",
+			wildcard: true,
+			objects: []runtime.Object{
+				newTag("tag-b", "quay.io/repo/app:v1"),
+				newTag("tag-a", "quay.io/repo/app:v1"),
+			},
+			expected: "tag-a",
+		},
+		{
+			name:     "no match",
+			image:    "quay.io/repo/app:v2",
+			wildcard: true,
+			objects:  []runtime.Object{newTag("mytag", "quay.io/repo/app:v1")},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tagcli := tagfake.NewSimpleClientset(tt.objects...)
+			taginf := itaginf.NewSharedInformerFactory(tagcli, time.Minute)
+			taglis := taginf.Images().V1().Tags().Lister()
+			taginf.Start(ctx.Done())
+			if !cache.WaitForCacheSync(
+				ctx.Done(),
+				taginf.Images().V1().Tags().Informer().HasSynced,
+			) {
+				t.Fatal("errors waiting for caches to sync")
+			}
+
+			it, err := tagForImage(taglis, "ns", tt.image, tt.wildcard)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			name := ""
+			if it != nil {
+				name = it.Name
+			}
+			if name != tt.expected {
+				t.Errorf("expected tag %q, %q received", tt.expected, name)
+			}
+		})
+	}
+}
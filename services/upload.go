@@ -0,0 +1,564 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// ChunkedUploader uploads blobs to a registry in chunks, using the docker
+// registry v2 chunked upload protocol. If sending a chunk fails the upload
+// status is read from the registry and the upload resumes from the last
+// byte the registry has received, i.e. a network blip during a multi GB layer
+// upload does not restart it from scratch.
+type ChunkedUploader struct {
+	mtx      sync.Mutex
+	client   *http.Client
+	host     string
+	insecure bool
+	scheme   string
+	auth     *types.DockerAuthConfig
+	agent    string
+	bearer   string
+	chunk    int64
+	retries  int
+	backoff  time.Duration
+	progress *ImportProgress
+	budget   *MemoryBudget
+}
+
+// NewChunkedUploader returns an uploader for the registry at host. Chunk is
+// the size of each chunk sent, retries is how many times a failed chunk is
+// resumed. Authentication, TLS verification and the User-Agent are read from
+// sysctx. As the image library does, registries we are allowed to skip TLS
+// verification for are talked to over plain http if https fails.
+func NewChunkedUploader(
+	host string, sysctx *types.SystemContext, chunk int64, retries int,
+) *ChunkedUploader {
+	insecure := sysctx.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecure}
+	return &ChunkedUploader{
+		client:   &http.Client{Transport: transport},
+		host:     host,
+		insecure: insecure,
+		auth:     sysctx.DockerAuthConfig,
+		agent:    sysctx.DockerRegistryUserAgent,
+		chunk:    chunk,
+		retries:  retries,
+		backoff:  time.Second,
+	}
+}
+
+// WithProgress makes the uploader report the upload progress.
+func (c *ChunkedUploader) WithProgress(progress *ImportProgress) *ChunkedUploader {
+	c.progress = progress
+	return c
+}
+
+// WithBudget makes the uploader take the chunk buffer of every upload from
+// the provided memory budget.
+func (c *ChunkedUploader) WithBudget(budget *MemoryBudget) *ChunkedUploader {
+	c.budget = budget
+	return c
+}
+
+// setUserAgent sets the configured User-Agent on the request.
+func (c *ChunkedUploader) setUserAgent(req *http.Request) {
+	if c.agent != "" {
+		req.Header.Set("User-Agent", c.agent)
+	}
+}
+
+// challenge parses a WWW-Authenticate header value into its scheme and
+// parameters.
+func challenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) < 2 {
+		return strings.ToLower(parts[0]), params
+	}
+	for _, param := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return strings.ToLower(parts[0]), params
+}
+
+// fetchToken obtains a bearer token from the realm in the challenge params.
+func (c *ChunkedUploader) fetchToken(ctx context.Context, params map[string]string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("invalid realm: %w", err)
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	if scope, ok := params["scope"]; ok {
+		query.Set("scope", scope)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	c.setUserAgent(req)
+	if c.auth != nil && c.auth.Username != "" {
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("error decoding token: %w", err)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.bearer = token.Token
+	if c.bearer == "" {
+		c.bearer = token.AccessToken
+	}
+	return nil
+}
+
+// authorize sets the authorization header on the request.
+func (c *ChunkedUploader) authorize(req *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	switch {
+	case c.bearer != "":
+		req.Header.Set("Authorization", "Bearer "+c.bearer)
+	case c.auth != nil && c.auth.IdentityToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.auth.IdentityToken)
+	case c.auth != nil && c.auth.Username != "":
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+}
+
+// do sends a request created by newreq. If the registry challenges us for
+// a token we obtain it and send the request once more.
+func (c *ChunkedUploader) do(
+	ctx context.Context, newreq func() (*http.Request, error),
+) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newreq()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		c.setUserAgent(req)
+		c.authorize(req)
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+
+		scheme, params := challenge(resp.Header.Get("WWW-Authenticate"))
+		resp.Body.Close()
+		if scheme != "bearer" {
+			return nil, fmt.Errorf("unauthorized")
+		}
+		if err := c.fetchToken(ctx, params); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// location resolves the upload location returned by the registry.
+func (c *ChunkedUploader) location(resp *http.Response) (string, error) {
+	loc, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location: %w", err)
+	}
+	return loc.String(), nil
+}
+
+// ping checks if the registry answers on the v2 endpoint using the provided
+// scheme.
+func (c *ChunkedUploader) ping(ctx context.Context, scheme string) error {
+	uri := fmt.Sprintf("%s://%s/v2/", scheme, c.host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	c.setUserAgent(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("unexpected status pinging registry: %s", resp.Status)
+	}
+	return nil
+}
+
+// endpoint returns the scheme used to talk to the registry. If https fails
+// and we are allowed to skip TLS verification plain http is attempted.
+func (c *ChunkedUploader) endpoint(ctx context.Context) (string, error) {
+	c.mtx.Lock()
+	scheme := c.scheme
+	c.mtx.Unlock()
+	if scheme != "" {
+		return scheme, nil
+	}
+
+	scheme = "https"
+	err := c.ping(ctx, scheme)
+	if err != nil && c.insecure {
+		scheme = "http"
+		err = c.ping(ctx, scheme)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error pinging registry %s: %w", c.host, err)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.scheme = scheme
+	return scheme, nil
+}
+
+// start starts a new upload for repository, returning its location.
+func (c *ChunkedUploader) start(ctx context.Context, repo string) (string, error) {
+	scheme, err := c.endpoint(ctx)
+	if err != nil {
+		return "", err
+	}
+	uri := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/", scheme, c.host, repo)
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, uri, nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("unexpected status starting upload: %s", resp.Status)
+	}
+	return c.location(resp)
+}
+
+// status returns the location and the number of bytes the registry already
+// received for the upload in location.
+func (c *ChunkedUploader) status(ctx context.Context, location string) (string, int64, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, location, nil)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return "", 0, fmt.Errorf("unexpected status reading upload: %s", resp.Status)
+	}
+
+	loc, err := c.location(resp)
+	if err != nil {
+		loc = location
+	}
+	received, err := rangeEnd(resp.Header.Get("Range"))
+	return loc, received, err
+}
+
+// rangeEnd parses a "0-<end>" range header, returning the number of bytes it
+// covers.
+func rangeEnd(header string) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	parts := strings.SplitN(header, "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid range %q", header)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid range %q: %w", header, err)
+	}
+	return end + 1, nil
+}
+
+// patch sends data, starting at offset, to the upload in location. Returns
+// the location to be used in the next request.
+func (c *ChunkedUploader) patch(
+	ctx context.Context, location string, data []byte, offset int64,
+) (string, error) {
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPatch, location, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set(
+			"Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(data))-1),
+		)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", fmt.Errorf("unexpected status sending chunk: %s", resp.Status)
+	}
+	return c.location(resp)
+}
+
+// finish commits the upload in location with the provided digest.
+func (c *ChunkedUploader) finish(
+	ctx context.Context, location string, dgst digest.Digest,
+) error {
+	uri, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	query := uri.Query()
+	query.Set("digest", dgst.String())
+	uri.RawQuery = query.Encode()
+
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPut, uri.String(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status committing upload: %s", resp.Status)
+	}
+	return nil
+}
+
+// sendChunk sends a chunk starting at offset. If sending fails the upload
+// status is read from the registry and only the part of the chunk not yet
+// received is sent again.
+func (c *ChunkedUploader) sendChunk(
+	ctx context.Context, location string, data []byte, offset int64, key string, size int64,
+) (string, error) {
+	sent := int64(0)
+	for retries := c.retries; ; retries-- {
+		loc, err := c.patch(ctx, location, data[sent:], offset+sent)
+		if err == nil {
+			return loc, nil
+		}
+		if retries <= 0 || ctx.Err() != nil {
+			return "", err
+		}
+
+		klog.V(2).Infof("error sending chunk at %d, resuming: %s", offset+sent, err)
+		select {
+		case <-time.After(c.backoff):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+
+		loc, received, serr := c.status(ctx, location)
+		if serr != nil {
+			return "", fmt.Errorf("unable to resume upload: %w", serr)
+		}
+		if received < offset || received > offset+int64(len(data)) {
+			return "", fmt.Errorf("registry has %d bytes, chunk at %d", received, offset)
+		}
+		location = loc
+		sent = received - offset
+		c.progress.Uploaded(key, location, received, size, true)
+
+		// the registry got the whole chunk but its answer was lost.
+		if sent == int64(len(data)) {
+			return location, nil
+		}
+	}
+}
+
+// resume resumes the upload of the blob left by a previous import, if there
+// is one and the registry still has it. The bytes the registry already has
+// are read from reader, so they are accounted for in its digest, and are not
+// sent again. Returns the upload location and the offset to continue from, an
+// empty location if the upload has to be started over.
+func (c *ChunkedUploader) resume(
+	ctx context.Context, reader io.Reader, expected digest.Digest, size int64,
+) (string, int64, error) {
+	if expected == "" {
+		return "", 0, nil
+	}
+	location := c.progress.ResumeLocation(expected.String())
+	if location == "" {
+		return "", 0, nil
+	}
+
+	location, received, err := c.status(ctx, location)
+	if err != nil {
+		klog.V(2).Infof("unable to resume upload of %s, restarting: %s", expected, err)
+		return "", 0, nil
+	}
+	if received <= 0 || (size >= 0 && received > size) {
+		return "", 0, nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, received); err != nil {
+		return "", 0, fmt.Errorf("error skipping %d uploaded bytes: %w", received, err)
+	}
+
+	klog.V(2).Infof("resuming upload of %s at %d", expected, received)
+	c.progress.Uploaded(expected.String(), location, received, size, true)
+	return location, received, nil
+}
+
+// Upload uploads the content read from stream to the repository. Expected
+// is the blob digest, if known, and size its size or -1 if unknown. Only one
+// chunk is kept in memory, the upload waits for it to fit in the budget.
+func (c *ChunkedUploader) Upload(
+	ctx context.Context, repo string, stream io.Reader, expected digest.Digest, size int64,
+) (types.BlobInfo, error) {
+	// small blobs, such as configs, don't need a whole chunk.
+	bufsize := c.chunk
+	if size >= 0 && size < bufsize {
+		bufsize = size
+	}
+	if bufsize == 0 {
+		bufsize = 1
+	}
+	if c.budget != nil {
+		if err := c.budget.Acquire(ctx, bufsize); err != nil {
+			return types.BlobInfo{}, err
+		}
+		defer c.budget.Release(bufsize)
+	}
+
+	digester := digest.Canonical.Digester()
+	reader := io.TeeReader(stream, digester.Hash())
+	location, offset, err := c.resume(ctx, reader, expected, size)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	if location == "" {
+		if location, err = c.start(ctx, repo); err != nil {
+			return types.BlobInfo{}, err
+		}
+	}
+
+	key := expected.String()
+	if expected == "" {
+		key = location
+	}
+	c.progress.Uploaded(key, location, offset, size, false)
+
+	buf := make([]byte, bufsize)
+	for {
+		n, rerr := io.ReadFull(reader, buf)
+		if n > 0 {
+			if location, err = c.sendChunk(
+				ctx, location, buf[:n], offset, key, size,
+			); err != nil {
+				return types.BlobInfo{}, err
+			}
+			offset += int64(n)
+			c.progress.Uploaded(key, location, offset, size, false)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return types.BlobInfo{}, rerr
+		}
+	}
+
+	dgst := digester.Digest()
+	if expected != "" && expected != dgst {
+		return types.BlobInfo{}, fmt.Errorf("digest mismatch: %s != %s", expected, dgst)
+	}
+	if err := c.finish(ctx, location, dgst); err != nil {
+		return types.BlobInfo{}, err
+	}
+	return types.BlobInfo{Digest: dgst, Size: offset}, nil
+}
+
+// ImageReference wraps provided image reference so blobs written to its image
+// destinations are uploaded in resumable chunks.
+func (c *ChunkedUploader) ImageReference(ref types.ImageReference) types.ImageReference {
+	return &chunkedReference{
+		ImageReference: ref,
+		uploader:       c,
+	}
+}
+
+// chunkedReference is an image reference whose destinations upload blobs in
+// chunks.
+type chunkedReference struct {
+	types.ImageReference
+	uploader *ChunkedUploader
+}
+
+// NewImageDestination returns an image destination uploading blobs in chunks.
+func (r *chunkedReference) NewImageDestination(
+	ctx context.Context, sys *types.SystemContext,
+) (types.ImageDestination, error) {
+	dst, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	named := r.ImageReference.DockerReference()
+	if named == nil {
+		return nil, fmt.Errorf("reference is not a docker reference")
+	}
+	return &chunkedDestination{
+		ImageDestination: dst,
+		uploader:         r.uploader,
+		repo:             reference.Path(named),
+	}, nil
+}
+
+// chunkedDestination is an image destination that uploads blobs in chunks.
+type chunkedDestination struct {
+	types.ImageDestination
+	uploader *ChunkedUploader
+	repo     string
+}
+
+// PutBlob uploads the blob in resumable chunks.
+func (d *chunkedDestination) PutBlob(
+	ctx context.Context,
+	stream io.Reader,
+	info types.BlobInfo,
+	cache types.BlobInfoCache,
+	isConfig bool,
+) (types.BlobInfo, error) {
+	return d.uploader.Upload(ctx, d.repo, stream, info.Digest, info.Size)
+}
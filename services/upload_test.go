@@ -0,0 +1,293 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// uploadRegistry implements the registry chunked upload protocol. Failing
+// chunks are only partially stored before failing the request, lost ones are
+// fully stored before failing it. Requests without the required headers are
+// refused.
+type uploadRegistry struct {
+	sync.Mutex
+	data     []byte
+	blobs    map[string][]byte
+	failures int
+	lost     int
+	token    string
+	patches  int
+	requires http.Header
+}
+
+func (u *uploadRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.Lock()
+	defer u.Unlock()
+
+	for name := range u.requires {
+		if r.Header.Get(name) != u.requires.Get(name) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.URL.Path == "/v2/" {
+		return
+	}
+
+	if r.URL.Path == "/token" {
+		fmt.Fprintf(w, `{"token": %q}`, u.token)
+		return
+	}
+
+	if u.token != "" && r.Header.Get("Authorization") != "Bearer "+u.token {
+		scheme := "https"
+		if r.TLS == nil {
+			scheme = "http"
+		}
+		w.Header().Set(
+			"WWW-Authenticate",
+			fmt.Sprintf(`Bearer realm="%s://%s/token",service="registry"`, scheme, r.Host),
+		)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	location := "/v2/repo/blobs/uploads/uuid"
+	switch r.Method {
+	case http.MethodPost:
+		u.data = nil
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		u.patches++
+		var start, end int
+		fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end)
+		if start != len(u.data) || end < start {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if u.lost > 0 {
+			u.lost--
+			u.data = append(u.data, body...)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if u.failures > 0 {
+			u.failures--
+			u.data = append(u.data, body[:len(body)/2]...)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		u.data = append(u.data, body...)
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodGet:
+		w.Header().Set("Location", location)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(u.data)-1))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPut:
+		dgst := r.URL.Query().Get("digest")
+		if digest.FromBytes(u.data).String() != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		u.blobs[dgst] = u.data
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestChunkedUploaderUpload(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 1000))
+	for _, tt := range []struct {
+		name     string
+		failures int
+		lost     int
+		retries  int
+		token    string
+		agent    string
+		plain    bool
+		secure   bool
+		expected digest.Digest
+		previous int
+		resumes  int
+		patches  int
+		err      string
+	}{
+		{
+			name: "upload without failures",
+		},
+		{
+			name:     "resumed upload",
+			failures: 2,
+			retries:  3,
+			resumes:  2,
+		},
+		{
+			name:    "chunk stored but answer lost",
+			lost:    1,
+			retries: 1,
+			resumes: 1,
+			patches: 10,
+		},
+		{
+			name:     "too many failures",
+			failures: 2,
+			retries:  1,
+			err:      "unexpected status sending chunk",
+		},
+		{
+			name:  "bearer token",
+			token: "secret",
+		},
+		{
+			name:  "user agent",
+			token: "secret",
+			agent: "tagger/1.0",
+		},
+		{
+			name:  "plain http registry",
+			plain: true,
+		},
+		{
+			name:  "plain http registry with bearer token",
+			plain: true,
+			token: "secret",
+		},
+		{
+			name:   "plain http registry without skipping verification",
+			plain:  true,
+			secure: true,
+			err:    "error pinging registry",
+		},
+		{
+			name:     "resumed from previous import",
+			expected: digest.FromBytes(data),
+			previous: 4500,
+			resumes:  1,
+			patches:  6,
+		},
+		{
+			name:     "digest mismatch",
+			expected: digest.FromString("other content"),
+			err:      "digest mismatch",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := &uploadRegistry{
+				blobs:    map[string][]byte{},
+				failures: tt.failures,
+				lost:     tt.lost,
+				token:    tt.token,
+				requires: http.Header{},
+			}
+			if tt.previous > 0 {
+				registry.data = append([]byte{}, data[:tt.previous]...)
+			}
+			if tt.agent != "" {
+				registry.requires.Set("User-Agent", tt.agent)
+			}
+			server := httptest.NewUnstartedServer(registry)
+			if tt.plain {
+				server.Start()
+			} else {
+				server.StartTLS()
+			}
+			defer server.Close()
+
+			insecure := types.OptionalBoolTrue
+			if tt.secure {
+				insecure = types.OptionalBoolFalse
+			}
+
+			var uploads []imagtagv1.BlobUpload
+			progress := NewImportProgress(
+				0,
+				func(u []imagtagv1.BlobUpload, _ imagtagv1.CopyProgress) {
+					uploads = u
+				},
+			)
+
+			uploader := NewChunkedUploader(
+				server.Listener.Addr().String(),
+				&types.SystemContext{
+					DockerInsecureSkipTLSVerify: insecure,
+					DockerRegistryUserAgent:     tt.agent,
+				},
+				1024,
+				tt.retries,
+			).WithProgress(progress)
+			uploader.backoff = time.Millisecond
+			if tt.previous > 0 {
+				progress.Resume([]imagtagv1.BlobUpload{
+					{
+						Digest:   tt.expected.String(),
+						Location: server.URL + "/v2/repo/blobs/uploads/uuid",
+					},
+				})
+			}
+			budget := NewMemoryBudget()
+			uploader.WithBudget(budget)
+
+			info, err := uploader.Upload(
+				context.Background(),
+				"repo",
+				bytes.NewReader(data),
+				tt.expected,
+				int64(len(data)),
+			)
+			progress.Close()
+			if inuse, _ := budget.usage(); inuse != 0 {
+				t.Errorf("expected budget to be released, %d bytes in use", inuse)
+			}
+			if err != nil {
+				if len(tt.err) == 0 {
+					t.Errorf("unexpected error: %s", err)
+				} else if !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expecting %q, %q received instead", tt.err, err)
+				}
+				return
+			} else if len(tt.err) > 0 {
+				t.Errorf("expecting error %q, nil received instead", tt.err)
+				return
+			}
+
+			dgst := digest.FromBytes(data)
+			if info.Digest != dgst || info.Size != int64(len(data)) {
+				t.Errorf("unexpected blob info: %+v", info)
+			}
+			if !bytes.Equal(registry.blobs[dgst.String()], data) {
+				t.Errorf("blob content mismatch")
+			}
+			if len(uploads) != 1 {
+				t.Fatalf("expected 1 upload in progress, %d found", len(uploads))
+			}
+			if uploads[0].Uploaded != int64(len(data)) {
+				t.Errorf("expected %d bytes uploaded: %+v", len(data), uploads[0])
+			}
+			if uploads[0].Resumes != tt.resumes {
+				t.Errorf("expected %d resumes: %+v", tt.resumes, uploads[0])
+			}
+			if uploads[0].Location == "" {
+				t.Errorf("expected upload location: %+v", uploads[0])
+			}
+			if tt.patches > 0 && registry.patches != tt.patches {
+				t.Errorf("expected %d chunks sent, %d sent", tt.patches, registry.patches)
+			}
+		})
+	}
+}
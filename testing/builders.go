@@ -0,0 +1,76 @@
+package testing
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// TagOption customizes a Tag built by NewTag.
+type TagOption func(*imagtagv1.Tag)
+
+// NewTag returns a Tag with the provided namespace and name, customized by
+// the provided options.
+func NewTag(namespace, name string, opts ...TagOption) *imagtagv1.Tag {
+	it := &imagtagv1.Tag{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+	for _, opt := range opts {
+		opt(it)
+	}
+	return it
+}
+
+// WithFrom sets the image the Tag imports from.
+func WithFrom(from string) TagOption {
+	return func(it *imagtagv1.Tag) {
+		it.Spec.From = from
+	}
+}
+
+// WithCache flags the Tag to be cached in the mirror registry.
+func WithCache() TagOption {
+	return func(it *imagtagv1.Tag) {
+		it.Spec.Cache = true
+	}
+}
+
+// WithGeneration sets the Tag spec generation.
+func WithGeneration(gen int64) TagOption {
+	return func(it *imagtagv1.Tag) {
+		it.Spec.Generation = gen
+	}
+}
+
+// WithImported adds an imported reference for generation gen pointing to
+// imgref, as if the import succeeded. The status generation is updated if
+// gen matches the spec generation.
+func WithImported(gen int64, imgref string) TagOption {
+	return func(it *imagtagv1.Tag) {
+		it.PrependHashReference(
+			imagtagv1.HashReference{
+				Generation:     gen,
+				From:           it.Spec.From,
+				ImportedAt:     metav1.NewTime(time.Now()),
+				ImageReference: imgref,
+			},
+		)
+		if gen == it.Spec.Generation {
+			it.Status.Generation = gen
+			it.RegisterImportSuccess()
+		}
+	}
+}
+
+// WithImportFailure registers a failed import attempt with provided message.
+func WithImportFailure(msg string) TagOption {
+	return func(it *imagtagv1.Tag) {
+		it.RegisterImportFailure(fmt.Errorf("%s", msg))
+	}
+}
@@ -0,0 +1,5 @@
+// Package testing provides fakes, builders and helpers for unit testing code
+// that interacts with Tags, e.g. operators consuming the Tag API or custom
+// webhook receivers. Fakes implement the abstractions defined by the
+// controllers package so they can be handed over to controller constructors.
+package testing
@@ -0,0 +1,96 @@
+package testing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	coreinf "k8s.io/client-go/informers"
+	corecli "k8s.io/client-go/kubernetes"
+	corefake "k8s.io/client-go/kubernetes/fake"
+
+	tagcli "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned"
+	tagfake "github.com/ricardomaraschini/tagger/imagetags/generated/clientset/versioned/fake"
+	taginf "github.com/ricardomaraschini/tagger/imagetags/generated/informers/externalversions"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// Environment holds fake clients and informers for both Kubernetes core and
+// Tag objects. It allows code built on top of clients and listers, such as
+// the services package, to be tested without an api server.
+type Environment struct {
+	CoreClient    corecli.Interface
+	TagClient     tagcli.Interface
+	CoreInformers coreinf.SharedInformerFactory
+	TagInformers  taginf.SharedInformerFactory
+}
+
+// NewEnvironment returns an Environment whose clients are populated with the
+// provided objects. Tags go to the Tag client, everything else goes to the
+// core client. Informers are not started, see Start.
+func NewEnvironment(objects ...runtime.Object) *Environment {
+	var core, tags []runtime.Object
+	for _, obj := range objects {
+		if _, ok := obj.(*imagtagv1.Tag); ok {
+			tags = append(tags, obj)
+			continue
+		}
+		core = append(core, obj)
+	}
+
+	corecli := corefake.NewSimpleClientset(core...)
+	tagcli := tagfake.NewSimpleClientset(tags...)
+	return &Environment{
+		CoreClient:    corecli,
+		TagClient:     tagcli,
+		CoreInformers: coreinf.NewSharedInformerFactory(corecli, time.Minute),
+		TagInformers:  taginf.NewSharedInformerFactory(tagcli, time.Minute),
+	}
+}
+
+// Start starts all informers requested so far and waits for their caches to
+// sync. Informers must be requested (e.g. by calling Lister()) before Start
+// is called. Informers stop when ctx is done.
+func (e *Environment) Start(ctx context.Context) error {
+	e.CoreInformers.Start(ctx.Done())
+	e.TagInformers.Start(ctx.Done())
+
+	for typ, synced := range e.CoreInformers.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("timeout waiting for %s cache", typ)
+		}
+	}
+	for typ, synced := range e.TagInformers.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("timeout waiting for %s cache", typ)
+		}
+	}
+	return nil
+}
+
+// WaitForTag waits until the Tag lister has a Tag with provided namespace and
+// name for which cond returns true. Returns an error if ctx is done first.
+func (e *Environment) WaitForTag(
+	ctx context.Context, namespace, name string, cond func(*imagtagv1.Tag) bool,
+) error {
+	lister := e.TagInformers.Images().V1().Tags().Lister()
+	return wait(ctx, func() bool {
+		it, err := lister.Tags(namespace).Get(name)
+		return err == nil && cond(it)
+	})
+}
+
+// wait polls cond until it returns true or ctx is done.
+func wait(ctx context.Context, cond func() bool) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !cond() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
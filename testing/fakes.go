@@ -0,0 +1,84 @@
+package testing
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+// TagUpdater is a fake implementation of controllers.TagUpdater. It records
+// a copy of every updated Tag. If Err is set it is returned by Update.
+type TagUpdater struct {
+	sync.Mutex
+	Err     error
+	updates []*imagtagv1.Tag
+}
+
+// Update records a copy of the provided Tag.
+func (t *TagUpdater) Update(ctx context.Context, it *imagtagv1.Tag) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.Err != nil {
+		return t.Err
+	}
+	t.updates = append(t.updates, it.DeepCopy())
+	return nil
+}
+
+// Updates returns all updated Tags, in the order they were updated.
+func (t *TagUpdater) Updates() []*imagtagv1.Tag {
+	t.Lock()
+	defer t.Unlock()
+	return append([]*imagtagv1.Tag(nil), t.updates...)
+}
+
+// Last returns the last update for the Tag with provided namespace and name
+// or nil if the Tag has never been updated.
+func (t *TagUpdater) Last(namespace, name string) *imagtagv1.Tag {
+	t.Lock()
+	defer t.Unlock()
+	for i := len(t.updates) - 1; i >= 0; i-- {
+		it := t.updates[i]
+		if it.Namespace == namespace && it.Name == name {
+			return it
+		}
+	}
+	return nil
+}
+
+// TagGenerationUpdater is a fake implementation of the interface with the
+// same name in the controllers package. It records every image reference
+// it receives. If Err is set it is returned by NewGenerationForImageRef.
+type TagGenerationUpdater struct {
+	sync.Mutex
+	Err       error
+	imageRefs []string
+}
+
+// NewGenerationForImageRef records the provided image reference.
+func (t *TagGenerationUpdater) NewGenerationForImageRef(
+	ctx context.Context, imgpath string,
+) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.Err != nil {
+		return t.Err
+	}
+	t.imageRefs = append(t.imageRefs, imgpath)
+	return nil
+}
+
+// ImageRefs returns all image references received so far.
+func (t *TagGenerationUpdater) ImageRefs() []string {
+	t.Lock()
+	defer t.Unlock()
+	return append([]string(nil), t.imageRefs...)
+}
+
+// String returns a summary of the received image references, useful in test
+// failure messages.
+func (t *TagGenerationUpdater) String() string {
+	return fmt.Sprintf("%v", t.ImageRefs())
+}
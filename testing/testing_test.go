@@ -0,0 +1,118 @@
+package testing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ricardomaraschini/tagger/controllers"
+	imagtagv1 "github.com/ricardomaraschini/tagger/imagetags/v1"
+)
+
+var (
+	_ controllers.TagUpdater           = &TagUpdater{}
+	_ controllers.TagGenerationUpdater = &TagGenerationUpdater{}
+)
+
+func TestNewTag(t *testing.T) {
+	it := NewTag(
+		"namespace",
+		"name",
+		WithFrom("centos:latest"),
+		WithCache(),
+		WithGeneration(1),
+		WithImported(0, "centos@sha256:a"),
+		WithImported(1, "centos@sha256:b"),
+	)
+	if it.Namespace != "namespace" || it.Name != "name" {
+		t.Errorf("unexpected object meta: %+v", it.ObjectMeta)
+	}
+	if !it.Spec.Cache || it.Spec.From != "centos:latest" {
+		t.Errorf("unexpected spec: %+v", it.Spec)
+	}
+	if it.Status.Generation != 1 || len(it.Status.References) != 2 {
+		t.Fatalf("unexpected status: %+v", it.Status)
+	}
+	if it.Status.References[0].ImageReference != "centos@sha256:b" {
+		t.Errorf("unexpected current reference: %+v", it.Status.References[0])
+	}
+	if !it.Status.LastImportAttempt.Succeed {
+		t.Errorf("last import should have succeeded")
+	}
+
+	it = NewTag("namespace", "name", WithImportFailure("boom"))
+	if it.Status.LastImportAttempt.Succeed || it.Status.LastImportAttempt.Reason != "boom" {
+		t.Errorf("unexpected import attempt: %+v", it.Status.LastImportAttempt)
+	}
+}
+
+func TestFakes(t *testing.T) {
+	ctx := context.Background()
+
+	updater := &TagUpdater{}
+	it := NewTag("namespace", "name")
+	if err := updater.Update(ctx, it); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	it.Spec.Generation = 1
+	if err := updater.Update(ctx, it); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(updater.Updates()) != 2 {
+		t.Errorf("expected 2 updates, %d found", len(updater.Updates()))
+	}
+	if last := updater.Last("namespace", "name"); last.Spec.Generation != 1 {
+		t.Errorf("unexpected last update: %+v", last)
+	}
+	if last := updater.Last("namespace", "other"); last != nil {
+		t.Errorf("unexpected update: %+v", last)
+	}
+
+	updater.Err = fmt.Errorf("failure")
+	if err := updater.Update(ctx, it); err == nil {
+		t.Errorf("expected error, nil received")
+	}
+
+	genupdater := &TagGenerationUpdater{}
+	if err := genupdater.NewGenerationForImageRef(ctx, "centos:latest"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if refs := genupdater.ImageRefs(); len(refs) != 1 || refs[0] != "centos:latest" {
+		t.Errorf("unexpected image references: %s", genupdater)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	env := NewEnvironment(NewTag("namespace", "name", WithFrom("centos:latest")))
+	env.TagInformers.Images().V1().Tags().Lister()
+	if err := env.Start(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	it, err := env.TagClient.ImagesV1().Tags("namespace").Get(
+		ctx, "name", metav1.GetOptions{},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	it.Spec.Generation = 1
+	if _, err := env.TagClient.ImagesV1().Tags("namespace").Update(
+		ctx, it, metav1.UpdateOptions{},
+	); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := env.WaitForTag(
+		ctx, "namespace", "name", func(it *imagtagv1.Tag) bool {
+			return it.Spec.Generation == 1
+		},
+	); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
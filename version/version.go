@@ -0,0 +1,41 @@
+// Package version holds build information embedded into tagger binaries at
+// link time, see Makefile for details on how these are populated.
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// These variables are set during build through -ldflags "-X ...".
+var (
+	Version   = "devel"
+	GitSHA    = "unknown"
+	BuildDate = "unknown"
+)
+
+// Info gathers build information about the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"gitSHA"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build information for the running binary.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		GitSHA:    GitSHA,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// String returns a human readable representation of the build information.
+func (i Info) String() string {
+	return fmt.Sprintf(
+		"%s (git sha %s, built on %s with %s)",
+		i.Version, i.GitSHA, i.BuildDate, i.GoVersion,
+	)
+}